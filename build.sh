@@ -15,6 +15,13 @@ echo "build..."
 go build -ldflags "-s -w" ./cmd/sshx
 go build -ldflags "-s -w" ./cmd/signaling
 echo "$1"
+if [ "$1" = "web" ];then
+  # the browser client, served by the signaling server with SSHX_SIGNALING_WEB=./web
+  mkdir -p ./web
+  GOOS=js GOARCH=wasm go build -ldflags "-s -w" -o ./web/sshx.wasm ./cmd/web
+  cp "$(go env GOROOT)/misc/wasm/wasm_exec.js" ./web/ 2>/dev/null || cp "$(go env GOROOT)/lib/wasm/wasm_exec.js" ./web/
+  cp ./cmd/web/index.html ./web/
+fi
 if [ "$1" = "install" ];then
   echo "build for ${platform}"
   if [ "$platform" = "Linux" ];then
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/e2e"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	// DIRECTORY_CLOCK_SKEW bounds the difference between the time an entry
+	// was signed and the clock of the server
+	DIRECTORY_CLOCK_SKEW = 10 * time.Minute
+	// DIRECTORY_MAX_RESULTS bounds the entries of a search
+	DIRECTORY_MAX_RESULTS = 500
+)
+
+// Directory is the optional peer directory of the server. Devices register
+// their name, owner, tags and capabilities, signed by their node key, and
+// search the entries of their tenant. The key an ID registers with is kept
+// while its entry is refreshed, an entry is only replaced by one signed with
+// the same key until it expires.
+type Directory struct {
+	lock sync.Mutex
+	// entries are keyed by the queue name of the device, so tenants only
+	// see their own devices
+	entries map[string]types.DirectoryEntry
+	// file keeps the entries across restarts, if set
+	file string
+	// ttl hides the entries not refreshed for that long and frees their ID
+	// for another key
+	ttl time.Duration
+	// max bounds the entries
+	max int
+}
+
+// NewDirectory creates the directory, loading the entries of file if it is
+// set
+func NewDirectory(file string, ttl time.Duration, max int) (*Directory, error) {
+	d := &Directory{
+		entries: make(map[string]types.DirectoryEntry),
+		file:    file,
+		ttl:     ttl,
+		max:     max,
+	}
+	if file == "" {
+		return d, nil
+	}
+	bs, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, json.Unmarshal(bs, &d.entries)
+}
+
+// save writes the entries to the file of the directory, the lock is held
+func (d *Directory) save() error {
+	if d.file == "" {
+		return nil
+	}
+	bs, err := json.Marshal(d.entries)
+	if err != nil {
+		return err
+	}
+	tmp := d.file + ".new"
+	err = ioutil.WriteFile(tmp, bs, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.file)
+}
+
+// validateEntry checks the entry is signed by its node key, recent, and not
+// over the limits
+func validateEntry(e *types.DirectoryEntry) bool {
+	if len(e.NodeKey) != ed25519.PublicKeySize || len(e.ID) == 0 || len(e.ID) > types.MAX_ID_LENGTH {
+		return false
+	}
+	if len(e.Tags) > types.MAX_DIRECTORY_TAGS || len(e.Capabilities) > types.MAX_DIRECTORY_TAGS {
+		return false
+	}
+	skew := time.Since(time.Unix(e.Updated, 0))
+	if skew > DIRECTORY_CLOCK_SKEW || skew < -DIRECTORY_CLOCK_SKEW {
+		return false
+	}
+	return ed25519.Verify(e.NodeKey, e2e.DirectoryDigest(e), e.Signature)
+}
+
+// expired tells if e was not refreshed within the TTL of the directory
+func (d *Directory) expired(e *types.DirectoryEntry) bool {
+	return d.ttl > 0 && time.Since(time.Unix(e.Updated, 0)) > d.ttl
+}
+
+// Put registers, replaces or removes the entry of the device queued as
+// key, it returns the HTTP status of the answer
+func (d *Directory) Put(key string, e types.DirectoryEntry) int {
+	if !validateEntry(&e) {
+		return http.StatusBadRequest
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	old, ok := d.entries[key]
+	if ok && d.expired(&old) {
+		delete(d.entries, key)
+		ok = false
+	}
+	if !ok && len(d.entries) >= d.max {
+		for k, v := range d.entries {
+			if d.expired(&v) {
+				delete(d.entries, k)
+			}
+		}
+	}
+	if ok && string(old.NodeKey) != string(e.NodeKey) {
+		return http.StatusForbidden
+	}
+	if ok && e.Updated <= old.Updated {
+		return http.StatusConflict
+	}
+	if !ok && e.Removed {
+		return http.StatusOK
+	}
+	if !ok && len(d.entries) >= d.max {
+		return http.StatusInsufficientStorage
+	}
+	if e.Removed {
+		delete(d.entries, key)
+	} else {
+		d.entries[key] = e
+	}
+	err := d.save()
+	if err != nil {
+		logrus.Error("save directory: ", err)
+	}
+	return http.StatusOK
+}
+
+// Search returns the entries queued under prefix which q selects, by name,
+// at most limit of them
+func (d *Directory) Search(prefix string, q types.DirectoryQuery, limit int) []types.DirectoryEntry {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	ret := make([]types.DirectoryEntry, 0)
+	for k, e := range d.entries {
+		if !strings.HasPrefix(k, prefix) || strings.Contains(k[len(prefix):], "/") {
+			continue
+		}
+		if d.expired(&e) {
+			continue
+		}
+		if q.Match(&e) {
+			ret = append(ret, e)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Name != ret[j].Name {
+			return ret[i].Name < ret[j].Name
+		}
+		return ret[i].ID < ret[j].ID
+	})
+	if len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret
+}
+
+// register handles the entries devices put under /directory/{id}
+func (sv *Server) register() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		key, ok := sv.queue(r, id)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		var e types.DirectoryEntry
+		err := json.NewDecoder(&types.LimitedReader{R: r.Body, N: types.MAX_DIRECTORY_ENTRY}).Decode(&e)
+		if err != nil || e.ID != id {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		status := sv.dir.Put(key, e)
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		logrus.Debug("directory entry of ", id, " removed: ", e.Removed)
+	})
+}
+
+// search answers the entries of the tenant of the request selected by the
+// q, owner, tag and cap parameters, tag and cap may be repeated
+func (sv *Server) search() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix, ok := sv.queue(r, "")
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		v := r.URL.Query()
+		q := types.DirectoryQuery{
+			Text:         v.Get("q"),
+			Owner:        v.Get("owner"),
+			Tags:         v["tag"],
+			Capabilities: v["cap"],
+		}
+		limit, err := strconv.Atoi(v.Get("limit"))
+		if err != nil || limit <= 0 || limit > DIRECTORY_MAX_RESULTS {
+			limit = DIRECTORY_MAX_RESULTS
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(sv.dir.Search(prefix, q, limit))
+		if err != nil {
+			logrus.Debug("directory search: ", err)
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/suutaku/sshx/internal/e2e"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// signedEntry returns an entry of id signed now by a new node key
+func signedEntry(t *testing.T, id string) types.DirectoryEntry {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := types.DirectoryEntry{
+		ID:      id,
+		Name:    id,
+		NodeKey: pub,
+		Updated: time.Now().Unix(),
+	}
+	e.Signature = ed25519.Sign(priv, e2e.DirectoryDigest(&e))
+	return e
+}
+
+func TestDirectoryKeyExpiry(t *testing.T) {
+	d, err := NewDirectory("", time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := signedEntry(t, "alice")
+	if status := d.Put("tenant/alice", first); status != http.StatusOK {
+		t.Fatalf("first registration answered %d", status)
+	}
+	second := signedEntry(t, "alice")
+	if status := d.Put("tenant/alice", second); status != http.StatusForbidden {
+		t.Fatalf("registration with another key answered %d, want %d", status, http.StatusForbidden)
+	}
+	// the entry of the first key is not refreshed within the TTL
+	first.Updated = time.Now().Add(-2 * time.Minute).Unix()
+	d.entries["tenant/alice"] = first
+	if got := d.Search("tenant/", types.DirectoryQuery{}, 10); len(got) != 0 {
+		t.Fatalf("expired entry found: %v", got)
+	}
+	if status := d.Put("tenant/alice", second); status != http.StatusOK {
+		t.Fatalf("registration with another key after expiry answered %d", status)
+	}
+	if got := d.Search("tenant/", types.DirectoryQuery{}, 10); len(got) != 1 || string(got[0].NodeKey) != string(second.NodeKey) {
+		t.Fatalf("entry of the new key not found: %v", got)
+	}
+}
+
+func TestDirectoryFullOfExpired(t *testing.T) {
+	d, err := NewDirectory("", time.Minute, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := signedEntry(t, "alice")
+	old.Updated = time.Now().Add(-2 * time.Minute).Unix()
+	d.entries["tenant/alice"] = old
+	if status := d.Put("tenant/bob", signedEntry(t, "bob")); status != http.StatusOK {
+		t.Fatalf("registration in a directory full of expired entries answered %d", status)
+	}
+}
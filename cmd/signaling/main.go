@@ -2,6 +2,9 @@ package main
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/suutaku/sshx/internal/utils"
@@ -13,7 +16,33 @@ func main() {
 		port = "11095"
 	}
 
-	server := NewServer(port)
+	// Comma separated tenant tokens, peers without one are refused if set
+	var tokens []string
+	if v := os.Getenv("SSHX_SIGNALING_TOKENS"); v != "" {
+		tokens = strings.Split(v, ",")
+	}
+
+	// Peer directory, enabled by SSHX_DIRECTORY or a file keeping its
+	// entries, entries not refreshed for SSHX_DIRECTORY_TTL seconds are
+	// hidden
+	var dir *Directory
+	if file := os.Getenv("SSHX_DIRECTORY_FILE"); file != "" || os.Getenv("SSHX_DIRECTORY") != "" {
+		ttl, err := strconv.Atoi(os.Getenv("SSHX_DIRECTORY_TTL"))
+		if err != nil || ttl <= 0 {
+			ttl = 24 * 3600
+		}
+		max, err := strconv.Atoi(os.Getenv("SSHX_DIRECTORY_MAX"))
+		if err != nil || max <= 0 {
+			max = 100000
+		}
+		dir, err = NewDirectory(file, time.Duration(ttl)*time.Second, max)
+		if err != nil {
+			logrus.Fatal("directory: ", err)
+		}
+	}
+
+	// Directory of the browser client, see the web target of the makefile
+	server := NewServer(port, tokens, os.Getenv("SSHX_SIGNALING_WEB"), dir)
 
 	if utils.DebugOn() {
 		logrus.SetLevel(logrus.DebugLevel)
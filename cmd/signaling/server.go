@@ -3,7 +3,9 @@ package main
 import (
 	"encoding/gob"
 	"fmt"
+	"mime"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -14,17 +16,45 @@ import (
 // This server facilitates peer discovery and SDP exchange for WebRTC connections
 // It uses HTTP endpoints for peers to exchange offers/answers and ICE candidates
 type Server struct {
-	port string    // Port to listen on for HTTP requests
-	dm   *DManager // Data manager handles peer message queues and lifecycle
+	port   string          // Port to listen on for HTTP requests
+	dm     *DManager       // Data manager handles peer message queues and lifecycle
+	tokens map[string]bool // Tenant tokens accepted by the server, any peer if empty
+	web    string          // Directory of the browser client served under /web/, none if empty
+	dir    *Directory      // Peer directory of the devices, disabled if nil
 }
 
 // NewServer creates a new signaling server instance
 // port: The port number to bind the HTTP server to
-func NewServer(port string) *Server {
-	return &Server{
-		port: port,
-		dm:   NewDManager(), // Initialize data manager for peer messaging
+// tokens: The tenant tokens peers must give, peers of a tenant only reach each other
+// web: The directory of the browser client, sshx.wasm, wasm_exec.js and index.html
+// dir: The peer directory, nil to disable it
+func NewServer(port string, tokens []string, web string, dir *Directory) *Server {
+	sv := &Server{
+		port:   port,
+		web:    web,
+		dir:    dir,
+		dm:     NewDManager(), // Initialize data manager for peer messaging
+		tokens: make(map[string]bool),
 	}
+	for _, v := range tokens {
+		if v = strings.TrimSpace(v); v != "" {
+			sv.tokens[v] = true
+		}
+	}
+	return sv
+}
+
+// queue returns the queue name of a peer, prefixed by the tenant token of the
+// request. It returns false if the server requires a token the request lacks.
+func (sv *Server) queue(r *http.Request, id string) (string, bool) {
+	if len(sv.tokens) == 0 {
+		return id, true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !sv.tokens[token] {
+		return "", false
+	}
+	return token + "/" + id, true
 }
 
 // Start launches the HTTP server with routing endpoints
@@ -43,6 +73,19 @@ func (sv *Server) Start() {
 	// target_id is the ID of the peer to receive the message
 	r.Handle("/push/{target_id}", sv.push())
 
+	// Routes of the peer directory, devices register their entry and
+	// search the ones of their tenant
+	if sv.dir != nil {
+		r.Handle("/directory/{id}", sv.register()).Methods(http.MethodPut)
+		r.Handle("/directory", sv.search()).Methods(http.MethodGet)
+	}
+
+	// Pages of the browser client, which signal through this server
+	if sv.web != "" {
+		mime.AddExtensionType(".wasm", "application/wasm")
+		r.PathPrefix("/web/").Handler(http.StripPrefix("/web/", http.FileServer(http.Dir(sv.web))))
+	}
+
 	// Register router with default HTTP handler
 	http.Handle("/", r)
 
@@ -57,17 +100,28 @@ func (sv *Server) Start() {
 func (sv *Server) pull() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		self_id := vars["self_id"] // Extract peer ID from URL path
+		self_id, ok := sv.queue(r, vars["self_id"]) // Extract peer ID from URL path
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
 		
 		// Non-blocking read from peer's message channel
 		select {
 		case v := <-sv.dm.Get(self_id):
 			// Message available - encode and send it
 			logrus.Debug("pull from ", self_id, v.Flag)
-			w.Header().Add("Content-Type", "application/binary")
-			
-			// Encode SignalingInfo as binary using gob
-			if err := gob.NewEncoder(w).Encode(v); err != nil {
+			// Encode SignalingInfo in the wire encoding for peers asking
+			// for it, older peers only decode gob
+			var err error
+			if strings.Contains(r.Header.Get("Accept"), types.WIRE_CONTENT_TYPE) {
+				w.Header().Add("Content-Type", types.WIRE_CONTENT_TYPE)
+				err = types.WriteSignalingInfo(w, &v)
+			} else {
+				w.Header().Add("Content-Type", "application/binary")
+				err = gob.NewEncoder(w).Encode(v)
+			}
+			if err != nil {
 				logrus.Error("binary encode failed:", err)
 				return
 			}
@@ -83,18 +137,26 @@ func (sv *Server) pull() http.Handler {
 // for the target peer to retrieve via pull requests
 func (sv *Server) push() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var info types.SignalingInfo
+		vars := mux.Vars(r)
+		target_id, ok := sv.queue(r, vars["target_id"]) // Extract target peer ID from URL path
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
 		
-		// Decode binary SignalingInfo from request body
-		if err := gob.NewDecoder(r.Body).Decode(&info); err != nil {
-			logrus.Error("binary decode failed:", err)
+		// Decode binary SignalingInfo from request body, refusing
+		// oversized or malformed messages before they are queued
+		info, err := types.DecodeSignalingInfo(r.Body)
+		if err == types.ErrTooLarge {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			logrus.Debug("binary decode failed:", err)
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
 		
-		vars := mux.Vars(r)
-		target_id := vars["target_id"] // Extract target peer ID from URL path
-		
 		// Queue message for target peer and reset their keepalive timer
 		sv.dm.Set(target_id, info)
 		logrus.Debug("push from ", info.Source, " to ", target_id, info.Flag)
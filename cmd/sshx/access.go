@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+// requestAccess sends an access request to the daemon
+func requestAccess(a *impl.Access) (*impl.AccessResult, error) {
+	cm, err := conf.NewConfManager(getRootPath())
+	if err != nil {
+		return nil, err
+	}
+	a.SetHostId(cm.Conf.ID)
+	return impl.RequestAccess(a)
+}
+
+func showAccessRules(res *impl.AccessResult) {
+	if !res.Enabled {
+		fmt.Println("access rules are disabled, set accessconf.enabled to apply them")
+	}
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"#", "Peers", "Applications", "Action", "Constraints"})
+	t.AppendSeparator()
+	for i, r := range res.Rules {
+		var constraints []string
+		if r.ReadOnly {
+			constraints = append(constraints, "read only")
+		}
+		if r.ViewOnly {
+			constraints = append(constraints, "view only")
+		}
+		t.AppendRows([]table.Row{{i, strings.Join(r.Peers, ","), strings.Join(r.Apps, ","), r.Action, strings.Join(constraints, ",")}})
+	}
+	t.AppendSeparator()
+	t.AppendRows([]table.Row{{"", "*", "*", res.Default, ""}})
+	t.Render()
+}
+
+func cmdAccessList(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		res, err := requestAccess(impl.NewAccess(""))
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if res.Error != "" {
+			logrus.Error(res.Error)
+			return
+		}
+		showAccessRules(res)
+	}
+}
+
+func cmdAccessAdd(cmd *cli.Cmd) {
+	cmd.Spec = "[-i] [--deny] [--read-only] [--view-only] PEERS APPS"
+	index := cmd.IntOpt("i index", -1, "insert the rule before the rule at index, at the end by default")
+	deny := cmd.BoolOpt("deny", false, "deny the sessions, they are allowed by default")
+	readOnly := cmd.BoolOpt("read-only", false, "refuse uploads of transfer and sync sessions")
+	viewOnly := cmd.BoolOpt("view-only", false, "drop the input of vnc sessions")
+	peers := cmd.StringArg("PEERS", "", "comma separated peer IDs, names, group:NAME or *")
+	apps := cmd.StringArg("APPS", "", "comma separated applications as ssh,vnc,transfer or *")
+	cmd.Action = func() {
+		a := impl.NewAccess("")
+		a.Op = impl.ACCESS_OP_ADD
+		a.Index = *index
+		a.Rule = conf.AccessRule{
+			Peers:    strings.Split(*peers, ","),
+			Apps:     strings.Split(*apps, ","),
+			Action:   conf.ACCESS_ALLOW,
+			ReadOnly: *readOnly,
+			ViewOnly: *viewOnly,
+		}
+		if *deny {
+			a.Rule.Action = conf.ACCESS_DENY
+		}
+		res, err := requestAccess(a)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if res.Error != "" {
+			logrus.Error(res.Error)
+			return
+		}
+		showAccessRules(res)
+	}
+}
+
+func cmdAccessRemove(cmd *cli.Cmd) {
+	cmd.Spec = "INDEX"
+	index := cmd.IntArg("INDEX", 0, "index of the rule, shown by 'sshx access list'")
+	cmd.Action = func() {
+		a := impl.NewAccess("")
+		a.Op = impl.ACCESS_OP_REMOVE
+		a.Index = *index
+		res, err := requestAccess(a)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if res.Error != "" {
+			logrus.Error(res.Error)
+			return
+		}
+		showAccessRules(res)
+	}
+}
+
+func cmdAccessCheck(cmd *cli.Cmd) {
+	cmd.Spec = "ADDR APP"
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	app := cmd.StringArg("APP", "", "application as ssh or vnc")
+	cmd.Action = func() {
+		a := impl.NewAccess("")
+		a.Op = impl.ACCESS_OP_CHECK
+		a.Peer = *addr
+		a.App = *app
+		res, err := requestAccess(a)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if res.Error != "" {
+			fmt.Println(res.Error)
+			return
+		}
+		fmt.Println(*app, "session of", *addr, "allowed")
+		if res.Rule.ReadOnly {
+			fmt.Println("read only")
+		}
+		if res.Rule.ViewOnly {
+			fmt.Println("view only")
+		}
+	}
+}
+
+func cmdAccess(cmd *cli.Cmd) {
+	cmd.Command("list", "show the access rules", cmdAccessList)
+	cmd.Command("add", "add an access rule", cmdAccessAdd)
+	cmd.Command("remove", "remove an access rule", cmdAccessRemove)
+	cmd.Command("check", "show whether a session of a peer is allowed", cmdAccessCheck)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+func cmdAudio(cmd *cli.Cmd) {
+	cmd.Spec = "[-p] ADDR"
+	parent := cmd.StringOpt("p parent", "", "pair id of a vnc or rdp session to attach the audio to")
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	cmd.Action = func() {
+		imp := impl.NewAudio(*addr)
+		imp.SetParentId(*parent)
+		err := imp.Preper(context.Background())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+		conn, err := sender.Send()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		imp.SetConn(conn)
+		defer imp.Close()
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt)
+		go func() {
+			<-c
+			imp.Close()
+		}()
+		err = imp.DoPlay()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// humanRate formats a throughput in bits per second
+func humanRate(bytesPerSecond float64) string {
+	bits := bytesPerSecond * 8
+	units := []string{"bit/s", "Kbit/s", "Mbit/s", "Gbit/s"}
+	i := 0
+	for bits >= 1000 && i < len(units)-1 {
+		bits /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.2f %s", bits, units[i])
+}
+
+func cmdBench(cmd *cli.Cmd) {
+	cmd.Spec = "[-n] [-t] [--json] ADDR"
+	pings := cmd.IntOpt("n pings", 20, "number of round trips measured")
+	seconds := cmd.IntOpt("t time", 5, "seconds of the upload and of the download, 60 at most")
+	asJSON := cmd.BoolOpt("json", false, "print the result as JSON")
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	cmd.Action = func() {
+		imp := impl.NewBench(*addr)
+		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+		conn, err := sender.Send()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		imp.SetConn(conn)
+		defer imp.Close()
+		res, err := imp.Run(*pings, time.Duration(*seconds)*time.Second)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if *asJSON {
+			bs, _ := json.MarshalIndent(res, "", "  ")
+			fmt.Println(string(bs))
+			return
+		}
+		fmt.Println("peer:    ", res.Peer)
+		fmt.Println("path:    ", res.Path)
+		fmt.Printf("rtt:      min %.2f ms, avg %.2f ms, max %.2f ms (%d pings)\n", res.RTTMin, res.RTTAvg, res.RTTMax, res.Pings)
+		fmt.Println("upload:  ", humanRate(res.UploadRate))
+		fmt.Println("download:", humanRate(res.DownloadRate))
+	}
+}
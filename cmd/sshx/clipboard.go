@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+func clipboardCommand(op int32) cli.CmdInitializer {
+	return func(cmd *cli.Cmd) {
+		cmd.Spec = "[-i] [-p] ADDR"
+		images := cmd.BoolOpt("i images", false, "also synchronize PNG images")
+		parent := cmd.StringOpt("p parent", "", "pair id of a ssh or vnc session to attach this clipboard to")
+		addr := cmd.StringArg("ADDR", "", "remote device id")
+		cmd.Action = func() {
+			imp := impl.NewClipboard(*addr, *images)
+			imp.SetParentId(*parent)
+			err := imp.Preper(context.Background())
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+			sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+			conn, err := sender.Send()
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+			imp.SetConn(conn)
+			defer imp.Close()
+			switch op {
+			case impl.CLIPBOARD_GET:
+				err = imp.DoGet()
+			case impl.CLIPBOARD_SET:
+				err = imp.DoSet()
+			case impl.CLIPBOARD_WATCH:
+				c := make(chan os.Signal, 1)
+				signal.Notify(c, os.Interrupt)
+				go func() {
+					<-c
+					imp.Close()
+				}()
+				err = imp.DoWatch()
+			}
+			if err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+}
+
+func cmdClipboard(cmd *cli.Cmd) {
+	cmd.Command("get", "copy clipboard of remote device to local clipboard", clipboardCommand(impl.CLIPBOARD_GET))
+	cmd.Command("set", "copy local clipboard to remote device", clipboardCommand(impl.CLIPBOARD_SET))
+	cmd.Command("sync", "keep local and remote clipboard in sync", clipboardCommand(impl.CLIPBOARD_WATCH))
+}
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
 
 	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/go-qrc/pkg/qrc"
 	"github.com/suutaku/sshx/pkg/conf"
 )
 
@@ -11,14 +19,23 @@ func cmdGetConfig(cmd *cli.Cmd) {
 	cmd.Spec = "[KEYS...]"
 	keys := cmd.StringsArg("KEYS", nil, "get cofigure by key [[key1] [key2]],[key1.key2]. if key is empty, list all configure info")
 	cmd.Action = func() {
-		cm := conf.NewConfManager(getRootPath())
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
 		if keys == nil || len(*keys) == 0 {
 			cm.Show()
 			return
 		}
 		for _, v := range *keys {
-			res := cm.Viper.Get(v)
-			fmt.Printf("%s:\t%#v\n", v, res)
+			res, err := cm.Get(v)
+			if err != nil {
+				logrus.Error(err)
+				continue
+			}
+			bs, _ := json.MarshalIndent(res, "", "  ")
+			fmt.Printf("%s:\t%s\n", v, bs)
 		}
 	}
 }
@@ -26,20 +43,175 @@ func cmdGetConfig(cmd *cli.Cmd) {
 func cmdSetConfig(cmd *cli.Cmd) {
 	cmd.Spec = "KEY VALUE"
 	key := cmd.StringArg("KEY", "", "configure key, [key] ]value], [key1.key2] [value]")
-	value := cmd.StringArg("VALUE", "", "configure value")
+	value := cmd.StringArg("VALUE", "", "configure value, structures and lists in JSON")
 	cmd.Action = func() {
-		cm := conf.NewConfManager(getRootPath())
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
 		if key == nil || *key == "" {
 			return
 		}
 		if value == nil || *value == "" {
 			return
 		}
-		cm.Set(*key, *value)
+		err = cm.SetString(*key, *value)
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdListICEServer(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"URLs", "Username"})
+		t.AppendSeparator()
+		for _, v := range cm.Conf.RTCConf.ICEServers {
+			t.AppendRows([]table.Row{
+				{strings.Join(v.URLs, "\n"), v.Username},
+			})
+		}
+		t.AppendSeparator()
+		t.Render()
+	}
+}
+
+func cmdAddICEServer(cmd *cli.Cmd) {
+	cmd.Spec = "[-u] [-c] URLS..."
+	username := cmd.StringOpt("u username", "", "username of a TURN server")
+	credential := cmd.StringOpt("c credential", "", "password of a TURN server")
+	urls := cmd.StringsArg("URLS", nil, "server URLs, like stun:stun.l.google.com:19302 or turn:turn.example.com:3478")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		server := webrtc.ICEServer{URLs: *urls, Username: *username}
+		if *credential != "" {
+			server.Credential = *credential
+		}
+		err = cm.AddICEServer(server)
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdRemoveICEServer(cmd *cli.Cmd) {
+	cmd.Spec = "URLS..."
+	urls := cmd.StringsArg("URLS", nil, "server URLs")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		for _, v := range *urls {
+			err = cm.RemoveICEServer(v)
+			if err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+}
+
+func cmdICEServer(cmd *cli.Cmd) {
+	cmd.Command("list", "list ICE servers", cmdListICEServer)
+	cmd.Command("add", "add a STUN or TURN server", cmdAddICEServer)
+	cmd.Command("remove rm", "remove ICE server URLs", cmdRemoveICEServer)
+}
+
+func cmdExportBundle(cmd *cli.Cmd) {
+	cmd.Spec = "[-n] [-o] [-q] [--turn]"
+	name := cmd.StringOpt("n name", "", "name of this device on the new one, the host name by default")
+	output := cmd.StringOpt("o output", "", "write the bundle to a file")
+	showQR := cmd.BoolOpt("q qrcode", false, "show the bundle as QR code")
+	withTURN := cmd.BoolOpt("turn", false, "include TURN servers and their credentials")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		text, err := cm.ExportBundle(*name, *withTURN).Encode()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if *output != "" {
+			err = ioutil.WriteFile(*output, []byte(text+"\n"), 0600)
+			if err != nil {
+				logrus.Error(err)
+			}
+			return
+		}
+		if *showQR {
+			qrc.ShowQR(text, false)
+			fmt.Println()
+			return
+		}
+		fmt.Println(text)
+	}
+}
+
+// readBundle returns the text of a bundle given as is, in a file or - for
+// standard input
+func readBundle(arg string) (string, error) {
+	var bs []byte
+	var err error
+	if arg == "-" {
+		bs, err = ioutil.ReadAll(os.Stdin)
+	} else if !strings.HasPrefix(arg, conf.BUNDLE_PREFIX) {
+		bs, err = ioutil.ReadFile(arg)
+	} else {
+		return arg, nil
+	}
+	return string(bs), err
+}
+
+func cmdImportBundle(cmd *cli.Cmd) {
+	cmd.Spec = "BUNDLE"
+	bundle := cmd.StringArg("BUNDLE", "", "bundle text, or a file holding it, - for standard input")
+	cmd.Action = func() {
+		text, err := readBundle(*bundle)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		b, err := conf.DecodeBundle(text)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		err = cm.ImportBundle(b)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Printf("joined %s (%s), restart the daemon to apply the signaling settings\n", b.Peer.Name, b.Peer.ID)
+		fmt.Println("this device is", cm.Conf.ID)
 	}
 }
 
 func cmdConfig(cmd *cli.Cmd) {
 	cmd.Command("set", "set configure with key value", cmdSetConfig)
 	cmd.Command("get", "get configure value with key", cmdGetConfig)
+	cmd.Command("ice", "manage STUN and TURN servers", cmdICEServer)
+	cmd.Command("export", "export a bundle for a new device to join this one", cmdExportBundle)
+	cmd.Command("import", "join the devices of an exported bundle", cmdImportBundle)
+	cmd.Command("remote", "manage the configure overlay of a managed fleet", cmdRemote)
 }
@@ -2,13 +2,54 @@ package main
 
 import (
 	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
 	"github.com/suutaku/sshx/internal/node"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
 )
 
 func cmdDaemon(cmd *cli.Cmd) {
+	cmd.Spec = "[--join]"
+	join := cmd.StringOpt("join", "", "join bundle with a token issued by 'sshx join token', or a file holding it, to provision this device")
 	cmd.Action = func() {
-		n := node.NewNode(getRootPath())
+		var bundle *conf.JoinBundle
+		if *join != "" {
+			cm, err := conf.NewConfManager(getRootPath())
+			if err == nil {
+				var text string
+				text, err = readBundle(*join)
+				if err == nil {
+					bundle, err = impl.PrepareJoin(cm, text)
+				}
+			}
+			if err != nil {
+				logrus.Error(err)
+				cli.Exit(1)
+			}
+		}
+		// a standby waits for the active daemon to fail
+		err := node.WaitStandby(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		n, err := node.NewNode(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
 		defer n.Stop()
-		n.Start()
+		if bundle != nil {
+			go func() {
+				err := impl.CompleteJoin(bundle)
+				if err != nil {
+					logrus.Error(err)
+				}
+			}()
+		}
+		err = n.Start()
+		if err != nil {
+			logrus.Error(err)
+		}
 	}
 }
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/jedib0t/go-pretty/v6/text"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/client"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// Panes of the dashboard
+const (
+	panePeers = iota
+	paneSessions
+	paneTransfers
+	paneApprovals
+	paneEvents
+)
+
+var paneNames = []string{"Peers", "Sessions", "Transfers", "Approvals", "Events"}
+
+const (
+	// dashboardEvents is the number of events the dashboard keeps
+	dashboardEvents = 200
+	// dashboardLANPoll is the interval of the polls of the devices of the
+	// local network, slower than the ones of the daemon
+	dashboardLANPoll = 10 * time.Second
+)
+
+// dashboardData is what a refresh of the dashboard got from the daemon
+type dashboardData struct {
+	at    time.Time
+	cm    *conf.ConfManager
+	conns []client.Connection
+	// err is set if the daemon didn't answer
+	err       error
+	transfers []types.TransferState
+	// transfersErr and knocksErr are the errors of the lists of the
+	// transfers and of the sessions waiting for approval
+	transfersErr error
+	knocks       []types.KnockRequest
+	knocksErr    error
+	// lan is set if the local network was polled
+	lan       []types.LANPeer
+	lanPolled bool
+}
+
+// dashboardPrompt asks for a value at the bottom of the dashboard
+type dashboardPrompt struct {
+	label string
+	value string
+	done  func(value string)
+}
+
+// peerRow is a device of the peers pane, of the address book, of the local
+// network or with sessions
+type peerRow struct {
+	id       string
+	name     string
+	lan      string
+	sessions int
+	in, out  float64
+}
+
+// dashboard shows the peers, sessions, transfers and events of the daemon
+// and acts on them
+type dashboard struct {
+	cm     *conf.ConfManager
+	client *client.Client
+	screen *screen
+	pane   int
+	// selected is the selected row of each pane
+	selected [5]int
+	data     dashboardData
+	lan      []types.LANPeer
+	lanAt    time.Time
+	// last are the bytes received and sent by the sessions at the previous
+	// refresh, rates their throughput since
+	last  map[string][2]int64
+	rates map[string][2]float64
+	// events are the events of the daemon, the newest first
+	events []types.Event
+	// proxies are the proxies started from the dashboard by pair ID, they
+	// stop with it
+	proxies map[string]*impl.Proxy
+	// prompt takes the keys while it is set
+	prompt  *dashboardPrompt
+	message string
+	// fatal ends the dashboard, as a terminal which can't be set raw
+	// again
+	fatal error
+}
+
+func newDashboard(cm *conf.ConfManager) (*dashboard, error) {
+	c, err := client.New(client.Options{Home: getRootPath()})
+	if err != nil {
+		return nil, err
+	}
+	return &dashboard{
+		cm:      cm,
+		client:  c,
+		screen:  newScreen(),
+		last:    make(map[string][2]int64),
+		rates:   make(map[string][2]float64),
+		proxies: make(map[string]*impl.Proxy),
+	}, nil
+}
+
+// fetchDashboard asks the daemon for its state, it runs beside the key
+// handling so it doesn't touch the dashboard
+func fetchDashboard(c *client.Client, id string, lan bool) dashboardData {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ret := dashboardData{at: time.Now()}
+	ret.cm, _ = conf.NewConfManager(getRootPath())
+	ret.conns, ret.err = c.ListConnections(ctx)
+	if ret.err != nil {
+		return ret
+	}
+	ret.transfers, ret.transfersErr = impl.ListTransfers()
+	ret.knocks, ret.knocksErr = impl.ListKnocks()
+	if lan {
+		ret.lan, _ = impl.RequestDiscoverContext(ctx, impl.NewDiscover(id))
+		ret.lanPolled = true
+	}
+	return ret
+}
+
+// apply shows data, the throughput of the sessions is the one since the
+// previous refresh
+func (d *dashboard) apply(data dashboardData) {
+	elapsed := data.at.Sub(d.data.at).Seconds()
+	last := make(map[string][2]int64, len(data.conns))
+	rates := make(map[string][2]float64, len(data.conns))
+	for _, v := range data.conns {
+		cur := [2]int64{v.BytesIn, v.BytesOut}
+		if prev, ok := d.last[v.ID]; ok && elapsed > 0 {
+			rates[v.ID] = [2]float64{
+				float64(cur[0]-prev[0]) / elapsed,
+				float64(cur[1]-prev[1]) / elapsed,
+			}
+		}
+		last[v.ID] = cur
+	}
+	d.last, d.rates = last, rates
+	if data.cm != nil {
+		d.cm = data.cm
+	}
+	if data.lanPolled {
+		d.lan = data.lan
+	}
+	d.data = data
+	d.clamp()
+}
+
+// addEvent adds an event of the stream in the order of their time, as the
+// daemon may send them a bit out of order. The last events sent again when
+// the stream is opened again are skipped.
+func (d *dashboard) addEvent(ev types.Event) {
+	i := 0
+	for i < len(d.events) && d.events[i].Time.After(ev.Time) {
+		i++
+	}
+	for j := i; j < len(d.events) && d.events[j].Time.Equal(ev.Time); j++ {
+		v := d.events[j]
+		if v.Kind == ev.Kind && v.PairId == ev.PairId && v.TargetId == ev.TargetId && v.App == ev.App && v.Message == ev.Message {
+			return
+		}
+	}
+	if i >= dashboardEvents {
+		return
+	}
+	d.events = append(d.events[:i], append([]types.Event{ev}, d.events[i:]...)...)
+	if len(d.events) > dashboardEvents {
+		d.events = d.events[:dashboardEvents]
+	}
+	if selected := d.selected[paneEvents]; selected > 0 && i <= selected {
+		// keep the selected event in place
+		d.selected[paneEvents]++
+	}
+	d.clamp()
+}
+
+// watchEvents sends the events of the daemon to out until ctx is done,
+// the stream is opened again if the daemon restarts
+func (d *dashboard) watchEvents(ctx context.Context, out chan<- types.Event) {
+	for {
+		ch, err := d.client.Events(ctx)
+		if err == nil {
+			for ev := range ch {
+				select {
+				case out <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (d *dashboard) peerRows() []peerRow {
+	var ret []peerRow
+	index := make(map[string]int)
+	add := func(id, name string) int {
+		if i, ok := index[id]; ok {
+			if ret[i].name == "" {
+				ret[i].name = name
+			}
+			return i
+		}
+		index[id] = len(ret)
+		ret = append(ret, peerRow{id: id, name: name})
+		return len(ret) - 1
+	}
+	for _, v := range d.cm.Conf.AddressBook {
+		add(v.ID, v.Name)
+	}
+	for _, v := range d.lan {
+		i := add(v.ID, v.Name)
+		ret[i].lan = "yes"
+		if len(v.Addrs) > 0 {
+			ret[i].lan = v.Addrs[0]
+		}
+	}
+	for _, v := range d.data.conns {
+		if v.Peer == "" || v.Peer == d.cm.Conf.ID {
+			continue
+		}
+		i := add(v.Peer, "")
+		ret[i].sessions++
+		ret[i].in += d.rates[v.ID][0]
+		ret[i].out += d.rates[v.ID][1]
+	}
+	return ret
+}
+
+// rows returns the number of rows of a pane
+func (d *dashboard) rows(pane int) int {
+	switch pane {
+	case panePeers:
+		return len(d.peerRows())
+	case paneSessions:
+		return len(d.data.conns)
+	case paneTransfers:
+		return len(d.data.transfers)
+	case paneApprovals:
+		return len(d.data.knocks)
+	case paneEvents:
+		return len(d.events)
+	}
+	return 0
+}
+
+// clamp keeps the selected rows in their panes
+func (d *dashboard) clamp() {
+	for i := range d.selected {
+		if n := d.rows(i); d.selected[i] >= n {
+			d.selected[i] = n - 1
+		}
+		if d.selected[i] < 0 {
+			d.selected[i] = 0
+		}
+	}
+}
+
+// table renders rows under header, scrolled to the selected row of the
+// pane, in height lines at most
+func (d *dashboard) table(header table.Row, rows []table.Row, width, height int) []string {
+	t := table.NewWriter()
+	t.SetStyle(table.StyleLight)
+	t.SetAllowedRowLength(width)
+	t.AppendHeader(append(table.Row{""}, header...))
+	// the borders and the header take 4 lines
+	visible := height - 4
+	if visible < 1 {
+		visible = 1
+	}
+	selected := d.selected[d.pane]
+	start := 0
+	if selected >= visible {
+		start = selected - visible + 1
+	}
+	for i := start; i < len(rows) && i < start+visible; i++ {
+		marker := ""
+		if i == selected {
+			marker = ">"
+		}
+		t.AppendRow(append(table.Row{marker}, rows[i]...))
+	}
+	t.SetRowPainter(func(row table.Row) text.Colors {
+		if len(row) > 0 && row[0] == ">" {
+			return text.Colors{text.ReverseVideo}
+		}
+		return nil
+	})
+	return strings.Split(t.Render(), "\n")
+}
+
+func (d *dashboard) body(width, height int) []string {
+	if d.data.err != nil {
+		return []string{"", "daemon: " + d.data.err.Error()}
+	}
+	var header table.Row
+	var rows []table.Row
+	switch d.pane {
+	case panePeers:
+		header = table.Row{"Name", "ID", "Local network", "Sessions", "In", "Out"}
+		for _, v := range d.peerRows() {
+			rows = append(rows, table.Row{v.name, v.id, v.lan, v.sessions, formatRate(v.in), formatRate(v.out)})
+		}
+	case paneSessions:
+		header = table.Row{"Pair ID", "Peer", "Application", "Time", "In", "Out", "Total"}
+		for _, v := range d.data.conns {
+			total := fmt.Sprintf("%s / %s", utils.FormatByteSize(v.BytesIn), utils.FormatByteSize(v.BytesOut))
+			rate := d.rates[v.ID]
+			rows = append(rows, table.Row{v.ID, d.cm.PeerName(v.Peer), v.App, time.Since(v.Started).Round(time.Second), formatRate(rate[0]), formatRate(rate[1]), total})
+		}
+	case paneTransfers:
+		if d.data.transfersErr != nil {
+			return []string{"", d.data.transfersErr.Error()}
+		}
+		header = table.Row{"Pair ID", "Peer", "File", "Direction", "Bytes", "State"}
+		for _, v := range d.data.transfers {
+			direction := "download"
+			if v.Upload {
+				direction = "upload"
+			}
+			rows = append(rows, table.Row{v.PairId, d.cm.PeerName(v.TargetId), v.FileName, direction, utils.FormatByteSize(v.Bytes), impl.TransferStateName(v.State)})
+		}
+	case paneApprovals:
+		if d.data.knocksErr != nil {
+			return []string{"", d.data.knocksErr.Error()}
+		}
+		header = table.Row{"#", "Peer", "Application", "Since"}
+		for _, v := range d.data.knocks {
+			rows = append(rows, table.Row{v.Id, knockPeer(v), v.App, v.Time.Format("15:04:05")})
+		}
+	case paneEvents:
+		header = table.Row{"Time", "Event", "Peer", "Application", "Message"}
+		for _, v := range d.events {
+			peer := v.TargetId
+			if peer != "" {
+				peer = d.cm.PeerName(peer)
+			}
+			rows = append(rows, table.Row{v.Time.Format("15:04:05"), v.Kind, peer, v.App, v.Message})
+		}
+	}
+	return d.table(header, rows, width, height)
+}
+
+// hints returns the keys of the current pane
+func (d *dashboard) hints() string {
+	ret := "tab/1-5 pane  ↑↓ select  q quit"
+	switch d.pane {
+	case panePeers:
+		ret = "enter ssh  p proxy  " + ret
+	case paneSessions:
+		ret = "x close  v start vnc service  " + ret
+	case paneTransfers:
+		ret = "p pause  u resume  c cancel  " + ret
+	case paneApprovals:
+		ret = "a allow  A always allow  d deny  " + ret
+	}
+	return ret
+}
+
+func (d *dashboard) render() {
+	width, height := d.screen.size()
+	title := "sshx " + d.cm.Conf.ID + " "
+	for i, v := range paneNames {
+		name := fmt.Sprintf(" %d %s ", i+1, v)
+		if i == paneApprovals && len(d.data.knocks) > 0 {
+			name = fmt.Sprintf(" %d %s (%d) ", i+1, v, len(d.data.knocks))
+			name = text.FgHiYellow.Sprint(name)
+		}
+		if i == d.pane {
+			name = text.ReverseVideo.Sprint(name)
+		}
+		title += name
+	}
+	lines := []string{title}
+	lines = append(lines, d.body(width, height-3)...)
+	for len(lines) < height-2 {
+		lines = append(lines, "")
+	}
+	lines = lines[:height-2]
+	lines = append(lines, text.FgHiBlack.Sprint(d.hints()))
+	if d.prompt != nil {
+		lines = append(lines, d.prompt.label+": "+d.prompt.value+"_")
+	} else {
+		lines = append(lines, d.message)
+	}
+	d.screen.draw(lines)
+}
+
+// handle handles a key and returns whether the dashboard quits
+func (d *dashboard) handle(key string) bool {
+	if d.prompt != nil {
+		d.handlePrompt(key)
+		return false
+	}
+	switch key {
+	case "q", keyCtrlC:
+		return true
+	case keyTab, keyRight, "l":
+		d.pane = (d.pane + 1) % len(paneNames)
+	case keyBackTab, keyLeft, "h":
+		d.pane = (d.pane + len(paneNames) - 1) % len(paneNames)
+	case keyUp, "k":
+		d.selected[d.pane]--
+	case keyDown, "j":
+		d.selected[d.pane]++
+	default:
+		if len(key) == 1 && key[0] >= '1' && int(key[0]-'1') < len(paneNames) {
+			d.pane = int(key[0] - '1')
+			break
+		}
+		d.message = ""
+		err := d.act(key)
+		if err != nil {
+			d.message = text.FgHiRed.Sprint(err.Error())
+		}
+	}
+	d.clamp()
+	return false
+}
+
+func (d *dashboard) handlePrompt(key string) {
+	p := d.prompt
+	switch key {
+	case keyEnter:
+		d.prompt = nil
+		p.done(p.value)
+	case keyEscape, keyCtrlC:
+		d.prompt = nil
+	case keyBackspace:
+		if r := []rune(p.value); len(r) > 0 {
+			p.value = string(r[:len(r)-1])
+		}
+	default:
+		if key >= " " && !strings.HasPrefix(key, keyEscape) {
+			p.value += key
+		}
+	}
+}
+
+// act runs the action of key on the selected row of the pane
+func (d *dashboard) act(key string) error {
+	selected := d.selected[d.pane]
+	if selected >= d.rows(d.pane) {
+		if d.pane == paneSessions && key == "v" {
+			return d.startVNC()
+		}
+		return nil
+	}
+	switch d.pane {
+	case panePeers:
+		peer := d.peerRows()[selected]
+		switch key {
+		case keyEnter:
+			return d.ssh(peer.id)
+		case "p":
+			d.askProxy(peer.id)
+		}
+	case paneSessions:
+		switch key {
+		case "x":
+			return d.closeSession(d.data.conns[selected])
+		case "v":
+			return d.startVNC()
+		}
+	case paneTransfers:
+		options := map[string]int32{
+			"p": types.OPTION_TYPE_PAUSE,
+			"u": types.OPTION_TYPE_RESUME,
+			"c": types.OPTION_TYPE_DOWN,
+		}
+		if option, ok := options[key]; ok {
+			return impl.ControlTransfer(d.data.transfers[selected].PairId, option)
+		}
+	case paneApprovals:
+		r := d.data.knocks[selected]
+		switch key {
+		case "a", "A":
+			d.message = fmt.Sprintf("allowed the %s session of %s", r.App, knockPeer(r))
+			return decideKnock(r, true, key == "A")
+		case "d":
+			d.message = fmt.Sprintf("denied the %s session of %s", r.App, knockPeer(r))
+			return decideKnock(r, false, false)
+		}
+	}
+	return nil
+}
+
+// ssh hands the terminal over to an ssh session with id until it ends
+func (d *dashboard) ssh(id string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	d.screen.leave()
+	out := logrus.StandardLogger().Out
+	logrus.SetOutput(os.Stderr)
+	cmd := exec.Command(self, "conn", id)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	logrus.SetOutput(out)
+	d.fatal = d.screen.enter()
+	if err != nil {
+		return fmt.Errorf("ssh %s: %v", d.cm.PeerName(id), err)
+	}
+	d.message = "ssh session with " + d.cm.PeerName(id) + " ended"
+	return nil
+}
+
+func (d *dashboard) askProxy(id string) {
+	port := ""
+	if d.cm.Conf.ProxyConf.Port != 0 {
+		port = strconv.Itoa(int(d.cm.Conf.ProxyConf.Port))
+	}
+	d.prompt = &dashboardPrompt{
+		label: "local port of the proxy to " + d.cm.PeerName(id),
+		value: port,
+		done: func(value string) {
+			port, err := strconv.Atoi(value)
+			if err == nil {
+				err = d.startProxy(id, port)
+			}
+			if err != nil {
+				d.message = text.FgHiRed.Sprint(err.Error())
+			}
+		},
+	}
+}
+
+// startProxy serves a proxy to the ssh server of id on the local port, as
+// 'sshx proxy start' does, until the dashboard quits
+func (d *dashboard) startProxy(id string, port int) error {
+	proxy, pairId, err := startProxy(d.cm, id, port)
+	if err != nil {
+		return err
+	}
+	d.proxies[pairId] = proxy
+	d.message = fmt.Sprintf("proxy to %s at 127.0.0.1:%d", d.cm.PeerName(id), port)
+	return nil
+}
+
+func (d *dashboard) startVNC() error {
+	err := startVNCService()
+	if err != nil {
+		return err
+	}
+	d.message = "vnc service started"
+	return nil
+}
+
+// closeSession closes a session of the daemon, and stops its proxy if the
+// dashboard started it
+func (d *dashboard) closeSession(c client.Connection) error {
+	if proxy := d.proxies[c.ID]; proxy != nil {
+		proxy.Close()
+		delete(d.proxies, c.ID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := d.client.CloseConnection(ctx, c.ID)
+	if err != nil {
+		return err
+	}
+	d.message = fmt.Sprintf("closed the %s session with %s", c.App, d.cm.PeerName(c.Peer))
+	return nil
+}
+
+// run shows the dashboard until q is typed
+func (d *dashboard) run() error {
+	err := d.screen.enter()
+	if err != nil {
+		return err
+	}
+	defer d.screen.leave()
+	// the output of the proxies would write over the frames
+	out := logrus.StandardLogger().Out
+	logrus.SetOutput(ioutil.Discard)
+	defer logrus.SetOutput(out)
+	defer func() {
+		for _, v := range d.proxies {
+			v.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan types.Event, 64)
+	go d.watchEvents(ctx, events)
+	next := make(chan struct{}, 1)
+	keys := make(chan string)
+	go readKeys(next, keys)
+	next <- struct{}{}
+
+	fetched := make(chan dashboardData, 1)
+	fetching := false
+	refresh := func() {
+		if fetching {
+			return
+		}
+		fetching = true
+		lan := time.Since(d.lanAt) >= dashboardLANPoll
+		if lan {
+			d.lanAt = time.Now()
+		}
+		go func(id string) {
+			fetched <- fetchDashboard(d.client, id, lan)
+		}(d.cm.Conf.ID)
+	}
+	refresh()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		d.render()
+		select {
+		case key, ok := <-keys:
+			if !ok || d.handle(key) {
+				return nil
+			}
+			if d.fatal != nil {
+				return d.fatal
+			}
+			next <- struct{}{}
+			refresh()
+		case data := <-fetched:
+			fetching = false
+			d.apply(data)
+		case ev := <-events:
+			d.addEvent(ev)
+		case <-ticker.C:
+			refresh()
+		}
+	}
+}
+
+func cmdDashboard(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		d, err := newDashboard(cm)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		err = d.run()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+	}
+}
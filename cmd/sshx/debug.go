@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/node"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+func cmdDebug(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		dc := cm.Conf.DebugConf
+		if !dc.Enabled {
+			fmt.Println("debug endpoints are disabled, set debugconf.enabled and restart the daemon")
+			return
+		}
+		token, err := node.DebugToken(dc)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		base := "http://" + node.DebugAddr(dc)
+		fmt.Println("profiles:  ", base+"/debug/pprof/")
+		fmt.Println("variables: ", base+"/debug/vars")
+		fmt.Println("token:     ", token)
+		fmt.Printf("go tool pprof '%s/debug/pprof/heap?token=%s'\n", base, token)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+func cmdDERP(cmd *cli.Cmd) {
+	cmd.Command("status", "show the DERP keys and relays of this and remote devices", cmdDERPStatus)
+	cmd.Command("set", "set the DERP key and home relay of a remote device", cmdDERPSet)
+}
+
+func cmdDERPStatus(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		dc := cm.Conf.DERPConf
+		if len(dc.URLs) == 0 {
+			fmt.Println("DERP is disabled, set derpconf.urls and restart the daemon")
+			return
+		}
+		_, pub, err := impl.DERPKey()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		fmt.Println("this device:", base64.StdEncoding.EncodeToString(pub), dc.URLs[0])
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"Name", "ID", "DERP Key", "Relay"})
+		t.AppendSeparator()
+		for _, p := range cm.Conf.AddressBook {
+			if p.DERPKey != "" {
+				t.AppendRows([]table.Row{{p.Name, p.ID, p.DERPKey, p.DERPRelay}})
+			}
+		}
+		t.AppendSeparator()
+		t.Render()
+	}
+}
+
+func cmdDERPSet(cmd *cli.Cmd) {
+	cmd.Spec = "ID [KEY [RELAY]]"
+	id := cmd.StringArg("ID", "", "device ID or address book name")
+	key := cmd.StringArg("KEY", "", "DERP key of the device, as 'sshx derp status' shows it there, empty to forget it")
+	relay := cmd.StringArg("RELAY", "", "home relay of the device, the one of this device if empty")
+	cmd.Action = func() {
+		if bs, err := base64.StdEncoding.DecodeString(*key); *key != "" && (err != nil || len(bs) != 32) {
+			fmt.Println("invalid DERP key", *key)
+			cli.Exit(1)
+		}
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		peer := cm.ResolvePeer(*id)
+		p := cm.FindPeer(peer)
+		if p == nil {
+			cm.Conf.AddressBook = append(cm.Conf.AddressBook, conf.Peer{ID: peer})
+			p = &cm.Conf.AddressBook[len(cm.Conf.AddressBook)-1]
+		}
+		p.DERPKey, p.DERPRelay = *key, *relay
+		if *key == "" {
+			p.DERPRelay = ""
+		}
+		err = cm.SaveAddressBook()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+func cmdSearch(cmd *cli.Cmd) {
+	cmd.Spec = "[-o] [-t...] [-c...] [-n] [--add] [QUERY]"
+	query := cmd.StringArg("QUERY", "", "text found in the ID, name, owner or tags of the devices")
+	owner := cmd.StringOpt("o owner", "", "owner of the devices")
+	tags := cmd.StringsOpt("t tag", nil, "tags the devices have")
+	caps := cmd.StringsOpt("c cap", nil, "capabilities the devices have, as ssh or vnc")
+	limit := cmd.IntOpt("n limit", 50, "maximum number of devices shown")
+	add := cmd.BoolOpt("add", false, "add the devices found to the address book by their name")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		hits, err := impl.SearchDirectory(cm, types.DirectoryQuery{
+			Text:         *query,
+			Owner:        *owner,
+			Tags:         *tags,
+			Capabilities: *caps,
+		}, *limit)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"Name", "ID", "Owner", "Tags", "Capabilities", "Key"})
+		t.AppendSeparator()
+		for _, v := range hits {
+			key := ""
+			if v.Pinned {
+				key = "pinned"
+			} else if v.Mismatch {
+				key = "MISMATCH"
+			}
+			t.AppendRows([]table.Row{{v.Name, v.ID, v.Owner, strings.Join(v.Tags, ","), strings.Join(v.Capabilities, ","), key}})
+		}
+		t.AppendSeparator()
+		t.Render()
+		if !*add {
+			return
+		}
+		for _, v := range hits {
+			if v.Mismatch || v.ID == cm.Conf.ID {
+				continue
+			}
+			err = cm.AddJoinedPeer(v.ID, v.Name, nil)
+			if err != nil {
+				logrus.Error(err)
+				cli.Exit(1)
+			}
+		}
+		fmt.Println("added to the address book, pair with the devices before trusting them")
+	}
+}
+
+func cmdDirectoryRegister(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		err = impl.RegisterDirectory(cm)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		if !cm.Conf.DirectoryConf.Enabled {
+			fmt.Println("registered, set directoryconf.enabled for the daemon to keep the entry")
+		}
+	}
+}
+
+func cmdDirectoryRemove(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		err = impl.RemoveDirectory(cm)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		if cm.Conf.DirectoryConf.Enabled {
+			fmt.Println("removed, unset directoryconf.enabled or the daemon registers again")
+		}
+	}
+}
+
+func cmdDirectory(cmd *cli.Cmd) {
+	cmd.Command("register", "put the entry of this device in the directory now", cmdDirectoryRegister)
+	cmd.Command("remove rm", "drop the entry of this device from the directory", cmdDirectoryRemove)
+}
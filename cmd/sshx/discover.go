@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+func cmdDiscover(cmd *cli.Cmd) {
+	cmd.Spec = "[-w] [--json]"
+	wait := cmd.IntOpt("w wait", 2, "seconds to wait for the answers of the devices, 0 lists the ones known")
+	asJSON := cmd.BoolOpt("json", false, "print the devices as JSON")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if !cm.Conf.DiscoveryConf.Enabled {
+			fmt.Println("discovery is disabled, set discoveryconf.enabled to true and restart the daemon")
+			return
+		}
+		d := impl.NewDiscover(cm.Conf.ID)
+		d.Wait = *wait
+		peers, err := impl.RequestDiscover(d)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if *asJSON {
+			bs, _ := json.MarshalIndent(peers, "", "  ")
+			fmt.Println(string(bs))
+			return
+		}
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"Name", "ID", "Address", "Applications", "Last Seen", "Address Book"})
+		t.AppendSeparator()
+		for _, p := range peers {
+			addr := ""
+			if len(p.Addrs) > 0 {
+				addr = p.Addrs[0]
+			}
+			book := "no"
+			if cm.FindPeer(p.ID) != nil {
+				book = "yes"
+			}
+			t.AppendRows([]table.Row{{
+				p.Name, p.ID, addr, strings.Join(p.Apps, ", "), p.Seen.Format(time.Stamp), book,
+			}})
+		}
+		t.AppendSeparator()
+		t.Render()
+		if len(peers) == 0 {
+			fmt.Println("devices are only found once they set discoveryconf.advertise")
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/dnsdisc"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+func cmdDNSRecord(cmd *cli.Cmd) {
+	cmd.Spec = "NAME"
+	name := cmd.StringArg("NAME", "", "domain name of this device, as host.example.com")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		pub, err := impl.NodePublicKey()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		p := dnsdisc.Peer{Host: *name, ID: cm.Conf.ID, Fingerprint: impl.KeyFingerprint(pub)}
+		fmt.Println(p.Record())
+		if cm.Conf.SignalingServerAddr == "" {
+			return
+		}
+		// the signaling server is published by the parent domain
+		domain := strings.TrimSuffix(*name, ".")
+		if i := strings.Index(domain, "."); i > 0 && dnsdisc.IsDomain(domain[i+1:]) {
+			domain = domain[i+1:]
+		}
+		s := dnsdisc.Signaling{Domain: domain, Addr: cm.Conf.SignalingServerAddr}
+		records, err := s.Records()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		for _, v := range records {
+			fmt.Println(v)
+		}
+	}
+}
+
+func cmdDNSLookup(cmd *cli.Cmd) {
+	cmd.Spec = "HOST"
+	host := cmd.StringArg("HOST", "", "domain name of a device")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		r := &dnsdisc.Resolver{Server: cm.Conf.DNSConf.Server}
+		p, err := r.LookupPeer(*host)
+		if err != nil {
+			fmt.Println("device:", err)
+		} else {
+			fmt.Println("id:", p.ID)
+			fmt.Println("fingerprint:", p.Fingerprint)
+		}
+		s, err := r.LookupSignaling(*host)
+		if err != nil {
+			fmt.Println("signaling server:", err)
+		} else {
+			fmt.Println("signaling server:", s.Addr, "of", s.Domain)
+		}
+	}
+}
+
+func cmdDNS(cmd *cli.Cmd) {
+	cmd.Command("record", "print the DNS records publishing this device and its signaling server", cmdDNSRecord)
+	cmd.Command("lookup", "show the device and signaling server published by a domain name", cmdDNSLookup)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+func cmdDockerPs(cmd *cli.Cmd) {
+	cmd.Spec = "[-a] [--json] ADDR"
+	all := cmd.BoolOpt("a all", false, "list the stopped containers too")
+	asJSON := cmd.BoolOpt("json", false, "print the containers as JSON")
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	cmd.Action = func() {
+		imp := impl.NewDocker(*addr, impl.DockerRequest{All: *all})
+		err := imp.Preper(context.Background())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+		conn, err := sender.Send()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		imp.SetConn(conn)
+		list, err := imp.DoList()
+		imp.Close()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if *asJSON {
+			bs, _ := json.MarshalIndent(list, "", "  ")
+			fmt.Println(string(bs))
+			return
+		}
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"ID", "Name", "Image", "Status"})
+		t.AppendSeparator()
+		for _, c := range list {
+			id := c.ID
+			if len(id) > 12 {
+				id = id[:12]
+			}
+			t.AppendRows([]table.Row{{id, c.Name, c.Image, c.Status}})
+		}
+		t.AppendSeparator()
+		t.Render()
+	}
+}
+
+// runDocker execs into or attaches to a container and exits with the exit
+// code of its command
+func runDocker(addr, otp string, req impl.DockerRequest) {
+	imp := impl.NewDocker(addr, req)
+	err := imp.Preper(context.Background())
+	if err != nil {
+		logrus.Error(err)
+		cli.Exit(1)
+	}
+	imp.SetOneTimeCode(oneTimeCode(imp.HostId(), otp))
+	sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+	conn, err := sender.Send()
+	if err != nil {
+		logrus.Error(err)
+		cli.Exit(1)
+	}
+	imp.SetConn(conn)
+	code, err := imp.DoExec()
+	imp.Close()
+	if err != nil {
+		logrus.Error(err)
+		cli.Exit(1)
+	}
+	cli.Exit(code)
+}
+
+func cmdDockerExec(cmd *cli.Cmd) {
+	cmd.Spec = "[-t] [-u] [--otp] ADDR CONTAINER [CMD...]"
+	tty := cmd.BoolOpt("t tty", false, "run the command on a terminal")
+	user := cmd.StringOpt("u user", "", "user of the command, the one of the container by default")
+	otp := cmd.StringOpt("otp", "", "one-time code asked by the remote device")
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	container := cmd.StringArg("CONTAINER", "", "name or id of the container")
+	command := cmd.StringsArg("CMD", nil, "command to run, sh by default, put -- before it if it has options")
+	cmd.Action = func() {
+		runDocker(*addr, *otp, impl.DockerRequest{
+			Container: *container,
+			Command:   *command,
+			User:      *user,
+			TTY:       *tty,
+		})
+	}
+}
+
+func cmdDockerAttach(cmd *cli.Cmd) {
+	cmd.Spec = "[--otp] ADDR CONTAINER"
+	otp := cmd.StringOpt("otp", "", "one-time code asked by the remote device")
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	container := cmd.StringArg("CONTAINER", "", "name or id of the container")
+	cmd.Action = func() {
+		runDocker(*addr, *otp, impl.DockerRequest{
+			Container: *container,
+			Attach:    true,
+		})
+	}
+}
+
+func cmdDocker(cmd *cli.Cmd) {
+	cmd.Command("ps", "list the containers of a remote device", cmdDockerPs)
+	cmd.Command("exec", "run a command in a container of a remote device", cmdDockerExec)
+	cmd.Command("attach", "attach to the main process of a container of a remote device", cmdDockerAttach)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/suutaku/sshx/internal/doctor"
+)
+
+func cmdDoctor(cmd *cli.Cmd) {
+	cmd.Spec = "[--json]"
+	asJSON := cmd.BoolOpt("json", false, "print the results as JSON")
+	cmd.Action = func() {
+		results := doctor.Run(getRootPath())
+		if *asJSON {
+			bs, _ := json.MarshalIndent(results, "", "  ")
+			fmt.Println(string(bs))
+		} else {
+			t := table.NewWriter()
+			t.SetOutputMirror(os.Stdout)
+			t.AppendHeader(table.Row{"Check", "Status", "Message", "Hint"})
+			t.AppendSeparator()
+			for _, v := range results {
+				t.AppendRows([]table.Row{{v.Check, v.Status, v.Message, v.Hint}})
+			}
+			t.AppendSeparator()
+			t.Render()
+		}
+		// scripts read the outcome from the exit code
+		if doctor.Failed(results) {
+			cli.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// prefixWriter writes the lines written to it behind prefix, the lines of
+// the devices running at once don't mix
+type prefixWriter struct {
+	out    io.Writer
+	lock   *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.lock.Lock()
+		fmt.Fprintf(w.out, "%s%s\n", w.prefix, w.buf[:i])
+		w.lock.Unlock()
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// Flush writes the last line if it has no newline
+func (w *prefixWriter) Flush() {
+	if len(w.buf) == 0 {
+		return
+	}
+	w.Write([]byte("\n"))
+}
+
+// execResult is the outcome of a command on a device
+type execResult struct {
+	name     string
+	code     int
+	err      error
+	duration time.Duration
+}
+
+// execOn runs command on the device id, its output goes to stdout and
+// stderr
+func execOn(ctx context.Context, id, command string, stdout, stderr io.Writer) (int, error) {
+	imp := impl.NewExec(id, command)
+	err := imp.Preper(ctx)
+	if err != nil {
+		return 0, err
+	}
+	sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+	conn, err := sender.SendContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	imp.SetConn(conn)
+	defer imp.Close()
+	return imp.DoRun(ctx, stdout, stderr)
+}
+
+// fanOut runs command on every device of ids, parallel at a time, and
+// returns the results in the order of ids
+func fanOut(cm *conf.ConfManager, ids []string, command string, parallel int, timeout time.Duration) []execResult {
+	width := 0
+	for _, id := range ids {
+		if n := len(cm.PeerName(id)); n > width {
+			width = n
+		}
+	}
+	var lock sync.Mutex
+	results := make([]execResult, len(ids))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, id string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			ctx := context.Background()
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			name := cm.PeerName(id)
+			prefix := fmt.Sprintf("%-*s | ", width, name)
+			stdout := &prefixWriter{out: os.Stdout, lock: &lock, prefix: prefix}
+			stderr := &prefixWriter{out: os.Stderr, lock: &lock, prefix: prefix}
+			start := time.Now()
+			code, err := execOn(ctx, id, command, stdout, stderr)
+			stdout.Flush()
+			stderr.Flush()
+			results[i] = execResult{name: name, code: code, err: err, duration: time.Since(start)}
+		}(i, id)
+	}
+	wg.Wait()
+	return results
+}
+
+func cmdExec(cmd *cli.Cmd) {
+	cmd.Spec = "[-p] [-t] PEERS CMD..."
+	parallel := cmd.IntOpt("p parallel", 32, "devices the command runs on at a time")
+	timeout := cmd.IntOpt("t timeout", 0, "seconds after which the command is killed, 0 for none")
+	peers := cmd.StringArg("PEERS", "", "comma separated peer IDs, names, group:NAME or *")
+	command := cmd.StringsArg("CMD", nil, "command line run by the shell of the devices, put -- before it if it has options")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		ids := cm.ExpandPeers(strings.Split(*peers, ","))
+		if len(ids) == 0 {
+			logrus.Error("no device in ", *peers)
+			cli.Exit(1)
+		}
+		if *parallel < 1 {
+			*parallel = 1
+		}
+		results := fanOut(cm, ids, strings.Join(*command, " "), *parallel, time.Duration(*timeout)*time.Second)
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"Device", "Exit", "Time", "Error"})
+		t.AppendSeparator()
+		failed := 0
+		for _, r := range results {
+			code, msg := fmt.Sprint(r.code), ""
+			if r.err != nil {
+				code, msg = "-", r.err.Error()
+			}
+			if r.err != nil || r.code != 0 {
+				failed++
+			}
+			t.AppendRows([]table.Row{{r.name, code, r.duration.Round(time.Millisecond), msg}})
+		}
+		t.AppendSeparator()
+		t.AppendFooter(table.Row{"", "", "", fmt.Sprintf("%d/%d succeeded", len(results)-failed, len(results))})
+		t.Render()
+		if failed > 0 {
+			cli.Exit(1)
+		}
+	}
+}
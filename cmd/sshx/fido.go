@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+func cmdFIDOEnroll(cmd *cli.Cmd) {
+	cmd.Spec = "[-d]"
+	device := cmd.StringOpt("d device", "", "path of the FIDO2 key, the first one plugged by default")
+	cmd.Action = func() {
+		fmt.Println("touch the FIDO2 key")
+		err := impl.EnrollFIDO(*device)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("FIDO2 key enrolled, list the peers which need it in fidoconf.peers")
+	}
+}
+
+func cmdFIDOTest(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		fmt.Println("touch the FIDO2 key")
+		err := impl.ConfirmPresence("test", "test")
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("assertion verified")
+	}
+}
+
+func cmdFIDO(cmd *cli.Cmd) {
+	cmd.Command("enroll", "create the credential connections to sensitive peers are confirmed with", cmdFIDOEnroll)
+	cmd.Command("test", "ask for a touch and verify the assertion", cmdFIDOTest)
+}
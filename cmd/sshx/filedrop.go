@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/node"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+func cmdFileDrop(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fc := cm.Conf.FileDropConf
+		if !fc.Enabled {
+			fmt.Println("the file drop page is disabled, set filedropconf.enabled and restart the daemon")
+			return
+		}
+		token, err := node.FileDropToken(fc)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		host, port, err := net.SplitHostPort(node.FileDropAddr(fc))
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		fmt.Printf("http://%s/?token=%s\n", net.JoinHostPort(host, port), token)
+	}
+}
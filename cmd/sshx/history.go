@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+// humanBytes formats a number of bytes
+func humanBytes(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	v := float64(n)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
+
+func cmdHistory(cmd *cli.Cmd) {
+	cmd.Spec = "[-p] [-a] [-s] [-n] [--json]"
+	peer := cmd.StringOpt("p peer", "", "device ID or address book name of the peer")
+	app := cmd.StringOpt("a app", "", "application, as ssh, vnc or transfer")
+	since := cmd.StringOpt("s since", "", "sessions which ended in this duration, as 24h")
+	limit := cmd.IntOpt("n", 20, "maximum number of sessions, 0 for all")
+	asJSON := cmd.BoolOpt("json", false, "print the sessions as JSON")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		h := impl.NewHistory(cm.Conf.ID)
+		h.Peer, h.App, h.Limit = *peer, *app, *limit
+		for _, p := range cm.Conf.AddressBook {
+			if p.Name != "" && p.Name == *peer {
+				h.Peer = p.ID
+			}
+		}
+		if *since != "" {
+			d, err := time.ParseDuration(*since)
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+			h.Since = time.Now().Add(-d)
+		}
+		recs, err := impl.RequestHistory(h)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if *asJSON {
+			bs, _ := json.MarshalIndent(recs, "", "  ")
+			fmt.Println(string(bs))
+			return
+		}
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"Start At", "Duration", "Peer", "Application", "Direction", "Path", "Received", "Sent", "Average", "Failure"})
+		t.AppendSeparator()
+		for _, r := range recs {
+			name := r.TargetId
+			if p := cm.FindPeer(r.TargetId); p != nil && p.Name != "" {
+				name = p.Name
+			}
+			direction := "out"
+			if r.Inbound {
+				direction = "in"
+			}
+			t.AppendRows([]table.Row{{
+				r.Start.Format("2 Jan 2006 15:04:05"), r.Duration().Round(time.Second), name, r.App, direction,
+				r.Candidate, humanBytes(r.BytesIn), humanBytes(r.BytesOut), humanRate(r.Rate()), r.Failure,
+			}})
+		}
+		t.AppendSeparator()
+		t.Render()
+	}
+}
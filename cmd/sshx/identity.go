@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+func cmdIdentityShow(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		err := impl.ShowIdentity()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdIdentityInstall(cmd *cli.Cmd) {
+	cmd.Spec = "FILE"
+	file := cmd.StringArg("FILE", "", "certificate signed by the CA")
+	cmd.Action = func() {
+		bs, err := ioutil.ReadFile(*file)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		nc, err := impl.InstallNodeCertificate(bs)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("certificate of", nc.ID, "installed")
+	}
+}
+
+func cmdIdentityForget(cmd *cli.Cmd) {
+	cmd.Spec = "ADDR"
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	cmd.Action = func() {
+		err := impl.ForgetNodeKey(*addr)
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdIdentityRotate(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		res, err := impl.Rotate()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("new node key", res.Fingerprint+",", "rotation sent to", res.Notified, "peers")
+	}
+}
+
+func cmdIdentity(cmd *cli.Cmd) {
+	cmd.Command("show", "show the node key and certificate of this device", cmdIdentityShow)
+	cmd.Command("install", "install the certificate of this device", cmdIdentityInstall)
+	cmd.Command("forget", "unpin the node key of a device", cmdIdentityForget)
+	cmd.Command("rotate", "replace the keys of this device and announce them", cmdIdentityRotate)
+}
+
+func cmdCAKeygen(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		pub, err := impl.GenerateCAKey()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("set identityconf.capublickey of the devices to", pub)
+	}
+}
+
+func cmdCASign(cmd *cli.Cmd) {
+	cmd.Spec = "[-d] [-o] ADDR KEY"
+	days := cmd.IntOpt("d days", 365, "days the certificate is valid, 0 for ever")
+	output := cmd.StringOpt("o output", "", "write the certificate to a file")
+	addr := cmd.StringArg("ADDR", "", "id of the device")
+	key := cmd.StringArg("KEY", "", "node key of the device, shown by 'sshx identity show'")
+	cmd.Action = func() {
+		bs, err := impl.SignNodeCertificate(*addr, *key, time.Duration(*days)*24*time.Hour)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if *output == "" {
+			fmt.Println(string(bs))
+			return
+		}
+		err = ioutil.WriteFile(*output, bs, 0644)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("certificate of", *addr, "written to", *output)
+	}
+}
+
+func cmdCA(cmd *cli.Cmd) {
+	cmd.Command("keygen", "create the key of a CA certifying devices", cmdCAKeygen)
+	cmd.Command("sign", "certify the node key of a device", cmdCASign)
+}
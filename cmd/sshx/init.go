@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	cli "github.com/jawher/mow.cli"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/conn"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"golang.org/x/term"
+)
+
+const checkTimeout = 10 * time.Second
+
+// setupDone is set once the setup ran for this command
+var setupDone bool
+
+type prompter struct {
+	r *bufio.Reader
+	// outbound is the proxy the servers are checked through
+	outbound *utils.OutboundProxy
+}
+
+// ask prints a question and returns the answer, def if it is empty
+func (p *prompter) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	line, err := p.r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+func (p *prompter) confirm(question string) (bool, error) {
+	answer, err := p.ask(question+" (y/N)", "")
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes", nil
+}
+
+func (p *prompter) askProxy(s *conf.Setup) error {
+	for {
+		addr, err := p.ask("Proxy to the internet, as http://proxy:3128 or socks5://proxy:1080, empty for the one of the environment", s.Proxy)
+		if err != nil {
+			return err
+		}
+		p.outbound, err = utils.NewOutboundProxy(addr, nil)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		s.Proxy = addr
+		return nil
+	}
+}
+
+func (p *prompter) askSignaling(s *conf.Setup) error {
+	for {
+		addr, err := p.ask("Signaling server address", s.SignalingServerAddr)
+		if err != nil {
+			return err
+		}
+		if addr == "" {
+			fmt.Println("a signaling server is needed to reach other devices, see 'Signaling server' in the README to run one")
+			continue
+		}
+		if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+			addr = "http://" + addr
+		}
+		token, err := p.ask("Tenant token of the signaling server, empty if none", s.SignalingToken)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("checking %s ... ", addr)
+		err = conn.CheckSignaling(strings.TrimSuffix(addr, "/"), token, uuid.New().String(), p.outbound, checkTimeout)
+		if err != nil {
+			fmt.Println(err)
+			ok, err := p.confirm("Use it anyway?")
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+		} else {
+			fmt.Println("ok")
+		}
+		s.SignalingServerAddr = strings.TrimSuffix(addr, "/")
+		s.SignalingToken = token
+		return nil
+	}
+}
+
+func (p *prompter) askICE(s *conf.Setup) error {
+	var def []string
+	for _, v := range s.ICEServers {
+		if len(v.Username) == 0 {
+			def = append(def, v.URLs...)
+		}
+	}
+	urls, err := p.ask("STUN servers, separated by commas", strings.Join(def, ","))
+	if err != nil {
+		return err
+	}
+	servers := []webrtc.ICEServer{}
+	for _, v := range strings.Split(urls, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			servers = append(servers, webrtc.ICEServer{URLs: []string{v}})
+		}
+	}
+	for _, v := range s.ICEServers {
+		if len(v.Username) > 0 {
+			servers = append(servers, v)
+		}
+	}
+	turn, err := p.ask("TURN server for devices behind strict NATs, empty if none", "")
+	if err != nil {
+		return err
+	}
+	if turn != "" {
+		user, err := p.ask("TURN username", "")
+		if err != nil {
+			return err
+		}
+		credential, err := p.ask("TURN password", "")
+		if err != nil {
+			return err
+		}
+		servers = append(servers, webrtc.ICEServer{URLs: []string{turn}, Username: user, Credential: credential})
+	}
+	reachable := 0
+	for _, v := range servers {
+		fmt.Printf("checking %s ... ", strings.Join(v.URLs, ","))
+		err = conn.CheckICEServer(v, p.outbound, checkTimeout)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Println("ok")
+		reachable++
+	}
+	if reachable == 0 {
+		fmt.Println("no ICE server is reachable, only devices of the same network can connect")
+	}
+	s.ICEServers = servers
+	return nil
+}
+
+// runSetup asks for the signaling and ICE servers, checks them and writes
+// the configure. A join bundle may be given instead of a signaling server.
+func runSetup() error {
+	setupDone = true
+	root := getRootPath()
+	s, err := conf.DefaultSetup(root)
+	if err != nil {
+		return err
+	}
+	p := &prompter{r: bufio.NewReader(os.Stdin)}
+	fmt.Println("Setting up sshx in", root)
+	var bundle *conf.JoinBundle
+	answer, err := p.ask("Join bundle of another device, empty to set the servers", "")
+	if err != nil {
+		return err
+	}
+	if answer != "" {
+		bundle, err = conf.DecodeBundle(answer)
+		if err != nil {
+			return err
+		}
+		s.SignalingServerAddr = bundle.SignalingServerAddr
+		s.SignalingToken = bundle.SignalingToken
+		s.ICEServers = bundle.ICEServers
+	}
+	err = p.askProxy(&s)
+	if err != nil {
+		return err
+	}
+	err = p.askSignaling(&s)
+	if err != nil {
+		return err
+	}
+	err = p.askICE(&s)
+	if err != nil {
+		return err
+	}
+	cm, err := s.Apply(root)
+	if err != nil {
+		return err
+	}
+	if bundle != nil {
+		err = cm.ImportBundle(bundle)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Println("configure written to", strings.Join(conf.ConfigFiles(cm.Path, cm.Profile), ", "))
+	fmt.Println("the ID of this device is", cm.Conf.ID)
+	return nil
+}
+
+// setupOnFirstRun runs the setup when there is no configure and the
+// command is run from a terminal
+func setupOnFirstRun() {
+	if conf.ConfigExists(getRootPath()) || !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return
+	}
+	err := runSetup()
+	if err != nil {
+		logrus.Error("setup: ", err)
+	}
+}
+
+func cmdInit(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		if setupDone {
+			return
+		}
+		err := runSetup()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+func cmdJoinToken(cmd *cli.Cmd) {
+	cmd.Spec = "[-n] [-g...] [-t] [-u] [--template]"
+	name := cmd.StringOpt("n name", "", "address book name of the joining device, its host name by default")
+	groups := cmd.StringsOpt("g group", nil, "address book groups the joining device is added to")
+	ttl := cmd.IntOpt("t ttl", 86400, "seconds the token is valid")
+	uses := cmd.IntOpt("u uses", 1, "number of devices which may join with the token")
+	template := cmd.StringOpt("template", "", "access template of joinconf.templates applied on the joining device")
+	cmd.Action = func() {
+		t, text, err := impl.IssueJoinToken(*name, *groups, *template, time.Duration(*ttl)*time.Second, *uses)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		fmt.Println(text)
+		fmt.Fprintln(os.Stderr, "on the new device run: sshx daemon --join <token>")
+		fmt.Fprintf(os.Stderr, "token %s valid for %d devices until %s\n", t.ID, t.Uses, t.Expires.Format("2006-01-02 15:04:05"))
+	}
+}
+
+func cmdJoinList(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		tokens, err := impl.ListJoinTokens()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"ID", "Name", "Groups", "Template", "Uses Left", "Expires", "Joined"})
+		t.AppendSeparator()
+		for _, v := range tokens {
+			expires := v.Expires.Format("2006-01-02 15:04:05")
+			if time.Now().After(v.Expires) {
+				expires += " (expired)"
+			}
+			t.AppendRows([]table.Row{{v.ID, v.Name, strings.Join(v.Groups, ","), v.Template, v.Uses, expires, strings.Join(v.Joined, ",")}})
+		}
+		t.AppendSeparator()
+		t.Render()
+	}
+}
+
+func cmdJoinRevoke(cmd *cli.Cmd) {
+	cmd.Spec = "ID"
+	id := cmd.StringArg("ID", "", "token ID, as 'sshx join list' shows it")
+	cmd.Action = func() {
+		err := impl.RevokeJoinToken(*id)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+	}
+}
+
+func cmdJoin(cmd *cli.Cmd) {
+	cmd.Command("token", "issue a token new devices join this one with", cmdJoinToken)
+	cmd.Command("list", "list the join tokens of this device", cmdJoinList)
+	cmd.Command("revoke", "remove a join token", cmdJoinRevoke)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/impl"
+	"golang.org/x/term"
+)
+
+func readPassphrase(prompt string) (string, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("the passphrase is asked in a terminal, or set %s", impl.PASSPHRASE_ENV)
+	}
+	fmt.Print(prompt)
+	bs, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return string(bs), err
+}
+
+func cmdKeyStoreEnable(cmd *cli.Cmd) {
+	cmd.Spec = "[-k]"
+	keychain := cmd.BoolOpt("k keychain", false, "keep the key in the keychain of the system instead of asking a passphrase")
+	cmd.Action = func() {
+		passphrase := ""
+		if !*keychain {
+			var err error
+			passphrase, err = readPassphrase("new passphrase: ")
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+			again, err := readPassphrase("repeat passphrase: ")
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+			if passphrase == "" || passphrase != again {
+				logrus.Error("the passphrases are empty or differ")
+				return
+			}
+		}
+		err := impl.EnableKeyStore(passphrase)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("keys are encrypted")
+		if passphrase != "" {
+			fmt.Println("run 'sshx keystore unlock' after the daemon starts, or set", impl.PASSPHRASE_ENV, "for it")
+		}
+	}
+}
+
+func cmdKeyStoreDisable(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		err := impl.DisableKeyStore()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdKeyStoreUnlock(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		mode, _, err := impl.KeyStoreStatus()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		passphrase := ""
+		if mode == impl.KEYSTORE_PASSPHRASE {
+			passphrase, err = readPassphrase("key store passphrase: ")
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+		}
+		err = impl.UnlockDaemon(passphrase)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("key store of the daemon unlocked")
+	}
+}
+
+func cmdKeyStoreStatus(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		mode, _, err := impl.KeyStoreStatus()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if mode == impl.KEYSTORE_PLAIN {
+			fmt.Println("keys are not encrypted")
+			return
+		}
+		fmt.Println("keys are encrypted with a key protected by", mode)
+	}
+}
+
+func cmdKeyStore(cmd *cli.Cmd) {
+	cmd.Command("enable", "encrypt the keys of this device and of its peers", cmdKeyStoreEnable)
+	cmd.Command("disable", "keep the keys unencrypted", cmdKeyStoreDisable)
+	cmd.Command("unlock", "unlock the keys for the daemon", cmdKeyStoreUnlock)
+	cmd.Command("status", "show how the keys are protected", cmdKeyStoreStatus)
+}
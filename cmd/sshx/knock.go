@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+func knockPeer(r types.KnockRequest) string {
+	if r.Name != "" {
+		return fmt.Sprintf("%s (%s)", r.Name, r.Peer)
+	}
+	return r.Peer
+}
+
+// trustPeer adds a peer to the ones approved without asking
+func trustPeer(peer string) error {
+	cm, err := conf.NewConfManager(getRootPath())
+	if err != nil {
+		return err
+	}
+	for _, v := range cm.Conf.KnockConf.Trusted {
+		if v == peer {
+			return nil
+		}
+	}
+	return cm.SetValue("knockconf.trusted", append(cm.Conf.KnockConf.Trusted, peer))
+}
+
+// decideKnock approves or denies a session, and trusts its peer from now on
+// if remember is set
+func decideKnock(r types.KnockRequest, allow, remember bool) error {
+	err := impl.DecideKnock(r.Id, allow)
+	if err != nil {
+		return err
+	}
+	if allow && remember {
+		return trustPeer(r.Peer)
+	}
+	return nil
+}
+
+func findKnock(id int64) (types.KnockRequest, error) {
+	list, err := impl.ListKnocks()
+	if err != nil {
+		return types.KnockRequest{}, err
+	}
+	for _, v := range list {
+		if v.Id == id {
+			return v, nil
+		}
+	}
+	return types.KnockRequest{}, fmt.Errorf("no session %d waiting for approval", id)
+}
+
+func cmdKnockList(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		list, err := impl.ListKnocks()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"#", "Peer", "Application", "Since"})
+		t.AppendSeparator()
+		for _, v := range list {
+			t.AppendRows([]table.Row{{v.Id, knockPeer(v), v.App, v.Time.Format("15:04:05")}})
+		}
+		t.AppendSeparator()
+		t.Render()
+	}
+}
+
+func cmdKnockDecide(allow bool) func(cmd *cli.Cmd) {
+	return func(cmd *cli.Cmd) {
+		remember := new(bool)
+		if allow {
+			cmd.Spec = "[-r] ID"
+			remember = cmd.BoolOpt("r remember", false, "approve the later sessions of this peer without asking")
+		} else {
+			cmd.Spec = "ID"
+		}
+		id := cmd.IntArg("ID", 0, "session waiting for approval, as listed by 'sshx knock list'")
+		cmd.Action = func() {
+			r, err := findKnock(int64(*id))
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+			err = decideKnock(r, allow, *remember)
+			if err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+}
+
+func cmdKnockWatch(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		reader := bufio.NewReader(os.Stdin)
+		seen := make(map[int64]bool)
+		fmt.Println("waiting for sessions to approve, Ctrl-C to stop")
+		for {
+			list, err := impl.ListKnocks()
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+			for _, v := range list {
+				if seen[v.Id] {
+					continue
+				}
+				seen[v.Id] = true
+				fmt.Printf("%s asks for a %s session, allow? (y)es, (n)o, (a)lways: ", knockPeer(v), v.App)
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				answer := strings.ToLower(strings.TrimSpace(line))
+				allow := answer == "y" || answer == "yes" || answer == "a" || answer == "always"
+				err = decideKnock(v, allow, answer == "a" || answer == "always")
+				if err != nil {
+					logrus.Error(err)
+				}
+			}
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func cmdKnock(cmd *cli.Cmd) {
+	cmd.Command("list", "list inbound sessions waiting for approval", cmdKnockList)
+	cmd.Command("allow", "approve an inbound session", cmdKnockDecide(true))
+	cmd.Command("deny", "deny an inbound session", cmdKnockDecide(false))
+	cmd.Command("watch", "approve inbound sessions as they come", cmdKnockWatch)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+func cmdKubeExec(cmd *cli.Cmd) {
+	cmd.Spec = "[-n] [-c] [-t] [--otp] ADDR POD [CMD...]"
+	namespace := cmd.StringOpt("n namespace", "", "namespace of the pod, the one of the remote device by default")
+	container := cmd.StringOpt("c container", "", "container of the pod, its default container by default")
+	tty := cmd.BoolOpt("t tty", false, "run the command on a terminal")
+	otp := cmd.StringOpt("otp", "", "one-time code asked by the remote device")
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	pod := cmd.StringArg("POD", "", "a pod, pod/NAME or svc/NAME")
+	command := cmd.StringsArg("CMD", nil, "command to run, sh by default, put -- before it if it has options")
+	cmd.Action = func() {
+		imp := impl.NewKube(*addr, impl.KubeRequest{
+			Namespace: *namespace,
+			Target:    *pod,
+			Exec:      true,
+			Container: *container,
+			Command:   *command,
+			TTY:       *tty,
+		})
+		err := imp.Preper(context.Background())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		imp.SetOneTimeCode(oneTimeCode(imp.HostId(), *otp))
+		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+		conn, err := sender.Send()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		imp.SetConn(conn)
+		code, err := imp.DoExec()
+		imp.Close()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		cli.Exit(code)
+	}
+}
+
+func cmdKubeForward(cmd *cli.Cmd) {
+	cmd.Spec = "[-n] [-p] ADDR TARGET [PORT]"
+	namespace := cmd.StringOpt("n namespace", "", "namespace of the target, the one of the remote device by default")
+	port := cmd.IntOpt("p port", 0, "local port, the remote port by default")
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	target := cmd.StringArg("TARGET", "", "a pod, pod/NAME or svc/NAME")
+	remotePort := cmd.IntArg("PORT", 0, "port of the pod or the service, may be omitted for services with one port")
+	cmd.Action = func() {
+		if *port == 0 {
+			*port = *remotePort
+		}
+		imp := impl.NewKube(*addr, impl.KubeRequest{
+			Namespace: *namespace,
+			Target:    *target,
+			Port:      int32(*remotePort),
+		})
+		imp.LocalPort = int32(*port)
+		imp.Preper(context.Background())
+		imp.NoNeedConnect()
+
+		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+		_, err := sender.SendDetach()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		// streams to the workload are children of this pair
+		imp.SetPairId(string(sender.PairId))
+		err = imp.Listen()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt)
+		go func() {
+			<-c
+			imp.Close()
+			closeSender := impl.NewSender(imp, types.OPTION_TYPE_DOWN)
+			closeSender.PairId = []byte(imp.PairId())
+			closeSender.SendDetach()
+		}()
+		err = imp.Start()
+		if err != nil {
+			logrus.Error(err)
+		}
+		imp.Close()
+	}
+}
+
+func cmdKubeStop(cmd *cli.Cmd) {
+	cmd.Spec = "PID"
+	pairId := cmd.StringArg("PID", "", "Connection pair id which can found by using status command")
+	cmd.Action = func() {
+		imp := impl.NewKube("", impl.KubeRequest{})
+		imp.NoNeedConnect()
+		sender := impl.NewSender(imp, types.OPTION_TYPE_DOWN)
+		sender.PairId = []byte(*pairId)
+		sender.SendDetach()
+	}
+}
+
+func cmdKube(cmd *cli.Cmd) {
+	cmd.Command("exec", "run a command in a pod of the cluster of a remote device", cmdKubeExec)
+	cmd.Command("forward", "forward a local port to a pod or service of the cluster of a remote device", cmdKubeForward)
+	cmd.Command("stop", "stop a port forward", cmdKubeStop)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+func cmdLog(cmd *cli.Cmd) {
+	cmd.Spec = "[-l] [-f] [-o] [-s] [-b]"
+	level := cmd.StringOpt("l level", "", "log level: debug, info, warn or error")
+	format := cmd.StringOpt("f format", "", "log format: text or json")
+	file := cmd.StringOpt("o output", "", "log file, \"-\" logs to stderr")
+	maxSize := cmd.IntOpt("s max-size", -1, "size in bytes the log file is rotated at, 0 disables rotation")
+	backups := cmd.IntOpt("b backups", -1, "number of rotated log files kept")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		settings := map[string]string{}
+		if *level != "" {
+			settings["logconf.level"] = *level
+		}
+		if *format != "" {
+			settings["logconf.format"] = *format
+		}
+		if *file == "-" {
+			settings["logconf.file"] = ""
+		} else if *file != "" {
+			settings["logconf.file"] = *file
+		}
+		if *maxSize >= 0 {
+			settings["logconf.maxsize"] = strconv.Itoa(*maxSize)
+		}
+		if *backups >= 0 {
+			settings["logconf.maxbackups"] = strconv.Itoa(*backups)
+		}
+		for k, v := range settings {
+			err = cm.SetString(k, v)
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+		}
+		lc := cm.Conf.LogConf
+		fmt.Printf("level: %s, format: %s, file: %s, max size: %d, backups: %d\n", orDefault(lc.Level, "info"), orDefault(lc.Format, "text"), orDefault(lc.File, "stderr"), lc.MaxSize, lc.MaxBackups)
+		if len(settings) == 0 {
+			return
+		}
+		err = impl.ReloadLogging()
+		if err != nil {
+			logrus.Warn(err, ", the settings apply when the daemon starts")
+		}
+	}
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -6,10 +6,9 @@ import (
 	cli "github.com/jawher/mow.cli"
 	"github.com/sirupsen/logrus"
 	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
 )
 
-var defaultHomePath = "/etc/sshx"
-
 func main() {
 	if utils.DebugOn() {
 		logrus.SetLevel(logrus.DebugLevel)
@@ -17,17 +16,68 @@ func main() {
 		logrus.SetLevel(logrus.InfoLevel)
 	}
 	app := cli.App("sshx", "a webrtc based ssh remote toolbox")
+	profile := app.StringOpt("profile", "", "configure profile of this command, the default one if empty")
+	app.Before = func() {
+		if *profile != "" {
+			// inherited by the daemon and tools started by the command
+			os.Setenv(conf.PROFILE_ENV, *profile)
+		}
+		setupOnFirstRun()
+	}
+	app.Command("init", "set up the signaling and ICE servers of this device", cmdInit)
 	app.Command("daemon", "launch a sshx daemon", cmdDaemon)
 	app.Command("conf", "list configure informations", cmdConfig)
 	app.Command("conn", "connect to remote host", cmdConnect)
 	app.Command("cpyid", "copy public key to server", cmdCopyId)
 	app.Command("scp", "copy files or directory from/to remote host", cmdCopy)
 	app.Command("proxy", "start proxy", cmdProxy)
+	app.Command("stdio", "bridge stdin and stdout to the ssh server of a device, for ssh ProxyCommand", cmdStdio)
 	app.Command("stat", "get status", cmdStatus)
-	app.Command("fs", "sshfs filesystem", cmdSSHFS)
+	app.Command("dashboard ui", "watch and manage peers, sessions, transfers and approvals in the terminal", cmdDashboard)
+	app.Command("tray", "run the agent of the notification area for desktop users", cmdTray)
+	app.Command("bench", "measure the round trip time and throughput to a device", cmdBench)
+	app.Command("perf", "measure the transports between two nodes of this process", cmdPerf)
+	app.Command("history", "list the completed sessions", cmdHistory)
+	app.Command("discover", "list the devices found on the local network", cmdDiscover)
+	app.Command("search", "find devices in the peer directory of the signaling server", cmdSearch)
+	app.Command("directory", "manage the entry of this device in the peer directory", cmdDirectory)
+	app.Command("dns", "publish and look up devices in DNS", cmdDNS)
+	app.Command("overlay", "connect over WireGuard or Tailscale networks", cmdOverlay)
+	app.Command("derp", "connect over the DERP relays of Tailscale", cmdDERP)
+	app.Command("doctor", "check the daemon, configure, servers and dependencies", cmdDoctor)
+	app.Command("fs sfs", "sshfs filesystem", cmdSSHFS)
 	app.Command("vnc", "vnc service", cmdVNCService)
+	app.Command("screenshot", "capture the desktop of a remote device, as a preview before vnc", cmdScreenshot)
 	app.Command("msg", "a message console", cmdMessage)
+	app.Command("notify", "pop a desktop notification on a remote device", cmdNotify)
 	app.Command("trans", "transfer a file", cmdTransfer)
+	app.Command("sync", "synchronize files with delta transfer", cmdSync)
+	app.Command("clip", "synchronize clipboard with remote device", cmdClipboard)
+	app.Command("rdp", "forward a local port to a remote rdp server", cmdRDP)
+	app.Command("print", "print to the printers of the network of a remote device", cmdPrint)
+	app.Command("kube", "exec into pods and forward ports of the kubernetes cluster of a remote device", cmdKube)
+	app.Command("docker", "list and exec into the containers of a remote device", cmdDocker)
+	app.Command("serial", "open the serial consoles of a remote device", cmdSerial)
+	app.Command("shell", "persistent shell sessions on a remote device", cmdShell)
+	app.Command("exec", "run a command on devices and groups of the address book at once", cmdExec)
+	app.Command("task", "run exec, pull and push tasks on a schedule", cmdTask)
+	app.Command("wol", "wake devices with wake-on-lan packets sent by a device of their network", cmdWOL)
+	app.Command("audio", "play the audio output of remote device", cmdAudio)
+	app.Command("profile", "manage configure profiles", cmdProfile)
+	app.Command("log", "configure logging of the daemon", cmdLog)
+	app.Command("debug", "show the profiling endpoints of the daemon", cmdDebug)
+	app.Command("pair", "pair with trusted devices", cmdPair)
+	app.Command("join", "issue the tokens new devices are provisioned with", cmdJoin)
+	app.Command("standby", "run an active/standby pair of daemons", cmdStandby)
+	app.Command("knock", "approve inbound sessions of the knock mode", cmdKnock)
+	app.Command("totp", "require one-time codes for inbound sessions", cmdTOTP)
+	app.Command("identity", "manage the node key and certificate of this device", cmdIdentity)
+	app.Command("ca", "certify the node keys of an organization", cmdCA)
+	app.Command("access", "manage the access rules of inbound sessions", cmdAccess)
+	app.Command("keystore", "encrypt the keys of this device", cmdKeyStore)
+	app.Command("fido", "confirm connections to sensitive peers with a FIDO2 key", cmdFIDO)
+	app.Command("session", "limit the duration of sessions", cmdSession)
+	app.Command("filedrop", "show the address of the file drop page", cmdFileDrop)
 	app.Run(os.Args)
 
 }
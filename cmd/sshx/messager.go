@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"strings"
 
 	cli "github.com/jawher/mow.cli"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
@@ -19,7 +23,7 @@ func cmdStartMessage(cmd *cli.Cmd) {
 		}
 
 		msgr := impl.NewMessager(*addr)
-		msgr.Preper()
+		msgr.Preper(context.Background())
 
 		sender := impl.NewSender(msgr, types.OPTION_TYPE_UP)
 		conn, err := sender.Send()
@@ -27,7 +31,12 @@ func cmdStartMessage(cmd *cli.Cmd) {
 			logrus.Error("cannot create messager with ", *addr, ":", err)
 			return
 		}
-		msgr.OpenChatConsole(conn)
+		conn, err = msgr.Secure(conn)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		msgr.OpenChatConsole(conn, true)
 		msgr.Close()
 	}
 }
@@ -42,7 +51,7 @@ func cmdAttachMessage(cmd *cli.Cmd) {
 		}
 
 		msgr := impl.NewMessager("")
-		msgr.Preper()
+		msgr.Preper(context.Background())
 
 		sender := impl.NewSender(msgr, types.OPTION_TYPE_ATTACH)
 		sender.PairId = []byte(*pairId)
@@ -52,13 +61,194 @@ func cmdAttachMessage(cmd *cli.Cmd) {
 			return
 		}
 		updateMsgr := sender.GetImpl().(*impl.Messager)
-		updateMsgr.OpenChatConsole(conn)
+		// the daemon saves the messages of attached consoles
+		updateMsgr.OpenChatConsole(conn, false)
 		updateMsgr.Close()
 	}
 }
 
+func cmdMessageHistory(cmd *cli.Cmd) {
+	cmd.Spec = "[-n] ADDR"
+	lines := cmd.IntOpt("n lines", 0, "number of last messages to show, 0 shows all")
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	cmd.Action = func() {
+		entries, err := impl.LoadHistory(*addr, *lines)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		impl.ShowHistory(entries)
+	}
+}
+
+func cmdSearchMessage(cmd *cli.Cmd) {
+	cmd.Spec = "[-p] QUERY"
+	peer := cmd.StringOpt("p peer", "", "only search messages of this device")
+	query := cmd.StringArg("QUERY", "", "text to search, case is ignored")
+	cmd.Action = func() {
+		entries, err := impl.SearchHistory(*peer, *query)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		impl.ShowHistory(entries)
+	}
+}
+
+func cmdGroupAdd(cmd *cli.Cmd) {
+	cmd.Spec = "GROUP ADDR..."
+	group := cmd.StringArg("GROUP", "", "group name")
+	addrs := cmd.StringsArg("ADDR", nil, "remote device ids")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err == nil {
+			err = cm.AddToGroup(*group, *addrs...)
+		}
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdGroupRemove(cmd *cli.Cmd) {
+	cmd.Spec = "GROUP [ADDR...]"
+	group := cmd.StringArg("GROUP", "", "group name")
+	addrs := cmd.StringsArg("ADDR", nil, "remote device ids, the whole group is removed if empty")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err == nil {
+			err = cm.RemoveFromGroup(*group, *addrs...)
+		}
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdGroupList(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		groups := cm.Groups()
+		names := make([]string, 0, len(groups))
+		for k := range groups {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, v := range names {
+			fmt.Printf("%s:\t%s\n", v, strings.Join(groups[v], " "))
+		}
+	}
+}
+
+func cmdGroupChat(cmd *cli.Cmd) {
+	cmd.Spec = "GROUP"
+	group := cmd.StringArg("GROUP", "", "group name")
+	cmd.Action = func() {
+		gc := impl.NewGroupChat(*group)
+		err := gc.Connect()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		gc.OpenConsole()
+		gc.Close()
+	}
+}
+
+func cmdGroupSend(cmd *cli.Cmd) {
+	cmd.Spec = "GROUP MESSAGE"
+	group := cmd.StringArg("GROUP", "", "group name")
+	text := cmd.StringArg("MESSAGE", "", "message to broadcast")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		members := cm.GroupMembers(*group)
+		if len(members) == 0 {
+			fmt.Println("group", *group, "has no members")
+			return
+		}
+		for _, id := range members {
+			sendMessage(id, *group, *text)
+		}
+	}
+}
+
+// sendMessage delivers a message, peers which are offline get it once they
+// are reachable again
+func sendMessage(peerId, group, text string) {
+	queued, err := impl.SendOrQueue(peerId, group, text)
+	switch {
+	case err != nil:
+		logrus.Error("cannot send to ", peerId, ": ", err)
+	case queued:
+		fmt.Println(peerId, "is offline, the message was queued")
+	default:
+		fmt.Println("delivered to", peerId)
+	}
+}
+
+func cmdSendMessage(cmd *cli.Cmd) {
+	cmd.Spec = "ADDR MESSAGE"
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	text := cmd.StringArg("MESSAGE", "", "message to send")
+	cmd.Action = func() {
+		sendMessage(*addr, "", *text)
+	}
+}
+
+func cmdMessageOutbox(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		err := impl.ShowOutbox()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdMessageKeys(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		err := impl.ShowMessageKeys()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdForgetMessageKey(cmd *cli.Cmd) {
+	cmd.Spec = "ADDR"
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	cmd.Action = func() {
+		err := impl.ForgetPeerKey(*addr)
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdMessageGroup(cmd *cli.Cmd) {
+	cmd.Command("add", "add devices to a group", cmdGroupAdd)
+	cmd.Command("remove", "remove devices from a group", cmdGroupRemove)
+	cmd.Command("list", "list groups and their members", cmdGroupList)
+	cmd.Command("chat", "open a chat console with a group", cmdGroupChat)
+	cmd.Command("send", "broadcast a message to a group", cmdGroupSend)
+}
+
 func cmdMessage(cmd *cli.Cmd) {
 	cmd.Command("start", "start message service", cmdStartMessage)
 	cmd.Command("attach", "attach a message service service", cmdAttachMessage)
+	cmd.Command("send", "send a message, queued until delivered if the device is offline", cmdSendMessage)
+	cmd.Command("outbox", "list messages waiting for offline devices", cmdMessageOutbox)
+	cmd.Command("history", "show saved messages of a remote device", cmdMessageHistory)
+	cmd.Command("search", "search saved messages", cmdSearchMessage)
+	cmd.Command("group", "message groups of the address book", cmdMessageGroup)
+	cmd.Command("keys", "show the message key fingerprints of this and known devices", cmdMessageKeys)
+	cmd.Command("forget", "forget the pinned message key of a device", cmdForgetMessageKey)
 	// cmd.Command("stop", "stop proxy service", cmdStopMessage)
 }
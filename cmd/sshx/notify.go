@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+func cmdNotify(cmd *cli.Cmd) {
+	cmd.Spec = "[-t] ADDR [MESSAGE...]"
+	title := cmd.StringOpt("t title", "", "title of the notification, after the name of this device")
+	addr := cmd.StringArg("ADDR", "", "remote device id or name")
+	words := cmd.StringsArg("MESSAGE", nil, "text of the notification, read from stdin if it is not given")
+	cmd.Action = func() {
+		msg := strings.Join(*words, " ")
+		if len(*words) == 0 {
+			data, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				logrus.Error(err)
+				cli.Exit(1)
+			}
+			msg = string(data)
+		}
+		if strings.TrimSpace(msg) == "" {
+			logrus.Error("empty notification")
+			cli.Exit(1)
+		}
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		imp := impl.NewNotify(cm.ResolvePeer(*addr), impl.NotifyRequest{
+			Title:   *title,
+			Message: msg,
+		})
+		err = imp.Preper(context.Background())
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+		conn, err := sender.Send()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		imp.SetConn(conn)
+		err = imp.Do()
+		imp.Close()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/conn"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+func cmdOverlay(cmd *cli.Cmd) {
+	cmd.Command("status", "show the overlay addresses of this and remote devices", cmdOverlayStatus)
+	cmd.Command("set", "set the overlay address of a remote device", cmdOverlaySet)
+}
+
+func cmdOverlayStatus(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		oc := cm.Conf.OverlayConf
+		if !oc.Enabled {
+			fmt.Println("the overlay is disabled, set overlayconf.enabled to true and restart the daemon")
+			return
+		}
+		addrs := conn.NewOverlayService(cm.Conf.ID, oc).LocalAddrs()
+		if len(addrs) == 0 {
+			fmt.Println("this device is on no overlay network, sessions go over WebRTC")
+		}
+		for _, v := range addrs {
+			fmt.Println("this device:", net.JoinHostPort(v.String(), fmt.Sprint(oc.Port)))
+		}
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"Name", "ID", "Overlay Address"})
+		t.AppendSeparator()
+		for _, p := range cm.Conf.AddressBook {
+			if p.Overlay != "" {
+				t.AppendRows([]table.Row{{p.Name, p.ID, p.Overlay}})
+			}
+		}
+		t.AppendSeparator()
+		t.Render()
+	}
+}
+
+func cmdOverlaySet(cmd *cli.Cmd) {
+	cmd.Spec = "ID [ADDR]"
+	id := cmd.StringArg("ID", "", "device ID or address book name")
+	addr := cmd.StringArg("ADDR", "", "overlay address or name of the device, empty to forget it")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		peer := cm.ResolvePeer(*id)
+		p := cm.FindPeer(peer)
+		if p == nil {
+			cm.Conf.AddressBook = append(cm.Conf.AddressBook, conf.Peer{ID: peer})
+			p = &cm.Conf.AddressBook[len(cm.Conf.AddressBook)-1]
+		}
+		p.Overlay = *addr
+		err = cm.SaveAddressBook()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+func cmdPairCode(cmd *cli.Cmd) {
+	cmd.Spec = "[-t] [--totp]"
+	ttl := cmd.IntOpt("t ttl", 300, "seconds the code is valid")
+	totp := cmd.BoolOpt("totp", false, "require one-time codes of the device pairing for its sessions")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		res, err := impl.NewPairingCode(time.Duration(*ttl)*time.Second, *totp)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("pairing code:", res.Code)
+		fmt.Println("on the other device run: sshx pair join", cm.Conf.ID, res.Code)
+		fmt.Println("valid once until", res.Expires.Format("15:04:05"))
+	}
+}
+
+func cmdPairJoin(cmd *cli.Cmd) {
+	cmd.Spec = "ADDR CODE"
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	code := cmd.StringArg("CODE", "", "pairing code shown by the remote device")
+	cmd.Action = func() {
+		res, err := impl.PairWith(*addr, *code)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("paired with", *addr, res.Fingerprint)
+		if res.TOTPURI == "" {
+			return
+		}
+		showTOTPURI(res.TOTPURI)
+		err = promptTOTP(*addr)
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdPairList(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		err := impl.ShowMessageKeys()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdPairRemove(cmd *cli.Cmd) {
+	cmd.Spec = "ADDR"
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	cmd.Action = func() {
+		err := impl.ForgetPeerKey(*addr)
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdPairRevoke(cmd *cli.Cmd) {
+	cmd.Spec = "ADDR"
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	cmd.Action = func() {
+		closed, err := impl.Revoke(*addr)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("revoked", *addr+",", closed, "connections closed")
+	}
+}
+
+func cmdPair(cmd *cli.Cmd) {
+	cmd.Command("code", "show a one-time code another device pairs with", cmdPairCode)
+	cmd.Command("join", "pair with a device using the code it shows", cmdPairJoin)
+	cmd.Command("list", "show the identity keys of this and paired devices", cmdPairList)
+	cmd.Command("remove", "unpair a device", cmdPairRemove)
+	cmd.Command("revoke", "refuse a device and close its connections", cmdPairRevoke)
+}
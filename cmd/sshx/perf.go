@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/conn"
+)
+
+func cmdPerf(cmd *cli.Cmd) {
+	cmd.Spec = "[-T...] [-n] [-s] [-c] [--json]"
+	transports := cmd.StringsOpt("T transport", conn.PerfTransports, "transports measured: "+strings.Join(conn.PerfTransports, ", "))
+	pings := cmd.IntOpt("n pings", 100, "number of round trips measured")
+	size := cmd.IntOpt("s size", 64, "MiB sent to measure the throughput")
+	tunnels := cmd.IntOpt("c tunnels", 0, "measure the goroutines and memory of this many concurrent tunnels instead")
+	asJSON := cmd.BoolOpt("json", false, "print the results as JSON")
+	cmd.Action = func() {
+		if *tunnels > 0 {
+			res, err := conn.RunTunnels(*tunnels)
+			if err != nil {
+				logrus.Error(err)
+				cli.Exit(1)
+			}
+			if *asJSON {
+				bs, _ := json.MarshalIndent(res, "", "  ")
+				fmt.Println(string(bs))
+				return
+			}
+			fmt.Printf("%d tunnels opened in %.0f ms: %d goroutines, %.1f per tunnel, %s per tunnel\n",
+				res.Tunnels, res.Setup, res.Goroutines, res.GoroutinesPerTunnel, humanBytes(int64(res.MemoryPerTunnel)))
+			return
+		}
+		results := make([]conn.PerfResult, 0, len(*transports))
+		failed := false
+		for _, v := range *transports {
+			res, err := conn.RunPerf(v, *pings, int64(*size)<<20)
+			if err != nil {
+				logrus.Error(v, ": ", err)
+				failed = true
+				continue
+			}
+			results = append(results, res)
+		}
+		if *asJSON {
+			bs, _ := json.MarshalIndent(results, "", "  ")
+			fmt.Println(string(bs))
+		} else {
+			for _, v := range results {
+				fmt.Printf("%-13s setup %8.2f ms  rtt min %.3f ms, median %.3f ms, p99 %.3f ms  throughput %s\n",
+					v.Transport, v.Setup, v.RTTMin, v.RTTMedian, v.RTTP99, humanRate(v.Rate))
+			}
+		}
+		if failed {
+			cli.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// listPrinters returns the printers of the remote device addr this device
+// may print to
+func listPrinters(addr string) ([]impl.PrinterInfo, error) {
+	imp := impl.NewPrint(0, addr, impl.PrintRequest{List: true})
+	err := imp.Preper(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+	conn, err := sender.Send()
+	if err != nil {
+		return nil, err
+	}
+	imp.SetConn(conn)
+	defer imp.Close()
+	return imp.DoList()
+}
+
+func cmdPrintList(cmd *cli.Cmd) {
+	cmd.Spec = "ADDR"
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	cmd.Action = func() {
+		printers, err := listPrinters(*addr)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		for _, v := range printers {
+			fmt.Println(v.Name, v.URI)
+		}
+	}
+}
+
+func cmdStopPrint(cmd *cli.Cmd) {
+	cmd.Spec = "PID"
+	pairId := cmd.StringArg("PID", "", "Connection pair id which can found by using status command")
+	cmd.Action = func() {
+		imp := impl.NewPrint(0, "", impl.PrintRequest{})
+		imp.NoNeedConnect()
+		sender := impl.NewSender(imp, types.OPTION_TYPE_DOWN)
+		sender.PairId = []byte(*pairId)
+		sender.SendDetach()
+	}
+}
+
+func cmdStartPrint(cmd *cli.Cmd) {
+	cmd.Spec = "[-p] [-q] ADDR PRINTER"
+	port := cmd.IntOpt("p port", 6310, "local port print jobs are sent to")
+	queue := cmd.StringOpt("q queue", "", "add a CUPS print queue of this name while forwarding")
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	printer := cmd.StringArg("PRINTER", "", "printer of the remote device, see 'sshx print list'")
+	cmd.Action = func() {
+		printers, err := listPrinters(*addr)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		var info *impl.PrinterInfo
+		for i := range printers {
+			if printers[i].Name == *printer {
+				info = &printers[i]
+			}
+		}
+		if info == nil {
+			logrus.Error("no printer ", *printer, " on ", *addr)
+			return
+		}
+		imp := impl.NewPrint(int32(*port), *addr, impl.PrintRequest{Printer: *printer})
+		imp.Preper(context.Background())
+		imp.NoNeedConnect()
+
+		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+		_, err = sender.SendDetach()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		// connections to the printer are children of this pair
+		imp.SetPairId(string(sender.PairId))
+		err = imp.Listen()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		uri := imp.LocalURI(*info)
+		fmt.Println("printer", *printer, "of", imp.HostId(), "at", uri)
+		if *queue != "" {
+			err = impl.AddPrintQueue(*queue, uri)
+			if err != nil {
+				logrus.Error(err)
+			} else {
+				fmt.Println("print queue", *queue, "added")
+				defer impl.RemovePrintQueue(*queue)
+			}
+		}
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt)
+		go func() {
+			<-c
+			imp.Close()
+			closeSender := impl.NewSender(imp, types.OPTION_TYPE_DOWN)
+			closeSender.PairId = []byte(imp.PairId())
+			closeSender.SendDetach()
+		}()
+		err = imp.Start()
+		if err != nil {
+			logrus.Error(err)
+		}
+		imp.Close()
+	}
+}
+
+func cmdPrint(cmd *cli.Cmd) {
+	cmd.Command("list", "list the printers of a remote device", cmdPrintList)
+	cmd.Command("start", "forward a local port to a printer of the network of a remote device", cmdStartPrint)
+	cmd.Command("stop", "stop print forwarding", cmdStopPrint)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+func cmdListProfile(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		root := getRootPath()
+		active := conf.ActiveProfile(root)
+		for _, v := range conf.Profiles(root) {
+			mark := " "
+			if v == active {
+				mark = "*"
+			}
+			fmt.Println(mark, v)
+		}
+	}
+}
+
+func cmdUseProfile(cmd *cli.Cmd) {
+	cmd.Spec = "NAME"
+	name := cmd.StringArg("NAME", "", "profile name, default for the default configure")
+	cmd.Action = func() {
+		err := conf.SetDefaultProfile(getRootPath(), *name)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Printf("default profile is %s, restart the daemon to apply it\n", *name)
+	}
+}
+
+func cmdCreateProfile(cmd *cli.Cmd) {
+	cmd.Spec = "[-f] NAME"
+	from := cmd.StringOpt("f from", "", "profile to copy, the active one by default")
+	name := cmd.StringArg("NAME", "", "profile name")
+	cmd.Action = func() {
+		root := getRootPath()
+		if *from == "" {
+			// creates the configure of the active profile if missing
+			cm, err := conf.NewConfManager(root)
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+			*from = cm.Profile
+		}
+		err := conf.CreateProfile(root, *name, *from)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("profile", *name, "created from", *from)
+	}
+}
+
+func cmdRemoveProfile(cmd *cli.Cmd) {
+	cmd.Spec = "NAME"
+	name := cmd.StringArg("NAME", "", "profile name")
+	cmd.Action = func() {
+		err := conf.RemoveProfile(getRootPath(), *name)
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdProfile(cmd *cli.Cmd) {
+	cmd.Command("list", "list configure profiles, the active one is marked", cmdListProfile)
+	cmd.Command("use", "set the default profile", cmdUseProfile)
+	cmd.Command("create", "create a profile from a copy of another", cmdCreateProfile)
+	cmd.Command("remove", "remove a profile", cmdRemoveProfile)
+}
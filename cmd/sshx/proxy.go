@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	cli "github.com/jawher/mow.cli"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
@@ -21,26 +24,66 @@ func cmdStopProxy(cmd *cli.Cmd) {
 	}
 }
 
+// startProxy registers a proxy to the ssh server of id with the daemon and
+// serves it on the local port in the background until it is closed, it
+// returns the proxy and the pair ID of its session
+func startProxy(cm *conf.ConfManager, id string, port int) (*impl.Proxy, string, error) {
+	proxy := impl.NewProxy(int32(port), id)
+	proxy.SetWarm(int(cm.Conf.ProxyConf.Warm), time.Duration(cm.Conf.ProxyConf.WarmIdle)*time.Second)
+	err := proxy.Preper(context.Background())
+	if err != nil {
+		return nil, "", err
+	}
+	proxy.NoNeedConnect()
+	// a port in use fails before the daemon knows the proxy
+	err = proxy.Listen()
+	if err != nil {
+		return nil, "", err
+	}
+	sender := impl.NewSender(proxy, types.OPTION_TYPE_UP)
+	_, err = sender.SendDetach()
+	if err != nil {
+		proxy.Close()
+		return nil, "", err
+	}
+	go proxy.Start()
+	return proxy, string(sender.PairId), nil
+}
+
 func cmdStartProxy(cmd *cli.Cmd) {
 	// cmd.Spec = "-P [-d] ADDR"
-	cmd.Spec = "-P ADDR"
-	proxyPort := cmd.IntOpt("P", 0, "local proxy port")
+	cmd.Spec = "[-P] [ADDR]"
+	proxyPort := cmd.IntOpt("P", 0, "local proxy port, proxyconf.port by default")
 	// detach := cmd.BoolOpt("d", false, "detach process")
-	addr := cmd.StringArg("ADDR", "", "remote target address [username]@[host]:[port]")
+	addr := cmd.StringArg("ADDR", "", "remote target address [username]@[host]:[port], proxyconf.target by default")
 	cmd.Action = func() {
-		if proxyPort == nil || *proxyPort == 0 {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if *proxyPort == 0 {
+			*proxyPort = int(cm.Conf.ProxyConf.Port)
+		}
+		if *addr == "" {
+			*addr = cm.Conf.ProxyConf.Target
+		}
+		if *proxyPort == 0 {
 			fmt.Println("please set a proxy port")
+			return
 		}
-		if addr == nil || *addr == "" {
+		if *addr == "" {
 			fmt.Println("please set a remote device")
+			return
 		}
 
-		proxy := impl.NewProxy(int32(*proxyPort), *addr)
-		proxy.Preper()
+		proxy := impl.NewProxy(int32(*proxyPort), cm.ResolvePeer(*addr))
+		proxy.SetWarm(int(cm.Conf.ProxyConf.Warm), time.Duration(cm.Conf.ProxyConf.WarmIdle)*time.Second)
+		proxy.Preper(context.Background())
 		proxy.NoNeedConnect()
 
 		sender := impl.NewSender(proxy, types.OPTION_TYPE_UP)
-		_, err := sender.SendDetach()
+		_, err = sender.SendDetach()
 		if err != nil {
 			logrus.Error(err)
 		}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+func cmdStopRDP(cmd *cli.Cmd) {
+	cmd.Spec = "PID"
+	pairId := cmd.StringArg("PID", "", "Connection pair id which can found by using status command")
+	cmd.Action = func() {
+		imp := impl.NewRDP(0, "")
+		imp.NoNeedConnect()
+		sender := impl.NewSender(imp, types.OPTION_TYPE_DOWN)
+		sender.PairId = []byte(*pairId)
+		sender.SendDetach()
+	}
+}
+
+func cmdStartRDP(cmd *cli.Cmd) {
+	cmd.Spec = "[-p] [-o] ADDR"
+	port := cmd.IntOpt("p port", 13389, "local port the rdp client connects to")
+	open := cmd.BoolOpt("o open", false, "launch the rdp client of this platform")
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	cmd.Action = func() {
+		if *addr == "" {
+			fmt.Println("please set a remote device")
+			return
+		}
+		imp := impl.NewRDP(int32(*port), *addr)
+		imp.Preper(context.Background())
+		imp.NoNeedConnect()
+
+		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+		_, err := sender.SendDetach()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		// connections to the remote server are children of this pair
+		imp.SetPairId(string(sender.PairId))
+		err = imp.Listen()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt)
+		go func() {
+			<-c
+			imp.Close()
+			closeSender := impl.NewSender(imp, types.OPTION_TYPE_DOWN)
+			closeSender.PairId = []byte(imp.PairId())
+			closeSender.SendDetach()
+		}()
+		if *open {
+			err = impl.LaunchRDPClient(int32(*port))
+			if err != nil {
+				logrus.Error(err)
+			}
+		}
+		err = imp.Start()
+		if err != nil {
+			logrus.Error(err)
+		}
+		imp.Close()
+	}
+}
+
+func cmdRDP(cmd *cli.Cmd) {
+	cmd.Command("start", "forward a local port to the rdp server of a remote device", cmdStartRDP)
+	cmd.Command("stop", "stop rdp forwarding", cmdStopRDP)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+func cmdRemoteKeygen(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		pub, err := conf.GenerateAdminKey()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("set remoteconf.publickey of the devices to", pub)
+	}
+}
+
+func cmdRemoteSign(cmd *cli.Cmd) {
+	cmd.Spec = "[-s] [-o] FILE"
+	serial := cmd.IntOpt("s serial", 0, "serial of the overlay, the current time by default")
+	output := cmd.StringOpt("o output", "", "write the signed overlay to a file")
+	file := cmd.StringArg("FILE", "", "configure file holding the settings of the overlay")
+	cmd.Action = func() {
+		o, err := conf.NewOverlay(*file, int64(*serial))
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		bs, err := conf.SignOverlay(o)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if *output == "" {
+			fmt.Println(string(bs))
+			return
+		}
+		err = ioutil.WriteFile(*output, bs, 0644)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("signed overlay", o.Serial, "written to", *output)
+	}
+}
+
+func cmdRemotePublish(cmd *cli.Cmd) {
+	cmd.Spec = "FILE"
+	file := cmd.StringArg("FILE", "", "signed overlay")
+	cmd.Action = func() {
+		bs, err := ioutil.ReadFile(*file)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		err = impl.PublishOverlay(bs)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println("devices with remoteconf.adminpeer set to this device fetch the overlay")
+	}
+}
+
+func cmdRemotePull(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		changed, err := impl.PullOverlay()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if !changed {
+			fmt.Println("overlay is up to date")
+			return
+		}
+		fmt.Println("overlay applied, restart the daemon to apply signaling and ICE settings")
+	}
+}
+
+func cmdRemoteShow(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		o, err := cm.AppliedOverlay()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if o == nil {
+			fmt.Println("no overlay applied")
+			return
+		}
+		bs, _ := json.MarshalIndent(o.Config, "", "  ")
+		fmt.Println("overlay", o.Serial)
+		fmt.Println(string(bs))
+	}
+}
+
+func cmdRemoteClear(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		err = cm.RemoveOverlay()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdRemote(cmd *cli.Cmd) {
+	cmd.Command("keygen", "create the signing key of a fleet admin", cmdRemoteKeygen)
+	cmd.Command("sign", "sign a configure overlay with the admin key", cmdRemoteSign)
+	cmd.Command("publish", "serve a signed overlay to the devices of the fleet", cmdRemotePublish)
+	cmd.Command("pull", "fetch and apply the overlay now", cmdRemotePull)
+	cmd.Command("show", "show the applied overlay", cmdRemoteShow)
+	cmd.Command("clear", "remove the applied overlay", cmdRemoteClear)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	cli "github.com/jawher/mow.cli"
 	"github.com/sirupsen/logrus"
 	"github.com/suutaku/sshx/pkg/impl"
@@ -11,7 +12,7 @@ func cmdCopy(cmd *cli.Cmd) {
 	cmd.Spec = "[ -i ] SRC DEST"
 	srcPath := cmd.StringArg("SRC", "", "[username]@[host]:/path")
 	destPath := cmd.StringArg("DEST", "", "[username]@[host]:/path")
-	ident := cmd.StringOpt("i identification", "", "a private path, default empty for ~/.ssh/id_rsa")
+	ident := cmd.StringOpt("i identification", "", "a private key path, sshconf.identityfile or ~/.ssh/id_rsa by default")
 	cmd.Action = func() {
 		if srcPath == nil || *destPath == "" {
 			return
@@ -20,7 +21,7 @@ func cmdCopy(cmd *cli.Cmd) {
 			return
 		}
 		imp := impl.NewSCP(*srcPath, *destPath, *ident)
-		err := imp.Preper()
+		err := imp.Preper(context.Background())
 		if err != nil {
 			logrus.Error(err)
 			return
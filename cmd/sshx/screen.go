@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/jedib0t/go-pretty/v6/text"
+	"github.com/suutaku/sshx/internal/utils"
+	"golang.org/x/term"
+)
+
+// Keys of the dashboard, as a raw terminal sends them
+const (
+	keyUp        = "\x1b[A"
+	keyDown      = "\x1b[B"
+	keyRight     = "\x1b[C"
+	keyLeft      = "\x1b[D"
+	keyBackTab   = "\x1b[Z"
+	keyEscape    = "\x1b"
+	keyEnter     = "\r"
+	keyTab       = "\t"
+	keyCtrlC     = "\x03"
+	keyBackspace = "\x7f"
+)
+
+// screen draws full screen frames on a raw terminal, on the alternate
+// screen so the shell gets its lines back afterwards
+type screen struct {
+	out   *bufio.Writer
+	state *term.State
+}
+
+func newScreen() *screen {
+	return &screen{out: bufio.NewWriter(os.Stdout)}
+}
+
+// enter sets the terminal raw and switches to the alternate screen
+func (s *screen) enter() error {
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	s.state = state
+	s.out.WriteString("\x1b[?1049h\x1b[?25l")
+	return s.out.Flush()
+}
+
+// leave gives the terminal back as it was
+func (s *screen) leave() {
+	if s.state == nil {
+		return
+	}
+	s.out.WriteString("\x1b[?25h\x1b[?1049l")
+	s.out.Flush()
+	term.Restore(int(os.Stdin.Fd()), s.state)
+	s.state = nil
+}
+
+// size returns the columns and rows of the terminal
+func (s *screen) size() (int, int) {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		return 80, 24
+	}
+	return width, height
+}
+
+// draw writes lines from the top of the screen, trimmed to its width, and
+// clears the rest
+func (s *screen) draw(lines []string) {
+	width, height := s.size()
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+	s.out.WriteString("\x1b[H")
+	for i, v := range lines {
+		if n := strings.IndexByte(v, '\n'); n >= 0 {
+			v = v[:n]
+		}
+		s.out.WriteString(text.Trim(v, width))
+		s.out.WriteString("\x1b[K")
+		if i < len(lines)-1 {
+			s.out.WriteString("\r\n")
+		}
+	}
+	s.out.WriteString("\x1b[J")
+	s.out.Flush()
+}
+
+// readKeys reads what the terminal sends once each time next is signaled,
+// a key or an escape sequence by read, so no read is pending when the
+// terminal is handed over to a command
+func readKeys(next <-chan struct{}, keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 64)
+	for range next {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		keys <- string(buf[:n])
+	}
+}
+
+// formatRate formats a throughput in bytes per second
+func formatRate(rate float64) string {
+	if rate < 1 {
+		return "-"
+	}
+	return utils.FormatByteSize(int64(rate)) + "/s"
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// writeScreenshot replaces path with data, viewers watching the file never
+// read half of it
+func writeScreenshot(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func cmdScreenshot(cmd *cli.Cmd) {
+	cmd.Spec = "[-o] [-w] [-q] [-i] ADDR"
+	output := cmd.StringOpt("o output", "", "JPEG file written, NAME-TIME.jpg or NAME.jpg with -i by default")
+	width := cmd.IntOpt("w width", 0, "scale the screenshots down to this width, 0 for the size of the screen")
+	quality := cmd.IntOpt("q quality", 0, "JPEG quality from 1 to 100")
+	interval := cmd.IntOpt("i interval", 0, "replace the file with a new screenshot every this many seconds until interrupted")
+	addr := cmd.StringArg("ADDR", "", "remote device id or name")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		id := cm.ResolvePeer(*addr)
+		name := cm.PeerName(id)
+		if *output == "" {
+			*output = name + ".jpg"
+			if *interval == 0 {
+				*output = fmt.Sprintf("%s-%s.jpg", name, time.Now().Format("20060102-150405"))
+			}
+		}
+		imp := impl.NewScreenshot(id, impl.ScreenshotRequest{
+			Width:    int32(*width),
+			Quality:  int32(*quality),
+			Interval: int32(*interval),
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		go func() {
+			<-sig
+			cancel()
+		}()
+		err = imp.Preper(ctx)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+		conn, err := sender.SendContext(ctx)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		imp.SetConn(conn)
+		err = imp.DoCapture(ctx, func(f impl.ScreenshotFrame) error {
+			err := writeScreenshot(*output, f.JPEG)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s: %dx%d screen at %s, saved to %s\n", name, f.Width, f.Height, f.Time.Format("15:04:05"), *output)
+			return nil
+		})
+		imp.Close()
+		if err != nil && ctx.Err() == nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/serial"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+func cmdSerialList(cmd *cli.Cmd) {
+	cmd.Spec = "ADDR"
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	cmd.Action = func() {
+		imp := impl.NewSerial(*addr, impl.SerialRequest{})
+		err := imp.Preper(context.Background())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+		conn, err := sender.Send()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		imp.SetConn(conn)
+		devices, err := imp.DoList()
+		imp.Close()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		for _, v := range devices {
+			fmt.Println(v)
+		}
+	}
+}
+
+func cmdSerialOpen(cmd *cli.Cmd) {
+	cmd.Spec = "[-b] [-f] [--rtscts] [--otp] ADDR DEVICE"
+	baud := cmd.IntOpt("b baud", 0, "speed, serialconf.baud of the remote device by default")
+	framing := cmd.StringOpt("f framing", "8N1", "data bits, parity (N, E or O) and stop bits")
+	rtscts := cmd.BoolOpt("rtscts", false, "enable hardware flow control")
+	otp := cmd.StringOpt("otp", "", "one-time code asked by the remote device")
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	device := cmd.StringArg("DEVICE", "", "serial device of the remote device, as /dev/ttyUSB0")
+	cmd.Action = func() {
+		mode := serial.Mode{Baud: *baud, RTSCTS: *rtscts}
+		err := mode.ParseFraming(*framing)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		imp := impl.NewSerial(*addr, impl.SerialRequest{Device: *device, Mode: mode})
+		err = imp.Preper(context.Background())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		imp.SetOneTimeCode(oneTimeCode(imp.HostId(), *otp))
+		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+		conn, err := sender.Send()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		imp.SetConn(conn)
+		err = imp.DoConsole()
+		imp.Close()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdSerial(cmd *cli.Cmd) {
+	cmd.Command("list", "list the serial devices of a remote device", cmdSerialList)
+	cmd.Command("open", "open the console of a serial device of a remote device", cmdSerialOpen)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+func showSessionLimits(cm *conf.ConfManager) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"#", "Peers", "Applications", "Max duration"})
+	t.AppendSeparator()
+	for i, l := range cm.Conf.SessionConf.Limits {
+		max := "unlimited"
+		if l.MaxDuration > 0 {
+			max = (time.Duration(l.MaxDuration) * time.Second).String()
+		}
+		t.AppendRows([]table.Row{{i, strings.Join(l.Peers, ","), strings.Join(l.Apps, ","), max}})
+	}
+	t.Render()
+	fmt.Println("sessions are warned", cm.SessionWarning(), "before they expire")
+}
+
+func cmdSessionList(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		showSessionLimits(cm)
+	}
+}
+
+func cmdSessionAdd(cmd *cli.Cmd) {
+	cmd.Spec = "[-i] PEERS APPS DURATION"
+	index := cmd.IntOpt("i index", -1, "insert the limit before the limit at index, at the end by default")
+	peers := cmd.StringArg("PEERS", "", "comma separated peer IDs, names, group:NAME or *")
+	apps := cmd.StringArg("APPS", "", "comma separated applications as ssh,vnc,transfer or *")
+	duration := cmd.StringArg("DURATION", "", "maximum duration as 2h or 30m, 0 for no limit")
+	cmd.Action = func() {
+		max, err := time.ParseDuration(*duration)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		err = cm.AddSessionLimit(conf.SessionLimit{
+			Peers:       strings.Split(*peers, ","),
+			Apps:        strings.Split(*apps, ","),
+			MaxDuration: int(max / time.Second),
+		}, *index)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		showSessionLimits(cm)
+	}
+}
+
+func cmdSessionRemove(cmd *cli.Cmd) {
+	cmd.Spec = "INDEX"
+	index := cmd.IntArg("INDEX", 0, "index of the limit, shown by 'sshx session list'")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		err = cm.RemoveSessionLimit(*index)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		showSessionLimits(cm)
+	}
+}
+
+func cmdSession(cmd *cli.Cmd) {
+	cmd.Command("list", "show the session limits", cmdSessionList)
+	cmd.Command("add", "limit the duration of sessions", cmdSessionAdd)
+	cmd.Command("remove", "remove a session limit", cmdSessionRemove)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// sendShell sends a shell request to the daemon and sets the connection of
+// imp
+func sendShell(imp *impl.Shell, option int32) error {
+	sender := impl.NewSender(imp, option)
+	conn, err := sender.Send()
+	if err != nil {
+		return err
+	}
+	imp.SetConn(conn)
+	return nil
+}
+
+func cmdShellList(cmd *cli.Cmd) {
+	cmd.Spec = "ADDR"
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	cmd.Action = func() {
+		imp := impl.NewShell(*addr, impl.ShellRequest{})
+		err := imp.Preper(context.Background())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		err = sendShell(imp, types.OPTION_TYPE_UP)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		list, err := imp.DoList()
+		imp.Close()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"Name", "Command", "Started", "State"})
+		t.AppendSeparator()
+		for _, v := range list {
+			state := "detached"
+			if v.Exited {
+				state = "exited"
+			} else if v.Attached {
+				state = "attached"
+			}
+			t.AppendRows([]table.Row{{v.Name, v.Command, v.Started.Format("2006-01-02 15:04:05"), state}})
+		}
+		t.AppendSeparator()
+		t.Render()
+	}
+}
+
+// runShell attaches to a session, attaching again over new connections
+// while the remote device is unreachable, and exits with the exit code of
+// its command
+func runShell(addr, otp string, req impl.ShellRequest) {
+	imp := impl.NewShell(addr, req)
+	err := imp.Preper(context.Background())
+	if err != nil {
+		logrus.Error(err)
+		cli.Exit(1)
+	}
+	imp.SetOneTimeCode(oneTimeCode(imp.HostId(), otp))
+	option := int32(types.OPTION_TYPE_UP)
+	if req.Attach {
+		option = types.OPTION_TYPE_ATTACH
+	}
+	err = sendShell(imp, option)
+	if err != nil {
+		logrus.Error(err)
+		cli.Exit(1)
+	}
+	code, err := imp.DoShell(func() (net.Conn, error) {
+		err := sendShell(imp, types.OPTION_TYPE_ATTACH)
+		if err != nil {
+			return nil, err
+		}
+		return imp.Conn(), nil
+	})
+	imp.Close()
+	if errors.Is(err, impl.ErrDetached) {
+		fmt.Printf("\r\n[detached from %s]\n", imp.HostId())
+		cli.Exit(0)
+	}
+	if err != nil {
+		fmt.Print("\r\n")
+		logrus.Error(err)
+		cli.Exit(1)
+	}
+	cli.Exit(code)
+}
+
+func cmdShellOpen(cmd *cli.Cmd) {
+	cmd.Spec = "[-n] [--otp] ADDR [CMD...]"
+	name := cmd.StringOpt("n name", "", "name of the session, default by default")
+	otp := cmd.StringOpt("otp", "", "one-time code asked by the remote device")
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	command := cmd.StringsArg("CMD", nil, "command of a new session, shellconf.shell of the remote device by default, put -- before it if it has options")
+	cmd.Action = func() {
+		runShell(*addr, *otp, impl.ShellRequest{
+			Name:    *name,
+			Command: *command,
+		})
+	}
+}
+
+func cmdShellAttach(cmd *cli.Cmd) {
+	cmd.Spec = "[--otp] ADDR [NAME]"
+	otp := cmd.StringOpt("otp", "", "one-time code asked by the remote device")
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	name := cmd.StringArg("NAME", "", "name of the session, default by default")
+	cmd.Action = func() {
+		runShell(*addr, *otp, impl.ShellRequest{
+			Name:   *name,
+			Attach: true,
+		})
+	}
+}
+
+func cmdShellKill(cmd *cli.Cmd) {
+	cmd.Spec = "ADDR [NAME]"
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	name := cmd.StringArg("NAME", "", "name of the session, default by default")
+	cmd.Action = func() {
+		imp := impl.NewShell(*addr, impl.ShellRequest{Name: *name})
+		err := imp.Preper(context.Background())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		err = sendShell(imp, types.OPTION_TYPE_UP)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		err = imp.DoKill()
+		imp.Close()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdShell(cmd *cli.Cmd) {
+	cmd.Command("open", "start or attach to a persistent session of a remote device", cmdShellOpen)
+	cmd.Command("attach", "attach to a running session of a remote device", cmdShellAttach)
+	cmd.Command("ls list", "list the sessions of a remote device", cmdShellList)
+	cmd.Command("kill", "end a session of a remote device", cmdShellKill)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	cli "github.com/jawher/mow.cli"
 	"github.com/sirupsen/logrus"
 	"github.com/suutaku/sshx/pkg/impl"
@@ -8,18 +9,20 @@ import (
 )
 
 func cmdCopyId(cmd *cli.Cmd) {
-	cmd.Spec = "ADDR"
+	cmd.Spec = "[--otp] ADDR"
+	otp := cmd.StringOpt("otp", "", "one-time code asked by the remote device")
 	addr := cmd.StringArg("ADDR", "", "remote target address [username]@[host]:[port]")
 	cmd.Action = func() {
 		if addr == nil || *addr == "" {
 			return
 		}
 		imp := impl.NewSSH(*addr, false, "", false)
-		err := imp.Preper()
+		err := imp.Preper(context.Background())
 		if err != nil {
 			logrus.Error(err)
 			return
 		}
+		imp.SetOneTimeCode(oneTimeCode(imp.HostId(), *otp))
 		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
 		conn, err := sender.Send()
 		if err != nil {
@@ -31,10 +34,11 @@ func cmdCopyId(cmd *cli.Cmd) {
 }
 
 func cmdConnect(cmd *cli.Cmd) {
-	cmd.Spec = "[ -X ] [ -i ]ADDR"
+	cmd.Spec = "[ -X ] [ -i ] [ --otp ] ADDR"
 
-	tmp := cmd.BoolOpt("X x11", false, "using X11 opton, default false")
-	ident := cmd.StringOpt("i identification", "", "a private path, default empty for ~/.ssh/id_rsa")
+	tmp := cmd.BoolOpt("X x11", false, "using X11 opton, sshconf.x11 by default")
+	ident := cmd.StringOpt("i identification", "", "a private key path, sshconf.identityfile or ~/.ssh/id_rsa by default")
+	otp := cmd.StringOpt("otp", "", "one-time code asked by the remote device")
 
 	addr := cmd.StringArg("ADDR", "", "remote target address [username]@[host]:[port]")
 	cmd.Action = func() {
@@ -42,11 +46,12 @@ func cmdConnect(cmd *cli.Cmd) {
 			return
 		}
 		imp := impl.NewSSH(*addr, *tmp, *ident, false)
-		err := imp.Preper()
+		err := imp.Preper(context.Background())
 		if err != nil {
 			logrus.Error(err)
 			return
 		}
+		imp.SetOneTimeCode(oneTimeCode(imp.HostId(), *otp))
 		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
 		conn, err := sender.Send()
 		if err != nil {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"strings"
 
 	cli "github.com/jawher/mow.cli"
@@ -11,24 +12,37 @@ import (
 
 func cmdSSHFS(cmd *cli.Cmd) {
 	cmd.Command("mount", "mount a remote filesystem", cmdMount)
-	cmd.Command("unmount", "unmount a remote filesystem", cmdUnmount)
+	cmd.Command("unmount umount", "unmount a remote filesystem", cmdUnmount)
 }
 
 func cmdUnmount(cmd *cli.Cmd) {
-	cmd.Spec = "PID"
-	pidOpt := cmd.StringArg("PID", "", "vnc server pair Id")
+	cmd.Spec = "PID [MOUNTPOINT]"
+	pidOpt := cmd.StringArg("PID", "", "sshfs pair Id")
+	mtpOpt := cmd.StringArg("MOUNTPOINT", "", "mount point to release if the daemon cannot unmount it")
 	cmd.Action = func() {
 		if pidOpt == nil || *pidOpt == "" {
 			return
 		}
 		sender := impl.NewSender(&impl.SSHFS{}, types.OPTION_TYPE_DOWN)
 		sender.PairId = []byte(*pidOpt)
-		sender.SendDetach()
+		_, err := sender.SendDetach()
+		if err != nil {
+			logrus.Warn(err)
+		}
+		if *mtpOpt != "" {
+			// the mount may outlive its connection, make sure it is released.
+			// fails harmlessly if the daemon already unmounted it
+			err = impl.ReleaseMount(*mtpOpt)
+			if err != nil {
+				logrus.Debug(err)
+			}
+		}
 	}
 }
 
 func splitMountPoint(mtopt string) (root, mt string) {
-	sp := strings.Split(mtopt, ":")
+	// mount point may be a windows drive letter like "X:"
+	sp := strings.SplitN(mtopt, ":", 2)
 	if len(sp) < 2 {
 		return
 	}
@@ -41,14 +55,14 @@ func cmdMount(cmd *cli.Cmd) {
 	cmd.Spec = "[-i] HOST MOUNTOPTION"
 	host := cmd.StringArg("HOST", "", "moumt root path")
 	mtpOpt := cmd.StringArg("MOUNTOPTION", "", "moumt option with [root]:[mount point]")
-	ident := cmd.StringOpt("i identification", "", "a private path, default empty for ~/.ssh/id_rsa")
+	ident := cmd.StringOpt("i identification", "", "a private key path, sshconf.identityfile or ~/.ssh/id_rsa by default")
 	cmd.Action = func() {
 		if host == nil || *(host) == "" {
 			return
 		}
 		root, mtp := splitMountPoint(*mtpOpt)
 		imp := impl.NewSSHFS(mtp, root, *host, *ident)
-		err := imp.Preper()
+		err := imp.Preper(context.Background())
 		if err != nil {
 			logrus.Error(err)
 			return
@@ -60,6 +74,6 @@ func cmdMount(cmd *cli.Cmd) {
 			logrus.Error(err)
 			return
 		}
-		logrus.Infof("Mount %s %s to %s\n", imp.HostId(), root, mtp)
+		logrus.Infof("Mount %s %s to %s (pair id %s)\n", imp.HostId(), root, mtp, string(sender.PairId))
 	}
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+func cmdStandbySetup(cmd *cli.Cmd) {
+	cmd.Spec = "[-s] ROLE PEER"
+	role := cmd.StringArg("ROLE", "", "role of this daemon, active or standby")
+	peer := cmd.StringArg("PEER", "", "address of the other daemon, as gateway-b:7800")
+	secret := cmd.StringOpt("s secret", "", "secret the other daemon was set up with, a new one by default")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if *secret == "" {
+			bs := make([]byte, 32)
+			_, err = rand.Read(bs)
+			if err != nil {
+				logrus.Error(err)
+				cli.Exit(1)
+			}
+			*secret = base64.RawURLEncoding.EncodeToString(bs)
+		}
+		err = cm.SetValue("standbyconf.role", *role)
+		if err == nil {
+			err = cm.SetValue("standbyconf.peer", *peer)
+		}
+		if err == nil {
+			err = cm.SetValue("standbyconf.secret", *secret)
+		}
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		other := conf.STANDBY_STANDBY
+		if *role == conf.STANDBY_STANDBY {
+			other = conf.STANDBY_ACTIVE
+		}
+		fmt.Println("on the other daemon run:")
+		fmt.Printf("sshx standby setup -s %s %s <address of this daemon>\n", *secret, other)
+		fmt.Println("then restart both daemons")
+	}
+}
+
+func cmdStandbyDisable(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		err = cm.SetValue("standbyconf.role", "")
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+	}
+}
+
+func cmdStandby(cmd *cli.Cmd) {
+	cmd.Command("setup", "pair this daemon with another one which takes over when it fails", cmdStandbySetup)
+	cmd.Command("disable", "run this daemon alone again", cmdStandbyDisable)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/suutaku/sshx/pkg/types"
 
 	cli "github.com/jawher/mow.cli"
@@ -9,11 +10,17 @@ import (
 )
 
 func cmdStatus(cmd *cli.Cmd) {
-	cmd.Spec = "[ -t ]"
+	cmd.Spec = "[ -t | -e | -s | -m ]"
 	treeOpt := cmd.BoolOpt("t", false, "display in tree view")
+	eventsOpt := cmd.BoolOpt("e events", false, "display the last events of the daemon")
+	stunOpt := cmd.BoolOpt("s stun", false, "display the last checks of the STUN servers")
+	meshOpt := cmd.BoolOpt("m mesh", false, "display the routes of the mesh")
 	cmd.Action = func() {
 		imp := impl.NewSTAT()
-		err := imp.Preper()
+		imp.Events = *eventsOpt
+		imp.STUN = *stunOpt
+		imp.Mesh = *meshOpt
+		err := imp.Preper(context.Background())
 		if err != nil {
 			logrus.Error(err)
 			return
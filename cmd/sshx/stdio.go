@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+// stdioFailure is the exit code of a bridge which could not be set up,
+// the one ssh exits with when it can't connect, so git, rsync and ansible
+// report the host unreachable
+const stdioFailure = 255
+
+func cmdStdio(cmd *cli.Cmd) {
+	cmd.Spec = "[--otp] PEER"
+	otp := cmd.StringOpt("otp", "", "one-time code asked by the remote device")
+	peer := cmd.StringArg("PEER", "", "remote device [username@][device id or name][.sshx][:port], %h of ssh_config")
+	cmd.Action = func() {
+		// stdout carries the ssh stream, errors only go to stderr where ssh
+		// shows them
+		fail := func(err error) {
+			fmt.Fprintln(os.Stderr, "sshx stdio:", err)
+			cli.Exit(stdioFailure)
+		}
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			fail(err)
+		}
+		id, err := impl.ResolveHost(cm, impl.StdioPeer(*peer))
+		if err != nil {
+			fail(err)
+		}
+		conn, err := impl.DialSSH(id, oneTimeCode(id, *otp))
+		if err != nil {
+			fail(fmt.Errorf("%s: %v", id, err))
+		}
+		err = impl.StdioBridge(conn, os.Stdin, os.Stdout)
+		if err != nil {
+			fail(err)
+		}
+	}
+}
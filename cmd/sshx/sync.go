@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+func cmdSyncPush(cmd *cli.Cmd) {
+	cmd.Spec = "[-t] [-b] [-l] LOCAL [REMOTE]"
+	hostId := cmd.StringOpt("t target", "", "target device id")
+	blockSize := cmd.IntOpt("b block-size", 0, "block size in bytes from 1KiB to 1MiB, default 64KiB")
+	limit := cmd.StringOpt("l limit", "", "bandwidth cap in bytes per second, e.g. 5M")
+	local := cmd.StringArg("LOCAL", "", "path of local file")
+	remote := cmd.StringArg("REMOTE", "", "path on remote device, relative paths are under its download directory")
+	cmd.Action = func() {
+		if hostId == nil || *hostId == "" {
+			*hostId = "127.0.0.1"
+		}
+		rate, err := utils.ParseByteSize(*limit)
+		if *limit != "" && err != nil {
+			logrus.Error(err)
+			return
+		}
+		imp := impl.NewSync(*hostId, *local, *remote, int32(*blockSize))
+		imp.RateLimit = rate
+		err = imp.Preper(context.Background())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+		conn, err := sender.Send()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		imp.SetConn(conn)
+		res, err := imp.DoPush()
+		imp.Close()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Printf("\n%d bytes matched, %d bytes sent\n", res.Matched, res.Literal)
+	}
+}
+
+func cmdSyncWatch(cmd *cli.Cmd) {
+	cmd.Spec = "[-t] [-b] [-l] [-d] [--delete] DIR [REMOTE]"
+	hostId := cmd.StringOpt("t target", "", "target device id")
+	blockSize := cmd.IntOpt("b block-size", 0, "block size in bytes from 1KiB to 1MiB, default 64KiB")
+	limit := cmd.StringOpt("l limit", "", "bandwidth cap in bytes per second, e.g. 5M")
+	debounce := cmd.IntOpt("d debounce", 1000, "milliseconds without changes before pushing")
+	del := cmd.BoolOpt("delete", false, "remove files on target device when they are removed locally")
+	local := cmd.StringArg("DIR", "", "local directory to watch")
+	remote := cmd.StringArg("REMOTE", "", "directory on remote device, default to the name of DIR under its download directory")
+	cmd.Action = func() {
+		if hostId == nil || *hostId == "" {
+			*hostId = "127.0.0.1"
+		}
+		rate, err := utils.ParseByteSize(*limit)
+		if *limit != "" && err != nil {
+			logrus.Error(err)
+			return
+		}
+		sw := impl.NewSyncWatcher(*hostId, *local, *remote)
+		sw.BlockSize = int32(*blockSize)
+		sw.RateLimit = rate
+		sw.Delete = *del
+		if *debounce > 0 {
+			sw.Debounce = time.Duration(*debounce) * time.Millisecond
+		}
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt)
+		go func() {
+			<-c
+			sw.Close()
+		}()
+		err = sw.Run()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdSync(cmd *cli.Cmd) {
+	cmd.Command("push", "push a file to target device, only changed blocks are transmitted", cmdSyncPush)
+	cmd.Command("watch", "watch a directory and push every change to target device", cmdSyncWatch)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/cron"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+// taskAction describes what a task does
+func taskAction(t conf.TaskConf) string {
+	switch {
+	case t.Exec != "":
+		return "exec " + t.Exec
+	case t.Pull != "":
+		return "pull " + t.Pull
+	case t.Push != "":
+		return "push " + t.Push
+	}
+	return ""
+}
+
+func showTasks(cm *conf.ConfManager) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Name", "Schedule", "Peer", "Action", "Next run"})
+	t.AppendSeparator()
+	now := time.Now()
+	for _, v := range cm.Conf.ScheduleConf.Tasks {
+		next := "never"
+		if schedule, err := cron.Parse(v.Schedule); err != nil {
+			next = err.Error()
+		} else if at := schedule.Next(now); !at.IsZero() {
+			next = at.Format("2006-01-02 15:04")
+		}
+		t.AppendRows([]table.Row{{v.Name, v.Schedule, v.Peer, taskAction(v), next}})
+	}
+	t.Render()
+}
+
+func cmdTaskList(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		showTasks(cm)
+	}
+}
+
+func cmdTaskAdd(cmd *cli.Cmd) {
+	cmd.Spec = "(--exec | --pull | --push) [--local] [-t] NAME SCHEDULE PEER"
+	exec := cmd.StringOpt("exec", "", "command line run by the shell of the peer")
+	pull := cmd.StringOpt("pull", "", "path of a file of the peer to download")
+	push := cmd.StringOpt("push", "", "path of a local file to upload to the peer")
+	local := cmd.StringOpt("local", "", "destination of the pulled file, the download directory by default")
+	timeout := cmd.IntOpt("t timeout", 0, "seconds after which a run is stopped, 0 for none")
+	name := cmd.StringArg("NAME", "", "name of the task, a task of the same name is replaced")
+	schedule := cmd.StringArg("SCHEDULE", "", "cron expression as \"0 3 * * *\", or @daily, @hourly, @every 30m...")
+	peer := cmd.StringArg("PEER", "", "peer ID or name")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		err = cm.AddTask(conf.TaskConf{
+			Name:     *name,
+			Schedule: *schedule,
+			Peer:     *peer,
+			Exec:     *exec,
+			Pull:     *pull,
+			Push:     *push,
+			Local:    *local,
+			Timeout:  int64(*timeout),
+		})
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		showTasks(cm)
+	}
+}
+
+func cmdTaskRemove(cmd *cli.Cmd) {
+	cmd.Spec = "NAME"
+	name := cmd.StringArg("NAME", "", "name of the task")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		err = cm.RemoveTask(*name)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		showTasks(cm)
+	}
+}
+
+func cmdTaskRun(cmd *cli.Cmd) {
+	cmd.Spec = "NAME"
+	name := cmd.StringArg("NAME", "", "name of the task")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		t := cm.FindTask(*name)
+		if t == nil {
+			logrus.Error("no task ", *name)
+			cli.Exit(1)
+		}
+		ctx := context.Background()
+		if t.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(t.Timeout)*time.Second)
+			defer cancel()
+		}
+		msg, err := impl.RunTask(ctx, cm.ResolvePeer(t.Peer), *t)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		fmt.Println(msg)
+	}
+}
+
+func cmdTask(cmd *cli.Cmd) {
+	cmd.Command("list", "show the scheduled tasks and their next run", cmdTaskList)
+	cmd.Command("add", "schedule an exec, pull or push task", cmdTaskAdd)
+	cmd.Command("remove", "remove a scheduled task", cmdTaskRemove)
+	cmd.Command("run", "run a scheduled task now", cmdTaskRun)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/go-qrc/pkg/qrc"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"golang.org/x/term"
+)
+
+// showTOTPURI prints the URI an authenticator app enrolls a secret with
+func showTOTPURI(uri string) {
+	fmt.Println("add the secret to an authenticator app:")
+	qrc.ShowQR(uri, false)
+	fmt.Println(uri)
+}
+
+// promptTOTP makes commands connecting to hostId ask for a code
+func promptTOTP(hostId string) error {
+	cm, err := conf.NewConfManager(getRootPath())
+	if err != nil {
+		return err
+	}
+	for _, v := range cm.Conf.TOTPConf.Prompt {
+		if v == hostId {
+			return nil
+		}
+	}
+	return cm.SetValue("totpconf.prompt", append(cm.Conf.TOTPConf.Prompt, hostId))
+}
+
+// oneTimeCode returns the code given to a command, or asks for one if the
+// host asks this device for codes and the command runs in a terminal
+func oneTimeCode(hostId, code string) string {
+	if code != "" || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return code
+	}
+	cm, err := conf.NewConfManager(getRootPath())
+	if err != nil {
+		return code
+	}
+	for _, v := range cm.Conf.TOTPConf.Prompt {
+		if v == hostId {
+			p := &prompter{r: bufio.NewReader(os.Stdin)}
+			code, _ = p.ask("one-time code of "+hostId, "")
+			return code
+		}
+	}
+	return code
+}
+
+func cmdTOTPEnroll(cmd *cli.Cmd) {
+	cmd.Spec = "ADDR"
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	cmd.Action = func() {
+		secret, err := impl.EnrollTOTP(*addr)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		showTOTPURI(impl.TOTPURI(secret, *addr))
+		fmt.Println("sessions of", *addr, "now need a one-time code")
+	}
+}
+
+func cmdTOTPRemove(cmd *cli.Cmd) {
+	cmd.Spec = "ADDR"
+	addr := cmd.StringArg("ADDR", "", "remote device id")
+	cmd.Action = func() {
+		err := impl.RemoveTOTP(*addr)
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func cmdTOTP(cmd *cli.Cmd) {
+	cmd.Command("enroll", "require one-time codes of a device", cmdTOTPEnroll)
+	cmd.Command("remove", "stop requiring one-time codes of a device", cmdTOTPRemove)
+}
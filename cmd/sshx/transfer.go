@@ -1,27 +1,38 @@
 package main
 
 import (
+	"context"
 	cli "github.com/jawher/mow.cli"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
 
 func cmdUpload(cmd *cli.Cmd) {
-	cmd.Spec = "[-t] [-f] [-q]"
+	cmd.Spec = "[-t] [-f] [-q] [-p] [-l]"
 	hostId := cmd.StringOpt("t target", "", "target device id")
 	filePath := cmd.StringOpt("f file", "", "path of file to upload")
 	showQR := cmd.BoolOpt("q qrcode", false, "show QR code (upload from or download to mobile device)")
+	parallel := cmd.IntOpt("p parallel", 0, "number of parallel data channels for large files, default from configure")
+	limit := cmd.StringOpt("l limit", "", "bandwidth cap in bytes per second, e.g. 5M")
 	cmd.Action = func() {
 
 		if hostId == nil || *hostId == "" {
 			*hostId = "127.0.0.1"
 		}
 
+		rate, err := utils.ParseByteSize(*limit)
+		if *limit != "" && err != nil {
+			logrus.Error(err)
+			return
+		}
 		imp := impl.NewTransferService(*hostId, *filePath, true, *showQR)
+		imp.Parallelism = int32(*parallel)
+		imp.RateLimit = rate
 		imp.Init()
 		imp.NoNeedConnect()
-		err := imp.Preper()
+		err = imp.Preper(context.Background())
 		if err != nil {
 			logrus.Error(err)
 			return
@@ -43,23 +54,32 @@ func cmdUpload(cmd *cli.Cmd) {
 
 }
 func cmdDownload(cmd *cli.Cmd) {
-	cmd.Spec = "[-t] [-f] [-q]"
+	cmd.Spec = "[-t] [-f] [-q] [-p] [-l]"
 	hostId := cmd.StringOpt("t target", "", "target device id")
 	filePath := cmd.StringOpt("f file", "", "path of file to download")
 	showQR := cmd.BoolOpt("q qrcode", false, "show QR code (upload from or download to mobile device)")
+	parallel := cmd.IntOpt("p parallel", 0, "number of parallel data channels for large files, default from configure")
+	limit := cmd.StringOpt("l limit", "", "bandwidth cap in bytes per second, e.g. 5M")
 	cmd.Action = func() {
 		if hostId == nil || *hostId == "" {
 			*hostId = "127.0.0.1"
 		}
 
+		rate, err := utils.ParseByteSize(*limit)
+		if *limit != "" && err != nil {
+			logrus.Error(err)
+			return
+		}
 		imp := impl.NewTransferService(*hostId, *filePath, false, *showQR)
 		if imp == nil {
 			logrus.Error("Please input a remote file path when using download command")
 			return
 		}
+		imp.Parallelism = int32(*parallel)
+		imp.RateLimit = rate
 		imp.Init()
 		imp.NoNeedConnect()
-		err := imp.Preper()
+		err = imp.Preper(context.Background())
 		if err != nil {
 			logrus.Error(err)
 			return
@@ -80,7 +100,35 @@ func cmdDownload(cmd *cli.Cmd) {
 	}
 }
 
+func cmdTransferList(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		states, err := impl.ListTransfers()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		impl.ShowTransfers(states)
+	}
+}
+
+func transferControl(option int32) cli.CmdInitializer {
+	return func(cmd *cli.Cmd) {
+		cmd.Spec = "PID"
+		pidOpt := cmd.StringArg("PID", "", "pair id of the transfer, see 'trans list'")
+		cmd.Action = func() {
+			err := impl.ControlTransfer(*pidOpt, option)
+			if err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+}
+
 func cmdTransfer(cmd *cli.Cmd) {
 	cmd.Command("upload", "upload file to target device", cmdUpload)
 	cmd.Command("download", "download file from target device", cmdDownload)
+	cmd.Command("list", "list queued and running transfers", cmdTransferList)
+	cmd.Command("pause", "pause a running transfer", transferControl(types.OPTION_TYPE_PAUSE))
+	cmd.Command("resume", "resume a paused transfer", transferControl(types.OPTION_TYPE_RESUME))
+	cmd.Command("cancel", "cancel a queued or running transfer", transferControl(types.OPTION_TYPE_DOWN))
 }
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/systray"
+	cli "github.com/jawher/mow.cli"
+	"github.com/martinlindhe/notify"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/client"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	// traySlots is the number of sessions and of approvals the menus of
+	// the tray show
+	traySlots = 8
+	// trayRefresh is the interval of the polls of the daemon
+	trayRefresh = 2 * time.Second
+)
+
+// Colors of the icon of the tray
+var (
+	// trayOffline is the color while the daemon isn't running
+	trayOffline = color.RGBA{0x9e, 0x9e, 0x9e, 0xff}
+	trayOnline  = color.RGBA{0x2e, 0x7d, 0x32, 0xff}
+	// trayWaiting is the color while sessions wait for approval
+	trayWaiting = color.RGBA{0xf9, 0xa8, 0x25, 0xff}
+)
+
+// trayIcon draws the icon of the tray, a disc of c, as a PNG, in an ICO on
+// Windows
+func trayIcon(c color.RGBA) []byte {
+	const size = 32
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	radius := float64(size) / 2
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			d := math.Hypot(float64(x)+0.5-radius, float64(y)+0.5-radius)
+			// the edge is blended over a pixel
+			alpha := math.Max(0, math.Min(1, radius-d))
+			if alpha == 0 {
+				continue
+			}
+			v := c
+			v.R, v.G, v.B, v.A = uint8(float64(c.R)*alpha), uint8(float64(c.G)*alpha), uint8(float64(c.B)*alpha), uint8(float64(c.A)*alpha)
+			img.SetRGBA(x, y, v)
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	if runtime.GOOS != "windows" {
+		return buf.Bytes()
+	}
+	// an icon directory of one PNG image
+	ico := bytes.NewBuffer(nil)
+	binary.Write(ico, binary.LittleEndian, []uint16{0, 1, 1})
+	ico.Write([]byte{size, size, 0, 0})
+	binary.Write(ico, binary.LittleEndian, []uint16{1, 32})
+	binary.Write(ico, binary.LittleEndian, []uint32{uint32(buf.Len()), 22})
+	ico.Write(buf.Bytes())
+	return ico.Bytes()
+}
+
+// shellQuote quotes s for sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// openTerminal runs this program with args in a new terminal window
+func openTerminal(args ...string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("cmd", append([]string{"/C", "start", "", self}, args...)...).Start()
+	case "darwin":
+		line := shellQuote(self)
+		for _, v := range args {
+			line += " " + shellQuote(v)
+		}
+		script := fmt.Sprintf("tell application \"Terminal\"\nactivate\ndo script %q\nend tell", line)
+		return exec.Command("osascript", "-e", script).Start()
+	}
+	for _, v := range []string{os.Getenv("TERMINAL"), "x-terminal-emulator", "gnome-terminal", "konsole", "xfce4-terminal", "xterm"} {
+		if v == "" {
+			continue
+		}
+		path, err := exec.LookPath(v)
+		if err != nil {
+			continue
+		}
+		flag := "-e"
+		if v == "gnome-terminal" {
+			flag = "--"
+		}
+		return exec.Command(path, append([]string{flag, self}, args...)...).Start()
+	}
+	return fmt.Errorf("no terminal found, set TERMINAL")
+}
+
+// traySlot is a menu item showing a session or an approval, hidden while
+// there are fewer of them
+type traySlot struct {
+	item *systray.MenuItem
+	// actions are the items of its submenu
+	actions []*systray.MenuItem
+}
+
+// tray is the agent of the notification area, it shows the sessions of the
+// daemon and the ones waiting for approval and opens sessions
+type tray struct {
+	cm     *conf.ConfManager
+	client *client.Client
+
+	status    *systray.MenuItem
+	proxy     *systray.MenuItem
+	inbound   *systray.MenuItem
+	approvals *systray.MenuItem
+	sessions  [traySlots]traySlot
+	knocks    [traySlots]traySlot
+
+	lock sync.Mutex
+	// shown are the sessions of the slots of inbound, waiting the ones
+	// of the slots of approvals
+	shown   []client.Connection
+	waiting []types.KnockRequest
+	icon    color.RGBA
+	// proxyConn is the proxy of proxyconf while it runs, proxyPairId
+	// the pair ID of its session
+	proxyConn   *impl.Proxy
+	proxyPairId string
+}
+
+func newTray(cm *conf.ConfManager) (*tray, error) {
+	c, err := client.New(client.Options{Home: getRootPath()})
+	if err != nil {
+		return nil, err
+	}
+	return &tray{cm: cm, client: c}, nil
+}
+
+// onClick calls fn each time item is clicked
+func onClick(item *systray.MenuItem, fn func()) {
+	go func() {
+		for range item.ClickedCh {
+			fn()
+		}
+	}()
+}
+
+// alert shows an error as a notification, nobody reads the log of the tray
+func alert(err error) {
+	if err != nil {
+		logrus.Error(err)
+		notify.Notify("sshx", "tray", err.Error(), "")
+	}
+}
+
+// favorites returns the IDs of the devices of the connect menu
+func (t *tray) favorites() []string {
+	var ret []string
+	for _, v := range t.cm.Conf.TrayConf.Favorites {
+		ret = append(ret, t.cm.ResolvePeer(v))
+	}
+	if len(ret) > 0 {
+		return ret
+	}
+	for _, v := range t.cm.Conf.AddressBook {
+		ret = append(ret, v.ID)
+	}
+	return ret
+}
+
+func (t *tray) ready() {
+	t.icon = trayOffline
+	systray.SetIcon(trayIcon(t.icon))
+	systray.SetTooltip("sshx")
+	t.status = systray.AddMenuItem("sshx", t.cm.Conf.ID)
+	t.status.Disable()
+	systray.AddSeparator()
+
+	connect := systray.AddMenuItem("Connect", "open an ssh session in a terminal")
+	favorites := t.favorites()
+	for _, id := range favorites {
+		id := id
+		onClick(connect.AddSubMenuItem(t.cm.PeerName(id), id), func() {
+			alert(openTerminal("conn", id))
+		})
+	}
+	if len(favorites) == 0 {
+		connect.AddSubMenuItem("no device in the address book", "").Disable()
+	}
+
+	pc := t.cm.Conf.ProxyConf
+	t.proxy = systray.AddMenuItemCheckbox(fmt.Sprintf("Proxy to %s", t.cm.PeerName(pc.Target)), fmt.Sprintf("ssh proxy at 127.0.0.1:%d", pc.Port), false)
+	if pc.Port == 0 || pc.Target == "" {
+		t.proxy.SetTitle("Proxy")
+		t.proxy.SetTooltip("set proxyconf.port and proxyconf.target")
+		t.proxy.Disable()
+	}
+	onClick(t.proxy, t.toggleProxy)
+
+	t.inbound = systray.AddMenuItem("Connected to me", "sessions peers opened with this device")
+	for i := range t.sessions {
+		i := i
+		slot := &t.sessions[i]
+		slot.item = t.inbound.AddSubMenuItem("", "")
+		slot.actions = []*systray.MenuItem{slot.item.AddSubMenuItem("Disconnect", "close the session")}
+		slot.item.Hide()
+		onClick(slot.actions[0], func() {
+			t.disconnect(i)
+		})
+	}
+	t.approvals = systray.AddMenuItem("Approvals", "sessions waiting for approval in knock mode")
+	for i := range t.knocks {
+		i := i
+		slot := &t.knocks[i]
+		slot.item = t.approvals.AddSubMenuItem("", "")
+		slot.actions = []*systray.MenuItem{
+			slot.item.AddSubMenuItem("Allow", "allow this session"),
+			slot.item.AddSubMenuItem("Always allow", "allow the sessions of this peer from now on"),
+			slot.item.AddSubMenuItem("Deny", "deny this session"),
+		}
+		slot.item.Hide()
+		onClick(slot.actions[0], func() { t.decide(i, true, false) })
+		onClick(slot.actions[1], func() { t.decide(i, true, true) })
+		onClick(slot.actions[2], func() { t.decide(i, false, false) })
+	}
+
+	systray.AddSeparator()
+	onClick(systray.AddMenuItem("Open dashboard", "open the dashboard in a terminal"), func() {
+		alert(openTerminal("dashboard"))
+	})
+	onClick(systray.AddMenuItem("Quit", "quit the tray agent, the daemon keeps running"), systray.Quit)
+	go t.watch()
+}
+
+func (t *tray) exit() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.proxyConn != nil {
+		t.proxyConn.Close()
+	}
+}
+
+func (t *tray) watch() {
+	for {
+		t.refresh()
+		time.Sleep(trayRefresh)
+	}
+}
+
+// refresh asks the daemon for its sessions and the ones waiting for
+// approval and shows them
+func (t *tray) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), trayRefresh)
+	defer cancel()
+	conns, err := t.client.ListConnections(ctx)
+	var knocks []types.KnockRequest
+	if err == nil {
+		// knock mode may be off
+		knocks, _ = impl.ListKnocks()
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	icon, status := trayOffline, "the daemon isn't running"
+	t.shown = nil
+	if err == nil {
+		for _, v := range conns {
+			if v.Inbound && v.Parent == "" {
+				t.shown = append(t.shown, v)
+			}
+		}
+		icon = trayOnline
+		status = fmt.Sprintf("%d sessions, %d connected to me", len(conns), len(t.shown))
+	}
+	t.waiting = knocks
+	if len(knocks) > 0 {
+		icon = trayWaiting
+		status += fmt.Sprintf(", %d waiting for approval", len(knocks))
+	}
+	if icon != t.icon {
+		t.icon = icon
+		systray.SetIcon(trayIcon(icon))
+	}
+	t.status.SetTitle(status)
+	systray.SetTooltip("sshx: " + status)
+
+	t.inbound.SetTitle(fmt.Sprintf("Connected to me (%d)", len(t.shown)))
+	for i := range t.sessions {
+		slot := &t.sessions[i]
+		if i >= len(t.shown) {
+			slot.item.Hide()
+			continue
+		}
+		v := t.shown[i]
+		slot.item.SetTitle(fmt.Sprintf("%s: %s since %s", t.cm.PeerName(v.Peer), v.App, v.Started.Format("15:04")))
+		slot.item.Show()
+	}
+	t.approvals.SetTitle(fmt.Sprintf("Approvals (%d)", len(t.waiting)))
+	for i := range t.knocks {
+		slot := &t.knocks[i]
+		if i >= len(t.waiting) {
+			slot.item.Hide()
+			continue
+		}
+		v := t.waiting[i]
+		slot.item.SetTitle(fmt.Sprintf("%s asks for %s", knockPeer(v), v.App))
+		slot.item.Show()
+	}
+
+	// the session of the proxy is gone if the daemon restarted
+	if t.proxyConn != nil && err == nil {
+		found := false
+		for _, v := range conns {
+			found = found || v.ID == t.proxyPairId
+		}
+		if !found {
+			t.proxyConn.Close()
+			t.proxyConn = nil
+			t.proxy.Uncheck()
+		}
+	}
+}
+
+func (t *tray) toggleProxy() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.proxyConn != nil {
+		t.proxyConn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), trayRefresh)
+		defer cancel()
+		alert(t.client.CloseConnection(ctx, t.proxyPairId))
+		t.proxyConn = nil
+		t.proxy.Uncheck()
+		return
+	}
+	pc := t.cm.Conf.ProxyConf
+	proxy, pairId, err := startProxy(t.cm, t.cm.ResolvePeer(pc.Target), int(pc.Port))
+	if err != nil {
+		alert(err)
+		return
+	}
+	t.proxyConn, t.proxyPairId = proxy, pairId
+	t.proxy.Check()
+}
+
+// disconnect closes the session of the slot i of inbound
+func (t *tray) disconnect(i int) {
+	t.lock.Lock()
+	if i >= len(t.shown) {
+		t.lock.Unlock()
+		return
+	}
+	v := t.shown[i]
+	t.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), trayRefresh)
+	defer cancel()
+	alert(t.client.CloseConnection(ctx, v.ID))
+	t.refresh()
+}
+
+// decide allows or denies the session of the slot i of approvals
+func (t *tray) decide(i int, allow, remember bool) {
+	t.lock.Lock()
+	if i >= len(t.waiting) {
+		t.lock.Unlock()
+		return
+	}
+	v := t.waiting[i]
+	t.lock.Unlock()
+	alert(decideKnock(v, allow, remember))
+	t.refresh()
+}
+
+func cmdTray(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		t, err := newTray(cm)
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		systray.Run(t.ready, t.exit)
+	}
+}
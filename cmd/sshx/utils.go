@@ -5,15 +5,13 @@ import (
 	"os"
 
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
 )
 
 func getRootPath() string {
-	rootStr := os.Getenv("SSHX_HOME")
-	if rootStr == "" {
-		rootStr = defaultHomePath
-	}
+	rootStr := utils.GetSSHXHome()
 	if _, err := os.Stat(rootStr); errors.Is(err, os.ErrNotExist) {
-		err := os.Mkdir(rootStr, 0766)
+		err := os.MkdirAll(rootStr, 0700)
 		if err != nil {
 			logrus.Error(err)
 		}
@@ -1,29 +1,39 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"time"
+
 	cli "github.com/jawher/mow.cli"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
 
+// startVNCService asks the daemon to serve the desktop of this device to
+// remote viewers
+func startVNCService() error {
+	imp := impl.NewVNCService(nil)
+	err := imp.Preper(context.Background())
+	if err != nil {
+		return err
+	}
+	sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+	if sender == nil {
+		return fmt.Errorf("can not create impl")
+	}
+	_, err = sender.SendDetach()
+	return err
+}
+
 func cmdStartVNCService(cmd *cli.Cmd) {
 	cmd.Action = func() {
-		imp := impl.NewVNCService(nil)
-		err := imp.Preper()
-		if err != nil {
-			logrus.Error(err)
-			return
-		}
-		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
-		if sender == nil {
-			logrus.Error("can not create impl")
-			return
-		}
-		_, err = sender.SendDetach()
+		err := startVNCService()
 		if err != nil {
 			logrus.Error(err)
-			return
 		}
 	}
 }
@@ -41,7 +51,62 @@ func cmdStopVNCService(cmd *cli.Cmd) {
 	}
 }
 
+func cmdVNCToken(cmd *cli.Cmd) {
+	cmd.Spec = "[-n] [-e] [-v]"
+	uses := cmd.IntOpt("n uses", 1, "number of sessions the token is valid for, 0 for unlimited")
+	expire := cmd.IntOpt("e expire", 60, "minutes before the token expires")
+	viewOnly := cmd.BoolOpt("v view-only", false, "viewers can watch but not control the desktop")
+	cmd.Action = func() {
+		token, err := impl.NewVNCToken(int32(*uses), time.Duration(*expire)*time.Minute, *viewOnly)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if cm.Conf.VNCAuthConf.Password == "" && !cm.Conf.VNCAuthConf.RequireAuth {
+			logrus.Warn("VNCAuthConf.RequireAuth is not set, viewers can connect without token")
+		}
+		fmt.Println(token)
+		fmt.Printf("viewers connect with path ws?device=%s&token=%s\n", cm.Conf.ID, token)
+	}
+}
+
+func cmdVNCFingerprint(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		if !cm.Conf.VNCWebConf.TLS {
+			logrus.Warn("VNCWebConf.TLS is not set, the web interface is served over http")
+		}
+		cert, err := impl.VNCWebCert(cm.Conf.VNCWebConf)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		fmt.Println(utils.CertFingerprint(cert))
+	}
+}
+
+func cmdVNCRecordings(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		err := impl.ShowVNCRecordings()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
 func cmdVNCService(cmd *cli.Cmd) {
 	cmd.Command("start", "start vnc service", cmdStartVNCService)
 	cmd.Command("stop", "stop vnc service", cmdStopVNCService)
+	cmd.Command("token", "create a one-time token for remote viewers of this device", cmdVNCToken)
+	cmd.Command("recordings", "list recorded sessions of remote viewers", cmdVNCRecordings)
+	cmd.Command("fingerprint", "show the certificate fingerprint of the web interface", cmdVNCFingerprint)
 }
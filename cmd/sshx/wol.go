@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+func cmdWOLWake(cmd *cli.Cmd) {
+	cmd.Spec = "[-v] [-m] [-w] [-s] [-b] [-p] TARGET"
+	relay := cmd.StringOpt("v via", "", "device of the network of the target which sends the packets, the wake device of its address book entry by default")
+	mac := cmd.StringOpt("m mac", "", "hardware address of the target, the one of its address book entry by default")
+	wait := cmd.IntOpt("w wait", 120, "seconds to wait for the target to come online, 0 to not wait")
+	connect := cmd.BoolOpt("s ssh", false, "connect to the target over ssh once it is online")
+	broadcast := cmd.StringOpt("b broadcast", "", "broadcast address of the packets, the ones of the networks of the relay by default")
+	port := cmd.IntOpt("p port", 9, "udp port of the packets")
+	target := cmd.StringArg("TARGET", "", "device to wake [username]@[device id or name], or its hardware address")
+	cmd.Action = func() {
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		// a bare hardware address is a device sshx does not run on
+		var user, id string
+		if _, err := net.ParseMAC(*target); err == nil {
+			*mac = *target
+		} else {
+			id = *target
+			if i := strings.Index(id, "@"); i >= 0 {
+				user, id = id[:i+1], id[i+1:]
+			}
+			id = cm.ResolvePeer(id)
+			if p := cm.FindPeer(id); p != nil {
+				if *mac == "" {
+					*mac = p.MAC
+				}
+				if *relay == "" {
+					*relay = p.Wake
+				}
+			}
+		}
+		if *mac == "" || *relay == "" {
+			logrus.Error("unknown hardware address or relay of ", *target, ", see wol set")
+			cli.Exit(1)
+		}
+		imp := impl.NewWOL(cm.ResolvePeer(*relay), impl.WOLRequest{
+			MAC:       *mac,
+			Broadcast: *broadcast,
+			Port:      *port,
+		})
+		err = imp.Preper(context.Background())
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+		conn, err := sender.Send()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		imp.SetConn(conn)
+		sent, err := imp.Do()
+		imp.Close()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		fmt.Printf("%s sent magic packets for %s to %s\n", imp.HostId(), *mac, strings.Join(sent, ", "))
+		if id == "" || (*wait == 0 && !*connect) {
+			return
+		}
+		if *wait > 0 {
+			fmt.Printf("waiting for %s to come online\n", id)
+			err = impl.WaitOnline(id, time.Duration(*wait)*time.Second)
+			if err != nil {
+				logrus.Error(err)
+				cli.Exit(1)
+			}
+			fmt.Printf("%s is online\n", id)
+		}
+		if !*connect {
+			return
+		}
+		ssh := impl.NewSSH(user+id, false, "", false)
+		err = ssh.Preper(context.Background())
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		sender = impl.NewSender(ssh, types.OPTION_TYPE_UP)
+		conn, err = sender.Send()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+		ssh.OpenTerminal(conn)
+	}
+}
+
+func cmdWOLSet(cmd *cli.Cmd) {
+	cmd.Spec = "ID [MAC] [RELAY]"
+	id := cmd.StringArg("ID", "", "device ID or address book name")
+	mac := cmd.StringArg("MAC", "", "hardware address of the device, empty to forget it")
+	relay := cmd.StringArg("RELAY", "", "device of its network which sends the packets")
+	cmd.Action = func() {
+		if *mac != "" {
+			if _, err := net.ParseMAC(*mac); err != nil {
+				logrus.Error(err)
+				cli.Exit(1)
+			}
+		}
+		cm, err := conf.NewConfManager(getRootPath())
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		peer := cm.ResolvePeer(*id)
+		p := cm.FindPeer(peer)
+		if p == nil {
+			cm.Conf.AddressBook = append(cm.Conf.AddressBook, conf.Peer{ID: peer})
+			p = &cm.Conf.AddressBook[len(cm.Conf.AddressBook)-1]
+		}
+		p.MAC = *mac
+		p.Wake = cm.ResolvePeer(*relay)
+		err = cm.SaveAddressBook()
+		if err != nil {
+			logrus.Error(err)
+			cli.Exit(1)
+		}
+	}
+}
+
+func cmdWOL(cmd *cli.Cmd) {
+	cmd.Command("wake", "wake a device with magic packets sent by a device of its network", cmdWOLWake)
+	cmd.Command("set", "set the hardware address and relay of a device of the address book", cmdWOLSet)
+}
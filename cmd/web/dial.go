@@ -0,0 +1,295 @@
+//go:build js && wasm
+// +build js,wasm
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall/js"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/suutaku/sshx/internal/e2e"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	// dialTimeout bounds the signaling and ICE of a connection
+	dialTimeout = 30 * time.Second
+
+	// pollInterval is the time between two pulls of the signaling server
+	// while a connection is made
+	pollInterval = 500 * time.Millisecond
+
+	// flagLen is the shift of the app code in the request type of offers,
+	// as impl.Sender encodes it
+	flagLen = 8
+
+	// maxMessageSize is the largest data a message carries, small enough
+	// for every browser once sealed
+	maxMessageSize = 16 << 10
+
+	// highWaterMark bounds the data queued in the data channel by writes
+	highWaterMark = 1 << 20
+)
+
+// channelConn is a data channel to an app of a device, sealed like the
+// channels of the daemon. The messages are handled by the page's event
+// loop as they come, in order, since the sealing drops late messages.
+type channelConn struct {
+	pc     *webrtc.PeerConnection
+	dc     js.Value
+	sealed *e2e.Channel
+	funcs  []js.Func
+	opened chan struct{}
+	lock   sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+	once   sync.Once
+}
+
+func newChannelConn(pc *webrtc.PeerConnection) *channelConn {
+	ret := &channelConn{
+		pc:     pc,
+		opened: make(chan struct{}),
+	}
+	ret.cond = sync.NewCond(&ret.lock)
+	ret.dc = pc.JSValue().Call("createDataChannel", "data")
+	ret.dc.Set("binaryType", "arraybuffer")
+	ret.on("open", func(js.Value) {
+		close(ret.opened)
+	})
+	ret.on("message", ret.receive)
+	ret.on("close", func(js.Value) {
+		go ret.Close()
+	})
+	return ret
+}
+
+// on sets the handler of an event of the data channel
+func (c *channelConn) on(event string, fn func(js.Value)) {
+	f := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		fn(args[0])
+		return nil
+	})
+	c.funcs = append(c.funcs, f)
+	c.dc.Set("on"+event, f)
+}
+
+func (c *channelConn) receive(ev js.Value) {
+	array := js.Global().Get("Uint8Array").New(ev.Get("data"))
+	msg := make([]byte, array.Get("length").Int())
+	js.CopyBytesToGo(msg, array)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	data, err := c.sealed.Open(msg)
+	if err == e2e.ErrStaleMessage {
+		return
+	}
+	if err != nil {
+		go c.Close()
+		return
+	}
+	c.buf.Write(data)
+	c.cond.Broadcast()
+}
+
+func (c *channelConn) Read(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for c.buf.Len() == 0 && !c.closed {
+		c.cond.Wait()
+	}
+	if c.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.buf.Read(p)
+}
+
+func (c *channelConn) Write(p []byte) (n int, err error) {
+	defer func() {
+		// the data channel throws once it is closed
+		if e := recover(); e != nil {
+			err = io.ErrClosedPipe
+		}
+	}()
+	for n < len(p) {
+		c.lock.Lock()
+		closed := c.closed
+		c.lock.Unlock()
+		if closed {
+			return n, io.ErrClosedPipe
+		}
+		if c.dc.Get("bufferedAmount").Int() > highWaterMark {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		size := len(p) - n
+		if size > maxMessageSize {
+			size = maxMessageSize
+		}
+		msg := c.sealed.Seal(p[n : n+size])
+		array := js.Global().Get("Uint8Array").New(len(msg))
+		js.CopyBytesToJS(array, msg)
+		c.dc.Call("send", array)
+		n += size
+	}
+	return n, nil
+}
+
+func (c *channelConn) Close() error {
+	c.once.Do(func() {
+		c.lock.Lock()
+		c.closed = true
+		c.cond.Broadcast()
+		c.lock.Unlock()
+		for _, event := range []string{"open", "message", "close"} {
+			c.dc.Set("on"+event, js.Null())
+		}
+		for _, f := range c.funcs {
+			f.Release()
+		}
+		c.dc.Call("close")
+		c.pc.Close()
+	})
+	return nil
+}
+
+// channelAddr is the address of either end of a channelConn
+type channelAddr string
+
+func (a channelAddr) Network() string { return "webrtc" }
+func (a channelAddr) String() string  { return string(a) }
+
+func (c *channelConn) LocalAddr() net.Addr                { return channelAddr("local") }
+func (c *channelConn) RemoteAddr() net.Addr               { return channelAddr("remote") }
+func (c *channelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *channelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *channelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// dial opens a connection with the app of target, asking for it with the
+// one time code otp if it isn't empty. It offers and waits for the answer
+// the way the daemon's dialer does.
+func dial(sig *signaling, iceServers []string, target string, app int32, otp string) (*channelConn, error) {
+	kx, err := e2e.NewKeyExchange(e2e.ConnectionHello, sig.id.MessageKey)
+	if err != nil {
+		return nil, err
+	}
+	config := webrtc.Configuration{}
+	if len(iceServers) > 0 {
+		config.ICEServers = []webrtc.ICEServer{{URLs: iceServers}}
+	}
+	pc, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+	conn := newChannelConn(pc)
+	fail := func(err error) (*channelConn, error) {
+		conn.Close()
+		return nil, err
+	}
+
+	// the offer carries the candidates, the browser doesn't trickle them
+	gathered := webrtc.GatheringCompletePromise(pc)
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return fail(err)
+	}
+	err = pc.SetLocalDescription(offer)
+	if err != nil {
+		return fail(err)
+	}
+	select {
+	case <-gathered:
+	case <-time.After(dialTimeout):
+		return fail(fmt.Errorf("ICE gathering timeout"))
+	}
+	id := types.NewPoolId(time.Now().UnixNano(), app)
+	err = sig.push(types.SignalingInfo{
+		Id:                *id,
+		Flag:              types.SIG_TYPE_OFFER,
+		Target:            target,
+		SDP:               pc.LocalDescription().SDP,
+		RemoteRequestType: app<<flagLen | types.OPTION_TYPE_UP,
+		Hello:             kx.Hello(),
+		OTP:               otp,
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	deadline := time.Now().Add(dialTimeout)
+	var pending []webrtc.ICECandidateInit
+	answered := false
+	for {
+		select {
+		case <-conn.opened:
+			return conn, nil
+		default:
+		}
+		if time.Now().After(deadline) {
+			return fail(fmt.Errorf("%s did not answer", target))
+		}
+		info, err := sig.pull()
+		if err == io.EOF {
+			time.Sleep(pollInterval)
+			continue
+		}
+		if err != nil {
+			return fail(err)
+		}
+		// messages of earlier sessions
+		if info.Source != target || info.Id.Value != id.Value {
+			continue
+		}
+		err = sig.verify(&info)
+		if err != nil {
+			return fail(err)
+		}
+		switch info.Flag {
+		case types.SIG_TYPE_ANSWER:
+			peerKey, err := kx.PeerKey(info.Hello)
+			if err != nil {
+				return fail(fmt.Errorf("%s does not encrypt connections end to end", target))
+			}
+			err = pin(messageKeysKey, target, "message key", peerKey)
+			if err != nil {
+				return fail(err)
+			}
+			send, recv, err := kx.Keys(info.Hello, true, e2e.ConnectionLabel)
+			if err != nil {
+				return fail(err)
+			}
+			conn.lock.Lock()
+			conn.sealed = e2e.NewChannel(send, recv)
+			conn.lock.Unlock()
+			err = pc.SetRemoteDescription(webrtc.SessionDescription{
+				Type: webrtc.SDPTypeAnswer,
+				SDP:  info.SDP,
+			})
+			if err != nil {
+				return fail(err)
+			}
+			answered = true
+			for _, v := range pending {
+				pc.AddICECandidate(v)
+			}
+			pending = nil
+		case types.SIG_TYPE_CANDIDATE:
+			ca := webrtc.ICECandidateInit{Candidate: string(info.Candidate)}
+			if !answered {
+				pending = append(pending, ca)
+				continue
+			}
+			pc.AddICECandidate(ca)
+		}
+	}
+}
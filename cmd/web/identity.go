@@ -0,0 +1,124 @@
+//go:build js && wasm
+// +build js,wasm
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"syscall/js"
+
+	"github.com/suutaku/sshx/internal/e2e"
+	"github.com/suutaku/sshx/pkg/types"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Keys of the local storage of the page
+const (
+	identityKey = "sshx.identity"
+	// nodeKeysKey pins the node keys which sign the messages of devices
+	nodeKeysKey = "sshx.nodekeys"
+	// messageKeysKey pins the static keys of the hellos of devices
+	messageKeysKey = "sshx.messagekeys"
+	// hostKeysKey pins the host keys of the ssh servers of devices
+	hostKeysKey = "sshx.hostkeys"
+)
+
+// identity is the device ID and keys of the browser, made on the first
+// session and kept in the local storage of the page
+type identity struct {
+	ID string
+	// NodeKey is the seed of the ed25519 key signing the signaling messages
+	NodeKey []byte
+	// MessageKey is the static X25519 key of the key exchanges
+	MessageKey []byte
+}
+
+func storageGet(key string) string {
+	v := js.Global().Get("localStorage").Call("getItem", key)
+	if v.IsNull() || v.IsUndefined() {
+		return ""
+	}
+	return v.String()
+}
+
+func storageSet(key, value string) {
+	js.Global().Get("localStorage").Call("setItem", key, value)
+}
+
+// loadIdentity returns the identity of the browser, a new one if it has none
+func loadIdentity() (*identity, error) {
+	var ret identity
+	if v := storageGet(identityKey); v != "" {
+		err := json.Unmarshal([]byte(v), &ret)
+		if err == nil && len(ret.NodeKey) == ed25519.SeedSize && len(ret.MessageKey) == curve25519.ScalarSize {
+			return &ret, nil
+		}
+	}
+	suffix := make([]byte, 8)
+	ret.NodeKey = make([]byte, ed25519.SeedSize)
+	ret.MessageKey = make([]byte, curve25519.ScalarSize)
+	for _, v := range [][]byte{suffix, ret.NodeKey, ret.MessageKey} {
+		_, err := rand.Read(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ret.ID = "web-" + hex.EncodeToString(suffix)
+	bs, err := json.Marshal(ret)
+	if err != nil {
+		return nil, err
+	}
+	storageSet(identityKey, string(bs))
+	return &ret, nil
+}
+
+// sign signs a signaling message with the node key, as the daemon does
+func (id *identity) sign(info *types.SignalingInfo) {
+	key := ed25519.NewKeyFromSeed(id.NodeKey)
+	info.NodeKey = key.Public().(ed25519.PublicKey)
+	info.Signature = ed25519.Sign(key, e2e.SignalingDigest(info))
+}
+
+func loadPins(store string) map[string]string {
+	ret := make(map[string]string)
+	if v := storageGet(store); v != "" {
+		json.Unmarshal([]byte(v), &ret)
+	}
+	return ret
+}
+
+// pin checks key is the key of peer pinned in store, the first key of a
+// peer is pinned. The browser doesn't follow key rotations, a changed key
+// has to be forgotten.
+func pin(store, peer, what string, key []byte) error {
+	pins := loadPins(store)
+	value := base64.StdEncoding.EncodeToString(key)
+	if pinned, ok := pins[peer]; ok {
+		if pinned != value {
+			return fmt.Errorf("%s of %s changed, forget the device if it was reinstalled", what, peer)
+		}
+		return nil
+	}
+	pins[peer] = value
+	bs, err := json.Marshal(pins)
+	if err != nil {
+		return err
+	}
+	storageSet(store, string(bs))
+	return nil
+}
+
+// forget removes the pinned keys of peer
+func forget(peer string) {
+	for _, store := range []string{nodeKeysKey, messageKeysKey, hostKeysKey} {
+		pins := loadPins(store)
+		delete(pins, peer)
+		bs, _ := json.Marshal(pins)
+		storageSet(store, string(bs))
+	}
+}
@@ -0,0 +1,149 @@
+//go:build js && wasm
+// +build js,wasm
+
+// The browser client of sshx, built with
+//
+//	GOOS=js GOARCH=wasm go build -o sshx.wasm ./cmd/web
+//
+// It opens ssh and VNC sessions to devices over WebRTC as the daemon does,
+// from a page of the signaling server and without installing sshx. The
+// page runs it with wasm_exec.js of the Go distribution and calls the
+// functions of the global sshx object, see index.html.
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+)
+
+// options are the options of a session given by the page
+type options struct {
+	js.Value
+}
+
+func (o options) str(key string) string {
+	v := o.Get(key)
+	if v.Type() != js.TypeString {
+		return ""
+	}
+	return v.String()
+}
+
+func (o options) integer(key string, def int) int {
+	v := o.Get(key)
+	if v.Type() != js.TypeNumber {
+		return def
+	}
+	return v.Int()
+}
+
+func (o options) boolean(key string) bool {
+	v := o.Get(key)
+	return v.Type() == js.TypeBoolean && v.Bool()
+}
+
+func (o options) strings(key string) []string {
+	v := o.Get(key)
+	if v.Type() != js.TypeObject {
+		return nil
+	}
+	ret := make([]string, v.Length())
+	for i := range ret {
+		ret[i] = v.Index(i).String()
+	}
+	return ret
+}
+
+// call calls the function of key with args if the page set it
+func (o options) call(key string, args ...interface{}) js.Value {
+	v := o.Get(key)
+	if v.Type() != js.TypeFunction {
+		return js.Undefined()
+	}
+	return v.Invoke(args...)
+}
+
+// dial opens a connection with the app of target through the signaling
+// server of o
+func (o options) dial(target string, app int32) (*channelConn, error) {
+	id, err := loadIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if o.str("signaling") == "" || target == "" {
+		return nil, fmt.Errorf("no signaling server or target")
+	}
+	sig := newSignaling(o.str("signaling"), o.str("token"), id)
+	return dial(sig, o.strings("iceServers"), target, app, o.str("otp"))
+}
+
+func jsBytes(bs []byte) js.Value {
+	ret := js.Global().Get("Uint8Array").New(len(bs))
+	js.CopyBytesToJS(ret, bs)
+	return ret
+}
+
+// goBytes returns the bytes of a string or an Uint8Array
+func goBytes(v js.Value) []byte {
+	if v.Type() == js.TypeString {
+		return []byte(v.String())
+	}
+	ret := make([]byte, v.Get("length").Int())
+	js.CopyBytesToGo(ret, v)
+	return ret
+}
+
+// promise runs fn in a goroutine, since it blocks, and returns a promise of
+// its result
+func promise(fn func() (interface{}, error)) js.Value {
+	executor := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resolve, reject := args[0], args[1]
+		go func() {
+			ret, err := fn()
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(ret)
+		}()
+		return nil
+	})
+	// the executor runs before the promise is returned
+	defer executor.Release()
+	return js.Global().Get("Promise").New(executor)
+}
+
+func main() {
+	api := map[string]interface{}{
+		// id returns the device ID of the browser, the one devices see
+		"id": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			id, err := loadIdentity()
+			if err != nil {
+				return ""
+			}
+			return id.ID
+		}),
+		// ssh opens a shell, it returns a promise of the session
+		"ssh": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			o := options{args[0]}
+			return promise(func() (interface{}, error) {
+				return openSSH(o)
+			})
+		}),
+		// vnc opens a VNC stream, it returns a promise of the stream
+		"vnc": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			o := options{args[0]}
+			return promise(func() (interface{}, error) {
+				return openVNC(o)
+			})
+		}),
+		// forget removes the pinned keys of a device
+		"forget": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			forget(args[0].String())
+			return nil
+		}),
+	}
+	js.Global().Set("sshx", api)
+	js.Global().Call("dispatchEvent", js.Global().Get("Event").New("sshxready"))
+	select {}
+}
@@ -0,0 +1,227 @@
+//go:build js && wasm
+// +build js,wasm
+
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall/js"
+
+	"github.com/suutaku/sshx/pkg/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// vncAuthRequest and vncAuthReply are impl.VNCAuthRequest and
+// impl.VNCAuthReply, which the VNC service reads before the stream
+type vncAuthRequest struct {
+	Token    string
+	ViewOnly bool
+}
+
+type vncAuthReply struct {
+	Error string
+}
+
+// exactReader makes gob read byte by byte, so nothing of the VNC stream
+// following the reply is buffered away
+type exactReader struct {
+	io.Reader
+}
+
+func (er exactReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(er.Reader, b[:])
+	return b[0], err
+}
+
+// inputQueue writes the data of the page to a session in order. The
+// callbacks of the page must not block, so they only queue the data.
+type inputQueue struct {
+	lock  sync.Mutex
+	queue [][]byte
+	wake  chan struct{}
+}
+
+func newInputQueue(w io.Writer) *inputQueue {
+	ret := &inputQueue{
+		wake: make(chan struct{}, 1),
+	}
+	go func() {
+		for range ret.wake {
+			ret.lock.Lock()
+			queue := ret.queue
+			ret.queue = nil
+			ret.lock.Unlock()
+			for _, v := range queue {
+				if _, err := w.Write(v); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return ret
+}
+
+func (q *inputQueue) push(data []byte) {
+	q.lock.Lock()
+	q.queue = append(q.queue, data)
+	q.lock.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pageWriter passes the output of a session to the onData callback
+type pageWriter struct {
+	o options
+}
+
+func (w pageWriter) Write(p []byte) (int, error) {
+	w.o.call("onData", jsBytes(p))
+	return len(p), nil
+}
+
+// closed calls the onClose callback with the error which ended a session,
+// an empty string if it ended cleanly
+func (o options) closed(err error) {
+	if err != nil && err != io.EOF {
+		o.call("onClose", err.Error())
+		return
+	}
+	o.call("onClose", "")
+}
+
+// openSSH opens a shell on target, [username]@[device id], and returns
+// the session of the page, which has write, resize and close
+func openSSH(o options) (interface{}, error) {
+	target := o.str("target")
+	i := strings.Index(target, "@")
+	if i <= 0 {
+		return nil, fmt.Errorf("no user name in %s", target)
+	}
+	user, device := target[:i], target[i+1:]
+	conn, err := o.dial(device, types.APP_TYPE_SSH)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{
+			ssh.PasswordCallback(func() (string, error) {
+				pass := o.call("password", fmt.Sprintf("Password of %s: ", target))
+				if pass.Type() != js.TypeString || pass.String() == "" {
+					return "", fmt.Errorf("login canceled")
+				}
+				return pass.String(), nil
+			}),
+		},
+		// the connection already is with the pinned keys of the device
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return pin(hostKeysKey, device, "host key", key.Marshal())
+		},
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, device, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	err = session.RequestPty("xterm-256color", o.integer("rows", 24), o.integer("cols", 80), ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	})
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	session.Stdout = pageWriter{o}
+	session.Stderr = pageWriter{o}
+	err = session.Shell()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	go func() {
+		err := session.Wait()
+		client.Close()
+		o.closed(err)
+	}()
+	input := newInputQueue(stdin)
+	return map[string]interface{}{
+		"write": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			input.push(goBytes(args[0]))
+			return nil
+		}),
+		"resize": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			cols, rows := args[0].Int(), args[1].Int()
+			go session.WindowChange(rows, cols)
+			return nil
+		}),
+		"close": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			go client.Close()
+			return nil
+		}),
+	}, nil
+}
+
+// openVNC opens the RFB stream of the VNC service of target, with the
+// session token vncToken, and returns the stream of the page, which has
+// write and close. The page gives it to noVNC as its channel.
+func openVNC(o options) (interface{}, error) {
+	conn, err := o.dial(o.str("target"), types.APP_TYPE_VNC)
+	if err != nil {
+		return nil, err
+	}
+	err = gob.NewEncoder(conn).Encode(vncAuthRequest{
+		Token:    o.str("vncToken"),
+		ViewOnly: o.boolean("viewOnly"),
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var reply vncAuthReply
+	err = gob.NewDecoder(exactReader{conn}).Decode(&reply)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply.Error != "" {
+		conn.Close()
+		return nil, errors.New(reply.Error)
+	}
+	go func() {
+		_, err := io.Copy(pageWriter{o}, conn)
+		conn.Close()
+		o.closed(err)
+	}()
+	input := newInputQueue(conn)
+	return map[string]interface{}{
+		"write": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			input.push(goBytes(args[0]))
+			return nil
+		}),
+		"close": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			go conn.Close()
+			return nil
+		}),
+	}, nil
+}
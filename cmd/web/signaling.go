@@ -0,0 +1,89 @@
+//go:build js && wasm
+// +build js,wasm
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/suutaku/sshx/internal/e2e"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// signaling exchanges the messages of the browser with devices through a
+// signaling server, over fetch
+type signaling struct {
+	addr  string
+	token string
+	id    *identity
+}
+
+func newSignaling(addr, token string, id *identity) *signaling {
+	return &signaling{
+		addr:  strings.TrimSuffix(addr, "/"),
+		token: token,
+		id:    id,
+	}
+}
+
+func (s *signaling) request(method, p string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.addr+p, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", types.WIRE_CONTENT_TYPE)
+	}
+	req.Header.Set("Accept", types.WIRE_CONTENT_TYPE)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// push signs and sends a message to its target
+func (s *signaling) push(info types.SignalingInfo) error {
+	info.Source = s.id.ID
+	s.id.sign(&info)
+	buf := bytes.NewBuffer(nil)
+	err := types.WriteSignalingInfo(buf, &info)
+	if err != nil {
+		return err
+	}
+	resp, err := s.request(http.MethodPost, path.Join("/", "push", info.Target), buf)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("push to %s: %s", info.Target, resp.Status)
+	}
+	return nil
+}
+
+// pull returns the next message of the browser, io.EOF if there is none
+func (s *signaling) pull() (types.SignalingInfo, error) {
+	resp, err := s.request(http.MethodGet, path.Join("/", "pull", s.id.ID), nil)
+	if err != nil {
+		return types.SignalingInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return types.SignalingInfo{}, fmt.Errorf("signaling server refused the token")
+	}
+	return types.DecodeSignalingInfo(resp.Body)
+}
+
+// verify checks the signature of a message and the node key of its source
+func (s *signaling) verify(info *types.SignalingInfo) error {
+	if len(info.NodeKey) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(info.NodeKey), e2e.SignalingDigest(info), info.Signature) {
+		return fmt.Errorf("invalid signature of the signaling message of %s", info.Source)
+	}
+	return pin(nodeKeysKey, info.Source, "node key", info.NodeKey)
+}
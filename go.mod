@@ -3,10 +3,12 @@ module github.com/suutaku/sshx
 go 1.16
 
 require (
+	fyne.io/systray v1.10.1-0.20231115130155-104f5ef7839e
 	github.com/andybalholm/brotli v1.0.4
 	github.com/deckarep/gosx-notifier v0.0.0-20180201035817-e127226297fb // indirect
 	github.com/fsnotify/fsnotify v1.5.4
-	github.com/go-vgo/robotgo v1.0.0-beta5.2 // indirect
+	github.com/go-vgo/robotgo v1.0.0-beta5.2
+	github.com/godbus/dbus/v5 v5.1.0 // indirect
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.5.0
@@ -18,6 +20,7 @@ require (
 	github.com/martinlindhe/notify v0.0.0-20181008203735-20632c9a275a
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d // indirect
+	github.com/pion/stun v0.3.5
 	github.com/pion/webrtc/v3 v3.1.33
 	github.com/pkg/sftp v1.13.4
 	github.com/povsister/scp v0.0.0-20210427074412-33febfd9f13e
@@ -29,9 +32,11 @@ require (
 	github.com/suutaku/go-qrc v0.0.0-20220614095855-d9b49b30d0fe
 	github.com/suutaku/go-sshfs v0.0.0-20220518043403-602beaef1003
 	github.com/suutaku/go-vnc v0.0.0-20220423131932-dd675a6c4e62
+	github.com/winfsp/cgofuse v1.5.0
 	golang.org/x/crypto v0.0.0-20220427172511-eb4f295cb31f
-	golang.org/x/image v0.0.0-20220413100746-70e8d0d3baa9 // indirect
+	golang.org/x/image v0.0.0-20220413100746-70e8d0d3baa9
 	golang.org/x/net v0.0.0-20220425223048-2871e0cb64e4
+	golang.org/x/sys v0.0.0-20220422013727-9388b58f7150
 	golang.org/x/term v0.0.0-20220526004731-065cf7ba2467
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 	gopkg.in/toast.v1 v1.0.0-20180812000517-0a84660828b2 // indirect
@@ -0,0 +1,225 @@
+// Package audit exports the security events of the daemon to syslog and
+// to a webhook, for SIEM systems
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+// Categories of events
+const (
+	CATEGORY_SESSION = "session"
+	CATEGORY_AUTH    = "auth"
+	CATEGORY_PAIRING = "pairing"
+	CATEGORY_KEYS    = "keys"
+	CATEGORY_TASK    = "task"
+)
+
+// Outcomes of events
+const (
+	OUTCOME_SUCCESS = "success"
+	OUTCOME_FAILURE = "failure"
+)
+
+// events waiting to be sent, more are dropped
+const queueSize = 256
+
+// Event is a security event of the daemon
+type Event struct {
+	Time     time.Time `json:"time"`
+	Device   string    `json:"device"`
+	Category string    `json:"category"`
+	Action   string    `json:"action"`
+	Outcome  string    `json:"outcome"`
+	Peer     string    `json:"peer,omitempty"`
+	App      string    `json:"app,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+type exporter struct {
+	once   sync.Once
+	events chan exportedEvent
+	syslog net.Conn
+	addr   string
+	client http.Client
+}
+
+// exportedEvent is an event with the settings it is exported with
+type exportedEvent struct {
+	Event
+	ac conf.AuditConf
+}
+
+var exp = &exporter{
+	events: make(chan exportedEvent, queueSize),
+	client: http.Client{Timeout: 10 * time.Second},
+}
+
+// Emit exports an event if its category is enabled, it doesn't block
+func Emit(category, action, outcome, peer, app, message string) {
+	cm, err := conf.Shared()
+	if err != nil {
+		return
+	}
+	ac := cm.Conf.AuditConf
+	if ac.Syslog == "" && ac.Webhook == "" {
+		return
+	}
+	enabled := false
+	for _, v := range ac.Categories {
+		if v == category || v == "*" {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return
+	}
+	exp.once.Do(func() {
+		go exp.run()
+	})
+	ev := exportedEvent{
+		Event: Event{
+			Time:     time.Now().UTC(),
+			Device:   cm.Conf.ID,
+			Category: category,
+			Action:   action,
+			Outcome:  outcome,
+			Peer:     peer,
+			App:      app,
+			Message:  message,
+		},
+		ac: ac,
+	}
+	select {
+	case exp.events <- ev:
+	default:
+		logrus.Warn("audit queue full, dropped ", action, " event")
+	}
+}
+
+// Denied exports the failure of an action, err tells why
+func Denied(category, action, peer, app string, err error) {
+	Emit(category, action, OUTCOME_FAILURE, peer, app, err.Error())
+}
+
+func (e *exporter) run() {
+	for ev := range e.events {
+		if ev.ac.Syslog != "" {
+			err := e.sendSyslog(ev.ac.Syslog, ev.Event)
+			if err != nil {
+				logrus.Warn("audit syslog: ", err)
+			}
+		}
+		if ev.ac.Webhook != "" {
+			err := e.sendWebhook(ev.ac, ev.Event)
+			if err != nil {
+				logrus.Warn("audit webhook: ", err)
+			}
+		}
+	}
+}
+
+// dialSyslog connects to udp://host:port, tcp://host:port or unix:///path
+func dialSyslog(addr string) (net.Conn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		return net.DialTimeout(u.Scheme, u.Host, 10*time.Second)
+	case "unix":
+		conn, err := net.Dial("unixgram", u.Path)
+		if err != nil {
+			conn, err = net.Dial("unix", u.Path)
+		}
+		return conn, err
+	}
+	return nil, fmt.Errorf("unknown syslog address %s, use udp://, tcp:// or unix://", addr)
+}
+
+func (e *exporter) sendSyslog(addr string, ev Event) error {
+	if e.syslog != nil && e.addr != addr {
+		e.syslog.Close()
+		e.syslog = nil
+	}
+	msg := []byte(formatRFC5424(ev))
+	// stream transports frame messages by octet counting, RFC 6587
+	stream := strings.HasPrefix(addr, "tcp://")
+	if stream {
+		msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	}
+	for try := 0; try < 2; try++ {
+		if e.syslog == nil {
+			conn, err := dialSyslog(addr)
+			if err != nil {
+				return err
+			}
+			e.syslog, e.addr = conn, addr
+		}
+		e.syslog.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		_, err := e.syslog.Write(msg)
+		if err == nil {
+			return nil
+		}
+		// the server may have closed the connection, dial again once
+		e.syslog.Close()
+		e.syslog = nil
+		if try == 1 {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *exporter) sendWebhook(ac conf.AuditConf, ev Event) error {
+	var body []byte
+	contentType := "application/json"
+	if strings.EqualFold(ac.WebhookFormat, "cef") {
+		body = []byte(formatCEF(ev))
+		contentType = "text/plain"
+	} else {
+		var err error
+		body, err = json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, ac.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if ac.WebhookToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ac.WebhookToken)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", ac.Webhook, resp.Status)
+	}
+	return nil
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "-"
+	}
+	return name
+}
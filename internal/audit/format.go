@@ -0,0 +1,90 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// facility authpriv, severities notice and warning
+const (
+	facilityAuthPriv = 10
+	severityWarning  = 4
+	severityNotice   = 5
+)
+
+// enterprise number of the structured data of events, the private one
+// of RFC 5612 reserved for documentation
+const sdID = "sshx@32473"
+
+func severity(ev Event) int {
+	if ev.Outcome == OUTCOME_FAILURE {
+		return severityWarning
+	}
+	return severityNotice
+}
+
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// formatRFC5424 returns the syslog message of an event
+func formatRFC5424(ev Event) string {
+	params := []string{
+		fmt.Sprintf(`category="%s"`, sdEscaper.Replace(ev.Category)),
+		fmt.Sprintf(`outcome="%s"`, sdEscaper.Replace(ev.Outcome)),
+		fmt.Sprintf(`device="%s"`, sdEscaper.Replace(ev.Device)),
+	}
+	if ev.Peer != "" {
+		params = append(params, fmt.Sprintf(`peer="%s"`, sdEscaper.Replace(ev.Peer)))
+	}
+	if ev.App != "" {
+		params = append(params, fmt.Sprintf(`app="%s"`, sdEscaper.Replace(ev.App)))
+	}
+	msg := ev.Action
+	if ev.Message != "" {
+		msg += ": " + ev.Message
+	}
+	return fmt.Sprintf("<%d>1 %s %s sshx %d %s [%s %s] %s",
+		facilityAuthPriv*8+severity(ev),
+		ev.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		hostname(),
+		os.Getpid(),
+		strings.ReplaceAll(ev.Action, " ", "_"),
+		sdID,
+		strings.Join(params, " "),
+		msg,
+	)
+}
+
+var (
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefValueEscaper  = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// formatCEF returns the ArcSight Common Event Format line of an event
+func formatCEF(ev Event) string {
+	cefSeverity := 3
+	if ev.Outcome == OUTCOME_FAILURE {
+		cefSeverity = 7
+	}
+	ext := []string{
+		fmt.Sprintf("rt=%d", ev.Time.UnixNano()/1e6),
+		"cat=" + cefValueEscaper.Replace(ev.Category),
+		"outcome=" + cefValueEscaper.Replace(ev.Outcome),
+		"dvchost=" + cefValueEscaper.Replace(ev.Device),
+	}
+	if ev.Peer != "" {
+		ext = append(ext, "suser="+cefValueEscaper.Replace(ev.Peer))
+	}
+	if ev.App != "" {
+		ext = append(ext, "app="+cefValueEscaper.Replace(ev.App))
+	}
+	if ev.Message != "" {
+		ext = append(ext, "msg="+cefValueEscaper.Replace(ev.Message))
+	}
+	return fmt.Sprintf("CEF:0|sshx|sshx|1.0|%s|%s|%d|%s",
+		cefHeaderEscaper.Replace(ev.Action),
+		cefHeaderEscaper.Replace(strings.ReplaceAll(ev.Action, ".", " ")),
+		cefSeverity,
+		strings.Join(ext, " "),
+	)
+}
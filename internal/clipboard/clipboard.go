@@ -0,0 +1,66 @@
+// Package clipboard reads and writes the system clipboard. Text works on every
+// platform supported by robotgo, PNG images need xclip or wl-clipboard on Linux.
+package clipboard
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/go-vgo/robotgo"
+)
+
+const (
+	FORMAT_TEXT = "text/plain"
+	FORMAT_PNG  = "image/png"
+)
+
+func imageCommand(write bool) (*exec.Cmd, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("image clipboard is not supported on %s", runtime.GOOS)
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		if write {
+			return exec.Command("wl-copy", "--type", FORMAT_PNG), nil
+		}
+		return exec.Command("wl-paste", "--no-newline", "--type", FORMAT_PNG), nil
+	}
+	if write {
+		return exec.Command("xclip", "-selection", "clipboard", "-t", FORMAT_PNG, "-i"), nil
+	}
+	return exec.Command("xclip", "-selection", "clipboard", "-t", FORMAT_PNG, "-o"), nil
+}
+
+// Read returns the clipboard content in the given format
+func Read(format string) ([]byte, error) {
+	switch format {
+	case FORMAT_TEXT, "":
+		text, err := robotgo.ReadAll()
+		return []byte(text), err
+	case FORMAT_PNG:
+		cmd, err := imageCommand(false)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Output()
+	}
+	return nil, fmt.Errorf("unknown clipboard format %s", format)
+}
+
+// Write replaces the clipboard content
+func Write(format string, data []byte) error {
+	switch format {
+	case FORMAT_TEXT, "":
+		return robotgo.WriteAll(string(data))
+	case FORMAT_PNG:
+		cmd, err := imageCommand(true)
+		if err != nil {
+			return err
+		}
+		cmd.Stdin = bytes.NewReader(data)
+		return cmd.Run()
+	}
+	return fmt.Errorf("unknown clipboard format %s", format)
+}
@@ -0,0 +1,59 @@
+package conn
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/suutaku/sshx/internal/audit"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// admit runs the checks of an inbound session of peerId: the revocation,
+// the access rules, the one-time code and the approval of the knock mode.
+// The outcome is exported as a session event. source is the address the
+// session comes from, wrong one-time codes are throttled by it.
+func admit(knocks *KnockQueue, peerId, source string, imp impl.Impl) error {
+	app := impl.AppName(imp.Code())
+	err := checkAdmission(knocks, peerId, source, imp)
+	if err != nil {
+		recordEvent(types.EVENT_DENIED, imp.PairId(), app, peerId, err)
+		audit.Denied(audit.CATEGORY_SESSION, "session.accept", peerId, app, err)
+		return err
+	}
+	audit.Emit(audit.CATEGORY_SESSION, "session.accept", audit.OUTCOME_SUCCESS, peerId, app, "")
+	return nil
+}
+
+func checkAdmission(knocks *KnockQueue, peerId, source string, imp impl.Impl) error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	if impl.IsRevoked(cm, peerId) {
+		return fmt.Errorf("%s is revoked", peerId)
+	}
+	err = impl.Authorize(peerId, imp)
+	if err != nil {
+		return err
+	}
+	err = impl.CheckOneTimeCode(peerId, source, imp.Code(), imp.OneTimeCode())
+	if err != nil {
+		return err
+	}
+	return knocks.Approve(peerId, imp.Code())
+}
+
+// sourceHost returns the host of addr, the port changes with each
+// connection of a peer
+func sourceHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,91 @@
+package conn
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/suutaku/sshx/internal/utils"
+)
+
+// CheckSignaling polls the queue of id once, through the outbound proxy op,
+// to check the signaling server is reachable and accepts the tenant token
+func CheckSignaling(addr, token, id string, op *utils.OutboundProxy, timeout time.Duration) error {
+	req, err := http.NewRequest(http.MethodGet, addr+path.Join("/", "pull", id), nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := op.HTTPClient(timeout).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return fmt.Errorf("the signaling server refused the token")
+	}
+	return fmt.Errorf("signaling server answered %s", resp.Status)
+}
+
+// CheckICEServer gathers candidates with one ICE server: a STUN server must
+// give a server reflexive candidate, a TURN server a relay one. TURN servers
+// over TCP are reached through the outbound proxy op.
+func CheckICEServer(s webrtc.ICEServer, op *utils.OutboundProxy, timeout time.Duration) error {
+	conf := webrtc.Configuration{ICEServers: []webrtc.ICEServer{s}}
+	want := webrtc.ICECandidateTypeSrflx
+	for _, u := range s.URLs {
+		if strings.HasPrefix(strings.ToLower(u), "turn") {
+			conf.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+			want = webrtc.ICECandidateTypeRelay
+		}
+	}
+	pc, err := NewPeerConnection(conf, op)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	found := make(chan struct{}, 1)
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil && c.Typ == want {
+			select {
+			case found <- struct{}{}:
+			default:
+			}
+		}
+	})
+	// an offer needs something to negotiate
+	_, err = pc.CreateDataChannel("check", nil)
+	if err != nil {
+		return err
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	err = pc.SetLocalDescription(offer)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-found:
+		return nil
+	case <-gathered:
+		select {
+		case <-found:
+			return nil
+		default:
+		}
+		return fmt.Errorf("no %s candidate", want)
+	case <-time.After(timeout):
+		return fmt.Errorf("no %s candidate after %s", want, timeout)
+	}
+}
@@ -0,0 +1,75 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// errClientGone fails the dials of the clients which hung up
+var errClientGone = errors.New("the client hung up")
+
+// clientWatch cancels the dial of a session once its local client hangs
+// up. Clients wait for the answer to their request before they write, so
+// the read only returns when they close the connection.
+type clientWatch struct {
+	sock   net.Conn
+	raw    net.Conn
+	cancel context.CancelFunc
+	done   chan struct{}
+	buf    []byte
+}
+
+func watchClient(sock net.Conn, cancel context.CancelFunc) *clientWatch {
+	cw := &clientWatch{
+		sock:   sock,
+		raw:    sock,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	// a paused transfer would hold the read of its connection
+	if tc, ok := sock.(*transferConn); ok {
+		cw.raw = tc.Conn
+	}
+	go cw.run()
+	return cw
+}
+
+func (cw *clientWatch) run() {
+	defer close(cw.done)
+	b := make([]byte, 1)
+	n, err := cw.raw.Read(b)
+	cw.buf = b[:n]
+	var ne net.Error
+	if err != nil && !(errors.As(err, &ne) && ne.Timeout()) {
+		cw.cancel()
+	}
+}
+
+// stop ends the watch and returns the connection of the client, which
+// starts with the byte read if the client wrote before the answer
+func (cw *clientWatch) stop() net.Conn {
+	cw.raw.SetReadDeadline(time.Unix(1, 0))
+	<-cw.done
+	cw.raw.SetReadDeadline(time.Time{})
+	if len(cw.buf) == 0 {
+		return cw.sock
+	}
+	return &prefixConn{Conn: cw.sock, prefix: cw.buf}
+}
+
+// prefixConn reads prefix before the connection
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (pc *prefixConn) Read(p []byte) (int, error) {
+	if len(pc.prefix) > 0 {
+		n := copy(p, pc.prefix)
+		pc.prefix = pc.prefix[n:]
+		return n, nil
+	}
+	return pc.Conn.Read(p)
+}
@@ -1,6 +1,9 @@
 package conn
 
 import (
+	"context"
+	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -22,12 +25,19 @@ type Connection interface {
 	Dial() error
 	Response() error
 	Direction() int32
+	// Context is done once the connection is closed
+	Context() context.Context
 	IsReady() bool
 	Ready()
 	Name() string
+	History() types.HistoryRecord
 }
 
 type BaseConnection struct {
+	// bytesIn and bytesOut count the data received from and sent to the
+	// peer, updated atomically so they come first to be 64-bit aligned
+	bytesIn  int64
+	bytesOut int64
 	impl     impl.Impl
 	nodeId   string
 	targetId string
@@ -35,17 +45,31 @@ type BaseConnection struct {
 	Exit     chan error
 	Direct   int32
 	ready    bool
+	// created is when the session was dialed or offered
+	created time.Time
+	// path and candidate describe the path of the connection once open
+	path      string
+	candidate string
+	// failure is why the session failed, the first reason is kept
+	failure string
+	// ctx is passed to the impl and canceled on Close
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func NewBaseConnection(impl impl.Impl, nodeId, targetId string, poolId types.PoolId, direct, implc int32) *BaseConnection {
 	impl.Init()
+	ctx, cancel := context.WithCancel(context.Background())
 	ret := &BaseConnection{
+		ctx:      ctx,
+		cancel:   cancel,
 		Exit:     make(chan error, 10),
 		nodeId:   nodeId,
 		targetId: targetId,
 		poolId:   poolId,
 		impl:     impl,
 		Direct:   direct,
+		created:  time.Now(),
 	}
 	if ret.PoolId().Raw() == 0 {
 		ret.poolId = *types.NewPoolId(time.Now().UnixNano(), implc)
@@ -53,6 +77,46 @@ func NewBaseConnection(impl impl.Impl, nodeId, targetId string, poolId types.Poo
 	return ret
 }
 
+// sessionLog returns the logger of the session of a pool, its lines carry
+// the session, the pair ID, the application and the peer
+func sessionLog(poolId types.PoolId, direct int32, peer string) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		types.LOG_FIELD_SESSION: poolId.Session(),
+		types.LOG_FIELD_PAIR:    poolId.String(direct),
+		types.LOG_FIELD_APP:     impl.AppName(poolId.ImplCode),
+		types.LOG_FIELD_PEER:    peer,
+	})
+}
+
+// log returns the logger of the connection
+func (bc *BaseConnection) log() *logrus.Entry {
+	return sessionLog(bc.poolId, bc.Direct, bc.targetId)
+}
+
+// fail records why the session failed for the history
+func (bc *BaseConnection) fail(reason ...interface{}) {
+	if bc.failure == "" {
+		bc.failure = fmt.Sprint(reason...)
+	}
+}
+
+// History returns the record of the session for the history, its end is
+// set when it is added
+func (bc *BaseConnection) History() types.HistoryRecord {
+	return types.HistoryRecord{
+		PairId:    bc.poolId.String(bc.Direct),
+		TargetId:  bc.targetId,
+		App:       impl.AppName(bc.poolId.ImplCode),
+		Inbound:   bc.Direct == CONNECTION_DRECT_IN,
+		Start:     bc.created,
+		BytesIn:   atomic.LoadInt64(&bc.bytesIn),
+		BytesOut:  atomic.LoadInt64(&bc.bytesOut),
+		Candidate: bc.candidate,
+		Path:      bc.path,
+		Failure:   bc.failure,
+	}
+}
+
 func (bc *BaseConnection) Ready() {
 	bc.ready = true
 }
@@ -66,7 +130,8 @@ func (bc *BaseConnection) Direction() int32 {
 }
 
 func (bc *BaseConnection) Close() {
-	logrus.Debug("close pair")
+	bc.log().Debug("close pair")
+	bc.cancel()
 	if bc.impl != nil {
 		bc.impl.Close()
 	}
@@ -80,7 +145,7 @@ func (bc *BaseConnection) GetImpl() impl.Impl {
 }
 
 func (bc *BaseConnection) ResetPoolId(id types.PoolId) {
-	logrus.Debug("reset pool id from ", bc.poolId, " to ", id)
+	bc.log().Debug("reset pool id from ", bc.poolId, " to ", id)
 	bc.poolId = id
 }
 
@@ -88,10 +153,15 @@ func (bc *BaseConnection) TargetId() string {
 	return bc.targetId
 }
 
+// Context returns the context of the session, done once it is closed
+func (bc *BaseConnection) Context() context.Context {
+	return bc.ctx
+}
+
 func (bc *BaseConnection) Dial() error {
-	return bc.impl.Dial()
+	return bc.impl.Dial(bc.ctx)
 }
 func (bc *BaseConnection) Response() error {
-	logrus.Debug("base connection response")
-	return bc.impl.Response()
+	bc.log().Debug("base connection response")
+	return bc.impl.Response(bc.ctx)
 }
@@ -0,0 +1,263 @@
+package conn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/suutaku/sshx/internal/utils"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// frames of the DERP protocol, as Tailscale relays speak it
+const (
+	derpFrameServerKey     = 0x01
+	derpFrameClientInfo    = 0x02
+	derpFrameServerInfo    = 0x03
+	derpFrameSendPacket    = 0x04
+	derpFrameRecvPacket    = 0x05
+	derpFrameKeepAlive     = 0x06
+	derpFrameNotePreferred = 0x07
+	derpFramePeerGone      = 0x08
+	derpFramePing          = 0x12
+	derpFramePong          = 0x13
+)
+
+const (
+	// derpProtocolVersion is the version of the protocol the client
+	// announces
+	derpProtocolVersion = 2
+
+	// derpMaxFrame bounds the frames read from a relay
+	derpMaxFrame = 1 << 20
+
+	// derpMaxPacket is the largest packet relays forward
+	derpMaxPacket = 64 << 10
+
+	// derpDialTimeout bounds the connection to a relay and its handshake
+	derpDialTimeout = 10 * time.Second
+)
+
+// derpMagic starts the key frame of the server, "DERP🔑"
+var derpMagic = []byte("DERP\xf0\x9f\x94\x91")
+
+// derpKey is the public X25519 key of a client of a relay
+type derpKey [32]byte
+
+// derpClient is a connection to a DERP relay. It sends packets to the keys
+// of the clients of the relay and receives the ones sent to its own key.
+type derpClient struct {
+	url       string
+	conn      net.Conn
+	br        *bufio.Reader
+	bw        *bufio.Writer
+	serverKey derpKey
+	// wlock serializes the frames written
+	wlock sync.Mutex
+}
+
+// dialDERP connects to the relay at rawURL through the outbound proxy and
+// logs in with the key pair priv and pub
+func dialDERP(rawURL string, op *utils.OutboundProxy, priv, pub []byte) (*derpClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DERP relay %s: %v", rawURL, err)
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "https":
+		if port == "" {
+			port = "443"
+		}
+	case "http":
+		if port == "" {
+			port = "80"
+		}
+	default:
+		return nil, fmt.Errorf("invalid DERP relay %s: unknown scheme %s", rawURL, u.Scheme)
+	}
+	if u.Path == "" {
+		u.Path = "/derp"
+	}
+	conn, err := op.Dial("tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(derpDialTimeout))
+	if u.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		err = tc.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("DERP relay %s: %v", u.Host, err)
+		}
+		conn = tc
+	}
+	dc := &derpClient{
+		url:  rawURL,
+		conn: conn,
+		br:   bufio.NewReader(conn),
+		bw:   bufio.NewWriter(conn),
+	}
+	err = dc.upgrade(u)
+	if err == nil {
+		err = dc.login(priv, pub)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("DERP relay %s: %v", u.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return dc, nil
+}
+
+// upgrade switches the HTTP connection to the DERP protocol
+func (dc *derpClient) upgrade(u *url.URL) error {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "DERP")
+	err = req.Write(dc.bw)
+	if err == nil {
+		err = dc.bw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	res, err := http.ReadResponse(dc.br, req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		res.Body.Close()
+		return fmt.Errorf("upgrade refused: %s", res.Status)
+	}
+	return nil
+}
+
+// login reads the key of the server and sends the info of the client,
+// sealed for the server
+func (dc *derpClient) login(priv, pub []byte) error {
+	typ, payload, err := dc.readFrame()
+	if err != nil {
+		return err
+	}
+	if typ != derpFrameServerKey || len(payload) != len(derpMagic)+32 || !bytes.Equal(payload[:len(derpMagic)], derpMagic) {
+		return fmt.Errorf("not a DERP server")
+	}
+	copy(dc.serverKey[:], payload[len(derpMagic):])
+	info := []byte(fmt.Sprintf(`{"version":%d}`, derpProtocolVersion))
+	var nonce [24]byte
+	_, err = rand.Read(nonce[:])
+	if err != nil {
+		return err
+	}
+	var sk [32]byte
+	copy(sk[:], priv)
+	sealed := box.Seal(nil, info, &nonce, (*[32]byte)(&dc.serverKey), &sk)
+	return dc.writeFrame(derpFrameClientInfo, pub, nonce[:], sealed)
+}
+
+// notePreferred tells the relay whether it is the home relay of this
+// device
+func (dc *derpClient) notePreferred(home bool) error {
+	b := byte(0)
+	if home {
+		b = 1
+	}
+	return dc.writeFrame(derpFrameNotePreferred, []byte{b})
+}
+
+// readFrame reads a frame of the relay, its type and payload
+func (dc *derpClient) readFrame() (byte, []byte, error) {
+	var hdr [5]byte
+	_, err := io.ReadFull(dc.br, hdr[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	l := binary.BigEndian.Uint32(hdr[1:])
+	if l > derpMaxFrame {
+		return 0, nil, fmt.Errorf("DERP frame of %d bytes", l)
+	}
+	payload := make([]byte, l)
+	_, err = io.ReadFull(dc.br, payload)
+	return hdr[0], payload, err
+}
+
+// writeFrame writes a frame of type typ with the parts of its payload
+func (dc *derpClient) writeFrame(typ byte, parts ...[]byte) error {
+	dc.wlock.Lock()
+	defer dc.wlock.Unlock()
+	l := 0
+	for _, v := range parts {
+		l += len(v)
+	}
+	var hdr [5]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(l))
+	dc.bw.Write(hdr[:])
+	for _, v := range parts {
+		dc.bw.Write(v)
+	}
+	return dc.bw.Flush()
+}
+
+// Send sends pkt to the client of the relay with the key dst
+func (dc *derpClient) Send(dst derpKey, pkt []byte) error {
+	if len(pkt) > derpMaxPacket {
+		return fmt.Errorf("DERP packet of %d bytes", len(pkt))
+	}
+	return dc.writeFrame(derpFrameSendPacket, dst[:], pkt)
+}
+
+// KeepAlive tells the relay the client is still there
+func (dc *derpClient) KeepAlive() error {
+	return dc.writeFrame(derpFrameKeepAlive)
+}
+
+// Recv returns the next packet sent to this device and the key of its
+// sender, gone is set for the peers the relay tells are gone, without a
+// packet. It answers the pings of the relay.
+func (dc *derpClient) Recv() (src derpKey, pkt []byte, gone bool, err error) {
+	for {
+		typ, payload, err := dc.readFrame()
+		if err != nil {
+			return src, nil, false, err
+		}
+		switch typ {
+		case derpFrameRecvPacket:
+			if len(payload) < len(src) {
+				return src, nil, false, fmt.Errorf("short DERP packet")
+			}
+			copy(src[:], payload)
+			return src, payload[len(src):], false, nil
+		case derpFramePeerGone:
+			if len(payload) < len(src) {
+				continue
+			}
+			copy(src[:], payload)
+			return src, nil, true, nil
+		case derpFramePing:
+			err = dc.writeFrame(derpFramePong, payload)
+			if err != nil {
+				return src, nil, false, err
+			}
+		}
+		// server info, keep alives and the frames of newer versions
+	}
+}
+
+func (dc *derpClient) Close() error {
+	return dc.conn.Close()
+}
@@ -0,0 +1,139 @@
+package conn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// DERPConnection is a session over a DERP relay. It is a direct connection
+// over the stream once the handshake proved the node keys of both ends.
+type DERPConnection struct {
+	DirectConnection
+	stream *derpStream
+}
+
+func NewDERPConnection(impl impl.Impl, nodeId string, targetId string, stream *derpStream, poolId types.PoolId, direct int32, cleanChan *chan CleanRequest) *DERPConnection {
+	ret := &DERPConnection{
+		DirectConnection: *NewDirectConnection(impl, nodeId, targetId, poolId, direct, cleanChan),
+		stream:           stream,
+	}
+	ret.Conn = stream
+	return ret
+}
+
+// derpPath describes the path of a DERP connection
+func derpPath(conn net.Conn) string {
+	return fmt.Sprintf("derp relay %s", conn.RemoteAddr())
+}
+
+// handshake proves the node keys of both ends as over the overlay, the
+// offer carries the DERP key and home relay of this device and the answer
+// must carry the DERP key the stream goes to
+func (dc *DERPConnection) handshake(key []byte, home string) (types.SignalingInfo, error) {
+	conn := dc.stream
+	conn.SetDeadline(time.Now().Add(overlayHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	nonce, err := overlayNonce()
+	if err != nil {
+		return types.SignalingInfo{}, err
+	}
+	err = writeHandshake(conn, types.SignalingInfo{
+		Flag:      types.SIG_TYPE_OFFER,
+		Source:    dc.nodeId,
+		Target:    dc.TargetId(),
+		Id:        dc.poolId,
+		OTP:       dc.impl.OneTimeCode(),
+		Hello:     nonce,
+		DERPKey:   key,
+		DERPRelay: home,
+	})
+	if err != nil {
+		return types.SignalingInfo{}, err
+	}
+	answer, err := readHandshake(conn, types.SIG_TYPE_ANSWER, dc.TargetId(), dc.nodeId, nonce)
+	if err != nil {
+		return answer, err
+	}
+	if !bytes.Equal(answer.DERPKey, conn.peer[:]) {
+		return answer, fmt.Errorf("%s answered with another DERP key", dc.TargetId())
+	}
+	return answer, writeHandshake(conn, types.SignalingInfo{
+		Flag:   types.SIG_TYPE_ANSWER,
+		Source: dc.nodeId,
+		Target: dc.TargetId(),
+		Id:     dc.poolId,
+		Proof:  answer.Hello,
+	})
+}
+
+func (dc *DERPConnection) Name() string {
+	if t := reflect.TypeOf(dc); t.Kind() == reflect.Ptr {
+		return "*" + t.Elem().Name()
+	} else {
+		return t.Name()
+	}
+}
+
+func (dc *DERPConnection) Dial() error {
+	return dc.dial(dc.Context())
+}
+
+// dial sets up the session with the target over the stream until ctx is
+// done
+func (dc *DERPConnection) dial(ctx context.Context) error {
+	if dc.impl.IsNeedConnect() {
+		dc.log().Debug("dial ", dc.TargetId(), " over DERP relay ", dc.stream.url)
+		var answer types.SignalingInfo
+		err := utils.WithContext(ctx, dc.stream, func() error {
+			var err error
+			answer, err = dc.handshake(dc.stream.ds.pub, dc.stream.ds.home())
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if answer.DERPRelay != "" {
+			dc.stream.ds.learn(dc.TargetId(), dc.stream.peer, answer.DERPRelay)
+		}
+		implConn := dc.impl.Conn()
+		dc.path, dc.candidate = derpPath(dc.stream), "derp"
+		go func() {
+			dc.pipe(implConn)
+			dc.log().Error("derp broken ", dc.Name())
+			*dc.CleanChan <- CleanRequest{dc.PoolId().String(dc.Direction()), dc.Name()}
+		}()
+	} else {
+		dc.log().Error("NOT create connection for ", impl.GetImplName(dc.impl.Code()))
+	}
+	err := dc.BaseConnection.Dial()
+	if err != nil {
+		return err
+	}
+	dc.Exit <- err
+	dc.Ready()
+	return nil
+}
+
+func (dc *DERPConnection) Response() error {
+	dc.Ready()
+	err := dc.BaseConnection.Response()
+	if err != nil {
+		return err
+	}
+	implConn := dc.impl.Conn()
+	dc.path, dc.candidate = derpPath(dc.stream), "derp"
+	go func() {
+		dc.pipe(implConn)
+		dc.log().Error("derp broken ", dc.Name())
+		*dc.CleanChan <- CleanRequest{dc.poolId.String(dc.Direction()), dc.Name()}
+	}()
+	return nil
+}
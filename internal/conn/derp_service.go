@@ -0,0 +1,865 @@
+package conn
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// segments of the streams carried in DERP packets
+const (
+	derpSegData = iota + 1
+	derpSegAck
+	derpSegFin
+	derpSegReset
+)
+
+const (
+	// derpSegHeader is the size of the type, stream and sequence number of
+	// a segment
+	derpSegHeader = 13
+
+	// derpSegSize is the most data of a segment
+	derpSegSize = 16 << 10
+
+	// derpWindow is the number of segments sent and not acknowledged yet,
+	// relays drop the packets of clients which queue too many
+	derpWindow = 16
+
+	// derpRecvBuffer bounds the data received and not read yet, the
+	// segments beyond are dropped and sent again
+	derpRecvBuffer = 1 << 20
+
+	// derpRetransmit is how long segments wait to be acknowledged before
+	// they are sent again
+	derpRetransmit = time.Second
+
+	// derpGiveUp closes the streams whose segments weren't acknowledged
+	// for that long
+	derpGiveUp = 30 * time.Second
+
+	// derpTick is the period of the retransmissions
+	derpTick = 250 * time.Millisecond
+
+	// derpRedialMax bounds the wait before connecting to a relay again
+	derpRedialMax = 30 * time.Second
+)
+
+var errDERPReset = fmt.Errorf("DERP stream reset by the peer")
+
+// derpSegment is a part of a stream, data segments and the fin one are
+// numbered, acks carry the next number expected
+type derpSegment struct {
+	typ  byte
+	id   uint64
+	seq  uint32
+	data []byte
+}
+
+func (seg derpSegment) marshal() []byte {
+	ret := make([]byte, derpSegHeader+len(seg.data))
+	ret[0] = seg.typ
+	binary.BigEndian.PutUint64(ret[1:], seg.id)
+	binary.BigEndian.PutUint32(ret[9:], seg.seq)
+	copy(ret[derpSegHeader:], seg.data)
+	return ret
+}
+
+func unmarshalDERPSegment(bs []byte) (derpSegment, error) {
+	if len(bs) < derpSegHeader {
+		return derpSegment{}, fmt.Errorf("short DERP segment")
+	}
+	return derpSegment{
+		typ:  bs[0],
+		id:   binary.BigEndian.Uint64(bs[1:]),
+		seq:  binary.BigEndian.Uint32(bs[9:]),
+		data: bs[derpSegHeader:],
+	}, nil
+}
+
+// derpStreamId identifies a stream by the key of the peer and the number
+// the dialer picked
+type derpStreamId struct {
+	peer derpKey
+	id   uint64
+}
+
+// DERPService connects to the peers no other service reaches over DERP
+// relays, the relay servers of Tailscale. Packets are sealed with the DERP
+// keys of both ends, sessions are streams of numbered segments which are
+// sent again until acknowledged, and both ends prove their node keys with
+// signed messages before the session starts, as over the overlay.
+type DERPService struct {
+	BaseConnectionService
+	dc       conf.DERPConf
+	outbound *utils.OutboundProxy
+	priv     []byte
+	pub      []byte
+	// relays are the connected relays by URL, started the ones connected
+	// or being connected
+	relays  map[string]*derpClient
+	started map[string]bool
+	streams map[derpStreamId]*derpStream
+	// shared are the keys of the boxes of each peer
+	shared map[derpKey]*[32]byte
+	lock   sync.Mutex
+}
+
+func NewDERPService(id string, dc conf.DERPConf, pc conf.OutboundProxyConf) *DERPService {
+	outbound, err := NewOutboundProxy(pc)
+	if err != nil {
+		logrus.Error(err, ", using the proxy of the environment")
+		outbound, _ = NewOutboundProxy(conf.OutboundProxyConf{})
+	}
+	return &DERPService{
+		BaseConnectionService: *NewBaseConnectionService(id),
+		dc:                    dc,
+		outbound:              outbound,
+		relays:                make(map[string]*derpClient),
+		started:               make(map[string]bool),
+		streams:               make(map[derpStreamId]*derpStream),
+		shared:                make(map[derpKey]*[32]byte),
+	}
+}
+
+func (ds *DERPService) Start() error {
+	ds.BaseConnectionService.Start()
+	var err error
+	ds.priv, ds.pub, err = impl.DERPKey()
+	if err != nil {
+		logrus.Error(err)
+		ds.isReady = false
+		return err
+	}
+	for i, v := range ds.dc.URLs {
+		ds.startRelay(v, i == 0)
+	}
+	go ds.tick()
+	return nil
+}
+
+func (ds *DERPService) Stop() {
+	ds.BaseConnectionService.Stop()
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	for _, v := range ds.relays {
+		v.Close()
+	}
+}
+
+// IsReady reports whether this device is connected to its home relay
+func (ds *DERPService) IsReady() bool {
+	return ds.BaseConnectionService.IsReady() && len(ds.dc.URLs) > 0 && ds.relay(ds.dc.URLs[0]) != nil
+}
+
+// Fallback reports that DERP relays are only tried once the other
+// services failed to connect
+func (ds *DERPService) Fallback() bool {
+	return true
+}
+
+// home returns the URL of the home relay
+func (ds *DERPService) home() string {
+	if len(ds.dc.URLs) == 0 {
+		return ""
+	}
+	return ds.dc.URLs[0]
+}
+
+func (ds *DERPService) relay(u string) *derpClient {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	return ds.relays[u]
+}
+
+// startRelay keeps this device connected to the relay at u while the
+// service runs, once
+func (ds *DERPService) startRelay(u string, home bool) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if ds.started[u] {
+		return
+	}
+	ds.started[u] = true
+	go ds.serveRelay(u, home)
+}
+
+// serveRelay connects to the relay at u and receives its packets, it
+// connects again with a growing delay when the connection fails
+func (ds *DERPService) serveRelay(u string, home bool) {
+	delay := time.Second
+	for ds.running {
+		dc, err := dialDERP(u, ds.outbound, ds.priv, ds.pub)
+		if err != nil {
+			logrus.Warn(err)
+			time.Sleep(delay)
+			if delay *= 2; delay > derpRedialMax {
+				delay = derpRedialMax
+			}
+			continue
+		}
+		delay = time.Second
+		err = dc.notePreferred(home)
+		if err != nil {
+			dc.Close()
+			continue
+		}
+		logrus.Info("connected to DERP relay ", u)
+		ds.lock.Lock()
+		ds.relays[u] = dc
+		ds.lock.Unlock()
+		done := make(chan struct{})
+		go ds.keepAlive(dc, done)
+		err = ds.receive(dc)
+		close(done)
+		ds.lock.Lock()
+		delete(ds.relays, u)
+		ds.lock.Unlock()
+		dc.Close()
+		if ds.running {
+			logrus.Warn("DERP relay ", u, ": ", err)
+		}
+	}
+}
+
+// keepAlive sends keep alive frames to dc until done is closed
+func (ds *DERPService) keepAlive(dc *derpClient, done chan struct{}) {
+	if ds.dc.KeepAlive <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(ds.dc.KeepAlive) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if dc.KeepAlive() != nil {
+				dc.Close()
+				return
+			}
+		}
+	}
+}
+
+// receive dispatches the packets of dc to their streams until it fails
+func (ds *DERPService) receive(dc *derpClient) error {
+	for {
+		src, pkt, gone, err := dc.Recv()
+		if err != nil {
+			return err
+		}
+		if gone {
+			ds.peerGone(dc.url, src)
+			continue
+		}
+		seg, err := ds.open(src, pkt)
+		if err != nil {
+			logrus.Debug("dropped DERP packet: ", err)
+			continue
+		}
+		ds.dispatch(dc.url, src, seg)
+	}
+}
+
+// sharedKey returns the key of the boxes exchanged with peer
+func (ds *DERPService) sharedKey(peer derpKey) *[32]byte {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if k := ds.shared[peer]; k != nil {
+		return k
+	}
+	var priv [32]byte
+	copy(priv[:], ds.priv)
+	k := new([32]byte)
+	box.Precompute(k, (*[32]byte)(&peer), &priv)
+	ds.shared[peer] = k
+	return k
+}
+
+// seal boxes a segment for peer, the relay only sees the keys of both ends
+func (ds *DERPService) seal(peer derpKey, seg derpSegment) ([]byte, error) {
+	var nonce [24]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	return box.SealAfterPrecomputation(nonce[:], seg.marshal(), &nonce, ds.sharedKey(peer)), nil
+}
+
+// open reads the segment peer boxed in pkt
+func (ds *DERPService) open(peer derpKey, pkt []byte) (derpSegment, error) {
+	if len(pkt) < 24 {
+		return derpSegment{}, fmt.Errorf("short DERP packet")
+	}
+	var nonce [24]byte
+	copy(nonce[:], pkt)
+	bs, ok := box.OpenAfterPrecomputation(nil, pkt[24:], &nonce, ds.sharedKey(peer))
+	if !ok {
+		return derpSegment{}, fmt.Errorf("DERP packet not sealed by its sender")
+	}
+	return unmarshalDERPSegment(bs)
+}
+
+// send sends seg to peer over the relay at u
+func (ds *DERPService) send(u string, peer derpKey, seg derpSegment) error {
+	dc := ds.relay(u)
+	if dc == nil {
+		return fmt.Errorf("not connected to DERP relay %s", u)
+	}
+	pkt, err := ds.seal(peer, seg)
+	if err != nil {
+		return err
+	}
+	return dc.Send(peer, pkt)
+}
+
+// dispatch hands seg to its stream, a first data segment opens a stream
+// of the peer
+func (ds *DERPService) dispatch(u string, src derpKey, seg derpSegment) {
+	sid := derpStreamId{src, seg.id}
+	ds.lock.Lock()
+	s := ds.streams[sid]
+	if s == nil && seg.typ == derpSegData && seg.seq == 0 && ds.running {
+		s = newDERPStream(ds, u, src, seg.id)
+		ds.streams[sid] = s
+		go ds.serveDERP(s)
+	}
+	ds.lock.Unlock()
+	if s != nil {
+		s.receive(seg)
+		return
+	}
+	if seg.typ != derpSegReset && seg.typ != derpSegAck {
+		ds.send(u, src, derpSegment{typ: derpSegReset, id: seg.id})
+	}
+}
+
+// peerGone resets the streams of a peer which left the relay at u
+func (ds *DERPService) peerGone(u string, peer derpKey) {
+	ds.lock.Lock()
+	var gone []*derpStream
+	for k, v := range ds.streams {
+		if k.peer == peer && v.url == u {
+			gone = append(gone, v)
+		}
+	}
+	ds.lock.Unlock()
+	for _, v := range gone {
+		v.fail(fmt.Errorf("peer left DERP relay %s", u))
+	}
+}
+
+func (ds *DERPService) removeStream(s *derpStream) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if ds.streams[s.sid()] == s {
+		delete(ds.streams, s.sid())
+	}
+}
+
+// tick sends the segments which weren't acknowledged again, and forgets
+// the streams which are done
+func (ds *DERPService) tick() {
+	ticker := time.NewTicker(derpTick)
+	defer ticker.Stop()
+	for ds.running {
+		<-ticker.C
+		ds.lock.Lock()
+		streams := make([]*derpStream, 0, len(ds.streams))
+		for _, v := range ds.streams {
+			streams = append(streams, v)
+		}
+		ds.lock.Unlock()
+		now := time.Now()
+		for _, v := range streams {
+			v.retransmit(now)
+		}
+	}
+}
+
+// peerAddress returns the DERP key and home relay of a peer, from its
+// address book entry
+func (ds *DERPService) peerAddress(peer string) (derpKey, string, error) {
+	var key derpKey
+	cm, err := conf.Shared()
+	if err != nil {
+		return key, "", err
+	}
+	p := cm.FindPeer(peer)
+	if p == nil || p.DERPKey == "" {
+		return key, "", fmt.Errorf("no DERP key of %s", peer)
+	}
+	bs, err := base64.StdEncoding.DecodeString(p.DERPKey)
+	if err != nil || len(bs) != len(key) {
+		return key, "", fmt.Errorf("invalid DERP key of %s", peer)
+	}
+	copy(key[:], bs)
+	return key, p.DERPRelay, nil
+}
+
+// learn keeps the DERP key and home relay a peer proved in a handshake in
+// its address book entry
+func (ds *DERPService) learn(peer string, key derpKey, relay string) {
+	cm, err := conf.Shared()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	p := cm.FindPeer(peer)
+	if p == nil {
+		cm.Conf.AddressBook = append(cm.Conf.AddressBook, conf.Peer{ID: peer})
+		p = &cm.Conf.AddressBook[len(cm.Conf.AddressBook)-1]
+	}
+	k := base64.StdEncoding.EncodeToString(key[:])
+	if p.DERPKey == k && p.DERPRelay == relay {
+		return
+	}
+	p.DERPKey, p.DERPRelay = k, relay
+	err = cm.SaveAddressBook()
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// relayTo returns the URL of the relay to reach a peer whose home relay
+// is u on, connecting to it if this device isn't yet
+func (ds *DERPService) relayTo(ctx context.Context, u string) (string, error) {
+	if u == "" {
+		u = ds.home()
+	}
+	ds.startRelay(u, false)
+	deadline := time.Now().Add(derpDialTimeout)
+	for ds.relay(u) == nil {
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("not connected to DERP relay %s", u)
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return u, nil
+}
+
+// handshake answers the offer of a dialer and checks its confirmation,
+// the dialer must offer the DERP key the stream comes from. It returns the
+// offer.
+func (ds *DERPService) handshake(s *derpStream) (types.SignalingInfo, error) {
+	offer, err := readHandshake(s, types.SIG_TYPE_OFFER, "", ds.Id(), nil)
+	if err != nil {
+		return offer, err
+	}
+	if len(offer.Hello) != overlayNonceSize {
+		return offer, fmt.Errorf("invalid DERP challenge of %s", offer.Source)
+	}
+	if !bytes.Equal(offer.DERPKey, s.peer[:]) {
+		return offer, fmt.Errorf("%s offered another DERP key", offer.Source)
+	}
+	nonce, err := overlayNonce()
+	if err != nil {
+		return offer, err
+	}
+	err = writeHandshake(s, types.SignalingInfo{
+		Flag:      types.SIG_TYPE_ANSWER,
+		Source:    ds.Id(),
+		Target:    offer.Source,
+		Id:        offer.Id,
+		Hello:     nonce,
+		Proof:     offer.Hello,
+		DERPKey:   ds.pub,
+		DERPRelay: ds.home(),
+	})
+	if err != nil {
+		return offer, err
+	}
+	_, err = readHandshake(s, types.SIG_TYPE_ANSWER, offer.Source, ds.Id(), nonce)
+	return offer, err
+}
+
+// serveDERP serves a stream a peer opened
+func (ds *DERPService) serveDERP(s *derpStream) {
+	s.SetDeadline(time.Now().Add(overlayHandshakeTimeout))
+	offer, err := ds.handshake(s)
+	if err != nil {
+		logrus.Warn("refused DERP connection from ", s.RemoteAddr(), ": ", err)
+		s.Close()
+		return
+	}
+	s.SetDeadline(time.Time{})
+	ds.learn(offer.Source, s.peer, offer.DERPRelay)
+	imp := impl.GetImpl(offer.Id.ImplCode)
+	if imp == nil {
+		logrus.Error("unknow impl for IMCODE: ", offer.Id.ImplCode)
+		s.Close()
+		return
+	}
+	imp.SetHostId(offer.Source)
+	imp.SetOneTimeCode(offer.OTP)
+	poolId := types.NewPoolId(offer.Id.Value, imp.Code())
+	err = admit(ds.knocks, offer.Source, s.RemoteAddr().String(), imp)
+	if err != nil {
+		sessionLog(*poolId, CONNECTION_DRECT_IN, offer.Source).Warn(err)
+		s.Close()
+		return
+	}
+	conn := NewDERPConnection(imp, ds.Id(), offer.Source, s, *poolId, CONNECTION_DRECT_IN, &ds.CleanChan)
+	if pr, ok := imp.(impl.PathReporter); ok {
+		pr.SetPath(derpPath(s))
+	}
+	err = conn.Response()
+	if err != nil {
+		conn.log().Error(err)
+		recordEvent(types.EVENT_FAILURE, poolId.String(CONNECTION_DRECT_IN), impl.AppName(imp.Code()), offer.Source, err)
+		conn.fail(err)
+		history.Add(conn.History())
+		return
+	}
+	ds.AddPair(conn)
+}
+
+func (ds *DERPService) CreateConnection(ctx context.Context, sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
+	iface := sender.GetImpl()
+	if iface == nil {
+		return fmt.Errorf("unknown impl")
+	}
+	key, relay, err := ds.peerAddress(iface.HostId())
+	if err != nil {
+		return err
+	}
+	u, err := ds.relayTo(ctx, relay)
+	if err != nil {
+		return err
+	}
+	var id [8]byte
+	_, err = rand.Read(id[:])
+	if err != nil {
+		return err
+	}
+	s := newDERPStream(ds, u, key, binary.BigEndian.Uint64(id[:]))
+	ds.lock.Lock()
+	ds.streams[s.sid()] = s
+	ds.lock.Unlock()
+	if !sender.Detach {
+		iface.SetConn(sock)
+	}
+	pair := NewDERPConnection(iface, ds.Id(), iface.HostId(), s, poolId, CONNECTION_DRECT_OUT, &ds.CleanChan)
+	err = pair.dial(ctx)
+	if err != nil {
+		s.Close()
+		return err
+	}
+	return ds.AddPair(pair)
+}
+
+// derpAddr is the address of a stream: the relay and the key of the peer
+type derpAddr struct {
+	relay string
+	key   derpKey
+}
+
+func (da derpAddr) Network() string {
+	return "derp"
+}
+
+func (da derpAddr) String() string {
+	return fmt.Sprintf("%s/%s", da.relay, base64.StdEncoding.EncodeToString(da.key[:]))
+}
+
+// derpStream is a session with a peer over a relay. Data segments are
+// numbered and sent again until the peer acknowledges them, the peer only
+// accepts them in order.
+type derpStream struct {
+	ds   *DERPService
+	url  string
+	peer derpKey
+	id   uint64
+
+	lock sync.Mutex
+	// wake is closed and replaced when the state changes
+	wake chan struct{}
+	// buf holds the data received and not read, recvNext is the number of
+	// the next segment expected and eof is set once the fin arrived
+	buf      []byte
+	recvNext uint32
+	eof      bool
+	// unacked are the segments sent and not acknowledged, sendNext is the
+	// number of the next one
+	unacked  []derpSegment
+	sendNext uint32
+	// sent is when the segments were last sent, progress when the peer
+	// last acknowledged some or the first one was queued
+	sent     time.Time
+	progress time.Time
+	closed   bool
+	err      error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newDERPStream(ds *DERPService, u string, peer derpKey, id uint64) *derpStream {
+	return &derpStream{
+		ds:   ds,
+		url:  u,
+		peer: peer,
+		id:   id,
+		wake: make(chan struct{}),
+	}
+}
+
+func (s *derpStream) sid() derpStreamId {
+	return derpStreamId{s.peer, s.id}
+}
+
+// signal wakes the readers and writers, the lock is held
+func (s *derpStream) signal() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// wait releases the lock until the state changes or deadline passes
+func (s *derpStream) wait(deadline time.Time) error {
+	wake := s.wake
+	s.lock.Unlock()
+	defer s.lock.Lock()
+	if deadline.IsZero() {
+		<-wake
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-wake:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (s *derpStream) Read(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for {
+		if len(s.buf) > 0 {
+			n := copy(p, s.buf)
+			s.buf = s.buf[n:]
+			return n, nil
+		}
+		if s.closed {
+			return 0, net.ErrClosed
+		}
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.eof {
+			return 0, io.EOF
+		}
+		err := s.wait(s.readDeadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *derpStream) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		l := len(p)
+		if l > derpSegSize {
+			l = derpSegSize
+		}
+		s.lock.Lock()
+		for len(s.unacked) >= derpWindow && !s.closed && s.err == nil {
+			err := s.wait(s.writeDeadline)
+			if err != nil {
+				s.lock.Unlock()
+				return n, err
+			}
+		}
+		if s.closed || s.err != nil {
+			err := s.err
+			if s.closed {
+				err = net.ErrClosed
+			}
+			s.lock.Unlock()
+			return n, err
+		}
+		seg := s.queue(derpSegData, append([]byte{}, p[:l]...))
+		s.lock.Unlock()
+		s.ds.send(s.url, s.peer, seg)
+		n += l
+		p = p[l:]
+	}
+	return n, nil
+}
+
+// queue numbers a segment and keeps it until it is acknowledged, the lock
+// is held
+func (s *derpStream) queue(typ byte, data []byte) derpSegment {
+	seg := derpSegment{typ: typ, id: s.id, seq: s.sendNext, data: data}
+	s.sendNext++
+	now := time.Now()
+	if len(s.unacked) == 0 {
+		s.progress = now
+	}
+	s.unacked = append(s.unacked, seg)
+	s.sent = now
+	return seg
+}
+
+// Close sends the fin, the stream is forgotten once the peer acknowledged
+// it
+func (s *derpStream) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.buf = nil
+	s.signal()
+	if s.err != nil {
+		s.lock.Unlock()
+		s.ds.removeStream(s)
+		return nil
+	}
+	seg := s.queue(derpSegFin, nil)
+	s.lock.Unlock()
+	return s.ds.send(s.url, s.peer, seg)
+}
+
+// fail ends the stream with err
+func (s *derpStream) fail(err error) {
+	s.lock.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.signal()
+	s.lock.Unlock()
+	s.ds.removeStream(s)
+}
+
+// receive handles a segment of the peer
+func (s *derpStream) receive(seg derpSegment) {
+	switch seg.typ {
+	case derpSegReset:
+		s.fail(errDERPReset)
+		return
+	case derpSegAck:
+		s.lock.Lock()
+		if len(s.unacked) > 0 {
+			// seg.seq is the next one the peer expects
+			n := int(seg.seq - s.unacked[0].seq)
+			if n > 0 && n <= len(s.unacked) {
+				s.unacked = s.unacked[n:]
+				s.progress = time.Now()
+				s.signal()
+			}
+		}
+		done := s.closed && len(s.unacked) == 0
+		s.lock.Unlock()
+		if done {
+			s.ds.removeStream(s)
+		}
+		return
+	case derpSegData, derpSegFin:
+	default:
+		return
+	}
+	s.lock.Lock()
+	if seg.seq == s.recvNext && !s.eof {
+		switch {
+		case seg.typ == derpSegFin:
+			s.eof = true
+			s.recvNext++
+		case s.closed:
+			// nobody reads anymore
+			s.recvNext++
+		case len(s.buf)+len(seg.data) <= derpRecvBuffer:
+			s.buf = append(s.buf, seg.data...)
+			s.recvNext++
+		}
+		s.signal()
+	}
+	ack := derpSegment{typ: derpSegAck, id: s.id, seq: s.recvNext}
+	s.lock.Unlock()
+	s.ds.send(s.url, s.peer, ack)
+}
+
+// retransmit sends the segments not acknowledged for derpRetransmit again,
+// the stream fails once none was for derpGiveUp
+func (s *derpStream) retransmit(now time.Time) {
+	s.lock.Lock()
+	if len(s.unacked) == 0 || now.Sub(s.sent) < derpRetransmit {
+		s.lock.Unlock()
+		return
+	}
+	if now.Sub(s.progress) > derpGiveUp {
+		s.lock.Unlock()
+		s.fail(fmt.Errorf("DERP peer %s stopped answering", derpAddr{s.url, s.peer}))
+		return
+	}
+	segs := append([]derpSegment{}, s.unacked...)
+	s.sent = now
+	s.lock.Unlock()
+	for _, v := range segs {
+		if s.ds.send(s.url, s.peer, v) != nil {
+			return
+		}
+	}
+}
+
+func (s *derpStream) LocalAddr() net.Addr {
+	var key derpKey
+	copy(key[:], s.ds.pub)
+	return derpAddr{s.ds.home(), key}
+}
+
+func (s *derpStream) RemoteAddr() net.Addr {
+	return derpAddr{s.url, s.peer}
+}
+
+func (s *derpStream) SetDeadline(t time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.readDeadline, s.writeDeadline = t, t
+	s.signal()
+	return nil
+}
+
+func (s *derpStream) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.readDeadline = t
+	s.signal()
+	return nil
+}
+
+func (s *derpStream) SetWriteDeadline(t time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.writeDeadline = t
+	s.signal()
+	return nil
+}
@@ -1,21 +1,29 @@
 package conn
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
 	"net"
 	"reflect"
+	"time"
 
-	"github.com/sirupsen/logrus"
 	"github.com/suutaku/sshx/internal/utils"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
 
+// directDialTimeout bounds the dial of a peer, the WebRTC service runs
+// alongside so an unreachable address only holds its own attempt
+const directDialTimeout = 5 * time.Second
+
 type DirectConnection struct {
 	BaseConnection
 	net.Conn
 	CleanChan *chan CleanRequest
+	// seal, if set, authenticates the target once the DirectInfo is sent
+	// and returns the stream sealed end to end
+	seal func(net.Conn) (net.Conn, error)
 }
 
 func NewDirectConnection(impl impl.Impl, nodeId string, targetId string, poolId types.PoolId, direct int32, cleanChan *chan CleanRequest) *DirectConnection {
@@ -26,6 +34,18 @@ func NewDirectConnection(impl impl.Impl, nodeId string, targetId string, poolId
 	return ret
 }
 
+// directPath describes the path of a direct connection
+func directPath(conn net.Conn) string {
+	return fmt.Sprintf("direct tcp %s -> %s", conn.LocalAddr(), conn.RemoteAddr())
+}
+
+// pipe copies the data of the impl and of the peer, counting the bytes of
+// the session. The connections are kept unwrapped so TCP ones splice, the
+// sealed ones of the direct service are copied.
+func (dc *DirectConnection) pipe(implConn net.Conn) {
+	utils.PipeCounted(&implConn, &dc.Conn, &dc.bytesOut, &dc.bytesIn)
+}
+
 func (dc *DirectConnection) Close() {
 	dc.BaseConnection.Close()
 	dc.Conn.Close()
@@ -39,10 +59,38 @@ func (dc *DirectConnection) Name() string {
 	}
 }
 
+// sealDirect authenticates the target of a session of the direct service
+// with the key pinned for it
+func (dc *DirectConnection) sealDirect(conn net.Conn) (net.Conn, error) {
+	return impl.DirectHandshake(conn, conn, dc.TargetId(), true)
+}
+
 func (dc *DirectConnection) Dial() error {
+	dc.seal = dc.sealDirect
+	return dc.dialWith(func() (net.Conn, error) {
+		return dc.dialTCP(dc.Context())
+	})
+}
+
+// dialTCP connects to the direct service of the target until ctx is done
+func (dc *DirectConnection) dialTCP(ctx context.Context) (net.Conn, error) {
+	addr := lan.DirectAddress(dc.TargetId())
+	if addr == "" {
+		addr = endpoints.Address(dc.TargetId())
+	}
+	if addr == "" {
+		addr = fmt.Sprintf("%s:%d", dc.TargetId(), directPort)
+	}
+	dialer := net.Dialer{Timeout: directDialTimeout}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// dialWith sets up the connection over the stream to the target dial
+// returns
+func (dc *DirectConnection) dialWith(dial func() (net.Conn, error)) error {
 	if dc.impl.IsNeedConnect() {
-		logrus.Debug("dial ", dc.TargetId(), " directly")
-		conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", dc.TargetId(), directPort))
+		dc.log().Debug("dial ", dc.TargetId(), " directly")
+		conn, err := dial()
 		if err != nil {
 			return err
 		}
@@ -50,18 +98,28 @@ func (dc *DirectConnection) Dial() error {
 			ImplCode: dc.impl.Code(),
 			HostId:   dc.nodeId,
 			Id:       dc.poolId.Raw(),
+			OTP:      dc.impl.OneTimeCode(),
 		}
-		logrus.Debug("send direct info")
+		dc.log().Debug("send direct info")
 		gob.NewEncoder(conn).Encode(info)
+		if dc.seal != nil {
+			sealed, err := dc.seal(conn)
+			if err != nil {
+				conn.Close()
+				return err
+			}
+			conn = sealed
+		}
 		implConn := dc.impl.Conn()
 		dc.Conn = conn
+		dc.path, dc.candidate = directPath(conn), "direct"
 		go func() {
-			utils.Pipe(&implConn, &dc.Conn)
-			logrus.Error("direct broken ", dc.Name())
+			dc.pipe(implConn)
+			dc.log().Error("direct broken ", dc.Name())
 			*dc.CleanChan <- CleanRequest{dc.PoolId().String(dc.Direction()), dc.Name()}
 		}()
 	} else {
-		logrus.Error("NOT create connection for ", impl.GetImplName(dc.impl.Code()))
+		dc.log().Error("NOT create connection for ", impl.GetImplName(dc.impl.Code()))
 	}
 	err := dc.BaseConnection.Dial()
 	if err != nil {
@@ -79,9 +137,10 @@ func (dc *DirectConnection) Response() error {
 		return err
 	}
 	implConn := dc.impl.Conn() //connection from dial ssh
+	dc.path, dc.candidate = directPath(dc.Conn), "direct"
 	go func() {
-		utils.Pipe(&implConn, &dc.Conn)
-		logrus.Error("direct broken ", dc.Name())
+		dc.pipe(implConn)
+		dc.log().Error("direct broken ", dc.Name())
 		*dc.CleanChan <- CleanRequest{dc.poolId.String(dc.Direction()), dc.Name()}
 	}()
 
@@ -1,11 +1,13 @@
 package conn
 
 import (
-	"encoding/gob"
+	"context"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
@@ -16,15 +18,39 @@ type DirectInfo struct {
 	Id       int64
 	ImplCode int32
 	HostId   string
+	OTP      string
+}
+
+const (
+	// maxDirectInfoSize bounds an encoded DirectInfo
+	maxDirectInfoSize = 4 << 10
+
+	// directInfoTimeout bounds the time a peer takes to send its DirectInfo
+	directInfoTimeout = 10 * time.Second
+)
+
+// Validate checks the lengths of the fields of a DirectInfo
+func (info *DirectInfo) Validate() error {
+	if info.HostId == "" || len(info.HostId) > types.MAX_ID_LENGTH {
+		return fmt.Errorf("invalid host id of %d bytes", len(info.HostId))
+	}
+	if len(info.OTP) > types.MAX_KEY_LENGTH {
+		return fmt.Errorf("one-time code too long")
+	}
+	return nil
 }
 
 type DirectService struct {
 	BaseConnectionService
+	pc conf.PortMapConf
+	// stopMapping ends the port mapping on the router
+	stopMapping chan struct{}
 }
 
-func NewDirectService(id string) *DirectService {
+func NewDirectService(id string, pc conf.PortMapConf) *DirectService {
 	return &DirectService{
 		BaseConnectionService: *NewBaseConnectionService(id),
+		pc:                    pc,
 	}
 }
 
@@ -34,6 +60,11 @@ func (ds *DirectService) Start() error {
 	if err != nil {
 		logrus.Error(err)
 	}
+	endpoints.setDial(ds.pc.Dial)
+	if ds.pc.Enabled && err == nil {
+		ds.stopMapping = make(chan struct{})
+		go ds.mapPort(ds.stopMapping)
+	}
 
 	go func() {
 		logrus.Debug("runing status ", ds.running)
@@ -43,33 +74,97 @@ func (ds *DirectService) Start() error {
 				logrus.Error(err)
 				continue
 			}
-			var info DirectInfo
-			err = gob.NewDecoder(sock).Decode(&info)
-			if err != nil {
-				logrus.Error(err)
-				continue
-			}
-			logrus.Debug("new direct info com ", info)
-			imp := impl.GetImpl(info.ImplCode)
-			imp.SetHostId(info.HostId)
-			poolId := types.NewPoolId(info.Id, imp.Code())
-			// server reset direction
-			conn := NewDirectConnection(imp, ds.Id(), info.HostId, *poolId, CONNECTION_DRECT_IN, &ds.CleanChan)
-			conn.Conn = sock
-			err = conn.Response()
-			if err != nil {
-				logrus.Error(err)
-				continue
-			}
-			ds.AddPair(conn)
+			go ds.serveSealed(sock)
 		}
 	}()
 	return nil
 }
 
-func (ds *DirectService) CreateConnection(sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
+func (ds *DirectService) Stop() {
+	if ds.stopMapping != nil {
+		close(ds.stopMapping)
+		ds.stopMapping = nil
+	}
+	ds.BaseConnectionService.Stop()
+}
+
+// readDirectInfo reads the DirectInfo a peer starts sock with
+func readDirectInfo(sock net.Conn) (DirectInfo, error) {
+	sock.SetReadDeadline(time.Now().Add(directInfoTimeout))
+	var info DirectInfo
+	err := types.DecodeLimited(sock, maxDirectInfoSize, &info)
+	if err == nil {
+		err = info.Validate()
+	}
+	sock.SetReadDeadline(time.Time{})
+	logrus.Debug("new direct info com ", info)
+	return info, err
+}
+
+// serveSock reads the DirectInfo a peer starts sock with and serves it
+func (base *BaseConnectionService) serveSock(sock net.Conn) {
+	info, err := readDirectInfo(sock)
+	if err != nil {
+		logrus.Warn("refused direct connection from ", sock.RemoteAddr(), ": ", err)
+		sock.Close()
+		return
+	}
+	base.serveDirect(info, sock)
+}
+
+// serveSealed serves sock once the peer proved the key pinned for the ID
+// its DirectInfo claims, the session is then sealed end to end. The direct
+// service may be reached from any network, through a port mapping.
+func (ds *DirectService) serveSealed(sock net.Conn) {
+	info, err := readDirectInfo(sock)
+	var sealed net.Conn
+	if err == nil {
+		sealed, err = impl.DirectHandshake(sock, sock, info.HostId, false)
+	}
+	if err != nil {
+		logrus.Warn("refused direct connection from ", sock.RemoteAddr(), ": ", err)
+		sock.Close()
+		return
+	}
+	ds.serveDirect(info, sealed)
+}
+
+func (base *BaseConnectionService) serveDirect(info DirectInfo, sock net.Conn) {
+	imp := impl.GetImpl(info.ImplCode)
+	if imp == nil {
+		logrus.Error("unknow impl for IMCODE: ", info.ImplCode)
+		sock.Close()
+		return
+	}
+	imp.SetHostId(info.HostId)
+	imp.SetOneTimeCode(info.OTP)
+	poolId := types.NewPoolId(info.Id, imp.Code())
+	err := admit(base.knocks, info.HostId, sourceHost(sock.RemoteAddr()), imp)
+	if err != nil {
+		sessionLog(*poolId, CONNECTION_DRECT_IN, info.HostId).Warn(err)
+		sock.Close()
+		return
+	}
+	// server reset direction
+	conn := NewDirectConnection(imp, base.Id(), info.HostId, *poolId, CONNECTION_DRECT_IN, &base.CleanChan)
+	conn.Conn = sock
+	if pr, ok := imp.(impl.PathReporter); ok {
+		pr.SetPath(directPath(sock))
+	}
+	err = conn.Response()
+	if err != nil {
+		conn.log().Error(err)
+		recordEvent(types.EVENT_FAILURE, poolId.String(CONNECTION_DRECT_IN), impl.AppName(imp.Code()), info.HostId, err)
+		conn.fail(err)
+		history.Add(conn.History())
+		return
+	}
+	base.AddPair(conn)
+}
+
+func (ds *DirectService) CreateConnection(ctx context.Context, sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
 	// client reset direction
-	err := ds.BaseConnectionService.CreateConnection(sender, sock, poolId)
+	err := ds.BaseConnectionService.CreateConnection(ctx, sender, sock, poolId)
 	if err != nil {
 		return err
 	}
@@ -83,7 +178,10 @@ func (ds *DirectService) CreateConnection(sender *impl.Sender, sock net.Conn, po
 		iface.SetConn(sock)
 	}
 	pair := NewDirectConnection(iface, ds.Id(), iface.HostId(), poolId, CONNECTION_DRECT_OUT, &ds.CleanChan)
-	err = pair.Dial()
+	pair.seal = pair.sealDirect
+	err = pair.dialWith(func() (net.Conn, error) {
+		return pair.dialTCP(ctx)
+	})
 	if err != nil {
 		return err
 	}
@@ -93,12 +191,3 @@ func (ds *DirectService) CreateConnection(sender *impl.Sender, sock net.Conn, po
 	}
 	return nil
 }
-
-func (ds *DirectService) DestroyConnection(tmp *impl.Sender) error {
-	pair := ds.GetPair(string(tmp.PairId))
-	if pair == nil {
-		return fmt.Errorf("cannot get pair for %s", string(tmp.PairId))
-	}
-	ds.RemovePair(CleanRequest{string(tmp.PairId), (&DirectConnection{}).Name()})
-	return nil
-}
@@ -0,0 +1,271 @@
+package conn
+
+import (
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/mdns"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	// discoveryService is the mDNS service type of sshx devices
+	discoveryService = "_sshx._tcp"
+
+	// discoveryTTL is the time to live of the records advertised
+	discoveryTTL = 120 * time.Second
+
+	// discoveryVersion is the version of the TXT record advertised
+	discoveryVersion = "1"
+
+	// maxDiscoveredPeers caps the address book entries discovery adds
+	maxDiscoveredPeers = 64
+
+	// discoveredPeerAge drops the entries discovery added of the devices
+	// not seen for this long and never paired
+	discoveredPeerAge = 30 * 24 * time.Hour
+
+	// discoveredRefresh is how often the time a device was seen is saved
+	discoveredRefresh = 24 * time.Hour
+)
+
+// LANDiscovery advertises the device on the local network with multicast
+// DNS and keeps the devices it finds there
+type LANDiscovery struct {
+	lock  sync.Mutex
+	id    string
+	dc    conf.DiscoveryConf
+	mc    *mdns.Conn
+	stop  chan struct{}
+	peers map[string]*types.LANPeer
+}
+
+func NewLANDiscovery() *LANDiscovery {
+	return &LANDiscovery{
+		peers: make(map[string]*types.LANPeer),
+	}
+}
+
+// devices of the local network, shared by the services
+var lan = NewLANDiscovery()
+
+// Start queries the network every interval of dc until Stop, and
+// advertises the device id if dc says so
+func (ld *LANDiscovery) Start(id string, dc conf.DiscoveryConf) error {
+	mc, err := mdns.Listen()
+	if err != nil {
+		return err
+	}
+	name := dc.Name
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	ld.lock.Lock()
+	ld.id, ld.dc, ld.mc = id, dc, mc
+	ld.stop = make(chan struct{})
+	stop := ld.stop
+	ld.lock.Unlock()
+	if dc.Advertise {
+		err = mc.Advertise(mdns.Service{
+			Instance: id,
+			Service:  discoveryService,
+			Port:     directPort,
+			Text: []string{
+				"v=" + discoveryVersion,
+				"id=" + id,
+				"name=" + name,
+				"apps=" + strings.Join(dc.Apps, ","),
+			},
+			TTL: discoveryTTL,
+		})
+		if err != nil {
+			logrus.Warn("advertise on the local network: ", err)
+		}
+	}
+	go mc.Serve(ld.found)
+	go func() {
+		// a second query catches the devices which missed the first one
+		delays := []time.Duration{0, time.Second}
+		for {
+			delay := time.Duration(dc.Interval) * time.Second
+			if len(delays) > 0 {
+				delay, delays = delays[0], delays[1:]
+			}
+			timer := time.NewTimer(delay)
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			ld.Query()
+		}
+	}()
+	return nil
+}
+
+// Stop leaves the network
+func (ld *LANDiscovery) Stop() {
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+	if ld.mc == nil {
+		return
+	}
+	close(ld.stop)
+	ld.mc.Close()
+	ld.mc = nil
+}
+
+// Query asks the devices of the network to announce themselves
+func (ld *LANDiscovery) Query() {
+	ld.lock.Lock()
+	mc := ld.mc
+	ld.lock.Unlock()
+	if mc == nil {
+		return
+	}
+	err := mc.Query(discoveryService)
+	if err != nil {
+		logrus.Debug("query the local network: ", err)
+	}
+}
+
+// found records a device announced on the network
+func (ld *LANDiscovery) found(svc mdns.Service) {
+	if svc.Service != discoveryService {
+		return
+	}
+	text := make(map[string]string)
+	for _, v := range svc.Text {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 2 {
+			text[kv[0]] = kv[1]
+		}
+	}
+	id := text["id"]
+	if id == "" || len(id) > types.MAX_ID_LENGTH || len(text["name"]) > types.MAX_ID_LENGTH {
+		return
+	}
+	ld.lock.Lock()
+	if id == ld.id {
+		ld.lock.Unlock()
+		return
+	}
+	if svc.TTL == 0 {
+		delete(ld.peers, id)
+		ld.lock.Unlock()
+		logrus.Debug("device ", id, " left the local network")
+		return
+	}
+	peer, known := ld.peers[id]
+	if !known {
+		peer = &types.LANPeer{ID: id}
+		ld.peers[id] = peer
+	}
+	peer.Name, peer.Port, peer.Seen = text["name"], svc.Port, time.Now()
+	peer.Apps = nil
+	if text["apps"] != "" {
+		peer.Apps = strings.Split(text["apps"], ",")
+	}
+	peer.Addrs = make([]string, 0, len(svc.Addrs))
+	for _, ip := range svc.Addrs {
+		peer.Addrs = append(peer.Addrs, ip.String())
+	}
+	addressBook := ld.dc.AddressBook
+	ld.lock.Unlock()
+	if !known {
+		logrus.Info("found ", text["name"], " (", id, ") on the local network at ", svc.Addrs[0])
+	}
+	if addressBook {
+		addToAddressBook(id, text["name"])
+	}
+}
+
+// addToAddressBook adds a device found on the network to the address book,
+// or names its entry if it has no name and the name is free. The entries
+// discovery added are pruned as they are.
+func addToAddressBook(id, name string) {
+	cm, err := conf.Shared()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	now := time.Now()
+	changed := false
+	p := cm.FindPeer(id)
+	if p == nil {
+		cm.Conf.AddressBook = append(cm.Conf.AddressBook, conf.Peer{ID: id, Discovered: now.Unix()})
+		p = &cm.Conf.AddressBook[len(cm.Conf.AddressBook)-1]
+		changed = true
+	} else if p.Discovered != 0 && now.Sub(time.Unix(p.Discovered, 0)) > discoveredRefresh {
+		p.Discovered = now.Unix()
+		changed = true
+	}
+	if p.Name == "" && name != "" && cm.ResolvePeer(name) == name {
+		p.Name = name
+		changed = true
+	}
+	if cm.PruneDiscovered(now.Add(-discoveredPeerAge), maxDiscoveredPeers, impl.IsPaired) {
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	err = cm.SaveAddressBook()
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// Peers returns the devices seen on the network lately, by name
+func (ld *LANDiscovery) Peers() []types.LANPeer {
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+	ld.expire()
+	ret := make([]types.LANPeer, 0, len(ld.peers))
+	for _, v := range ld.peers {
+		ret = append(ret, *v)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Name != ret[j].Name {
+			return ret[i].Name < ret[j].Name
+		}
+		return ret[i].ID < ret[j].ID
+	})
+	return ret
+}
+
+// expire forgets the devices not seen for three queries
+func (ld *LANDiscovery) expire() {
+	maxAge := 3 * time.Duration(ld.dc.Interval) * time.Second
+	for k, v := range ld.peers {
+		if time.Since(v.Seen) > maxAge {
+			delete(ld.peers, k)
+		}
+	}
+}
+
+// DirectAddress returns the address of the direct service of a device seen
+// on the network, empty if there is none or direct connections to the
+// devices found are disabled
+func (ld *LANDiscovery) DirectAddress(id string) string {
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+	if !ld.dc.Direct {
+		return ""
+	}
+	ld.expire()
+	peer, ok := ld.peers[id]
+	if !ok || len(peer.Addrs) == 0 || peer.Port == 0 {
+		return ""
+	}
+	return net.JoinHostPort(peer.Addrs[0], strconv.Itoa(peer.Port))
+}
@@ -0,0 +1,136 @@
+package conn
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// eventRingSize is the number of events the daemon keeps
+const eventRingSize = 256
+
+// EventRing keeps the last events of the daemon, older ones are dropped
+type EventRing struct {
+	lock   sync.Mutex
+	events []types.Event
+	next   int
+	full   bool
+	// watchers are called with the events recorded
+	watchers map[int]func(types.Event)
+	watchId  int
+}
+
+func NewEventRing(size int) *EventRing {
+	return &EventRing{
+		events: make([]types.Event, size),
+	}
+}
+
+// Add records an event
+func (er *EventRing) Add(ev types.Event) {
+	er.lock.Lock()
+	defer er.lock.Unlock()
+	er.events[er.next] = ev
+	er.next = (er.next + 1) % len(er.events)
+	if er.next == 0 {
+		er.full = true
+	}
+	for _, fn := range er.watchers {
+		// watchers must not block the session which records the event
+		go fn(ev)
+	}
+}
+
+// Watch calls fn with the events recorded from now on, until the returned
+// function is called. Each call runs on its own goroutine.
+func (er *EventRing) Watch(fn func(types.Event)) func() {
+	er.lock.Lock()
+	defer er.lock.Unlock()
+	if er.watchers == nil {
+		er.watchers = make(map[int]func(types.Event))
+	}
+	er.watchId++
+	id := er.watchId
+	er.watchers[id] = fn
+	return func() {
+		er.lock.Lock()
+		delete(er.watchers, id)
+		er.lock.Unlock()
+	}
+}
+
+// Events returns the events from the oldest to the newest
+func (er *EventRing) Events() []types.Event {
+	er.lock.Lock()
+	defer er.lock.Unlock()
+	if !er.full {
+		return append([]types.Event{}, er.events[:er.next]...)
+	}
+	return append(append([]types.Event{}, er.events[er.next:]...), er.events[:er.next]...)
+}
+
+// events of the daemon, shared by the services
+var events = NewEventRing(eventRingSize)
+
+// streamEvents writes the events recorded from now on to conn until the
+// client closes it. A client which doesn't keep up loses events rather
+// than holding the sessions.
+func streamEvents(conn net.Conn) {
+	defer conn.Close()
+	ch := make(chan types.Event, eventRingSize)
+	unwatch := events.Watch(func(ev types.Event) {
+		select {
+		case ch <- ev:
+		default:
+		}
+	})
+	defer unwatch()
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+	enc := gob.NewEncoder(conn)
+	for {
+		select {
+		case ev := <-ch:
+			err := enc.Encode(ev)
+			if err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// WatchEvents calls fn with the events of the daemon recorded from now on,
+// until the returned function is called
+func WatchEvents(fn func(types.Event)) func() {
+	return events.Watch(fn)
+}
+
+// RecordEvent records an event of the daemon which is not one of a
+// session, as the ones of its scheduled tasks
+func RecordEvent(ev types.Event) {
+	events.Add(ev)
+}
+
+// recordEvent records an event of a session, msg is formatted as
+// fmt.Sprint does
+func recordEvent(kind, pairId, app, peer string, msg ...interface{}) {
+	events.Add(types.Event{
+		Time:     time.Now(),
+		Kind:     kind,
+		PairId:   pairId,
+		TargetId: peer,
+		App:      app,
+		Message:  fmt.Sprint(msg...),
+	})
+}
@@ -0,0 +1,79 @@
+package conn
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/martinlindhe/notify"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/audit"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// sessionCheckInterval is how often the durations of sessions are checked
+const sessionCheckInterval = 10 * time.Second
+
+// WatchLimits closes the sessions which last longer than their limit of
+// SessionConf, and warns about them SessionConf.Warning before. Limits are
+// read again at every check, so changes apply to running sessions.
+func (stm *StatManager) WatchLimits() {
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+	for stm.running {
+		<-ticker.C
+		stm.checkLimits()
+	}
+}
+
+func (stm *StatManager) checkLimits() {
+	cm, err := conf.Shared()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	if len(cm.Conf.SessionConf.Limits) == 0 {
+		return
+	}
+	warning := cm.SessionWarning()
+	now := time.Now()
+	expired := make(map[CleanRequest]types.Status)
+	stm.lock.Lock()
+	for k, v := range stm.stats {
+		// children end with their parent
+		if v.ParentPairId != "" {
+			continue
+		}
+		limit := cm.SessionLimit(v.TargetId, impl.AppName(v.ImplType))
+		if limit <= 0 {
+			continue
+		}
+		elapsed := now.Sub(v.StartTime)
+		if elapsed >= limit {
+			if pair := stm.cpPool[k]; pair != nil {
+				expired[CleanRequest{k, pair.Name()}] = v
+			}
+		} else if elapsed >= limit-warning && !stm.warned[k] {
+			stm.warned[k] = true
+			warnExpiry(v, limit-elapsed)
+		}
+	}
+	stm.lock.Unlock()
+	for req, v := range expired {
+		app := impl.AppName(v.ImplType)
+		limit := cm.SessionLimit(v.TargetId, app)
+		logrus.Warn(app, " session with ", v.TargetId, " expired after ", limit)
+		recordEvent(types.EVENT_EXPIRED, req.Key, app, v.TargetId, "after ", limit)
+		stm.RemovePair(req)
+		audit.Emit(audit.CATEGORY_SESSION, "session.expire", audit.OUTCOME_SUCCESS, v.TargetId, app, fmt.Sprintf("expired after %s", limit))
+	}
+}
+
+func warnExpiry(stat types.Status, left time.Duration) {
+	app := impl.AppName(stat.ImplType)
+	msg := fmt.Sprintf("%s session with %s expires in %s", app, stat.TargetId, left.Round(time.Second))
+	logrus.Warn(msg)
+	notify.Notify("sshx", "session", msg, "")
+	audit.Emit(audit.CATEGORY_SESSION, "session.warn", audit.OUTCOME_SUCCESS, stat.TargetId, app, msg)
+}
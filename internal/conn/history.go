@@ -0,0 +1,197 @@
+package conn
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// historyPruneEvery is the number of sessions recorded between two prunes
+// of the history
+const historyPruneEvery = 100
+
+// HistoryStore keeps the completed sessions in a file of JSON lines, one
+// record per line. Records are appended as sessions end, and the file is
+// rewritten without the records out of the retention of HistoryConf.
+type HistoryStore struct {
+	lock  sync.Mutex
+	file  string
+	added int
+}
+
+// NewHistoryStore returns the history kept in file, history.jsonl of the
+// state home if empty
+func NewHistoryStore(file string) *HistoryStore {
+	return &HistoryStore{
+		file: file,
+	}
+}
+
+// history of the sessions of the daemon, shared by the services
+var history = NewHistoryStore("")
+
+func (hs *HistoryStore) name() string {
+	if hs.file == "" {
+		return filepath.Join(utils.GetSSHXStateHome(), "history.jsonl")
+	}
+	return hs.file
+}
+
+// Add records a session ending now if the history is enabled
+func (hs *HistoryStore) Add(rec types.HistoryRecord) {
+	cm, err := conf.Shared()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	hc := cm.Conf.HistoryConf
+	if !hc.Enabled {
+		return
+	}
+	if rec.End.IsZero() {
+		rec.End = time.Now()
+	}
+	bs, err := json.Marshal(rec)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	err = os.MkdirAll(filepath.Dir(hs.name()), 0700)
+	if err != nil {
+		logrus.Error("history ", err)
+		return
+	}
+	f, err := os.OpenFile(hs.name(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		logrus.Error("history ", err)
+		return
+	}
+	_, err = f.Write(append(bs, '\n'))
+	f.Close()
+	if err != nil {
+		logrus.Error("history ", err)
+		return
+	}
+	hs.added++
+	if hs.added%historyPruneEvery == 0 {
+		hs.prune(hc)
+	}
+}
+
+// read returns the records of the file from the oldest to the newest,
+// broken lines are skipped
+func (hs *HistoryStore) read() ([]types.HistoryRecord, error) {
+	f, err := os.Open(hs.name())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret := make([]types.HistoryRecord, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec types.HistoryRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+			continue
+		}
+		ret = append(ret, rec)
+	}
+	return ret, scanner.Err()
+}
+
+// Query returns the records a history request selects, the newest first
+func (hs *HistoryStore) Query(h *impl.History) ([]types.HistoryRecord, error) {
+	hs.lock.Lock()
+	recs, err := hs.read()
+	hs.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]types.HistoryRecord, 0)
+	for i := len(recs) - 1; i >= 0; i-- {
+		if !h.Match(recs[i]) {
+			continue
+		}
+		ret = append(ret, recs[i])
+		if h.Limit > 0 && len(ret) >= h.Limit {
+			break
+		}
+	}
+	return ret, nil
+}
+
+// Prune drops the records out of the retention of HistoryConf
+func (hs *HistoryStore) Prune() {
+	cm, err := conf.Shared()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.prune(cm.Conf.HistoryConf)
+}
+
+func (hs *HistoryStore) prune(hc conf.HistoryConf) {
+	recs, err := hs.read()
+	if err != nil {
+		logrus.Error("history ", err)
+		return
+	}
+	keep := recs
+	if hc.Retention > 0 {
+		oldest := time.Now().AddDate(0, 0, -hc.Retention)
+		// records are appended as sessions end, in order
+		i := sort.Search(len(keep), func(i int) bool {
+			return keep[i].End.After(oldest)
+		})
+		keep = keep[i:]
+	}
+	if hc.MaxRecords > 0 && len(keep) > hc.MaxRecords {
+		keep = keep[len(keep)-hc.MaxRecords:]
+	}
+	if len(keep) == len(recs) {
+		return
+	}
+	tmp := hs.name() + ".new"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		logrus.Error("history ", err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, rec := range keep {
+		err = enc.Encode(rec)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, hs.name())
+	}
+	if err != nil {
+		os.Remove(tmp)
+		logrus.Error("history ", err)
+		return
+	}
+	logrus.Debug("history pruned ", len(recs)-len(keep), " sessions")
+}
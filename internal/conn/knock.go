@@ -0,0 +1,149 @@
+package conn
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/martinlindhe/notify"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// knock is an inbound session waiting for approval
+type knock struct {
+	types.KnockRequest
+	decision chan bool
+}
+
+// KnockQueue holds the inbound sessions of the knock mode until the
+// operator approves or denies them
+type KnockQueue struct {
+	lock    sync.Mutex
+	lastId  int64
+	pending map[int64]*knock
+}
+
+func NewKnockQueue() *KnockQueue {
+	return &KnockQueue{
+		pending: make(map[int64]*knock),
+	}
+}
+
+// needsApproval reports whether a session of peerId with the application
+// code needs the approval of the operator, and how long it waits for it
+func needsApproval(cm *conf.ConfManager, peerId string, code int32) (bool, time.Duration) {
+	kc := cm.Conf.KnockConf
+	if !kc.Enabled {
+		return false, 0
+	}
+	name := impl.AppName(code)
+	asked := false
+	for _, v := range kc.Apps {
+		if v == name {
+			asked = true
+		}
+	}
+	if !asked {
+		return false, 0
+	}
+	peerName := ""
+	if p := cm.FindPeer(peerId); p != nil {
+		peerName = p.Name
+	}
+	for _, v := range kc.Trusted {
+		if v == peerId || (peerName != "" && v == peerName) {
+			return false, 0
+		}
+	}
+	timeout := time.Duration(kc.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return true, timeout
+}
+
+// Approve returns once the operator approved the session of peerId with
+// the application code, or an error if it was denied or not approved in
+// time. Sessions which need no approval return right away.
+func (kq *KnockQueue) Approve(peerId string, code int32) error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	ask, timeout := needsApproval(cm, peerId, code)
+	if !ask {
+		return nil
+	}
+	if kq == nil {
+		return fmt.Errorf("%s session of %s needs an approval nobody can give", impl.AppName(code), peerId)
+	}
+	k := &knock{
+		KnockRequest: types.KnockRequest{
+			Peer: peerId,
+			App:  impl.AppName(code),
+			Time: time.Now(),
+		},
+		decision: make(chan bool, 1),
+	}
+	if p := cm.FindPeer(peerId); p != nil {
+		k.Name = p.Name
+	}
+	kq.lock.Lock()
+	kq.lastId++
+	k.Id = kq.lastId
+	kq.pending[k.Id] = k
+	kq.lock.Unlock()
+	defer func() {
+		kq.lock.Lock()
+		delete(kq.pending, k.Id)
+		kq.lock.Unlock()
+	}()
+
+	who := peerId
+	if k.Name != "" {
+		who = fmt.Sprintf("%s (%s)", k.Name, peerId)
+	}
+	logrus.Info(who, " asks for a ", k.App, " session, run 'sshx knock allow ", k.Id, "' to approve it")
+	notify.Notify("sshx", "knock", fmt.Sprintf("%s asks for a %s session, run 'sshx knock allow %d'", who, k.App, k.Id), "")
+	select {
+	case allow := <-k.decision:
+		if !allow {
+			return fmt.Errorf("%s session of %s denied", k.App, peerId)
+		}
+		logrus.Info(k.App, " session of ", who, " approved")
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("%s session of %s not approved in %s", k.App, peerId, timeout)
+	}
+}
+
+// List returns the sessions waiting for approval, oldest first
+func (kq *KnockQueue) List() []types.KnockRequest {
+	kq.lock.Lock()
+	defer kq.lock.Unlock()
+	ret := make([]types.KnockRequest, 0, len(kq.pending))
+	for _, k := range kq.pending {
+		ret = append(ret, k.KnockRequest)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id < ret[j].Id
+	})
+	return ret
+}
+
+// Decide approves or denies a waiting session
+func (kq *KnockQueue) Decide(id int64, allow bool) error {
+	kq.lock.Lock()
+	defer kq.lock.Unlock()
+	k, ok := kq.pending[id]
+	if !ok {
+		return fmt.Errorf("no session %d waiting for approval", id)
+	}
+	delete(kq.pending, id)
+	k.decision <- allow
+	return nil
+}
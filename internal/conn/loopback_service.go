@@ -0,0 +1,99 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// LoopbackHub stands for the network between the nodes of one process,
+// each LoopbackService started on it reaches the others by their IDs
+type LoopbackHub struct {
+	services map[string]*LoopbackService
+	lock     sync.Mutex
+}
+
+func NewLoopbackHub() *LoopbackHub {
+	return &LoopbackHub{
+		services: make(map[string]*LoopbackService),
+	}
+}
+
+func (hub *LoopbackHub) add(ls *LoopbackService) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	hub.services[ls.Id()] = ls
+}
+
+func (hub *LoopbackHub) remove(ls *LoopbackService) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if hub.services[ls.Id()] == ls {
+		delete(hub.services, ls.Id())
+	}
+}
+
+// dial opens an in-memory stream to the service of id, served as the
+// direct service serves the TCP ones
+func (hub *LoopbackHub) dial(id string) (net.Conn, error) {
+	hub.lock.Lock()
+	ls := hub.services[id]
+	hub.lock.Unlock()
+	if ls == nil || !ls.IsReady() {
+		return nil, &impl.Error{Kind: impl.ErrPeerOffline, Err: fmt.Errorf("%s is not on the loopback hub", id)}
+	}
+	local, remote := net.Pipe()
+	go ls.serveSock(remote)
+	return local, nil
+}
+
+// LoopbackService connects the nodes of a LoopbackHub over in-memory pipes
+// with the protocol of the direct service, so the connection manager and
+// the impls run in one process without sockets or a signaling server
+type LoopbackService struct {
+	BaseConnectionService
+	hub *LoopbackHub
+}
+
+func NewLoopbackService(hub *LoopbackHub, id string) *LoopbackService {
+	return &LoopbackService{
+		BaseConnectionService: *NewBaseConnectionService(id),
+		hub:                   hub,
+	}
+}
+
+func (ls *LoopbackService) Start() error {
+	ls.BaseConnectionService.Start()
+	ls.hub.add(ls)
+	return nil
+}
+
+func (ls *LoopbackService) Stop() {
+	ls.hub.remove(ls)
+	ls.BaseConnectionService.Stop()
+}
+
+func (ls *LoopbackService) CreateConnection(ctx context.Context, sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
+	iface := sender.GetImpl()
+	if iface == nil {
+		return fmt.Errorf("unknown impl")
+	}
+	if !sender.Detach {
+		iface.SetConn(sock)
+	}
+	pair := NewDirectConnection(iface, ls.Id(), iface.HostId(), poolId, CONNECTION_DRECT_OUT, &ls.CleanChan)
+	err := pair.dialWith(func() (net.Conn, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return ls.hub.dial(iface.HostId())
+	})
+	if err != nil {
+		return err
+	}
+	return ls.AddPair(pair)
+}
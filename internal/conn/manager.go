@@ -1,110 +1,437 @@
 package conn
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
 	"net"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/audit"
 	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
 
+// dialStagger is how long a service tries to connect alone before the
+// next one starts too, as in happy eyeballs. A failure starts the next one
+// at once.
+const dialStagger = 300 * time.Millisecond
+
+// dialLearnWait bounds how long a dial waits for the one in flight to a
+// peer no service connected to yet
+const dialLearnWait = 5 * time.Second
+
+// Manager answers the requests of the local clients of the daemon, as
+// ConnectionManager does over its connection services
+type Manager interface {
+	Start()
+	Stop()
+	StartDiscovery(id string, dc conf.DiscoveryConf) error
+	Stats() []types.Status
+	TransferManager() *TransferManager
+
+	CreateConnection(sender *impl.Sender, sock net.Conn, poolId types.PoolId) error
+	DestroyConnection(sender *impl.Sender, conn net.Conn) error
+	AttachConnection(sender *impl.Sender, sock net.Conn) error
+	Status(sender impl.Sender, conn net.Conn) error
+	ListTransfers(sender impl.Sender, conn net.Conn) error
+	PauseTransfer(sender *impl.Sender, conn net.Conn, pause bool) error
+	Pair(sender impl.Sender, conn net.Conn) error
+	Access(sender impl.Sender, conn net.Conn) error
+	History(sender impl.Sender, conn net.Conn) error
+	Discover(sender impl.Sender, conn net.Conn) error
+	Identity(sender impl.Sender, conn net.Conn) error
+	Knock(sender impl.Sender, conn net.Conn) error
+}
+
+var _ Manager = (*ConnectionManager)(nil)
+
 // manage all supported connection implementations
 type ConnectionManager struct {
 	css []ConnectionService
 	stm *StatManager
+	tfm *TransferManager
+	kq  *KnockQueue
+	// winners is the service which connected to each peer last, it is
+	// tried first
+	winners map[string]string
+	// learning is closed once the dial in flight to a peer without a
+	// winner is decided
+	learning map[string]chan struct{}
+	lock     sync.Mutex
 }
 
 func NewConnectionManager(enabledService []ConnectionService) *ConnectionManager {
-	return &ConnectionManager{
-		stm: NewStatManager(),
-		css: enabledService,
+	ret := &ConnectionManager{
+		stm:      NewStatManager(),
+		tfm:      NewTransferManager(0),
+		kq:       NewKnockQueue(),
+		css:      enabledService,
+		winners:  make(map[string]string),
+		learning: make(map[string]chan struct{}),
 	}
+	for _, v := range enabledService {
+		v.SetKnockQueue(ret.kq)
+	}
+	return ret
+}
+
+// Stats returns the status of the sessions of the daemon
+func (cm *ConnectionManager) Stats() []types.Status {
+	cm.stm.lock.Lock()
+	defer cm.stm.lock.Unlock()
+	return cm.stm.Stat()
+}
+
+func (cm *ConnectionManager) TransferManager() *TransferManager {
+	return cm.tfm
 }
 
 func (cm *ConnectionManager) Start() {
 	logrus.Debug("Start connection manager")
+	cm.stm.running = true
+	go cm.stm.WatchLimits()
+	go history.Prune()
 	for _, v := range cm.css {
 		v.SetStateManager(cm.stm)
 		v.Start()
-		typeName := ""
-		if t := reflect.TypeOf(v); t.Kind() == reflect.Ptr {
-			typeName = "*" + t.Elem().Name()
+		logrus.Debug("Start ", serviceName(v))
+	}
+}
+
+func serviceName(cs ConnectionService) string {
+	if t := reflect.TypeOf(cs); t.Kind() == reflect.Ptr {
+		return "*" + t.Elem().Name()
+	} else {
+		return t.Name()
+	}
+}
+
+// reacher is a service which only reaches some peers
+type reacher interface {
+	Reaches(peer string) bool
+}
+
+// fallback is a service which is only tried once the others failed to
+// connect, as the mesh
+type fallback interface {
+	Fallback() bool
+}
+
+// pairer is a service which pairs devices with codes
+type pairer interface {
+	NewPairingCode(ttl time.Duration, totp bool) (string, time.Time, error)
+	PairWith(hostId, code, name string) (string, []byte, error)
+}
+
+// announcer is a service which tells the peers of the key rotations of
+// this device
+type announcer interface {
+	AnnounceRotation() int
+}
+
+// dialOrder returns the ready services which reach peer in the order they
+// are tried to connect to it: the services which only reach some peers,
+// as the overlay, then the last one which connected, and the fallback
+// ones last
+func (cm *ConnectionManager) dialOrder(peer string) []ConnectionService {
+	cm.lock.Lock()
+	winner := cm.winners[peer]
+	cm.lock.Unlock()
+	var first, ret, last []ConnectionService
+	for _, v := range cm.css {
+		if !v.IsReady() {
+			continue
+		}
+		if f, ok := v.(fallback); ok && f.Fallback() {
+			last = append(last, v)
+			continue
+		}
+		if r, ok := v.(reacher); ok {
+			if r.Reaches(peer) {
+				first = append(first, v)
+			}
+			continue
+		}
+		if serviceName(v) == winner {
+			ret = append([]ConnectionService{v}, ret...)
 		} else {
-			typeName = t.Name()
+			ret = append(ret, v)
+		}
+	}
+	return append(append(first, ret...), last...)
+}
+
+func (cm *ConnectionManager) setWinner(peer string, cs ConnectionService) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.winners[peer] = serviceName(cs)
+}
+
+// learnWinner makes the dials to a peer no service connected to yet wait
+// for the one in flight, so a burst of sessions starts the service which
+// connected instead of racing them all. It returns the function to call
+// once the dial is decided.
+func (cm *ConnectionManager) learnWinner(peer string) func() {
+	cm.lock.Lock()
+	_, known := cm.winners[peer]
+	ch, learning := cm.learning[peer]
+	if known || peer == "" {
+		cm.lock.Unlock()
+		return func() {}
+	}
+	if !learning {
+		ch = make(chan struct{})
+		cm.learning[peer] = ch
+		cm.lock.Unlock()
+		var once sync.Once
+		return func() {
+			once.Do(func() {
+				cm.lock.Lock()
+				delete(cm.learning, peer)
+				cm.lock.Unlock()
+				close(ch)
+			})
 		}
-		logrus.Debug("Start ", typeName)
 	}
+	cm.lock.Unlock()
+	timer := time.NewTimer(dialLearnWait)
+	select {
+	case <-ch:
+	case <-timer.C:
+	}
+	timer.Stop()
+	return func() {}
+}
+
+// StartDiscovery advertises the device id on the local network and looks
+// for the devices there
+func (cm *ConnectionManager) StartDiscovery(id string, dc conf.DiscoveryConf) error {
+	return lan.Start(id, dc)
 }
 
 func (cm *ConnectionManager) Stop() {
+	lan.Stop()
+	cm.stm.Stop()
 	for _, v := range cm.css {
 		v.Stop()
 	}
 }
 
 func (cm *ConnectionManager) CreateConnection(sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
-	for i := 0; i < len(cm.css); i++ {
-
-		if cm.css[i].IsReady() {
-			go func(cs ConnectionService) {
-				s, c := net.Pipe()
-				err := cs.CreateConnection(sender, c, poolId)
-				if err != nil {
-					logrus.Error(err, i)
+	entry := cm.tfm.Track(sender.GetImpl(), poolId.String(CONNECTION_DRECT_OUT))
+	if entry == nil {
+		return cm.createConnection(sender, sock, poolId)
+	}
+	go func() {
+		if !cm.tfm.Wait(entry) {
+			sock.Close()
+			return
+		}
+		cm.createConnection(sender, cm.tfm.Wrap(entry, sock), poolId)
+	}()
+	return nil
+}
+
+// createConnection asks for a touch of the FIDO2 key first if the host is
+// a sensitive peer
+func (cm *ConnectionManager) createConnection(sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
+	imp := sender.GetImpl()
+	if imp == nil || !imp.IsNeedConnect() || !impl.NeedsPresence(imp.HostId()) {
+		return cm.dial(sender, sock, poolId)
+	}
+	go func() {
+		err := impl.ConfirmPresence(imp.HostId(), impl.AppName(imp.Code()))
+		if err != nil {
+			impl.Log(imp).Warn("connection refused: ", err)
+			recordEvent(types.EVENT_DENIED, poolId.String(CONNECTION_DRECT_OUT), impl.AppName(imp.Code()), imp.HostId(), err)
+			audit.Denied(audit.CATEGORY_AUTH, "fido.confirm", imp.HostId(), impl.AppName(imp.Code()), err)
+			Refuse(sender, sock, impl.Denied(err))
+			return
+		}
+		cm.dial(sender, sock, poolId)
+	}()
+	return nil
+}
+
+// Refuse answers the request on sock with the status of err, so the client
+// knows why it failed, and closes sock
+func Refuse(sender *impl.Sender, sock net.Conn, err error) {
+	sender.Status = impl.ErrorStatus(err)
+	sender.Encode(sock)
+	sock.Close()
+}
+
+func (cm *ConnectionManager) dial(sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
+	peer := ""
+	if imp := sender.GetImpl(); imp != nil {
+		peer = imp.HostId()
+	}
+	log := sessionLog(poolId, CONNECTION_DRECT_OUT, peer)
+	pairId, app := poolId.String(CONNECTION_DRECT_OUT), impl.AppName(poolId.ImplCode)
+	recordEvent(types.EVENT_DIAL, pairId, app, peer)
+	start := time.Now()
+	services := cm.dialOrder(peer)
+	learned := func() {}
+	cm.stm.SetUser(pairId, sender.User())
+	fail := func(err error) {
+		learned()
+		cm.stm.SetUser(pairId, "")
+		Refuse(sender, sock, err)
+		history.Add(types.HistoryRecord{
+			PairId:   pairId,
+			TargetId: peer,
+			App:      app,
+			Start:    start,
+			Failure:  err.Error(),
+			User:     sender.User(),
+		})
+	}
+	if len(services) == 0 {
+		err := &impl.Error{Kind: impl.ErrPeerOffline, Err: fmt.Errorf("no connection service ready")}
+		log.Error(err)
+		recordEvent(types.EVENT_FAILURE, pairId, app, peer, err)
+		fail(err)
+		return err
+	}
+
+	// the services race, the first one connected serves the session and
+	// the others give up. They all give up if the client hangs up first.
+	ctx, cancel := context.WithCancel(context.Background())
+	watch := watchClient(sock, cancel)
+	var failed, won int32
+	failure := make(chan struct{}, len(services))
+	attempt := func(cs ConnectionService) {
+		s, c := net.Pipe()
+		err := ctx.Err()
+		if err == nil {
+			err = cs.CreateConnection(ctx, sender, c, poolId)
+		}
+		if err != nil {
+			if atomic.LoadInt32(&won) == 1 {
+				log.Debug(serviceName(cs), " gave up, the session was served")
+				s.Close()
+				return
+			}
+			if ctx.Err() != nil {
+				err = errClientGone
+			}
+			log.Error(err)
+			recordEvent(types.EVENT_FAILURE, pairId, app, peer, err)
+			n := int(atomic.AddInt32(&failed, 1))
+			failure <- struct{}{}
+			// nobody will serve this socket anymore
+			if n == len(services) {
+				fail(err)
+			}
+			return
+		}
+		if !atomic.CompareAndSwapInt32(&won, 0, 1) {
+			log.Debug(serviceName(cs), " connected after the session was served")
+			s.Close()
+			return
+		}
+		cm.setWinner(peer, cs)
+		learned()
+		cancel()
+		client := watch.stop()
+		sender.PairId = []byte(poolId.String(CONNECTION_DRECT_OUT))
+		err = respond(sender, client)
+		if err != nil {
+			log.Error(err)
+			// the pair ends with its side of the pipe
+			s.Close()
+			return
+		}
+		utils.Pipe(&client, &s)
+	}
+	go func() {
+		learned = cm.learnWinner(peer)
+		// the dial in flight may have taught the winner
+		if order := cm.dialOrder(peer); len(order) == len(services) {
+			services = order
+		}
+		for i, cs := range services {
+			if f, ok := cs.(fallback); ok && f.Fallback() {
+				// only once the services before it failed
+				for int(atomic.LoadInt32(&failed)) < i && atomic.LoadInt32(&won) == 0 && ctx.Err() == nil {
+					select {
+					case <-failure:
+					case <-ctx.Done():
+					}
+				}
+				if atomic.LoadInt32(&won) == 1 || ctx.Err() != nil {
 					return
 				}
-				sender.PairId = []byte(poolId.String(CONNECTION_DRECT_OUT))
-				err = cs.ResponseTCP(sender, sock)
-				if err != nil {
-					logrus.Error(err, i)
+			} else if i > 0 {
+				timer := time.NewTimer(dialStagger)
+				select {
+				case <-timer.C:
+				case <-failure:
+				case <-ctx.Done():
+				}
+				timer.Stop()
+				if atomic.LoadInt32(&won) == 1 {
 					return
 				}
-				utils.Pipe(&sock, &s)
-			}(cm.css[i])
+			}
+			go attempt(cs)
 		}
-
-		// go func(idx int) {
-		// 	if cm.css[idx].IsReady() {
-		// 		err := cm.css[idx].CreateConnection(sender, sock, poolId)
-		// 		if err != nil {
-		// 			logrus.Error(err)
-		// 			return
-		// 		}
-		// 	}
-		// }(i)
-	}
+	}()
 	return nil
 }
 
+// DestroyConnection closes the pair sender.PairId, or cancels the transfer
+// waiting under it
 func (cm *ConnectionManager) DestroyConnection(sender *impl.Sender, conn net.Conn) error {
-	err := cm.css[0].DestroyConnection(sender)
+	err := cm.checkOwner(sender)
 	if err != nil {
 		return err
 	}
-	err = cm.css[0].ResponseTCP(sender, conn)
-	if err != nil {
-		logrus.Error(err)
-		return err
+	if cm.tfm.Cancel(string(sender.PairId)) {
+		return respond(sender, conn)
 	}
-	return nil
+	pair := cm.stm.GetPair(string(sender.PairId))
+	if pair == nil {
+		return fmt.Errorf("cannot get pair for %s", string(sender.PairId))
+	}
+	if pair.GetImpl().Code() == sender.GetAppCode() {
+		cm.stm.RemovePair(CleanRequest{string(sender.PairId), pair.Name()})
+	}
+	return respond(sender, conn)
 }
 
+// checkOwner refuses the requests of the users of a shared daemon on the
+// sessions of the other users
+func (cm *ConnectionManager) checkOwner(sender *impl.Sender) error {
+	if !sender.Scoped() || cm.stm.User(string(sender.PairId)) == sender.User() {
+		return nil
+	}
+	return impl.Denied(fmt.Errorf("%s is not a session of %s", string(sender.PairId), sender.User()))
+}
+
+// AttachConnection replaces the local client of the pair sender.PairId by
+// sock, the sessions of persistent impls are reached over a new connection
 func (cm *ConnectionManager) AttachConnection(sender *impl.Sender, sock net.Conn) error {
+	if p, ok := sender.GetImpl().(impl.Persistent); ok && p.Persistent() {
+		poolId := types.NewPoolId(time.Now().UnixNano(), sender.GetAppCode())
+		return cm.CreateConnection(sender, sock, *poolId)
+	}
 	go func() {
 		s, c := net.Pipe()
-		err := cm.css[0].AttachConnection(sender, c)
+		err := cm.attach(sender, c)
 		if err != nil {
 			logrus.Error(err)
 			return
 		}
-		logrus.Debug("attached ", sender.GetImpl().HostId())
-		err = cm.css[0].ResponseTCP(sender, sock)
+		impl.Log(sender.GetImpl()).Debug("attached")
+		err = respond(sender, sock)
 		if err != nil {
 			logrus.Error(err)
 			return
@@ -114,11 +441,29 @@ func (cm *ConnectionManager) AttachConnection(sender *impl.Sender, sock net.Conn
 	return nil
 }
 
+func (cm *ConnectionManager) attach(sender *impl.Sender, sock net.Conn) error {
+	err := cm.checkOwner(sender)
+	if err != nil {
+		return err
+	}
+	imp := sender.GetImpl()
+	pair := cm.stm.GetPair(string(sender.PairId))
+	if pair == nil {
+		return fmt.Errorf("cannot attach impl with id: %s", string(sender.PairId))
+	}
+	if impl.GetImplName(pair.GetImpl().Code()) != impl.GetImplName(imp.Code()) {
+		return fmt.Errorf("cannot impl type dismatch, except %s, got %s", impl.GetImplName(pair.GetImpl().Code()), impl.GetImplName(imp.Code()))
+	}
+	newSender := impl.NewSender(pair.GetImpl(), types.OPTION_TYPE_ATTACH)
+	logrus.Warn("replace impl for host id ", pair.GetImpl().HostId())
+	sender.Payload = newSender.Payload
+	return pair.GetImpl().Attach(pair.Context(), sock)
+}
+
 func (cm *ConnectionManager) Status(sender impl.Sender, conn net.Conn) error {
 	imp := sender.GetImpl()
-	bs := NewBaseConnectionService(imp.HostId())
 	imp.SetConn(conn)
-	err := bs.ResponseTCP(&sender, conn)
+	err := respond(&sender, conn)
 	if err != nil {
 		logrus.Error(err)
 		return err
@@ -129,23 +474,266 @@ func (cm *ConnectionManager) Status(sender impl.Sender, conn net.Conn) error {
 		logrus.Error(err)
 		return err
 	}
-	res = cm.stm.Stat()
+	res = cm.Stats()
+	if sender.Scoped() {
+		// users of a shared daemon only see their own sessions
+		own := res[:0]
+		for _, v := range res {
+			if v.User == sender.User() {
+				own = append(own, v)
+			}
+		}
+		res = own
+	}
 	logrus.Debug("responsed ----->", res)
 	err = gob.NewEncoder(conn).Encode(res)
 	if err != nil {
 		logrus.Error(err)
 		return err
 	}
+	// the last events and the STUN servers follow for clients which ask
+	// for them
+	st, ok := imp.(*impl.STAT)
+	if ok && st.Events && !sender.Scoped() {
+		err = gob.NewEncoder(conn).Encode(events.Events())
+		if err != nil {
+			logrus.Error(err)
+			return err
+		}
+	}
+	if ok && st.STUN {
+		err = gob.NewEncoder(conn).Encode(STUNServers())
+		if err != nil {
+			logrus.Error(err)
+			return err
+		}
+	}
+	if ok && st.Mesh {
+		routes := []types.MeshRoute{}
+		for _, v := range cm.css {
+			if ms, ok := v.(*MeshService); ok {
+				routes = ms.Routes()
+			}
+		}
+		err = gob.NewEncoder(conn).Encode(routes)
+		if err != nil {
+			logrus.Error(err)
+			return err
+		}
+	}
+	if ok && st.Events && st.Watch {
+		go streamEvents(conn)
+		return nil
+	}
 	logrus.Debug("responsed <-----")
 	return nil
 }
 
+// ListTransfers responds the transfers tracked by the daemon
+func (cm *ConnectionManager) ListTransfers(sender impl.Sender, conn net.Conn) error {
+	err := respond(&sender, conn)
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+	res := []types.TransferState{}
+	err = gob.NewDecoder(conn).Decode(&res)
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+	res = cm.tfm.List()
+	return gob.NewEncoder(conn).Encode(res)
+}
+
+// Pair creates a pairing code, or pairs with the host of the Pair impl, and
+// answers with a PairResult
+func (cm *ConnectionManager) Pair(sender impl.Sender, conn net.Conn) error {
+	defer conn.Close()
+	var ps pairer
+	for _, v := range cm.css {
+		if s, ok := v.(pairer); ok {
+			ps = s
+		}
+	}
+	p, ok := sender.GetImpl().(*impl.Pair)
+	if !ok || ps == nil {
+		sender.Status = -1
+		return respond(&sender, conn)
+	}
+	err := respond(&sender, conn)
+	if err != nil {
+		return err
+	}
+	var res types.PairResult
+	if p.PairingCode == "" {
+		res.Code, res.Expires, err = ps.NewPairingCode(time.Duration(p.TTL)*time.Second, p.TOTP)
+	} else {
+		var secret []byte
+		res.Fingerprint, secret, err = ps.PairWith(p.HostId(), p.PairingCode, p.Name)
+		if len(secret) > 0 {
+			res.TOTPURI = impl.TOTPURI(secret, p.HostId())
+		}
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return gob.NewEncoder(conn).Encode(res)
+}
+
+// Access runs a request on the access rules and answers with an
+// AccessResult
+func (cm *ConnectionManager) Access(sender impl.Sender, conn net.Conn) error {
+	defer conn.Close()
+	a, ok := sender.GetImpl().(*impl.Access)
+	if !ok {
+		sender.Status = -1
+		return respond(&sender, conn)
+	}
+	err := respond(&sender, conn)
+	if err != nil {
+		return err
+	}
+	return gob.NewEncoder(conn).Encode(a.Serve())
+}
+
+// History answers the completed sessions a history request selects
+func (cm *ConnectionManager) History(sender impl.Sender, conn net.Conn) error {
+	defer conn.Close()
+	h, ok := sender.GetImpl().(*impl.History)
+	if !ok {
+		sender.Status = -1
+		return respond(&sender, conn)
+	}
+	err := respond(&sender, conn)
+	if err != nil {
+		return err
+	}
+	res, err := history.Query(h)
+	if err != nil {
+		logrus.Error(err)
+	}
+	return gob.NewEncoder(conn).Encode(res)
+}
+
+// Discover answers the devices found on the local network, after waiting
+// for the answers of a new query if asked to
+func (cm *ConnectionManager) Discover(sender impl.Sender, conn net.Conn) error {
+	defer conn.Close()
+	d, ok := sender.GetImpl().(*impl.Discover)
+	if !ok {
+		sender.Status = -1
+		return respond(&sender, conn)
+	}
+	err := respond(&sender, conn)
+	if err != nil {
+		return err
+	}
+	if wait := d.WaitSeconds(); wait > 0 {
+		lan.Query()
+		time.Sleep(time.Duration(wait) * time.Second)
+	}
+	return gob.NewEncoder(conn).Encode(lan.Peers())
+}
+
+// Identity revokes a peer and closes its connections, or rotates the keys
+// of this device and announces them to its peers. It answers with an
+// IdentityResult.
+func (cm *ConnectionManager) Identity(sender impl.Sender, conn net.Conn) error {
+	defer conn.Close()
+	id, ok := sender.GetImpl().(*impl.Identity)
+	if !ok {
+		sender.Status = -1
+		return respond(&sender, conn)
+	}
+	err := respond(&sender, conn)
+	if err != nil {
+		return err
+	}
+	var res impl.IdentityResult
+	var action string
+	switch id.Op {
+	case impl.IDENTITY_OP_REVOKE:
+		action = "peer.revoke"
+		err = impl.RevokePeer(id.Peer)
+		if err == nil {
+			res.Closed = cm.stm.RemovePeer(id.Peer)
+		}
+	case impl.IDENTITY_OP_ROTATE:
+		action = "key.rotate"
+		res.Fingerprint, err = impl.RotateIdentity()
+		if err == nil {
+			for _, v := range cm.css {
+				if s, ok := v.(announcer); ok {
+					res.Notified += s.AnnounceRotation()
+				}
+			}
+		}
+	case impl.IDENTITY_OP_UNLOCK:
+		action = "keystore.unlock"
+		err = impl.UnlockKeyStore(id.Passphrase)
+	default:
+		err = fmt.Errorf("unknown identity request %d", id.Op)
+	}
+	if err != nil {
+		res.Error = err.Error()
+		if action != "" {
+			audit.Denied(audit.CATEGORY_KEYS, action, id.Peer, "", err)
+		}
+	} else {
+		audit.Emit(audit.CATEGORY_KEYS, action, audit.OUTCOME_SUCCESS, id.Peer, "", "")
+	}
+	return gob.NewEncoder(conn).Encode(res)
+}
+
+// Knock lists the inbound sessions waiting for approval, or approves or
+// denies one, and answers with a KnockResult
+func (cm *ConnectionManager) Knock(sender impl.Sender, conn net.Conn) error {
+	defer conn.Close()
+	k, ok := sender.GetImpl().(*impl.Knock)
+	if !ok {
+		sender.Status = -1
+		return respond(&sender, conn)
+	}
+	err := respond(&sender, conn)
+	if err != nil {
+		return err
+	}
+	var res types.KnockResult
+	if k.Request == 0 {
+		res.Requests = cm.kq.List()
+	} else if err = cm.kq.Decide(k.Request, k.Allow); err != nil {
+		res.Error = err.Error()
+	}
+	return gob.NewEncoder(conn).Encode(res)
+}
+
+// PauseTransfer pauses or resumes the transfer identified by sender.PairId
+func (cm *ConnectionManager) PauseTransfer(sender *impl.Sender, conn net.Conn, pause bool) error {
+	err := cm.checkOwner(sender)
+	if err == nil {
+		err = cm.tfm.Pause(string(sender.PairId), pause)
+	}
+	if err != nil {
+		sender.Status = -1
+	}
+	rerr := respond(sender, conn)
+	if err != nil {
+		return err
+	}
+	return rerr
+}
+
 type StatManager struct {
 	stats    map[string]types.Status
 	children map[string][]string
 	cpPool   map[string]Connection
-	running  bool
-	lock     sync.Mutex
+	warned   map[string]bool
+	// users are the local users who opened the sessions through a shared
+	// daemon
+	users   map[string]string
+	running bool
+	lock    sync.Mutex
 }
 
 func NewStatManager() *StatManager {
@@ -154,6 +742,8 @@ func NewStatManager() *StatManager {
 		stats:    make(map[string]types.Status),
 		children: make(map[string][]string),
 		cpPool:   make(map[string]Connection),
+		warned:   make(map[string]bool),
+		users:    make(map[string]string),
 	}
 }
 
@@ -191,14 +781,53 @@ func (stm *StatManager) putStat(stat types.Status) {
 func (stm *StatManager) getStat() []types.Status {
 	ret := make([]types.Status, 0)
 
-	for _, v := range stm.stats {
+	for k, v := range stm.stats {
+		if pair := stm.cpPool[k]; pair != nil {
+			h := pair.History()
+			v.BytesIn, v.BytesOut = h.BytesIn, h.BytesOut
+		}
+		v.User = stm.users[k]
+		if v.User == "" && v.ParentPairId != "" {
+			v.User = stm.users[v.ParentPairId]
+		}
 		ret = append(ret, []types.Status{v}...)
 	}
 	return ret
 }
 
+// SetUser attributes the session pid to the local user name, an empty name
+// drops the attribution
+func (stm *StatManager) SetUser(pid, name string) {
+	stm.lock.Lock()
+	defer stm.lock.Unlock()
+	if name == "" {
+		delete(stm.users, pid)
+	} else {
+		stm.users[pid] = name
+	}
+}
+
+// User returns the local user the session pid is attributed to
+func (stm *StatManager) User(pid string) string {
+	stm.lock.Lock()
+	defer stm.lock.Unlock()
+	return stm.users[pid]
+}
+
+// history returns the record of the session pair, attributed to its user
+func (stm *StatManager) history(key string, pair Connection) types.HistoryRecord {
+	rec := pair.History()
+	rec.User = stm.users[key]
+	if rec.User == "" && pair.GetImpl().ParentId() != "" {
+		rec.User = stm.users[pair.GetImpl().ParentId()]
+	}
+	return rec
+}
+
 func (stm *StatManager) removeStat(pid string) {
 	delete(stm.stats, pid)
+	delete(stm.warned, pid)
+	delete(stm.users, pid)
 	logrus.Debug("remove status for ", pid)
 }
 
@@ -219,20 +848,44 @@ func (stm *StatManager) RemovePair(id CleanRequest) {
 	for _, v := range children {
 		if stm.cpPool[v] != nil && stm.cpPool[v].Name() == id.ConnectionName {
 			stm.cpPool[v].Close()
+			history.Add(stm.history(v, stm.cpPool[v]))
 			delete(stm.cpPool, v)
-			stm.removeStat(id.Key)
+			stm.removeStat(v)
 		}
 
 	}
 	// close parent
 	if stm.cpPool[id.Key] != nil && stm.cpPool[id.Key].Name() == id.ConnectionName {
+		pair := stm.cpPool[id.Key]
+		recordEvent(types.EVENT_CLOSE, id.Key, impl.AppName(pair.GetImpl().Code()), pair.TargetId())
 		stm.cpPool[id.Key].Close()
+		rec := stm.history(id.Key, pair)
+		if rec.Failure == "" && !pair.IsReady() {
+			rec.Failure = "closed before it was open"
+		}
+		history.Add(rec)
 		delete(stm.cpPool, id.Key)
 		stm.removeStat(id.Key)
 		stm.removeParent(id.Key)
 	}
 }
 
+// RemovePeer closes the connections with peerId and returns their number
+func (stm *StatManager) RemovePeer(peerId string) int {
+	stm.lock.Lock()
+	reqs := make([]CleanRequest, 0)
+	for k, v := range stm.cpPool {
+		if v.TargetId() == peerId {
+			reqs = append(reqs, CleanRequest{k, v.Name()})
+		}
+	}
+	stm.lock.Unlock()
+	for _, v := range reqs {
+		stm.RemovePair(v)
+	}
+	return len(reqs)
+}
+
 func (stm *StatManager) doAddPair(pair Connection) error {
 	stm.cpPool[pair.PoolId().String(pair.Direction())] = pair
 	logrus.Debugf("add pair %s %s successfully\n", pair.PoolId().String(pair.Direction()), pair.Name())
@@ -241,6 +894,7 @@ func (stm *StatManager) doAddPair(pair Connection) error {
 		TargetId:  pair.TargetId(),
 		ImplType:  pair.GetImpl().Code(),
 		StartTime: time.Now(),
+		Inbound:   pair.Direction() == CONNECTION_DRECT_IN,
 	}
 
 	if pair.GetImpl().ParentId() != "" {
@@ -249,6 +903,7 @@ func (stm *StatManager) doAddPair(pair Connection) error {
 		stm.addChild(pair.GetImpl().ParentId(), pair.PoolId().String(pair.Direction()))
 	}
 	stm.putStat(stat)
+	recordEvent(types.EVENT_OPEN, stat.PairId, impl.AppName(stat.ImplType), stat.TargetId)
 	logrus.Debug("put pair on stat ", impl.GetImplName(pair.GetImpl().Code()), " with pair id ", stat.PairId)
 	return nil
 
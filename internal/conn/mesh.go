@@ -0,0 +1,436 @@
+package conn
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	// meshQueryTimeout bounds the query of the routes of a neighbor
+	meshQueryTimeout = 30 * time.Second
+
+	// meshQueries is the number of neighbors queried at a time
+	meshQueries = 4
+
+	// meshExpiry is the number of intervals the routes of a neighbor are
+	// kept once it stopped answering
+	meshExpiry = 3
+)
+
+// meshNeighbor is what a neighbor answered last
+type meshNeighbor struct {
+	answered time.Time
+	routes   []types.MeshRoute
+}
+
+// MeshService connects to the peers the other services don't reach
+// through the neighbors which advertise routes to them, it also relays the
+// sessions of peers and accepts the ones relayed to this node. The origin
+// of a session proves its pinned key end to end, then passes the checks of
+// inbound sessions as if it connected itself.
+type MeshService struct {
+	BaseConnectionService
+	interval  time.Duration
+	neighbors map[string]meshNeighbor
+	lock      sync.Mutex
+}
+
+func NewMeshService(id string, mc conf.MeshConf) *MeshService {
+	return &MeshService{
+		BaseConnectionService: *NewBaseConnectionService(id),
+		interval:              time.Duration(mc.Interval) * time.Second,
+		neighbors:             make(map[string]meshNeighbor),
+	}
+}
+
+func (ms *MeshService) Start() error {
+	ms.BaseConnectionService.Start()
+	impl.SetMeshRouter(ms)
+	if ms.interval > 0 {
+		go ms.learn()
+	}
+	return nil
+}
+
+func (ms *MeshService) Stop() {
+	impl.SetMeshRouter(nil)
+	ms.BaseConnectionService.Stop()
+}
+
+// Fallback reports that the mesh is only tried once the other services
+// failed to connect
+func (ms *MeshService) Fallback() bool {
+	return true
+}
+
+func meshConf() (*conf.ConfManager, conf.MeshConf, error) {
+	cm, err := conf.Shared()
+	if err != nil {
+		return nil, conf.MeshConf{}, err
+	}
+	return cm, cm.Conf.MeshConf, nil
+}
+
+// learn queries the routes of the neighbors every interval
+func (ms *MeshService) learn() {
+	for ms.running {
+		ms.refresh()
+		time.Sleep(ms.interval)
+	}
+}
+
+// refresh queries the routes of the neighbors, the routes of the ones
+// which don't answer are dropped after meshExpiry intervals
+func (ms *MeshService) refresh() {
+	cm, mc, err := meshConf()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	entries := mc.Neighbors
+	if len(entries) == 0 {
+		entries = []string{"*"}
+	}
+	sem := make(chan struct{}, meshQueries)
+	var wg sync.WaitGroup
+	for _, id := range cm.ExpandPeers(entries) {
+		if id == ms.Id() {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), meshQueryTimeout)
+			routes, err := impl.MeshRoutes(ctx, id)
+			cancel()
+			ms.lock.Lock()
+			defer ms.lock.Unlock()
+			if err != nil {
+				logrus.Debug("mesh routes of ", id, ": ", err)
+				if n, ok := ms.neighbors[id]; ok && time.Since(n.answered) > meshExpiry*ms.interval {
+					logrus.Info("mesh neighbor ", id, " is gone")
+					delete(ms.neighbors, id)
+				}
+				return
+			}
+			if _, ok := ms.neighbors[id]; !ok {
+				logrus.Info("mesh neighbor ", id, " advertises ", len(routes), " routes")
+			}
+			now := time.Now()
+			var learned []types.MeshRoute
+			for _, r := range routes {
+				if r.Target == ms.Id() || r.Hops < 1 {
+					continue
+				}
+				learned = append(learned, types.MeshRoute{Target: r.Target, Via: id, Hops: r.Hops + 1, Updated: now})
+			}
+			ms.neighbors[id] = meshNeighbor{answered: now, routes: learned}
+		}(id)
+	}
+	wg.Wait()
+}
+
+// Routes returns the routes of this node, to the peers and networks of
+// meshconf.routes and to the neighbors which answered, then the ones
+// learned from the neighbors, by target and from the shortest
+func (ms *MeshService) Routes() []types.MeshRoute {
+	var ret []types.MeshRoute
+	add := func(target string, updated time.Time) {
+		if target != ms.Id() {
+			ret = append(ret, types.MeshRoute{Target: target, Hops: 1, Updated: updated})
+		}
+	}
+	cm, mc, err := meshConf()
+	if err == nil {
+		var peers []string
+		for _, v := range mc.Routes {
+			if _, ipn, err := net.ParseCIDR(v); err == nil {
+				add(ipn.String(), time.Time{})
+				continue
+			}
+			peers = append(peers, v)
+		}
+		for _, v := range cm.ExpandPeers(peers) {
+			add(v, time.Time{})
+		}
+	}
+	ms.lock.Lock()
+	for id, n := range ms.neighbors {
+		add(id, n.answered)
+		ret = append(ret, n.routes...)
+	}
+	ms.lock.Unlock()
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Target != ret[j].Target {
+			return ret[i].Target < ret[j].Target
+		}
+		if ret[i].Hops != ret[j].Hops {
+			return ret[i].Hops < ret[j].Hops
+		}
+		return ret[i].Via < ret[j].Via
+	})
+	return ret
+}
+
+// Advertise returns the shortest route to each target, but the ones to the
+// neighbor or learned from it, and the ones it couldn't use within
+// meshconf.maxhops
+func (ms *MeshService) Advertise(peerId string) []types.MeshRoute {
+	_, mc, err := meshConf()
+	if err != nil {
+		return nil
+	}
+	var ret []types.MeshRoute
+	for _, r := range ms.Routes() {
+		if r.Target == peerId || r.Via == peerId || r.Hops >= mc.MaxHops {
+			continue
+		}
+		if len(ret) > 0 && ret[len(ret)-1].Target == r.Target {
+			continue
+		}
+		r.Via = ""
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// nextHops returns the devices to connect to for a session with target,
+// the target itself if this node reaches it and direct is set, then the
+// neighbors of the routes learned from the shortest, leaving out the ones
+// of path
+func (ms *MeshService) nextHops(target string, path []string, direct bool) []string {
+	var ret []string
+	for _, r := range ms.Routes() {
+		if r.Target != target {
+			continue
+		}
+		if r.Via == "" {
+			if direct {
+				return []string{target}
+			}
+			continue
+		}
+		if !meshOnPath(path, r.Via) {
+			ret = append(ret, r.Via)
+		}
+	}
+	return ret
+}
+
+func meshOnPath(path []string, id string) bool {
+	for _, v := range path {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func noMeshRoute(target string) error {
+	return &impl.Error{Kind: impl.ErrPeerOffline, Err: fmt.Errorf("no mesh route to %s", target)}
+}
+
+// Relay carries the session of req to its target, or accepts it if this
+// node is the target
+func (ms *MeshService) Relay(ctx context.Context, peerId string, req impl.MeshRequest, conn net.Conn, reply func(error) error) {
+	fail := func(err error) {
+		logrus.Warn("mesh session of ", peerId, " for ", req.Target, ": ", err)
+		reply(err)
+		conn.Close()
+	}
+	_, mc, err := meshConf()
+	if err != nil {
+		fail(err)
+		return
+	}
+	switch {
+	case len(req.Path) == 0 || req.Path[len(req.Path)-1] != peerId:
+		fail(impl.Denied(fmt.Errorf("the mesh path doesn't end with %s", peerId)))
+		return
+	case meshOnPath(req.Path, ms.Id()) || meshOnPath(req.Path, req.Target):
+		fail(impl.Denied(fmt.Errorf("loop in the mesh path %s", strings.Join(req.Path, ", "))))
+		return
+	case len(req.Path) > int(mc.MaxHops):
+		fail(impl.Denied(fmt.Errorf("more than %d hops", mc.MaxHops)))
+		return
+	}
+	// the origin is held to meshconf.peers as the previous node is
+	err = impl.MeshAllowed(mc, req.Path[0])
+	if err != nil {
+		fail(err)
+		return
+	}
+	if req.Target == ms.Id() {
+		ms.accept(req, conn, reply)
+		return
+	}
+	next := ms.nextHops(req.Target, req.Path, true)
+	if len(next) == 0 {
+		fail(noMeshRoute(req.Target))
+		return
+	}
+	fwd := req
+	fwd.Path = append(append([]string{}, req.Path...), ms.Id())
+	var out net.Conn
+	for _, v := range next {
+		out, err = impl.DialMesh(ctx, v, fwd)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	err = reply(nil)
+	if err != nil {
+		out.Close()
+		conn.Close()
+		return
+	}
+	logrus.Info("relaying the ", impl.AppName(req.App), " session of ", req.Path[0], " to ", req.Target)
+	go utils.Pipe(&conn, &out)
+}
+
+// accept serves a session relayed to this node as the ones of the direct
+// service. The relays only vouch for the ID of the origin, so it proves its
+// pinned key with the key exchange of the session, which then passes the
+// checks of inbound sessions and is sealed end to end.
+func (ms *MeshService) accept(req impl.MeshRequest, conn net.Conn, reply func(error) error) {
+	origin := req.Path[0]
+	imp := impl.GetImpl(req.App)
+	if imp == nil || req.App == types.APP_TYPE_MESH {
+		reply(impl.ErrUnsupportedApp)
+		conn.Close()
+		return
+	}
+	if !impl.IsPaired(origin) {
+		err := impl.Denied(fmt.Errorf("%s is not paired, mesh sessions need its pinned key", origin))
+		logrus.Warn("mesh session of ", origin, ": ", err)
+		reply(err)
+		conn.Close()
+		return
+	}
+	imp.SetHostId(origin)
+	imp.SetOneTimeCode(req.OTP)
+	poolId := types.NewPoolId(req.Id, imp.Code())
+	log := sessionLog(*poolId, CONNECTION_DRECT_IN, origin)
+	err := reply(nil)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	sealed, err := impl.MeshHandshake(conn, conn, origin, false)
+	if err == nil {
+		err = admit(ms.knocks, origin, sourceHost(conn.RemoteAddr()), imp)
+	}
+	if err != nil {
+		log.Warn("refused mesh session: ", err)
+		conn.Close()
+		return
+	}
+	conn = sealed
+	// the dialer starts with the DirectInfo of its session
+	conn.SetReadDeadline(time.Now().Add(directInfoTimeout))
+	r := bufio.NewReader(conn)
+	var info DirectInfo
+	err = types.DecodeLimited(r, maxDirectInfoSize, &info)
+	if err == nil && (info.HostId != origin || info.ImplCode != req.App) {
+		err = fmt.Errorf("the session doesn't match the mesh request")
+	}
+	if err != nil {
+		log.Warn("refused mesh session: ", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	buffered, _ := r.Peek(r.Buffered())
+	pair := NewDirectConnection(imp, ms.Id(), origin, *poolId, CONNECTION_DRECT_IN, &ms.CleanChan)
+	pair.Conn = &prefixConn{Conn: conn, prefix: buffered}
+	err = pair.Response()
+	if err != nil {
+		pair.log().Error(err)
+		recordEvent(types.EVENT_FAILURE, poolId.String(CONNECTION_DRECT_IN), impl.AppName(imp.Code()), origin, err)
+		pair.fail(err)
+		history.Add(pair.History())
+		return
+	}
+	pair.path, pair.candidate = "mesh "+strings.Join(append(req.Path, ms.Id()), " -> "), "mesh"
+	ms.AddPair(pair)
+}
+
+// CreateConnection connects to the peer of sender through the neighbors
+// which reach it, the shortest route first
+func (ms *MeshService) CreateConnection(ctx context.Context, sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
+	err := ms.BaseConnectionService.CreateConnection(ctx, sender, sock, poolId)
+	if err != nil {
+		return err
+	}
+	iface := sender.GetImpl()
+	if iface == nil {
+		return fmt.Errorf("unknown impl")
+	}
+	if iface.Code() == types.APP_TYPE_MESH {
+		return fmt.Errorf("mesh sessions are not relayed")
+	}
+	target := iface.HostId()
+	if !impl.IsPaired(target) {
+		return impl.Denied(fmt.Errorf("%s is not paired, mesh sessions need its pinned key", target))
+	}
+	// the other services already failed to reach the target directly
+	next := ms.nextHops(target, []string{ms.Id()}, false)
+	if len(next) == 0 {
+		return noMeshRoute(target)
+	}
+	if !sender.Detach {
+		iface.SetConn(sock)
+	}
+	pair := NewDirectConnection(iface, ms.Id(), target, poolId, CONNECTION_DRECT_OUT, &ms.CleanChan)
+	var via string
+	err = pair.dialWith(func() (net.Conn, error) {
+		var err error
+		for _, via = range next {
+			var conn net.Conn
+			conn, err = impl.DialMesh(ctx, via, impl.MeshRequest{
+				Target: target,
+				App:    iface.Code(),
+				OTP:    iface.OneTimeCode(),
+				Id:     poolId.Raw(),
+				Path:   []string{ms.Id()},
+			})
+			if err == nil {
+				// the session is sealed end to end, with the key pinned
+				// for the target
+				var sealed net.Conn
+				sealed, err = impl.MeshHandshake(conn, conn, target, true)
+				if err == nil {
+					return sealed, nil
+				}
+				conn.Close()
+			}
+			pair.log().Debug("mesh route via ", via, ": ", err)
+		}
+		return nil, err
+	})
+	if err != nil {
+		return err
+	}
+	pair.path, pair.candidate = "mesh via "+via, "mesh"
+	return ms.AddPair(pair)
+}
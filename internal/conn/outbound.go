@@ -0,0 +1,90 @@
+package conn
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+// NewOutboundProxy returns the proxy of the signaling requests and TURN
+// connections over TCP of the configure
+func NewOutboundProxy(pc conf.OutboundProxyConf) (*utils.OutboundProxy, error) {
+	return utils.NewOutboundProxy(pc.URL, pc.NoProxy)
+}
+
+// NewPeerConnection creates a peer connection whose TURN connections over
+// TCP and TLS go through the outbound proxy op, if not nil. TURN over UDP
+// can't go through HTTP proxies and is used as is.
+func NewPeerConnection(config webrtc.Configuration, op *utils.OutboundProxy) (*webrtc.PeerConnection, error) {
+	if op == nil {
+		return webrtc.NewPeerConnection(config)
+	}
+	m := &webrtc.MediaEngine{}
+	err := m.RegisterDefaultCodecs()
+	if err != nil {
+		return nil, err
+	}
+	var se webrtc.SettingEngine
+	se.SetICEProxyDialer(&turnDialer{proxy: op, tls: turnsServers(config.ICEServers)})
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(se))
+	return api.NewPeerConnection(config)
+}
+
+// turnDialer connects to TURN servers through the outbound proxy. ICE
+// leaves TLS to the dialer, it starts it with the turns servers.
+type turnDialer struct {
+	proxy *utils.OutboundProxy
+	// tls holds the server names of the turns servers by address
+	tls map[string]string
+}
+
+func (td *turnDialer) Dial(network, addr string) (net.Conn, error) {
+	target := addr
+	if i := strings.LastIndex(addr, ":"); i > 0 && strings.Count(addr, ":") > 1 {
+		// ICE formats IPv6 addresses without brackets
+		target = net.JoinHostPort(addr[:i], addr[i+1:])
+	}
+	conn, err := td.proxy.Dial("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	name, ok := td.tls[addr]
+	if !ok {
+		return conn, nil
+	}
+	tc := tls.Client(conn, &tls.Config{ServerName: name})
+	err = tc.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// turnsServers returns the host names of the turns URLs of servers by
+// address, as ICE dials them
+func turnsServers(servers []webrtc.ICEServer) map[string]string {
+	ret := make(map[string]string)
+	for _, s := range servers {
+		for _, u := range s.URLs {
+			if !strings.HasPrefix(strings.ToLower(u), "turns:") {
+				continue
+			}
+			hostport := u[len("turns:"):]
+			if i := strings.Index(hostport, "?"); i >= 0 {
+				hostport = hostport[:i]
+			}
+			host, port, err := net.SplitHostPort(hostport)
+			if err != nil {
+				host, port = strings.Trim(hostport, "[]"), "5349"
+			}
+			// ICE formats the address without brackets, as host:port
+			ret[host+":"+port] = host
+		}
+	}
+	return ret
+}
@@ -0,0 +1,174 @@
+package conn
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	// overlayHandshakeTimeout bounds the handshake of an overlay connection
+	overlayHandshakeTimeout = 10 * time.Second
+
+	// overlayNonceSize is the size of the challenges of the handshake
+	overlayNonceSize = 32
+)
+
+// OverlayConnection is a session over the WireGuard or Tailscale network
+// of both devices. It is a direct connection once the handshake proved the
+// node keys of both ends.
+type OverlayConnection struct {
+	DirectConnection
+	// addr is the overlay address of the peer
+	addr string
+}
+
+func NewOverlayConnection(impl impl.Impl, nodeId string, targetId string, addr string, poolId types.PoolId, direct int32, cleanChan *chan CleanRequest) *OverlayConnection {
+	return &OverlayConnection{
+		DirectConnection: *NewDirectConnection(impl, nodeId, targetId, poolId, direct, cleanChan),
+		addr:             addr,
+	}
+}
+
+// overlayPath describes the path of an overlay connection
+func overlayPath(conn net.Conn) string {
+	return fmt.Sprintf("overlay tcp %s -> %s", conn.LocalAddr(), conn.RemoteAddr())
+}
+
+// overlayNonce returns a new challenge of the handshake
+func overlayNonce() ([]byte, error) {
+	nonce := make([]byte, overlayNonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// readHandshake reads a signed message of the handshake and checks it
+// comes from source to target and answers the challenge if any
+func readHandshake(conn net.Conn, flag int, source, target string, challenge []byte) (types.SignalingInfo, error) {
+	info, err := types.DecodeSignalingInfo(conn)
+	if err != nil {
+		return info, err
+	}
+	if info.Flag != flag || (source != "" && info.Source != source) || info.Target != target {
+		return info, fmt.Errorf("unexpected overlay handshake message of %s", info.Source)
+	}
+	if challenge != nil && !bytes.Equal(info.Proof, challenge) {
+		return info, fmt.Errorf("%s failed the overlay challenge", info.Source)
+	}
+	return info, impl.VerifySignaling(&info, true)
+}
+
+// writeHandshake signs and writes a message of the handshake
+func writeHandshake(conn net.Conn, info types.SignalingInfo) error {
+	err := impl.SignSignaling(&info)
+	if err != nil {
+		return err
+	}
+	return types.WriteSignalingInfo(conn, &info)
+}
+
+// handshake proves the node keys of both ends, the dialer offers the
+// session with a challenge, the responder answers it with its own and the
+// dialer confirms by answering it
+func (oc *OverlayConnection) handshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(overlayHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	nonce, err := overlayNonce()
+	if err != nil {
+		return err
+	}
+	err = writeHandshake(conn, types.SignalingInfo{
+		Flag:   types.SIG_TYPE_OFFER,
+		Source: oc.nodeId,
+		Target: oc.TargetId(),
+		Id:     oc.poolId,
+		OTP:    oc.impl.OneTimeCode(),
+		Hello:  nonce,
+	})
+	if err != nil {
+		return err
+	}
+	answer, err := readHandshake(conn, types.SIG_TYPE_ANSWER, oc.TargetId(), oc.nodeId, nonce)
+	if err != nil {
+		return err
+	}
+	return writeHandshake(conn, types.SignalingInfo{
+		Flag:   types.SIG_TYPE_ANSWER,
+		Source: oc.nodeId,
+		Target: oc.TargetId(),
+		Id:     oc.poolId,
+		Proof:  answer.Hello,
+	})
+}
+
+func (oc *OverlayConnection) Name() string {
+	if t := reflect.TypeOf(oc); t.Kind() == reflect.Ptr {
+		return "*" + t.Elem().Name()
+	} else {
+		return t.Name()
+	}
+}
+
+func (oc *OverlayConnection) Dial() error {
+	return oc.dial(oc.Context())
+}
+
+// dial connects to the target over the overlay until ctx is done
+func (oc *OverlayConnection) dial(ctx context.Context) error {
+	if oc.impl.IsNeedConnect() {
+		oc.log().Debug("dial ", oc.TargetId(), " over the overlay at ", oc.addr)
+		dialer := net.Dialer{Timeout: directDialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", oc.addr)
+		if err != nil {
+			return err
+		}
+		err = utils.WithContext(ctx, conn, func() error {
+			return oc.handshake(conn)
+		})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		implConn := oc.impl.Conn()
+		oc.Conn = conn
+		oc.path, oc.candidate = overlayPath(conn), "overlay"
+		go func() {
+			oc.pipe(implConn)
+			oc.log().Error("overlay broken ", oc.Name())
+			*oc.CleanChan <- CleanRequest{oc.PoolId().String(oc.Direction()), oc.Name()}
+		}()
+	} else {
+		oc.log().Error("NOT create connection for ", impl.GetImplName(oc.impl.Code()))
+	}
+	err := oc.BaseConnection.Dial()
+	if err != nil {
+		return err
+	}
+	oc.Exit <- err
+	oc.Ready()
+	return nil
+}
+
+func (oc *OverlayConnection) Response() error {
+	oc.Ready()
+	err := oc.BaseConnection.Response()
+	if err != nil {
+		return err
+	}
+	implConn := oc.impl.Conn()
+	oc.path, oc.candidate = overlayPath(oc.Conn), "overlay"
+	go func() {
+		oc.pipe(implConn)
+		oc.log().Error("overlay broken ", oc.Name())
+		*oc.CleanChan <- CleanRequest{oc.poolId.String(oc.Direction()), oc.Name()}
+	}()
+	return nil
+}
@@ -0,0 +1,270 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// OverlayService connects to peers of a WireGuard or Tailscale network
+// this device is on, on their overlay address. The overlay encrypts the
+// data, the node keys of both ends are proved by a handshake of signed
+// signaling messages.
+type OverlayService struct {
+	BaseConnectionService
+	oc conf.OverlayConf
+	// learned are the overlay addresses peers connected from
+	learned map[string]string
+	lock    sync.Mutex
+}
+
+func NewOverlayService(id string, oc conf.OverlayConf) *OverlayService {
+	return &OverlayService{
+		BaseConnectionService: *NewBaseConnectionService(id),
+		oc:                    oc,
+		learned:               make(map[string]string),
+	}
+}
+
+// networks returns the networks of the overlay: the configured ones and
+// the ones of the overlay interfaces
+func (ovs *OverlayService) networks() []*net.IPNet {
+	var ret []*net.IPNet
+	for _, v := range ovs.oc.CIDRs {
+		_, ipn, err := net.ParseCIDR(v)
+		if err == nil {
+			ret = append(ret, ipn)
+		}
+	}
+	for _, name := range ovs.oc.Interfaces {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, v := range addrs {
+			if ipn, ok := v.(*net.IPNet); ok {
+				ret = append(ret, &net.IPNet{IP: ipn.IP.Mask(ipn.Mask), Mask: ipn.Mask})
+			}
+		}
+	}
+	return ret
+}
+
+// isOverlay reports whether ip is in the networks of the overlay
+func (ovs *OverlayService) isOverlay(ip net.IP) bool {
+	for _, v := range ovs.networks() {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalAddrs returns the overlay addresses of this device
+func (ovs *OverlayService) LocalAddrs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var ret []net.IP
+	for _, v := range addrs {
+		if ipn, ok := v.(*net.IPNet); ok && !ipn.IP.IsLoopback() && ovs.isOverlay(ipn.IP) {
+			ret = append(ret, ipn.IP)
+		}
+	}
+	return ret
+}
+
+func (ovs *OverlayService) IsReady() bool {
+	return ovs.BaseConnectionService.IsReady() && len(ovs.LocalAddrs()) > 0
+}
+
+// peerAddress returns the overlay address of a peer, the one of its
+// address book entry or the one it connected from
+func (ovs *OverlayService) peerAddress(peer string) string {
+	cm, err := conf.Shared()
+	if err == nil {
+		if p := cm.FindPeer(peer); p != nil && p.Overlay != "" {
+			return p.Overlay
+		}
+	}
+	ovs.lock.Lock()
+	defer ovs.lock.Unlock()
+	return ovs.learned[peer]
+}
+
+// Reaches reports whether the peer has an overlay address
+func (ovs *OverlayService) Reaches(peer string) bool {
+	return ovs.peerAddress(peer) != ""
+}
+
+// resolve returns the address to dial a peer at, its overlay address must
+// be in the networks of the overlay so sessions never leave it
+func (ovs *OverlayService) resolve(peer string) (string, error) {
+	host := ovs.peerAddress(peer)
+	if host == "" {
+		return "", fmt.Errorf("no overlay address of %s", peer)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if ovs.isOverlay(ip) {
+			return net.JoinHostPort(ip.String(), strconv.Itoa(int(ovs.oc.Port))), nil
+		}
+	}
+	return "", fmt.Errorf("%s of %s is not an overlay address", host, peer)
+}
+
+// learn keeps the overlay address a peer connected from, it is saved in
+// the address book entry of the peer if it has none
+func (ovs *OverlayService) learn(peer string, ip net.IP) {
+	ovs.lock.Lock()
+	ovs.learned[peer] = ip.String()
+	ovs.lock.Unlock()
+	cm, err := conf.Shared()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	p := cm.FindPeer(peer)
+	if p == nil {
+		cm.Conf.AddressBook = append(cm.Conf.AddressBook, conf.Peer{ID: peer})
+		p = &cm.Conf.AddressBook[len(cm.Conf.AddressBook)-1]
+	}
+	if p.Overlay != "" {
+		return
+	}
+	p.Overlay = ip.String()
+	err = cm.SaveAddressBook()
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (ovs *OverlayService) Start() error {
+	ovs.BaseConnectionService.Start()
+	listenner, err := net.Listen("tcp", fmt.Sprintf(":%d", ovs.oc.Port))
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+	go func() {
+		for ovs.running {
+			sock, err := listenner.Accept()
+			if err != nil {
+				logrus.Error(err)
+				continue
+			}
+			local, _ := sock.LocalAddr().(*net.TCPAddr)
+			remote, _ := sock.RemoteAddr().(*net.TCPAddr)
+			if local == nil || remote == nil || !ovs.isOverlay(local.IP) || !ovs.isOverlay(remote.IP) {
+				logrus.Warn("refused overlay connection from ", sock.RemoteAddr(), ": not on the overlay")
+				sock.Close()
+				continue
+			}
+			go ovs.serveOverlay(sock, remote.IP)
+		}
+	}()
+	return nil
+}
+
+// handshake answers the offer of a dialer and checks its confirmation,
+// it returns the offer
+func (ovs *OverlayService) handshake(sock net.Conn) (types.SignalingInfo, error) {
+	offer, err := readHandshake(sock, types.SIG_TYPE_OFFER, "", ovs.Id(), nil)
+	if err != nil {
+		return offer, err
+	}
+	if len(offer.Hello) != overlayNonceSize {
+		return offer, fmt.Errorf("invalid overlay challenge of %s", offer.Source)
+	}
+	nonce, err := overlayNonce()
+	if err != nil {
+		return offer, err
+	}
+	err = writeHandshake(sock, types.SignalingInfo{
+		Flag:   types.SIG_TYPE_ANSWER,
+		Source: ovs.Id(),
+		Target: offer.Source,
+		Id:     offer.Id,
+		Hello:  nonce,
+		Proof:  offer.Hello,
+	})
+	if err != nil {
+		return offer, err
+	}
+	_, err = readHandshake(sock, types.SIG_TYPE_ANSWER, offer.Source, ovs.Id(), nonce)
+	return offer, err
+}
+
+func (ovs *OverlayService) serveOverlay(sock net.Conn, from net.IP) {
+	sock.SetDeadline(time.Now().Add(overlayHandshakeTimeout))
+	offer, err := ovs.handshake(sock)
+	if err != nil {
+		logrus.Warn("refused overlay connection from ", sock.RemoteAddr(), ": ", err)
+		sock.Close()
+		return
+	}
+	sock.SetDeadline(time.Time{})
+	ovs.learn(offer.Source, from)
+	imp := impl.GetImpl(offer.Id.ImplCode)
+	if imp == nil {
+		logrus.Error("unknow impl for IMCODE: ", offer.Id.ImplCode)
+		sock.Close()
+		return
+	}
+	imp.SetHostId(offer.Source)
+	imp.SetOneTimeCode(offer.OTP)
+	poolId := types.NewPoolId(offer.Id.Value, imp.Code())
+	err = admit(ovs.knocks, offer.Source, from.String(), imp)
+	if err != nil {
+		sessionLog(*poolId, CONNECTION_DRECT_IN, offer.Source).Warn(err)
+		sock.Close()
+		return
+	}
+	conn := NewOverlayConnection(imp, ovs.Id(), offer.Source, from.String(), *poolId, CONNECTION_DRECT_IN, &ovs.CleanChan)
+	conn.Conn = sock
+	if pr, ok := imp.(impl.PathReporter); ok {
+		pr.SetPath(overlayPath(sock))
+	}
+	err = conn.Response()
+	if err != nil {
+		conn.log().Error(err)
+		recordEvent(types.EVENT_FAILURE, poolId.String(CONNECTION_DRECT_IN), impl.AppName(imp.Code()), offer.Source, err)
+		conn.fail(err)
+		history.Add(conn.History())
+		return
+	}
+	ovs.AddPair(conn)
+}
+
+func (ovs *OverlayService) CreateConnection(ctx context.Context, sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
+	iface := sender.GetImpl()
+	if iface == nil {
+		return fmt.Errorf("unknown impl")
+	}
+	addr, err := ovs.resolve(iface.HostId())
+	if err != nil {
+		return err
+	}
+	if !sender.Detach {
+		iface.SetConn(sock)
+	}
+	pair := NewOverlayConnection(iface, ovs.Id(), iface.HostId(), addr, poolId, CONNECTION_DRECT_OUT, &ovs.CleanChan)
+	err = pair.dial(ctx)
+	if err != nil {
+		return err
+	}
+	return ovs.AddPair(pair)
+}
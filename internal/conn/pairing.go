@@ -0,0 +1,250 @@
+package conn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/audit"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	// default validity of a pairing code
+	defaultPairTTL = 5 * time.Minute
+	// wrong codes a pairing code survives
+	pairCodeAttempts = 3
+	// wait for the answer of the device to pair with
+	pairTimeout = time.Minute
+)
+
+// pairing holds the pairing code of this device and the pairings waiting
+// for the answer of another device
+type pairing struct {
+	lock     sync.Mutex
+	code     string
+	expires  time.Time
+	attempts int
+	// totp enrolls a TOTP secret for the device pairing with the code
+	totp  bool
+	joins map[string]chan types.SignalingInfo
+}
+
+// NewPairingCode creates the numeric code a device gives to pair with this
+// one, it replaces the previous code and is valid once. With totp the
+// device pairing is enrolled for TOTP codes.
+func (wss *WebRTCService) NewPairingCode(ttl time.Duration, totp bool) (string, time.Time, error) {
+	if ttl <= 0 {
+		ttl = defaultPairTTL
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	wss.pairing.lock.Lock()
+	defer wss.pairing.lock.Unlock()
+	wss.pairing.code = fmt.Sprintf("%06d", n.Int64())
+	wss.pairing.expires = time.Now().Add(ttl)
+	wss.pairing.attempts = 0
+	wss.pairing.totp = totp
+	return wss.pairing.code, wss.pairing.expires, nil
+}
+
+// PairWith sends the identity key of this device to hostId with the proof
+// it knows the pairing code, and pins the key hostId answers with. It
+// returns the fingerprint of that key, and the TOTP secret hostId enrolled
+// this device with if it did. The name this device asks to be known by is
+// only kept by hosts which issued code as a join token.
+func (wss *WebRTCService) PairWith(hostId, code, name string) (string, []byte, error) {
+	if wss.signalingServerAddr == "" {
+		return "", nil, fmt.Errorf("no signaling server set")
+	}
+	pub, err := impl.IdentityKey()
+	if err != nil {
+		return "", nil, err
+	}
+	nodePub, err := impl.NodePublicKey()
+	if err != nil {
+		return "", nil, err
+	}
+	ch := make(chan types.SignalingInfo, 1)
+	wss.pairing.lock.Lock()
+	if wss.pairing.joins == nil {
+		wss.pairing.joins = make(map[string]chan types.SignalingInfo)
+	}
+	if wss.pairing.joins[hostId] != nil {
+		wss.pairing.lock.Unlock()
+		return "", nil, fmt.Errorf("already pairing with %s", hostId)
+	}
+	wss.pairing.joins[hostId] = ch
+	wss.pairing.lock.Unlock()
+	defer func() {
+		wss.pairing.lock.Lock()
+		delete(wss.pairing.joins, hostId)
+		wss.pairing.lock.Unlock()
+	}()
+
+	err = wss.push(types.SignalingInfo{
+		Flag:   types.SIG_TYPE_PAIR_REQUEST,
+		Source: wss.id,
+		Target: hostId,
+		Id:     *types.NewPoolId(time.Now().UnixNano(), types.APP_TYPE_PAIR),
+		Hello:  pub,
+		Proof:  impl.PairingProof(code, wss.id, hostId, pub, nodePub, []byte(name)),
+		Name:   name,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	var info types.SignalingInfo
+	select {
+	case info = <-ch:
+	case <-time.After(pairTimeout):
+		return "", nil, fmt.Errorf("%s did not answer, is its daemon running?", hostId)
+	}
+	if len(info.Proof) == 0 {
+		return "", nil, fmt.Errorf("%s refused the pairing code", hostId)
+	}
+	if !hmac.Equal(info.Proof, impl.PairingProof(code, hostId, wss.id, info.Hello, pub, info.TOTPSecret, info.NodeKey)) {
+		return "", nil, fmt.Errorf("the answer of %s does not prove the pairing code", hostId)
+	}
+	var secret []byte
+	if len(info.TOTPSecret) > 0 {
+		secret, err = impl.OpenPairingSecret(wss.id, info.Hello, code, info.TOTPSecret)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	err = impl.PairPeer(hostId, info.Hello)
+	if err == nil && len(info.NodeKey) > 0 {
+		err = impl.PinNodeKey(hostId, info.NodeKey)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return impl.KeyFingerprint(info.Hello), secret, nil
+}
+
+// checkPairingCode reports whether proof was made with the pairing code of
+// this device, which is then used up, and whether the code enrolls TOTP.
+// Too many wrong proofs drop the code.
+func (wss *WebRTCService) checkPairingCode(info types.SignalingInfo) (string, bool, bool) {
+	wss.pairing.lock.Lock()
+	defer wss.pairing.lock.Unlock()
+	code := wss.pairing.code
+	if code == "" || time.Now().After(wss.pairing.expires) {
+		return "", false, false
+	}
+	if hmac.Equal(info.Proof, impl.PairingProof(code, info.Source, wss.id, info.Hello, info.NodeKey, []byte(info.Name))) {
+		wss.pairing.code = ""
+		return code, wss.pairing.totp, true
+	}
+	wss.pairing.attempts++
+	if wss.pairing.attempts >= pairCodeAttempts {
+		logrus.Warn("too many wrong pairing codes, the code is no longer valid")
+		wss.pairing.code = ""
+	}
+	return "", false, false
+}
+
+func (wss *WebRTCService) ServePairRequest(info types.SignalingInfo) {
+	resp := types.SignalingInfo{
+		Flag:   types.SIG_TYPE_PAIR_RESPONSE,
+		Source: wss.id,
+		Target: info.Source,
+		Id:     info.Id,
+	}
+	// join tokens are tried first, their proofs would count as wrong
+	// pairing codes
+	token, err := impl.AcceptJoinToken(info.Source, func(secret string) bool {
+		return hmac.Equal(info.Proof, impl.PairingProof(secret, info.Source, wss.id, info.Hello, info.NodeKey, []byte(info.Name)))
+	})
+	if err != nil {
+		logrus.Warn("refused joining of ", info.Source, ": ", err)
+		audit.Denied(audit.CATEGORY_PAIRING, "join.accept", info.Source, "", err)
+		wss.push(resp)
+		return
+	}
+	var code string
+	var totp, ok bool
+	if token != nil {
+		code, ok = token.Secret, true
+	} else {
+		code, totp, ok = wss.checkPairingCode(info)
+	}
+	if !ok {
+		logrus.Warn("refused pairing of ", info.Source)
+		recordEvent(types.EVENT_DENIED, "", "pair", info.Source, "wrong or expired pairing code")
+		audit.Denied(audit.CATEGORY_PAIRING, "pair.accept", info.Source, "", fmt.Errorf("wrong or expired pairing code"))
+		wss.push(resp)
+		return
+	}
+	pub, err := impl.IdentityKey()
+	if err == nil {
+		err = impl.PairPeer(info.Source, info.Hello)
+	}
+	if err == nil && len(info.NodeKey) > 0 {
+		err = impl.PinNodeKey(info.Source, info.NodeKey)
+	}
+	var nodePub []byte
+	if err == nil {
+		nodePub, err = impl.NodePublicKey()
+	}
+	if err == nil && totp {
+		var secret []byte
+		secret, err = impl.EnrollTOTP(info.Source)
+		if err == nil {
+			resp.TOTPSecret, err = impl.SealPairingSecret(info.Source, info.Hello, code, secret)
+		}
+	}
+	if err != nil {
+		logrus.Error("pairing of ", info.Source, ": ", err)
+		audit.Denied(audit.CATEGORY_PAIRING, "pair.accept", info.Source, "", err)
+		wss.push(resp)
+		return
+	}
+	if token != nil {
+		err = wss.addJoined(info, token)
+		if err != nil {
+			logrus.Error("joining of ", info.Source, ": ", err)
+		}
+		audit.Emit(audit.CATEGORY_PAIRING, "join.accept", audit.OUTCOME_SUCCESS, info.Source, "", "token "+token.ID)
+	} else {
+		audit.Emit(audit.CATEGORY_PAIRING, "pair.accept", audit.OUTCOME_SUCCESS, info.Source, "", "")
+	}
+	resp.Hello = pub
+	resp.Proof = impl.PairingProof(code, wss.id, info.Source, pub, info.Hello, resp.TOTPSecret, nodePub)
+	wss.push(resp)
+}
+
+// addJoined adds a device which joined with token to the address book, with
+// the name of the token or the one it asked for
+func (wss *WebRTCService) addJoined(info types.SignalingInfo, token *impl.JoinToken) error {
+	if wss.cm == nil {
+		return fmt.Errorf("no address book")
+	}
+	name := token.Name
+	if name == "" {
+		name = info.Name
+	}
+	return wss.cm.AddJoinedPeer(info.Source, name, token.Groups)
+}
+
+func (wss *WebRTCService) ServePairResponse(info types.SignalingInfo) {
+	wss.pairing.lock.Lock()
+	ch := wss.pairing.joins[info.Source]
+	wss.pairing.lock.Unlock()
+	if ch == nil {
+		logrus.Debug("unexpected pairing answer of ", info.Source)
+		return
+	}
+	select {
+	case ch <- info:
+	default:
+	}
+}
@@ -0,0 +1,572 @@
+package conn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/e2e"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/types"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Transports measured by RunPerf
+const (
+	// PERF_DIRECT relays TCP as the direct service does
+	PERF_DIRECT = "direct"
+	// PERF_WEBRTC sends sealed messages over a data channel
+	PERF_WEBRTC = "webrtc"
+	// PERF_WEBRTC_PLAIN sends the messages of PERF_WEBRTC unsealed
+	PERF_WEBRTC_PLAIN = "webrtc-plain"
+)
+
+// PerfTransports lists the transports RunPerf measures
+var PerfTransports = []string{PERF_DIRECT, PERF_WEBRTC, PERF_WEBRTC_PLAIN}
+
+const (
+	// perfSetupTimeout bounds the setup of a link
+	perfSetupTimeout = 30 * time.Second
+	// perfTimeout bounds the measurements once a link is up
+	perfTimeout = 5 * time.Minute
+	// pings are echoed by the responder, the rest of the data is counted
+	perfPingSize = 8
+)
+
+// PerfResult is the outcome of the measurement of a transport between two
+// nodes of this process, in milliseconds and bytes per second
+type PerfResult struct {
+	Transport string  `json:"transport"`
+	Setup     float64 `json:"setup_ms"`
+	Bytes     int64   `json:"bytes"`
+	Rate      float64 `json:"bytes_per_second"`
+	Pings     int     `json:"pings"`
+	RTTMin    float64 `json:"rtt_min_ms"`
+	RTTMedian float64 `json:"rtt_median_ms"`
+	RTTP99    float64 `json:"rtt_p99_ms"`
+}
+
+// RunPerf sets up a link of transport between two nodes of this process
+// and measures its setup time, the round trip time of pings messages and
+// the throughput of size bytes. WebRTC links use the network interfaces of
+// the device and signal through memory, in the wire encoding.
+func RunPerf(transport string, pings int, size int64) (PerfResult, error) {
+	switch transport {
+	case PERF_DIRECT:
+		return perfDirect(pings, size)
+	case PERF_WEBRTC:
+		return perfWebRTC(true, pings, size)
+	case PERF_WEBRTC_PLAIN:
+		return perfWebRTC(false, pings, size)
+	}
+	return PerfResult{}, fmt.Errorf("unknown transport %q", transport)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// perfDial runs the measurements from the dialer side of a link
+func perfDial(rw io.ReadWriter, pings int, size int64) (PerfResult, error) {
+	res := PerfResult{Pings: pings, Bytes: size}
+	rtts := make([]time.Duration, 0, pings)
+	ping := make([]byte, perfPingSize)
+	for i := 0; i < pings; i++ {
+		start := time.Now()
+		_, err := rw.Write(ping)
+		if err == nil {
+			_, err = io.ReadFull(rw, ping)
+		}
+		if err != nil {
+			return res, fmt.Errorf("ping: %v", err)
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	if len(rtts) > 0 {
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		res.RTTMin = milliseconds(rtts[0])
+		res.RTTMedian = milliseconds(rtts[len(rtts)/2])
+		res.RTTP99 = milliseconds(rtts[(len(rtts)*99+99)/100-1])
+	}
+
+	buf := utils.GetBuffer()
+	defer utils.PutBuffer(buf)
+	start := time.Now()
+	for left := size; left > 0; {
+		chunk := *buf
+		if int64(len(chunk)) > left {
+			chunk = chunk[:left]
+		}
+		n, err := rw.Write(chunk)
+		if err != nil {
+			return res, fmt.Errorf("send: %v", err)
+		}
+		left -= int64(n)
+	}
+	// the responder acknowledges the last byte
+	_, err := io.ReadFull(rw, ping[:1])
+	if err != nil {
+		return res, fmt.Errorf("send: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 0 {
+		res.Rate = float64(size) / elapsed.Seconds()
+	}
+	return res, nil
+}
+
+// perfRespond echoes the pings of perfDial, reads the data and
+// acknowledges it
+func perfRespond(r io.Reader, w io.Writer, pings int, size int64) error {
+	ping := make([]byte, perfPingSize)
+	for i := 0; i < pings; i++ {
+		_, err := io.ReadFull(r, ping)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(ping)
+		if err != nil {
+			return err
+		}
+	}
+	buf := utils.GetBuffer()
+	defer utils.PutBuffer(buf)
+	_, err := io.CopyBuffer(io.Discard, io.LimitReader(r, size), *buf)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(ping[:1])
+	return err
+}
+
+// perfDirect measures a TCP connection relayed to the responder, as the
+// direct service relays sessions
+func perfDirect(pings int, size int64) (PerfResult, error) {
+	res := PerfResult{Transport: PERF_DIRECT}
+	responder, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return res, err
+	}
+	defer responder.Close()
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return res, err
+	}
+	defer relay.Close()
+
+	go func() {
+		conn, err := responder.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		err = perfRespond(conn, conn, pings, size)
+		if err != nil {
+			logrus.Debug("perf responder ", err)
+		}
+	}()
+	relayed := make(chan error, 1)
+	go func() {
+		in, err := relay.Accept()
+		if err != nil {
+			relayed <- err
+			return
+		}
+		out, err := net.DialTimeout("tcp", responder.Addr().String(), perfSetupTimeout)
+		relayed <- err
+		if err != nil {
+			in.Close()
+			return
+		}
+		utils.Pipe(&in, &out)
+	}()
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", relay.Addr().String(), perfSetupTimeout)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Close()
+	err = <-relayed
+	if err != nil {
+		return res, err
+	}
+	res.Setup = milliseconds(time.Since(start))
+	conn.SetDeadline(time.Now().Add(perfTimeout))
+	ret, err := perfDial(conn, pings, size)
+	ret.Transport, ret.Setup = res.Transport, res.Setup
+	return ret, err
+}
+
+// TunnelResult is the cost of concurrent idle tunnels, each one counts its
+// relay and the responder echoing its data
+type TunnelResult struct {
+	Tunnels             int     `json:"tunnels"`
+	Setup               float64 `json:"setup_ms"`
+	Goroutines          int     `json:"goroutines"`
+	GoroutinesPerTunnel float64 `json:"goroutines_per_tunnel"`
+	MemoryPerTunnel     float64 `json:"memory_bytes_per_tunnel"`
+}
+
+// RunTunnels opens n tunnels at once and measures the goroutines and the
+// memory they hold once idle. The tunnels are relayed as the daemon relays
+// sessions: a TCP connection piped to its service, piped to the TCP
+// connection of the responder.
+func RunTunnels(n int) (TunnelResult, error) {
+	res := TunnelResult{Tunnels: n}
+	responder, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return res, err
+	}
+	defer responder.Close()
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return res, err
+	}
+	defer relay.Close()
+	go func() {
+		for {
+			conn, err := responder.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				utils.Copy(conn, conn, nil)
+				conn.Close()
+			}()
+		}
+	}()
+	go func() {
+		for {
+			in, err := relay.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				out, err := net.DialTimeout("tcp", responder.Addr().String(), perfSetupTimeout)
+				if err != nil {
+					in.Close()
+					return
+				}
+				s, c := net.Pipe()
+				go utils.Pipe(&c, &out)
+				utils.Pipe(&in, &s)
+			}()
+		}
+	}()
+
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+	conns := make([]net.Conn, 0, n)
+	defer func() {
+		for _, v := range conns {
+			v.Close()
+		}
+	}()
+	start := time.Now()
+	ping := make([]byte, perfPingSize)
+	for i := 0; i < n; i++ {
+		conn, err := net.DialTimeout("tcp", relay.Addr().String(), perfSetupTimeout)
+		if err != nil {
+			return res, fmt.Errorf("tunnel %d: %v, raise the limit of open files", i, err)
+		}
+		conns = append(conns, conn)
+		conn.SetDeadline(time.Now().Add(perfSetupTimeout))
+		_, err = conn.Write(ping)
+		if err == nil {
+			_, err = io.ReadFull(conn, ping)
+		}
+		if err != nil {
+			return res, fmt.Errorf("tunnel %d: %v", i, err)
+		}
+	}
+	res.Setup = milliseconds(time.Since(start))
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	res.Goroutines = runtime.NumGoroutine() - goroutines
+	if n > 0 {
+		res.GoroutinesPerTunnel = float64(res.Goroutines) / float64(n)
+		used := int64(after.HeapInuse+after.StackInuse) - int64(before.HeapInuse+before.StackInuse)
+		res.MemoryPerTunnel = float64(used) / float64(n)
+	}
+	return res, nil
+}
+
+// perfSignaling delivers signaling messages between the nodes of a
+// measurement through memory, encoded and decoded as the daemon does
+type perfSignaling struct {
+	inbox map[string]chan types.SignalingInfo
+	done  chan struct{}
+}
+
+func newPerfSignaling(ids ...string) *perfSignaling {
+	ret := &perfSignaling{
+		inbox: make(map[string]chan types.SignalingInfo),
+		done:  make(chan struct{}),
+	}
+	for _, v := range ids {
+		ret.inbox[v] = make(chan types.SignalingInfo, 128)
+	}
+	return ret
+}
+
+func (ps *perfSignaling) push(info types.SignalingInfo) {
+	buf := bytes.NewBuffer(nil)
+	err := types.WriteSignalingInfo(buf, &info)
+	if err == nil {
+		info, err = types.DecodeSignalingInfo(buf)
+	}
+	if err != nil {
+		logrus.Error("perf signaling ", err)
+		return
+	}
+	select {
+	case ps.inbox[info.Target] <- info:
+	case <-ps.done:
+	}
+}
+
+func (ps *perfSignaling) Close() {
+	close(ps.done)
+}
+
+// perfPeer is a node of a WebRTC measurement
+type perfPeer struct {
+	id     string
+	peerId string
+	pc     *webrtc.PeerConnection
+	sealed *sealedChannel
+	// data reads the opened messages of the data channel
+	data   *io.PipeReader
+	dataW  *io.PipeWriter
+	opened chan *webrtc.DataChannel
+}
+
+func newPerfPeer(id, peerId string, sealed *sealedChannel) (*perfPeer, error) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	return &perfPeer{
+		id:     id,
+		peerId: peerId,
+		pc:     pc,
+		sealed: sealed,
+		data:   pr,
+		dataW:  pw,
+		opened: make(chan *webrtc.DataChannel, 1),
+	}, nil
+}
+
+// serve wires a data channel to the pipe of the peer
+func (pp *perfPeer) serve(dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		pp.opened <- dc
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		data := msg.Data
+		if pp.sealed != nil {
+			var err error
+			data, err = pp.sealed.Open(data)
+			if err != nil {
+				pp.dataW.CloseWithError(err)
+				return
+			}
+		}
+		pp.dataW.Write(data)
+	})
+	dc.OnClose(func() {
+		pp.dataW.CloseWithError(io.ErrClosedPipe)
+	})
+}
+
+// signal trickles the candidates of the peer and serves the messages of
+// the other one until the signaling is closed
+func (pp *perfPeer) signal(ps *perfSignaling) {
+	pp.pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		ps.push(types.SignalingInfo{
+			Flag:      types.SIG_TYPE_CANDIDATE,
+			Source:    pp.id,
+			Target:    pp.peerId,
+			Candidate: []byte(c.ToJSON().Candidate),
+		})
+	})
+	go func() {
+		// candidates may come before the description they belong to
+		var pending []webrtc.ICECandidateInit
+		for {
+			var info types.SignalingInfo
+			select {
+			case info = <-ps.inbox[pp.id]:
+			case <-ps.done:
+				return
+			}
+			var err error
+			switch info.Flag {
+			case types.SIG_TYPE_OFFER:
+				err = pp.answer(ps, info)
+			case types.SIG_TYPE_ANSWER:
+				err = pp.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: info.SDP})
+			case types.SIG_TYPE_CANDIDATE:
+				pending = append(pending, webrtc.ICECandidateInit{Candidate: string(info.Candidate)})
+			}
+			if err != nil {
+				logrus.Error("perf signaling ", err)
+				continue
+			}
+			if pp.pc.RemoteDescription() == nil {
+				continue
+			}
+			for _, v := range pending {
+				err = pp.pc.AddICECandidate(v)
+				if err != nil {
+					logrus.Debug("perf candidate ", err)
+				}
+			}
+			pending = pending[:0]
+		}
+	}()
+}
+
+func (pp *perfPeer) offer(ps *perfSignaling) error {
+	offer, err := pp.pc.CreateOffer(nil)
+	if err == nil {
+		err = pp.pc.SetLocalDescription(offer)
+	}
+	if err != nil {
+		return err
+	}
+	ps.push(types.SignalingInfo{Flag: types.SIG_TYPE_OFFER, Source: pp.id, Target: pp.peerId, SDP: offer.SDP})
+	return nil
+}
+
+func (pp *perfPeer) answer(ps *perfSignaling, info types.SignalingInfo) error {
+	err := pp.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: info.SDP})
+	if err != nil {
+		return err
+	}
+	answer, err := pp.pc.CreateAnswer(nil)
+	if err == nil {
+		err = pp.pc.SetLocalDescription(answer)
+	}
+	if err != nil {
+		return err
+	}
+	ps.push(types.SignalingInfo{Flag: types.SIG_TYPE_ANSWER, Source: pp.id, Target: pp.peerId, SDP: answer.SDP})
+	return nil
+}
+
+func (pp *perfPeer) Close() {
+	pp.pc.Close()
+	pp.dataW.CloseWithError(io.ErrClosedPipe)
+}
+
+// newPerfSeals returns the sealing of the dialer and of the responder,
+// their keys are random as the key exchange would pin the keys of the
+// nodes of the measurement
+func newPerfSeals() (*sealedChannel, *sealedChannel, error) {
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	_, err := rand.Read(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	toResponder, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	toDialer, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return e2e.NewChannel(toResponder, toDialer), e2e.NewChannel(toDialer, toResponder), nil
+}
+
+// perfWebRTC measures a data channel between two peer connections, the
+// setup includes the signaling and the ICE, DTLS and SCTP handshakes
+func perfWebRTC(sealed bool, pings int, size int64) (PerfResult, error) {
+	res := PerfResult{Transport: PERF_WEBRTC_PLAIN}
+	var dialSeal, respondSeal *sealedChannel
+	if sealed {
+		res.Transport = PERF_WEBRTC
+		var err error
+		dialSeal, respondSeal, err = newPerfSeals()
+		if err != nil {
+			return res, err
+		}
+	}
+	ps := newPerfSignaling("perf-dialer", "perf-responder")
+	defer ps.Close()
+
+	start := time.Now()
+	dialer, err := newPerfPeer("perf-dialer", "perf-responder", dialSeal)
+	if err != nil {
+		return res, err
+	}
+	defer dialer.Close()
+	responder, err := newPerfPeer("perf-responder", "perf-dialer", respondSeal)
+	if err != nil {
+		return res, err
+	}
+	defer responder.Close()
+	responder.pc.OnDataChannel(responder.serve)
+	dc, err := dialer.pc.CreateDataChannel("perf", nil)
+	if err != nil {
+		return res, err
+	}
+	dialer.serve(dc)
+	dialer.signal(ps)
+	responder.signal(ps)
+	err = dialer.offer(ps)
+	if err != nil {
+		return res, err
+	}
+
+	var dialDC, respondDC *webrtc.DataChannel
+	timeout := time.After(perfSetupTimeout)
+	for dialDC == nil || respondDC == nil {
+		select {
+		case dialDC = <-dialer.opened:
+		case respondDC = <-responder.opened:
+		case <-timeout:
+			return res, fmt.Errorf("no data channel after %v, the device needs a network interface other than loopback", perfSetupTimeout)
+		}
+	}
+	res.Setup = milliseconds(time.Since(start))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := perfRespond(responder.data, NewWrapper(respondDC, respondSeal, nil), pings, size)
+		if err != nil {
+			logrus.Debug("perf responder ", err)
+		}
+	}()
+	stop := time.AfterFunc(perfTimeout, func() {
+		dialer.Close()
+		responder.Close()
+	})
+	defer stop.Stop()
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{dialer.data, NewWrapper(dialDC, dialSeal, nil)}
+	ret, err := perfDial(rw, pings, size)
+	ret.Transport, ret.Setup = res.Transport, res.Setup
+	responder.Close()
+	wg.Wait()
+	return ret, err
+}
@@ -0,0 +1,73 @@
+package conn
+
+import "testing"
+
+const (
+	// perfChunk is the data each iteration of the throughput benchmarks sends
+	perfChunk = 32 << 10
+	// perfTunnels are opened by each iteration of BenchmarkTunnels, below
+	// the default limit of open files
+	perfTunnels = 100
+)
+
+// perfFailed skips the WebRTC benchmarks on devices with no interface other
+// than loopback, a direct link always works
+func perfFailed(b *testing.B, transport string, err error) {
+	if transport == PERF_DIRECT {
+		b.Fatal(err)
+	}
+	b.Skip(err)
+}
+
+func benchmarkThroughput(b *testing.B, transport string) {
+	b.SetBytes(perfChunk)
+	b.ResetTimer()
+	res, err := RunPerf(transport, 0, int64(b.N)*perfChunk)
+	if err != nil {
+		perfFailed(b, transport, err)
+	}
+	b.ReportMetric(res.Setup, "setup-ms")
+}
+
+func benchmarkRTT(b *testing.B, transport string) {
+	b.ResetTimer()
+	res, err := RunPerf(transport, b.N, 0)
+	if err != nil {
+		perfFailed(b, transport, err)
+	}
+	b.ReportMetric(res.RTTMedian, "rtt-median-ms")
+	b.ReportMetric(res.RTTP99, "rtt-p99-ms")
+}
+
+func BenchmarkDirectThroughput(b *testing.B) {
+	benchmarkThroughput(b, PERF_DIRECT)
+}
+
+func BenchmarkDirectRTT(b *testing.B) {
+	benchmarkRTT(b, PERF_DIRECT)
+}
+
+func BenchmarkWebRTCThroughput(b *testing.B) {
+	benchmarkThroughput(b, PERF_WEBRTC)
+}
+
+func BenchmarkWebRTCPlainThroughput(b *testing.B) {
+	benchmarkThroughput(b, PERF_WEBRTC_PLAIN)
+}
+
+func BenchmarkWebRTCRTT(b *testing.B) {
+	benchmarkRTT(b, PERF_WEBRTC)
+}
+
+func BenchmarkTunnels(b *testing.B) {
+	var res TunnelResult
+	for i := 0; i < b.N; i++ {
+		var err error
+		res, err = RunTunnels(perfTunnels)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(res.GoroutinesPerTunnel, "goroutines/tunnel")
+	b.ReportMetric(res.MemoryPerTunnel, "B/tunnel")
+}
@@ -0,0 +1,140 @@
+package conn
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/portmap"
+)
+
+const (
+	// endpointTTL is the time the public address a peer sent is used
+	endpointTTL = time.Hour
+
+	// portMapRetry is the time between two attempts to map the port of the
+	// direct service when the router didn't
+	portMapRetry = 5 * time.Minute
+)
+
+// publicEndpoints are the public addresses of direct services: the one of
+// this device, mapped on its router, and the ones peers sent
+type publicEndpoints struct {
+	lock  sync.Mutex
+	self  string
+	dial  bool
+	peers map[string]peerEndpoint
+}
+
+type peerEndpoint struct {
+	addr string
+	seen time.Time
+}
+
+var endpoints = &publicEndpoints{
+	peers: make(map[string]peerEndpoint),
+}
+
+// Self returns the public address of the direct service of this device,
+// empty if its port isn't mapped
+func (pe *publicEndpoints) Self() string {
+	pe.lock.Lock()
+	defer pe.lock.Unlock()
+	return pe.self
+}
+
+func (pe *publicEndpoints) setSelf(addr string) {
+	pe.lock.Lock()
+	defer pe.lock.Unlock()
+	pe.self = addr
+}
+
+// setDial makes Address return the addresses peers sent
+func (pe *publicEndpoints) setDial(dial bool) {
+	pe.lock.Lock()
+	defer pe.lock.Unlock()
+	pe.dial = dial
+}
+
+// learn keeps the public address a peer sent in a verified signaling
+// message
+func (pe *publicEndpoints) learn(id, addr string) {
+	if addr == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		logrus.Warn("invalid endpoint ", addr, " of ", id)
+		return
+	}
+	pe.lock.Lock()
+	defer pe.lock.Unlock()
+	pe.peers[id] = peerEndpoint{addr: addr, seen: time.Now()}
+}
+
+// Address returns the public address of the direct service of a peer,
+// empty if it sent none lately or dialing them is disabled
+func (pe *publicEndpoints) Address(id string) string {
+	pe.lock.Lock()
+	defer pe.lock.Unlock()
+	ep, ok := pe.peers[id]
+	if !pe.dial || !ok {
+		return ""
+	}
+	if time.Since(ep.seen) > endpointTTL {
+		delete(pe.peers, id)
+		return ""
+	}
+	return ep.addr
+}
+
+// mapPort keeps a port of the router mapped to the direct service until
+// stop is closed, then removes it
+func (ds *DirectService) mapPort(stop chan struct{}) {
+	pc := ds.pc
+	external := int(pc.ExternalPort)
+	if external == 0 {
+		external = directPort
+	}
+	lease := time.Duration(pc.Lease) * time.Second
+	var m *portmap.Mapping
+	for {
+		var err error
+		if m == nil {
+			m, err = portmap.Map(pc.Protocol, directPort, external, lease)
+		} else {
+			err = m.Renew()
+		}
+		wait := portMapRetry
+		if err != nil {
+			logrus.Warn("port mapping: ", err)
+			endpoints.setSelf("")
+			m = nil
+		} else {
+			if endpoints.Self() != m.Endpoint() {
+				logrus.Info("direct service mapped to ", m.Endpoint(), " with ", m.Protocol)
+			}
+			endpoints.setSelf(m.Endpoint())
+			// permanent mappings are checked as often as the lease asked
+			if m.Lease > 0 {
+				wait = m.Lease / 2
+			} else if lease > 0 {
+				wait = lease / 2
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			endpoints.setSelf("")
+			if m != nil {
+				err = m.Delete()
+				if err != nil {
+					logrus.Warn("remove port mapping: ", err)
+				}
+			}
+			return
+		case <-timer.C:
+		}
+	}
+}
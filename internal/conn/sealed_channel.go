@@ -0,0 +1,43 @@
+package conn
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/e2e"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+// sealedChannel encrypts the messages of a data channel, see e2e.Channel
+type sealedChannel = e2e.Channel
+
+// newKeyExchange makes the keys of a connection
+func newKeyExchange() (*impl.KeyExchange, error) {
+	return impl.NewKeyExchange(e2e.ConnectionHello)
+}
+
+// newSealedChannel returns the sealing of a connection with peerId from the
+// hello it sent, nil if the peer does not encrypt and AllowPlaintextPeers
+// is set
+func newSealedChannel(kx *impl.KeyExchange, peerHello []byte, peerId string, dialer bool) (*sealedChannel, error) {
+	if len(peerHello) == 0 {
+		cm, err := conf.Shared()
+		if err != nil {
+			return nil, err
+		}
+		if !cm.Conf.AllowPlaintextPeers {
+			return nil, fmt.Errorf("%s does not encrypt connections end to end", peerId)
+		}
+		if !cm.Conf.AllowUnpairedPeers && !impl.IsPaired(peerId) {
+			return nil, fmt.Errorf("%s is not paired, pair with 'sshx pair'", peerId)
+		}
+		logrus.Warn("connection with ", peerId, " is not encrypted end to end")
+		return nil, nil
+	}
+	send, recv, err := kx.Keys(peerHello, peerId, dialer, e2e.ConnectionLabel)
+	if err != nil {
+		return nil, err
+	}
+	return e2e.NewChannel(send, recv), nil
+}
@@ -1,8 +1,7 @@
 package conn
 
 import (
-	"encoding/gob"
-	"fmt"
+	"context"
 	"net"
 
 	"github.com/sirupsen/logrus"
@@ -10,19 +9,32 @@ import (
 	"github.com/suutaku/sshx/pkg/types"
 )
 
-// a connection service interface
+// ConnectionService is a transport the connection manager reaches peers
+// with, as direct TCP or WebRTC. The manager answers the local clients, a
+// service only sets up the connections of sessions and registers them as
+// pairs of the StatManager, which closes them. Services embed
+// BaseConnectionService and implement CreateConnection.
 type ConnectionService interface {
+	// Id returns the device ID of this node
+	Id() string
+	// Start serves the sessions peers open with this node
 	Start() error
-	SetStateManager(*StatManager) error
-	CreateConnection(*impl.Sender, net.Conn, types.PoolId) error
-	DestroyConnection(*impl.Sender) error
-	AttachConnection(*impl.Sender, net.Conn) error
-	ResponseTCP(*impl.Sender, net.Conn) error
-	IsReady() bool
+	// Stop stops serving, the open pairs are left to the StatManager
 	Stop()
-	GetPair(id string) Connection
-	WatchPairs()
-	Id() string
+	// IsReady reports whether the service can connect to peers
+	IsReady() bool
+	// SetStateManager sets where the pairs of the service are registered,
+	// before Start
+	SetStateManager(*StatManager) error
+	// SetKnockQueue sets where inbound sessions wait for approval
+	SetKnockQueue(*KnockQueue)
+	// CreateConnection connects the impl of sender to its host and
+	// registers the pair of poolId. sock is the stream of the local client
+	// unless sender.Detach is set. It returns once the pair is connected.
+	// ctx is done once the session isn't wanted anymore, as when the
+	// client hangs up or another service connected first, the service then
+	// gives up and closes what it set up. It isn't kept after the return.
+	CreateConnection(ctx context.Context, sender *impl.Sender, sock net.Conn, poolId types.PoolId) error
 }
 
 type CleanRequest struct {
@@ -36,6 +48,7 @@ type BaseConnectionService struct {
 	running   bool
 	CleanChan chan CleanRequest
 	id        string
+	knocks    *KnockQueue
 }
 
 func NewBaseConnectionService(id string) *BaseConnectionService {
@@ -49,9 +62,10 @@ func (base *BaseConnectionService) Id() string {
 	return base.id
 }
 
-func (base *BaseConnectionService) ResponseTCP(sender *impl.Sender, conn net.Conn) error {
+// respond answers the request of sender on conn
+func respond(sender *impl.Sender, conn net.Conn) error {
 	logrus.Debug("do Response TCP")
-	err := gob.NewEncoder(conn).Encode(sender)
+	err := sender.Encode(conn)
 	if err != nil {
 		logrus.Error(err)
 		return err
@@ -91,34 +105,13 @@ func (base *BaseConnectionService) SetStateManager(stm *StatManager) error {
 	return nil
 }
 
-func (base *BaseConnectionService) CreateConnection(sender *impl.Sender, conn net.Conn, poolId types.PoolId) error {
-	return nil
+// SetKnockQueue sets where inbound sessions wait for approval
+func (base *BaseConnectionService) SetKnockQueue(kq *KnockQueue) {
+	base.knocks = kq
 }
 
-// func (base *BaseConnectionService) DestroyConnection(tmp impl.Sender) error {
-// 	pair := base.GetPair(string(tmp.PairId))
-// 	if pair == nil {
-// 		return fmt.Errorf("cannot get pair for %s", string(tmp.PairId))
-// 	}
-// 	if pair.GetImpl().Code() == tmp.GetAppCode() {
-// 		base.RemovePair(string(tmp.PairId))
-// 	}
-// 	return nil
-// }
-
-func (base *BaseConnectionService) AttachConnection(sender *impl.Sender, sock net.Conn) error {
-	imp := sender.GetImpl()
-	pair := base.GetPair(string(sender.PairId))
-	if pair == nil {
-		return fmt.Errorf("cannot attach impl with id: %s", string(sender.PairId))
-	}
-	if impl.GetImplName(pair.GetImpl().Code()) != impl.GetImplName(imp.Code()) {
-		return fmt.Errorf("cannot impl type dismatch, except %s, got %s", impl.GetImplName(pair.GetImpl().Code()), impl.GetImplName(imp.Code()))
-	}
-	newSender := impl.NewSender(pair.GetImpl(), types.OPTION_TYPE_ATTACH)
-	logrus.Warn("replace impl for host id ", pair.GetImpl().HostId())
-	sender.Payload = newSender.Payload
-	return pair.GetImpl().Attach(sock)
+func (base *BaseConnectionService) CreateConnection(ctx context.Context, sender *impl.Sender, conn net.Conn, poolId types.PoolId) error {
+	return nil
 }
 
 func (base *BaseConnectionService) IsReady() bool {
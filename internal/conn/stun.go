@@ -0,0 +1,240 @@
+package conn
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// STUNHealth keeps the last checks of the STUN servers of the daemon
+type STUNHealth struct {
+	lock    sync.Mutex
+	servers map[string]types.STUNServer
+}
+
+func NewSTUNHealth() *STUNHealth {
+	return &STUNHealth{
+		servers: make(map[string]types.STUNServer),
+	}
+}
+
+// stunHealth is the STUN health of the daemon
+var stunHealth = NewSTUNHealth()
+
+// STUNServers returns the last checks of the STUN servers, the fastest
+// first
+func STUNServers() []types.STUNServer {
+	return stunHealth.Servers()
+}
+
+// isSTUN reports whether u is the URL of a STUN server
+func isSTUN(u string) bool {
+	u = strings.ToLower(u)
+	return strings.HasPrefix(u, "stun:") || strings.HasPrefix(u, "stuns:")
+}
+
+// stunAddr returns the host and port of a stun: or stuns: URL and whether
+// it is reached over TLS
+func stunAddr(u string) (string, bool, error) {
+	i := strings.Index(u, ":")
+	if i < 0 {
+		return "", false, fmt.Errorf("invalid STUN URL %q", u)
+	}
+	secure := strings.ToLower(u[:i]) == "stuns"
+	hostport := u[i+1:]
+	if j := strings.Index(hostport, "?"); j >= 0 {
+		hostport = hostport[:j]
+	}
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		port := "3478"
+		if secure {
+			port = "5349"
+		}
+		hostport = net.JoinHostPort(strings.Trim(hostport, "[]"), port)
+	}
+	return hostport, secure, nil
+}
+
+// ProbeSTUN sends a binding request to the STUN server of u and returns
+// the time it took to answer and the address of this node it saw
+func ProbeSTUN(u string, timeout time.Duration) (time.Duration, string, error) {
+	addr, secure, err := stunAddr(u)
+	if err != nil {
+		return 0, "", err
+	}
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	if err != nil {
+		return 0, "", err
+	}
+	start := time.Now()
+	var c net.Conn
+	if secure {
+		host, _, _ := net.SplitHostPort(addr)
+		c, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		c, err = net.DialTimeout("udp", addr, timeout)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	defer c.Close()
+	c.SetDeadline(start.Add(timeout))
+	_, err = c.Write(req.Raw)
+	if err != nil {
+		return 0, "", err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return 0, "", err
+		}
+		res := &stun.Message{Raw: buf[:n]}
+		if res.Decode() != nil || res.TransactionID != req.TransactionID {
+			// a late answer of another request, or not STUN at all
+			continue
+		}
+		rtt := time.Since(start)
+		if res.Type != stun.BindingSuccess {
+			return rtt, "", fmt.Errorf("answered %s", res.Type)
+		}
+		var xor stun.XORMappedAddress
+		if xor.GetFrom(res) != nil {
+			return rtt, "", nil
+		}
+		return rtt, xor.String(), nil
+	}
+}
+
+// Check probes the STUN servers of the ICE servers at once, and records
+// the servers which went up or down
+func (sh *STUNHealth) Check(servers []webrtc.ICEServer, timeout time.Duration) {
+	var urls []string
+	for _, s := range servers {
+		for _, u := range s.URLs {
+			if isSTUN(u) {
+				urls = append(urls, u)
+			}
+		}
+	}
+	results := make([]types.STUNServer, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			st := types.STUNServer{URL: u, Checked: time.Now()}
+			rtt, addr, err := ProbeSTUN(u, timeout)
+			if err != nil {
+				st.Error = err.Error()
+			} else {
+				st.Up, st.RTT, st.Address = true, rtt, addr
+			}
+			results[i] = st
+		}(i, u)
+	}
+	wg.Wait()
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	checked := make(map[string]types.STUNServer, len(results))
+	for _, st := range results {
+		prev, known := sh.servers[st.URL]
+		if known && prev.Up != st.Up || !known && !st.Up {
+			msg := "up, " + st.RTT.Round(time.Millisecond).String()
+			if !st.Up {
+				msg = "down: " + st.Error
+				logrus.Warn("STUN server ", st.URL, " is ", msg)
+			} else {
+				logrus.Info("STUN server ", st.URL, " is ", msg)
+			}
+			RecordEvent(types.Event{Time: st.Checked, Kind: types.EVENT_STUN, Message: st.URL + " is " + msg})
+		}
+		checked[st.URL] = st
+	}
+	sh.servers = checked
+}
+
+// Servers returns the last checks, the servers which are up first from the
+// fastest, then the others in the order of their URLs
+func (sh *STUNHealth) Servers() []types.STUNServer {
+	sh.lock.Lock()
+	ret := make([]types.STUNServer, 0, len(sh.servers))
+	for _, v := range sh.servers {
+		ret = append(ret, v)
+	}
+	sh.lock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Up != ret[j].Up {
+			return ret[i].Up
+		}
+		if ret[i].Up && ret[i].RTT != ret[j].RTT {
+			return ret[i].RTT < ret[j].RTT
+		}
+		return ret[i].URL < ret[j].URL
+	})
+	return ret
+}
+
+// Select returns a copy of config whose STUN servers which are down are
+// left out and the others ordered from the fastest. Servers not checked
+// yet come after the ones which are up, and every server is kept if none
+// is up. TURN servers are kept as they are.
+func (sh *STUNHealth) Select(config webrtc.Configuration) webrtc.Configuration {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	anyUp := false
+	for _, v := range sh.servers {
+		anyUp = anyUp || v.Up
+	}
+	if !anyUp {
+		return config
+	}
+	// rank returns the time u took to answer, and false if it is down
+	rank := func(u string) (time.Duration, bool) {
+		st, ok := sh.servers[u]
+		if !ok {
+			return time.Duration(math.MaxInt64), true
+		}
+		return st.RTT, st.Up
+	}
+	var stuns []string
+	var others []webrtc.ICEServer
+	for _, s := range config.ICEServers {
+		var urls []string
+		for _, u := range s.URLs {
+			if !isSTUN(u) {
+				urls = append(urls, u)
+				continue
+			}
+			if _, ok := rank(u); ok {
+				stuns = append(stuns, u)
+			}
+		}
+		if len(urls) > 0 {
+			s.URLs = urls
+			others = append(others, s)
+		}
+	}
+	sort.SliceStable(stuns, func(i, j int) bool {
+		ri, _ := rank(stuns[i])
+		rj, _ := rank(stuns[j])
+		return ri < rj
+	})
+	ret := config
+	ret.ICEServers = nil
+	for _, u := range stuns {
+		ret.ICEServers = append(ret.ICEServers, webrtc.ICEServer{URLs: []string{u}})
+	}
+	ret.ICEServers = append(ret.ICEServers, others...)
+	return ret
+}
@@ -0,0 +1,283 @@
+package conn
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+type transferEntry struct {
+	state    types.TransferState
+	bytes    int64
+	canceled bool
+	admitted chan struct{}
+	conn     net.Conn
+	limiter  *utils.RateLimiter
+}
+
+// chunk size used to pace rate limited transfers
+const transferPace = 16 * 1024
+
+// keep track of local transfers, limit how many run at the same time
+// and allow to pause, resume or cancel them
+type TransferManager struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	active  int
+	entries map[string]*transferEntry
+	queue   []*transferEntry
+	// limiter is shared by all transfers
+	limiter *utils.RateLimiter
+}
+
+func NewTransferManager(limit int) *TransferManager {
+	ret := &TransferManager{
+		limit:   limit,
+		entries: make(map[string]*transferEntry),
+		limiter: utils.NewRateLimiter(0),
+	}
+	ret.cond = sync.NewCond(&ret.lock)
+	return ret
+}
+
+// SetLimit changes the maximum number of concurrent transfers, 0 means unlimited
+func (tm *TransferManager) SetLimit(limit int) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	tm.limit = limit
+	tm.schedule()
+}
+
+// SetRateLimit caps the total throughput of all transfers in bytes per second,
+// 0 means unlimited
+func (tm *TransferManager) SetRateLimit(rate int64) {
+	tm.limiter.SetRate(rate)
+}
+
+func isTransfer(imp impl.Impl) (name string, upload bool, rate int64, ok bool) {
+	switch v := imp.(type) {
+	case *impl.Transfer:
+		name = v.FilePath
+		if v.FileName != "" {
+			name = v.FileName
+		}
+		return filepath.Base(name), v.Upload, v.RateLimit, true
+	case *impl.Sync:
+		return filepath.Base(v.LocalPath), true, v.RateLimit, true
+	}
+	return "", false, 0, false
+}
+
+// Track registers a transfer request, returns nil for other applications
+func (tm *TransferManager) Track(imp impl.Impl, pairId string) *transferEntry {
+	name, upload, rate, ok := isTransfer(imp)
+	if !ok {
+		return nil
+	}
+	entry := &transferEntry{
+		state: types.TransferState{
+			PairId:    pairId,
+			TargetId:  imp.HostId(),
+			FileName:  name,
+			Upload:    upload,
+			State:     types.TRANSFER_STATE_QUEUED,
+			StartTime: time.Now(),
+		},
+		admitted: make(chan struct{}),
+	}
+	if rate > 0 {
+		entry.limiter = utils.NewRateLimiter(rate)
+	}
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	tm.entries[pairId] = entry
+	tm.queue = append(tm.queue, entry)
+	tm.schedule()
+	return entry
+}
+
+// start queued transfers while there are free slots, must hold the lock
+func (tm *TransferManager) schedule() {
+	for len(tm.queue) > 0 && (tm.limit <= 0 || tm.active < tm.limit) {
+		entry := tm.queue[0]
+		tm.queue = tm.queue[1:]
+		tm.active++
+		entry.state.State = types.TRANSFER_STATE_ACTIVE
+		close(entry.admitted)
+	}
+}
+
+// Wait blocks until the transfer is allowed to start, false if it was canceled
+func (tm *TransferManager) Wait(entry *transferEntry) bool {
+	<-entry.admitted
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	return !entry.canceled
+}
+
+// Wrap returns a connection which accounts and gates the traffic of a transfer
+func (tm *TransferManager) Wrap(entry *transferEntry, conn net.Conn) net.Conn {
+	tm.lock.Lock()
+	entry.conn = conn
+	tm.lock.Unlock()
+	return &transferConn{
+		Conn:  conn,
+		entry: entry,
+		tm:    tm,
+	}
+}
+
+func (tm *TransferManager) finish(entry *transferEntry) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	if tm.entries[entry.state.PairId] != entry {
+		return
+	}
+	delete(tm.entries, entry.state.PairId)
+	select {
+	case <-entry.admitted:
+		tm.active--
+	default:
+	}
+	tm.cond.Broadcast()
+	tm.schedule()
+	logrus.Debug("transfer finished ", entry.state.PairId)
+}
+
+// wait while a transfer is paused, false if it was canceled meanwhile
+func (tm *TransferManager) gate(entry *transferEntry) bool {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	for entry.state.State == types.TRANSFER_STATE_PAUSED && !entry.canceled {
+		tm.cond.Wait()
+	}
+	return !entry.canceled
+}
+
+func (tm *TransferManager) List() []types.TransferState {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	ret := make([]types.TransferState, 0, len(tm.entries))
+	for _, v := range tm.entries {
+		state := v.state
+		state.Bytes = atomic.LoadInt64(&v.bytes)
+		ret = append(ret, state)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].StartTime.Before(ret[j].StartTime)
+	})
+	return ret
+}
+
+func (tm *TransferManager) Pause(pairId string, pause bool) error {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	entry := tm.entries[pairId]
+	if entry == nil {
+		return fmt.Errorf("no transfer with id %s", pairId)
+	}
+	if pause && entry.state.State == types.TRANSFER_STATE_ACTIVE {
+		entry.state.State = types.TRANSFER_STATE_PAUSED
+	} else if !pause && entry.state.State == types.TRANSFER_STATE_PAUSED {
+		entry.state.State = types.TRANSFER_STATE_ACTIVE
+		tm.cond.Broadcast()
+	} else {
+		return fmt.Errorf("transfer %s cannot be paused or resumed in current state", pairId)
+	}
+	return nil
+}
+
+// Cancel stops a queued or running transfer, false if pairId is unknown
+func (tm *TransferManager) Cancel(pairId string) bool {
+	tm.lock.Lock()
+	entry := tm.entries[pairId]
+	if entry == nil {
+		tm.lock.Unlock()
+		return false
+	}
+	entry.canceled = true
+	for i, v := range tm.queue {
+		if v == entry {
+			tm.queue = append(tm.queue[:i], tm.queue[i+1:]...)
+			delete(tm.entries, pairId)
+			close(entry.admitted)
+			break
+		}
+	}
+	tm.cond.Broadcast()
+	conn := entry.conn
+	tm.lock.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	logrus.Debug("transfer canceled ", pairId)
+	return true
+}
+
+type transferConn struct {
+	net.Conn
+	entry *transferEntry
+	tm    *TransferManager
+	once  sync.Once
+}
+
+func (tc *transferConn) limited() bool {
+	return tc.entry.limiter != nil || tc.tm.limiter.Rate() > 0
+}
+
+func (tc *transferConn) wait(n int) {
+	tc.entry.limiter.Wait(n)
+	tc.tm.limiter.Wait(n)
+}
+
+func (tc *transferConn) Read(b []byte) (int, error) {
+	if !tc.tm.gate(tc.entry) {
+		return 0, fmt.Errorf("transfer canceled")
+	}
+	if len(b) > transferPace && tc.limited() {
+		b = b[:transferPace]
+	}
+	n, err := tc.Conn.Read(b)
+	atomic.AddInt64(&tc.entry.bytes, int64(n))
+	tc.wait(n)
+	return n, err
+}
+
+func (tc *transferConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if !tc.tm.gate(tc.entry) {
+			return written, fmt.Errorf("transfer canceled")
+		}
+		part := b
+		if len(part) > transferPace && tc.limited() {
+			part = part[:transferPace]
+		}
+		tc.wait(len(part))
+		n, err := tc.Conn.Write(part)
+		atomic.AddInt64(&tc.entry.bytes, int64(n))
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (tc *transferConn) Close() error {
+	tc.once.Do(func() {
+		tc.tm.finish(tc.entry)
+	})
+	return tc.Conn.Close()
+}
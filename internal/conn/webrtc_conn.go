@@ -3,43 +3,131 @@ package conn
 import (
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"reflect"
+	"sync/atomic"
 	"time"
 
+	"github.com/suutaku/sshx/internal/e2e"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 
 	"github.com/pion/webrtc/v3"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
+// Writes to a data channel block once highWaterMark bytes are queued, and
+// resume when SCTP brought the queue down to lowWaterMark
+const (
+	highWaterMark = 4 << 20
+	lowWaterMark  = 1 << 20
+)
+
+// maxMessageSize is the largest data a message carries, peers take
+// messages of 65535 bytes once sealed
+const maxMessageSize = math.MaxUint16 - 8 - chacha20poly1305.Overhead
+
 type Wrapper struct {
 	*webrtc.DataChannel
+	sealed *sealedChannel
+	// sent counts the bytes written
+	sent *int64
+	// resume is signaled when the queue of the channel is low
+	resume chan struct{}
+}
+
+// NewWrapper returns the writer of a data channel, the data is sealed if
+// sealed is not nil
+func NewWrapper(dc *webrtc.DataChannel, sealed *sealedChannel, sent *int64) *Wrapper {
+	ret := &Wrapper{
+		DataChannel: dc,
+		sealed:      sealed,
+		sent:        sent,
+		resume:      make(chan struct{}, 1),
+	}
+	dc.SetBufferedAmountLowThreshold(lowWaterMark)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case ret.resume <- struct{}{}:
+		default:
+		}
+	})
+	return ret
+}
+
+// wait blocks while the queue of the channel is above highWaterMark
+func (s *Wrapper) wait() error {
+	for s.DataChannel.BufferedAmount() > highWaterMark {
+		if s.DataChannel.ReadyState() != webrtc.DataChannelStateOpen {
+			return io.ErrClosedPipe
+		}
+		// a closing channel never gets low, its state is checked again
+		select {
+		case <-s.resume:
+		case <-time.After(time.Second):
+		}
+	}
+	return nil
 }
 
 func (s *Wrapper) Write(b []byte) (int, error) {
-	err := s.DataChannel.Send(b)
+	err := s.wait()
+	if err != nil {
+		return 0, err
+	}
+	msg := b
+	if s.sealed != nil {
+		msg = s.sealed.Seal(b)
+	}
+	err = s.DataChannel.Send(msg)
+	if err == nil && s.sent != nil {
+		atomic.AddInt64(s.sent, int64(len(b)))
+	}
 	return len(b), err
 }
 
 type WebRTC struct {
 	BaseConnection
 	*webrtc.PeerConnection
-	conf    webrtc.Configuration
-	stmChan *chan CleanRequest
+	conf webrtc.Configuration
+	// outbound is the proxy of TURN connections over TCP
+	outbound *utils.OutboundProxy
+	stmChan  *chan CleanRequest
+	// kx makes the keys of the end-to-end encryption
+	kx *impl.KeyExchange
+	// sealed encrypts the data channel once the peer sent its hello
+	sealed *sealedChannel
+	// knocks holds inbound sessions until they are approved
+	knocks *KnockQueue
+	// responded is closed once the impl of a responder is ready for data,
+	// or failed with respondErr
+	responded  chan struct{}
+	respondErr error
 }
 
-func NewWebRTC(conf webrtc.Configuration, impl impl.Impl, nodeId string, targetId string, poolId types.PoolId, direct int32, stmChan *chan CleanRequest) *WebRTC {
-	pc, err := webrtc.NewPeerConnection(conf)
+func NewWebRTC(conf webrtc.Configuration, outbound *utils.OutboundProxy, impl impl.Impl, nodeId string, targetId string, poolId types.PoolId, direct int32, stmChan *chan CleanRequest) *WebRTC {
+	pc, err := NewPeerConnection(conf, outbound)
 	if err != nil {
 		logrus.Error("rtc error:", err)
 		return nil
 	}
+	kx, err := newKeyExchange()
+	if err != nil {
+		logrus.Error("key exchange error:", err)
+		pc.Close()
+		return nil
+	}
 	ret := &WebRTC{
 		PeerConnection: pc,
 		conf:           conf,
+		outbound:       outbound,
 		BaseConnection: *NewBaseConnection(impl, nodeId, targetId, poolId, direct, impl.Code()),
 		stmChan:        stmChan,
+		kx:             kx,
 	}
 	ret.impl.SetPairId(poolId.String(ret.Direction()))
 	return ret
@@ -55,50 +143,70 @@ func (pair *WebRTC) Name() string {
 
 // create responser
 func (pair *WebRTC) Response() error {
-	logrus.Debug("pair response")
-	peer, err := webrtc.NewPeerConnection(pair.conf)
+	pair.log().Debug("pair response")
+	peer, err := NewPeerConnection(pair.conf, pair.outbound)
 	if err != nil {
 		pair.Exit <- err
-		logrus.Print(err)
+		pair.log().Print(err)
 		pair.Close()
 		return err
 	}
+	pair.responded = make(chan struct{})
 	peer.OnDataChannel(func(dc *webrtc.DataChannel) {
 		//dc.Lock()
 		dc.OnOpen(func() {
-			err := pair.BaseConnection.Response()
+			err := admit(pair.knocks, pair.targetId, remoteAddress(peer), pair.impl)
+			pair.path, pair.candidate = selectedPath(peer)
+			if pr, ok := pair.impl.(impl.PathReporter); ok && err == nil {
+				pr.SetPath(pair.path)
+			}
+			if err == nil {
+				err = pair.BaseConnection.Response()
+			}
+			pair.respondErr = err
+			close(pair.responded)
 			if err != nil {
-				logrus.Error(err)
+				pair.log().Error(err)
 				pair.Exit <- err
 				pair.Close()
 				return
 			}
 			pair.Exit <- err
 			pair.Ready()
-			logrus.Info("data channel open 2")
-			n, err := io.Copy(&Wrapper{dc}, pair.impl.Reader())
+			pair.log().Info("data channel open 2")
+			n, err := pair.send(dc)
 			for dc.BufferedAmount() > 0 {
 				time.Sleep(100 * time.Millisecond)
 			}
-			logrus.Info("trans2 ", n, err)
+			pair.log().Info("trans2 ", n, err)
 			pair.Exit <- fmt.Errorf("io copy break")
 			dc.Close()
 			pair.Close()
 		})
 		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			// data waits until the session is approved
+			<-pair.responded
+			if pair.respondErr != nil {
+				return
+			}
 			if pair.impl == nil {
 				pair.Close()
 				return
 			}
-			_, err := pair.impl.Writer().Write(msg.Data)
+			data, err := pair.openMessage(msg.Data)
 			if err != nil {
-				logrus.Error("sock write failed:", err)
+				return
+			}
+			atomic.AddInt64(&pair.bytesIn, int64(len(data)))
+			_, err = pair.impl.Writer().Write(data)
+			if err != nil {
+				pair.log().Error("sock write failed:", err)
 				pair.Close()
 				return
 			}
 		})
 		dc.OnClose(func() {
-			logrus.Debug("data channel close 2")
+			pair.log().Debug("data channel close 2")
 			pair.Exit <- nil
 			pair.Close()
 		})
@@ -108,69 +216,224 @@ func (pair *WebRTC) Response() error {
 	return nil
 }
 
+// bulkApp reports whether the data of an app is sent in large messages,
+// its throughput matters more than the latency of its writes
+func bulkApp(code int32) bool {
+	switch code {
+	case types.APP_TYPE_TRANSFER, types.APP_TYPE_SYNC, types.APP_TYPE_SCP:
+		return true
+	}
+	return false
+}
+
+// send copies the data of the impl to the data channel. Bulk apps send
+// messages of TransferConf.MessageSize, their reads wait
+// TransferConf.BatchDelay for more data to fill the message.
+func (pair *WebRTC) send(dc *webrtc.DataChannel) (int64, error) {
+	w := NewWrapper(dc, pair.sealed, &pair.bytesOut)
+	if !bulkApp(pair.impl.Code()) {
+		return utils.Copy(w, pair.impl.Reader(), nil)
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return 0, err
+	}
+	tc := cm.Conf.TransferConf
+	size := tc.MessageSize
+	if size <= 0 || size > maxMessageSize {
+		size = maxMessageSize
+	}
+	return batchCopy(w, pair.impl.Reader(), size, time.Duration(tc.BatchDelay)*time.Millisecond)
+}
+
+// batchCopy copies src to dst in writes of size bytes at most. Reads
+// shorter than size are followed by more reads for delay, if src has read
+// deadlines, so small writes of src go out together.
+func batchCopy(dst io.Writer, src io.Reader, size int, delay time.Duration) (int64, error) {
+	dl, batch := src.(interface{ SetReadDeadline(time.Time) error })
+	batch = batch && delay > 0
+	buf := make([]byte, size)
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if batch && err == nil && n < size {
+			dl.SetReadDeadline(time.Now().Add(delay))
+			for n < size && err == nil {
+				var m int
+				m, err = src.Read(buf[n:])
+				n += m
+			}
+			dl.SetReadDeadline(time.Time{})
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				err = nil
+			}
+		}
+		if n > 0 {
+			_, werr := dst.Write(buf[:n])
+			written += int64(n)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// selectedPath describes the candidate pair ICE selected, as
+// "srflx udp 1.2.3.4:5000 -> relay udp 5.6.7.8:3478", and its least direct
+// candidate type
+func selectedPath(pc *webrtc.PeerConnection) (string, string) {
+	sctp := pc.SCTP()
+	if sctp == nil || sctp.Transport() == nil {
+		return "unknown", ""
+	}
+	cp, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || cp == nil {
+		return "unknown", ""
+	}
+	path := fmt.Sprintf("%s %s %s:%d -> %s %s %s:%d",
+		cp.Local.Typ, cp.Local.Protocol, cp.Local.Address, cp.Local.Port,
+		cp.Remote.Typ, cp.Remote.Protocol, cp.Remote.Address, cp.Remote.Port)
+	return path, candidateType(cp.Local.Typ, cp.Remote.Typ)
+}
+
+// remoteAddress returns the address of the remote candidate ICE selected
+func remoteAddress(pc *webrtc.PeerConnection) string {
+	sctp := pc.SCTP()
+	if sctp == nil || sctp.Transport() == nil {
+		return ""
+	}
+	cp, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || cp == nil {
+		return ""
+	}
+	return cp.Remote.Address
+}
+
+// candidateType returns relay if either end is relayed, srflx if either end
+// is behind a NAT, host otherwise
+func candidateType(local, remote webrtc.ICECandidateType) string {
+	switch {
+	case local == webrtc.ICECandidateTypeRelay || remote == webrtc.ICECandidateTypeRelay:
+		return webrtc.ICECandidateTypeRelay.String()
+	case local != webrtc.ICECandidateTypeHost || remote != webrtc.ICECandidateTypeHost:
+		return webrtc.ICECandidateTypeSrflx.String()
+	}
+	return webrtc.ICECandidateTypeHost.String()
+}
+
+// dataChannelInit returns the data channel options of an impl, audio frames
+// are useless once late so they are neither ordered nor retransmitted
+func dataChannelInit(iface impl.Impl) *webrtc.DataChannelInit {
+	if iface.Code() != types.APP_TYPE_AUDIO {
+		return nil
+	}
+	ordered := false
+	retransmits := uint16(0)
+	return &webrtc.DataChannelInit{
+		Ordered:        &ordered,
+		MaxRetransmits: &retransmits,
+	}
+}
+
 // create dialer
 func (pair *WebRTC) Dial() error {
-	logrus.Debug("pair dial")
-	peer, err := webrtc.NewPeerConnection(pair.conf)
+	pair.log().Debug("pair dial")
+	peer, err := NewPeerConnection(pair.conf, pair.outbound)
 	if err != nil {
-		logrus.Error(err)
+		pair.log().Error(err)
 		return err
 	}
-	dc, err := peer.CreateDataChannel("data", nil)
+	dc, err := peer.CreateDataChannel("data", dataChannelInit(pair.impl))
 	if err != nil {
 		pair.Close()
 		return err
 	}
 	go func() {
 		for !pair.IsReady() {
-			time.Sleep(100 * time.Millisecond)
+			select {
+			case <-pair.Context().Done():
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
 		}
 		err := pair.BaseConnection.Dial()
 		if err != nil {
-			logrus.Error(err)
+			pair.log().Error(err)
 			pair.Exit <- err
 			dc.Close()
 			pair.Close()
 		}
 	}()
 	dc.OnOpen(func() {
-		logrus.Info("data channel open 1")
+		pair.log().Info("data channel open 1")
+		pair.path, pair.candidate = selectedPath(peer)
 		pair.Exit <- nil
 		pair.Ready()
 		// hangs
-		n, err := io.Copy(&Wrapper{dc}, pair.impl.Reader())
+		n, err := pair.send(dc)
 		if err != nil {
-			logrus.Error(err)
+			pair.log().Error(err)
 		}
 		for dc.BufferedAmount() > 0 {
 			time.Sleep(100 * time.Millisecond)
 		}
-		logrus.Info("trans1 ", n, err)
+		pair.log().Info("trans1 ", n, err)
 		pair.Exit <- err
 		dc.Close()
 		pair.Close()
-		logrus.Info("data channel close 1")
+		pair.log().Info("data channel close 1")
 	})
 	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
 		if pair.impl == nil {
 			pair.Close()
 			return
 		}
-		_, err := pair.impl.Writer().Write(msg.Data)
+		data, err := pair.openMessage(msg.Data)
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&pair.bytesIn, int64(len(data)))
+		_, err = pair.impl.Writer().Write(data)
 		if err != nil {
-			logrus.Error("sock write failed:", err)
+			pair.log().Error("sock write failed:", err)
 			pair.Close()
 		}
 	})
 	dc.OnClose(func() {
-		logrus.Info("data channel close 1")
+		pair.log().Info("data channel close 1")
 		pair.Exit <- fmt.Errorf("data channel close")
 		pair.Close()
-		logrus.Debug("data channel closed")
+		pair.log().Debug("data channel closed")
 	})
 	pair.PeerConnection = peer
 	return nil
 }
+
+// openMessage returns the plain text of a message of the data channel. The
+// pair is closed if it can't be decrypted, stale messages are dropped.
+func (pair *WebRTC) openMessage(msg []byte) ([]byte, error) {
+	if pair.sealed == nil {
+		return msg, nil
+	}
+	data, err := pair.sealed.Open(msg)
+	if err == e2e.ErrStaleMessage {
+		pair.log().Debug("drop stale message of ", pair.targetId)
+		return nil, err
+	}
+	if err != nil {
+		pair.log().Error(err)
+		pair.Close()
+		return nil, err
+	}
+	return data, nil
+}
+
 func (pair *WebRTC) Close() {
 	if pair.PeerConnection != nil {
 		pair.PeerConnection.Close()
@@ -181,7 +444,7 @@ func (pair *WebRTC) Close() {
 
 func (pair *WebRTC) Offer(target string, reType int32) (types.SignalingInfo, error) {
 	var info types.SignalingInfo
-	logrus.Debug("pair offer")
+	pair.log().Debug("pair offer")
 	if target == "" {
 		return info, fmt.Errorf("target was empty")
 	}
@@ -201,12 +464,21 @@ func (pair *WebRTC) Offer(target string, reType int32) (types.SignalingInfo, err
 		SDP:               offer.SDP,
 		RemoteRequestType: reType,
 		Source:            pair.nodeId,
+		Hello:             pair.kx.Hello(),
+		OTP:               pair.impl.OneTimeCode(),
+		Endpoint:          endpoints.Self(),
 	}
 	return ret, nil
 }
 
 func (pair *WebRTC) Anwser(info types.SignalingInfo) (types.SignalingInfo, error) {
-	logrus.Debug("pair anwser")
+	pair.log().Debug("pair anwser")
+	sealed, err := newSealedChannel(pair.kx, info.Hello, pair.targetId, false)
+	if err != nil {
+		pair.Close()
+		return info, err
+	}
+	pair.sealed = sealed
 	if err := pair.PeerConnection.SetRemoteDescription(webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer,
 		SDP:  info.SDP,
@@ -222,30 +494,42 @@ func (pair *WebRTC) Anwser(info types.SignalingInfo) (types.SignalingInfo, error
 
 	err = pair.PeerConnection.SetLocalDescription(answer)
 	if err != nil {
-		logrus.Error(err)
+		pair.log().Error(err)
 		pair.Close()
 		return info, err
 	}
 	ret := types.SignalingInfo{
-		Id:     info.Id,
-		Flag:   types.SIG_TYPE_ANSWER,
-		SDP:    answer.SDP,
-		Target: pair.targetId,
-		Source: pair.nodeId,
+		Id:       info.Id,
+		Flag:     types.SIG_TYPE_ANSWER,
+		SDP:      answer.SDP,
+		Target:   pair.targetId,
+		Source:   pair.nodeId,
+		Hello:    pair.kx.Hello(),
+		Endpoint: endpoints.Self(),
 	}
 	return ret, nil
 }
 
 func (pair *WebRTC) MakeConnection(info types.SignalingInfo) error {
-	logrus.Debug("pair make connection")
+	pair.log().Debug("pair make connection")
 	if pair == nil || pair.PeerConnection == nil {
 		return fmt.Errorf("invalid peer connection")
 	}
+	sealed, err := newSealedChannel(pair.kx, info.Hello, pair.targetId, true)
+	if err != nil {
+		pair.log().Error("make connection: ", err)
+		pair.fail(err)
+		pair.Exit <- err
+		pair.Close()
+		return err
+	}
+	pair.sealed = sealed
 	if err := pair.PeerConnection.SetRemoteDescription(webrtc.SessionDescription{
 		Type: webrtc.SDPTypeAnswer,
 		SDP:  info.SDP,
 	}); err != nil {
-		logrus.Error("make connection rtc error: ", pair.poolId.String(pair.Direction()), " ", err)
+		pair.log().Error("make connection rtc error: ", pair.poolId.String(pair.Direction()), " ", err)
+		pair.fail(err)
 		pair.Close()
 		return err
 	}
@@ -256,12 +540,12 @@ func (pair *WebRTC) MakeConnection(info types.SignalingInfo) error {
 func (pair *WebRTC) AddCandidate(ca *webrtc.ICECandidateInit, id types.PoolId) error {
 	if pair != nil && id.Raw() == pair.PoolId().Raw() {
 		if !pair.IsRemoteDescriptionSet() {
-			logrus.Warn("waiting remote description be set ", pair.poolId.String(pair.Direction()))
+			pair.log().Warn("waiting remote description be set ", pair.poolId.String(pair.Direction()))
 			return fmt.Errorf("remote description NOT set")
 		}
 		err := pair.PeerConnection.AddICECandidate(*ca)
 		if err != nil {
-			logrus.Error(err, pair.PoolId(), id)
+			pair.log().Error(err, pair.PoolId(), id)
 			return err
 		}
 	} else {
@@ -2,15 +2,21 @@ package conn
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"path"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/webrtc/v3"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/audit"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
@@ -21,14 +27,45 @@ type WebRTCService struct {
 	sigPush             chan types.SignalingInfo
 	conf                webrtc.Configuration
 	signalingServerAddr string
+	signalingToken      string
+	pairing             pairing
+	// gobSignaling is set once the signaling server refused a message in
+	// the wire encoding, older servers only decode gob
+	gobSignaling int32
+	// lastSignal is the time in nanoseconds a message was last sent or
+	// received, polls are quick for poll.Window seconds after it
+	lastSignal int64
+	poll       conf.SignalingPollConf
+	// wake cuts short the wait of the pull loop when a handshake starts
+	wake chan struct{}
+	// outbound is the proxy of the signaling requests and TURN connections
+	outbound *utils.OutboundProxy
+	client   *http.Client
+	// probe sets how often the STUN servers of conf are checked
+	probe conf.STUNProbeConf
+	// cm is the configure of the daemon, devices joining with a token are
+	// added to its address book
+	cm *conf.ConfManager
 }
 
-func NewWebRTCService(id, signalingServerAddr string, conf webrtc.Configuration) *WebRTCService {
+func NewWebRTCService(id, signalingServerAddr, signalingToken string, rtcConf webrtc.Configuration, poll conf.SignalingPollConf, probe conf.STUNProbeConf, pc conf.OutboundProxyConf, cm *conf.ConfManager) *WebRTCService {
+	outbound, err := NewOutboundProxy(pc)
+	if err != nil {
+		logrus.Error(err, ", using the proxy of the environment")
+		outbound, _ = NewOutboundProxy(conf.OutboundProxyConf{})
+	}
 	return &WebRTCService{
 		sigPull:               make(chan types.SignalingInfo, 128),
 		sigPush:               make(chan types.SignalingInfo, 128),
-		conf:                  conf,
+		conf:                  rtcConf,
 		signalingServerAddr:   signalingServerAddr,
+		signalingToken:        signalingToken,
+		poll:                  poll,
+		probe:                 probe,
+		wake:                  make(chan struct{}, 1),
+		outbound:              outbound,
+		client:                outbound.HTTPClient(0),
+		cm:                    cm,
 		BaseConnectionService: *NewBaseConnectionService(id),
 	}
 }
@@ -36,13 +73,40 @@ func NewWebRTCService(id, signalingServerAddr string, conf webrtc.Configuration)
 func (wss *WebRTCService) Start() error {
 	logrus.Debug("start webrtc service")
 	wss.BaseConnectionService.Start()
+	if wss.signalingServerAddr == "" {
+		logrus.Warn("no signaling server set, run 'sshx init' to connect to other devices")
+		return nil
+	}
 	go wss.ServeSignaling()
+	if wss.probe.Interval > 0 {
+		go wss.probeSTUN()
+	}
 
 	return nil
 }
 
-func (wss *WebRTCService) CreateConnection(sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
-	err := wss.BaseConnectionService.CreateConnection(sender, sock, poolId)
+// probeSTUN checks the STUN servers every probe.Interval seconds while the
+// service runs
+func (wss *WebRTCService) probeSTUN() {
+	interval := time.Duration(wss.probe.Interval) * time.Second
+	timeout := time.Duration(wss.probe.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	for wss.running {
+		stunHealth.Check(wss.conf.ICEServers, timeout)
+		time.Sleep(interval)
+	}
+}
+
+// rtcConf returns the configure of new pairs, with the STUN servers which
+// answer the last checks, the fastest first
+func (wss *WebRTCService) rtcConf() webrtc.Configuration {
+	return stunHealth.Select(wss.conf)
+}
+
+func (wss *WebRTCService) CreateConnection(ctx context.Context, sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
+	err := wss.BaseConnectionService.CreateConnection(ctx, sender, sock, poolId)
 	if err != nil {
 		return err
 	}
@@ -54,7 +118,7 @@ func (wss *WebRTCService) CreateConnection(sender *impl.Sender, sock net.Conn, p
 		iface.SetConn(sock)
 	}
 
-	pair := NewWebRTC(wss.conf, iface, wss.id, iface.HostId(), poolId, CONNECTION_DRECT_OUT, &wss.CleanChan)
+	pair := NewWebRTC(wss.rtcConf(), wss.outbound, iface, wss.id, iface.HostId(), poolId, CONNECTION_DRECT_OUT, &wss.CleanChan)
 	if pair == nil {
 		return fmt.Errorf("cannot create pair")
 	}
@@ -64,7 +128,7 @@ func (wss *WebRTCService) CreateConnection(sender *impl.Sender, sock net.Conn, p
 		return err
 	}
 	if iface.IsNeedConnect() {
-		logrus.Debug("create connection for ", impl.GetImplName(iface.Code()))
+		pair.log().Debug("create connection")
 		info, err := pair.Offer(string(iface.HostId()), sender.Type)
 		if err != nil {
 			return err
@@ -83,31 +147,55 @@ func (wss *WebRTCService) CreateConnection(sender *impl.Sender, sock net.Conn, p
 			return err
 		}
 	} else {
-		logrus.Error("NOT create connection for ", impl.GetImplName(iface.Code()))
+		pair.log().Error("NOT create connection for ", impl.GetImplName(iface.Code()))
 	}
 
-	logrus.Debug("ready to put piar ", pair.poolId.String(pair.Direction()))
+	pair.log().Debug("ready to put pair")
 	err = wss.AddPair(pair)
 	if err != nil {
 		return err
 	}
 	if !sender.Detach {
-		logrus.Warn("waitting pair send exit message")
-		<-pair.Exit
-		logrus.Warn("pair send exit message")
+		pair.log().Warn("waitting pair send exit message")
+		select {
+		case <-pair.Exit:
+		case <-ctx.Done():
+			wss.cancel(pair)
+			return ctx.Err()
+		}
+		pair.log().Warn("pair send exit message")
 	}
 	return nil
 }
 
-func (wss *WebRTCService) DestroyConnection(tmp *impl.Sender) error {
-	pair := wss.GetPair(string(tmp.PairId))
-	if pair == nil {
-		return fmt.Errorf("cannot get pair for %s", string(tmp.PairId))
+// cancel closes a pair which is still negotiating and tells the peer to
+// close its side
+func (wss *WebRTCService) cancel(pair *WebRTC) {
+	pair.log().Info("dial canceled")
+	wss.RemovePair(CleanRequest{pair.PoolId().String(pair.Direction()), pair.Name()})
+	if !pair.GetImpl().IsNeedConnect() {
+		return
 	}
-	if pair.GetImpl().Code() == tmp.GetAppCode() {
-		wss.RemovePair(CleanRequest{string(tmp.PairId), (&WebRTC{}).Name()})
+	err := wss.push(types.SignalingInfo{
+		Flag:   types.SIG_TYPE_CANCEL,
+		Source: wss.id,
+		Target: pair.TargetId(),
+		Id:     *pair.PoolId(),
+	})
+	if err != nil {
+		pair.log().Error(err)
 	}
-	return nil
+}
+
+// ServeCancelInfo closes the pair a peer gave up before it was connected
+func (wss *WebRTCService) ServeCancelInfo(info types.SignalingInfo) {
+	key := info.Id.String(CONNECTION_DRECT_IN)
+	pair := wss.GetPair(key)
+	if pair == nil || pair.TargetId() != info.Source {
+		return
+	}
+	pair.(*WebRTC).log().Info("dial canceled by the peer")
+	wss.RemovePair(CleanRequest{key, pair.Name()})
 }
 
 func (wss *WebRTCService) isValidSignalingInfo(input types.SignalingInfo) bool {
@@ -127,10 +215,61 @@ func (wss *WebRTCService) push(info types.SignalingInfo) error {
 	if !wss.isValidSignalingInfo(info) {
 		return fmt.Errorf("invalid SignalingInfo")
 	}
+	err := impl.SignSignaling(&info)
+	if err != nil {
+		return err
+	}
+	wss.signaled()
 	wss.sigPush <- info
 	return nil
 }
 
+// signaled records that a handshake goes on, so the signaling server is
+// polled quickly for the answer of the peer
+func (wss *WebRTCService) signaled() {
+	atomic.StoreInt64(&wss.lastSignal, time.Now().UnixNano())
+	select {
+	case wss.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pollInterval returns how long the pull loop waits after a poll which
+// found no message: poll.Active during handshakes, otherwise twice the
+// previous interval up to poll.Idle
+func (wss *WebRTCService) pollInterval(prev time.Duration) time.Duration {
+	active := time.Duration(wss.poll.Active) * time.Millisecond
+	if active <= 0 {
+		active = time.Second
+	}
+	idle := time.Duration(wss.poll.Idle) * time.Millisecond
+	if idle < active {
+		idle = active
+	}
+	window := time.Duration(wss.poll.Window) * time.Second
+	if time.Since(time.Unix(0, atomic.LoadInt64(&wss.lastSignal))) < window {
+		return active
+	}
+	next := 2 * prev
+	if next < active {
+		next = active
+	}
+	if next > idle {
+		next = idle
+	}
+	return next
+}
+
+// waitPoll waits for d or for a handshake to start
+func (wss *WebRTCService) waitPoll(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-wss.wake:
+	}
+}
+
 func (wss *WebRTCService) ServeOfferInfo(info types.SignalingInfo) {
 	if !wss.isValidSignalingInfo(info) {
 		logrus.Error("invalid SignalingInfo")
@@ -145,22 +284,34 @@ func (wss *WebRTCService) ServeOfferInfo(info types.SignalingInfo) {
 		return
 	}
 	iface.SetHostId(info.Source)
+	iface.SetOneTimeCode(info.OTP)
 	// set candidate pool id direction to out for self(server)
-	pair := NewWebRTC(wss.conf, iface, wss.id, info.Source, info.Id, CONNECTION_DRECT_IN, &wss.CleanChan)
+	pair := NewWebRTC(wss.rtcConf(), wss.outbound, iface, wss.id, info.Source, info.Id, CONNECTION_DRECT_IN, &wss.CleanChan)
+	if pair == nil {
+		sessionLog(info.Id, CONNECTION_DRECT_IN, info.Source).Error("cannot create pair")
+		return
+	}
+	pair.knocks = wss.knocks
 	// set candidate pool id direction to out for client
 	err := pair.Response()
 	if err != nil {
-		logrus.Error(err)
+		pair.log().Error(err)
+		recordEvent(types.EVENT_FAILURE, pair.PoolId().String(pair.Direction()), impl.AppName(iface.Code()), info.Source, err)
+		pair.fail(err)
+		history.Add(pair.History())
 		return
 	}
 	awser, err := pair.Anwser(info)
 	if err != nil {
-		logrus.Error("pair create a nil anwser")
+		pair.log().Error("pair create a nil anwser")
+		recordEvent(types.EVENT_FAILURE, pair.PoolId().String(pair.Direction()), impl.AppName(iface.Code()), info.Source, "answer: ", err)
+		pair.fail("answer: ", err)
+		history.Add(pair.History())
 		return
 	}
 
 	pair.PeerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
-		logrus.Debug("send candidate")
+		pair.log().Debug("send candidate")
 		// set candidate pool id direction to out for client
 		info.Id.Direction = pair.Direction()
 		wss.SignalCandidate(info, info.Source, c)
@@ -168,23 +319,65 @@ func (wss *WebRTCService) ServeOfferInfo(info types.SignalingInfo) {
 	wss.push(awser)
 	err = wss.AddPair(pair)
 	if err != nil {
-		logrus.Error(err)
+		pair.log().Error(err)
 		return
 	}
 }
 
-func (wss *WebRTCService) ServePush(info types.SignalingInfo) {
+// signalingRequest sends a request to the signaling server with the tenant
+// token, if any. Messages are asked in the wire encoding, servers which
+// don't know it answer in gob.
+func (wss *WebRTCService) signalingRequest(method, p, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, wss.signalingServerAddr+p, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", types.WIRE_CONTENT_TYPE)
+	if wss.signalingToken != "" {
+		req.Header.Set("Authorization", "Bearer "+wss.signalingToken)
+	}
+	return wss.client.Do(req)
+}
+
+// pushRequest sends a message to the signaling server in the wire encoding,
+// or in gob if legacy is set
+func (wss *WebRTCService) pushRequest(info *types.SignalingInfo, legacy bool) (*http.Response, error) {
 	buf := bytes.NewBuffer(nil)
-	if err := gob.NewEncoder(buf).Encode(info); err != nil {
-		logrus.Error(err)
-		return
+	contentType := types.WIRE_CONTENT_TYPE
+	var err error
+	if legacy {
+		contentType = "application/binary"
+		err = gob.NewEncoder(buf).Encode(info)
+	} else {
+		err = types.WriteSignalingInfo(buf, info)
+	}
+	if err != nil {
+		return nil, err
 	}
-	resp, err := http.Post(wss.signalingServerAddr+
-		path.Join("/", "push", info.Target), "application/binary", buf)
+	return wss.signalingRequest(http.MethodPost, path.Join("/", "push", info.Target), contentType, buf)
+}
+
+func (wss *WebRTCService) ServePush(info types.SignalingInfo) {
+	legacy := atomic.LoadInt32(&wss.gobSignaling) == 1
+	resp, err := wss.pushRequest(&info, legacy)
 	if err != nil {
 		logrus.Error(err)
 		return
 	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest && !legacy {
+		logrus.Info("signaling server doesn't decode the wire encoding, fall back to gob")
+		atomic.StoreInt32(&wss.gobSignaling, 1)
+		resp, err = wss.pushRequest(&info, true)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		resp.Body.Close()
+	}
 	if resp.StatusCode != http.StatusOK {
 		logrus.Errorln("push to ", info.Target, "faild")
 		return
@@ -197,7 +390,7 @@ func (wss *WebRTCService) ServeCandidateInfo(info types.SignalingInfo) {
 	info.Id.Direction = ^info.Id.Direction & 0x01
 	pair := wss.GetPair(info.Id.String(info.Id.Direction))
 	if pair == nil {
-		logrus.Warn("pair ", info.Id.String(info.Id.Direction), " was empty, cannot serve candidate")
+		sessionLog(info.Id, info.Id.Direction, info.Source).Warn("pair was empty, cannot serve candidate")
 		return
 	}
 	pair.(*WebRTC).AddCandidate(&webrtc.ICECandidateInit{Candidate: string(info.Candidate)}, info.Id)
@@ -207,12 +400,13 @@ func (wss *WebRTCService) ServeAnwserInfo(info types.SignalingInfo) {
 	// set candidate pool id direction to out for self(client)
 	pair := wss.GetPair(info.Id.String(CONNECTION_DRECT_OUT))
 	if pair == nil {
-		logrus.Error("pair for id ", info.Id.String(CONNECTION_DRECT_OUT), " was empty, cannot serve anwser")
+		sessionLog(info.Id, CONNECTION_DRECT_OUT, info.Source).Error("pair was empty, cannot serve anwser")
 		return
 	}
 	err := pair.(*WebRTC).MakeConnection(info)
 	if err != nil {
-		logrus.Error(err)
+		pair.(*WebRTC).log().Error(err)
+		recordEvent(types.EVENT_FAILURE, info.Id.String(CONNECTION_DRECT_OUT), impl.AppName(info.Id.ImplCode), info.Source, err)
 	}
 }
 
@@ -220,22 +414,34 @@ func (wss *WebRTCService) ServeSignaling() {
 
 	// pull loop
 	go func() {
+		var interval time.Duration
 		for wss.running {
-			res, err := http.Get(wss.signalingServerAddr +
-				path.Join("/", "pull", wss.id))
+			res, err := wss.signalingRequest(http.MethodGet, path.Join("/", "pull", wss.id), "", nil)
 			if err != nil {
 				time.Sleep(1 * time.Second)
 				continue
 			}
-			var info types.SignalingInfo
-			if err = gob.NewDecoder(res.Body).Decode(&info); err != nil {
-				if err != nil {
-					res.Body.Close()
-					time.Sleep(1 * time.Second)
-					continue
-				}
+			if res.StatusCode == http.StatusUnauthorized {
+				logrus.Error("signaling server refused the token, check SignalingToken")
+				res.Body.Close()
+				time.Sleep(10 * time.Second)
+				continue
 			}
+			info, err := types.DecodeSignalingInfo(res.Body)
 			res.Body.Close()
+			if err == io.EOF {
+				// no message waiting
+				interval = wss.pollInterval(interval)
+				wss.waitPoll(interval)
+				continue
+			}
+			if err != nil {
+				logrus.Warn("refused signaling message: ", err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+			wss.signaled()
+			interval = 0
 			wss.sigPull <- info
 		}
 	}()
@@ -245,23 +451,75 @@ func (wss *WebRTCService) ServeSignaling() {
 		case info := <-wss.sigPush:
 			go wss.ServePush(info)
 		case info := <-wss.sigPull:
-			switch info.Flag {
-			case types.SIG_TYPE_OFFER:
-				// server side
-				go wss.ServeOfferInfo(info)
-			case types.SIG_TYPE_CANDIDATE:
-				// common side
-				go wss.ServeCandidateInfo(info)
-			case types.SIG_TYPE_ANSWER:
-				// client side
-				go wss.ServeAnwserInfo(info)
-			case types.SIG_TYPE_UNKNOWN:
-				logrus.Error("unknow signaling type")
-			}
+			go wss.serveInfo(info)
 		}
 	}
 }
 
+// AnnounceRotation sends the key rotations of this device to the peers
+// which pinned its keys, and returns the number of peers
+func (wss *WebRTCService) AnnounceRotation() int {
+	if wss.signalingServerAddr == "" {
+		return 0
+	}
+	peers, err := impl.PinnedPeers()
+	if err != nil {
+		logrus.Error(err)
+		return 0
+	}
+	for _, v := range peers {
+		err = wss.push(types.SignalingInfo{
+			Flag:   types.SIG_TYPE_KEY_ROTATION,
+			Source: wss.id,
+			Target: v,
+			Id:     *types.NewPoolId(time.Now().UnixNano(), types.APP_TYPE_IDENTITY),
+		})
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+	return len(peers)
+}
+
+// serveInfo serves a signaling message once its signature is verified
+func (wss *WebRTCService) serveInfo(info types.SignalingInfo) {
+	// pairing pins the node key itself
+	pairing := info.Flag == types.SIG_TYPE_PAIR_REQUEST || info.Flag == types.SIG_TYPE_PAIR_RESPONSE
+	err := impl.VerifySignaling(&info, !pairing)
+	if err != nil {
+		logrus.Warn("refused signaling message: ", err)
+		recordEvent(types.EVENT_DENIED, "", "", info.Source, "signaling message: ", err)
+		audit.Denied(audit.CATEGORY_AUTH, "signaling.verify", info.Source, "", err)
+		return
+	}
+	// the public address of the direct service of the peer, if mapped
+	if info.Flag == types.SIG_TYPE_OFFER || info.Flag == types.SIG_TYPE_ANSWER {
+		endpoints.learn(info.Source, info.Endpoint)
+	}
+	switch info.Flag {
+	case types.SIG_TYPE_OFFER:
+		// server side
+		wss.ServeOfferInfo(info)
+	case types.SIG_TYPE_CANDIDATE:
+		// common side
+		wss.ServeCandidateInfo(info)
+	case types.SIG_TYPE_ANSWER:
+		// client side
+		wss.ServeAnwserInfo(info)
+	case types.SIG_TYPE_PAIR_REQUEST:
+		wss.ServePairRequest(info)
+	case types.SIG_TYPE_PAIR_RESPONSE:
+		wss.ServePairResponse(info)
+	case types.SIG_TYPE_KEY_ROTATION:
+		// the verification pinned the new keys
+		logrus.Debug("key rotation of ", info.Source)
+	case types.SIG_TYPE_CANCEL:
+		wss.ServeCancelInfo(info)
+	case types.SIG_TYPE_UNKNOWN:
+		logrus.Error("unknow signaling type")
+	}
+}
+
 func (wss *WebRTCService) SignalCandidate(info types.SignalingInfo, target string, c *webrtc.ICECandidate) {
 	if c == nil {
 		return
@@ -0,0 +1,184 @@
+// Package cron parses the schedules of the tasks of the daemon, cron
+// expressions and their shorthands
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule gives the times a task runs at
+type Schedule interface {
+	// Next returns the first time after t, the zero time if there is
+	// none as for february the 30th
+	Next(t time.Time) time.Time
+}
+
+// every runs a task at a fixed interval
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// fields of a cron expression
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 6},
+}
+
+var shorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// expression is a cron expression, the bits of each field are the values
+// it matches
+type expression struct {
+	minute, hour, dom, month, dow uint64
+	// anyDom and anyDow are set if the field starts with *, a day
+	// matches both fields then, either one otherwise as in cron
+	anyDom, anyDow bool
+}
+
+// Parse parses a cron expression of 5 fields, minute hour day-of-month
+// month day-of-week with lists, ranges and steps as 0,30 1-5 */15, or
+// @yearly, @monthly, @weekly, @daily, @hourly or @every DURATION
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Minute {
+			return nil, fmt.Errorf("interval %s is shorter than a minute", d)
+		}
+		return every(d), nil
+	}
+	if v, ok := shorthands[spec]; ok {
+		spec = v
+	}
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("invalid schedule %q, want minute hour day month weekday", spec)
+	}
+	var bits [5]uint64
+	for i, f := range fields {
+		var err error
+		bits[i], err = parseField(parts[i], f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// 7 is sunday too
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &expression{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		anyDom: strings.HasPrefix(parts[2], "*"),
+		anyDow: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+// parseField returns the bits of the values of a comma separated list of
+// *, N, N-M and their /STEP forms
+func parseField(s string, f field) (uint64, error) {
+	max := f.max
+	if f.name == "day of week" {
+		max = 7
+	}
+	var ret uint64
+	for _, v := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.IndexByte(v, '/'); i >= 0 {
+			n, err := strconv.Atoi(v[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %s %q", f.name, v)
+			}
+			step = n
+			v = v[:i]
+		}
+		lo, hi := f.min, max
+		if v != "*" {
+			bounds := strings.SplitN(v, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid %s %q", f.name, v)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid %s %q", f.name, v)
+				}
+			} else if step > 1 {
+				// N/STEP runs from N to the end
+				hi = max
+			}
+		}
+		if lo < f.min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%s %q out of %d-%d", f.name, v, f.min, max)
+		}
+		for n := lo; n <= hi; n += step {
+			ret |= 1 << uint(n)
+		}
+	}
+	return ret, nil
+}
+
+func (e *expression) matchDay(t time.Time) bool {
+	dom := e.dom&(1<<uint(t.Day())) != 0
+	dow := e.dow&(1<<uint(t.Weekday())) != 0
+	if e.anyDom || e.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (e *expression) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// every schedule matches within 5 years, as february the 29th
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if e.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !e.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if e.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if e.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,214 @@
+// Package dnsdisc finds the signaling server of an organization and its
+// devices in DNS. A domain publishes its signaling server with a SRV
+// record, and optionally the scheme with a TXT record of the same name:
+//
+//	_sshx._tcp.example.com. SRV 0 0 443 signal.example.com.
+//	_sshx._tcp.example.com. TXT "v=sshx1 scheme=https"
+//
+// A device is published with a TXT record holding its ID and the
+// fingerprint of its node key, as 'sshx identity show' prints them:
+//
+//	_sshx.host.example.com. TXT "v=sshx1 id=<device id> fp=<fingerprint>"
+package dnsdisc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// version starts the TXT records of sshx
+	version = "v=sshx1"
+
+	// lookupTimeout bounds each lookup
+	lookupTimeout = 5 * time.Second
+)
+
+// ErrNotFound is returned when the name publishes no sshx record
+var ErrNotFound = errors.New("no sshx record")
+
+// Peer is a device published in DNS
+type Peer struct {
+	// Host is the name the device is published with
+	Host string
+
+	// ID is the device ID
+	ID string
+
+	// Fingerprint is the fingerprint of the node key of the device, empty
+	// if the record has none
+	Fingerprint string
+}
+
+// Signaling is the signaling server a domain publishes
+type Signaling struct {
+	// Domain is the domain of the SRV record
+	Domain string
+
+	// Addr is the URL of the signaling server
+	Addr string
+}
+
+// Resolver looks sshx records up with the DNS server at Server, or the one
+// of the system if empty
+type Resolver struct {
+	Server string
+}
+
+func (r *Resolver) resolver() *net.Resolver {
+	if r.Server == "" {
+		return net.DefaultResolver
+	}
+	server := r.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// IsDomain reports whether host may be published in DNS: a name of two
+// labels or more which isn't an IP address
+func IsDomain(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	return strings.Contains(host, ".") && net.ParseIP(host) == nil
+}
+
+// text returns the key=value pairs of the sshx TXT record of name
+func (r *Resolver) text(name string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	records, err := r.resolver().LookupTXT(ctx, name)
+	if err != nil {
+		return nil, lookupError(err)
+	}
+	for _, v := range records {
+		fields := strings.Fields(v)
+		if len(fields) == 0 || fields[0] != version {
+			continue
+		}
+		ret := make(map[string]string)
+		for _, f := range fields[1:] {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) == 2 {
+				ret[strings.ToLower(kv[0])] = kv[1]
+			}
+		}
+		return ret, nil
+	}
+	return nil, ErrNotFound
+}
+
+// lookupError turns the errors of names which don't exist into ErrNotFound
+func lookupError(err error) error {
+	var de *net.DNSError
+	if errors.As(err, &de) && de.IsNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+// LookupPeer returns the device published at host
+func (r *Resolver) LookupPeer(host string) (*Peer, error) {
+	host = strings.TrimSuffix(host, ".")
+	values, err := r.text("_sshx." + host + ".")
+	if err != nil {
+		return nil, err
+	}
+	if values["id"] == "" {
+		return nil, fmt.Errorf("sshx record of %s has no device id", host)
+	}
+	return &Peer{
+		Host:        host,
+		ID:          values["id"],
+		Fingerprint: strings.ToUpper(values["fp"]),
+	}, nil
+}
+
+// LookupSignaling returns the signaling server published by host or by the
+// closest of its parent domains, top level domains excepted
+func (r *Resolver) LookupSignaling(host string) (*Signaling, error) {
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	for i := 0; i+2 <= len(labels); i++ {
+		domain := strings.Join(labels[i:], ".")
+		ret, err := r.lookupSignaling(domain)
+		if err != ErrNotFound {
+			return ret, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *Resolver) lookupSignaling(domain string) (*Signaling, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	// the records come sorted by priority and weight
+	_, srvs, err := r.resolver().LookupSRV(ctx, "sshx", "tcp", domain+".")
+	if err != nil {
+		return nil, lookupError(err)
+	}
+	if len(srvs) == 0 || srvs[0].Target == "." {
+		// a target of "." means the service is not available
+		return nil, ErrNotFound
+	}
+	scheme := "https"
+	values, err := r.text("_sshx._tcp." + domain + ".")
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	switch values["scheme"] {
+	case "":
+	case "http", "https":
+		scheme = values["scheme"]
+	default:
+		return nil, fmt.Errorf("unknown signaling scheme %s of %s", values["scheme"], domain)
+	}
+	target := strings.TrimSuffix(srvs[0].Target, ".")
+	return &Signaling{
+		Domain: domain,
+		Addr:   scheme + "://" + net.JoinHostPort(target, fmt.Sprint(srvs[0].Port)),
+	}, nil
+}
+
+// Record returns the TXT record publishing the device, in zone file form
+func (p *Peer) Record() string {
+	text := version + " id=" + p.ID
+	if p.Fingerprint != "" {
+		text += " fp=" + p.Fingerprint
+	}
+	return fmt.Sprintf("_sshx.%s. TXT %q", strings.TrimSuffix(p.Host, "."), text)
+}
+
+// Records returns the SRV and TXT records publishing the signaling server,
+// in zone file form
+func (s *Signaling) Records() ([]string, error) {
+	u, err := url.Parse(s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid signaling server %s", s.Addr)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	name := "_sshx._tcp." + strings.TrimSuffix(s.Domain, ".") + "."
+	return []string{
+		fmt.Sprintf("%s SRV 0 0 %s %s.", name, port, u.Hostname()),
+		fmt.Sprintf("%s TXT %q", name, version+" scheme="+u.Scheme),
+	}, nil
+}
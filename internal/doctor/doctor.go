@@ -0,0 +1,281 @@
+// Package doctor checks that this device can reach its peers and serve
+// its applications, and says what to do about what it can't
+package doctor
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/suutaku/sshx/internal/conn"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// Status of a check
+const (
+	STATUS_OK   = "ok"
+	STATUS_WARN = "warn"
+	STATUS_FAIL = "fail"
+	STATUS_SKIP = "skip"
+)
+
+const (
+	// requestTimeout bounds the requests to the daemon and the signaling
+	// server
+	requestTimeout = 10 * time.Second
+
+	// gatherTimeout bounds the gathering of the candidates of an ICE server
+	gatherTimeout = 10 * time.Second
+
+	// one-time codes of peers apart by more than a step are refused
+	maxClockSkew  = 30 * time.Second
+	warnClockSkew = 10 * time.Second
+)
+
+// Result is the outcome of a check
+type Result struct {
+	Check   string `json:"check"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	// Hint says how to fix a failure or a warning
+	Hint string `json:"hint,omitempty"`
+}
+
+func result(check, status, hint string, msg ...interface{}) Result {
+	return Result{Check: check, Status: status, Message: fmt.Sprint(msg...), Hint: hint}
+}
+
+// Failed reports whether any of the results failed
+func Failed(results []Result) bool {
+	for _, v := range results {
+		if v.Status == STATUS_FAIL {
+			return true
+		}
+	}
+	return false
+}
+
+// Run runs every check with the configure of rootPath
+func Run(rootPath string) []Result {
+	cm, err := conf.NewConfManager(rootPath)
+	if err != nil {
+		return []Result{result("config", STATUS_FAIL, "fix or remove the configure file", err)}
+	}
+	ret := []Result{checkConfig(cm), checkDaemon(cm)}
+	op, err := conn.NewOutboundProxy(cm.Conf.OutboundProxyConf)
+	if err != nil {
+		// the daemon falls back to the proxy of the environment too
+		ret = append(ret, result("proxy", STATUS_FAIL, "fix outboundproxyconf.url", err))
+		op, _ = conn.NewOutboundProxy(conf.OutboundProxyConf{})
+	}
+	ret = append(ret, checkSignaling(cm, op)...)
+	ret = append(ret, checkICE(cm, op)...)
+	ret = append(ret, checkFUSE(), checkVNC(cm))
+	return ret
+}
+
+func checkConfig(cm *conf.ConfManager) Result {
+	if cm.Conf.ID == "" {
+		return result("config", STATUS_FAIL, "run 'sshx init'", "no device ID")
+	}
+	err := cm.Validate()
+	if err != nil {
+		return result("config", STATUS_FAIL, "fix the value with 'sshx conf set'", err)
+	}
+	return result("config", STATUS_OK, "", "device ", cm.Conf.ID)
+}
+
+// checkDaemon asks the daemon for its sessions
+func checkDaemon(cm *conf.ConfManager) Result {
+	hint := "start the daemon with 'sshx daemon'"
+	st := impl.NewSTAT()
+	st.SetHostId(cm.Conf.ID)
+	sender := impl.NewSender(st, types.OPTION_TYPE_STAT)
+	if sender == nil {
+		return result("daemon", STATUS_FAIL, hint, "cannot create sender")
+	}
+	conn, err := sender.Send()
+	if err != nil {
+		return result("daemon", STATUS_FAIL, hint, "not reachable: ", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+	var stats []types.Status
+	err = gob.NewEncoder(conn).Encode(stats)
+	if err == nil {
+		err = gob.NewDecoder(conn).Decode(&stats)
+	}
+	if err != nil {
+		return result("daemon", STATUS_FAIL, "restart the daemon", "no answer: ", err)
+	}
+	return result("daemon", STATUS_OK, "", "reachable, ", len(stats), " sessions")
+}
+
+// checkSignaling polls a queue of its own on the signaling server, so no
+// message of the daemon is taken, and compares the clocks
+func checkSignaling(cm *conf.ConfManager, op *utils.OutboundProxy) []Result {
+	addr := cm.Conf.SignalingServerAddr
+	if addr == "" {
+		return []Result{
+			result("signaling", STATUS_FAIL, "set signalingserveraddr", "no signaling server"),
+			result("clock", STATUS_SKIP, "", "no signaling server to compare with"),
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+path.Join("/", "pull", cm.Conf.ID+".doctor"), nil)
+	if err != nil {
+		return []Result{
+			result("signaling", STATUS_FAIL, "fix signalingserveraddr", err),
+			result("clock", STATUS_SKIP, "", "no signaling server to compare with"),
+		}
+	}
+	if cm.Conf.SignalingToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cm.Conf.SignalingToken)
+	}
+	start := time.Now()
+	res, err := op.HTTPClient(requestTimeout).Do(req)
+	rtt := time.Since(start)
+	if err != nil {
+		return []Result{
+			result("signaling", STATUS_FAIL, "check the address and the network", "not reachable: ", err),
+			result("clock", STATUS_SKIP, "", "no signaling server to compare with"),
+		}
+	}
+	res.Body.Close()
+	var sig Result
+	switch res.StatusCode {
+	case http.StatusOK:
+		sig = result("signaling", STATUS_OK, "", addr, " answered in ", rtt.Round(time.Millisecond))
+	case http.StatusUnauthorized:
+		sig = result("signaling", STATUS_FAIL, "set signalingtoken to a token of the server", "token refused by ", addr)
+	default:
+		sig = result("signaling", STATUS_FAIL, "check the address is a sshx signaling server", addr, " answered ", res.Status)
+	}
+	return []Result{sig, checkClock(res, start, rtt)}
+}
+
+// checkClock compares the local clock with the Date of an answer of the
+// signaling server, which has a precision of a second
+func checkClock(res *http.Response, start time.Time, rtt time.Duration) Result {
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return result("clock", STATUS_SKIP, "", "the signaling server sent no date")
+	}
+	skew := start.Add(rtt / 2).Sub(date)
+	if skew < 0 {
+		skew = -skew
+	}
+	skew = skew.Round(time.Second)
+	hint := "synchronize the clock with NTP"
+	switch {
+	case skew > maxClockSkew:
+		return result("clock", STATUS_FAIL, hint, skew, " apart from the signaling server, one-time codes are refused")
+	case skew > warnClockSkew:
+		return result("clock", STATUS_WARN, hint, skew, " apart from the signaling server")
+	}
+	return result("clock", STATUS_OK, "", "within ", warnClockSkew, " of the signaling server")
+}
+
+// checkICE gathers candidates with each ICE server alone, STUN servers must
+// give server reflexive candidates and TURN servers relayed ones
+func checkICE(cm *conf.ConfManager, op *utils.OutboundProxy) []Result {
+	servers := cm.Conf.RTCConf.ICEServers
+	if len(servers) == 0 {
+		return []Result{result("ice", STATUS_WARN, "add a STUN server with 'sshx conf ice add'", "no ICE server, only peers of the local network are reached")}
+	}
+	ret := make([]Result, 0, len(servers))
+	for _, s := range servers {
+		name := "ice " + strings.Join(s.URLs, ",")
+		turn := false
+		for _, u := range s.URLs {
+			if strings.HasPrefix(strings.ToLower(u), "turn") {
+				turn = true
+			}
+		}
+		found, err := gather(s, turn, op)
+		switch {
+		case err != nil:
+			ret = append(ret, result(name, STATUS_FAIL, "check the URL of the server", err))
+		case turn && !found[webrtc.ICECandidateTypeRelay]:
+			ret = append(ret, result(name, STATUS_FAIL, "check the server is reachable and its username and credential", "no relayed candidate"))
+		case !turn && !found[webrtc.ICECandidateTypeSrflx]:
+			ret = append(ret, result(name, STATUS_FAIL, "check the server is reachable over UDP", "no server reflexive candidate"))
+		case turn:
+			ret = append(ret, result(name, STATUS_OK, "", "relay working"))
+		default:
+			ret = append(ret, result(name, STATUS_OK, "", "public address found"))
+		}
+	}
+	return ret
+}
+
+// gather returns the types of the candidates gathered with an ICE server,
+// relay only gathers relayed candidates
+func gather(s webrtc.ICEServer, relay bool, op *utils.OutboundProxy) (map[webrtc.ICECandidateType]bool, error) {
+	config := webrtc.Configuration{ICEServers: []webrtc.ICEServer{s}}
+	if relay {
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+	pc, err := conn.NewPeerConnection(config, op)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	found := make(map[webrtc.ICECandidateType]bool)
+	var lock sync.Mutex
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		lock.Lock()
+		found[c.Typ] = true
+		lock.Unlock()
+	})
+	_, err = pc.CreateDataChannel("doctor", nil)
+	if err != nil {
+		return nil, err
+	}
+	done := webrtc.GatheringCompletePromise(pc)
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	err = pc.SetLocalDescription(offer)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-done:
+	case <-time.After(gatherTimeout):
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	ret := make(map[webrtc.ICECandidateType]bool, len(found))
+	for k, v := range found {
+		ret[k] = v
+	}
+	return ret, nil
+}
+
+func checkFUSE() Result {
+	err := impl.CheckFUSE()
+	if err != nil {
+		return result("fuse", STATUS_WARN, "install it to mount remote directories with 'sshx fs'", err)
+	}
+	return result("fuse", STATUS_OK, "", "sshfs mounts supported")
+}
+
+func checkVNC(cm *conf.ConfManager) Result {
+	backend, err := impl.CheckVNCDisplay(cm.Conf.VNCDisplayConf)
+	if err != nil {
+		return result("vnc", STATUS_WARN, "set vncdisplayconf.backend or install what it needs", err)
+	}
+	return result("vnc", STATUS_OK, "", "desktop served with the ", backend, " backend")
+}
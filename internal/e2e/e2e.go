@@ -0,0 +1,253 @@
+// Package e2e is the end-to-end encryption of sshx connections without the
+// key storage and pinning of the daemon: the key exchange of the hellos,
+// the sealing of data channel messages and the digest signaling messages
+// are signed over. The browser client shares it with the daemon.
+package e2e
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/suutaku/sshx/pkg/types"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// ConnectionHello starts the hellos of the key exchange of connections,
+	// sent in offers and answers
+	ConnectionHello = "SSHXC1"
+
+	// ConnectionLabel binds the keys of a connection to its data channel
+	ConnectionLabel = "sshx connection"
+)
+
+// ErrInvalidHello is returned for hellos of another protocol or size
+var ErrInvalidHello = errors.New("invalid key exchange hello")
+
+// ErrStaleMessage is returned for messages older than the last one opened,
+// replayed or late on unordered channels
+var ErrStaleMessage = errors.New("stale message")
+
+// KeyExchange makes the keys of a connection with a peer. Both sides send
+// a hello with their static key and a key made for the connection, the
+// session keys mix the three Diffie-Hellman results so they depend on both
+// identities and are lost once the connection closes.
+type KeyExchange struct {
+	magic string
+	priv  []byte
+	eph   []byte
+	hello []byte
+}
+
+// NewKeyExchange makes the key of a connection for the static X25519 key
+// priv, magic starts the hellos and tells the protocols apart
+func NewKeyExchange(magic string, priv []byte) (*KeyExchange, error) {
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	eph := make([]byte, curve25519.ScalarSize)
+	_, err = rand.Read(eph)
+	if err != nil {
+		return nil, err
+	}
+	ephPub, err := curve25519.X25519(eph, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyExchange{
+		magic: magic,
+		priv:  priv,
+		eph:   eph,
+		hello: append(append([]byte(magic), pub...), ephPub...),
+	}, nil
+}
+
+// Hello returns the hello to send to the peer
+func (kx *KeyExchange) Hello() []byte {
+	return kx.hello
+}
+
+// PeerKey returns the static key of the peer which sent peerHello, the
+// caller checks it is the key of the peer before asking for the keys
+func (kx *KeyExchange) PeerKey(peerHello []byte) ([]byte, error) {
+	if len(peerHello) != len(kx.hello) || string(peerHello[:len(kx.magic)]) != kx.magic {
+		return nil, ErrInvalidHello
+	}
+	return peerHello[len(kx.magic) : len(kx.magic)+curve25519.PointSize], nil
+}
+
+// Keys returns the keys to seal and open data once the hello of the peer is
+// received, label binds them to their use. The dialer and the responder
+// get each other's keys.
+func (kx *KeyExchange) Keys(peerHello []byte, dialer bool, label string) (send, recv cipher.AEAD, err error) {
+	peerPub, err := kx.PeerKey(peerHello)
+	if err != nil {
+		return nil, nil, err
+	}
+	peerEph := peerHello[len(kx.magic)+curve25519.PointSize:]
+
+	var secrets [3][]byte
+	transcript := append(append([]byte{}, kx.hello...), peerHello...)
+	if dialer {
+		secrets[0], err = curve25519.X25519(kx.priv, peerEph)
+		if err == nil {
+			secrets[1], err = curve25519.X25519(kx.eph, peerPub)
+		}
+	} else {
+		secrets[0], err = curve25519.X25519(kx.eph, peerPub)
+		if err == nil {
+			secrets[1], err = curve25519.X25519(kx.priv, peerEph)
+		}
+		transcript = append(append([]byte{}, peerHello...), kx.hello...)
+	}
+	if err == nil {
+		secrets[2], err = curve25519.X25519(kx.eph, peerEph)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	ikm := bytes.Join(secrets[:], nil)
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	_, err = io.ReadFull(hkdf.New(sha256.New, ikm, nil, append([]byte(label), transcript...)), keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	dialerKey, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	responderKey, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if dialer {
+		return dialerKey, responderKey, nil
+	}
+	return responderKey, dialerKey, nil
+}
+
+// Channel encrypts the messages of a data channel with keys only the two
+// devices know, so whatever relays the data sees ciphertext. Every message
+// starts with its sequence number, which is the nonce and must grow.
+type Channel struct {
+	send     cipher.AEAD
+	recv     cipher.AEAD
+	sendSeq  uint64
+	recvNext uint64
+	lock     sync.Mutex
+}
+
+func NewChannel(send, recv cipher.AEAD) *Channel {
+	return &Channel{send: send, recv: recv}
+}
+
+func sequenceNonce(seq uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// Seal returns the message carrying p
+func (c *Channel) Seal(p []byte) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	msg := make([]byte, 8, 8+len(p)+c.send.Overhead())
+	binary.BigEndian.PutUint64(msg, c.sendSeq)
+	msg = c.send.Seal(msg, sequenceNonce(c.sendSeq), p, msg[:8])
+	c.sendSeq++
+	return msg
+}
+
+// Open returns the data of a message, msg is decrypted in place
+func (c *Channel) Open(msg []byte) ([]byte, error) {
+	if len(msg) < 8+c.recv.Overhead() {
+		return nil, fmt.Errorf("sealed message too short")
+	}
+	seq := binary.BigEndian.Uint64(msg)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if seq < c.recvNext {
+		return nil, ErrStaleMessage
+	}
+	ret, err := c.recv.Open(msg[8:8], sequenceNonce(seq), msg[8:], msg[:8])
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt message: %v", err)
+	}
+	c.recvNext = seq + 1
+	return ret, nil
+}
+
+// DirectoryDigest covers every field of a directory entry but its
+// signature
+func DirectoryDigest(e *types.DirectoryEntry) []byte {
+	h := sha256.New()
+	h.Write([]byte("sshx directory entry"))
+	for _, v := range []string{e.ID, e.Name, e.Owner} {
+		writeField(h, []byte(v))
+	}
+	for _, list := range [][]string{e.Tags, e.Capabilities} {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(list)))
+		h.Write(n[:])
+		for _, v := range list {
+			writeField(h, []byte(v))
+		}
+	}
+	writeField(h, e.NodeKey)
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(e.Updated))
+	h.Write(n[:])
+	if e.Removed {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)
+}
+
+func writeField(h hash.Hash, bs []byte) {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(bs)))
+	h.Write(n[:])
+	h.Write(bs)
+}
+
+// SignalingDigest covers every field of a signaling message but its
+// signature
+func SignalingDigest(info *types.SignalingInfo) []byte {
+	h := sha256.New()
+	var n [8]byte
+	for _, v := range []int64{int64(info.Flag), info.Id.Value, int64(info.Id.Direction), int64(info.Id.ImplCode), int64(info.PeerType), int64(info.RemoteRequestType)} {
+		binary.BigEndian.PutUint64(n[:], uint64(v))
+		h.Write(n[:])
+	}
+	for _, v := range [][]byte{[]byte(info.Source), []byte(info.Target), []byte(info.SDP), info.Candidate, info.Hello, info.Proof, []byte(info.OTP), info.TOTPSecret, info.NodeKey, info.Cert, info.Rotations} {
+		writeField(h, v)
+	}
+	// covered only if set, so the signatures of peers which don't know
+	// them still verify. A field set covers the ones before it too.
+	name := info.Name != ""
+	derp := len(info.DERPKey) > 0 || info.DERPRelay != "" || name
+	if info.Endpoint != "" || derp {
+		writeField(h, []byte(info.Endpoint))
+	}
+	if derp {
+		writeField(h, info.DERPKey)
+		writeField(h, []byte(info.DERPRelay))
+	}
+	if name {
+		writeField(h, []byte(info.Name))
+	}
+	return h.Sum(nil)
+}
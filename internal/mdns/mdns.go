@@ -0,0 +1,362 @@
+// Package mdns advertises and browses services on the local network with
+// multicast DNS (RFC 6762) and DNS service discovery (RFC 6763). It only
+// speaks IPv4 and knows the records a service instance needs: PTR, SRV,
+// TXT and A.
+package mdns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// group is the multicast address of mDNS
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const (
+	// domain of the names of mDNS
+	domain = "local."
+
+	// cacheFlush is set in the class of records which replace the ones
+	// cached for their name
+	cacheFlush = 1 << 15
+
+	// maxPacket bounds the packets read, larger ones are truncated
+	maxPacket = 9000
+)
+
+// Service is a service instance on the local network
+type Service struct {
+	// Instance is the name of the instance, a single label
+	Instance string
+
+	// Service is the type of the service, as _http._tcp
+	Service string
+
+	// Port is the port of the service
+	Port int
+
+	// Text holds the key=value pairs of the TXT record
+	Text []string
+
+	// Addrs are the addresses of the host of the instance. Instances
+	// found while browsing list the address they were sent from first.
+	Addrs []net.IP
+
+	// TTL is how long the instance is valid, zero for an instance leaving
+	// the network
+	TTL time.Duration
+}
+
+// Conn is a multicast DNS socket joined on the multicast interfaces of
+// the host
+type Conn struct {
+	conn   *net.UDPConn
+	pc     *ipv4.PacketConn
+	lock   sync.Mutex
+	joined map[int]net.Interface
+	local  *Service
+}
+
+// Listen joins the mDNS group on every interface up which supports
+// multicast. The port is shared with the other responders of the host.
+func Listen() (*Conn, error) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		conn:   conn,
+		pc:     ipv4.NewPacketConn(conn),
+		joined: make(map[int]net.Interface),
+	}
+	c.pc.SetMulticastTTL(255)
+	c.pc.SetMulticastLoopback(true)
+	if c.join() == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("no multicast interface")
+	}
+	return c, nil
+}
+
+// join joins the group on the interfaces which came up since the last
+// time and returns the number of interfaces joined
+func (c *Conn) join() int {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if _, ok := c.joined[ifi.Index]; ok || len(ipv4Addrs(&ifi)) == 0 {
+			continue
+		}
+		ifi := ifi
+		if c.pc.JoinGroup(&ifi, group) == nil {
+			c.joined[ifi.Index] = ifi
+		}
+	}
+	return len(c.joined)
+}
+
+// ipv4Addrs returns the IPv4 addresses of an interface
+func ipv4Addrs(ifi *net.Interface) []net.IP {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	var ret []net.IP
+	for _, v := range addrs {
+		if ipn, ok := v.(*net.IPNet); ok && ipn.IP.To4() != nil {
+			ret = append(ret, ipn.IP.To4())
+		}
+	}
+	return ret
+}
+
+// send writes a packet to the group on every joined interface, with the
+// addresses of the interface if the packet holds them
+func (c *Conn) send(build func(addrs []net.IP) ([]byte, error)) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var last error
+	sent := false
+	for _, ifi := range c.joined {
+		ifi := ifi
+		msg, err := build(ipv4Addrs(&ifi))
+		if err != nil {
+			return err
+		}
+		err = c.pc.SetMulticastInterface(&ifi)
+		if err == nil {
+			_, err = c.pc.WriteTo(msg, nil, group)
+		}
+		if err != nil {
+			last = err
+			continue
+		}
+		sent = true
+	}
+	if !sent && last != nil {
+		return last
+	}
+	return nil
+}
+
+// Close stops advertising the service and closes the socket
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	local := c.local
+	c.lock.Unlock()
+	if local != nil {
+		bye := *local
+		bye.TTL = 0
+		c.send(func(addrs []net.IP) ([]byte, error) {
+			return response(&bye, addrs)
+		})
+	}
+	return c.conn.Close()
+}
+
+// Advertise answers the queries of svc from now on and announces it. Its
+// addresses are the ones of each interface.
+func (c *Conn) Advertise(svc Service) error {
+	c.lock.Lock()
+	c.local = &svc
+	c.lock.Unlock()
+	return c.announce()
+}
+
+// announce sends the records of the advertised service unasked
+func (c *Conn) announce() error {
+	c.lock.Lock()
+	local := c.local
+	c.lock.Unlock()
+	if local == nil {
+		return nil
+	}
+	return c.send(func(addrs []net.IP) ([]byte, error) {
+		return response(local, addrs)
+	})
+}
+
+// Query asks for the instances of a service, the answers are passed to
+// the function given to Serve
+func (c *Conn) Query(service string) error {
+	c.join()
+	name, err := dnsmessage.NewName(service + "." + domain)
+	if err != nil {
+		return err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.StartQuestions()
+	err = b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return err
+	}
+	return c.send(func([]net.IP) ([]byte, error) {
+		return msg, nil
+	})
+}
+
+// Serve reads the packets of the group until the connection is closed. It
+// answers the queries of the advertised service and passes the instances
+// found in the answers of others to found.
+func (c *Conn) Serve(found func(Service)) error {
+	buf := make([]byte, maxPacket)
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		var msg dnsmessage.Message
+		if msg.Unpack(buf[:n]) != nil {
+			continue
+		}
+		if !msg.Header.Response {
+			if c.asked(msg.Questions) {
+				c.announce()
+			}
+			continue
+		}
+		for _, svc := range instances(&msg, from.IP) {
+			found(svc)
+		}
+	}
+}
+
+// asked reports whether questions ask for the advertised service or for
+// its instance
+func (c *Conn) asked(questions []dnsmessage.Question) bool {
+	c.lock.Lock()
+	local := c.local
+	c.lock.Unlock()
+	if local == nil {
+		return false
+	}
+	service := strings.ToLower(local.Service + "." + domain)
+	instance := strings.ToLower(instanceName(local))
+	for _, q := range questions {
+		name := strings.ToLower(q.Name.String())
+		if name == service || name == instance {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceName is the full name of the instance of a service
+func instanceName(svc *Service) string {
+	return strings.NewReplacer(".", "-", " ", "-").Replace(svc.Instance) + "." + svc.Service + "." + domain
+}
+
+// response builds the records of an instance for a host with addrs
+func response(svc *Service, addrs []net.IP) ([]byte, error) {
+	service, err := dnsmessage.NewName(svc.Service + "." + domain)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := dnsmessage.NewName(instanceName(svc))
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(strings.NewReplacer(".", "-", " ", "-").Replace(svc.Instance) + "." + domain)
+	if err != nil {
+		return nil, err
+	}
+	ttl := uint32(svc.TTL / time.Second)
+	header := func(name dnsmessage.Name, typ dnsmessage.Type, class dnsmessage.Class) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: class, TTL: ttl}
+	}
+	text := svc.Text
+	if len(text) == 0 {
+		text = []string{""}
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	b.EnableCompression()
+	b.StartAnswers()
+	err = b.PTRResource(header(service, dnsmessage.TypePTR, dnsmessage.ClassINET), dnsmessage.PTRResource{PTR: instance})
+	if err != nil {
+		return nil, err
+	}
+	b.StartAdditionals()
+	err = b.SRVResource(header(instance, dnsmessage.TypeSRV, dnsmessage.ClassINET|cacheFlush), dnsmessage.SRVResource{Target: host, Port: uint16(svc.Port)})
+	if err != nil {
+		return nil, err
+	}
+	err = b.TXTResource(header(instance, dnsmessage.TypeTXT, dnsmessage.ClassINET|cacheFlush), dnsmessage.TXTResource{TXT: text})
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range addrs {
+		var a dnsmessage.AResource
+		copy(a.A[:], ip.To4())
+		err = b.AResource(header(host, dnsmessage.TypeA, dnsmessage.ClassINET|cacheFlush), a)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// instances returns the service instances announced by a response
+func instances(msg *dnsmessage.Message, from net.IP) []Service {
+	records := append(append([]dnsmessage.Resource{}, msg.Answers...), msg.Additionals...)
+	hosts := make(map[string][]net.IP)
+	for _, r := range records {
+		if a, ok := r.Body.(*dnsmessage.AResource); ok {
+			name := strings.ToLower(r.Header.Name.String())
+			hosts[name] = append(hosts[name], net.IP(append([]byte{}, a.A[:]...)))
+		}
+	}
+	var ret []Service
+	for _, r := range records {
+		ptr, ok := r.Body.(*dnsmessage.PTRResource)
+		if !ok {
+			continue
+		}
+		service := strings.TrimSuffix(r.Header.Name.String(), "."+domain)
+		instance := ptr.PTR.String()
+		if !strings.HasSuffix(strings.ToLower(instance), "."+strings.ToLower(r.Header.Name.String())) {
+			continue
+		}
+		svc := Service{
+			Instance: instance[:len(instance)-len(r.Header.Name.String())-1],
+			Service:  service,
+			TTL:      time.Duration(r.Header.TTL) * time.Second,
+			Addrs:    []net.IP{from},
+		}
+		for _, v := range records {
+			if !strings.EqualFold(v.Header.Name.String(), instance) {
+				continue
+			}
+			switch body := v.Body.(type) {
+			case *dnsmessage.SRVResource:
+				svc.Port = int(body.Port)
+				for _, ip := range hosts[strings.ToLower(body.Target.String())] {
+					if !ip.Equal(from) {
+						svc.Addrs = append(svc.Addrs, ip)
+					}
+				}
+			case *dnsmessage.TXTResource:
+				svc.Text = body.TXT
+			}
+		}
+		ret = append(ret, svc)
+	}
+	return ret
+}
@@ -0,0 +1,101 @@
+package node
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+// expvar variables are global, they are published once
+var publishVars sync.Once
+
+func debugTokenFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "debug.token")
+}
+
+// DebugToken returns the token of the debug endpoints: DebugConf.Token, or
+// the random token saved in the state home, created if needed
+func DebugToken(dc conf.DebugConf) (string, error) {
+	if dc.Token != "" {
+		return dc.Token, nil
+	}
+	return savedToken(debugTokenFile())
+}
+
+// DebugAddr returns the address of the debug endpoints
+func DebugAddr(dc conf.DebugConf) string {
+	port := dc.Port
+	if port == 0 {
+		port = 2227
+	}
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+func (node *Node) publishVars() {
+	started := time.Now()
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("uptime", expvar.Func(func() interface{} {
+		return time.Since(started).Round(time.Second).String()
+	}))
+	expvar.Publish("sessions", expvar.Func(func() interface{} {
+		apps := make(map[string]int)
+		for _, v := range node.connMgr.Stats() {
+			apps[impl.AppName(v.ImplType)]++
+		}
+		return apps
+	}))
+}
+
+// ServeDebug serves the pprof and expvar endpoints on the loopback
+// interface, requests need the debug token
+func (node *Node) ServeDebug() {
+	dc := node.confManager.Conf.DebugConf
+	token, err := DebugToken(dc)
+	if err != nil {
+		logrus.Error("debug endpoints: ", err)
+		return
+	}
+	publishVars.Do(node.publishVars)
+	r := mux.NewRouter()
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	r.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	r.Handle("/debug/vars", expvar.Handler())
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got := r.URL.Query().Get("token")
+			if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+				got = strings.TrimPrefix(auth, "Bearer ")
+			}
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				http.Error(w, "invalid token", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	addr := DebugAddr(dc)
+	node.debug = &http.Server{Addr: addr, Handler: r}
+	logrus.Info("debug endpoints listen on ", addr)
+	err = node.debug.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		logrus.Error(err)
+	}
+}
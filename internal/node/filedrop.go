@@ -0,0 +1,213 @@
+package node
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/res"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	// maxFileDropUpload bounds the body of an upload
+	maxFileDropUpload = 4 << 30
+	// maxFileDropMemory is the part of an upload kept in memory, the rest
+	// goes to a temporary file
+	maxFileDropMemory = 32 << 20
+	// fileDropHeaderTimeout bounds the headers of a request
+	fileDropHeaderTimeout = 10 * time.Second
+	// fileDropReadTimeout bounds the read of a request, the largest upload
+	// over a slow network included
+	fileDropReadTimeout = 30 * time.Minute
+	// fileDropIdleTimeout closes the idle connections of browsers
+	fileDropIdleTimeout = 2 * time.Minute
+)
+
+var fileDropPage = template.Must(template.New("filedrop").Parse(res.FileDropPage))
+
+func fileDropTokenFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "filedrop.token")
+}
+
+// FileDropToken returns the token of the file drop page: FileDropConf.Token,
+// or the random token saved in the state home, created if needed
+func FileDropToken(fc conf.FileDropConf) (string, error) {
+	if fc.Token != "" {
+		return fc.Token, nil
+	}
+	return savedToken(fileDropTokenFile())
+}
+
+// savedToken returns the random token saved in file, created if needed
+func savedToken(file string) (string, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err == nil && len(strings.TrimSpace(string(bs))) > 0 {
+		return strings.TrimSpace(string(bs)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	buf := make([]byte, 16)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return "", err
+	}
+	return token, ioutil.WriteFile(file, []byte(token+"\n"), 0600)
+}
+
+// FileDropAddr returns the address of the file drop page
+func FileDropAddr(fc conf.FileDropConf) string {
+	if fc.ListenAddr == "" {
+		return ":2226"
+	}
+	return fc.ListenAddr
+}
+
+// ServeFileDrop serves a web page where a browser on the LAN can send files
+// to or fetch files from a peer through the transfer application, requests
+// need the file drop token
+func (node *Node) ServeFileDrop() {
+	fc := node.confManager.Conf.FileDropConf
+	token, err := FileDropToken(fc)
+	if err != nil {
+		logrus.Error("file drop: ", err)
+		return
+	}
+	addr := FileDropAddr(fc)
+	r := mux.NewRouter()
+	r.HandleFunc("/", node.fileDropIndex).Methods("GET")
+	r.HandleFunc("/upload", node.fileDropUpload).Methods("POST")
+	r.HandleFunc("/download", node.fileDropDownload).Methods("GET")
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(token)) != 1 {
+				http.Error(w, "invalid token", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	// downloads last as long as the transfers, writes are not timed
+	node.fileDrop = &http.Server{
+		Addr:              addr,
+		Handler:           r,
+		ReadHeaderTimeout: fileDropHeaderTimeout,
+		ReadTimeout:       fileDropReadTimeout,
+		IdleTimeout:       fileDropIdleTimeout,
+	}
+	logrus.Info("file drop listen on ", addr)
+	err = node.fileDrop.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		logrus.Error(err)
+	}
+}
+
+func (node *Node) fileDropIndex(w http.ResponseWriter, r *http.Request) {
+	err := fileDropPage.Execute(w, struct{ Token string }{r.URL.Query().Get("token")})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (node *Node) fileDropUpload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileDropUpload)
+	err := r.ParseMultipartForm(maxFileDropMemory)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	target := r.FormValue("target")
+	if target == "" {
+		http.Error(w, "device ID required", http.StatusBadRequest)
+		return
+	}
+	transfer := impl.NewTransfer(target, "", true, header)
+	if transfer == nil {
+		http.Error(w, "cannot create transfer", http.StatusInternalServerError)
+		return
+	}
+	defer transfer.Close()
+	sender := impl.NewSender(transfer, types.OPTION_TYPE_UP)
+	conn, err := sender.Send()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	transfer.SetConn(conn)
+	err = transfer.DoUpload(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	logrus.Debugf("file drop sent %s (%d) to %s", header.Filename, header.Size, target)
+	fmt.Fprintf(w, "%s (%d bytes) sent to %s\n", header.Filename, header.Size, target)
+}
+
+func (node *Node) fileDropDownload(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	filePath := r.URL.Query().Get("path")
+	if target == "" || filePath == "" {
+		http.Error(w, "device ID and path required", http.StatusBadRequest)
+		return
+	}
+	transfer := impl.NewTransfer(target, filePath, false, nil)
+	defer transfer.Close()
+	sender := impl.NewSender(transfer, types.OPTION_TYPE_UP)
+	conn, err := sender.Send()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	transfer.SetConn(conn)
+	aw := &attachmentWriter{w: w, name: filepath.Base(filePath)}
+	err = transfer.DoDownload(aw)
+	if err != nil {
+		logrus.Error("file drop download ", err)
+		if !aw.started {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+	}
+}
+
+// attachmentWriter only sends the download headers once data arrives, so
+// errors before that can still be reported to the browser
+type attachmentWriter struct {
+	w       http.ResponseWriter
+	name    string
+	started bool
+}
+
+func (aw *attachmentWriter) Write(b []byte) (int, error) {
+	if !aw.started {
+		aw.started = true
+		aw.w.Header().Set("Content-Type", "application/octet-stream")
+		aw.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", aw.name))
+	}
+	return aw.w.Write(b)
+}
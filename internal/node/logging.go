@@ -0,0 +1,76 @@
+package node
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+// ApplyLogConf sets the level, format and output of the logs. The file of
+// the previous settings is closed once the new output is in use.
+func (node *Node) ApplyLogConf(lc conf.LogConf) error {
+	level := logrus.InfoLevel
+	if lc.Level != "" {
+		var err error
+		level, err = logrus.ParseLevel(lc.Level)
+		if err != nil {
+			return err
+		}
+	}
+	if utils.DebugOn() {
+		level = logrus.DebugLevel
+	}
+	var formatter logrus.Formatter
+	switch strings.ToLower(lc.Format) {
+	case "", "text":
+		formatter = &logrus.TextFormatter{}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %s, use text or json", lc.Format)
+	}
+	var out io.Writer = os.Stderr
+	var file *utils.RotatingFile
+	if lc.File != "" {
+		backups := int(lc.MaxBackups)
+		if backups <= 0 {
+			backups = 3
+		}
+		var err error
+		file, err = utils.NewRotatingFile(lc.File, lc.MaxSize, backups)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+	node.logLock.Lock()
+	defer node.logLock.Unlock()
+	logrus.SetLevel(level)
+	logrus.SetFormatter(formatter)
+	logrus.SetOutput(out)
+	if node.logFile != nil {
+		node.logFile.Close()
+	}
+	node.logFile = file
+	return nil
+}
+
+// reloadLogConf applies the logging settings of the configure, as they are
+// when the request arrives
+func (node *Node) reloadLogConf() error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	err = node.ApplyLogConf(cm.Conf.LogConf)
+	if err != nil {
+		return err
+	}
+	logrus.Info("logging settings applied")
+	return nil
+}
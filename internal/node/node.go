@@ -3,8 +3,18 @@
 package node
 
 import (
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/audit"
 	"github.com/suutaku/sshx/internal/conn"
+	"github.com/suutaku/sshx/internal/utils"
 	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
 )
 
 // Node represents the main sshx node that coordinates all system components
@@ -17,28 +27,148 @@ type Node struct {
 	running bool
 	
 	// connMgr manages all connection services (direct TCP and WebRTC)
-	connMgr *conn.ConnectionManager
+	connMgr conn.Manager
+	
+	// fileDrop is the optional HTTP file drop endpoint
+	fileDrop *http.Server
+	
+	// debug is the optional pprof and expvar endpoint
+	debug *http.Server
+	
+	// outbox delivers messages queued for offline peers
+	outbox *impl.Outbox
+	
+	// remote applies the configure overlay of a managed fleet
+	remote *impl.RemoteSync
+	
+	// scheduler runs the tasks of scheduleconf
+	scheduler *impl.Scheduler
+	
+	// directory keeps the entry of this node in the peer directory
+	directory *impl.DirectoryAgent
+	
+	// standby replicates this node to its standby
+	standby *standbyServer
+	
+	// logFile is the file the logs are written to, if any
+	logFile *utils.RotatingFile
+	
+	// logLock serializes changes of the logging settings
+	logLock sync.Mutex
+	
+	// listener is the local port of the clients
+	listener net.Listener
 }
 
-func NewNode(home string) *Node {
-	cm := conf.NewConfManager(home)
+func NewNode(home string) (*Node, error) {
+	cm, err := conf.NewConfManager(home)
+	if err != nil {
+		return nil, err
+	}
+	// services read the configure again, they keep the profile the daemon
+	// started with even if the default profile changes
+	os.Setenv(conf.PROFILE_ENV, cm.Profile)
+	logrus.Info("use configure profile ", cm.Profile)
+	// the services and the requests of peers share the configure of the
+	// daemon, which alone watches the file
+	err = cm.Watch()
+	if err != nil {
+		logrus.Warn("changes of the configure need a restart: ", err)
+	}
+	conf.SetShared(cm)
 	enabledService := []conn.ConnectionService{
-		conn.NewDirectService(cm.Conf.ID),
-		conn.NewWebRTCService(cm.Conf.ID, cm.Conf.SignalingServerAddr, cm.Conf.RTCConf),
+		conn.NewDirectService(cm.Conf.ID, cm.Conf.PortMapConf),
+		conn.NewWebRTCService(cm.Conf.ID, cm.Conf.SignalingServerAddr, cm.Conf.SignalingToken, cm.Conf.RTCConf, cm.Conf.SignalingPollConf, cm.Conf.STUNProbeConf, cm.Conf.OutboundProxyConf, cm),
+	}
+	if cm.Conf.OverlayConf.Enabled {
+		enabledService = append(enabledService, conn.NewOverlayService(cm.Conf.ID, cm.Conf.OverlayConf))
 	}
-	return &Node{
+	if len(cm.Conf.DERPConf.URLs) > 0 {
+		enabledService = append(enabledService, conn.NewDERPService(cm.Conf.ID, cm.Conf.DERPConf, cm.Conf.OutboundProxyConf))
+	}
+	if cm.Conf.MeshConf.Enabled {
+		enabledService = append(enabledService, conn.NewMeshService(cm.Conf.ID, cm.Conf.MeshConf))
+	}
+	connMgr := conn.NewConnectionManager(enabledService)
+	connMgr.TransferManager().SetLimit(int(cm.Conf.TransferConf.MaxConcurrent))
+	connMgr.TransferManager().SetRateLimit(cm.Conf.TransferConf.RateLimit)
+	node := &Node{
 		confManager: cm,
-		connMgr:     conn.NewConnectionManager(enabledService),
+		connMgr:     connMgr,
+		outbox:      impl.NewOutbox(),
+		remote:      impl.NewRemoteSync(),
+		scheduler:   impl.NewScheduler(recordTask),
+		directory:   impl.NewDirectoryAgent(cm),
+		standby:     newStandbyServer(cm),
+	}
+	err = node.ApplyLogConf(cm.Conf.LogConf)
+	if err != nil {
+		return nil, err
+	}
+	err = impl.UnlockKeyStore("")
+	if err != nil {
+		logrus.Warn(err)
+		audit.Denied(audit.CATEGORY_KEYS, "keystore.unlock", "", "", err)
+	}
+	return node, nil
+}
+
+// recordTask records the run of a scheduled task with the events of the
+// daemon and exports it
+func recordTask(ev types.Event) {
+	conn.RecordEvent(ev)
+	outcome := audit.OUTCOME_SUCCESS
+	if ev.Kind == types.EVENT_TASK_FAILURE {
+		outcome = audit.OUTCOME_FAILURE
 	}
+	audit.Emit(audit.CATEGORY_TASK, "task.run", outcome, ev.TargetId, ev.App, ev.Message)
 }
 
-func (node *Node) Start() {
+// Start runs the services and serves the clients until Stop is called
+func (node *Node) Start() error {
 	node.running = true
 	go node.connMgr.Start()
-	node.ServeTCP()
+	if dc := node.confManager.Conf.DiscoveryConf; dc.Enabled {
+		err := node.connMgr.StartDiscovery(node.confManager.Conf.ID, dc)
+		if err != nil {
+			logrus.Warn("discovery on the local network: ", err)
+		}
+	}
+	if node.confManager.Conf.FileDropConf.Enabled {
+		go node.ServeFileDrop()
+	}
+	if node.confManager.Conf.DebugConf.Enabled {
+		go node.ServeDebug()
+	}
+	go node.outbox.Run()
+	go node.remote.Run()
+	go node.scheduler.Run()
+	go node.directory.Run()
+	go node.standby.Run()
+	return node.ServeTCP()
 }
 
 func (node *Node) Stop() {
 	node.running = false
+	if node.listener != nil {
+		node.listener.Close()
+	}
+	if node.fileDrop != nil {
+		node.fileDrop.Close()
+	}
+	if node.debug != nil {
+		node.debug.Close()
+	}
+	node.outbox.Close()
+	node.remote.Close()
+	node.scheduler.Close()
+	node.directory.Close()
+	node.standby.Close()
 	node.connMgr.Stop()
+	node.logLock.Lock()
+	if node.logFile != nil {
+		node.logFile.Close()
+		node.logFile = nil
+	}
+	node.logLock.Unlock()
 }
@@ -0,0 +1,14 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package node
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerUID returns the uid of the process at the other end of a Unix socket
+func peerUID(conn *net.UnixConn) (int, error) {
+	return -1, fmt.Errorf("the users of Unix sockets are not known on this system, the daemon can't be shared")
+}
@@ -0,0 +1,96 @@
+package node
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	"github.com/suutaku/sshx/internal/audit"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// listenShared opens the Unix socket of a shared daemon, any local user
+// may connect to it and its requests are checked against SharingConf.Users
+func (node *Node) listenShared() (net.Listener, error) {
+	path := node.confManager.Conf.SharingConf.Socket
+	if path == "" {
+		return nil, fmt.Errorf("sharingconf.socket is not set")
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	// the socket of a daemon which didn't stop cleanly
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("another daemon listens on %s", path)
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0666)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// authorize attributes a request received on the socket of a shared daemon
+// to the local user who sent it, and checks the user may make it. Requests
+// of the local TCP port aren't shared, they are not checked.
+func (node *Node) authorize(sock net.Conn, sender *impl.Sender) error {
+	uc, ok := sock.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	uid, err := peerUID(uc)
+	if err != nil {
+		return err
+	}
+	id := strconv.Itoa(uid)
+	name := id
+	if u, err := user.LookupId(id); err == nil {
+		name = u.Username
+	}
+	cm := node.confManager
+	scope := cm.FindUserScope(name, id)
+	admin := uid == 0 || uid == os.Getuid() || (scope != nil && scope.Admin)
+	sender.SetUser(name, !admin)
+	if admin {
+		return nil
+	}
+	app := impl.AppName(sender.GetAppCode())
+	if scope == nil {
+		err = fmt.Errorf("user %s may not use this daemon", name)
+		audit.Denied(audit.CATEGORY_AUTH, "local.request", "", app, err)
+		return err
+	}
+	switch sender.GetOptionCode() {
+	case types.OPTION_TYPE_UP, types.OPTION_TYPE_ATTACH:
+		peer := ""
+		if imp := sender.GetImpl(); imp != nil {
+			peer = cm.ResolvePeer(imp.HostId())
+		}
+		if !scope.Allows(cm, peer, app) {
+			err = fmt.Errorf("user %s may not open %s sessions with %s", name, app, peer)
+			audit.Denied(audit.CATEGORY_AUTH, "local.request", peer, app, err)
+			return err
+		}
+	case types.OPTION_TYPE_DOWN, types.OPTION_TYPE_PAUSE, types.OPTION_TYPE_RESUME:
+		// only the sessions of the user, the manager checks it
+	case types.OPTION_TYPE_STAT, types.OPTION_TYPE_LIST:
+		// the status only shows the sessions of the user
+	default:
+		err = fmt.Errorf("user %s is not an admin of this daemon", name)
+		audit.Denied(audit.CATEGORY_AUTH, "local.request", "", app, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,432 @@
+package node
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/e2e"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// standbyMagic starts the hellos of the replication
+	standbyMagic = "SSHXHA2\n"
+	// standbyLabel binds the keys of the replication to it
+	standbyLabel = "sshx standby"
+	// size of the nonces of the hellos
+	standbyNonceSize = 32
+	// maxStandbyFrame bounds the messages of the active daemon
+	maxStandbyFrame = 16 << 20
+	// standbyDialTimeout bounds the connection to the other daemon
+	standbyDialTimeout = 5 * time.Second
+)
+
+// standbyState is what the active daemon replicates: the configure of the
+// user, without the standby settings, and the key store
+type standbyState struct {
+	Format string
+	Config []byte
+	Files  map[string][]byte
+}
+
+// sum hashes the state, the files in the order of their names
+func (st *standbyState) sum() [sha256.Size]byte {
+	h := sha256.New()
+	field := func(bs []byte) {
+		binary.Write(h, binary.BigEndian, uint32(len(bs)))
+		h.Write(bs)
+	}
+	field([]byte(st.Format))
+	field(st.Config)
+	names := make([]string, 0, len(st.Files))
+	for k := range st.Files {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		field([]byte(k))
+		field(st.Files[k])
+	}
+	var ret [sha256.Size]byte
+	copy(ret[:], h.Sum(nil))
+	return ret
+}
+
+// standbyMessage is sent by the active daemon every heartbeat, with its
+// state when it changed since the last one
+type standbyMessage struct {
+	State *standbyState
+}
+
+// standbyTimes returns the heartbeat and the failover of sc, configures
+// older than the standby settings have none
+func standbyTimes(sc conf.StandbyConf) (time.Duration, time.Duration) {
+	heartbeat, failover := time.Duration(sc.Heartbeat)*time.Second, time.Duration(sc.Failover)*time.Second
+	if heartbeat <= 0 {
+		heartbeat = 2 * time.Second
+	}
+	if failover <= heartbeat {
+		failover = 5 * heartbeat
+	}
+	return heartbeat, failover
+}
+
+// standbyMarker tells the standby holds a replica, it may take over even if
+// it restarted since
+func standbyMarker() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "standby_synced")
+}
+
+// standbyKeys keeps the key stretched from the secret, stretching it for
+// each connection would cost the memory of argon2 each time
+var standbyKeys struct {
+	sync.Mutex
+	secret string
+	key    []byte
+}
+
+// standbyKey stretches secret with argon2 as passphrases of the key store,
+// so a recorded handshake doesn't let guess a weak secret quickly
+func standbyKey(secret string) []byte {
+	standbyKeys.Lock()
+	defer standbyKeys.Unlock()
+	if standbyKeys.key == nil || standbyKeys.secret != secret {
+		standbyKeys.secret = secret
+		standbyKeys.key = argon2.IDKey([]byte(secret), []byte(standbyLabel), 1, 64*1024, 4, chacha20poly1305.KeySize)
+	}
+	return standbyKeys.key
+}
+
+// standbyChannel exchanges the hellos of the replication on sock and
+// returns the sealing of the messages. The keys derive from the secret
+// both daemons share and the nonces of the hellos, a daemon with another
+// secret can't open a message. The dialer then proves it knows the secret
+// with a MAC of both hellos, the active daemon sends nothing before.
+func standbyChannel(sock net.Conn, secret string, dialer bool) (*e2e.Channel, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("standbyconf.secret is not set")
+	}
+	key := standbyKey(secret)
+	hello := make([]byte, len(standbyMagic)+standbyNonceSize)
+	copy(hello, standbyMagic)
+	_, err := rand.Read(hello[len(standbyMagic):])
+	if err != nil {
+		return nil, err
+	}
+	sock.SetDeadline(time.Now().Add(standbyDialTimeout))
+	defer sock.SetDeadline(time.Time{})
+	_, err = sock.Write(hello)
+	if err != nil {
+		return nil, err
+	}
+	peerHello := make([]byte, len(hello))
+	_, err = io.ReadFull(sock, peerHello)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(peerHello, []byte(standbyMagic)) {
+		return nil, fmt.Errorf("%s is not a standby daemon", sock.RemoteAddr())
+	}
+	transcript := append(append([]byte(standbyLabel), hello...), peerHello...)
+	if !dialer {
+		transcript = append(append([]byte(standbyLabel), peerHello...), hello...)
+	}
+	keys := make([]byte, 3*chacha20poly1305.KeySize)
+	_, err = io.ReadFull(hkdf.New(sha256.New, key, nil, transcript), keys)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, keys[2*chacha20poly1305.KeySize:])
+	mac.Write(transcript)
+	proof := mac.Sum(nil)
+	if dialer {
+		_, err = sock.Write(proof)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		peerProof := make([]byte, len(proof))
+		_, err = io.ReadFull(sock, peerProof)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(proof, peerProof) {
+			return nil, fmt.Errorf("%s does not know standbyconf.secret", sock.RemoteAddr())
+		}
+	}
+	dialerKey, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+	responderKey, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize : 2*chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+	if dialer {
+		return e2e.NewChannel(dialerKey, responderKey), nil
+	}
+	return e2e.NewChannel(responderKey, dialerKey), nil
+}
+
+func writeStandbyMessage(sock net.Conn, ch *e2e.Channel, msg *standbyMessage) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(msg)
+	if err != nil {
+		return err
+	}
+	sealed := ch.Seal(buf.Bytes())
+	frame := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+	_, err = sock.Write(append(frame, sealed...))
+	return err
+}
+
+func readStandbyMessage(sock net.Conn, ch *e2e.Channel) (*standbyMessage, error) {
+	var size [4]byte
+	_, err := io.ReadFull(sock, size[:])
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxStandbyFrame {
+		return nil, fmt.Errorf("standby message of %d bytes is too large", n)
+	}
+	sealed := make([]byte, n)
+	_, err = io.ReadFull(sock, sealed)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := ch.Open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	var msg standbyMessage
+	return &msg, gob.NewDecoder(bytes.NewReader(bs)).Decode(&msg)
+}
+
+// standbyServer replicates the active daemon to the standby
+type standbyServer struct {
+	cm   *conf.ConfManager
+	stop chan struct{}
+	once sync.Once
+}
+
+func newStandbyServer(cm *conf.ConfManager) *standbyServer {
+	return &standbyServer{
+		cm:   cm,
+		stop: make(chan struct{}),
+	}
+}
+
+// Run serves the standby until Close is called, it returns right away if
+// the daemon has no standby
+func (ss *standbyServer) Run() {
+	sc := ss.cm.Conf.StandbyConf
+	if sc.Role == "" {
+		return
+	}
+	l, err := net.Listen("tcp", sc.Listen)
+	if err != nil {
+		logrus.Error("standby: ", err)
+		return
+	}
+	go func() {
+		<-ss.stop
+		l.Close()
+	}()
+	logrus.Info("serve the standby on ", sc.Listen)
+	for {
+		sock, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ss.stop:
+				return
+			default:
+			}
+			logrus.Warn("standby: ", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go func() {
+			err := ss.serve(sock)
+			if err != nil {
+				logrus.Warn("standby ", sock.RemoteAddr(), ": ", err)
+			}
+		}()
+	}
+}
+
+// snapshot returns the state the standby replicates
+func (ss *standbyServer) snapshot() (*standbyState, error) {
+	format, config, err := ss.cm.ReplicaConfig()
+	if err != nil {
+		return nil, err
+	}
+	files, err := impl.ReadReplica()
+	if err != nil {
+		return nil, err
+	}
+	return &standbyState{Format: format, Config: config, Files: files}, nil
+}
+
+// serve sends the heartbeats of this daemon to a standby, with the state
+// once it changed
+func (ss *standbyServer) serve(sock net.Conn) error {
+	defer sock.Close()
+	sc := ss.cm.Conf.StandbyConf
+	ch, err := standbyChannel(sock, sc.Secret, false)
+	if err != nil {
+		return err
+	}
+	logrus.Info("standby ", sock.RemoteAddr(), " follows")
+	interval, _ := standbyTimes(sc)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var sent [sha256.Size]byte
+	for {
+		state, err := ss.snapshot()
+		if err != nil {
+			return err
+		}
+		msg := &standbyMessage{}
+		if sum := state.sum(); sum != sent {
+			msg.State, sent = state, sum
+		}
+		sock.SetWriteDeadline(time.Now().Add(interval + standbyDialTimeout))
+		err = writeStandbyMessage(sock, ch, msg)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ss.stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ss *standbyServer) Close() {
+	ss.once.Do(func() {
+		close(ss.stop)
+	})
+}
+
+func dialStandby(sc conf.StandbyConf) (net.Conn, *e2e.Channel, error) {
+	if sc.Peer == "" {
+		return nil, nil, fmt.Errorf("standbyconf.peer is not set")
+	}
+	sock, err := net.DialTimeout("tcp", sc.Peer, standbyDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch, err := standbyChannel(sock, sc.Secret, true)
+	if err != nil {
+		sock.Close()
+		return nil, nil, err
+	}
+	return sock, ch, nil
+}
+
+// follow applies the state of the active daemon until it stays silent for
+// standbyconf.failover seconds. It only returns then if this daemon holds
+// a replica, otherwise it waits for the active daemon.
+func follow(cm *conf.ConfManager, sock net.Conn, ch *e2e.Channel) error {
+	sc := cm.Conf.StandbyConf
+	heartbeat, failover := standbyTimes(sc)
+	last := time.Now()
+	for {
+		var err error
+		if sock == nil {
+			sock, ch, err = dialStandby(sc)
+		}
+		for err == nil {
+			var msg *standbyMessage
+			sock.SetReadDeadline(time.Now().Add(failover))
+			msg, err = readStandbyMessage(sock, ch)
+			if err != nil {
+				break
+			}
+			last = time.Now()
+			if msg.State == nil {
+				continue
+			}
+			err = applyStandbyState(cm, msg.State)
+			if err != nil {
+				logrus.Error("standby: ", err)
+				err = nil
+			}
+		}
+		if sock != nil {
+			sock.Close()
+			sock = nil
+		}
+		logrus.Debug("standby: ", err)
+		_, synced := os.Stat(standbyMarker())
+		if synced == nil && time.Since(last) >= failover {
+			logrus.Warn("the active daemon ", sc.Peer, " is silent for ", time.Since(last).Round(time.Second), ", take over")
+			return nil
+		}
+		time.Sleep(heartbeat)
+	}
+}
+
+// applyStandbyState saves the state the active daemon replicated
+func applyStandbyState(cm *conf.ConfManager, state *standbyState) error {
+	if len(state.Config) > 0 {
+		err := cm.ApplyReplica(state.Format, state.Config)
+		if err != nil {
+			return err
+		}
+	}
+	err := impl.WriteReplica(state.Files)
+	if err != nil {
+		return err
+	}
+	logrus.Info("replicated the active daemon")
+	return ioutil.WriteFile(standbyMarker(), []byte(time.Now().Format(time.RFC3339)), 0600)
+}
+
+// WaitStandby returns once the daemon of home should serve. A standby
+// follows the active daemon and returns when it fails. An active daemon
+// which failed finds the other one serving, it follows it as its standby
+// instead.
+func WaitStandby(home string) error {
+	cm, err := conf.NewConfManager(home)
+	if err != nil {
+		return err
+	}
+	sc := cm.Conf.StandbyConf
+	switch sc.Role {
+	case "":
+		return nil
+	case conf.STANDBY_ACTIVE:
+		sock, ch, err := dialStandby(sc)
+		if err != nil {
+			logrus.Debug("standby: ", err)
+			return nil
+		}
+		logrus.Warn(sc.Peer, " took over, follow it as the standby")
+		return follow(cm, sock, ch)
+	}
+	logrus.Info("standby of ", sc.Peer)
+	return follow(cm, nil, nil)
+}
@@ -0,0 +1,67 @@
+package node
+
+import (
+	"net"
+	"testing"
+
+	"github.com/suutaku/sshx/internal/e2e"
+)
+
+// standbyPair runs the handshake of a standby with secret dialing an active
+// daemon with activeSecret, the message of the active daemon is sent once
+// the handshake passed
+func standbyPair(t *testing.T, secret, activeSecret string) (net.Conn, *e2e.Channel, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	active := make(chan error, 1)
+	go func() {
+		sock, err := l.Accept()
+		if err != nil {
+			active <- err
+			return
+		}
+		defer sock.Close()
+		ch, err := standbyChannel(sock, activeSecret, false)
+		if err == nil {
+			err = writeStandbyMessage(sock, ch, &standbyMessage{State: &standbyState{Format: "json"}})
+		}
+		active <- err
+	}()
+	sock, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sock.Close() })
+	ch, err := standbyChannel(sock, secret, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sock, ch, <-active
+}
+
+func TestStandbyChannel(t *testing.T) {
+	sock, ch, err := standbyPair(t, "secret", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readStandbyMessage(sock, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.State == nil || msg.State.Format != "json" {
+		t.Fatalf("got %+v", msg)
+	}
+}
+
+func TestStandbyChannelWrongSecret(t *testing.T) {
+	sock, ch, err := standbyPair(t, "guess", "secret")
+	if err == nil {
+		t.Fatal("the active daemon accepted a standby with another secret")
+	}
+	if _, err := readStandbyMessage(sock, ch); err == nil {
+		t.Fatal("the active daemon sent a message to a standby with another secret")
+	}
+}
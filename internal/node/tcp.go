@@ -2,70 +2,173 @@ package node
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"net"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/conn"
 	"github.com/suutaku/sshx/pkg/impl"
 	"github.com/suutaku/sshx/pkg/types"
 )
 
-func (node *Node) ServeTCP() {
-	listenner, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", node.confManager.Conf.LocalTCPPort))
+// requestTimeout bounds the time a client takes to send its request
+const requestTimeout = 10 * time.Second
+
+// Listen opens the local port clients send their requests to, or the Unix
+// socket of a shared daemon. Start opens it if it isn't open yet.
+func (node *Node) Listen() error {
+	var listenner net.Listener
+	var err error
+	if node.confManager.Conf.SharingConf.Enabled {
+		listenner, err = node.listenShared()
+	} else {
+		listenner, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", node.confManager.Conf.LocalTCPPort))
+	}
 	if err != nil {
-		logrus.Error(err)
-		panic(err)
+		return err
+	}
+	node.listener = listenner
+	return nil
+}
+
+// ServeTCP serves the requests of the clients until Stop is called
+func (node *Node) ServeTCP() error {
+	if node.listener == nil {
+		err := node.Listen()
+		if err != nil {
+			return err
+		}
 	}
+	listenner := node.listener
 	defer listenner.Close()
 	for node.running {
 		sock, err := listenner.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
 			logrus.Error(err)
 			continue
 		}
-		tmp := impl.Sender{}
-		err = gob.NewDecoder(sock).Decode(&tmp)
+		// a client which doesn't send its request holds the listener
+		sock.SetReadDeadline(time.Now().Add(requestTimeout))
+		tmp, err := impl.DecodeSender(sock)
 		if err != nil {
 			logrus.Debug("read not ok", err)
 			sock.Close()
 			continue
 		}
+		sock.SetReadDeadline(time.Time{})
+		err = node.authorize(sock, &tmp)
+		if err != nil {
+			tmp.Log().Warn(err)
+			conn.Refuse(&tmp, sock, impl.Denied(err))
+			continue
+		}
 		switch tmp.GetOptionCode() {
 		case types.OPTION_TYPE_UP:
-			logrus.Debug("up option")
-			impl := tmp.GetImpl()
-			if impl == nil {
-				logrus.Error("unkwon implementation")
+			tmp.Log().Debug("up option")
+			imp := tmp.GetImpl()
+			if imp == nil {
+				tmp.Log().Error("unkwon implementation")
+				conn.Refuse(&tmp, sock, impl.ErrUnsupportedApp)
 				continue
 			}
-			poolId := types.NewPoolId(time.Now().UnixNano(), impl.Code())
+			poolId := types.NewPoolId(time.Now().UnixNano(), imp.Code())
 			err := node.connMgr.CreateConnection(&tmp, sock, *poolId)
 			if err != nil {
-				sock.Close()
-				logrus.Error(err)
+				conn.Refuse(&tmp, sock, err)
+				tmp.Log().Error(err)
 			}
 
 		case types.OPTION_TYPE_DOWN:
-			logrus.Debug("down option ", string(tmp.PairId))
+			tmp.Log().Debug("down option")
 			err := node.connMgr.DestroyConnection(&tmp, sock)
 			if err != nil {
-				logrus.Error(err)
+				conn.Refuse(&tmp, sock, err)
+				tmp.Log().Error(err)
 			}
 
 		case types.OPTION_TYPE_STAT:
-			logrus.Debug("stat option")
+			tmp.Log().Debug("stat option")
 			err := node.connMgr.Status(tmp, sock)
 			if err != nil {
 				sock.Close()
-				logrus.Error(err)
+				tmp.Log().Error(err)
 			}
 		case types.OPTION_TYPE_ATTACH:
-			logrus.Debug("attach option")
+			tmp.Log().Debug("attach option")
 			err := node.connMgr.AttachConnection(&tmp, sock)
 			if err != nil {
-				logrus.Error(err)
+				conn.Refuse(&tmp, sock, err)
+				tmp.Log().Error(err)
+			}
+		case types.OPTION_TYPE_LIST:
+			tmp.Log().Debug("list option")
+			err := node.connMgr.ListTransfers(tmp, sock)
+			if err != nil {
+				sock.Close()
+				tmp.Log().Error(err)
 			}
+		case types.OPTION_TYPE_PAUSE, types.OPTION_TYPE_RESUME:
+			tmp.Log().Debug("pause/resume option")
+			err := node.connMgr.PauseTransfer(&tmp, sock, tmp.GetOptionCode() == types.OPTION_TYPE_PAUSE)
+			if err != nil {
+				tmp.Log().Error(err)
+			}
+			sock.Close()
+		case types.OPTION_TYPE_PAIR:
+			tmp.Log().Debug("pair option")
+			go func(sender impl.Sender, sock net.Conn) {
+				err := node.connMgr.Pair(sender, sock)
+				if err != nil {
+					sender.Log().Error(err)
+				}
+			}(tmp, sock)
+		case types.OPTION_TYPE_KNOCK:
+			tmp.Log().Debug("knock option")
+			err := node.connMgr.Knock(tmp, sock)
+			if err != nil {
+				tmp.Log().Error(err)
+			}
+		case types.OPTION_TYPE_ACCESS:
+			tmp.Log().Debug("access option")
+			err := node.connMgr.Access(tmp, sock)
+			if err != nil {
+				tmp.Log().Error(err)
+			}
+		case types.OPTION_TYPE_IDENTITY:
+			tmp.Log().Debug("identity option")
+			err := node.connMgr.Identity(tmp, sock)
+			if err != nil {
+				tmp.Log().Error(err)
+			}
+		case types.OPTION_TYPE_HISTORY:
+			tmp.Log().Debug("history option")
+			err := node.connMgr.History(tmp, sock)
+			if err != nil {
+				tmp.Log().Error(err)
+			}
+		case types.OPTION_TYPE_DISCOVER:
+			tmp.Log().Debug("discover option")
+			go func(sender impl.Sender, sock net.Conn) {
+				err := node.connMgr.Discover(sender, sock)
+				if err != nil {
+					sender.Log().Error(err)
+				}
+			}(tmp, sock)
+		case types.OPTION_TYPE_LOG:
+			tmp.Log().Debug("log option")
+			err := node.reloadLogConf()
+			if err != nil {
+				tmp.Log().Error(err)
+				tmp.Status = -1
+			}
+			gob.NewEncoder(sock).Encode(&tmp)
+			sock.Close()
 		}
 	}
+	return nil
 }
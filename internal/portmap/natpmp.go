@@ -0,0 +1,97 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// natPMPPort is the port of NAT-PMP servers on the gateway
+	natPMPPort = 5351
+
+	// natPMPTries is the number of requests sent, the first waits 250ms
+	// for the answer and each next one twice longer
+	natPMPTries = 4
+
+	natPMPOpExternal = 0
+	natPMPOpMapTCP   = 2
+)
+
+// natPMP maps ports with the NAT Port Mapping Protocol, RFC 6886
+type natPMP struct {
+	gateway net.IP
+}
+
+// request sends msg to the gateway until it answers with a response of
+// size bytes to the operation of msg
+func (n *natPMP) request(msg []byte, size int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: n.gateway, Port: natPMPPort})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	wait := 250 * time.Millisecond
+	buf := make([]byte, 16)
+	for i := 0; i < natPMPTries; i++ {
+		_, err = conn.Write(msg)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(wait))
+		for {
+			var l int
+			l, err = conn.Read(buf)
+			if err != nil {
+				break
+			}
+			// responses are the operation plus 128
+			if l < size || buf[0] != 0 || buf[1] != msg[1]+128 {
+				continue
+			}
+			if code := binary.BigEndian.Uint16(buf[2:]); code != 0 {
+				return nil, fmt.Errorf("NAT-PMP result code %d", code)
+			}
+			return buf[:l], nil
+		}
+		wait *= 2
+	}
+	return nil, fmt.Errorf("no NAT-PMP answer from %s", n.gateway)
+}
+
+func (n *natPMP) externalIP() (net.IP, error) {
+	resp, err := n.request([]byte{0, natPMPOpExternal}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+func (n *natPMP) mapTCP(internal, external int, lease time.Duration) (int, time.Duration, error) {
+	msg := make([]byte, 12)
+	msg[1] = natPMPOpMapTCP
+	binary.BigEndian.PutUint16(msg[4:], uint16(internal))
+	binary.BigEndian.PutUint16(msg[6:], uint16(external))
+	binary.BigEndian.PutUint32(msg[8:], uint32(lease/time.Second))
+	resp, err := n.request(msg, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	port := int(binary.BigEndian.Uint16(resp[10:]))
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second
+	return port, granted, nil
+}
+
+func (n *natPMP) add(internal, external int, lease time.Duration) (int, time.Duration, error) {
+	if lease <= 0 {
+		// NAT-PMP has no permanent mappings, a lifetime of 0 deletes
+		lease = 24 * time.Hour
+	}
+	return n.mapTCP(internal, external, lease)
+}
+
+func (n *natPMP) remove(internal, external int) error {
+	_, _, err := n.mapTCP(internal, 0, 0)
+	return err
+}
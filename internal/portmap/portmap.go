@@ -0,0 +1,187 @@
+// Package portmap forwards a TCP port of the router to this device with
+// NAT-PMP or UPnP IGD, so peers reach its services from the internet
+// without STUN or TURN
+package portmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	PROTOCOL_NATPMP = "natpmp"
+	PROTOCOL_UPNP   = "upnp"
+)
+
+// description names the mappings of sshx in the tables of routers
+const description = "sshx"
+
+// mapper is a protocol of the router
+type mapper interface {
+	externalIP() (net.IP, error)
+	add(internal, external int, lease time.Duration) (int, time.Duration, error)
+	remove(internal, external int) error
+}
+
+// Mapping is a port of the router forwarded to a port of this device
+type Mapping struct {
+	Protocol     string
+	ExternalIP   net.IP
+	ExternalPort int
+	InternalPort int
+	// Lease is the lifetime the router granted, 0 for a permanent mapping
+	Lease time.Duration
+	m     mapper
+}
+
+// Endpoint returns the public address of the mapping
+func (m *Mapping) Endpoint() string {
+	return net.JoinHostPort(m.ExternalIP.String(), fmt.Sprint(m.ExternalPort))
+}
+
+// Map forwards a port of the router to the TCP port internal of this
+// device for lease. protocol is PROTOCOL_NATPMP or PROTOCOL_UPNP, the
+// first one the router answers if empty. external is the port asked for,
+// the router may give another one.
+func Map(protocol string, internal, external int, lease time.Duration) (*Mapping, error) {
+	var protocols []string
+	switch protocol {
+	case "":
+		protocols = []string{PROTOCOL_NATPMP, PROTOCOL_UPNP}
+	case PROTOCOL_NATPMP, PROTOCOL_UPNP:
+		protocols = []string{protocol}
+	default:
+		return nil, fmt.Errorf("unknown port mapping protocol %s", protocol)
+	}
+	var errs []string
+	for _, v := range protocols {
+		m, err := newMapper(v)
+		if err == nil {
+			var ret *Mapping
+			ret, err = mapPort(v, m, internal, external, lease)
+			if err == nil {
+				return ret, nil
+			}
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", v, err))
+	}
+	return nil, fmt.Errorf("cannot map port %d: %s", internal, strings.Join(errs, ", "))
+}
+
+func newMapper(protocol string) (mapper, error) {
+	if protocol == PROTOCOL_NATPMP {
+		gw, err := defaultGateway()
+		if err != nil {
+			return nil, err
+		}
+		return &natPMP{gateway: gw}, nil
+	}
+	return discoverIGD()
+}
+
+func mapPort(protocol string, m mapper, internal, external int, lease time.Duration) (*Mapping, error) {
+	ip, err := m.externalIP()
+	if err != nil {
+		return nil, err
+	}
+	if !ip.IsGlobalUnicast() || isPrivate(ip) {
+		// the router is behind another NAT, the port wouldn't be reachable
+		return nil, fmt.Errorf("external address %s of the router is not public", ip)
+	}
+	port, granted, err := m.add(internal, external, lease)
+	if err != nil {
+		return nil, err
+	}
+	return &Mapping{
+		Protocol:     protocol,
+		ExternalIP:   ip,
+		ExternalPort: port,
+		InternalPort: internal,
+		Lease:        granted,
+		m:            m,
+	}, nil
+}
+
+// Renew extends the lease of the mapping, the router may give another
+// external port or address
+func (m *Mapping) Renew() error {
+	ip, err := m.m.externalIP()
+	if err != nil {
+		return err
+	}
+	port, granted, err := m.m.add(m.InternalPort, m.ExternalPort, m.Lease)
+	if err != nil {
+		return err
+	}
+	m.ExternalIP, m.ExternalPort, m.Lease = ip, port, granted
+	return nil
+}
+
+// Delete removes the mapping from the router
+func (m *Mapping) Delete() error {
+	return m.m.remove(m.InternalPort, m.ExternalPort)
+}
+
+// isPrivate reports whether ip is an address of private networks, or of
+// the shared address space of carrier grade NATs
+func isPrivate(ip net.IP) bool {
+	for _, v := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(v)
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultGateway returns the IPv4 address of the default gateway, from the
+// routing table on Linux, or the first address of the network of this
+// device, where routers usually are, elsewhere
+func defaultGateway() (net.IP, error) {
+	if f, err := os.Open("/proc/net/route"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			// Iface Destination Gateway ...
+			if len(fields) < 3 || fields[1] != "00000000" {
+				continue
+			}
+			bs, err := hex.DecodeString(fields[2])
+			if err != nil || len(bs) != net.IPv4len {
+				continue
+			}
+			// the table is in host byte order, little endian
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(bs))
+			return ip, nil
+		}
+	}
+	ip := localIPv4()
+	if ip == nil {
+		return nil, fmt.Errorf("no IPv4 network")
+	}
+	ip[3] = 1
+	return ip, nil
+}
+
+// localIPv4 returns the address of this device on the network of the
+// default route
+func localIPv4() net.IP {
+	conn, err := net.Dial("udp4", "192.0.2.1:9")
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	ip := conn.LocalAddr().(*net.UDPAddr).IP.To4()
+	if ip == nil {
+		return nil
+	}
+	return append(net.IP{}, ip...)
+}
@@ -0,0 +1,300 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ssdpAddr is the multicast address of SSDP, the discovery of UPnP
+	ssdpAddr = "239.255.255.250:1900"
+
+	// upnpTimeout bounds the discovery and each request to the router
+	upnpTimeout = 3 * time.Second
+
+	// upnpPortTries is the number of external ports tried when the one
+	// asked is mapped to another device
+	upnpPortTries = 8
+
+	// UPnP errors of AddPortMapping
+	upnpConflict      = 718
+	upnpOnlyPermanent = 725
+)
+
+// upnpDevices are the search targets of internet gateway devices
+var upnpDevices = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+}
+
+// upnpServices are the services of gateways which map ports
+var upnpServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:",
+	"urn:schemas-upnp-org:service:WANPPPConnection:",
+}
+
+// upnpIGD maps ports with the WAN connection service of an UPnP internet
+// gateway device
+type upnpIGD struct {
+	control string
+	service string
+	// local is the address of this device on the network of the gateway
+	local string
+}
+
+// upnpDevice is the part of device descriptions listing services
+type upnpDevice struct {
+	Services []struct {
+		Type    string `xml:"serviceType"`
+		Control string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// find returns the control URL and type of the first service of the
+// device, or of its devices, which maps ports
+func (d *upnpDevice) find() (string, string) {
+	for _, s := range d.Services {
+		for _, v := range upnpServices {
+			if strings.HasPrefix(s.Type, v) {
+				return s.Control, s.Type
+			}
+		}
+	}
+	for i := range d.Devices {
+		if control, service := d.Devices[i].find(); control != "" {
+			return control, service
+		}
+	}
+	return "", ""
+}
+
+// discoverIGD finds the internet gateway device of the network with SSDP
+func discoverIGD() (*upnpIGD, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range upnpDevices {
+		msg := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddr + "\r\n" +
+			"ST: " + v + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n\r\n"
+		_, err = conn.WriteTo([]byte(msg), dst)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(upnpTimeout))
+	buf := make([]byte, 2048)
+	tried := make(map[string]bool)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, fmt.Errorf("no UPnP gateway found")
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" || tried[location] {
+			continue
+		}
+		tried[location] = true
+		igd, err := describeIGD(location)
+		if err == nil {
+			return igd, nil
+		}
+	}
+}
+
+// describeIGD reads the description of the gateway at location
+func describeIGD(location string) (*upnpIGD, error) {
+	client := http.Client{Timeout: upnpTimeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var desc struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	err = xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&desc)
+	if err != nil {
+		return nil, err
+	}
+	control, service := desc.Device.find()
+	if control == "" {
+		return nil, fmt.Errorf("%s maps no ports", location)
+	}
+	base := location
+	if desc.URLBase != "" {
+		base = desc.URLBase
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	controlURL, err := baseURL.Parse(control)
+	if err != nil {
+		return nil, err
+	}
+	// the address of this device the gateway reaches
+	conn, err := net.DialTimeout("tcp", controlURL.Host, upnpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	local := conn.LocalAddr().(*net.TCPAddr).IP.String()
+	conn.Close()
+	return &upnpIGD{
+		control: controlURL.String(),
+		service: service,
+		local:   local,
+	}, nil
+}
+
+// upnpError is the fault of a failed SOAP action
+type upnpError struct {
+	Code        int
+	Description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+// call calls the SOAP action of the service with args, name and value
+// pairs, and returns the values of the response by name
+func (u *upnpIGD) call(action string, args ...string) (map[string]string, error) {
+	body := bytes.NewBuffer(nil)
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(body, `<u:%s xmlns:u="%s">`, action, u.service)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(body, "<%s>", args[i])
+		xml.EscapeText(body, []byte(args[i+1]))
+		fmt.Fprintf(body, "</%s>", args[i])
+	}
+	fmt.Fprintf(body, "</u:%s></s:Body></s:Envelope>", action)
+	req, err := http.NewRequest(http.MethodPost, u.control, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, u.service, action))
+	client := http.Client{Timeout: upnpTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	values, err := soapValues(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		code, _ := strconv.Atoi(values["errorCode"])
+		return nil, &upnpError{Code: code, Description: values["errorDescription"]}
+	}
+	return values, nil
+}
+
+// soapValues returns the text of the elements of a SOAP response without
+// children, by local name
+func soapValues(r io.Reader) (map[string]string, error) {
+	ret := make(map[string]string)
+	dec := xml.NewDecoder(r)
+	var name string
+	var text []byte
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name, text = t.Name.Local, nil
+		case xml.CharData:
+			text = append(text, t...)
+		case xml.EndElement:
+			if name == t.Name.Local {
+				ret[name] = strings.TrimSpace(string(text))
+			}
+			name = ""
+		}
+	}
+}
+
+func (u *upnpIGD) externalIP() (net.IP, error) {
+	values, err := u.call("GetExternalIPAddress")
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(values["NewExternalIPAddress"])
+	if ip == nil {
+		return nil, fmt.Errorf("gateway has no external address")
+	}
+	return ip, nil
+}
+
+func (u *upnpIGD) addPort(internal, external int, lease time.Duration) error {
+	_, err := u.call("AddPortMapping",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(external),
+		"NewProtocol", "TCP",
+		"NewInternalPort", strconv.Itoa(internal),
+		"NewInternalClient", u.local,
+		"NewEnabled", "1",
+		"NewPortMappingDescription", description,
+		"NewLeaseDuration", strconv.Itoa(int(lease/time.Second)),
+	)
+	return err
+}
+
+func (u *upnpIGD) add(internal, external int, lease time.Duration) (int, time.Duration, error) {
+	var err error
+	for i := 0; i < upnpPortTries; i++ {
+		port := external + i
+		err = u.addPort(internal, port, lease)
+		if ue, ok := err.(*upnpError); ok && ue.Code == upnpOnlyPermanent && lease > 0 {
+			lease = 0
+			err = u.addPort(internal, port, lease)
+		}
+		if ue, ok := err.(*upnpError); ok && ue.Code == upnpConflict {
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		return port, lease, nil
+	}
+	return 0, 0, err
+}
+
+func (u *upnpIGD) remove(internal, external int) error {
+	_, err := u.call("DeletePortMapping",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(external),
+		"NewProtocol", "TCP",
+	)
+	return err
+}
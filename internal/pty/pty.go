@@ -0,0 +1,2 @@
+// Package pty runs commands on pseudo terminals
+package pty
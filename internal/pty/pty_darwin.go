@@ -0,0 +1,43 @@
+package pty
+
+import (
+	"bytes"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// open opens a master and its slave
+func open() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	tty, err := openSlave(int(master.Fd()))
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, tty, nil
+}
+
+func openSlave(fd int) (*os.File, error) {
+	err := unix.IoctlSetInt(fd, unix.TIOCPTYGRANT, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.IoctlSetInt(fd, unix.TIOCPTYUNLK, 0)
+	if err != nil {
+		return nil, err
+	}
+	name := make([]byte, 128)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(unix.TIOCPTYGNAME), uintptr(unsafe.Pointer(&name[0])))
+	if errno != 0 {
+		return nil, errno
+	}
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return os.OpenFile(string(name), os.O_RDWR|unix.O_NOCTTY, 0)
+}
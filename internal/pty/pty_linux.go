@@ -0,0 +1,31 @@
+package pty
+
+import (
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// open opens a master and its slave
+func open() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	fd := int(master.Fd())
+	err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0)
+	if err == nil {
+		var n int
+		n, err = unix.IoctlGetInt(fd, unix.TIOCGPTN)
+		if err == nil {
+			var tty *os.File
+			tty, err = os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|unix.O_NOCTTY, 0)
+			if err == nil {
+				return master, tty, nil
+			}
+		}
+	}
+	master.Close()
+	return nil, nil, err
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package pty
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Start is only supported on Linux and macOS
+func Start(cmd *exec.Cmd) (*os.File, error) {
+	return nil, fmt.Errorf("pseudo terminals are not supported on this system")
+}
+
+// Resize is only supported on Linux and macOS
+func Resize(master *os.File, cols, rows int) error {
+	return fmt.Errorf("pseudo terminals are not supported on this system")
+}
@@ -0,0 +1,44 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package pty
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Start runs cmd on a new pseudo terminal, as the leader of its own session
+// with the terminal as its controlling one, and returns the master side
+func Start(cmd *exec.Cmd) (*os.File, error) {
+	master, tty, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	// the descriptor of the terminal in the child, its stdin
+	cmd.SysProcAttr.Ctty = 0
+	err = cmd.Start()
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	return master, nil
+}
+
+// Resize sets the size of the terminal of master
+func Resize(master *os.File, cols, rows int) error {
+	return unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, &unix.Winsize{
+		Col: uint16(cols),
+		Row: uint16(rows),
+	})
+}
@@ -0,0 +1,241 @@
+// Package rsync implements the rsync block matching algorithm: the receiver
+// describes the blocks of the file it already has, the sender scans its own
+// copy with a rolling checksum and only emits the bytes that did not match.
+package rsync
+
+import (
+	"bufio"
+	"crypto/md5"
+	"fmt"
+	"io"
+)
+
+const DefaultBlockSize = 64 * 1024
+
+// MinBlockSize and MaxBlockSize bound the block sizes a peer may ask for,
+// small blocks make huge signature lists and large ones huge buffers
+const (
+	MinBlockSize = 1 << 10
+	MaxBlockSize = 1 << 20
+)
+
+// BlockSignature identifies one block of the receiver's file
+type BlockSignature struct {
+	Index  int64
+	Weak   uint32
+	Strong [md5.Size]byte
+}
+
+// Operation is a single delta instruction. A non-negative Block copies that
+// block from the receiver's base file, otherwise Data is written literally.
+type Operation struct {
+	Block int64
+	Data  []byte
+}
+
+// weak rolling checksum from the rsync paper
+type rollsum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollsum(block []byte) rollsum {
+	var r rollsum
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += uint32(len(block)-i) * uint32(c)
+	}
+	r.n = uint32(len(block))
+	return r
+}
+
+func (r *rollsum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r rollsum) sum() uint32 {
+	return (r.a & 0xffff) | (r.b << 16)
+}
+
+// Signature reads base and returns the signature of every block
+func Signature(base io.Reader, blockSize int) ([]BlockSignature, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	ret := make([]BlockSignature, 0)
+	buf := make([]byte, blockSize)
+	for idx := int64(0); ; idx++ {
+		n, err := io.ReadFull(base, buf)
+		if n > 0 {
+			ret = append(ret, BlockSignature{
+				Index:  idx,
+				Weak:   newRollsum(buf[:n]).sum(),
+				Strong: md5.Sum(buf[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Delta scans target against the signatures of the receiver's file and calls
+// emit for every operation needed to rebuild target. Literal data is
+// coalesced into operations of at most blockSize bytes.
+func Delta(sigs []BlockSignature, target io.Reader, blockSize int, emit func(Operation) error) error {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	table := make(map[uint32][]BlockSignature, len(sigs))
+	for _, s := range sigs {
+		table[s.Weak] = append(table[s.Weak], s)
+	}
+	rd := bufio.NewReaderSize(target, 4*blockSize)
+	literal := make([]byte, 0, blockSize)
+	flush := func() error {
+		if len(literal) == 0 {
+			return nil
+		}
+		data := make([]byte, len(literal))
+		copy(data, literal)
+		literal = literal[:0]
+		return emit(Operation{Block: -1, Data: data})
+	}
+
+	// window holds the bytes currently covered by the rolling checksum
+	window := make([]byte, 0, 2*blockSize)
+	fill := func() error {
+		for len(window) < blockSize {
+			c, err := rd.ReadByte()
+			if err != nil {
+				return err
+			}
+			window = append(window, c)
+		}
+		return nil
+	}
+
+	err := fill()
+	for err == nil {
+		rs := newRollsum(window)
+		for {
+			if block, ok := match(table, rs.sum(), window); ok {
+				if err := flush(); err != nil {
+					return err
+				}
+				if err := emit(Operation{Block: block}); err != nil {
+					return err
+				}
+				window = window[:0]
+				break
+			}
+			out := window[0]
+			literal = append(literal, out)
+			if len(literal) == blockSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			in, rerr := rd.ReadByte()
+			if rerr != nil {
+				window = window[1:]
+				err = rerr
+				break
+			}
+			window = append(window[1:], in)
+			rs.roll(out, in)
+		}
+		if err == nil {
+			err = fill()
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+
+	// the tail is shorter than a block, it can still match the last block
+	if len(window) > 0 {
+		if block, ok := match(table, newRollsum(window).sum(), window); ok {
+			if err := flush(); err != nil {
+				return err
+			}
+			return emit(Operation{Block: block})
+		}
+		for len(window) > 0 {
+			n := blockSize - len(literal)
+			if n > len(window) {
+				n = len(window)
+			}
+			literal = append(literal, window[:n]...)
+			window = window[n:]
+			if len(literal) == blockSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return flush()
+}
+
+func match(table map[uint32][]BlockSignature, weak uint32, window []byte) (int64, bool) {
+	candidates, ok := table[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := md5.Sum(window)
+	for _, c := range candidates {
+		if c.Strong == strong {
+			return c.Index, true
+		}
+	}
+	return 0, false
+}
+
+// Patcher rebuilds a file from the receiver's base file and a stream of
+// operations
+type Patcher struct {
+	base      io.ReaderAt
+	out       io.Writer
+	blockSize int
+	buf       []byte
+	Matched   int64
+	Literal   int64
+}
+
+func NewPatcher(base io.ReaderAt, out io.Writer, blockSize int) *Patcher {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	return &Patcher{
+		base:      base,
+		out:       out,
+		blockSize: blockSize,
+		buf:       make([]byte, blockSize),
+	}
+}
+
+func (p *Patcher) Apply(op Operation) error {
+	if op.Block < 0 {
+		n, err := p.out.Write(op.Data)
+		p.Literal += int64(n)
+		return err
+	}
+	if p.base == nil {
+		return fmt.Errorf("block %d requested without base file", op.Block)
+	}
+	n, err := p.base.ReadAt(p.buf, op.Block*int64(p.blockSize))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("block %d out of range", op.Block)
+	}
+	n, err = p.out.Write(p.buf[:n])
+	p.Matched += int64(n)
+	return err
+}
@@ -0,0 +1,79 @@
+package rsync
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+const testBlockSize = MinBlockSize
+
+func randomBytes(seed int64, n int) []byte {
+	buf := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(buf)
+	return buf
+}
+
+// roundTrip rebuilds target from base through Signature, Delta and Patcher
+func roundTrip(t *testing.T, base, target []byte) *Patcher {
+	sigs, err := Signature(bytes.NewReader(base), testBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	p := NewPatcher(bytes.NewReader(base), &out, testBlockSize)
+	err = Delta(sigs, bytes.NewReader(target), testBlockSize, p.Apply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), target) {
+		t.Fatalf("rebuilt %d bytes differ from the %d bytes of target", out.Len(), len(target))
+	}
+	return p
+}
+
+func TestRoundTrip(t *testing.T) {
+	base := randomBytes(1, 8*testBlockSize)
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	tests := []struct {
+		name    string
+		base    []byte
+		target  []byte
+		matched int64
+		literal int64
+	}{
+		{"identical", base, base, int64(len(base)), 0},
+		{"insertion", base, join(base[:3*testBlockSize+100], []byte("inserted"), base[3*testBlockSize+100:]),
+			int64(7 * testBlockSize), int64(testBlockSize + len("inserted"))},
+		{"deletion", base, join(base[:2*testBlockSize], base[3*testBlockSize:]),
+			int64(7 * testBlockSize), 0},
+		{"short final block", base[:5*testBlockSize+10], base[:5*testBlockSize+10],
+			int64(5*testBlockSize + 10), 0},
+		{"short final block changed", base[:5*testBlockSize+10], join(base[:5*testBlockSize], []byte("0123456789")),
+			int64(5 * testBlockSize), 10},
+		{"empty basis", nil, base, 0, int64(len(base))},
+		{"empty target", base, nil, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := roundTrip(t, tt.base, tt.target)
+			if p.Matched != tt.matched || p.Literal != tt.literal {
+				t.Fatalf("matched %d and literal %d bytes, want %d and %d", p.Matched, p.Literal, tt.matched, tt.literal)
+			}
+		})
+	}
+}
+
+func TestPatcherOutOfRange(t *testing.T) {
+	var out bytes.Buffer
+	p := NewPatcher(bytes.NewReader(randomBytes(2, testBlockSize)), &out, testBlockSize)
+	if err := p.Apply(Operation{Block: 1}); err == nil {
+		t.Fatal("a block past the end of the base file is applied")
+	}
+	p = NewPatcher(nil, &out, testBlockSize)
+	if err := p.Apply(Operation{Block: 0}); err == nil {
+		t.Fatal("a block is applied without base file")
+	}
+}
@@ -0,0 +1,52 @@
+// Package serial opens serial devices in raw mode
+package serial
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Mode is the line settings of a serial device
+type Mode struct {
+	Baud     int
+	DataBits int
+	// Parity is 'N', 'E' or 'O'
+	Parity   byte
+	StopBits int
+	// RTSCTS enables hardware flow control
+	RTSCTS bool
+}
+
+// DefaultMode is 115200 bauds, 8N1 without flow control
+var DefaultMode = Mode{Baud: 115200, DataBits: 8, Parity: 'N', StopBits: 1}
+
+// ParseFraming sets the data bits, parity and stop bits of the mode from
+// their short form, as 8N1 or 7E2
+func (m *Mode) ParseFraming(framing string) error {
+	framing = strings.ToUpper(framing)
+	if len(framing) != 3 {
+		return fmt.Errorf("invalid framing %q, want as 8N1", framing)
+	}
+	dataBits, err := strconv.Atoi(framing[:1])
+	if err != nil || dataBits < 5 || dataBits > 8 {
+		return fmt.Errorf("invalid data bits in %q", framing)
+	}
+	if strings.IndexByte("NEO", framing[1]) < 0 {
+		return fmt.Errorf("invalid parity in %q", framing)
+	}
+	stopBits, err := strconv.Atoi(framing[2:])
+	if err != nil || stopBits < 1 || stopBits > 2 {
+		return fmt.Errorf("invalid stop bits in %q", framing)
+	}
+	m.DataBits, m.Parity, m.StopBits = dataBits, framing[1], stopBits
+	return nil
+}
+
+func (m Mode) String() string {
+	ret := fmt.Sprintf("%d %d%c%d", m.Baud, m.DataBits, m.Parity, m.StopBits)
+	if m.RTSCTS {
+		ret += " rtscts"
+	}
+	return ret
+}
@@ -0,0 +1,22 @@
+package serial
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	getTermios = unix.TIOCGETA
+	setTermios = unix.TIOCSETA
+)
+
+// setSpeed sets any speed, the driver refuses the ones it doesn't support
+func setSpeed(t *unix.Termios, baud int) error {
+	if baud <= 0 {
+		return fmt.Errorf("unsupported speed %d", baud)
+	}
+	t.Ispeed = uint64(baud)
+	t.Ospeed = uint64(baud)
+	return nil
+}
@@ -0,0 +1,45 @@
+package serial
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	getTermios = unix.TCGETS
+	setTermios = unix.TCSETS
+)
+
+// bauds are the standard speeds, the termios of Linux has no other
+var bauds = map[int]uint32{
+	1200:    unix.B1200,
+	2400:    unix.B2400,
+	4800:    unix.B4800,
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	500000:  unix.B500000,
+	576000:  unix.B576000,
+	921600:  unix.B921600,
+	1000000: unix.B1000000,
+	1500000: unix.B1500000,
+	2000000: unix.B2000000,
+	3000000: unix.B3000000,
+}
+
+func setSpeed(t *unix.Termios, baud int) error {
+	speed, ok := bauds[baud]
+	if !ok {
+		return fmt.Errorf("unsupported speed %d", baud)
+	}
+	t.Cflag &^= unix.CBAUD
+	t.Cflag |= speed
+	t.Ispeed = speed
+	t.Ospeed = speed
+	return nil
+}
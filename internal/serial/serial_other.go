@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package serial
+
+import (
+	"fmt"
+	"os"
+)
+
+// Open is only supported on Linux and macOS
+func Open(path string, m Mode) (*os.File, error) {
+	return nil, fmt.Errorf("serial devices are not supported on this system")
+}
@@ -0,0 +1,68 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package serial
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Open opens a serial device in raw mode with the settings of m. The file
+// is non blocking, so closing it ends pending reads.
+func Open(path string, m Mode) (*os.File, error) {
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = setMode(fd, m)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+func setMode(fd int, m Mode) error {
+	t, err := unix.IoctlGetTermios(fd, getTermios)
+	if err != nil {
+		return err
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF | unix.IXANY | unix.INPCK
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB | unix.CRTSCTS
+	t.Cflag |= unix.CREAD | unix.CLOCAL
+	switch m.DataBits {
+	case 5:
+		t.Cflag |= unix.CS5
+	case 6:
+		t.Cflag |= unix.CS6
+	case 7:
+		t.Cflag |= unix.CS7
+	default:
+		t.Cflag |= unix.CS8
+	}
+	switch m.Parity {
+	case 'E':
+		t.Cflag |= unix.PARENB
+		t.Iflag |= unix.INPCK
+	case 'O':
+		t.Cflag |= unix.PARENB | unix.PARODD
+		t.Iflag |= unix.INPCK
+	}
+	if m.StopBits == 2 {
+		t.Cflag |= unix.CSTOPB
+	}
+	if m.RTSCTS {
+		t.Cflag |= unix.CRTSCTS
+	}
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	err = setSpeed(t, m.Baud)
+	if err != nil {
+		return err
+	}
+	return unix.IoctlSetTermios(fd, setTermios, t)
+}
@@ -0,0 +1,184 @@
+package sshxtest
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/suutaku/sshx/internal/conn"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// MockService is a conn.ConnectionService whose CreateConnection calls
+// CreateFunc, nil refuses every connection. It records the senders it was
+// asked to connect.
+type MockService struct {
+	ID         string
+	CreateFunc func(ctx context.Context, sender *impl.Sender, sock net.Conn, poolId types.PoolId) error
+
+	ready   bool
+	stm     *conn.StatManager
+	knocks  *conn.KnockQueue
+	senders []*impl.Sender
+	lock    sync.Mutex
+}
+
+var _ conn.ConnectionService = (*MockService)(nil)
+
+func (ms *MockService) Id() string {
+	return ms.ID
+}
+
+func (ms *MockService) Start() error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.ready = true
+	return nil
+}
+
+func (ms *MockService) Stop() {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.ready = false
+}
+
+func (ms *MockService) IsReady() bool {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.ready
+}
+
+func (ms *MockService) SetStateManager(stm *conn.StatManager) error {
+	ms.stm = stm
+	return nil
+}
+
+// StateManager returns where the pairs of the service go
+func (ms *MockService) StateManager() *conn.StatManager {
+	return ms.stm
+}
+
+func (ms *MockService) SetKnockQueue(kq *conn.KnockQueue) {
+	ms.knocks = kq
+}
+
+// KnockQueue returns where the inbound sessions of the service wait
+func (ms *MockService) KnockQueue() *conn.KnockQueue {
+	return ms.knocks
+}
+
+func (ms *MockService) CreateConnection(ctx context.Context, sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
+	ms.lock.Lock()
+	ms.senders = append(ms.senders, sender)
+	ms.lock.Unlock()
+	if ms.CreateFunc == nil {
+		return &impl.Error{Kind: impl.ErrPeerOffline}
+	}
+	return ms.CreateFunc(ctx, sender, sock, poolId)
+}
+
+// Senders returns the senders CreateConnection was called with
+func (ms *MockService) Senders() []*impl.Sender {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return append([]*impl.Sender(nil), ms.senders...)
+}
+
+// MockManager is a conn.Manager which answers every request with the
+// status of Err, or success if it is nil, and records the requests
+type MockManager struct {
+	Err error
+
+	tfm      *conn.TransferManager
+	requests []impl.Sender
+	lock     sync.Mutex
+}
+
+var _ conn.Manager = (*MockManager)(nil)
+
+// answer records the request of sender and answers it on sock
+func (mm *MockManager) answer(sender *impl.Sender, sock net.Conn) error {
+	mm.lock.Lock()
+	mm.requests = append(mm.requests, *sender)
+	mm.lock.Unlock()
+	conn.Refuse(sender, sock, mm.Err)
+	return nil
+}
+
+// Requests returns the requests the manager answered
+func (mm *MockManager) Requests() []impl.Sender {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	return append([]impl.Sender(nil), mm.requests...)
+}
+
+func (mm *MockManager) Start() {}
+
+func (mm *MockManager) Stop() {}
+
+func (mm *MockManager) StartDiscovery(id string, dc conf.DiscoveryConf) error {
+	return nil
+}
+
+func (mm *MockManager) Stats() []types.Status {
+	return nil
+}
+
+func (mm *MockManager) TransferManager() *conn.TransferManager {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+	if mm.tfm == nil {
+		mm.tfm = conn.NewTransferManager(0)
+	}
+	return mm.tfm
+}
+
+func (mm *MockManager) CreateConnection(sender *impl.Sender, sock net.Conn, poolId types.PoolId) error {
+	return mm.answer(sender, sock)
+}
+
+func (mm *MockManager) DestroyConnection(sender *impl.Sender, conn net.Conn) error {
+	return mm.answer(sender, conn)
+}
+
+func (mm *MockManager) AttachConnection(sender *impl.Sender, sock net.Conn) error {
+	return mm.answer(sender, sock)
+}
+
+func (mm *MockManager) Status(sender impl.Sender, conn net.Conn) error {
+	return mm.answer(&sender, conn)
+}
+
+func (mm *MockManager) ListTransfers(sender impl.Sender, conn net.Conn) error {
+	return mm.answer(&sender, conn)
+}
+
+func (mm *MockManager) PauseTransfer(sender *impl.Sender, conn net.Conn, pause bool) error {
+	return mm.answer(sender, conn)
+}
+
+func (mm *MockManager) Pair(sender impl.Sender, conn net.Conn) error {
+	return mm.answer(&sender, conn)
+}
+
+func (mm *MockManager) Access(sender impl.Sender, conn net.Conn) error {
+	return mm.answer(&sender, conn)
+}
+
+func (mm *MockManager) History(sender impl.Sender, conn net.Conn) error {
+	return mm.answer(&sender, conn)
+}
+
+func (mm *MockManager) Discover(sender impl.Sender, conn net.Conn) error {
+	return mm.answer(&sender, conn)
+}
+
+func (mm *MockManager) Identity(sender impl.Sender, conn net.Conn) error {
+	return mm.answer(&sender, conn)
+}
+
+func (mm *MockManager) Knock(sender impl.Sender, conn net.Conn) error {
+	return mm.answer(&sender, conn)
+}
@@ -0,0 +1,95 @@
+// Package sshxtest runs sshx nodes in one process for tests: a Network
+// connects the connection managers of its nodes over in-memory pipes,
+// Signaling is a signaling server for the tests of the WebRTC service and
+// MockService and MockManager stand for a transport and for the manager.
+//
+//	n := sshxtest.NewNetwork()
+//	defer n.Close()
+//	a, b := n.Node("a"), n.Node("b")
+//	conn, err := sshxtest.Dial(a, impl.NewForward("b", "127.0.0.1:5432"))
+//
+// Nothing leaves the process but what the impls themselves dial, the
+// configure of the impls is still the one of SSHX_HOME, point it to a
+// temporary directory.
+package sshxtest
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/suutaku/sshx/internal/conn"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// Network is a set of nodes reaching each other by their IDs
+type Network struct {
+	hub   *conn.LoopbackHub
+	nodes map[string]*conn.ConnectionManager
+	lock  sync.Mutex
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		hub:   conn.NewLoopbackHub(),
+		nodes: make(map[string]*conn.ConnectionManager),
+	}
+}
+
+// Node returns the connection manager of the node id, started with a
+// loopback service on its first call
+func (n *Network) Node(id string) *conn.ConnectionManager {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	cm := n.nodes[id]
+	if cm == nil {
+		cm = conn.NewConnectionManager([]conn.ConnectionService{conn.NewLoopbackService(n.hub, id)})
+		cm.Start()
+		n.nodes[id] = cm
+	}
+	return cm
+}
+
+// Close stops the nodes
+func (n *Network) Close() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for id, cm := range n.nodes {
+		cm.Stop()
+		delete(n.nodes, id)
+	}
+}
+
+// Dial asks cm to connect imp to imp.HostId() as the daemon does for the
+// request of a local client, and returns the stream of the client. The
+// request goes through its wire encoding so cm gets its own impl.
+func Dial(cm *conn.ConnectionManager, imp impl.Impl) (net.Conn, error) {
+	buf := bytes.NewBuffer(nil)
+	err := impl.NewSender(imp, types.OPTION_TYPE_UP).Encode(buf)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := impl.DecodeSender(buf)
+	if err != nil {
+		return nil, err
+	}
+	client, sock := net.Pipe()
+	poolId := types.NewPoolId(time.Now().UnixNano(), imp.Code())
+	err = cm.CreateConnection(&sender, sock, *poolId)
+	if err != nil {
+		go conn.Refuse(&sender, sock, err)
+	}
+	res, err := impl.DecodeSender(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	err = impl.StatusError(res.Status)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
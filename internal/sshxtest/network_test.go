@@ -0,0 +1,123 @@
+package sshxtest
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+func TestMain(m *testing.M) {
+	home, err := ioutil.TempDir("", "sshxtest")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("SSHX_HOME", home)
+	cm, err := conf.NewConfManager(home)
+	if err == nil {
+		err = cm.SetValue("forwardconf.enabled", true)
+	}
+	if err == nil {
+		err = cm.SetValue("forwardconf.allow", []string{"127.0.0.1:*"})
+	}
+	if err != nil {
+		panic(err)
+	}
+	conf.SetShared(cm)
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// echo serves an echo on a local port until the test ends
+func echo(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// forward dials addr from a through b as a forward client does
+func forward(t *testing.T, n *Network, addr string) (net.Conn, *bufio.Reader, impl.ForwardReply) {
+	c, err := Dial(n.Node("a"), impl.NewForward("b", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	err = gob.NewEncoder(c).Encode(impl.ForwardRequest{Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(c)
+	var reply impl.ForwardReply
+	err = gob.NewDecoder(reader).Decode(&reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, reader, reply
+}
+
+func TestNetworkForward(t *testing.T) {
+	n := NewNetwork()
+	defer n.Close()
+	n.Node("b")
+	c, reader, reply := forward(t, n, echo(t))
+	if !reply.Ready {
+		t.Fatalf("forward refused: %s", reply.Error)
+	}
+	msg := []byte("hello through the loopback")
+	_, err := c.Write(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	_, err = io.ReadFull(reader, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(msg) {
+		t.Fatalf("got %q, want %q", got, msg)
+	}
+}
+
+func TestNetworkForwardDenied(t *testing.T) {
+	n := NewNetwork()
+	defer n.Close()
+	n.Node("b")
+	_, _, reply := forward(t, n, "192.0.2.1:22")
+	if reply.Ready || reply.Error == "" {
+		t.Fatalf("forward to an address out of forwardconf.allow is served")
+	}
+}
+
+func TestNetworkUnknownNode(t *testing.T) {
+	n := NewNetwork()
+	defer n.Close()
+	c, err := Dial(n.Node("a"), impl.NewForward("nowhere", echo(t)))
+	if err == nil {
+		c.Close()
+		t.Fatal("dial of a node out of the network succeeded")
+	}
+}
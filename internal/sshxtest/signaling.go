@@ -0,0 +1,111 @@
+package sshxtest
+
+import (
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// signalingQueue bounds the messages waiting for a peer, as the signaling
+// server does
+const signalingQueue = 64
+
+// Signaling is an in-process signaling server with the push and pull API
+// of cmd/signaling, set URL as the signaling server of the nodes under test
+type Signaling struct {
+	URL string
+	// Token is the tenant token the requests must carry, none when empty
+	Token string
+
+	server *httptest.Server
+	queues map[string]chan types.SignalingInfo
+	lock   sync.Mutex
+}
+
+// NewSignaling starts a signaling server on a local port
+func NewSignaling() *Signaling {
+	sg := &Signaling{
+		queues: make(map[string]chan types.SignalingInfo),
+	}
+	sg.server = httptest.NewServer(sg)
+	sg.URL = sg.server.URL
+	return sg
+}
+
+// Close stops the server
+func (sg *Signaling) Close() {
+	sg.server.Close()
+}
+
+func (sg *Signaling) queue(id string) chan types.SignalingInfo {
+	sg.lock.Lock()
+	defer sg.lock.Unlock()
+	q := sg.queues[id]
+	if q == nil {
+		q = make(chan types.SignalingInfo, signalingQueue)
+		sg.queues[id] = q
+	}
+	return q
+}
+
+// Pending returns the number of messages waiting for id
+func (sg *Signaling) Pending(id string) int {
+	return len(sg.queue(id))
+}
+
+func (sg *Signaling) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if sg.Token != "" && r.Header.Get("Authorization") != "Bearer "+sg.Token {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch parts[0] {
+	case "pull":
+		sg.pull(w, r, parts[1])
+	case "push":
+		sg.push(w, r, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// pull answers the next message of id, or nothing if none waits
+func (sg *Signaling) pull(w http.ResponseWriter, r *http.Request, id string) {
+	select {
+	case v := <-sg.queue(id):
+		if strings.Contains(r.Header.Get("Accept"), types.WIRE_CONTENT_TYPE) {
+			w.Header().Add("Content-Type", types.WIRE_CONTENT_TYPE)
+			types.WriteSignalingInfo(w, &v)
+			return
+		}
+		w.Header().Add("Content-Type", "application/binary")
+		gob.NewEncoder(w).Encode(v)
+	default:
+	}
+}
+
+// push queues a message for id
+func (sg *Signaling) push(w http.ResponseWriter, r *http.Request, id string) {
+	info, err := types.DecodeSignalingInfo(r.Body)
+	if err == types.ErrTooLarge {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	select {
+	case sg.queue(id) <- info:
+	default:
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	}
+}
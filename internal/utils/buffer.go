@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// BufferSize is the size of the pooled buffers of the data path
+	BufferSize = 32 * 1024
+
+	// spliceChunk is the most a spliced copy moves before its count is
+	// updated
+	spliceChunk = 1 << 20
+
+	// idleBufferSize is the buffer of copies while little data flows, a
+	// buffer of the pool is only held by copies filling their reads
+	idleBufferSize = 2 << 10
+)
+
+var buffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, BufferSize)
+		return &buf
+	},
+}
+
+// GetBuffer returns a buffer of BufferSize bytes from the pool, it goes
+// back with PutBuffer once unused
+func GetBuffer() *[]byte {
+	return buffers.Get().(*[]byte)
+}
+
+func PutBuffer(buf *[]byte) {
+	buffers.Put(buf)
+}
+
+// spliceable reports whether the kernel can move the data of src to dst by
+// itself, TCP connections splice from TCP connections and send files
+func spliceable(dst io.Writer, src io.Reader) bool {
+	if _, ok := dst.(*net.TCPConn); !ok {
+		return false
+	}
+	switch src.(type) {
+	case *net.TCPConn, *os.File:
+		return true
+	}
+	return false
+}
+
+// Copy copies src to dst up until EOF as io.Copy does. TCP to TCP copies
+// are spliced by the kernel where it can. Other copies read into a small
+// buffer, and into a buffer of the pool while their reads fill it, so
+// idle connections don't hold large buffers.
+// count, if not nil, is added the bytes copied as they are written.
+func Copy(dst io.Writer, src io.Reader, count *int64) (int64, error) {
+	if spliceable(dst, src) {
+		return spliceCopy(dst, src, count)
+	}
+	small := make([]byte, idleBufferSize)
+	var pooled *[]byte
+	defer func() {
+		if pooled != nil {
+			PutBuffer(pooled)
+		}
+	}()
+	var written int64
+	for {
+		buf := small
+		if pooled != nil {
+			buf = *pooled
+		}
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			written += int64(nw)
+			if count != nil {
+				atomic.AddInt64(count, int64(nw))
+			}
+			if werr != nil {
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		switch {
+		case pooled == nil && nr == len(small):
+			pooled = GetBuffer()
+		case pooled != nil && nr < idleBufferSize:
+			PutBuffer(pooled)
+			pooled = nil
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// spliceCopy lets the ReadFrom of a TCP connection splice src, by chunks
+// so the count follows
+func spliceCopy(dst io.Writer, src io.Reader, count *int64) (int64, error) {
+	var written int64
+	for {
+		n, err := io.Copy(dst, &io.LimitedReader{R: src, N: spliceChunk})
+		written += n
+		if count != nil {
+			atomic.AddInt64(count, n)
+		}
+		if err != nil || n < spliceChunk {
+			return written, err
+		}
+	}
+}
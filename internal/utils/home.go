@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SYSTEM_HOME holds the system-wide configure, which the configure of users
+// overlays, and everything sshx keeps when it runs as root
+const SYSTEM_HOME = "/etc/sshx"
+
+// GetSSHXHome returns the directory of the configure: SSHX_HOME if set, the
+// system home for root and the XDG configure directory of other users
+func GetSSHXHome() string {
+	if home := os.Getenv("SSHX_HOME"); home != "" {
+		return home
+	}
+	if os.Geteuid() == 0 {
+		return SYSTEM_HOME
+	}
+	return xdgDir("XDG_CONFIG_HOME", ".config")
+}
+
+var sharedState struct {
+	once   sync.Once
+	shared bool
+}
+
+// GetSSHXStateHome returns the directory of the data sshx keeps, like keys,
+// messages and recordings. Users share the system home with the daemon of a
+// system install if they may write it, so both see the same keys and tokens.
+func GetSSHXStateHome() string {
+	if home := os.Getenv("SSHX_HOME"); home != "" {
+		return home
+	}
+	if os.Geteuid() == 0 {
+		return SYSTEM_HOME
+	}
+	sharedState.once.Do(func() {
+		sharedState.shared = systemHomeWritable()
+	})
+	if sharedState.shared {
+		return SYSTEM_HOME
+	}
+	return xdgDir("XDG_STATE_HOME", filepath.Join(".local", "state"))
+}
+
+// systemHomeWritable reports whether the system home holds a configure and
+// may be written by this user, as installers set it up
+func systemHomeWritable() bool {
+	files, _ := filepath.Glob(filepath.Join(SYSTEM_HOME, ".sshx_config.*"))
+	if len(files) == 0 {
+		return false
+	}
+	f, err := ioutil.TempFile(SYSTEM_HOME, ".sshx_probe")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return true
+}
+
+// xdgDir returns the sshx directory of an XDG base directory, relative
+// values are invalid by the specification and ignored
+func xdgDir(env, fallback string) string {
+	dir := os.Getenv(env)
+	if dir == "" || !filepath.IsAbs(dir) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return SYSTEM_HOME
+		}
+		dir = filepath.Join(home, fallback)
+	}
+	return filepath.Join(dir, "sshx")
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RotatingFile is a log file renamed to name.1 when it grows over maxSize,
+// older files are shifted to name.2 and so on up to the number of backups
+type RotatingFile struct {
+	name    string
+	maxSize int64
+	backups int
+	lock    sync.Mutex
+	file    *os.File
+	size    int64
+}
+
+func NewRotatingFile(name string, maxSize int64, backups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		name:    name,
+		maxSize: maxSize,
+		backups: backups,
+	}
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return rf, rf.open()
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *RotatingFile) rotate() error {
+	rf.file.Close()
+	rf.file = nil
+	for i := rf.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.name, i), fmt.Sprintf("%s.%d", rf.name, i+1))
+	}
+	if rf.backups > 0 {
+		os.Rename(rf.name, rf.name+".1")
+	} else {
+		os.Remove(rf.name)
+	}
+	return rf.open()
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		err := rf.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// proxyTimeout bounds the connection to the proxy and its answer
+const proxyTimeout = 10 * time.Second
+
+// OutboundProxy picks the proxy of outbound connections and connects
+// through it
+type OutboundProxy struct {
+	proxy func(*url.URL) (*url.URL, error)
+}
+
+// NewOutboundProxy returns the proxy at proxyURL, an http, https or socks5
+// URL with an optional user:password, which hosts of noProxy are reached
+// without. Without proxyURL the HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+// variables of the environment are used.
+func NewOutboundProxy(proxyURL string, noProxy []string) (*OutboundProxy, error) {
+	if proxyURL == "" {
+		return &OutboundProxy{proxy: httpproxy.FromEnvironment().ProxyFunc()}, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %v", proxyURL, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy %s: unknown scheme %s", proxyURL, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy %s: no host", proxyURL)
+	}
+	cfg := httpproxy.Config{
+		HTTPProxy:  proxyURL,
+		HTTPSProxy: proxyURL,
+		NoProxy:    strings.Join(noProxy, ","),
+	}
+	return &OutboundProxy{proxy: cfg.ProxyFunc()}, nil
+}
+
+// Proxy returns the proxy of a request, nil if it goes directly, as
+// http.Transport asks it
+func (op *OutboundProxy) Proxy(req *http.Request) (*url.URL, error) {
+	return op.proxy(req.URL)
+}
+
+// HTTPClient returns a client sending its requests through the proxy
+func (op *OutboundProxy) HTTPClient(timeout time.Duration) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = op.Proxy
+	return &http.Client{Transport: t, Timeout: timeout}
+}
+
+// Dial connects to the TCP address addr through the proxy, HTTP ones with
+// CONNECT, or directly if there is none for addr
+func (op *OutboundProxy) Dial(network, addr string) (net.Conn, error) {
+	// the proxy of a TCP address is the one of the HTTPS requests to it
+	p, err := op.proxy(&url.URL{Scheme: "https", Host: addr})
+	if err != nil {
+		return nil, err
+	}
+	direct := &net.Dialer{Timeout: proxyTimeout}
+	if p == nil {
+		return direct.Dial(network, addr)
+	}
+	if p.Scheme == "socks5" || p.Scheme == "socks5h" {
+		d, err := proxy.FromURL(p, direct)
+		if err != nil {
+			return nil, err
+		}
+		return d.Dial(network, addr)
+	}
+	return dialConnect(p, addr)
+}
+
+// dialConnect opens a tunnel to addr with the CONNECT method of the HTTP
+// proxy p
+func dialConnect(p *url.URL, addr string) (net.Conn, error) {
+	port := p.Port()
+	if port == "" {
+		port = "80"
+		if p.Scheme == "https" {
+			port = "443"
+		}
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(p.Hostname(), port), proxyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(proxyTimeout))
+	if p.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: p.Hostname()})
+		err = tc.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s: %v", p.Host, err)
+		}
+		conn = tc
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.User != nil {
+		password, _ := p.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(p.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", p.Host, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", p.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused %s: %s", p.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// the server spoke first, its bytes were read with the answer
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads the bytes read ahead from the connection first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.r.Read(p)
+}
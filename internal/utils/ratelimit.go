@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting throughput to a number of bytes per
+// second, a nil or zero rate limiter never blocks
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (rl *RateLimiter) SetRate(rate int64) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.rate = rate
+	if rl.tokens > float64(rate) {
+		rl.tokens = float64(rate)
+	}
+}
+
+func (rl *RateLimiter) Rate() int64 {
+	if rl == nil {
+		return 0
+	}
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.rate
+}
+
+// Wait blocks until n bytes may pass. Callers going over the budget are
+// delayed in the order they arrive.
+func (rl *RateLimiter) Wait(n int) {
+	if rl == nil || n <= 0 {
+		return
+	}
+	rl.lock.Lock()
+	if rl.rate <= 0 {
+		rl.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * float64(rl.rate)
+	// allow bursts of at most one second
+	if rl.tokens > float64(rl.rate) {
+		rl.tokens = float64(rl.rate)
+	}
+	rl.last = now
+	rl.tokens -= float64(n)
+	var delay time.Duration
+	if rl.tokens < 0 {
+		delay = time.Duration(-rl.tokens / float64(rl.rate) * float64(time.Second))
+	}
+	rl.lock.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// ParseByteSize parses sizes like "512K", "5M" or "1.5G" into bytes
+func ParseByteSize(input string) (int64, error) {
+	str := strings.TrimSpace(strings.ToUpper(input))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "/S"), "B")
+	mult := float64(1)
+	if len(str) > 0 {
+		switch str[len(str)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			str = str[:len(str)-1]
+		}
+	}
+	val, err := strconv.ParseFloat(str, 64)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("invalid size %q", input)
+	}
+	return int64(val * mult), nil
+}
+
+// FormatByteSize formats bytes in the units ParseByteSize reads
+func FormatByteSize(size int64) string {
+	units := []string{"K", "M", "G"}
+	if size < 1<<10 {
+		return fmt.Sprintf("%dB", size)
+	}
+	val := float64(size)
+	unit := ""
+	for _, v := range units {
+		if val < 1<<10 {
+			break
+		}
+		val /= 1 << 10
+		unit = v
+	}
+	return fmt.Sprintf("%.1f%sB", val, unit)
+}
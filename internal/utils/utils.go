@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
@@ -20,13 +21,13 @@ func PipeWR(reader1, reader2 io.Reader, writer1, writer2 io.Writer) error {
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		_, err := io.Copy(writer1, reader2)
+		_, err := Copy(writer1, reader2, nil)
 		errCh <- err
 	}()
 
 	go func() {
 		defer wg.Done()
-		_, err := io.Copy(writer2, reader1)
+		_, err := Copy(writer2, reader1, nil)
 		errCh <- err
 	}()
 	wg.Wait()
@@ -34,37 +35,50 @@ func PipeWR(reader1, reader2 io.Reader, writer1, writer2 io.Writer) error {
 }
 
 func Pipe(con1 *net.Conn, con2 *net.Conn) error {
-	errCh := make(chan error, 2)
-	var wg sync.WaitGroup
-	wg.Add(2)
+	return PipeCounted(con1, con2, nil, nil)
+}
+
+// PipeCounted pipes con1 and con2 as Pipe does, and adds the bytes written
+// to con1 and con2 to toCon1 and toCon2 if they are not nil. One direction
+// is copied by the calling goroutine, so a pipe holds a single goroutine
+// of its own. Both connections are closed once either direction ends.
+func PipeCounted(con1 *net.Conn, con2 *net.Conn, toCon1, toCon2 *int64) error {
+	errCh := make(chan error, 1)
 	go func() {
-		defer wg.Done()
-		_, err := io.Copy(*con1, *con2)
-		if err != nil {
-			errCh <- err
-		}
-		if con1 != nil {
-			(*con1).Close()
-		}
-		if con2 != nil {
-			(*con2).Close()
-		}
+		_, err := Copy(*con1, *con2, toCon1)
+		(*con1).Close()
+		(*con2).Close()
+		errCh <- err
 	}()
+	_, err := Copy(*con2, *con1, toCon2)
+	(*con1).Close()
+	(*con2).Close()
+	if err2 := <-errCh; err == nil {
+		err = err2
+	}
+	return err
+}
+
+// WithContext runs f, which uses conn, and unblocks it by closing conn
+// once ctx is done. It returns the error of ctx if it is done.
+func WithContext(ctx context.Context, conn net.Conn, f func() error) error {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
 	go func() {
-		defer wg.Done()
-		_, err := io.Copy(*con2, *con1)
-		if err != nil {
-			errCh <- err
-		}
-		if con1 != nil {
-			(*con1).Close()
-		}
-		if con2 != nil {
-			(*con2).Close()
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
 		}
 	}()
-	wg.Wait()
-	return <-errCh
+	err := f()
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
 
 func ToNetConn(wsconn *websocket.Conn) *net.Conn {
@@ -91,14 +105,6 @@ func DebugOn() bool {
 	return false
 }
 
-func GetSSHXHome() string {
-	home := os.Getenv("SSHX_HOME")
-	if home == "" {
-		home = "/etc/sshx"
-	}
-	return home
-}
-
 func GetLocalIP() string {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
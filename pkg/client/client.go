@@ -0,0 +1,141 @@
+// Package client is the Go API of sshx, for programs which reach the
+// devices of the address book through the daemon of this device instead of
+// running the sshx command:
+//
+//	c, err := client.New(client.Options{})
+//	...
+//	s, err := c.SSH(ctx, "alice@laptop", &ssh.ClientConfig{Auth: auth})
+//	...
+//	defer s.Close()
+//	out, err := s.Output(ctx, "uptime")
+//
+// Every call which connects takes a context and returns its errors, nothing
+// of the package exits the process, logs or changes the logger of the
+// process. The daemon must be running, as for the sshx command.
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+// Classes of the errors of the calls which connect, test them with
+// errors.Is
+var (
+	// ErrPeerOffline is returned when the peer can't be reached
+	ErrPeerOffline = impl.ErrPeerOffline
+	// ErrDenied is returned when the peer or this device refused
+	ErrDenied = impl.ErrDenied
+	// ErrDaemonUnreachable is returned when the daemon isn't running
+	ErrDaemonUnreachable = impl.ErrDaemonUnreachable
+	// ErrTimeout is returned when the connection wasn't set up in time
+	ErrTimeout = impl.ErrTimeout
+	// ErrUnsupportedApp is returned when the daemon is too old for a call
+	ErrUnsupportedApp = impl.ErrUnsupportedApp
+)
+
+// Logger receives the errors of the background work of a client, as the
+// connections of tunnels. *log.Logger is one.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Options sets up a client
+type Options struct {
+	// Home is the directory of the configure, the one of sshx when empty.
+	// It is set in SSHX_HOME, the configure is global to the process.
+	Home string
+
+	// OneTimeCode returns the one-time code of the devices which ask this
+	// device for one, as set by sshx totp enroll. Dials to them fail
+	// without it.
+	OneTimeCode func(ctx context.Context, id string) (string, error)
+
+	// Logger receives the errors of the background work, they are
+	// dropped when it is nil
+	Logger Logger
+}
+
+// Client connects to the devices of the address book through the daemon
+type Client struct {
+	cm   *conf.ConfManager
+	opts Options
+}
+
+// New loads the configure of opts.Home, it doesn't connect to the daemon
+func New(opts Options) (*Client, error) {
+	if opts.Home != "" {
+		err := os.Setenv("SSHX_HOME", opts.Home)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cm, err := conf.NewConfManager(opts.Home)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{cm: cm, opts: opts}, nil
+}
+
+// ID returns the device ID of this device
+func (c *Client) ID() string {
+	return c.cm.Conf.ID
+}
+
+// Peers returns the devices of the address book
+func (c *Client) Peers() ([]conf.Peer, error) {
+	cm, err := conf.NewConfManager(c.cm.Path)
+	if err != nil {
+		return nil, err
+	}
+	return cm.Conf.AddressBook, nil
+}
+
+// Resolve returns the device ID of peer, an ID, a name of the address book
+// or a domain name publishing a device
+func (c *Client) Resolve(peer string) (string, error) {
+	return impl.ResolveHost(c.cm, peer)
+}
+
+// Dial opens a stream to the ssh server of peer, ctx cancels the set up
+// but not the stream
+func (c *Client) Dial(ctx context.Context, peer string) (net.Conn, error) {
+	id, err := c.Resolve(peer)
+	if err != nil {
+		return nil, err
+	}
+	otp, err := c.oneTimeCode(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := impl.DialSSHContext(ctx, id, otp)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", id, err)
+	}
+	return conn, nil
+}
+
+// oneTimeCode returns the code of id if it asks for one
+func (c *Client) oneTimeCode(ctx context.Context, id string) (string, error) {
+	for _, v := range c.cm.Conf.TOTPConf.Prompt {
+		if v != id {
+			continue
+		}
+		if c.opts.OneTimeCode == nil {
+			return "", impl.Denied(fmt.Errorf("%s asks for a one-time code", id))
+		}
+		return c.opts.OneTimeCode(ctx, id)
+	}
+	return "", nil
+}
+
+func (c *Client) logf(format string, v ...interface{}) {
+	if c.opts.Logger != nil {
+		c.opts.Logger.Printf(format, v...)
+	}
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+// DialPeer connects to the TCP address addr of the network of peer, as
+// 10.0.0.5:5432, through the daemon. The address must be allowed by the
+// forwardconf of peer. ctx cancels the set up but not the connection.
+func (c *Client) DialPeer(ctx context.Context, peer, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	id, err := c.Resolve(peer)
+	if err != nil {
+		return nil, err
+	}
+	otp, err := c.oneTimeCode(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	imp := impl.NewForward(id, addr)
+	imp.SetOneTimeCode(otp)
+	conn, err := imp.DialContext(ctx)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("%s via %s: %w", addr, id, err)}
+	}
+	return conn, nil
+}
+
+// Dialer connects to the network of a peer, its DialContext goes where
+// http.Transport, database drivers and the like take a dial function
+type Dialer struct {
+	client *Client
+	peer   string
+}
+
+// Dialer returns the dialer of the network of peer
+func (c *Client) Dialer(peer string) *Dialer {
+	return &Dialer{client: c, peer: peer}
+}
+
+// Dial connects to addr of the network of the peer
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr of the network of the peer, see DialPeer
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.client.DialPeer(ctx, d.peer, network, addr)
+}
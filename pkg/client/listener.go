@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/suutaku/sshx/pkg/impl"
+)
+
+// headerTimeout bounds the line the daemon starts connections with
+const headerTimeout = 10 * time.Second
+
+// PeerAddr is the address of an endpoint of a device, Endpoint is empty
+// for the remote ends of connections
+type PeerAddr struct {
+	ID       string
+	Endpoint string
+}
+
+func (a PeerAddr) Network() string {
+	return "sshx"
+}
+
+func (a PeerAddr) String() string {
+	if a.Endpoint == "" {
+		return a.ID
+	}
+	return a.ID + "/" + a.Endpoint
+}
+
+// peerConn is a connection of a peer to an endpoint
+type peerConn struct {
+	net.Conn
+	remote PeerAddr
+}
+
+func (pc *peerConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+// Listener accepts the connections of peers to an endpoint of this device,
+// the RemoteAddr of each one is the PeerAddr of the peer
+type Listener struct {
+	listener net.Listener
+	addr     PeerAddr
+	cancel   context.CancelFunc
+	once     sync.Once
+}
+
+// ListenPeer opens the endpoint name of this device, which peers connect
+// to with DialEndpoint, until ctx is done or the listener is closed. Every
+// peer this device accepts may connect, check their RemoteAddr to accept
+// fewer.
+func (c *Client) ListenPeer(ctx context.Context, name string) (*Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	err = impl.RegisterEndpoint(name, listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	l := &Listener{
+		listener: listener,
+		addr:     PeerAddr{ID: c.ID(), Endpoint: name},
+		cancel:   cancel,
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	return l, nil
+}
+
+// Accept waits for the next connection of a peer
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(headerTimeout))
+		id, err := impl.ReadEndpointPeer(conn)
+		if err != nil {
+			// a local process which isn't the daemon
+			conn.Close()
+			continue
+		}
+		conn.SetReadDeadline(time.Time{})
+		return &peerConn{Conn: conn, remote: PeerAddr{ID: id}}, nil
+	}
+}
+
+// Addr returns the PeerAddr of the endpoint
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// Close closes the endpoint, the accepted connections are left open
+func (l *Listener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		l.cancel()
+		impl.UnregisterEndpoint(l.addr.Endpoint)
+		err = l.listener.Close()
+	})
+	return err
+}
+
+// DialEndpoint connects to the endpoint name of peer, opened by a program
+// of peer with ListenPeer. ctx cancels the set up but not the connection.
+func (c *Client) DialEndpoint(ctx context.Context, peer, name string) (net.Conn, error) {
+	id, err := c.Resolve(peer)
+	if err != nil {
+		return nil, err
+	}
+	otp, err := c.oneTimeCode(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	imp := impl.NewEndpointForward(id, name)
+	imp.SetOneTimeCode(otp)
+	conn, err := imp.DialContext(ctx)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "sshx", Addr: PeerAddr{ID: id, Endpoint: name}, Err: err}
+	}
+	return conn, nil
+}
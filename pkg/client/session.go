@@ -0,0 +1,95 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/impl"
+	"golang.org/x/crypto/ssh"
+)
+
+// Session is an ssh connection to a remote device, the embedded client
+// opens sessions, SFTP and port forwards as usual
+type Session struct {
+	*ssh.Client
+}
+
+// SSH logs in the ssh server of addr, [username@]peer, with config. The
+// user of addr overrides the one of config. Host keys are checked with the
+// known_hosts of sshx if config has no HostKeyCallback.
+func (c *Client) SSH(ctx context.Context, addr string, config *ssh.ClientConfig) (*Session, error) {
+	cfg := *config
+	peer := addr
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		cfg.User = addr[:i]
+		peer = addr[i+1:]
+	}
+	if cfg.User == "" {
+		return nil, fmt.Errorf("no user to log in %s", peer)
+	}
+	if cfg.HostKeyCallback == nil {
+		cfg.HostKeyCallback = impl.KnownHostsCallback()
+	}
+	conn, err := c.Dial(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	var client *ssh.Client
+	err = utils.WithContext(ctx, conn, func() error {
+		sc, chans, reqs, err := ssh.NewClientConn(conn, peer, &cfg)
+		if err != nil {
+			return err
+		}
+		client = ssh.NewClient(sc, chans, reqs)
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Session{Client: client}, nil
+}
+
+// Run runs cmd on the remote device with the given input and outputs, any
+// of them may be nil. Canceling ctx ends the command.
+func (s *Session) Run(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) error {
+	session, err := s.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	err = session.Start(cmd)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		return ctx.Err()
+	}
+}
+
+// Output runs cmd on the remote device and returns its standard output,
+// the standard error is in the error of a failed command
+func (s *Session) Output(ctx context.Context, cmd string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	err := s.Run(ctx, cmd, nil, &stdout, &stderr)
+	if _, ok := err.(*ssh.ExitError); ok && stderr.Len() > 0 {
+		err = fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), err
+}
@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// Connection is a session of the daemon, with this device or the ones of
+// the address book
+type Connection struct {
+	// ID is the pair ID of the session, CloseConnection takes it
+	ID string
+	// Peer is the device ID of the other end
+	Peer string
+	// App is the application of the session, as ssh or vnc
+	App string
+	// Parent is the ID of the session which opened this one, if any
+	Parent  string
+	Started time.Time
+	// Inbound is set for the sessions the peer opened
+	Inbound bool
+	// BytesIn and BytesOut are the bytes received from and sent to the
+	// peer so far
+	BytesIn  int64
+	BytesOut int64
+
+	code int32
+}
+
+// Event is an event of the daemon, as a session opened, closed or denied
+type Event = types.Event
+
+// PeerInfo is what the daemon of this device knows of a device
+type PeerInfo struct {
+	ID string
+	// Peer is the entry of the address book, nil if there is none
+	Peer *conf.Peer
+	// LAN is the device as found on the local network, nil if it wasn't
+	LAN *types.LANPeer
+	// Connections are the sessions with the device
+	Connections []Connection
+}
+
+// ListConnections returns the sessions of the daemon
+func (c *Client) ListConnections(ctx context.Context) ([]Connection, error) {
+	res, _, err := impl.RequestStatus(ctx, impl.NewSTAT())
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]Connection, 0, len(res))
+	for _, v := range res {
+		ret = append(ret, Connection{
+			ID:       v.PairId,
+			Peer:     v.TargetId,
+			App:      impl.AppName(v.ImplType),
+			Parent:   v.ParentPairId,
+			Started:  v.StartTime,
+			Inbound:  v.Inbound,
+			BytesIn:  v.BytesIn,
+			BytesOut: v.BytesOut,
+			code:     v.ImplType,
+		})
+	}
+	return ret, nil
+}
+
+// GetPeerInfo returns what the daemon knows of peer, an ID, a name of the
+// address book or a domain name publishing a device
+func (c *Client) GetPeerInfo(ctx context.Context, peer string) (*PeerInfo, error) {
+	id, err := c.Resolve(peer)
+	if err != nil {
+		return nil, err
+	}
+	ret := &PeerInfo{ID: id}
+	peers, err := c.Peers()
+	if err != nil {
+		return nil, err
+	}
+	for i := range peers {
+		if peers[i].ID == id {
+			ret.Peer = &peers[i]
+			break
+		}
+	}
+	lan, err := impl.RequestDiscoverContext(ctx, impl.NewDiscover(c.ID()))
+	if err != nil {
+		return nil, err
+	}
+	for i := range lan {
+		if lan[i].ID == id {
+			ret.LAN = &lan[i]
+			break
+		}
+	}
+	conns, err := c.ListConnections(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range conns {
+		if v.Peer == id {
+			ret.Connections = append(ret.Connections, v)
+		}
+	}
+	return ret, nil
+}
+
+// CloseConnection closes the session id of the daemon, its child sessions
+// are closed with it
+func (c *Client) CloseConnection(ctx context.Context, id string) error {
+	conns, err := c.ListConnections(ctx)
+	if err != nil {
+		return err
+	}
+	for _, v := range conns {
+		if v.ID != id {
+			continue
+		}
+		imp := impl.GetImpl(v.code)
+		if imp == nil {
+			return ErrUnsupportedApp
+		}
+		sender := impl.NewSender(imp, types.OPTION_TYPE_DOWN)
+		sender.PairId = []byte(id)
+		sender.Detach = true
+		conn, err := sender.SendContext(ctx)
+		if err != nil {
+			return fmt.Errorf("close %s: %w", id, err)
+		}
+		return conn.Close()
+	}
+	return fmt.Errorf("no connection %s", id)
+}
+
+// Events returns the last events of the daemon then the ones it records
+// until ctx is done, the channel is closed then or if the daemon stops. The
+// daemon drops the events of a receiver which doesn't keep up.
+func (c *Client) Events(ctx context.Context) (<-chan Event, error) {
+	last, stream, err := impl.RequestEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan Event, len(last)+1)
+	for _, v := range last {
+		ch <- v
+	}
+	go func() {
+		defer close(ch)
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-done:
+			}
+			stream.Close()
+		}()
+		for {
+			ev, err := stream.Next()
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					c.logf("events: %v", err)
+				}
+				return
+			}
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
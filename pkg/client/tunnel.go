@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/suutaku/sshx/internal/utils"
+)
+
+// Tunnel forwards the connections of a local address to the ssh server of
+// a remote device, each one over its own stream
+type Tunnel struct {
+	listener net.Listener
+	cancel   context.CancelFunc
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Forward listens on localAddr, as 127.0.0.1:2222 or 127.0.0.1:0 for a free
+// port, and forwards its connections to the ssh server of peer until ctx is
+// done or the tunnel is closed
+func (c *Client) Forward(ctx context.Context, localAddr, peer string) (*Tunnel, error) {
+	id, err := c.Resolve(peer)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	t := &Tunnel{
+		listener: listener,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go func() {
+		<-ctx.Done()
+		t.Close()
+	}()
+	go t.serve(ctx, c, id)
+	return t, nil
+}
+
+func (t *Tunnel) serve(ctx context.Context, c *Client, id string) {
+	defer close(t.done)
+	for {
+		inconn, err := t.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			c.logf("tunnel to %s: %v", id, err)
+			continue
+		}
+		go func() {
+			conn, err := c.Dial(ctx, id)
+			if err != nil {
+				c.logf("tunnel to %s: %v", id, err)
+				inconn.Close()
+				return
+			}
+			utils.Pipe(&inconn, &conn)
+		}()
+	}
+}
+
+// Addr returns the local address of the tunnel
+func (t *Tunnel) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Done is closed once the tunnel stopped accepting connections, the
+// forwarded ones are left open
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// Close stops accepting connections
+func (t *Tunnel) Close() error {
+	var err error
+	t.once.Do(func() {
+		t.cancel()
+		err = t.listener.Close()
+	})
+	return err
+}
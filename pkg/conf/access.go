@@ -0,0 +1,190 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	ACCESS_ALLOW = "allow"
+	ACCESS_DENY  = "deny"
+)
+
+func validateAccessAction(action string) error {
+	switch strings.ToLower(action) {
+	case ACCESS_ALLOW, ACCESS_DENY:
+		return nil
+	}
+	return fmt.Errorf("unknown access action %q, use allow or deny", action)
+}
+
+// matchPeer reports whether an entry of AccessRule.Peers names peerId
+func (cm *ConfManager) matchPeer(entry, peerId string) bool {
+	if entry == "*" || entry == peerId {
+		return true
+	}
+	p := cm.FindPeer(peerId)
+	if p == nil {
+		return false
+	}
+	if strings.HasPrefix(entry, "group:") {
+		group := strings.TrimPrefix(entry, "group:")
+		for _, g := range p.Groups {
+			if g == group {
+				return true
+			}
+		}
+		return false
+	}
+	return p.Name != "" && entry == p.Name
+}
+
+// Matches reports whether the rule applies to a session of peerId with the
+// application app
+func (r AccessRule) Matches(cm *ConfManager, peerId, app string) bool {
+	return cm.matchSession(r.Peers, r.Apps, peerId, app)
+}
+
+// matchSession reports whether peers and apps name a session of peerId
+// with the application app
+func (cm *ConfManager) matchSession(peers, apps []string, peerId, app string) bool {
+	peer := false
+	for _, v := range peers {
+		if cm.matchPeer(v, peerId) {
+			peer = true
+			break
+		}
+	}
+	if !peer {
+		return false
+	}
+	for _, v := range apps {
+		if v == "*" || strings.EqualFold(v, app) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize returns the rule allowing a session of peerId with the
+// application app, or an error if the session is denied. Sessions are
+// allowed without constraints if AccessConf is not enabled.
+func (cm *ConfManager) Authorize(peerId, app string) (AccessRule, error) {
+	ac := cm.Conf.AccessConf
+	if !ac.Enabled {
+		return AccessRule{Action: ACCESS_ALLOW}, nil
+	}
+	for _, r := range ac.Rules {
+		if !r.Matches(cm, peerId, app) {
+			continue
+		}
+		if strings.EqualFold(r.Action, ACCESS_ALLOW) {
+			return r, nil
+		}
+		return r, fmt.Errorf("%s session of %s denied", app, peerId)
+	}
+	if strings.EqualFold(ac.Default, ACCESS_ALLOW) {
+		return AccessRule{Action: ACCESS_ALLOW}, nil
+	}
+	return AccessRule{Action: ACCESS_DENY}, fmt.Errorf("%s session of %s denied, no access rule allows it", app, peerId)
+}
+
+// AddAccessRule inserts a rule before the rule at index, or appends it if
+// index is out of range
+func (cm *ConfManager) AddAccessRule(r AccessRule, index int) error {
+	if len(r.Peers) == 0 || len(r.Apps) == 0 {
+		return fmt.Errorf("an access rule needs peers and applications")
+	}
+	r.Action = strings.ToLower(r.Action)
+	rules := append([]AccessRule{}, cm.Conf.AccessConf.Rules...)
+	if index < 0 || index >= len(rules) {
+		rules = append(rules, r)
+	} else {
+		rules = append(rules[:index], append([]AccessRule{r}, rules[index:]...)...)
+	}
+	return cm.SetValue("accessconf.rules", rules)
+}
+
+// RemoveAccessRule removes the rule at index
+func (cm *ConfManager) RemoveAccessRule(index int) error {
+	rules := cm.Conf.AccessConf.Rules
+	if index < 0 || index >= len(rules) {
+		return fmt.Errorf("no access rule %d", index)
+	}
+	left := append([]AccessRule{}, rules[:index]...)
+	return cm.SetValue("accessconf.rules", append(left, rules[index+1:]...))
+}
+
+// ADMIN_PEER names the device which issued a join token in the rules of
+// access templates
+const ADMIN_PEER = "@admin"
+
+// FindAccessTemplate returns the access template named name, nil if there
+// is none
+func (cm *ConfManager) FindAccessTemplate(name string) *AccessTemplate {
+	for i := range cm.Conf.JoinConf.Templates {
+		if cm.Conf.JoinConf.Templates[i].Name == name {
+			return &cm.Conf.JoinConf.Templates[i]
+		}
+	}
+	return nil
+}
+
+// Bind returns the template with the peer @admin of its rules replaced by
+// the device adminId
+func (t AccessTemplate) Bind(adminId string) AccessTemplate {
+	ret := t
+	ret.Rules = make([]AccessRule, len(t.Rules))
+	for i, r := range t.Rules {
+		r.Peers = append([]string{}, r.Peers...)
+		for j, v := range r.Peers {
+			if v == ADMIN_PEER {
+				r.Peers[j] = adminId
+			}
+		}
+		ret.Rules[i] = r
+	}
+	return ret
+}
+
+// Validate checks the actions of the template
+func (t AccessTemplate) Validate() error {
+	if t.Default != "" {
+		err := validateAccessAction(t.Default)
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range t.Rules {
+		if len(r.Peers) == 0 || len(r.Apps) == 0 {
+			return fmt.Errorf("an access rule needs peers and applications")
+		}
+		err := validateAccessAction(r.Action)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyAccessTemplate replaces the access rules with the ones of t and
+// enables them
+func (cm *ConfManager) ApplyAccessTemplate(t AccessTemplate) error {
+	err := t.Validate()
+	if err != nil {
+		return err
+	}
+	rules := make([]AccessRule, len(t.Rules))
+	for i, r := range t.Rules {
+		r.Action = strings.ToLower(r.Action)
+		rules[i] = r
+	}
+	err = cm.SetValue("accessconf.rules", rules)
+	if err == nil && t.Default != "" {
+		err = cm.SetValue("accessconf.default", strings.ToLower(t.Default))
+	}
+	if err == nil {
+		err = cm.SetValue("accessconf.enabled", true)
+	}
+	return err
+}
@@ -0,0 +1,224 @@
+package conf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Peer is a remote device of the address book
+type Peer struct {
+	// ID is the device ID used to connect to the device
+	ID string
+
+	// Name is a readable name of the device
+	Name string
+
+	// Groups are the message groups the device is a member of
+	Groups []string
+
+	// Overlay is the address of the device on the overlay network, as its
+	// Tailscale address or MagicDNS name
+	Overlay string
+
+	// DERPKey is the DERP key of the device, base64, and DERPRelay the
+	// relay it receives on, its home relay
+	DERPKey   string
+	DERPRelay string
+
+	// MAC is the hardware address Wake-on-LAN packets wake the device with
+	MAC string
+
+	// Wake is the device of its network which sends the Wake-on-LAN packets
+	Wake string
+
+	// Fingerprint is the fingerprint of the node key the device must
+	// present the first time it is seen, as published in DNS
+	Fingerprint string
+
+	// Discovered is when the device was last seen on the local network,
+	// in Unix seconds, for the entries LAN discovery added. It is zero for
+	// the others.
+	Discovered int64
+}
+
+// FindPeer returns the address book entry of id, nil if there is none
+func (cm *ConfManager) FindPeer(id string) *Peer {
+	for i := range cm.Conf.AddressBook {
+		if cm.Conf.AddressBook[i].ID == id {
+			return &cm.Conf.AddressBook[i]
+		}
+	}
+	return nil
+}
+
+// ResolvePeer returns the ID of the address book entry named name, name
+// itself if there is none
+func (cm *ConfManager) ResolvePeer(name string) string {
+	for _, p := range cm.Conf.AddressBook {
+		if p.Name != "" && p.Name == name {
+			return p.ID
+		}
+	}
+	return name
+}
+
+// PeerName returns the name of id in the address book, id itself if it has
+// none
+func (cm *ConfManager) PeerName(id string) string {
+	if p := cm.FindPeer(id); p != nil && p.Name != "" {
+		return p.Name
+	}
+	return id
+}
+
+// ExpandPeers returns the IDs named by entries, device IDs, names of the
+// address book, group:NAME for the members of a group or * for the whole
+// address book, each once in the order of entries
+func (cm *ConfManager) ExpandPeers(entries []string) []string {
+	var ret []string
+	add := func(id string) {
+		if !contains(ret, id) {
+			ret = append(ret, id)
+		}
+	}
+	for _, v := range entries {
+		switch {
+		case v == "*":
+			for _, p := range cm.Conf.AddressBook {
+				add(p.ID)
+			}
+		case strings.HasPrefix(v, "group:"):
+			for _, id := range cm.GroupMembers(strings.TrimPrefix(v, "group:")) {
+				add(id)
+			}
+		case v != "":
+			add(cm.ResolvePeer(v))
+		}
+	}
+	return ret
+}
+
+// Groups returns the message groups with their member IDs
+func (cm *ConfManager) Groups() map[string][]string {
+	ret := make(map[string][]string)
+	for _, p := range cm.Conf.AddressBook {
+		for _, g := range p.Groups {
+			ret[g] = append(ret[g], p.ID)
+		}
+	}
+	return ret
+}
+
+// GroupMembers returns the IDs of the members of group
+func (cm *ConfManager) GroupMembers(group string) []string {
+	members := cm.Groups()[group]
+	sort.Strings(members)
+	return members
+}
+
+// AddToGroup adds devices to group, devices missing in the address book are
+// added to it
+func (cm *ConfManager) AddToGroup(group string, ids ...string) error {
+	if group == "" {
+		return fmt.Errorf("empty group name")
+	}
+	for _, id := range ids {
+		p := cm.FindPeer(id)
+		if p == nil {
+			cm.Conf.AddressBook = append(cm.Conf.AddressBook, Peer{ID: id})
+			p = &cm.Conf.AddressBook[len(cm.Conf.AddressBook)-1]
+		}
+		if !contains(p.Groups, group) {
+			p.Groups = append(p.Groups, group)
+		}
+	}
+	return cm.SaveAddressBook()
+}
+
+// AddJoinedPeer adds a device which joined with a token to the address
+// book and its groups. It is named name unless another device already is.
+func (cm *ConfManager) AddJoinedPeer(id, name string, groups []string) error {
+	p := cm.FindPeer(id)
+	if p == nil {
+		cm.Conf.AddressBook = append(cm.Conf.AddressBook, Peer{ID: id})
+		p = &cm.Conf.AddressBook[len(cm.Conf.AddressBook)-1]
+	}
+	if name != "" && cm.ResolvePeer(name) == name {
+		p.Name = name
+	}
+	for _, g := range groups {
+		if !contains(p.Groups, g) {
+			p.Groups = append(p.Groups, g)
+		}
+	}
+	return cm.SaveAddressBook()
+}
+
+// PruneDiscovered drops the entries LAN discovery added of the devices keep
+// refuses: the ones not seen since before, and the least recently seen ones
+// over max. Entries put in groups stay. It reports whether entries were
+// dropped.
+func (cm *ConfManager) PruneDiscovered(before time.Time, max int, keep func(id string) bool) bool {
+	var found []Peer
+	for _, p := range cm.Conf.AddressBook {
+		if p.Discovered != 0 && len(p.Groups) == 0 && !keep(p.ID) {
+			found = append(found, p)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Discovered > found[j].Discovered
+	})
+	drop := make(map[string]bool)
+	for i, p := range found {
+		if i >= max || time.Unix(p.Discovered, 0).Before(before) {
+			drop[p.ID] = true
+		}
+	}
+	if len(drop) == 0 {
+		return false
+	}
+	book := cm.Conf.AddressBook[:0]
+	for _, p := range cm.Conf.AddressBook {
+		if !drop[p.ID] {
+			book = append(book, p)
+		}
+	}
+	cm.Conf.AddressBook = book
+	return true
+}
+
+// RemoveFromGroup removes devices from group, the whole group if no device
+// is given
+func (cm *ConfManager) RemoveFromGroup(group string, ids ...string) error {
+	for i := range cm.Conf.AddressBook {
+		p := &cm.Conf.AddressBook[i]
+		if len(ids) > 0 && !contains(ids, p.ID) {
+			continue
+		}
+		groups := p.Groups[:0]
+		for _, g := range p.Groups {
+			if g != group {
+				groups = append(groups, g)
+			}
+		}
+		p.Groups = groups
+	}
+	return cm.SaveAddressBook()
+}
+
+// SaveAddressBook writes the address book to the configuration file
+func (cm *ConfManager) SaveAddressBook() error {
+	cm.Viper.Set("AddressBook", cm.Conf.AddressBook)
+	return cm.write("AddressBook", cm.Conf.AddressBook)
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
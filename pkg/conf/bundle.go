@@ -0,0 +1,165 @@
+package conf
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// BUNDLE_PREFIX starts the text form of a join bundle, short enough for QR
+// codes
+const BUNDLE_PREFIX = "sshx-join:"
+
+// JoinBundle holds what a new device needs to reach the devices of the one
+// which exported it
+type JoinBundle struct {
+	// SignalingServerAddr is the signaling server of the devices
+	SignalingServerAddr string
+
+	// SignalingToken is the tenant token of the signaling server, if any
+	SignalingToken string `json:",omitempty"`
+
+	// ICEServers are the STUN servers, and TURN servers with credentials
+	// if they were exported
+	ICEServers []webrtc.ICEServer `json:",omitempty"`
+
+	// Peer is the exporting device and the name it is known by
+	Peer Peer
+
+	// Token is the secret of a join token, a device joining with the
+	// bundle proves it to the exporting device which pairs with it and
+	// adds it to its address book
+	Token string `json:",omitempty"`
+
+	// Access are the access rules the joining device applies, if any
+	Access *AccessTemplate `json:",omitempty"`
+
+	// Directory is the directory the joining device registers with, with
+	// its owner and tags, if any
+	Directory *DirectoryConf `json:",omitempty"`
+}
+
+// ExportBundle returns the join bundle of this device. TURN servers are
+// only exported with withTURN, as their credentials are secrets.
+func (cm *ConfManager) ExportBundle(name string, withTURN bool) JoinBundle {
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	b := JoinBundle{
+		SignalingServerAddr: cm.Conf.SignalingServerAddr,
+		SignalingToken:      cm.Conf.SignalingToken,
+		Peer:                Peer{ID: cm.Conf.ID, Name: name},
+	}
+	for _, s := range cm.Conf.RTCConf.ICEServers {
+		if withTURN || !isTURNServer(s) {
+			b.ICEServers = append(b.ICEServers, s)
+		}
+	}
+	return b
+}
+
+func isTURNServer(s webrtc.ICEServer) bool {
+	for _, u := range s.URLs {
+		if strings.HasPrefix(strings.ToLower(u), "turn") {
+			return true
+		}
+	}
+	return false
+}
+
+// Encode returns the text form of the bundle
+func (b JoinBundle) Encode() (string, error) {
+	bs, err := json.Marshal(b)
+	if err != nil {
+		return "", err
+	}
+	return BUNDLE_PREFIX + base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+// DecodeBundle reads a bundle from its text form, or from plain JSON
+func DecodeBundle(text string) (*JoinBundle, error) {
+	text = strings.TrimSpace(text)
+	bs := []byte(text)
+	if strings.HasPrefix(text, BUNDLE_PREFIX) {
+		var err error
+		bs, err = base64.RawURLEncoding.DecodeString(strings.TrimPrefix(text, BUNDLE_PREFIX))
+		if err != nil {
+			return nil, fmt.Errorf("invalid join bundle: %v", err)
+		}
+	}
+	var b JoinBundle
+	err := json.Unmarshal(bs, &b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid join bundle: %v", err)
+	}
+	if b.SignalingServerAddr == "" || b.Peer.ID == "" {
+		return nil, fmt.Errorf("invalid join bundle: no signaling server or device")
+	}
+	for _, s := range b.ICEServers {
+		err = validateICEServer(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid join bundle: %v", err)
+		}
+	}
+	if b.Access != nil {
+		err = b.Access.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid join bundle: %v", err)
+		}
+	}
+	return &b, nil
+}
+
+// ImportBundle merges a join bundle into the configure: the signaling
+// settings are replaced, ICE servers added and the exporting device is
+// added to the address book
+func (cm *ConfManager) ImportBundle(b *JoinBundle) error {
+	if b.Peer.ID == cm.Conf.ID {
+		return fmt.Errorf("the bundle was exported by this device")
+	}
+	err := cm.SetValue("signalingserveraddr", b.SignalingServerAddr)
+	if err != nil {
+		return err
+	}
+	err = cm.SetValue("signalingtoken", b.SignalingToken)
+	if err != nil {
+		return err
+	}
+	for _, s := range b.ICEServers {
+		err = cm.AddICEServer(s)
+		if err != nil {
+			return err
+		}
+	}
+	if p := cm.FindPeer(b.Peer.ID); p != nil {
+		if b.Peer.Name != "" {
+			p.Name = b.Peer.Name
+		}
+	} else {
+		cm.Conf.AddressBook = append(cm.Conf.AddressBook, Peer{ID: b.Peer.ID, Name: b.Peer.Name})
+	}
+	return cm.SaveAddressBook()
+}
+
+// ImportDirectory enables the directory of a join bundle, unless this
+// device already registers with one
+func (cm *ConfManager) ImportDirectory(dc DirectoryConf) error {
+	if cm.Conf.DirectoryConf.Enabled {
+		return nil
+	}
+	err := cm.SetValue("directoryconf.url", dc.URL)
+	if err == nil && dc.Owner != "" {
+		err = cm.SetValue("directoryconf.owner", dc.Owner)
+	}
+	if err == nil && len(dc.Tags) > 0 {
+		err = cm.SetValue("directoryconf.tags", dc.Tags)
+	}
+	if err == nil {
+		err = cm.SetValue("directoryconf.enabled", true)
+	}
+	return err
+}
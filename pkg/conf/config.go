@@ -4,13 +4,14 @@
 package conf
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -40,17 +41,1212 @@ type Configure struct {
 	// SignalingServerAddr is the URL of the WebRTC signaling server
 	SignalingServerAddr string
 	
+	// SignalingToken is the tenant token of signaling servers which require
+	// one, devices only see the devices of their tenant
+	SignalingToken string
+	
+	// SignalingPollConf sets how often the signaling server is polled
+	SignalingPollConf SignalingPollConf
+	
 	// RTCConf contains WebRTC configuration including ICE servers for NAT traversal
 	RTCConf webrtc.Configuration
 	
+	// STUNProbeConf sets how the STUN servers of RTCConf are checked
+	STUNProbeConf STUNProbeConf
+	
 	// VNCConf contains VNC server configuration settings
 	VNCConf config.Configure
 	
 	// VNCStaticPath is the filesystem path to noVNC web client files
 	VNCStaticPath string
 	
+	// VNCAuthConf controls who may attach to the VNC service of this node
+	VNCAuthConf VNCAuthConf
+	
+	// VNCWebConf contains TLS and authentication settings of the noVNC web page
+	VNCWebConf VNCWebConf
+	
+	// VNCQualityConf contains encoding preferences of VNC sessions opened here
+	VNCQualityConf VNCQualityConf
+	
+	// VNCSessionConf controls how viewers share the VNC service of this node
+	VNCSessionConf VNCSessionConf
+	
+	// VNCRecordConf controls recording of VNC sessions for auditing
+	VNCRecordConf VNCRecordConf
+	
+	// VNCDisplayConf selects the desktop served by the VNC service
+	VNCDisplayConf VNCDisplayConf
+	
 	// ETHAddr is the ethernet address/interface to use for networking
 	ETHAddr string
+	
+	// ProxyConf contains defaults of the ssh proxy
+	ProxyConf ProxyConf
+	
+	// TransferConf contains settings of the file transfer applications
+	TransferConf TransferConf
+	
+	// SSHConf contains host key settings of ssh connections
+	SSHConf SSHConf
+	
+	// KnockConf asks the operator to approve inbound sessions
+	KnockConf KnockConf
+	
+	// TOTPConf requires one-time codes of peers for inbound sessions
+	TOTPConf TOTPConf
+	
+	// IdentityConf checks the node keys signing signaling messages
+	IdentityConf IdentityConf
+	
+	// AccessConf authorizes inbound sessions per peer and application
+	AccessConf AccessConf
+	
+	// FIDOConf asks for a touch of a FIDO2 key to connect to some peers
+	FIDOConf FIDOConf
+	
+	// SessionConf limits the duration of sessions per peer and application
+	SessionConf SessionConf
+	
+	// HistoryConf keeps the completed sessions for 'sshx history'
+	HistoryConf HistoryConf
+	
+	// AuditConf exports security events to syslog and SIEM systems
+	AuditConf AuditConf
+	
+	// SSHFSConf contains caching and reconnection settings of sshfs mounts
+	SSHFSConf SSHFSConf
+	
+	// FileDropConf contains settings of the file drop web page
+	FileDropConf FileDropConf
+	
+	// DebugConf contains settings of the profiling endpoints of the daemon
+	DebugConf DebugConf
+	
+	// ClipboardConf contains settings of clipboard synchronization
+	ClipboardConf ClipboardConf
+	
+	// RDPConf controls access of remote peers to the local RDP server
+	RDPConf RDPConf
+	
+	// AudioConf controls streaming of the local audio output to peers
+	AudioConf AudioConf
+	
+	// MessageConf contains settings of the message console
+	MessageConf MessageConf
+	
+	// LogConf contains the logging settings of the daemon
+	LogConf LogConf
+	
+	// AllowPlaintextPeers connects to peers which don't encrypt connections
+	// end to end, only DTLS protects the data then
+	AllowPlaintextPeers bool
+	
+	// AllowUnpairedPeers trusts the identity key of unknown peers the first
+	// time they connect, instead of refusing peers not paired with a code
+	AllowUnpairedPeers bool
+	
+	// RemoteConf fetches the configure overlay of a managed fleet
+	RemoteConf RemoteConf
+	
+	// AddressBook lists known remote devices and their message groups
+	AddressBook []Peer
+	
+	// DiscoveryConf advertises the device on the local network and finds
+	// the devices there
+	DiscoveryConf DiscoveryConf
+	
+	// OverlayConf connects to peers of the same WireGuard or Tailscale
+	// network over it
+	OverlayConf OverlayConf
+	
+	// MeshConf relays sessions between peers which can't connect to each
+	// other
+	MeshConf MeshConf
+	
+	// DERPConf carries the sessions no other service connects over the
+	// DERP relays of Tailscale
+	DERPConf DERPConf
+	
+	// JoinConf holds the access templates of the join tokens this device
+	// issues
+	JoinConf JoinConf
+	
+	// DirectoryConf registers this device with the peer directory of the
+	// signaling server
+	DirectoryConf DirectoryConf
+	
+	// SharingConf lets a daemon of the whole system serve the local users
+	// with their own permissions
+	SharingConf SharingConf
+	
+	// StandbyConf pairs this daemon with another one of the same identity,
+	// the standby takes over when the active fails
+	StandbyConf StandbyConf
+	
+	// KubeConf lets peers exec into pods and forward ports of the
+	// Kubernetes cluster of this node
+	KubeConf KubeConf
+	
+	// DockerConf lets peers list and exec into the containers of the Docker
+	// engine of this node
+	DockerConf DockerConf
+	
+	// SerialConf lets peers open the serial consoles of this node
+	SerialConf SerialConf
+	
+	// ShellConf lets peers run persistent shell sessions on this node
+	ShellConf ShellConf
+	
+	// ExecConf lets peers run commands on this node
+	ExecConf ExecConf
+	
+	// ScreenshotConf lets peers capture the desktop of this node
+	ScreenshotConf ScreenshotConf
+	
+	// NotifyConf lets peers pop desktop notifications on this node
+	NotifyConf NotifyConf
+	
+	// ScheduleConf holds the tasks the daemon runs on a schedule
+	ScheduleConf ScheduleConf
+	
+	// TrayConf holds the settings of the tray agent
+	TrayConf TrayConf
+	
+	// WOLConf lets peers wake the devices of the network of this node
+	WOLConf WOLConf
+	
+	// PrintConf lets peers print to the printers of the network of this
+	// node
+	PrintConf PrintConf
+	
+	// PortMapConf forwards a port of the router to the direct service
+	PortMapConf PortMapConf
+	
+	// DNSConf finds devices and their signaling server in DNS
+	DNSConf DNSConf
+	
+	// OutboundProxyConf sends signaling requests and TURN connections over
+	// TCP through a proxy
+	OutboundProxyConf OutboundProxyConf
+	
+	// ForwardConf lets peers open TCP connections to the network of this
+	// node
+	ForwardConf ForwardConf
+}
+
+// VNCAuthConf holds the credentials required by remote VNC viewers. Viewers
+// give either Password or a token created with 'sshx vnc token'
+type VNCAuthConf struct {
+	// Password is a static password accepted for every session
+	Password string
+	
+	// RequireAuth rejects viewers without credential even if Password is empty,
+	// so only tokens are accepted
+	RequireAuth bool
+}
+
+// VNCWebConf secures the noVNC web interface served on LocalHTTPPort
+type VNCWebConf struct {
+	// TLS serves the web interface over https
+	TLS bool
+	
+	// CertFile and KeyFile are PEM files of the certificate, a self-signed
+	// certificate is created in the sshx home if they are empty
+	CertFile string
+	KeyFile  string
+	
+	// BasicAuthUser and BasicAuthPassword enable HTTP basic auth if not empty
+	BasicAuthUser     string
+	BasicAuthPassword string
+}
+
+// VNCQualityConf trades fidelity for responsiveness on slow links, the
+// viewer settings are replaced before they reach the remote VNC server
+type VNCQualityConf struct {
+	// Encodings lists preferred encodings (tight, tightpng, zrle, hextile,
+	// zlib, copyrect, rre, raw), empty keeps the order of the viewer
+	Encodings []string
+	
+	// Quality is the JPEG quality level from 1 (smallest) to 9 (best), 0
+	// keeps the level of the viewer
+	Quality int32
+	
+	// Compression is the level from 1 (fastest) to 9 (smallest), 0 keeps
+	// the level of the viewer
+	Compression int32
+}
+
+// VNCSessionConf holds settings of the sessions remote viewers open on the
+// VNC service of this node
+type VNCSessionConf struct {
+	// Shared lets all viewers watch one session, the desktop is captured once
+	// and every framebuffer update is sent to each viewer
+	Shared bool
+	
+	// MaxViewers limits the viewers of the shared session, 0 means no limit
+	MaxViewers int32
+}
+
+// VNCRecordConf controls recording of the sessions viewers open on the VNC
+// service of this node, every session is saved as an FBS file
+type VNCRecordConf struct {
+	// Enabled records every session
+	Enabled bool
+	
+	// Path is the directory of the recordings, recordings in the sshx home if
+	// empty
+	Path string
+	
+	// MaxAge removes recordings older than this number of days, 0 keeps them
+	MaxAge int32
+	
+	// MaxSize removes the oldest recordings once all of them take more bytes,
+	// 0 means no limit
+	MaxSize int64
+}
+
+// VNCDisplayConf selects the desktop the VNC service of this node serves
+type VNCDisplayConf struct {
+	// Backend is x11, wayland (wlroots desktops, served by wayvnc), headless
+	// (a virtual display for servers without desktop) or external (any RFB
+	// server at Address, like the portal based servers of GNOME and KDE).
+	// The backend of the running session is used if empty.
+	Backend string
+	
+	// Address is the RFB server of the wayland and external backends
+	Address string
+	
+	// Display is the X display number of the virtual display
+	Display string
+	
+	// Width and Height are the size of the virtual display
+	Width  int32
+	Height int32
+	
+	// Session is the command starting the desktop on the virtual display, the
+	// first installed of xfce, lxqt, openbox and xterm if empty
+	Session string
+}
+
+// ClipboardConf controls which peers may read or write the local clipboard
+type ClipboardConf struct {
+	// Enabled allows remote peers to access the clipboard
+	Enabled bool
+	
+	// Peers are the device IDs that may use the clipboard, empty means every
+	// peer
+	Peers []string
+	
+	// Images allows synchronizing PNG images besides text
+	Images bool
+	
+	// MaxSize is the largest clipboard content (bytes) sent or accepted
+	MaxSize int64
+	
+	// PollInterval is how often (milliseconds) the clipboard is checked for
+	// changes during continuous synchronization
+	PollInterval int32
+	
+	// VNCSessions synchronizes the clipboard with the remote desktop while a
+	// VNC session is open, the remote peer has to enable clipboard access
+	VNCSessions bool
+}
+
+// RDPConf holds settings of the RDP gateway, which lets peers reach the RDP
+// server of this node without exposing its port
+type RDPConf struct {
+	// Enabled allows remote peers to connect to the RDP server
+	Enabled bool
+	
+	// Address is the RDP server connections are forwarded to
+	Address string
+	
+	// Peers are the device IDs that may reach the RDP server, empty means
+	// every peer
+	Peers []string
+}
+
+// DockerConf holds the settings of the Docker gateway, which lets peers
+// reach the containers of this node without exposing the Docker socket
+type DockerConf struct {
+	// Enabled allows remote peers to list the containers
+	Enabled bool
+	
+	// Host is the address of the engine, as unix:///var/run/docker.sock or
+	// tcp://127.0.0.1:2375, empty means DOCKER_HOST and then the socket
+	Host string
+	
+	// Exec allows peers to exec into and attach to the containers, they
+	// can only list them otherwise
+	Exec bool
+	
+	// Containers limits access to these container names, empty means every
+	// container
+	Containers []string
+	
+	// Peers are the device IDs that may see the containers, empty means
+	// every peer
+	Peers []string
+}
+
+// SerialConf holds the settings of the serial consoles, which let peers
+// reach the devices wired to the serial ports of this node
+type SerialConf struct {
+	// Enabled allows remote peers to open serial devices
+	Enabled bool
+	
+	// Devices limits access to these devices, empty means every /dev/tty*
+	// and /dev/cu.* device
+	Devices []string
+	
+	// Baud is the speed of consoles opened without one
+	Baud int32
+	
+	// Peers are the device IDs that may open consoles, empty means every
+	// peer
+	Peers []string
+}
+
+// ShellConf holds the settings of the persistent shell sessions, which
+// keep running on this node while their client is away
+type ShellConf struct {
+	// Enabled allows remote peers to start and attach to sessions
+	Enabled bool
+	
+	// Shell is the command of sessions started without one, empty means
+	// $SHELL and then /bin/sh
+	Shell string
+	
+	// Scrollback is the number of bytes of output replayed to a client
+	// attaching to a session
+	Scrollback int32
+	
+	// Peers are the device IDs that may start and attach to sessions, empty
+	// means every peer
+	Peers []string
+}
+
+// ExecConf holds the settings of the commands peers run on this node, as
+// the ones sshx exec runs on groups of devices
+type ExecConf struct {
+	// Enabled allows remote peers to run commands
+	Enabled bool
+	
+	// Peers are the device IDs that may run commands here, empty means every
+	// peer
+	Peers []string
+}
+
+// ScreenshotConf holds the settings of the screenshots of the desktop peers
+// take, as a preview before a VNC session
+type ScreenshotConf struct {
+	// Enabled allows remote peers to capture the desktop
+	Enabled bool
+	
+	// Peers are the device IDs that may capture the desktop, empty means
+	// every peer
+	Peers []string
+}
+
+// NotifyConf holds the settings of the desktop notifications peers send to
+// this node, as the alerts of their scripts
+type NotifyConf struct {
+	// Enabled allows remote peers to send notifications
+	Enabled bool
+	
+	// Peers are the device IDs whose notifications are shown, empty means
+	// every peer
+	Peers []string
+	
+	// Rate is the number of notifications a peer may send per minute,
+	// the others are refused
+	Rate int32
+}
+
+// ScheduleConf holds the tasks the daemon runs against peers on a schedule,
+// their results are recorded as events and exported in the task category
+// of the security events
+type ScheduleConf struct {
+	Tasks []TaskConf
+}
+
+// TaskConf is a task of the scheduler, it runs Exec, Pull or Push
+type TaskConf struct {
+	// Name names the task in its events, unique among the tasks
+	Name string
+	
+	// Schedule is a cron expression, minute hour day month weekday, or
+	// @hourly, @daily, @weekly, @monthly or @every DURATION
+	Schedule string
+	
+	// Peer is the device ID or name the task runs against
+	Peer string
+	
+	// Exec is a command line run on the peer, which needs execconf
+	Exec string
+	
+	// Pull is a file of the peer downloaded to Local
+	Pull string
+	
+	// Push is a file uploaded to the download directory of the peer
+	Push string
+	
+	// Local is the file or the directory Pull is written to, the download
+	// directory by default
+	Local string
+	
+	// Timeout is the number of seconds after which the task is stopped,
+	// 0 means no limit
+	Timeout int64
+}
+
+// TrayConf holds the settings of 'sshx tray', the agent of the notification
+// area of desktop users
+type TrayConf struct {
+	// Favorites are the device IDs or names of the connect menu, the
+	// whole address book if empty
+	Favorites []string
+}
+
+// WOLConf holds the settings of the Wake-on-LAN relay, which sends magic
+// packets to the network of this node for peers
+type WOLConf struct {
+	// Enabled allows remote peers to send magic packets
+	Enabled bool
+	
+	// Peers limits the relay to these device IDs, empty means every peer
+	Peers []string
+}
+
+// PrintConf holds the settings of the print forwarder, which lets peers
+// print to the printers of the network of this node
+type PrintConf struct {
+	// Enabled allows remote peers to print
+	Enabled bool
+	
+	// Printers are the printers peers may print to
+	Printers []PrinterConf
+	
+	// Peers are the device IDs that may print, empty means every peer
+	Peers []string
+}
+
+// PrinterConf is a printer of the network of this node
+type PrinterConf struct {
+	// Name is the name peers print to
+	Name string
+	
+	// URI is the printer, as ipp://10.0.0.20/ipp/print, lpd://10.0.0.20/queue
+	// or socket://10.0.0.20:9100
+	URI string
+}
+
+// PortMapConf holds the settings of the port mapping of the direct service
+// on the router, with NAT-PMP or UPnP
+type PortMapConf struct {
+	// Enabled maps a port of the router to the direct service and sends
+	// its public address to peers in offers and answers. The service is
+	// then reachable from the internet, it only serves paired peers which
+	// prove their pinned key.
+	Enabled bool
+	
+	// Protocol is natpmp or upnp, the first one the router answers if
+	// empty
+	Protocol string
+	
+	// ExternalPort is the port asked from the router, the port of the
+	// direct service if 0. The router may give another one.
+	ExternalPort int32
+	
+	// Lease is the lifetime of the mapping in seconds, it is renewed
+	// halfway
+	Lease int32
+	
+	// Dial connects to the public addresses peers sent with the direct
+	// service first
+	Dial bool
+}
+
+// DNSConf holds the settings of the discovery of devices published in
+// DNS, which connections to domain names not in the address book use
+type DNSConf struct {
+	// Enabled looks up the _sshx TXT record of domain names not in the
+	// address book, and the _sshx._tcp SRV record of their domain when no
+	// signaling server is set
+	Enabled bool
+	
+	// Server is the address of the DNS server asked, the one of the
+	// system if empty
+	Server string
+}
+
+// OutboundProxyConf holds the proxy of networks which only reach the
+// internet through one. It carries the requests to the signaling server
+// and the connections to TURN servers over TCP or TLS, turn:...?transport=tcp
+// and turns: URLs.
+type OutboundProxyConf struct {
+	// URL is the proxy, http://, https:// or socks5:// with an optional
+	// user:password@. The HTTPS_PROXY, HTTP_PROXY and NO_PROXY variables of
+	// the environment of the daemon are used if empty.
+	URL string
+	
+	// NoProxy lists the hosts, domains (.example.com) and networks
+	// reached without URL, as NO_PROXY
+	NoProxy []string
+}
+
+// ForwardConf holds the settings of the TCP forwarder, which lets peers
+// connect to the addresses of the network of this node allowed here
+type ForwardConf struct {
+	// Enabled allows remote peers to open connections
+	Enabled bool
+	
+	// Allow lists the addresses peers may connect to, as host:port where
+	// host is a name, an address or a network (10.0.0.0/24) and port may
+	// be *. Nothing is allowed if it is empty.
+	Allow []string
+	
+	// Peers are the device IDs that may open connections through this node,
+	// empty means every peer
+	Peers []string
+}
+
+// MessageConf holds settings of the message console
+type MessageConf struct {
+	// History saves conversations in the sshx home, one file per peer
+	History bool
+	
+	// HistoryLines is the number of saved messages shown when a console opens
+	HistoryLines int32
+	
+	// RetryInterval is how often (seconds) the daemon tries to deliver
+	// messages queued for offline peers
+	RetryInterval int32
+	
+	// AllowPlaintext accepts consoles of peers which don't encrypt messages,
+	// messages are end-to-end encrypted otherwise
+	AllowPlaintext bool
+}
+
+// AudioConf holds settings of the audio stream remote peers can listen to
+// alongside VNC or RDP sessions
+type AudioConf struct {
+	// Enabled allows remote peers to listen to the audio output
+	Enabled bool
+	
+	// Peers are the device IDs that may listen to the audio, empty means
+	// every peer
+	Peers []string
+	
+	// Source is the PulseAudio or PipeWire source to capture, empty means
+	// the monitor of the default output
+	Source string
+	
+	// Bitrate of the Opus stream in bits per second
+	Bitrate int32
+}
+
+// FileDropConf holds settings of the optional HTTP endpoint where a browser
+// can send files to or fetch files from peers
+type FileDropConf struct {
+	// Enabled starts the endpoint with the daemon
+	Enabled bool
+	
+	// ListenAddr is the address of the endpoint (default: ":2226")
+	ListenAddr string
+	
+	// Token must be given as ?token= to access the endpoint, a random one
+	// is saved in the state home if empty
+	Token string
+}
+
+// DebugConf holds the settings of the pprof and expvar endpoints of the
+// daemon, served on the loopback interface only
+type DebugConf struct {
+	// Enabled starts the endpoints with the daemon
+	Enabled bool
+	
+	// Port of the endpoints on 127.0.0.1 (default: 2227)
+	Port int32
+	
+	// Token must be sent as bearer token or ?token=, a random one is
+	// saved in the state home if empty
+	Token string
+}
+
+// SSHConf holds host key settings of the ssh applications
+type SSHConf struct {
+	// KnownHostsFile keeps the host keys of remote devices, the known_hosts
+	// of the sshx home if empty
+	KnownHostsFile string
+	
+	// ClearKnownHosts removes the keys of local proxy ports from the
+	// ~/.ssh/known_hosts of the user when a proxy starts, so OpenSSH accepts
+	// the key of another device behind the same port
+	ClearKnownHosts bool
+	
+	// Username logs in to remote devices whose address has no user, the
+	// local user if empty
+	Username string
+	
+	// IdentityFile is the private key of ssh connections given without -i,
+	// ~/.ssh/id_rsa if empty
+	IdentityFile string
+	
+	// X11 forwards X11 of every ssh session
+	X11 bool
+}
+
+// KnockConf holds the knock mode: inbound sessions of untrusted peers wait
+// for the operator to approve them with 'sshx knock'
+type KnockConf struct {
+	// Enabled turns on the knock mode
+	Enabled bool
+	
+	// Apps are the applications which need approval, by name as ssh, vnc,
+	// scp or sshfs
+	Apps []string
+	
+	// Trusted are the IDs or address book names of peers approved without
+	// asking
+	Trusted []string
+	
+	// Timeout is the number of seconds a session waits for approval
+	// (default: 30)
+	Timeout int32
+}
+
+// TOTPConf holds the peers whose inbound sessions need a TOTP code as a
+// second factor, their secrets are kept in the encrypted key store
+type TOTPConf struct {
+	// Apps are the applications which need a code, by name as ssh or vnc
+	Apps []string
+	
+	// Peers are the IDs of the peers which must give a code, 'sshx totp
+	// enroll' and pairing with 'sshx pair code --totp' add them
+	Peers []string
+	
+	// Prompt are the IDs of the devices which ask this one for a code,
+	// commands connecting to them prompt for it
+	Prompt []string
+}
+
+// IdentityConf holds how devices prove their ID: signaling messages are
+// signed by the node key of their source, certified by the CA of the
+// organization or pinned the first time it is seen
+type IdentityConf struct {
+	// CAPublicKey is the public key of the CA certifying node keys, made
+	// by 'sshx ca keygen'
+	CAPublicKey string
+	
+	// RequireCert refuses devices without a certificate of the CA
+	RequireCert bool
+	
+	// AllowUnsignedPeers accepts signaling messages of peers which don't
+	// sign them, their ID can be spoofed
+	AllowUnsignedPeers bool
+	
+	// Revoked are the IDs of the peers refused by 'sshx pair revoke'
+	Revoked []string
+}
+
+// AccessConf holds the authorization matrix of inbound sessions, checked
+// by this device for every session a peer asks for
+type AccessConf struct {
+	// Enabled applies the rules, all sessions are allowed otherwise
+	Enabled bool
+	
+	// Default is allow or deny, for sessions no rule matches
+	Default string
+	
+	// Rules are tried in order, the first one matching decides
+	Rules []AccessRule
+}
+
+// AccessRule allows or denies sessions of peers with applications
+type AccessRule struct {
+	// Peers are peer IDs, address book names, group:NAME for the members
+	// of an address book group or * for any peer
+	Peers []string
+	
+	// Apps are application names as ssh, vnc or transfer, or * for any
+	Apps []string
+	
+	// Action is allow or deny
+	Action string
+	
+	// ReadOnly refuses uploads of allowed transfer and sync sessions
+	ReadOnly bool
+	
+	// ViewOnly drops the input of allowed VNC sessions
+	ViewOnly bool
+}
+
+// JoinConf holds the settings of the join tokens this device issues, which
+// provision new devices with one command
+type JoinConf struct {
+	// Templates are the access rules tokens apply on the devices joining
+	// with them, by name
+	Templates []AccessTemplate
+}
+
+// AccessTemplate is a set of access rules applied on the devices joining
+// with a token. The peer @admin of its rules is the device which issued
+// the token.
+type AccessTemplate struct {
+	// Name is the name tokens refer to the template by
+	Name string
+	
+	// Default is allow or deny, for sessions no rule matches
+	Default string
+	
+	// Rules replace the access rules of the joining device, which are
+	// then enabled
+	Rules []AccessRule
+}
+
+// SessionConf holds the maximum durations of sessions, inbound and outbound
+type SessionConf struct {
+	// Limits are tried in order, the first one matching a session sets its
+	// maximum duration
+	Limits []SessionLimit
+	
+	// Warning is the number of seconds before the expiry of a session its
+	// peer is warned
+	Warning int
+}
+
+// SessionLimit is the maximum duration of the sessions of peers with
+// applications
+type SessionLimit struct {
+	// Peers are peer IDs, address book names, group:NAME for the members
+	// of an address book group or * for any peer
+	Peers []string
+	
+	// Apps are application names as ssh, vnc or transfer, or * for any
+	Apps []string
+	
+	// MaxDuration is the maximum duration in seconds, 0 for no limit
+	MaxDuration int
+}
+
+// SignalingPollConf holds the intervals the daemon polls the signaling
+// server at, in milliseconds. Polls are quick while a handshake goes on
+// and back off to Idle once there is nothing to signal.
+type SignalingPollConf struct {
+	// Active is the interval of polls during handshakes
+	Active int
+	
+	// Idle is the longest interval of polls, the delay of the offers of
+	// peers. Signaling servers drop messages not pulled for 15 seconds.
+	Idle int
+	
+	// Window is the number of seconds polls stay quick after a signaling
+	// message was sent or received
+	Window int
+}
+
+// STUNProbeConf holds how often the daemon checks the STUN servers of the
+// ICE servers, in seconds. Sessions use the servers which answer, fastest
+// first, and all of them until they are checked or if none answers.
+type STUNProbeConf struct {
+	// Interval is the time between two checks, 0 disables them
+	Interval int64
+	
+	// Timeout is the time a server has to answer
+	Timeout int64
+}
+
+// HistoryConf holds how long the completed sessions of the daemon are kept
+type HistoryConf struct {
+	// Enabled records the sessions in the history of the state home
+	Enabled bool
+	
+	// Retention is the number of days sessions are kept, 0 to keep them
+	Retention int
+	
+	// MaxRecords is the number of sessions kept, the oldest are dropped
+	// first, 0 for no limit
+	MaxRecords int
+}
+
+// FIDOConf holds the peers connections to need a touch of a FIDO2 key,
+// and the credential of the key enrolled by 'sshx fido enroll'
+type FIDOConf struct {
+	// Peers are the IDs or address book names of the sensitive peers
+	Peers []string
+	
+	// Device is the path of the key, the first one plugged by default
+	Device string
+	
+	// RPID is the relying party of the credential, sshx by default
+	RPID string
+	
+	// Credential is the ID of the credential, in base64
+	Credential string
+	
+	// PublicKey is the es256 key of the credential, in PEM
+	PublicKey string
+	
+	// Timeout is the number of seconds to wait for the touch
+	Timeout int64
+}
+
+// AuditConf holds where security events are exported, nothing is exported
+// until Syslog or Webhook is set
+type AuditConf struct {
+	// Categories of the events exported: session, auth, pairing, keys,
+	// task or *
+	Categories []string
+	
+	// Syslog receives RFC 5424 messages, as udp://host:514,
+	// tcp://host:601 or unix:///dev/log
+	Syslog string
+	
+	// Webhook receives a POST for each event
+	Webhook string
+	
+	// WebhookFormat is json or cef
+	WebhookFormat string
+	
+	// WebhookToken is sent as bearer token, if set
+	WebhookToken string
+}
+
+// DiscoveryConf holds the settings of the discovery of devices on the
+// local network with multicast DNS
+type DiscoveryConf struct {
+	// Enabled browses the local network for devices
+	Enabled bool
+	
+	// Advertise announces the device to the local network and answers its
+	// queries, other devices only find it then
+	Advertise bool
+	
+	// Name is the name advertised, the host name if empty
+	Name string
+	
+	// Apps are the applications advertised as served by the device
+	Apps []string
+	
+	// Interval is the number of seconds between two queries of the
+	// network, devices not seen for three of them are forgotten
+	Interval int32
+	
+	// AddressBook adds the devices found to the address book, under the
+	// name they advertise unless an entry has it. The entries of devices
+	// never paired are dropped once unseen for 30 days, and discovery
+	// keeps 64 of them at most.
+	AddressBook bool
+	
+	// Direct connects to the devices found on their LAN address with the
+	// direct service first. Direct sessions are sealed end to end with
+	// the keys pinned by pairing, unpaired devices get WebRTC sessions.
+	Direct bool
+}
+
+// OverlayConf holds the settings of the overlay transport. Sessions with
+// peers of the same WireGuard or Tailscale network go over it directly,
+// authenticated by the node keys and encrypted by the overlay.
+type OverlayConf struct {
+	// Enabled dials the overlay address of peers and accepts sessions on
+	// the overlay addresses of this device
+	Enabled bool
+	
+	// CIDRs are the networks of the overlay, the Tailscale ones by default
+	CIDRs []string
+	
+	// Interfaces are overlay interfaces, as wg0, all their addresses are
+	// overlay addresses
+	Interfaces []string
+	
+	// Port is the port of the overlay service
+	Port int32
+}
+
+// MeshConf holds the settings of the mesh, where nodes advertise the peers
+// and networks they reach so the others connect through them
+type MeshConf struct {
+	// Enabled relays the sessions of peers, and dials through the routes
+	// of the neighbors when no other service connects to a peer
+	Enabled bool
+	
+	// Routes are the peers this node relays to, as device IDs, names,
+	// group:NAME or *, and the networks it reaches, as CIDRs
+	Routes []string
+	
+	// Neighbors are the peers whose routes are learned, empty means the
+	// address book
+	Neighbors []string
+	
+	// Peers limits the peers whose sessions are relayed or accepted
+	// through the mesh, empty means every peer
+	Peers []string
+	
+	// MaxHops is the most devices a session goes through after its origin
+	MaxHops int32
+	
+	// Interval is the number of seconds between two queries of the routes
+	// of the neighbors
+	Interval int64
+}
+
+// DERPConf holds the DERP relays, the relay servers of Tailscale, which
+// carry the sessions of peers no other service connects to. Operators
+// running DERP servers use them instead of TURN servers.
+type DERPConf struct {
+	// URLs are the relays, as https://derp.example.com/derp. This device
+	// receives on all of them, the first one is its home relay which peers
+	// learn to reach it on. DERP is disabled if empty.
+	URLs []string
+	
+	// KeepAlive is the number of seconds between two keep alive frames
+	// sent to the relays
+	KeepAlive int64
+}
+
+// DirectoryConf holds the entry of this device in the peer directory,
+// where devices are searched by name, owner, tags and capabilities
+type DirectoryConf struct {
+	// Enabled registers this device with the directory
+	Enabled bool
+	
+	// URL is the server of the directory, the signaling server if empty
+	URL string
+	
+	// Name is the name of this device in the directory, its host name if
+	// empty
+	Name string
+	
+	// Owner is the person or team this device belongs to
+	Owner string
+	
+	// Tags are free labels, as a site or a role
+	Tags []string
+	
+	// Capabilities are the applications this device serves, as ssh or
+	// vnc
+	Capabilities []string
+	
+	// Interval is the number of seconds between two registrations, the
+	// directory hides entries not refreshed for a day by default
+	Interval int64
+}
+
+// SharingConf holds the settings of a daemon shared by the local users. It
+// listens on a Unix socket instead of LocalTCPPort, the socket tells the
+// user of each request, whose sessions are attributed to it.
+type SharingConf struct {
+	// Enabled shares the daemon, it should run as root or as a user of its
+	// own
+	Enabled bool
+	
+	// Socket is the Unix socket of the daemon, every local user may
+	// connect to it
+	Socket string
+	
+	// Users are the permissions of the local users, the first one naming
+	// a user applies and users none names are refused. root and the user
+	// of the daemon are admins.
+	Users []UserScope
+}
+
+// StandbyConf holds the settings of an active/standby pair of daemons. The
+// active daemon serves its configure and its keys on Listen, the standby
+// follows it from Peer without registering with the signaling server, and
+// takes over once the active stays silent for Failover seconds.
+type StandbyConf struct {
+	// Role is active or standby, an empty role runs the daemon alone
+	Role string
+	
+	// Listen is the address the active daemon serves the standby on, as
+	// :7800
+	Listen string
+	
+	// Peer is the address of the other daemon of the pair
+	Peer string
+	
+	// Secret authenticates and encrypts the replication, both daemons set
+	// the same one. It is never replicated.
+	Secret string
+	
+	// Heartbeat is the number of seconds between two messages of the
+	// active daemon
+	Heartbeat int64
+	
+	// Failover is the number of seconds without message after which the
+	// standby takes over
+	Failover int64
+}
+
+// UserScope is what a local user may do with a shared daemon
+type UserScope struct {
+	// User is a user name, a uid, or * for any user
+	User string
+	
+	// Admin lets the user manage the daemon: pairing, access rules, the
+	// identity, knocks, logs, and the sessions of the other users
+	Admin bool
+	
+	// Apps are the applications the user may open sessions of, as ssh or
+	// vnc, or * for any
+	Apps []string
+	
+	// Peers are the peers the user may reach, as in AccessRule.Peers
+	Peers []string
+}
+
+// KubeConf holds the settings of the Kubernetes gateway, which lets peers
+// reach the workloads of the cluster this node runs in without exposing its
+// API server
+type KubeConf struct {
+	// Enabled allows remote peers to reach the cluster
+	Enabled bool
+	
+	// Kubeconfig is the kubeconfig of the cluster, empty means the service
+	// account of the pod of the node, then ~/.kube/config
+	Kubeconfig string
+	
+	// Context is the context of Kubeconfig, empty means the current one
+	Context string
+	
+	// Exec allows peers to run commands in pods, they can only forward
+	// ports otherwise
+	Exec bool
+	
+	// Namespaces limits access to these namespaces, empty means every one
+	Namespaces []string
+	
+	// Peers are the device IDs that may reach the cluster, empty means every
+	// peer
+	Peers []string
+}
+
+// ProxyConf holds the defaults of 'sshx proxy start'
+type ProxyConf struct {
+	// Port is the local port of proxies started without -P
+	Port int32
+	
+	// Target is the remote address of proxies started without one
+	Target string
+	
+	// Warm is the number of tunnels dialed ahead of the connections of
+	// the proxy, so a burst of connections doesn't wait for all of them
+	Warm int32
+	
+	// WarmIdle is how many seconds a warm tunnel waits for a connection
+	// before it is dialed again. SSH servers close connections which don't
+	// authenticate, after 120s for OpenSSH.
+	WarmIdle int32
+}
+
+// SSHFSConf holds sshfs mount settings. Timeouts are in seconds, 0 keeps the
+// FUSE library default and a negative value disables the cache
+type SSHFSConf struct {
+	// AttrTimeout is how long the kernel caches file attributes
+	AttrTimeout int32
+	
+	// EntryTimeout is how long the kernel caches name lookups
+	EntryTimeout int32
+	
+	// NegativeTimeout is how long the kernel caches failed lookups
+	NegativeTimeout int32
+	
+	// MaxReadAhead is the kernel read ahead size in bytes, 0 for default
+	MaxReadAhead int32
+	
+	// ReconnectMaxDelay is the longest wait in seconds between two attempts
+	// to reconnect a dropped mount. Negative disables reconnection
+	ReconnectMaxDelay int32
+}
+
+// TransferConf holds file transfer settings
+type TransferConf struct {
+	// Parallelism is the number of data channels a large file is split across
+	Parallelism int32
+	
+	// ParallelThreshold is the minimal file size (bytes) to use parallel transfer
+	ParallelThreshold int64
+	
+	// MaxConcurrent limits how many transfers run at the same time, others
+	// wait in a queue. 0 means unlimited
+	MaxConcurrent int32
+	
+	// RateLimit caps the total throughput of all transfers in bytes per
+	// second, 0 means unlimited
+	RateLimit int64
+	
+	// MessageSize is the size in bytes of the data channel messages of
+	// transfers, syncs and scp, 65511 at most
+	MessageSize int
+	
+	// BatchDelay is how long in milliseconds data shorter than a message
+	// waits for more before it is sent, 0 sends it at once
+	BatchDelay int
+	
+	// DownloadDir receives downloaded files, and uploads of peers if the
+	// sandbox has no root. ~/Downloads if empty
+	DownloadDir string
+	
+	// Sandbox restricts the paths remote peers may access
+	Sandbox SandboxConf
+	
+	// PeerSandboxes override Sandbox for specific peers
+	PeerSandboxes []SandboxConf
+}
+
+// SandboxConf confines the files a remote peer can read or write through the
+// transfer and sync applications
+type SandboxConf struct {
+	// PeerId selects the peer in PeerSandboxes, unused for the global sandbox
+	PeerId string
+	
+	// Roots are the directories accessible to the peer, transfers are
+	// refused while one of them can't be resolved. Without roots reads
+	// are unrestricted and writes are confined to ~/Downloads
+	Roots []string
+	
+	// ReadOnly rejects uploads and syncs
+	ReadOnly bool
+}
+
+// LogConf holds the logging settings of the daemon, 'sshx log' applies
+// changes to a running daemon
+type LogConf struct {
+	// Level is debug, info, warn or error (default: info). SSHX_DEBUG
+	// forces debug
+	Level string
+	
+	// Format is text or json (default: text)
+	Format string
+	
+	// File receives the logs instead of the standard error
+	File string
+	
+	// MaxSize rotates File when it grows over this number of bytes, 0
+	// disables rotation
+	MaxSize int64
+	
+	// MaxBackups is the number of rotated files kept (default: 3)
+	MaxBackups int32
+}
+
+// RemoteConf holds where a device of a managed fleet fetches its configure
+// overlay. Overlays are only applied if signed by the key of the admin.
+type RemoteConf struct {
+	// URL serves the signed overlay over HTTP(S)
+	URL string
+	
+	// AdminPeer is the device ID of an admin publishing the overlay, used
+	// if URL is empty
+	AdminPeer string
+	
+	// PublicKey is the base64 ed25519 public key of the admin
+	PublicKey string
+	
+	// Interval is the number of seconds between two fetches (default: 300)
+	Interval int32
 }
 
 // ConfManager manages configuration lifecycle including loading, saving, and watching
@@ -59,11 +1255,48 @@ type ConfManager struct {
 	// Conf is the current configuration loaded from file
 	Conf *Configure
 	
-	// Viper is the configuration management library instance
+	// Viper is the configuration management library instance, it holds the
+	// system configuration overlaid by the one of the user
 	Viper *viper.Viper
 	
+	// user holds the configuration file of the user, changes are written there
+	user *viper.Viper
+	
 	// Path is the directory where configuration files are stored
 	Path string
+	
+	// Profile is the name of the configuration set in use
+	Profile string
+	
+	// watch starts watching the configuration file once
+	watch sync.Once
+}
+
+// the configuration manager of the daemon, see SetShared
+var shared struct {
+	lock sync.Mutex
+	cm   *ConfManager
+}
+
+// SetShared makes cm the configuration manager Shared returns. The daemon
+// sets the one it watches, so its services and the requests of peers use
+// it instead of loading the configuration again.
+func SetShared(cm *ConfManager) {
+	shared.lock.Lock()
+	defer shared.lock.Unlock()
+	shared.cm = cm
+}
+
+// Shared returns the configuration manager of the daemon once it is set,
+// commands get the configuration of the default home as it is on disk
+func Shared() (*ConfManager, error) {
+	shared.lock.Lock()
+	cm := shared.cm
+	shared.lock.Unlock()
+	if cm != nil {
+		return cm, nil
+	}
+	return NewConfManager("")
 }
 
 // defaultConfig provides the default configuration values for new installations
@@ -81,8 +1314,15 @@ var defaultConfig = Configure{
 	// Generate unique identifier for this node
 	ID: uuid.New().String(),
 	
-	// Default signaling server (should be changed in production)
-	SignalingServerAddr: "http://140.179.153.231:11095",
+	// The signaling server is asked by 'sshx init', there is no public one
+	SignalingServerAddr: "",
+	
+	// Poll every 200ms during handshakes, every 5 seconds at most otherwise
+	SignalingPollConf: SignalingPollConf{
+		Active: 200,
+		Idle:   5000,
+		Window: 30,
+	},
 	
 	// WebRTC configuration with Google's public STUN servers
 	// STUN servers help with NAT traversal by discovering public IP addresses
@@ -101,129 +1341,406 @@ var defaultConfig = Configure{
 		},
 	},
 	
+	// Check the STUN servers every 5 minutes
+	STUNProbeConf: STUNProbeConf{
+		Interval: 300,
+		Timeout:  3,
+	},
+	
 	// Use default VNC configuration from the VNC library
 	VNCConf: config.DefaultConfigure,
+	
+	// Keep 2 tunnels of proxies ready, dialed again after a minute
+	ProxyConf: ProxyConf{
+		Warm:     2,
+		WarmIdle: 60,
+	},
+	
+	// Split files larger than 16MiB across 4 data channels, sent in
+	// messages of 60KiB
+	TransferConf: TransferConf{
+		Parallelism:       4,
+		ParallelThreshold: 16 << 20,
+		MessageSize:       60 << 10,
+		BatchDelay:        1,
+	},
+	
+	// Cache attributes briefly and retry dropped mounts for up to 30s apart
+	SSHFSConf: SSHFSConf{
+		AttrTimeout:       1,
+		EntryTimeout:      1,
+		ReconnectMaxDelay: 30,
+	},
+	
+	// File drop page is disabled unless explicitly enabled
+	FileDropConf: FileDropConf{
+		ListenAddr: ":2226",
+	},
+	
+	// Profiling endpoints are off unless asked for
+	DebugConf: DebugConf{
+		Port: 2227,
+	},
+	
+	// Viewers share one capture of the desktop
+	VNCSessionConf: VNCSessionConf{
+		Shared: true,
+	},
+	
+	// Recordings are kept for 30 days once enabled
+	VNCRecordConf: VNCRecordConf{
+		MaxAge: 30,
+	},
+	
+	// Serve the running session, virtual displays use 1280x800
+	VNCDisplayConf: VNCDisplayConf{
+		Address: "127.0.0.1:5900",
+		Display: ":99",
+		Width:   1280,
+		Height:  800,
+	},
+	
+	// Clipboard access is disabled unless explicitly enabled
+	ClipboardConf: ClipboardConf{
+		MaxSize:      4 << 20,
+		PollInterval: 500,
+		VNCSessions:  true,
+	},
+	
+	// RDP access is disabled unless explicitly enabled
+	RDPConf: RDPConf{
+		Address: "127.0.0.1:3389",
+	},
+	
+	// Audio streaming is disabled unless explicitly enabled
+	AudioConf: AudioConf{
+		Bitrate: 64000,
+	},
+	
+	// Knock mode asks for ssh and vnc sessions once enabled
+	KnockConf: KnockConf{
+		Apps:    []string{"ssh", "vnc"},
+		Timeout: 30,
+	},
+	
+	// Warn 5 minutes before sessions expire
+	SessionConf: SessionConf{
+		Warning: 300,
+	},
+	
+	// Sessions are kept for 90 days
+	HistoryConf: HistoryConf{
+		Enabled:    true,
+		Retention:  90,
+		MaxRecords: 10000,
+	},
+	
+	// Every category is exported once a destination is set
+	AuditConf: AuditConf{
+		Categories:    []string{"session", "auth", "pairing", "keys", "task"},
+		WebhookFormat: "json",
+	},
+	
+	// Wait 30 seconds for the touch of a FIDO2 key
+	FIDOConf: FIDOConf{
+		RPID:    "sshx",
+		Timeout: 30,
+	},
+	
+	// Rules apply once enabled, sessions no rule allows are denied
+	AccessConf: AccessConf{
+		Default: "deny",
+	},
+	
+	// Codes are asked for ssh and vnc sessions of enrolled peers
+	TOTPConf: TOTPConf{
+		Apps: []string{"ssh", "vnc"},
+	},
+	
+	// Keep conversations and show the last 20 messages
+	MessageConf: MessageConf{
+		History:       true,
+		HistoryLines:  20,
+		RetryInterval: 30,
+	},
+	
+	// Notifications are disabled unless explicitly enabled, 6 a minute
+	// per peer
+	NotifyConf: NotifyConf{
+		Rate: 6,
+	},
+	
+	// A standby takes over after 10 seconds without heartbeat
+	StandbyConf: StandbyConf{
+		Listen:    ":7800",
+		Heartbeat: 2,
+		Failover:  10,
+	},
+	
+	// A shared daemon listens on the socket of the system daemons
+	SharingConf: SharingConf{
+		Socket: "/run/sshx/sshx.sock",
+	},
+	
+	// Refresh the entry of the directory every hour once enabled
+	DirectoryConf: DirectoryConf{
+		Interval:     3600,
+		Capabilities: []string{"ssh"},
+	},
+	
+	// Keep the connections to DERP relays alive every minute once set
+	DERPConf: DERPConf{
+		KeepAlive: 60,
+	},
+	
+	// Routes are learned every 5 minutes once enabled, sessions go
+	// through 2 relays at most
+	MeshConf: MeshConf{
+		MaxHops:  3,
+		Interval: 300,
+	},
+	
+	// Take the Tailscale networks as the overlay
+	OverlayConf: OverlayConf{
+		Enabled: true,
+		CIDRs:   []string{"100.64.0.0/10", "fd7a:115c:a1e0::/48"},
+		Port:    8098,
+	},
+	
+	// Kubernetes access is disabled unless explicitly enabled, exec is
+	// allowed then
+	KubeConf: KubeConf{
+		Exec: true,
+	},
+	
+	// Docker access is disabled unless explicitly enabled, exec is allowed
+	// then
+	DockerConf: DockerConf{
+		Exec: true,
+	},
+	
+	// Serial consoles are disabled unless explicitly enabled
+	SerialConf: SerialConf{
+		Baud: 115200,
+	},
+	
+	// Shell sessions are disabled unless explicitly enabled
+	ShellConf: ShellConf{
+		Scrollback: 64 << 10,
+	},
+	
+	// Mappings live an hour unless renewed
+	PortMapConf: PortMapConf{
+		Lease: 3600,
+	},
+	
+	// Devices published in DNS are found by their domain name
+	DNSConf: DNSConf{
+		Enabled: true,
+	},
+	
+	// Advertise ssh and look for devices every minute, adding them to the
+	// address book
+	DiscoveryConf: DiscoveryConf{
+		Enabled:     true,
+		Apps:        []string{"ssh", "transfer", "messager"},
+		Interval:    60,
+		AddressBook: false,
+	},
 }
 
-// ClearKnownHosts removes entries from SSH known_hosts file matching the given substring
+// ClearKnownHosts removes entries from an SSH known_hosts file matching the given substring
 // This prevents SSH host key verification issues when connecting to local sshx instances
 // The function handles IPv4 localhost addresses by wrapping them in brackets
-func ClearKnownHosts(subStr string) {
+// The file keeps its permissions and is only rewritten if an entry was removed
+func ClearKnownHosts(fileName, subStr string) error {
 	// Convert localhost IP to bracketed format for SSH known_hosts
 	// SSH uses [127.0.0.1]:port format for non-standard ports
 	subStr = strings.Replace(subStr, "127.0.0.1", "[127.0.0.1]", 1)
 	
-	// Path to user's SSH known_hosts file
-	fileName := os.Getenv("HOME") + "/.ssh/known_hosts"
+	// Keep the permissions of the file
+	info, err := os.Stat(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
 	
 	// Read the current known_hosts file
 	input, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		logrus.Error(err)
-		return
+		return err
 	}
 	
 	// Split into lines and filter out matching entries
 	lines := strings.Split(string(input), "\n")
 	var newLines []string
-	for i, line := range lines {
+	for _, line := range lines {
 		// Skip lines that contain the substring we want to remove
-		if strings.Contains(line, subStr) {
-			// Skip this line (remove it)
-		} else {
-			// Keep this line
-			newLines = append(newLines, lines[i])
+		if !strings.Contains(line, subStr) {
+			newLines = append(newLines, line)
 		}
 	}
+	if len(newLines) == len(lines) {
+		return nil
+	}
 	
 	// Write the filtered content back to the file
 	output := strings.Join(newLines, "\n")
-	err = ioutil.WriteFile(fileName, []byte(output), 0777)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
+	return ioutil.WriteFile(fileName, []byte(output), info.Mode().Perm())
 }
 
 // NewConfManager creates a new configuration manager instance
-// It initializes Viper, loads configuration from file, and sets up file watching
+// It initializes Viper and loads configuration from file, Watch reloads it
+// when the file changes
 // If no config file exists, it creates one with default values
-func NewConfManager(homePath string) *ConfManager {
+func NewConfManager(homePath string) (*ConfManager, error) {
 	// Use default home path if none provided
 	if homePath == "" {
 		homePath = utils.GetSSHXHome()
 	}
 	
+	// Select the profile of this process
+	profile := ActiveProfile(homePath)
+	if err := checkProfileName(profile); err != nil {
+		return nil, err
+	}
+	
 	// Temporary configuration holder
 	var tmp Configure
 	
+	// The system configuration, if any, is overlaid by the one of the user
+	sysFile := systemConfigFile(homePath, profile)
+	
+	// The overlay of a managed fleet is applied over both
+	remoteFile := remoteOverlayFile(homePath, profile)
+	merged := viper.New()
+	
 	// Initialize Viper for configuration management
+	// The format is given by the extension of the file: json, yaml or toml
 	vp := viper.New()
-	vp.SetConfigName(".sshx_config")    // Config file name (without extension)
-	vp.SetConfigType("json")            // Configuration file format
-	vp.AddConfigPath(homePath)          // Directory to search for config file
-	
-	// Set up configuration file watching for live reloading
-	vp.WatchConfig()
-	vp.OnConfigChange(func(e fsnotify.Event) {
-		// Reload configuration when file changes
-		err := vp.Unmarshal(&tmp)
-		if err != nil {
-			logrus.Error(err)
-			return
-		}
-	})
+	vp.SetConfigName(configName(profile)) // Config file name (without extension)
+	vp.AddConfigPath(homePath)            // Directory to search for config file
+	vp.SetConfigPermissions(0600)         // Config file may hold credentials
 	
 	// Try to read existing configuration file
 	err := vp.ReadInConfig()
 	if err != nil {
 		// Check if error is due to missing config file
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok && sysFile != "" {
+			// Only the system configuration exists, changes of the user
+			// create a file that overlays it
+			vp.SetConfigFile(path.Join(homePath, configName(profile)+"."+configFormat()))
+		} else if ok {
 			// Config file not found - create default configuration
 			
+			// Create the configuration directory, XDG ones may not exist yet
+			err = os.MkdirAll(homePath, 0700)
+			if err != nil {
+				return nil, err
+			}
+			
 			// Generate unique peer identity for WebRTC
 			defaultConfig.RTCConf.PeerIdentity = utils.HashString(fmt.Sprintf("%s%d", defaultConfig.ID, time.Now().Unix()))
 			
 			// Set VNC static files path
 			defaultConfig.VNCStaticPath = path.Join(homePath, "noVNC")
 			
-			// Serialize default config to JSON
-			bs, _ := json.MarshalIndent(defaultConfig, "", "  ")
-			
 			// Load default config into Viper
-			vp.ReadConfig(bytes.NewBuffer(bs))
+			vp.MergeConfigMap(defaultConfigMap(defaultConfig))
 			
-			// Write default config to file
-			err = vp.WriteConfigAs(path.Join(homePath, "./.sshx_config.json"))
+			// Write default config to file in the chosen format
+			file := path.Join(homePath, configName(profile)+"."+configFormat())
+			err = vp.WriteConfigAs(file)
 			if err != nil {
-				logrus.Error(err)
-				os.Exit(1)
+				return nil, err
 			}
 			
-			// Make config file readable/writable
-			os.Chmod(path.Join(homePath, "./.sshx_config.json"), 0777)
+			// Later writes go to the new file
+			vp.SetConfigFile(file)
 		} else {
 			// Other error reading config file
-			logrus.Error(err)
-			os.Exit(1)
+			return nil, err
 		}
 	}
 
-	// Unmarshal configuration into struct
-	err = vp.Unmarshal(&tmp)
+	// Merge the layers and unmarshal configuration into struct
+	err = overlayConfig(merged, sysFile, vp, remoteFile)
 	if err != nil {
-		logrus.Error(err)
-		os.Exit(1)
+		return nil, err
+	}
+	err = merged.Unmarshal(&tmp)
+	if err != nil {
+		return nil, err
 	}
 
-	// Clean up SSH known_hosts to prevent host key conflicts
-	ClearKnownHosts(fmt.Sprintf("127.0.0.1:%d", tmp.LocalSSHPort))
-	
 	// Return initialized configuration manager
 	return &ConfManager{
-		Conf:  &tmp,
-		Viper: vp,
-		Path:  homePath,
+		Conf:    &tmp,
+		Viper:   merged,
+		user:    vp,
+		Path:    homePath,
+		Profile: profile,
+	}, nil
+}
+
+// Watch reloads the configuration when the file of the user or the fleet
+// overlay changes, from then on. Every watcher holds an inotify instance
+// until the process exits, so only the daemon watches the configuration it
+// shares.
+func (cm *ConfManager) Watch() error {
+	var err error
+	cm.watch.Do(func() {
+		var w *fsnotify.Watcher
+		w, err = fsnotify.NewWatcher()
+		if err != nil {
+			return
+		}
+		// editors replace files, the directory is watched
+		err = w.Add(cm.Path)
+		if err != nil {
+			w.Close()
+			return
+		}
+		go cm.watchFiles(w)
+	})
+	return err
+}
+
+func (cm *ConfManager) watchFiles(w *fsnotify.Watcher) {
+	defer w.Close()
+	files := map[string]bool{
+		filepath.Clean(cm.user.ConfigFileUsed()):               true,
+		filepath.Clean(remoteOverlayFile(cm.Path, cm.Profile)): true,
+	}
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if !files[filepath.Clean(ev.Name)] || ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			// Reload configuration when file changes
+			err := cm.user.ReadInConfig()
+			if err != nil {
+				if _, ok := err.(viper.ConfigFileNotFoundError); !ok && !os.IsNotExist(err) {
+					logrus.Error(err)
+					continue
+				}
+			}
+			err = cm.reload()
+			if err != nil {
+				logrus.Error(err)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			logrus.Warn("watch configure: ", err)
+		}
 	}
 }
 
@@ -232,18 +1749,9 @@ func NewConfManager(homePath string) *ConfManager {
 func (cm *ConfManager) Set(key, value string) {
 	logrus.Info("key/value", key, value)
 	
-	// Update the value in Viper
-	cm.Viper.Set(key, value)
-	
-	// Unmarshal updated config back to struct
-	err := cm.Viper.Unmarshal(cm.Conf)
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	
-	// Persist changes to configuration file
-	err = cm.Viper.WriteConfig()
+	// Parse the value as the type of the key and persist it to the
+	// configuration file of the user
+	err := cm.SetString(key, value)
 	if err != nil {
 		logrus.Error(err)
 		return
@@ -257,6 +1765,6 @@ func (cm *ConfManager) Show() {
 	bs, _ := json.MarshalIndent(cm.Conf, "", "  ")
 	
 	// Display configuration file location and contents
-	logrus.Info("read configure file at: ", cm.Path+"/.sshx_config.json")
+	logrus.Info("read configure files: ", strings.Join(ConfigFiles(cm.Path, cm.Profile), ", "), " (profile ", cm.Profile, ")")
 	logrus.Info(string(bs))
 }
@@ -0,0 +1,61 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// formats a configure file may be written in, viper finds the file by its
+// extension whatever the format
+var configFormats = []string{"json", "yaml", "yml", "toml"}
+
+// configFormat returns the format of a new configure file, chosen with the
+// SSHX_CONFIG_FORMAT environment value and JSON by default
+func configFormat() string {
+	format := strings.ToLower(strings.TrimPrefix(os.Getenv("SSHX_CONFIG_FORMAT"), "."))
+	if format == "" {
+		return "json"
+	}
+	for _, v := range configFormats {
+		if v == format {
+			return format
+		}
+	}
+	logrus.Warn("unsupported configure format ", format, ", use json")
+	return "json"
+}
+
+// defaultConfigMap converts a configure to the values viper writes. Numbers
+// keep their integer type, so TOML files don't show ports as floats.
+func defaultConfigMap(c Configure) map[string]interface{} {
+	bs, _ := json.Marshal(c)
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber()
+	var ret map[string]interface{}
+	dec.Decode(&ret)
+	return normalizeNumbers(ret).(map[string]interface{})
+}
+
+func normalizeNumbers(v interface{}) interface{} {
+	switch val := v.(type) {
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i
+		}
+		f, _ := val.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = normalizeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = normalizeNumbers(item)
+		}
+	}
+	return v
+}
@@ -0,0 +1,87 @@
+package conf
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/suutaku/sshx/internal/utils"
+)
+
+// systemConfigFile returns the system configuration a user configuration in
+// homePath overlays, or an empty string if there is none. SSHX_HOME keeps a
+// configuration on its own.
+func systemConfigFile(homePath, profile string) string {
+	if os.Getenv("SSHX_HOME") != "" || homePath == utils.SYSTEM_HOME {
+		return ""
+	}
+	return profileFile(utils.SYSTEM_HOME, profile)
+}
+
+// ConfigFiles returns the configuration files of a profile, the system one
+// first and the one overlaying it last
+func ConfigFiles(homePath, profile string) []string {
+	var ret []string
+	for _, v := range []string{systemConfigFile(homePath, profile), profileFile(homePath, profile)} {
+		if v != "" {
+			ret = append(ret, v)
+		}
+	}
+	if file := remoteOverlayFile(homePath, profile); fileExists(file) {
+		ret = append(ret, file)
+	}
+	return ret
+}
+
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+// overlayConfig replaces the settings of merged with the system file
+// overlaid by the settings of user, and by the fleet overlay in remoteFile
+func overlayConfig(merged *viper.Viper, sysFile string, user *viper.Viper, remoteFile string) error {
+	merged.SetConfigType("json")
+	err := merged.ReadConfig(bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return err
+	}
+	if sysFile != "" {
+		sys := viper.New()
+		sys.SetConfigFile(sysFile)
+		err = sys.ReadInConfig()
+		if err != nil {
+			return err
+		}
+		err = merged.MergeConfigMap(sys.AllSettings())
+		if err != nil {
+			return err
+		}
+	}
+	err = merged.MergeConfigMap(user.AllSettings())
+	if err != nil {
+		return err
+	}
+	overlay, err := readOverlay(remoteFile)
+	if err != nil {
+		// a broken overlay must not keep the device from starting
+		logrus.Warn("ignore fleet overlay: ", err)
+		return nil
+	}
+	if overlay == nil {
+		return nil
+	}
+	return merged.MergeConfigMap(overlay.Config)
+}
+
+// write saves a value to the configuration file of the user, the system one
+// is left to administrators
+func (cm *ConfManager) write(key string, value interface{}) error {
+	err := os.MkdirAll(cm.Path, 0700)
+	if err != nil {
+		return err
+	}
+	cm.user.Set(key, value)
+	return cm.user.WriteConfig()
+}
@@ -0,0 +1,160 @@
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PROFILE_ENV selects the profile of a process over the default one, it is
+// inherited by the processes it starts
+const PROFILE_ENV = "SSHX_PROFILE"
+
+// DEFAULT_PROFILE is the profile of .sshx_config, the configure used when no
+// other profile was chosen
+const DEFAULT_PROFILE = "default"
+
+var profileName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func checkProfileName(name string) error {
+	if !profileName.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q, use letters, digits, - and _", name)
+	}
+	for _, v := range configFormats {
+		if strings.EqualFold(v, name) {
+			return fmt.Errorf("invalid profile name %q", name)
+		}
+	}
+	return nil
+}
+
+// configName returns the name viper looks for, without extension. Profiles
+// are kept next to the default configure as .sshx_config.NAME.json
+func configName(profile string) string {
+	if profile == "" || profile == DEFAULT_PROFILE {
+		return ".sshx_config"
+	}
+	return ".sshx_config." + profile
+}
+
+func defaultProfileFile(homePath string) string {
+	return path.Join(homePath, ".sshx_profile")
+}
+
+// DefaultProfile returns the profile used when PROFILE_ENV is not set
+func DefaultProfile(homePath string) string {
+	bs, err := ioutil.ReadFile(defaultProfileFile(homePath))
+	if err != nil {
+		return DEFAULT_PROFILE
+	}
+	name := strings.TrimSpace(string(bs))
+	if checkProfileName(name) != nil {
+		return DEFAULT_PROFILE
+	}
+	return name
+}
+
+// SetDefaultProfile makes name the profile of commands and daemons started
+// without PROFILE_ENV
+func SetDefaultProfile(homePath, name string) error {
+	if name == DEFAULT_PROFILE {
+		err := os.Remove(defaultProfileFile(homePath))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !HasProfile(homePath, name) {
+		return fmt.Errorf("profile %s not found", name)
+	}
+	return ioutil.WriteFile(defaultProfileFile(homePath), []byte(name+"\n"), 0644)
+}
+
+// ActiveProfile returns the profile of this process
+func ActiveProfile(homePath string) string {
+	if name := os.Getenv(PROFILE_ENV); name != "" {
+		return name
+	}
+	return DefaultProfile(homePath)
+}
+
+// profileFile returns the configure file of a profile, or an empty string
+// if it has none yet
+func profileFile(homePath, name string) string {
+	for _, ext := range configFormats {
+		file := path.Join(homePath, configName(name)+"."+ext)
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return ""
+}
+
+// HasProfile reports whether the profile has a configure file
+func HasProfile(homePath, name string) bool {
+	return profileFile(homePath, name) != ""
+}
+
+// Profiles returns the names of the profiles in homePath, the default one
+// first
+func Profiles(homePath string) []string {
+	files, _ := filepath.Glob(path.Join(homePath, ".sshx_config.*.*"))
+	seen := make(map[string]bool)
+	var ret []string
+	for _, v := range files {
+		name := strings.TrimPrefix(filepath.Base(v), ".sshx_config.")
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+		if checkProfileName(name) != nil || seen[name] {
+			continue
+		}
+		seen[name] = true
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return append([]string{DEFAULT_PROFILE}, ret...)
+}
+
+// CreateProfile creates the profile name from a copy of the configure of
+// another profile, in the same format
+func CreateProfile(homePath, name, from string) error {
+	err := checkProfileName(name)
+	if err != nil {
+		return err
+	}
+	if name == DEFAULT_PROFILE || HasProfile(homePath, name) {
+		return fmt.Errorf("profile %s already exists", name)
+	}
+	src := profileFile(homePath, from)
+	if src == "" {
+		return fmt.Errorf("profile %s not found", from)
+	}
+	bs, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(homePath, configName(name)+filepath.Ext(src)), bs, 0600)
+}
+
+// RemoveProfile removes the configure of a profile, the default profile
+// can't be removed
+func RemoveProfile(homePath, name string) error {
+	if name == DEFAULT_PROFILE {
+		return fmt.Errorf("the default profile can't be removed")
+	}
+	file := profileFile(homePath, name)
+	if file == "" {
+		return fmt.Errorf("profile %s not found", name)
+	}
+	if DefaultProfile(homePath) == name {
+		err := SetDefaultProfile(homePath, DEFAULT_PROFILE)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(file)
+}
@@ -0,0 +1,313 @@
+package conf
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/suutaku/sshx/internal/utils"
+)
+
+// Overlay is the configure overlay of a managed fleet, its settings replace
+// the ones of the system and of the user
+type Overlay struct {
+	// Serial orders overlays, older ones are refused
+	Serial int64
+
+	// Config holds the settings with the layout of a configure file
+	Config map[string]interface{}
+}
+
+// SignedOverlay is an overlay signed by the admin of the fleet
+type SignedOverlay struct {
+	// Payload is the JSON of the Overlay
+	Payload []byte
+
+	// Signature is the ed25519 signature of Payload
+	Signature []byte
+}
+
+// remoteOverlayFile returns the applied overlay of a profile, named apart
+// from configure files so it is not taken for a profile
+func remoteOverlayFile(homePath, profile string) string {
+	name := strings.Replace(configName(profile), ".sshx_config", ".sshx_remote", 1)
+	return path.Join(homePath, name+".json")
+}
+
+func decodeOverlay(bs []byte) (*Overlay, error) {
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber()
+	var o Overlay
+	err := dec.Decode(&o)
+	if err != nil {
+		return nil, err
+	}
+	if o.Config == nil {
+		o.Config = make(map[string]interface{})
+	}
+	o.Config = normalizeNumbers(o.Config).(map[string]interface{})
+	return &o, nil
+}
+
+// readOverlay returns the overlay saved in file, nil if there is none
+func readOverlay(file string) (*Overlay, error) {
+	if file == "" {
+		return nil, nil
+	}
+	bs, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeOverlay(bs)
+}
+
+// NewOverlay reads the settings of an overlay from a configure file, in any
+// configure format
+func NewOverlay(file string, serial int64) (*Overlay, error) {
+	vp := viper.New()
+	vp.SetConfigFile(file)
+	err := vp.ReadInConfig()
+	if err != nil {
+		return nil, err
+	}
+	if serial == 0 {
+		serial = time.Now().Unix()
+	}
+	o := &Overlay{Serial: serial, Config: vp.AllSettings()}
+	return o, checkOverlayKeys(&Configure{}, "", o.Config)
+}
+
+// checkOverlayKeys refuses unknown keys, and the device ID which must stay
+// unique in the fleet
+func checkOverlayKeys(c *Configure, prefix string, m map[string]interface{}) error {
+	for k, v := range m {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		field, name, err := lookupField(c, key)
+		if err != nil {
+			return err
+		}
+		if name == "id" {
+			return fmt.Errorf("the device ID can't be set by a fleet overlay")
+		}
+		if sub, ok := v.(map[string]interface{}); ok && field.Kind() == reflect.Struct {
+			err = checkOverlayKeys(c, key, sub)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateConfigure checks every value of c as SetValue does
+func validateConfigure(c *Configure) error {
+	var walk func(v reflect.Value, prefix string) error
+	walk = func(v reflect.Value, prefix string) error {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			name := strings.ToLower(field.Name)
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			var err error
+			if v.Field(i).Kind() == reflect.Struct {
+				err = walk(v.Field(i), name)
+			} else {
+				err = validateValue(name, v.Field(i))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(reflect.ValueOf(c).Elem(), "")
+}
+
+// Validate checks every value of the configure as SetValue does
+func (cm *ConfManager) Validate() error {
+	return validateConfigure(cm.Conf)
+}
+
+func adminKeyFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "fleet_admin.key")
+}
+
+// GenerateAdminKey creates the signing key of a fleet admin and returns its
+// public key, to be set as RemoteConf.PublicKey on the devices
+func GenerateAdminKey() (string, error) {
+	if fileExists(adminKeyFile()) {
+		return "", fmt.Errorf("admin key %s already exists", adminKeyFile())
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(adminKeyFile()), 0700)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(adminKeyFile(), []byte(base64.StdEncoding.EncodeToString(priv)+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
+
+func loadAdminKey() (ed25519.PrivateKey, error) {
+	bs, err := ioutil.ReadFile(adminKeyFile())
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(bs)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid admin key %s", adminKeyFile())
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// AdminPublicKey returns the public key of the admin key of this device
+func AdminPublicKey() (string, error) {
+	key, err := loadAdminKey()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)), nil
+}
+
+// SignOverlay signs an overlay with the admin key of this device
+func SignOverlay(o *Overlay) ([]byte, error) {
+	key, err := loadAdminKey()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(SignedOverlay{
+		Payload:   payload,
+		Signature: ed25519.Sign(key, payload),
+	}, "", "  ")
+}
+
+// VerifyOverlay returns the overlay of a signed overlay if it was signed by
+// the admin key publicKey
+func VerifyOverlay(publicKey string, data []byte) (*Overlay, error) {
+	pub, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid admin public key")
+	}
+	var so SignedOverlay
+	err = json.Unmarshal(data, &so)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signed overlay: %v", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), so.Payload, so.Signature) {
+		return nil, fmt.Errorf("overlay not signed by the admin key")
+	}
+	o, err := decodeOverlay(so.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid overlay: %v", err)
+	}
+	return o, nil
+}
+
+// AppliedOverlay returns the overlay applied to this profile, nil if none
+func (cm *ConfManager) AppliedOverlay() (*Overlay, error) {
+	return readOverlay(remoteOverlayFile(cm.Path, cm.Profile))
+}
+
+// ApplyOverlay applies an overlay newer than the applied one and reports
+// whether the configure changed. The overlay is only saved if the configure
+// it results in is valid, otherwise the applied one is kept.
+func (cm *ConfManager) ApplyOverlay(o *Overlay) (bool, error) {
+	file := remoteOverlayFile(cm.Path, cm.Profile)
+	// a broken overlay may be replaced by any newer one
+	old, _ := readOverlay(file)
+	if old != nil && o.Serial <= old.Serial {
+		if o.Serial == old.Serial {
+			return false, nil
+		}
+		return false, fmt.Errorf("overlay %d is older than the applied overlay %d", o.Serial, old.Serial)
+	}
+	err := checkOverlayKeys(cm.Conf, "", o.Config)
+	if err != nil {
+		return false, err
+	}
+	bs, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	tmp := file + ".new"
+	err = ioutil.WriteFile(tmp, bs, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+
+	// validate the configure the overlay results in before applying it
+	sysFile := systemConfigFile(cm.Path, cm.Profile)
+	candidate := viper.New()
+	err = overlayConfig(candidate, sysFile, cm.user, tmp)
+	if err != nil {
+		return false, err
+	}
+	var c Configure
+	err = candidate.Unmarshal(&c)
+	if err == nil {
+		err = validateConfigure(&c)
+	}
+	if err != nil {
+		return false, fmt.Errorf("overlay %d refused: %v", o.Serial, err)
+	}
+	err = os.Rename(tmp, file)
+	if err != nil {
+		return false, err
+	}
+	return true, cm.reload()
+}
+
+// RemoveOverlay removes the applied overlay, the configure of the system and
+// of the user apply again
+func (cm *ConfManager) RemoveOverlay() error {
+	err := os.Remove(remoteOverlayFile(cm.Path, cm.Profile))
+	if err != nil {
+		return err
+	}
+	return cm.reload()
+}
+
+func (cm *ConfManager) reload() error {
+	err := overlayConfig(cm.Viper, systemConfigFile(cm.Path, cm.Profile), cm.user, remoteOverlayFile(cm.Path, cm.Profile))
+	if err != nil {
+		return err
+	}
+	var c Configure
+	err = cm.Viper.Unmarshal(&c)
+	if err != nil {
+		return err
+	}
+	*cm.Conf = c
+	return nil
+}
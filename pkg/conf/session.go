@@ -0,0 +1,47 @@
+package conf
+
+import (
+	"fmt"
+	"time"
+)
+
+// SessionLimit returns the maximum duration of a session of peerId with the
+// application app, zero if it is not limited
+func (cm *ConfManager) SessionLimit(peerId, app string) time.Duration {
+	for _, l := range cm.Conf.SessionConf.Limits {
+		if cm.matchSession(l.Peers, l.Apps, peerId, app) {
+			return time.Duration(l.MaxDuration) * time.Second
+		}
+	}
+	return 0
+}
+
+// SessionWarning returns how long before their expiry sessions are warned
+func (cm *ConfManager) SessionWarning() time.Duration {
+	return time.Duration(cm.Conf.SessionConf.Warning) * time.Second
+}
+
+// AddSessionLimit inserts a limit before the limit at index, or appends it
+// if index is out of range
+func (cm *ConfManager) AddSessionLimit(l SessionLimit, index int) error {
+	if len(l.Peers) == 0 || len(l.Apps) == 0 {
+		return fmt.Errorf("a session limit needs peers and applications")
+	}
+	limits := append([]SessionLimit{}, cm.Conf.SessionConf.Limits...)
+	if index < 0 || index >= len(limits) {
+		limits = append(limits, l)
+	} else {
+		limits = append(limits[:index], append([]SessionLimit{l}, limits[index:]...)...)
+	}
+	return cm.SetValue("sessionconf.limits", limits)
+}
+
+// RemoveSessionLimit removes the limit at index
+func (cm *ConfManager) RemoveSessionLimit(index int) error {
+	limits := cm.Conf.SessionConf.Limits
+	if index < 0 || index >= len(limits) {
+		return fmt.Errorf("no session limit %d", index)
+	}
+	left := append([]SessionLimit{}, limits[:index]...)
+	return cm.SetValue("sessionconf.limits", append(left, limits[index+1:]...))
+}
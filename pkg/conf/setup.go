@@ -0,0 +1,74 @@
+package conf
+
+import (
+	"github.com/pion/webrtc/v3"
+)
+
+// Setup holds the answers of the first run setup
+type Setup struct {
+	// SignalingServerAddr is the signaling server of the devices
+	SignalingServerAddr string
+
+	// SignalingToken is the tenant token of the signaling server, if any
+	SignalingToken string
+
+	// ICEServers are the STUN and TURN servers
+	ICEServers []webrtc.ICEServer
+
+	// Proxy is the outbound proxy of the signaling requests and TURN
+	// connections, the one of the environment if empty
+	Proxy string
+}
+
+// ConfigExists reports whether the active profile has a configure, of the
+// system or of the user
+func ConfigExists(homePath string) bool {
+	return len(ConfigFiles(homePath, ActiveProfile(homePath))) > 0
+}
+
+// DefaultSetup returns the settings the setup proposes: those of the
+// configure if it exists, the default ones otherwise
+func DefaultSetup(homePath string) (Setup, error) {
+	if !ConfigExists(homePath) {
+		return Setup{
+			SignalingServerAddr: defaultConfig.SignalingServerAddr,
+			ICEServers:          defaultConfig.RTCConf.ICEServers,
+		}, nil
+	}
+	cm, err := NewConfManager(homePath)
+	if err != nil {
+		return Setup{}, err
+	}
+	return Setup{
+		SignalingServerAddr: cm.Conf.SignalingServerAddr,
+		SignalingToken:      cm.Conf.SignalingToken,
+		ICEServers:          cm.Conf.RTCConf.ICEServers,
+		Proxy:               cm.Conf.OutboundProxyConf.URL,
+	}, nil
+}
+
+// Apply saves the answers of the setup, the configure is created with
+// a new identity if it does not exist yet
+func (s Setup) Apply(homePath string) (*ConfManager, error) {
+	cm, err := NewConfManager(homePath)
+	if err != nil {
+		return nil, err
+	}
+	err = cm.SetValue("signalingserveraddr", s.SignalingServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	err = cm.SetValue("signalingtoken", s.SignalingToken)
+	if err != nil {
+		return nil, err
+	}
+	err = cm.SetValue(iceServersKey, s.ICEServers)
+	if err != nil {
+		return nil, err
+	}
+	err = cm.SetValue("outboundproxyconf.url", s.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
@@ -0,0 +1,18 @@
+package conf
+
+// FindUserScope returns the permissions of the local user named name with
+// the uid uid, nil if the user may not use the shared daemon
+func (cm *ConfManager) FindUserScope(name, uid string) *UserScope {
+	for i, s := range cm.Conf.SharingConf.Users {
+		if s.User == "*" || s.User == uid || (name != "" && s.User == name) {
+			return &cm.Conf.SharingConf.Users[i]
+		}
+	}
+	return nil
+}
+
+// Allows reports whether the user may open a session of peerId with the
+// application app, admins may open any
+func (s *UserScope) Allows(cm *ConfManager, peerId, app string) bool {
+	return s.Admin || cm.matchSession(s.Peers, s.Apps, peerId, app)
+}
@@ -0,0 +1,91 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// the daemon serves and replicates itself to the standby
+	STANDBY_ACTIVE = "active"
+	// the daemon follows the active one and takes over when it fails
+	STANDBY_STANDBY = "standby"
+)
+
+// ReplicaConfig returns the configure file of the user and its format, as
+// the active daemon replicates it. It is empty if only the system configure
+// exists.
+func (cm *ConfManager) ReplicaConfig() (string, []byte, error) {
+	file := cm.user.ConfigFileUsed()
+	bs, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimPrefix(filepath.Ext(file), "."), bs, nil
+}
+
+// ApplyReplica replaces the configure of the user with the one the active
+// daemon replicated, in format. The standby settings of this daemon are
+// kept, and the replica is only saved if the configure it results in is
+// valid.
+func (cm *ConfManager) ApplyReplica(format string, data []byte) error {
+	switch format {
+	case "json", "yaml", "yml", "toml":
+	default:
+		return fmt.Errorf("unknown configure format %s", format)
+	}
+	replica := viper.New()
+	replica.SetConfigType(format)
+	err := replica.ReadConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	bs, err := json.Marshal(cm.Conf.StandbyConf)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber()
+	var own map[string]interface{}
+	err = dec.Decode(&own)
+	if err != nil {
+		return err
+	}
+	replica.Set("standbyconf", normalizeNumbers(own))
+
+	candidate := viper.New()
+	err = overlayConfig(candidate, systemConfigFile(cm.Path, cm.Profile), replica, remoteOverlayFile(cm.Path, cm.Profile))
+	if err != nil {
+		return err
+	}
+	var c Configure
+	err = candidate.Unmarshal(&c)
+	if err == nil {
+		err = validateConfigure(&c)
+	}
+	if err != nil {
+		return fmt.Errorf("replica refused: %v", err)
+	}
+	err = os.MkdirAll(cm.Path, 0700)
+	if err != nil {
+		return err
+	}
+	replica.SetConfigFile(cm.user.ConfigFileUsed())
+	replica.SetConfigPermissions(0600)
+	err = replica.WriteConfig()
+	if err != nil {
+		return err
+	}
+	cm.user = replica
+	return cm.reload()
+}
@@ -0,0 +1,77 @@
+package conf
+
+import (
+	"fmt"
+
+	"github.com/suutaku/sshx/internal/cron"
+)
+
+// Validate checks the task has a name, a peer, a valid schedule and one
+// action
+func (t TaskConf) Validate() error {
+	if t.Name == "" || t.Peer == "" {
+		return fmt.Errorf("a task needs a name and a peer")
+	}
+	_, err := cron.Parse(t.Schedule)
+	if err != nil {
+		return err
+	}
+	actions := 0
+	for _, v := range []string{t.Exec, t.Pull, t.Push} {
+		if v != "" {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("a task runs one of exec, pull or push")
+	}
+	if t.Timeout < 0 {
+		return fmt.Errorf("negative task timeout %d", t.Timeout)
+	}
+	return nil
+}
+
+// FindTask returns the task named name, nil if there is none
+func (cm *ConfManager) FindTask(name string) *TaskConf {
+	for i := range cm.Conf.ScheduleConf.Tasks {
+		if cm.Conf.ScheduleConf.Tasks[i].Name == name {
+			return &cm.Conf.ScheduleConf.Tasks[i]
+		}
+	}
+	return nil
+}
+
+// AddTask adds t to the tasks of the scheduler, or replaces the task of
+// the same name
+func (cm *ConfManager) AddTask(t TaskConf) error {
+	err := t.Validate()
+	if err != nil {
+		return err
+	}
+	tasks := append([]TaskConf{}, cm.Conf.ScheduleConf.Tasks...)
+	replaced := false
+	for i := range tasks {
+		if tasks[i].Name == t.Name {
+			tasks[i] = t
+			replaced = true
+		}
+	}
+	if !replaced {
+		tasks = append(tasks, t)
+	}
+	return cm.SetValue("scheduleconf.tasks", tasks)
+}
+
+// RemoveTask removes the task named name
+func (cm *ConfManager) RemoveTask(name string) error {
+	var tasks []TaskConf
+	for _, t := range cm.Conf.ScheduleConf.Tasks {
+		if t.Name != name {
+			tasks = append(tasks, t)
+		}
+	}
+	if len(tasks) == len(cm.Conf.ScheduleConf.Tasks) {
+		return fmt.Errorf("no task %s", name)
+	}
+	return cm.SetValue("scheduleconf.tasks", tasks)
+}
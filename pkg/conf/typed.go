@@ -0,0 +1,413 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const iceServersKey = "rtcconf.iceservers"
+
+// Transfer messages are sealed, and peers take messages of 65535 bytes at
+// most once sealed
+const (
+	minTransferMessage = 1 << 10
+	maxTransferMessage = 65535 - 24
+)
+
+// maxSignalingPoll is the longest idle poll interval in milliseconds,
+// signaling servers drop the messages of peers not pulled for 15 seconds
+const maxSignalingPoll = 10000
+
+// minDiscoveryInterval is the shortest interval of the queries of the
+// local network in seconds, the network is shared with other devices
+const minDiscoveryInterval = 5
+
+// maxProxyWarm bounds the tunnels a proxy dials ahead, each one holds a
+// session on the remote device
+const maxProxyWarm = 16
+
+// lookupField returns the field of c at a dotted key such as
+// vncconf.websockify.port and its viper key. Names are matched
+// case-insensitively against field names and their JSON tags.
+func lookupField(c *Configure, key string) (reflect.Value, string, error) {
+	v := reflect.ValueOf(c).Elem()
+	var names []string
+	for _, name := range strings.Split(key, ".") {
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, "", fmt.Errorf("invalid key %q: %s is not a section", key, strings.Join(names, "."))
+		}
+		found := false
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			tag := strings.Split(field.Tag.Get("json"), ",")[0]
+			if field.PkgPath != "" || tag == "-" {
+				continue
+			}
+			if strings.EqualFold(field.Name, name) || (tag != "" && strings.EqualFold(tag, name)) {
+				v = v.Field(i)
+				names = append(names, strings.ToLower(field.Name))
+				found = true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}, "", fmt.Errorf("unknown configure key %q", key)
+		}
+	}
+	return v, strings.Join(names, "."), nil
+}
+
+// Get returns the value of a dotted key such as rtcconf.iceservers
+func (cm *ConfManager) Get(key string) (interface{}, error) {
+	v, _, err := lookupField(cm.Conf, key)
+	if err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+// GetString returns the value of a string key
+func (cm *ConfManager) GetString(key string) (string, error) {
+	v, _, err := lookupField(cm.Conf, key)
+	if err != nil {
+		return "", err
+	}
+	if v.Kind() != reflect.String {
+		return "", fmt.Errorf("%s is a %s, not a string", key, v.Type())
+	}
+	return v.String(), nil
+}
+
+// GetInt returns the value of an integer key
+func (cm *ConfManager) GetInt(key string) (int64, error) {
+	v, _, err := lookupField(cm.Conf, key)
+	if err != nil {
+		return 0, err
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int64(v.Uint()), nil
+	}
+	return 0, fmt.Errorf("%s is a %s, not an integer", key, v.Type())
+}
+
+// GetBool returns the value of a boolean key
+func (cm *ConfManager) GetBool(key string) (bool, error) {
+	v, _, err := lookupField(cm.Conf, key)
+	if err != nil {
+		return false, err
+	}
+	if v.Kind() != reflect.Bool {
+		return false, fmt.Errorf("%s is a %s, not a boolean", key, v.Type())
+	}
+	return v.Bool(), nil
+}
+
+// SetValue sets a dotted key to value, which must have the type of the key
+// or one convertible to it, and writes it to the configure of the user
+func (cm *ConfManager) SetValue(key string, value interface{}) error {
+	field, name, err := lookupField(cm.Conf, key)
+	if err != nil {
+		return err
+	}
+	nv := reflect.ValueOf(value)
+	switch {
+	case !nv.IsValid():
+		nv = reflect.Zero(field.Type())
+	case nv.Type().AssignableTo(field.Type()):
+	case isNumber(nv.Kind()) && isNumber(field.Kind()):
+		nv = nv.Convert(field.Type())
+	default:
+		return fmt.Errorf("cannot set %s, a %s, to a %s", key, field.Type(), nv.Type())
+	}
+	return cm.setField(field, name, nv)
+}
+
+// SetString parses value as the type of the key and sets it. Structures and
+// lists of structures are given in JSON, lists of strings may also be
+// separated by commas.
+func (cm *ConfManager) SetString(key, value string) error {
+	field, name, err := lookupField(cm.Conf, key)
+	if err != nil {
+		return err
+	}
+	nv, err := parseValue(field.Type(), value)
+	if err != nil {
+		return fmt.Errorf("invalid value of %s: %v", key, err)
+	}
+	return cm.setField(field, name, nv)
+}
+
+func isNumber(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
+
+func parseValue(t reflect.Type, value string) (reflect.Value, error) {
+	ptr := reflect.New(t)
+	if t.Kind() == reflect.String {
+		ptr.Elem().SetString(value)
+		return ptr.Elem(), nil
+	}
+	err := json.Unmarshal([]byte(value), ptr.Interface())
+	if err == nil {
+		return ptr.Elem(), nil
+	}
+	// named types like policies unmarshal from JSON strings
+	if json.Unmarshal([]byte(strconv.Quote(value)), ptr.Interface()) == nil {
+		return ptr.Elem(), nil
+	}
+	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String {
+		list := reflect.MakeSlice(t, 0, 0)
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				list = reflect.Append(list, reflect.ValueOf(v).Convert(t.Elem()))
+			}
+		}
+		return list, nil
+	}
+	return reflect.Value{}, err
+}
+
+func (cm *ConfManager) setField(field reflect.Value, name string, nv reflect.Value) error {
+	err := validateValue(name, nv)
+	if err != nil {
+		return err
+	}
+	field.Set(nv)
+	value := configValue(nv.Interface())
+	cm.Viper.Set(name, value)
+	return cm.write(name, value)
+}
+
+// configValue converts a value to the maps and lists viper writes, with the
+// keys a configure file uses
+func configValue(v interface{}) interface{} {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber()
+	var ret interface{}
+	if dec.Decode(&ret) != nil {
+		return v
+	}
+	return normalizeNumbers(ret)
+}
+
+// validateValue checks the values which would break the node once saved
+func validateValue(name string, v reflect.Value) error {
+	last := name[strings.LastIndex(name, ".")+1:]
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if strings.HasSuffix(last, "port") && (v.Int() < 0 || v.Int() > 65535) {
+			return fmt.Errorf("invalid port %d for %s", v.Int(), name)
+		}
+	}
+	switch name {
+	case "logconf.level":
+		if v.String() != "" {
+			_, err := logrus.ParseLevel(v.String())
+			if err != nil {
+				return err
+			}
+		}
+	case "logconf.format":
+		switch strings.ToLower(v.String()) {
+		case "", "text", "json":
+		default:
+			return fmt.Errorf("unknown log format %s, use text or json", v.String())
+		}
+	case "auditconf.webhookformat":
+		switch strings.ToLower(v.String()) {
+		case "", "json", "cef":
+		default:
+			return fmt.Errorf("unknown webhook format %s, use json or cef", v.String())
+		}
+	case "accessconf.default":
+		return validateAccessAction(v.String())
+	case "accessconf.rules":
+		for _, r := range v.Interface().([]AccessRule) {
+			err := validateAccessAction(r.Action)
+			if err != nil {
+				return err
+			}
+		}
+	case "sessionconf.limits":
+		for _, l := range v.Interface().([]SessionLimit) {
+			if l.MaxDuration < 0 {
+				return fmt.Errorf("negative session duration %d", l.MaxDuration)
+			}
+		}
+	case "standbyconf.role":
+		switch v.String() {
+		case "", STANDBY_ACTIVE, STANDBY_STANDBY:
+		default:
+			return fmt.Errorf("unknown standby role %s, use %s or %s", v.String(), STANDBY_ACTIVE, STANDBY_STANDBY)
+		}
+	case "standbyconf.heartbeat", "standbyconf.failover":
+		if v.Int() <= 0 {
+			return fmt.Errorf("%s must be positive, got %d", name, v.Int())
+		}
+	case "sessionconf.warning":
+		if v.Int() < 0 {
+			return fmt.Errorf("negative session warning %d", v.Int())
+		}
+	case "signalingpollconf.active":
+		if v.Int() <= 0 {
+			return fmt.Errorf("signaling poll interval must be positive, got %d", v.Int())
+		}
+	case "signalingpollconf.idle":
+		if v.Int() <= 0 || v.Int() > maxSignalingPoll {
+			return fmt.Errorf("idle signaling poll interval must be within 1 and %d ms, got %d", maxSignalingPoll, v.Int())
+		}
+	case "signalingpollconf.window":
+		if v.Int() < 0 {
+			return fmt.Errorf("negative %s %d", name, v.Int())
+		}
+	case "overlayconf.cidrs":
+		for _, c := range v.Interface().([]string) {
+			_, _, err := net.ParseCIDR(c)
+			if err != nil {
+				return err
+			}
+		}
+	case "overlayconf.port":
+		if v.Int() < 1 || v.Int() > 65535 {
+			return fmt.Errorf("invalid overlay port %d", v.Int())
+		}
+	case "discoveryconf.interval":
+		if v.Int() < minDiscoveryInterval {
+			return fmt.Errorf("discovery interval must be at least %ds, got %d", minDiscoveryInterval, v.Int())
+		}
+	case "proxyconf.warm":
+		if v.Int() < 0 || v.Int() > maxProxyWarm {
+			return fmt.Errorf("proxy warm tunnels must be within 0 and %d, got %d", maxProxyWarm, v.Int())
+		}
+	case "proxyconf.warmidle":
+		if v.Int() < 1 {
+			return fmt.Errorf("proxy warm idle must be at least 1s, got %d", v.Int())
+		}
+	case "serialconf.baud":
+		if v.Int() <= 0 {
+			return fmt.Errorf("invalid serial speed %d", v.Int())
+		}
+	case "scheduleconf.tasks":
+		names := make(map[string]bool)
+		for _, t := range v.Interface().([]TaskConf) {
+			err := t.Validate()
+			if err != nil {
+				return fmt.Errorf("task %s: %v", t.Name, err)
+			}
+			if names[t.Name] {
+				return fmt.Errorf("two tasks named %s", t.Name)
+			}
+			names[t.Name] = true
+		}
+	case "shellconf.scrollback":
+		if v.Int() < 0 {
+			return fmt.Errorf("negative shell scrollback %d", v.Int())
+		}
+	case "transferconf.messagesize":
+		if v.Int() < minTransferMessage || v.Int() > maxTransferMessage {
+			return fmt.Errorf("transfer message size must be within %d and %d bytes, got %d", minTransferMessage, maxTransferMessage, v.Int())
+		}
+	case "transferconf.batchdelay":
+		if v.Int() < 0 || v.Int() > 100 {
+			return fmt.Errorf("transfer batch delay must be within 0 and 100 ms, got %d", v.Int())
+		}
+	case "historyconf.retention", "historyconf.maxrecords":
+		if v.Int() < 0 {
+			return fmt.Errorf("negative %s %d", name, v.Int())
+		}
+	}
+	if name == iceServersKey {
+		for _, s := range v.Interface().([]webrtc.ICEServer) {
+			err := validateICEServer(s)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateICEServer checks the URLs of an ICE server, TURN servers need
+// credentials
+func validateICEServer(s webrtc.ICEServer) error {
+	if len(s.URLs) == 0 {
+		return fmt.Errorf("ICE server without URL")
+	}
+	for _, u := range s.URLs {
+		i := strings.Index(u, ":")
+		if i < 0 || u[i+1:] == "" {
+			return fmt.Errorf("invalid ICE server URL %q", u)
+		}
+		switch strings.ToLower(u[:i]) {
+		case "stun", "stuns":
+		case "turn", "turns":
+			if s.Username == "" || s.Credential == nil {
+				return fmt.Errorf("TURN server %s needs a username and a credential", u)
+			}
+		default:
+			return fmt.Errorf("invalid ICE server URL %q, use stun:, stuns:, turn: or turns:", u)
+		}
+	}
+	return nil
+}
+
+// AddICEServer appends an ICE server, URLs which are already configured are
+// replaced by the new server
+func (cm *ConfManager) AddICEServer(server webrtc.ICEServer) error {
+	err := validateICEServer(server)
+	if err != nil {
+		return err
+	}
+	servers := removeICEURLs(cm.Conf.RTCConf.ICEServers, server.URLs...)
+	return cm.SetValue(iceServersKey, append(servers, server))
+}
+
+// RemoveICEServer removes an ICE server URL, servers left without URL are
+// removed
+func (cm *ConfManager) RemoveICEServer(url string) error {
+	servers := removeICEURLs(cm.Conf.RTCConf.ICEServers, url)
+	if countICEURLs(servers) == countICEURLs(cm.Conf.RTCConf.ICEServers) {
+		return fmt.Errorf("ICE server %s not found", url)
+	}
+	return cm.SetValue(iceServersKey, servers)
+}
+
+func countICEURLs(servers []webrtc.ICEServer) int {
+	n := 0
+	for _, s := range servers {
+		n += len(s.URLs)
+	}
+	return n
+}
+
+func removeICEURLs(servers []webrtc.ICEServer, urls ...string) []webrtc.ICEServer {
+	ret := make([]webrtc.ICEServer, 0, len(servers))
+	for _, s := range servers {
+		left := make([]string, 0, len(s.URLs))
+		for _, u := range s.URLs {
+			if !contains(urls, u) {
+				left = append(left, u)
+			}
+		}
+		if len(left) > 0 {
+			s.URLs = left
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,202 @@
+package impl
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of the frames of a split connection
+const (
+	frameData = iota
+	frameControl
+	frameDataEOF
+	frameControlEOF
+)
+
+const (
+	// frameHeader is the size of the kind and the length of a frame
+	frameHeader = 3
+	// maxFramePayload bounds the payload of a frame
+	maxFramePayload = 16 << 10
+)
+
+var errSplitDeadline = errors.New("deadlines are not supported on split streams")
+
+// SplitControl carries a control stream beside the data over conn, for the
+// impls which exchange messages as progress, approvals or receipts while
+// their data flows. Both ends of the connection of a pair split it, the
+// client over the connection of its request and the responder over the
+// one it serves in Response, so the daemons and the transports carry the
+// frames as any data. An impl which starts using it needs peers which know
+// it.
+//
+// The two streams share conn: the data stalls while the control stream
+// isn't read, read both as long as the connection lives. Closing a stream
+// ends it on the other end, conn is closed once both are.
+func SplitControl(conn net.Conn) (data, control net.Conn) {
+	sc := &splitConn{conn: conn, wbuf: make([]byte, frameHeader+maxFramePayload)}
+	sc.streams[frameData] = newSplitStream(sc, frameData)
+	sc.streams[frameControl] = newSplitStream(sc, frameControl)
+	go sc.read()
+	return sc.streams[frameData], sc.streams[frameControl]
+}
+
+// splitConn reads the frames of conn to its streams
+type splitConn struct {
+	conn    net.Conn
+	streams [2]*splitStream
+	wlock   sync.Mutex
+	wbuf    []byte
+	lock    sync.Mutex
+	closed  int
+}
+
+func (sc *splitConn) read() {
+	header := make([]byte, frameHeader)
+	payload := make([]byte, maxFramePayload)
+	for {
+		_, err := io.ReadFull(sc.conn, header)
+		if err != nil {
+			sc.fail(err)
+			return
+		}
+		kind, n := header[0], int(binary.BigEndian.Uint16(header[1:]))
+		switch kind {
+		case frameData, frameControl:
+			if n > maxFramePayload {
+				err = errors.New("frame too large")
+				break
+			}
+			_, err = io.ReadFull(sc.conn, payload[:n])
+			if err != nil {
+				break
+			}
+			_, err = sc.streams[kind].w.Write(payload[:n])
+			if err == io.ErrClosedPipe {
+				// the stream was closed here, its frames are dropped
+				err = nil
+			}
+		case frameDataEOF, frameControlEOF:
+			sc.streams[kind-frameDataEOF].w.Close()
+		default:
+			err = errors.New("invalid frame of a split connection")
+		}
+		if err != nil {
+			sc.fail(err)
+			return
+		}
+	}
+}
+
+// fail ends the streams with err, io.EOF ends them as a close would
+func (sc *splitConn) fail(err error) {
+	if err == io.EOF {
+		err = nil
+	}
+	for _, v := range sc.streams {
+		v.w.CloseWithError(err)
+	}
+}
+
+// write sends b as frames of kind
+func (sc *splitConn) write(kind byte, b []byte) (int, error) {
+	sc.wlock.Lock()
+	defer sc.wlock.Unlock()
+	written := 0
+	buf := sc.wbuf
+	for len(b) > 0 || kind >= frameDataEOF {
+		n := len(b)
+		if n > maxFramePayload {
+			n = maxFramePayload
+		}
+		buf[0] = kind
+		binary.BigEndian.PutUint16(buf[1:], uint16(n))
+		copy(buf[frameHeader:], b[:n])
+		_, err := sc.conn.Write(buf[:frameHeader+n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+		if kind >= frameDataEOF {
+			break
+		}
+	}
+	return written, nil
+}
+
+// closeStream ends the stream of kind on the other end, conn is closed
+// with the last one
+func (sc *splitConn) closeStream(kind byte) error {
+	_, err := sc.write(kind+frameDataEOF, nil)
+	sc.lock.Lock()
+	sc.closed++
+	last := sc.closed == len(sc.streams)
+	sc.lock.Unlock()
+	if last {
+		return sc.conn.Close()
+	}
+	return err
+}
+
+// splitStream is a stream of a split connection
+type splitStream struct {
+	sc   *splitConn
+	kind byte
+	r    *io.PipeReader
+	w    *io.PipeWriter
+	once sync.Once
+	// closed is set once the stream is closed here
+	closed int32
+}
+
+func newSplitStream(sc *splitConn, kind byte) *splitStream {
+	r, w := io.Pipe()
+	return &splitStream{sc: sc, kind: kind, r: r, w: w}
+}
+
+func (ss *splitStream) Read(b []byte) (int, error) {
+	return ss.r.Read(b)
+}
+
+func (ss *splitStream) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&ss.closed) == 1 {
+		return 0, net.ErrClosed
+	}
+	return ss.sc.write(ss.kind, b)
+}
+
+func (ss *splitStream) Close() error {
+	err := net.ErrClosed
+	ss.once.Do(func() {
+		atomic.StoreInt32(&ss.closed, 1)
+		ss.r.Close()
+		err = ss.sc.closeStream(ss.kind)
+	})
+	return err
+}
+
+func (ss *splitStream) LocalAddr() net.Addr {
+	return ss.sc.conn.LocalAddr()
+}
+
+func (ss *splitStream) RemoteAddr() net.Addr {
+	return ss.sc.conn.RemoteAddr()
+}
+
+func (ss *splitStream) SetDeadline(t time.Time) error {
+	return errSplitDeadline
+}
+
+func (ss *splitStream) SetReadDeadline(t time.Time) error {
+	return errSplitDeadline
+}
+
+func (ss *splitStream) SetWriteDeadline(t time.Time) error {
+	return errSplitDeadline
+}
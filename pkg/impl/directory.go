@@ -0,0 +1,219 @@
+package impl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/e2e"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// searches answer at most that many bytes
+const maxDirectoryAnswer = 4 << 20
+
+// DirectoryHit is an entry found in the directory, with how its node key
+// compares with the one pinned for the device
+type DirectoryHit struct {
+	types.DirectoryEntry
+	// Pinned is set if the key is the pinned one
+	Pinned bool
+	// Mismatch is set if another key is pinned for the device, the entry
+	// was not registered by the device this one knows
+	Mismatch bool
+}
+
+// directoryRequest sends a request to the directory of cm
+func directoryRequest(cm *conf.ConfManager, method, p string, body io.Reader) (*http.Response, error) {
+	dc := cm.Conf.DirectoryConf
+	base := dc.URL
+	if base == "" {
+		base = cm.Conf.SignalingServerAddr
+	}
+	if base == "" {
+		return nil, fmt.Errorf("no directory nor signaling server set")
+	}
+	op, err := utils.NewOutboundProxy(cm.Conf.OutboundProxyConf.URL, cm.Conf.OutboundProxyConf.NoProxy)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(base, "/")+p, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cm.Conf.SignalingToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cm.Conf.SignalingToken)
+	}
+	resp, err := op.HTTPClient(timeout).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		resp.Body.Close()
+		return nil, fmt.Errorf("the server of %s has no directory", base)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("directory: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// putDirectoryEntry signs the entry of this device and puts it in the
+// directory, removed drops it instead
+func putDirectoryEntry(cm *conf.ConfManager, removed bool) error {
+	key, err := NodeKey()
+	if err != nil {
+		return err
+	}
+	dc := cm.Conf.DirectoryConf
+	e := types.DirectoryEntry{
+		ID:           cm.Conf.ID,
+		Name:         dc.Name,
+		Owner:        dc.Owner,
+		Tags:         dc.Tags,
+		Capabilities: dc.Capabilities,
+		NodeKey:      key.Public().(ed25519.PublicKey),
+		Updated:      time.Now().Unix(),
+		Removed:      removed,
+	}
+	if e.Name == "" {
+		e.Name, _ = os.Hostname()
+	}
+	e.Signature = ed25519.Sign(key, e2e.DirectoryDigest(&e))
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := directoryRequest(cm, http.MethodPut, "/directory/"+url.PathEscape(e.ID), bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// RegisterDirectory puts the entry of this device in the directory
+func RegisterDirectory(cm *conf.ConfManager) error {
+	return putDirectoryEntry(cm, false)
+}
+
+// RemoveDirectory drops the entry of this device from the directory
+func RemoveDirectory(cm *conf.ConfManager) error {
+	return putDirectoryEntry(cm, true)
+}
+
+// SearchDirectory returns the entries of the directory q selects, at most
+// limit of them. Entries not signed by their node key are left out.
+func SearchDirectory(cm *conf.ConfManager, q types.DirectoryQuery, limit int) ([]DirectoryHit, error) {
+	v := url.Values{}
+	if q.Text != "" {
+		v.Set("q", q.Text)
+	}
+	if q.Owner != "" {
+		v.Set("owner", q.Owner)
+	}
+	v["tag"] = q.Tags
+	v["cap"] = q.Capabilities
+	if limit > 0 {
+		v.Set("limit", strconv.Itoa(limit))
+	}
+	resp, err := directoryRequest(cm, http.MethodGet, "/directory?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var entries []types.DirectoryEntry
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxDirectoryAnswer)).Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("directory: %v", err)
+	}
+	nodeKeysLock.Lock()
+	pinned, err := loadNodePeers()
+	nodeKeysLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]DirectoryHit, 0, len(entries))
+	for _, e := range entries {
+		if len(e.NodeKey) != ed25519.PublicKeySize || !ed25519.Verify(e.NodeKey, e2e.DirectoryDigest(&e), e.Signature) {
+			logrus.Debug("directory entry of ", e.ID, " is not signed by its key")
+			continue
+		}
+		hit := DirectoryHit{DirectoryEntry: e}
+		if k, ok := pinned[e.ID]; ok {
+			hit.Pinned = k == base64.StdEncoding.EncodeToString(e.NodeKey)
+			hit.Mismatch = !hit.Pinned
+		}
+		ret = append(ret, hit)
+	}
+	return ret, nil
+}
+
+// DirectoryAgent keeps the entry of this device in the directory, it is
+// refreshed every DirectoryConf.Interval
+type DirectoryAgent struct {
+	cm   *conf.ConfManager
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewDirectoryAgent(cm *conf.ConfManager) *DirectoryAgent {
+	return &DirectoryAgent{
+		cm:   cm,
+		stop: make(chan struct{}),
+	}
+}
+
+// Run registers this device until Close is called, it returns right away
+// if the directory is disabled
+func (da *DirectoryAgent) Run() {
+	dc := da.cm.Conf.DirectoryConf
+	if !dc.Enabled {
+		return
+	}
+	interval := time.Duration(dc.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	// the first registration waits for the daemon to settle, a failed one
+	// is retried sooner
+	timer := time.NewTimer(10 * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case <-da.stop:
+			return
+		case <-timer.C:
+			err := RegisterDirectory(da.cm)
+			if err != nil {
+				logrus.Warn("directory ", err)
+				timer.Reset(time.Minute)
+				continue
+			}
+			logrus.Debug("registered with the directory")
+			timer.Reset(interval)
+		}
+	}
+}
+
+func (da *DirectoryAgent) Close() {
+	da.once.Do(func() {
+		close(da.stop)
+	})
+}
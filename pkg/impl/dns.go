@@ -0,0 +1,63 @@
+package impl
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/dnsdisc"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+// ResolveHost returns the device ID of host: the one of its address book
+// entry, the one it publishes in DNS, or host itself. Devices found in DNS
+// are added to the address book under host, with the fingerprint their
+// node key must have. If no signaling server is set, the one of the domain
+// of host is set and an error asks to restart the daemon.
+func ResolveHost(cm *conf.ConfManager, host string) (string, error) {
+	id := cm.ResolvePeer(host)
+	if id != host || !cm.Conf.DNSConf.Enabled || !dnsdisc.IsDomain(host) {
+		return id, nil
+	}
+	r := &dnsdisc.Resolver{Server: cm.Conf.DNSConf.Server}
+	p, err := r.LookupPeer(host)
+	if err == dnsdisc.ErrNotFound {
+		return host, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("DNS lookup of %s: %v", host, err)
+	}
+	if ep := cm.FindPeer(p.ID); ep != nil {
+		if ep.Name == "" {
+			ep.Name = host
+		}
+		ep.Fingerprint = p.Fingerprint
+	} else {
+		cm.Conf.AddressBook = append(cm.Conf.AddressBook, conf.Peer{ID: p.ID, Name: host, Fingerprint: p.Fingerprint})
+	}
+	err = cm.SaveAddressBook()
+	if err != nil {
+		return "", err
+	}
+	logrus.Info("added ", host, " (", p.ID, ") from DNS to the address book")
+
+	s, err := r.LookupSignaling(host)
+	if err == dnsdisc.ErrNotFound {
+		return p.ID, nil
+	}
+	if err != nil {
+		logrus.Warn("DNS lookup of the signaling server of ", host, ": ", err)
+		return p.ID, nil
+	}
+	switch cm.Conf.SignalingServerAddr {
+	case s.Addr:
+	case "":
+		err = cm.SetValue("signalingserveraddr", s.Addr)
+		if err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("signaling server set to %s, the one of %s, restart the daemon to apply it", s.Addr, s.Domain)
+	default:
+		logrus.Warn(s.Domain, " uses the signaling server ", s.Addr, ", not ", cm.Conf.SignalingServerAddr)
+	}
+	return p.ID, nil
+}
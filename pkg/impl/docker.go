@@ -0,0 +1,242 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// dockerSocket is the default address of the Docker engine
+const dockerSocket = "unix:///var/run/docker.sock"
+
+// dockerClient talks to the API of a Docker engine
+type dockerClient struct {
+	network string
+	addr    string
+}
+
+// newDockerClient connects to the engine at host, DOCKER_HOST and then the
+// default socket if it is empty. TLS endpoints are not supported.
+func newDockerClient(host string) (*dockerClient, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = dockerSocket
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "unix":
+		return &dockerClient{network: "unix", addr: u.Path}, nil
+	case "tcp":
+		return &dockerClient{network: "tcp", addr: u.Host}, nil
+	default:
+		return nil, fmt.Errorf("unsupported docker host %s", host)
+	}
+}
+
+func (dc *dockerClient) dial() (net.Conn, error) {
+	return net.DialTimeout(dc.network, dc.addr, timeout)
+}
+
+// request makes a request of the API, body is encoded in JSON
+func (dc *dockerClient) request(method, path string, body interface{}) (*http.Request, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, "http://docker"+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// dockerError returns the error of a response of the API
+func dockerError(res *http.Response) error {
+	var msg struct {
+		Message string
+	}
+	if json.NewDecoder(res.Body).Decode(&msg) == nil && msg.Message != "" {
+		return fmt.Errorf("%s", msg.Message)
+	}
+	return fmt.Errorf("docker: %s", res.Status)
+}
+
+// do calls the API and decodes the result into v if it is not nil
+func (dc *dockerClient) do(method, path string, body, v interface{}) error {
+	req, err := dc.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	client := http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dc.dial()
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return dockerError(res)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// hijack calls an attach endpoint of the API and returns the connection
+// once the engine streams over it
+func (dc *dockerClient) hijack(path string, body interface{}) (net.Conn, error) {
+	req, err := dc.request("POST", path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	conn, err := dc.dial()
+	if err != nil {
+		return nil, err
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols && res.StatusCode != http.StatusOK {
+		defer conn.Close()
+		return nil, dockerError(res)
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// Containers lists the containers of the engine, the stopped ones too if
+// all is set
+func (dc *dockerClient) Containers(all bool) ([]types.DockerContainer, error) {
+	var list []struct {
+		Id      string
+		Names   []string
+		Image   string
+		State   string
+		Status  string
+		Created int64
+	}
+	err := dc.do("GET", fmt.Sprintf("/containers/json?all=%t", all), nil, &list)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]types.DockerContainer, 0, len(list))
+	for _, v := range list {
+		c := types.DockerContainer{
+			ID:      v.Id,
+			Image:   v.Image,
+			State:   v.State,
+			Status:  v.Status,
+			Created: time.Unix(v.Created, 0),
+		}
+		if len(v.Names) > 0 {
+			c.Name = strings.TrimPrefix(v.Names[0], "/")
+		}
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
+
+// dockerInspect is the part of the state of a container the client uses
+type dockerInspect struct {
+	Id     string
+	Name   string
+	Config struct {
+		Tty bool
+	}
+	State struct {
+		Running  bool
+		ExitCode int
+	}
+}
+
+// Inspect returns the state of a container given by name or ID
+func (dc *dockerClient) Inspect(container string) (dockerInspect, error) {
+	var ret dockerInspect
+	err := dc.do("GET", "/containers/"+url.PathEscape(container)+"/json", nil, &ret)
+	ret.Name = strings.TrimPrefix(ret.Name, "/")
+	return ret, err
+}
+
+// Exec runs command in a running container, it returns the ID of the exec
+// and the connection of its stdin, stdout and stderr
+func (dc *dockerClient) Exec(container string, command []string, user string, tty bool) (string, net.Conn, error) {
+	var created struct {
+		Id string
+	}
+	err := dc.do("POST", "/containers/"+url.PathEscape(container)+"/exec", map[string]interface{}{
+		"AttachStdin":  true,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          tty,
+		"User":         user,
+		"Cmd":          command,
+	}, &created)
+	if err != nil {
+		return "", nil, err
+	}
+	conn, err := dc.hijack("/exec/"+created.Id+"/start", map[string]interface{}{
+		"Detach": false,
+		"Tty":    tty,
+	})
+	return created.Id, conn, err
+}
+
+// ExecExitCode returns the exit code of a finished exec
+func (dc *dockerClient) ExecExitCode(id string) (int, error) {
+	var state struct {
+		ExitCode int
+	}
+	err := dc.do("GET", "/exec/"+id+"/json", nil, &state)
+	return state.ExitCode, err
+}
+
+// Attach attaches to the stdin, stdout and stderr of the main process of
+// a container
+func (dc *dockerClient) Attach(container string) (net.Conn, error) {
+	return dc.hijack("/containers/"+url.PathEscape(container)+"/attach?stream=1&stdin=1&stdout=1&stderr=1", nil)
+}
+
+// Resize sets the terminal size of an exec or a container, path is
+// /exec/ID or /containers/ID
+func (dc *dockerClient) Resize(path string, size execSize) error {
+	return dc.do("POST", fmt.Sprintf("%s/resize?h=%d&w=%d", path, size.Height, size.Width), nil, nil)
+}
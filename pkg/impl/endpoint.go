@@ -0,0 +1,96 @@
+package impl
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/suutaku/sshx/internal/utils"
+)
+
+// endpointHeader starts the line the daemon sends first on the connections
+// to endpoints, with the ID of the remote peer
+const endpointHeader = "SSHX-PEER "
+
+// maxEndpointHeader bounds the line of endpointHeader
+const maxEndpointHeader = 512
+
+var endpointName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// endpointsDir holds a file per endpoint with the local address of its
+// listener, so the daemon finds the endpoints of every process
+func endpointsDir() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "endpoints")
+}
+
+// RegisterEndpoint makes the connections of peers to the endpoint name go
+// to the local address addr. A name held by a listener which still accepts
+// connections is refused.
+func RegisterEndpoint(name, addr string) error {
+	if !endpointName.MatchString(name) {
+		return fmt.Errorf("invalid endpoint name %q, letters, digits, '.', '_' and '-'", name)
+	}
+	if old, err := endpointAddr(name); err == nil {
+		conn, err := net.DialTimeout("tcp", old, timeout)
+		if err == nil {
+			conn.Close()
+			return fmt.Errorf("endpoint %s is in use", name)
+		}
+	}
+	err := os.MkdirAll(endpointsDir(), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(endpointsDir(), name), []byte(addr), 0600)
+}
+
+// UnregisterEndpoint removes the endpoint name
+func UnregisterEndpoint(name string) error {
+	if !endpointName.MatchString(name) {
+		return fmt.Errorf("invalid endpoint name %q", name)
+	}
+	return os.Remove(filepath.Join(endpointsDir(), name))
+}
+
+// endpointAddr returns the local address of the endpoint name
+func endpointAddr(name string) (string, error) {
+	if !endpointName.MatchString(name) {
+		return "", fmt.Errorf("invalid endpoint name %q", name)
+	}
+	bs, err := ioutil.ReadFile(filepath.Join(endpointsDir(), name))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("no endpoint %s", name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bs)), nil
+}
+
+// ReadEndpointPeer reads the line the daemon starts the connections to
+// endpoints with and returns the ID of the remote peer
+func ReadEndpointPeer(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxEndpointHeader {
+		// byte by byte, what follows the line belongs to the caller
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			s := string(line)
+			if !strings.HasPrefix(s, endpointHeader) {
+				return "", fmt.Errorf("not a connection of the daemon")
+			}
+			return strings.TrimPrefix(s, endpointHeader), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("not a connection of the daemon")
+}
@@ -0,0 +1,106 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// Classes of the failures of requests, test them with errors.Is
+var (
+	ErrPeerOffline       = errors.New("peer offline")
+	ErrDenied            = errors.New("denied")
+	ErrDaemonUnreachable = errors.New("daemon unreachable")
+	ErrTimeout           = errors.New("timeout")
+	ErrUnsupportedApp    = errors.New("unsupported application")
+)
+
+// Error is a failed request, Kind is its class, one of the Err values
+// above, and Err its cause if known
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// newError returns err in the class kind
+func newError(kind, err error) error {
+	return &Error{Kind: kind, Err: err}
+}
+
+// Denied returns err in the class ErrDenied
+func Denied(err error) error {
+	return newError(ErrDenied, err)
+}
+
+// statuses maps the classes of failures to the status codes of the
+// responses of the daemon
+var statuses = []struct {
+	kind   error
+	status int32
+}{
+	{ErrPeerOffline, types.STATUS_PEER_OFFLINE},
+	{ErrDenied, types.STATUS_DENIED},
+	{ErrTimeout, types.STATUS_TIMEOUT},
+	{ErrUnsupportedApp, types.STATUS_UNSUPPORTED_APP},
+}
+
+// ErrorStatus returns the status code answering a request which failed
+// with err
+func ErrorStatus(err error) int32 {
+	if err == nil {
+		return types.STATUS_OK
+	}
+	for _, v := range statuses {
+		if errors.Is(err, v.kind) {
+			return v.status
+		}
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return types.STATUS_TIMEOUT
+	}
+	return types.STATUS_FAILED
+}
+
+// remoteError returns the error msg a remote node answered with, in the
+// class of its status code
+func remoteError(status int32, msg string) error {
+	err := errors.New(msg)
+	for _, v := range statuses {
+		if status == v.status {
+			return newError(v.kind, err)
+		}
+	}
+	return err
+}
+
+// StatusError returns the error of the status code of a response, nil if it
+// succeeded
+func StatusError(status int32) error {
+	if status == types.STATUS_OK {
+		return nil
+	}
+	for _, v := range statuses {
+		if status == v.status {
+			return v.kind
+		}
+	}
+	return errors.New("response error")
+}
@@ -0,0 +1,83 @@
+package impl
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/suutaku/sshx/pkg/types"
+	"golang.org/x/term"
+)
+
+// channels of exec sessions, every message between the dialer and the
+// responder starts with its channel. They are the channels of the
+// Kubernetes protocol, so kubernetes messages pass unchanged.
+const (
+	execStdin = iota
+	execStdout
+	execStderr
+	// execStatus ends the session with the exit code of the command
+	execStatus
+	// execResize carries the size of the terminal in JSON
+	execResize
+)
+
+// execSize is the message of execResize
+type execSize struct {
+	Width  int
+	Height int
+}
+
+// execTerminal runs the dialer side of an exec session over conn with the
+// terminal as stdin, stdout and stderr. An empty stdin message tells the
+// end of stdin. exitCode reads the exit code of the status message.
+func execTerminal(conn net.Conn, tty bool, exitCode func([]byte) (int, error)) (int, error) {
+	enc := gob.NewEncoder(conn)
+	dec := types.NewLimitedDecoder(conn, MaxStreamMessageSize)
+	fd := int(os.Stdin.Fd())
+	if tty && term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return 0, err
+		}
+		defer term.Restore(fd, state)
+		w, h, err := term.GetSize(fd)
+		if err == nil {
+			size, _ := json.Marshal(execSize{w, h})
+			enc.Encode(append([]byte{execResize}, size...))
+		}
+	}
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 && enc.Encode(append([]byte{execStdin}, buf[:n]...)) != nil {
+				return
+			}
+			if err != nil {
+				enc.Encode([]byte{execStdin})
+				return
+			}
+		}
+	}()
+	for {
+		var msg []byte
+		err := dec.Decode(&msg)
+		if err != nil {
+			return 0, fmt.Errorf("exec session closed: %v", err)
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		switch msg[0] {
+		case execStdout:
+			os.Stdout.Write(msg[1:])
+		case execStderr:
+			os.Stderr.Write(msg[1:])
+		case execStatus:
+			return exitCode(msg[1:])
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/martinlindhe/notify"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+// FIDO2 keys are driven by the fido2-cred, fido2-assert and fido2-token
+// tools of libfido2, assertions are verified here
+
+// one assertion at a time, the key is touched for the one asked
+var fidoLock sync.Mutex
+
+// fidoDevice returns the configured device, or the first one plugged
+func fidoDevice(fc conf.FIDOConf) (string, error) {
+	if fc.Device != "" {
+		return fc.Device, nil
+	}
+	out, err := exec.Command("fido2-token", "-L").Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot list FIDO2 keys, is libfido2 installed? %v", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if i := strings.Index(line, ": "); i > 0 {
+			return line[:i], nil
+		}
+	}
+	return "", fmt.Errorf("no FIDO2 key plugged")
+}
+
+func fidoRun(timeout time.Duration, input string, name string, args ...string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = strings.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("the FIDO2 key was not touched in time")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.Split(strings.TrimSpace(string(out)), "\n"), nil
+}
+
+func fidoTimeout(fc conf.FIDOConf) time.Duration {
+	if fc.Timeout <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(fc.Timeout) * time.Second
+}
+
+func fidoRPID(fc conf.FIDOConf) string {
+	if fc.RPID == "" {
+		return "sshx"
+	}
+	return fc.RPID
+}
+
+// EnrollFIDO creates a credential on the FIDO2 key device, the first one
+// plugged if it is empty, and saves it in FIDOConf
+func EnrollFIDO(device string) error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	fc := cm.Conf.FIDOConf
+	if device != "" {
+		fc.Device = device
+	}
+	dev, err := fidoDevice(fc)
+	if err != nil {
+		return err
+	}
+	cdh := make([]byte, 32)
+	user := make([]byte, 32)
+	rand.Read(cdh)
+	rand.Read(user)
+	input := strings.Join([]string{
+		base64.StdEncoding.EncodeToString(cdh),
+		fidoRPID(fc),
+		cm.Conf.ID,
+		base64.StdEncoding.EncodeToString(user),
+	}, "\n") + "\n"
+	cred, err := fidoRun(fidoTimeout(fc), input, "fido2-cred", "-M", dev, "es256")
+	if err != nil {
+		return err
+	}
+	// the verification prints the credential ID and the public key
+	out, err := fidoRun(fidoTimeout(fc), strings.Join(cred, "\n")+"\n", "fido2-cred", "-V", "es256")
+	if err != nil {
+		return err
+	}
+	if len(out) < 2 {
+		return fmt.Errorf("unexpected output of fido2-cred")
+	}
+	pub := strings.Join(out[1:], "\n") + "\n"
+	_, err = parseFIDOKey(pub)
+	if err != nil {
+		return err
+	}
+	fc.Credential = out[0]
+	fc.PublicKey = pub
+	return cm.SetValue("fidoconf", fc)
+}
+
+func parseFIDOKey(text string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(text))
+	if block == nil {
+		return nil, fmt.Errorf("invalid FIDO2 public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the FIDO2 public key is not an es256 key")
+	}
+	return pub, nil
+}
+
+// cborBytes decodes the CBOR byte string fido2-assert prints the
+// authenticator data as
+func cborBytes(bs []byte) ([]byte, error) {
+	if len(bs) == 0 || bs[0]>>5 != 2 {
+		return nil, fmt.Errorf("invalid authenticator data")
+	}
+	n, head := uint64(bs[0]&0x1f), 1
+	switch {
+	case n < 24:
+	case n == 24 && len(bs) >= 2:
+		n, head = uint64(bs[1]), 2
+	case n == 25 && len(bs) >= 3:
+		n, head = uint64(binary.BigEndian.Uint16(bs[1:])), 3
+	default:
+		return nil, fmt.Errorf("invalid authenticator data")
+	}
+	if uint64(len(bs)-head) != n {
+		return nil, fmt.Errorf("invalid authenticator data")
+	}
+	return bs[head:], nil
+}
+
+// verifyAssertion checks the authenticator data was signed by the enrolled
+// credential for the relying party, with the user present
+func verifyAssertion(pub *ecdsa.PublicKey, rpId string, cdh, authData, sig []byte) error {
+	if len(authData) < 37 {
+		return fmt.Errorf("invalid authenticator data")
+	}
+	rpHash := sha256.Sum256([]byte(rpId))
+	if !bytes.Equal(authData[:32], rpHash[:]) {
+		return fmt.Errorf("assertion for another relying party")
+	}
+	if authData[32]&0x01 == 0 {
+		return fmt.Errorf("the FIDO2 key was not touched")
+	}
+	digest := sha256.Sum256(append(append([]byte{}, authData...), cdh...))
+	if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		return fmt.Errorf("invalid FIDO2 assertion")
+	}
+	return nil
+}
+
+// NeedsPresence reports whether connections to peerId need a touch of the
+// FIDO2 key
+func NeedsPresence(peerId string) bool {
+	cm, err := conf.Shared()
+	if err != nil {
+		return false
+	}
+	name := ""
+	if p := cm.FindPeer(peerId); p != nil {
+		name = p.Name
+	}
+	for _, v := range cm.Conf.FIDOConf.Peers {
+		if v == peerId || (name != "" && v == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfirmPresence asks for a touch of the enrolled FIDO2 key and verifies
+// the assertion it signs, the challenge binds it to peerId and app
+func ConfirmPresence(peerId, app string) error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	fc := cm.Conf.FIDOConf
+	if fc.Credential == "" {
+		return fmt.Errorf("connections to %s need a FIDO2 key, run 'sshx fido enroll'", peerId)
+	}
+	pub, err := parseFIDOKey(fc.PublicKey)
+	if err != nil {
+		return err
+	}
+	dev, err := fidoDevice(fc)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+	challenge := sha256.Sum256(append(nonce, []byte(peerId+"\x00"+app)...))
+	input := strings.Join([]string{
+		base64.StdEncoding.EncodeToString(challenge[:]),
+		fidoRPID(fc),
+		fc.Credential,
+	}, "\n") + "\n"
+
+	fidoLock.Lock()
+	defer fidoLock.Unlock()
+	logrus.Info("touch the FIDO2 key to connect to ", peerId)
+	notify.Notify("sshx", "fido", fmt.Sprintf("touch your security key to open %s to %s", app, peerId), "")
+	out, err := fidoRun(fidoTimeout(fc), input, "fido2-assert", "-G", "-p", dev)
+	if err != nil {
+		return err
+	}
+	if len(out) < 4 {
+		return fmt.Errorf("unexpected output of fido2-assert")
+	}
+	cbor, err := base64.StdEncoding.DecodeString(out[2])
+	if err != nil {
+		return fmt.Errorf("invalid authenticator data")
+	}
+	authData, err := cborBytes(cbor)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(out[3])
+	if err != nil {
+		return fmt.Errorf("invalid FIDO2 signature")
+	}
+	return verifyAssertion(pub, fidoRPID(fc), challenge[:], authData, sig)
+}
@@ -0,0 +1,408 @@
+package impl
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/e2e"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+	"golang.org/x/crypto/curve25519"
+)
+
+// NodeCertificate binds the ID of a device to its node key
+type NodeCertificate struct {
+	ID        string
+	PublicKey []byte
+	// Expires is the end of validity, never if zero
+	Expires time.Time
+}
+
+// SignedCertificate is a node certificate signed by the CA
+type SignedCertificate struct {
+	// Payload is the JSON of the NodeCertificate
+	Payload []byte
+
+	// Signature is the ed25519 signature of Payload by the CA
+	Signature []byte
+}
+
+// pinned node keys are read and written by the daemon and the commands
+var nodeKeysLock sync.Mutex
+
+func nodeKeyFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "node.key")
+}
+
+func nodeCertFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "node.cert")
+}
+
+func nodePeersFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "node_peers.json")
+}
+
+func caKeyFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "ca.key")
+}
+
+func derpKeyFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "derp.key")
+}
+
+func writeKeyFile(file string, key []byte) error {
+	return writeStoreFile(file, []byte(base64.StdEncoding.EncodeToString(key)+"\n"))
+}
+
+func readKeyFile(file string) (ed25519.PrivateKey, error) {
+	bs, err := readStoreFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(bs)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid key %s", file)
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// NodeKey returns the ed25519 key signing the signaling messages of this
+// device, it is created on first use
+func NodeKey() (ed25519.PrivateKey, error) {
+	key, err := readKeyFile(nodeKeyFile())
+	if !os.IsNotExist(err) {
+		return key, err
+	}
+	_, key, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Info("created node key ", nodeKeyFile())
+	return key, writeKeyFile(nodeKeyFile(), key)
+}
+
+// NodePublicKey returns the public node key of this device
+func NodePublicKey() ([]byte, error) {
+	key, err := NodeKey()
+	if err != nil {
+		return nil, err
+	}
+	return key.Public().(ed25519.PublicKey), nil
+}
+
+// DERPKey returns the X25519 key of this device on DERP relays, where
+// peers send packets to its public key. It is created on first use.
+func DERPKey() (priv, pub []byte, err error) {
+	priv, err = readStoreFile(derpKeyFile())
+	if os.IsNotExist(err) {
+		priv, err = createX25519Key(derpKeyFile(), "DERP key")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(priv) != curve25519.ScalarSize {
+		return nil, nil, fmt.Errorf("invalid DERP key %s", derpKeyFile())
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	return priv, pub, err
+}
+
+// GenerateCAKey creates the key of a CA certifying the devices of an
+// organization and returns its public key, to be set as
+// IdentityConf.CAPublicKey on the devices
+func GenerateCAKey() (string, error) {
+	if _, err := os.Stat(caKeyFile()); err == nil {
+		return "", fmt.Errorf("CA key %s already exists", caKeyFile())
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	err = writeKeyFile(caKeyFile(), priv)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// SignNodeCertificate certifies the node key of the device id with the CA
+// key of this device, for ttl or forever if it is zero
+func SignNodeCertificate(id, publicKey string, ttl time.Duration) ([]byte, error) {
+	key, err := readKeyFile(caKeyFile())
+	if err != nil {
+		return nil, err
+	}
+	pub, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid node key %s", publicKey)
+	}
+	nc := NodeCertificate{ID: id, PublicKey: pub}
+	if ttl > 0 {
+		nc.Expires = time.Now().Add(ttl).UTC()
+	}
+	payload, err := json.Marshal(nc)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(SignedCertificate{
+		Payload:   payload,
+		Signature: ed25519.Sign(key, payload),
+	}, "", "  ")
+}
+
+// VerifyNodeCertificate returns the certificate of data if the CA key
+// caPublicKey signed it and it is valid now
+func VerifyNodeCertificate(caPublicKey string, data []byte) (*NodeCertificate, error) {
+	pub, err := base64.StdEncoding.DecodeString(caPublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid CA public key")
+	}
+	var sc SignedCertificate
+	err = json.Unmarshal(data, &sc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node certificate: %v", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), sc.Payload, sc.Signature) {
+		return nil, fmt.Errorf("node certificate not signed by the CA")
+	}
+	var nc NodeCertificate
+	err = json.Unmarshal(sc.Payload, &nc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node certificate: %v", err)
+	}
+	if !nc.Expires.IsZero() && time.Now().After(nc.Expires) {
+		return nil, fmt.Errorf("node certificate of %s expired on %s", nc.ID, nc.Expires.Format(time.RFC3339))
+	}
+	return &nc, nil
+}
+
+// NodeCertificateFile returns the certificate installed on this device,
+// nil if there is none
+func NodeCertificateFile() ([]byte, error) {
+	bs, err := ioutil.ReadFile(nodeCertFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return bs, err
+}
+
+// InstallNodeCertificate installs the certificate of this device, it must
+// certify the ID and node key of this device
+func InstallNodeCertificate(data []byte) (*NodeCertificate, error) {
+	cm, err := conf.Shared()
+	if err != nil {
+		return nil, err
+	}
+	if cm.Conf.IdentityConf.CAPublicKey == "" {
+		return nil, fmt.Errorf("IdentityConf.CAPublicKey is not set")
+	}
+	nc, err := VerifyNodeCertificate(cm.Conf.IdentityConf.CAPublicKey, data)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := NodePublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if nc.ID != cm.Conf.ID || !ed25519.PublicKey(pub).Equal(ed25519.PublicKey(nc.PublicKey)) {
+		return nil, fmt.Errorf("the certificate is issued to another device")
+	}
+	return nc, ioutil.WriteFile(nodeCertFile(), data, 0600)
+}
+
+// SignSignaling signs a signaling message with the node key, and adds the
+// certificate of this device if it has one
+func SignSignaling(info *types.SignalingInfo) error {
+	key, err := NodeKey()
+	if err != nil {
+		return err
+	}
+	info.NodeKey = key.Public().(ed25519.PublicKey)
+	info.Cert, err = NodeCertificateFile()
+	if err != nil {
+		return err
+	}
+	info.Rotations, err = rotationsData()
+	if err != nil {
+		return err
+	}
+	info.Signature = ed25519.Sign(key, e2e.SignalingDigest(info))
+	return nil
+}
+
+func loadNodePeers() (map[string]string, error) {
+	ret := make(map[string]string)
+	bs, err := readStoreFile(nodePeersFile())
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, json.Unmarshal(bs, &ret)
+}
+
+func saveNodePeers(keys map[string]string) error {
+	bs, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStoreFile(nodePeersFile(), bs)
+}
+
+// PinNodeKey pins the node key of peerId, replacing the one it had
+func PinNodeKey(peerId string, pub []byte) error {
+	if len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid node key of %s", peerId)
+	}
+	nodeKeysLock.Lock()
+	defer nodeKeysLock.Unlock()
+	keys, err := loadNodePeers()
+	if err != nil {
+		return err
+	}
+	keys[peerId] = base64.StdEncoding.EncodeToString(pub)
+	return saveNodePeers(keys)
+}
+
+// ForgetNodeKey unpins the node key of peerId
+func ForgetNodeKey(peerId string) error {
+	nodeKeysLock.Lock()
+	defer nodeKeysLock.Unlock()
+	keys, err := loadNodePeers()
+	if err != nil {
+		return err
+	}
+	if _, ok := keys[peerId]; !ok {
+		return fmt.Errorf("no node key pinned for %s", peerId)
+	}
+	delete(keys, peerId)
+	return saveNodePeers(keys)
+}
+
+// VerifySignaling checks a signaling message was signed by the node key of
+// its source. A key certified for the source by the CA is trusted, others
+// must be the pinned one. Keys of paired peers are pinned the first time
+// they are seen, and of any peer with AllowUnpairedPeers. With pin unset
+// only the signature and the certificate are checked, as pairing pins the
+// key itself.
+func VerifySignaling(info *types.SignalingInfo, pin bool) error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	ic := cm.Conf.IdentityConf
+	if IsRevoked(cm, info.Source) {
+		return fmt.Errorf("%s is revoked", info.Source)
+	}
+	if len(info.Signature) == 0 {
+		if ic.AllowUnsignedPeers && !ic.RequireCert {
+			return nil
+		}
+		return fmt.Errorf("signaling message of %s is not signed", info.Source)
+	}
+	if len(info.NodeKey) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(info.NodeKey), e2e.SignalingDigest(info), info.Signature) {
+		return fmt.Errorf("invalid signature of the signaling message of %s", info.Source)
+	}
+	if len(info.Cert) > 0 && ic.CAPublicKey != "" {
+		nc, err := VerifyNodeCertificate(ic.CAPublicKey, info.Cert)
+		if err != nil {
+			return fmt.Errorf("certificate of %s: %v", info.Source, err)
+		}
+		if nc.ID != info.Source || !ed25519.PublicKey(info.NodeKey).Equal(ed25519.PublicKey(nc.PublicKey)) {
+			return fmt.Errorf("certificate of %s is issued to another device", info.Source)
+		}
+		return nil
+	}
+	if ic.RequireCert {
+		return fmt.Errorf("%s has no certificate of the CA", info.Source)
+	}
+	if !pin {
+		return nil
+	}
+	nodeKeysLock.Lock()
+	defer nodeKeysLock.Unlock()
+	keys, err := loadNodePeers()
+	if err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(info.NodeKey)
+	if pinned, ok := keys[info.Source]; ok {
+		if pinned == key {
+			return nil
+		}
+		old, _ := base64.StdEncoding.DecodeString(pinned)
+		if len(info.Rotations) == 0 {
+			return fmt.Errorf("node key of %s changed to %s, run 'sshx identity forget %s' if the device was reinstalled", info.Source, keyFingerprint(info.NodeKey), info.Source)
+		}
+		identity, err := followRotations(info.Source, old, info.NodeKey, info.Rotations)
+		if err != nil {
+			return err
+		}
+		err = updateIdentityPin(info.Source, identity)
+		if err != nil {
+			return err
+		}
+		keys[info.Source] = key
+		logrus.Info("keys of ", info.Source, " rotated to ", keyFingerprint(info.NodeKey))
+		return saveNodePeers(keys)
+	}
+	if p := cm.FindPeer(info.Source); p != nil && p.Fingerprint != "" && !strings.EqualFold(p.Fingerprint, keyFingerprint(info.NodeKey)) {
+		return fmt.Errorf("node key of %s is %s, not %s as in its address book entry", info.Source, keyFingerprint(info.NodeKey), p.Fingerprint)
+	}
+	if !cm.Conf.AllowUnpairedPeers && !IsPaired(info.Source) {
+		return fmt.Errorf("%s is not paired, pair with 'sshx pair'", info.Source)
+	}
+	keys[info.Source] = key
+	logrus.Info("pinned node key of ", info.Source, " ", keyFingerprint(info.NodeKey))
+	return saveNodePeers(keys)
+}
+
+// ShowIdentity prints the node key and certificate of this device
+func ShowIdentity() error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	pub, err := NodePublicKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println("id:", cm.Conf.ID)
+	fmt.Println("node key:", base64.StdEncoding.EncodeToString(pub))
+	fmt.Println("fingerprint:", keyFingerprint(pub))
+	data, err := NodeCertificateFile()
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		fmt.Println("certificate: none")
+		return nil
+	}
+	if cm.Conf.IdentityConf.CAPublicKey == "" {
+		fmt.Println("certificate: installed, IdentityConf.CAPublicKey is not set")
+		return nil
+	}
+	nc, err := VerifyNodeCertificate(cm.Conf.IdentityConf.CAPublicKey, data)
+	if err != nil {
+		fmt.Println("certificate:", err)
+		return nil
+	}
+	if nc.Expires.IsZero() {
+		fmt.Println("certificate: valid")
+	} else {
+		fmt.Println("certificate: valid until", nc.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
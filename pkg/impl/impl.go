@@ -1,6 +1,7 @@
 package impl
 
 import (
+	"context"
 	"io"
 	"net"
 	"reflect"
@@ -22,14 +23,14 @@ type Impl interface {
 	Writer() io.Writer
 	// Reader of dialer
 	Reader() io.Reader
-	// Response of remote device call
-	Response() error
-	// Call remote device
-	Dial() error
-	// Preper
-	Preper() error
-	// Close Impl connection
-	Close()
+	// Response of remote device call, ctx is done once the session ends
+	Response(ctx context.Context) error
+	// Call remote device, ctx is done once the session ends
+	Dial(ctx context.Context) error
+	// Preper prepares the dialer before its request is sent to the daemon
+	Preper(ctx context.Context) error
+	// Close Impl connection, it may be called more than once
+	Close() error
 	SetHostId(id string)
 	// Get Host Id
 	HostId() string
@@ -37,9 +38,24 @@ type Impl interface {
 	SetPairId(string)
 	ParentId() string
 	SetParentId(string)
-	Attach(net.Conn) error
+	// Attach passes conn to the running session, ctx is the one of the
+	// session
+	Attach(ctx context.Context, conn net.Conn) error
 	NoNeedConnect()
 	IsNeedConnect() bool
+	// One-time code of the session, for remote devices which ask for one
+	OneTimeCode() string
+	SetOneTimeCode(string)
+	// Restrict applies the constraints of the access rule allowing an
+	// inbound session
+	Restrict(readOnly, viewOnly bool)
+}
+
+// Persistent is implemented by the impls whose sessions outlive their
+// connections on the responder, OPTION_TYPE_ATTACH reaches such a session
+// over a new connection instead of a pair of this node
+type Persistent interface {
+	Persistent() bool
 }
 
 var registeddApp = []Impl{
@@ -53,6 +69,29 @@ var registeddApp = []Impl{
 	&Messager{},
 	&Transfer{},
 	&TransferService{},
+	&Sync{},
+	&Clipboard{},
+	&RDP{},
+	&Audio{},
+	&Fleet{},
+	&Pair{},
+	&Knock{},
+	&Access{},
+	&Identity{},
+	&Bench{},
+	&History{},
+	&Discover{},
+	&Kube{},
+	&Docker{},
+	&Serial{},
+	&WOL{},
+	&Print{},
+	&Forward{},
+	&Shell{},
+	&Exec{},
+	&Screenshot{},
+	&Notify{},
+	&Mesh{},
 }
 
 func GetImpl(code int32) Impl {
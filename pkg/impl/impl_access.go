@@ -0,0 +1,119 @@
+package impl
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	ACCESS_OP_LIST = iota
+	ACCESS_OP_ADD
+	ACCESS_OP_REMOVE
+	ACCESS_OP_CHECK
+)
+
+// Access lists, adds, removes or checks the access rules of the daemon.
+// It is not a connection, peers refuse it.
+type Access struct {
+	BaseImpl
+	Op int
+	// Rule to add before Index
+	Rule conf.AccessRule
+	// Index of the rule to add before or to remove
+	Index int
+	// Peer and App of the session to check
+	Peer string
+	App  string
+}
+
+// AccessResult is the answer of the daemon to an access request
+type AccessResult struct {
+	Enabled bool
+	Default string
+	Rules   []conf.AccessRule
+	// Rule is the rule deciding a checked session
+	Rule conf.AccessRule
+	// Error is set if the request failed, or the checked session is denied
+	Error string
+}
+
+func NewAccess(hostId string) *Access {
+	ret := &Access{
+		BaseImpl: *NewBaseImpl(hostId),
+	}
+	ret.NoNeedConnect()
+	return ret
+}
+
+func (a *Access) Code() int32 {
+	return types.APP_TYPE_ACCESS
+}
+
+func (a *Access) Dial(ctx context.Context) error {
+	return fmt.Errorf("access is not a connection")
+}
+
+func (a *Access) Response(ctx context.Context) error {
+	return fmt.Errorf("access is not a connection")
+}
+
+// Authorize checks a session of peerId with the application code against
+// the access rules and applies the constraints of the allowing rule to imp
+func Authorize(peerId string, imp Impl) error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	r, err := cm.Authorize(peerId, AppName(imp.Code()))
+	if err != nil {
+		return err
+	}
+	imp.Restrict(r.ReadOnly, r.ViewOnly)
+	return nil
+}
+
+// Serve runs the request on the configure of the daemon
+func (a *Access) Serve() AccessResult {
+	var res AccessResult
+	cm, err := conf.Shared()
+	if err == nil {
+		switch a.Op {
+		case ACCESS_OP_ADD:
+			err = cm.AddAccessRule(a.Rule, a.Index)
+		case ACCESS_OP_REMOVE:
+			err = cm.RemoveAccessRule(a.Index)
+		case ACCESS_OP_CHECK:
+			res.Rule, err = cm.Authorize(a.Peer, a.App)
+		}
+		res.Enabled = cm.Conf.AccessConf.Enabled
+		res.Default = cm.Conf.AccessConf.Default
+		res.Rules = cm.Conf.AccessConf.Rules
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// RequestAccess sends an access request to the local daemon
+func RequestAccess(a *Access) (*AccessResult, error) {
+	sender := NewSender(a, types.OPTION_TYPE_ACCESS)
+	if sender == nil {
+		return nil, fmt.Errorf("cannot create sender")
+	}
+	conn, err := sender.Send()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var res AccessResult
+	err = gob.NewDecoder(conn).Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
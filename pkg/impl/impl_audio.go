@@ -0,0 +1,398 @@
+package impl
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	audioSampleRate = 48000
+	audioChannels   = 2
+	// audio frames start with the payload length and the timestamp
+	audioFrameHeader = 6
+)
+
+// Audio streams what the remote desktop plays as Opus packets. Channels of
+// audio connections drop late packets instead of retransmitting them, so a
+// frame is only played if it arrives in time.
+type Audio struct {
+	BaseImpl
+	cmd  *exec.Cmd
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewAudio(hostId string) *Audio {
+	return &Audio{
+		BaseImpl: *NewBaseImpl(hostId),
+	}
+}
+
+func (a *Audio) Code() int32 {
+	return types.APP_TYPE_AUDIO
+}
+
+func audioAllowed(ac conf.AudioConf, peerId string) bool {
+	if !ac.Enabled {
+		return false
+	}
+	if len(ac.Peers) == 0 {
+		return true
+	}
+	for _, v := range ac.Peers {
+		if v == peerId {
+			return true
+		}
+	}
+	return false
+}
+
+// captureCommand records the monitor of the default output through
+// PulseAudio, which PipeWire provides with pipewire-pulse, and encodes it as
+// Ogg Opus with one packet of 20ms per page
+func captureCommand(ac conf.AudioConf) (*exec.Cmd, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("audio capture needs PulseAudio or PipeWire")
+	}
+	source := ac.Source
+	if source == "" {
+		source = "@DEFAULT_MONITOR@"
+	}
+	bitrate := ac.Bitrate
+	if bitrate <= 0 {
+		bitrate = 64000
+	}
+	return exec.Command("ffmpeg", "-loglevel", "error",
+		"-f", "pulse", "-i", source,
+		"-ac", strconv.Itoa(audioChannels), "-ar", strconv.Itoa(audioSampleRate),
+		"-c:a", "libopus", "-b:a", strconv.Itoa(int(bitrate)),
+		"-application", "lowdelay", "-frame_duration", "20",
+		"-page_duration", "20000", "-f", "ogg", "-"), nil
+}
+
+// playCommand returns a player reading Ogg Opus from its standard input
+func playCommand() (*exec.Cmd, error) {
+	if path, err := exec.LookPath("ffplay"); err == nil {
+		return exec.Command(path, "-nodisp", "-loglevel", "error",
+			"-fflags", "nobuffer", "-flags", "low_delay", "-i", "-"), nil
+	}
+	if path, err := exec.LookPath("mpv"); err == nil {
+		return exec.Command(path, "--no-video", "--really-quiet", "--cache=no", "-"), nil
+	}
+	return nil, fmt.Errorf("no audio player found, please install ffplay or mpv")
+}
+
+// oggPackets splits an Ogg stream into its packets
+type oggPackets struct {
+	r       *bufio.Reader
+	packets [][]byte
+}
+
+func (op *oggPackets) next() ([]byte, error) {
+	for len(op.packets) == 0 {
+		header := make([]byte, 27)
+		_, err := io.ReadFull(op.r, header)
+		if err != nil {
+			return nil, err
+		}
+		if string(header[:4]) != "OggS" {
+			return nil, fmt.Errorf("invalid ogg page")
+		}
+		lacing := make([]byte, header[26])
+		_, err = io.ReadFull(op.r, lacing)
+		if err != nil {
+			return nil, err
+		}
+		var packet []byte
+		for _, v := range lacing {
+			seg := make([]byte, v)
+			_, err = io.ReadFull(op.r, seg)
+			if err != nil {
+				return nil, err
+			}
+			packet = append(packet, seg...)
+			// a segment shorter than 255 bytes ends the packet
+			if v < 255 {
+				op.packets = append(op.packets, packet)
+				packet = nil
+			}
+		}
+	}
+	ret := op.packets[0]
+	op.packets = op.packets[1:]
+	return ret, nil
+}
+
+// oggWriter muxes Opus packets into an Ogg stream, one packet per page
+type oggWriter struct {
+	w       io.Writer
+	serial  uint32
+	index   uint32
+	granule uint64
+}
+
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}()
+
+func newOggWriter(w io.Writer) (*oggWriter, error) {
+	ow := &oggWriter{w: w, serial: 0x73736878}
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = audioChannels
+	binary.LittleEndian.PutUint16(head[10:], 312)
+	binary.LittleEndian.PutUint32(head[12:], audioSampleRate)
+	err := ow.writePage(head, 2)
+	if err != nil {
+		return nil, err
+	}
+	// vendor string and an empty comment list
+	tags := []byte("OpusTags\x04\x00\x00\x00sshx\x00\x00\x00\x00")
+	return ow, ow.writePage(tags, 0)
+}
+
+// WritePacket adds a packet ending at sample position granule
+func (ow *oggWriter) WritePacket(packet []byte, granule uint64) error {
+	ow.granule = granule
+	return ow.writePage(packet, 0)
+}
+
+func (ow *oggWriter) writePage(packet []byte, headerType byte) error {
+	lacing := make([]byte, len(packet)/255+1)
+	for i := range lacing {
+		lacing[i] = 255
+	}
+	lacing[len(lacing)-1] = byte(len(packet) % 255)
+	page := make([]byte, 27, 27+len(lacing)+len(packet))
+	copy(page, "OggS")
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], ow.granule)
+	binary.LittleEndian.PutUint32(page[14:], ow.serial)
+	binary.LittleEndian.PutUint32(page[18:], ow.index)
+	page[26] = byte(len(lacing))
+	page = append(page, lacing...)
+	page = append(page, packet...)
+	var crc uint32
+	for _, v := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^v]
+	}
+	binary.LittleEndian.PutUint32(page[22:], crc)
+	ow.index++
+	_, err := ow.w.Write(page)
+	return err
+}
+
+// opusSamples returns the duration of an Opus packet in samples at 48kHz
+func opusSamples(packet []byte) uint32 {
+	if len(packet) == 0 {
+		return 0
+	}
+	config := packet[0] >> 3
+	var frame uint32
+	switch {
+	case config < 12:
+		frame = []uint32{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		frame = []uint32{480, 960}[config%2]
+	default:
+		frame = []uint32{120, 240, 480, 960}[config%4]
+	}
+	switch packet[0] & 3 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	}
+	if len(packet) < 2 {
+		return 0
+	}
+	return frame * uint32(packet[1]&0x3f)
+}
+
+func (a *Audio) stopChan() chan struct{} {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.stop == nil {
+		a.stop = make(chan struct{})
+	}
+	return a.stop
+}
+
+// DoPlay plays the remote audio until Close is called or the connection
+// drops
+func (a *Audio) DoPlay() error {
+	cmd, err := playCommand()
+	if err != nil {
+		return err
+	}
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	a.cmd = cmd
+	a.lock.Unlock()
+	defer cmd.Wait()
+	defer in.Close()
+
+	ogg, err := newOggWriter(in)
+	if err != nil {
+		return err
+	}
+	stop := a.stopChan()
+	r := bufio.NewReader(a.Conn())
+	header := make([]byte, audioFrameHeader)
+	var last, first uint32
+	started := false
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		_, err = io.ReadFull(r, header)
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			return err
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(header[:2]))
+		_, err = io.ReadFull(r, payload)
+		if err != nil {
+			return err
+		}
+		ts := binary.BigEndian.Uint32(header[2:])
+		// frames may arrive out of order, late ones are skipped
+		if started && int32(ts-last) <= 0 {
+			continue
+		}
+		if !started {
+			first = ts
+			started = true
+		}
+		last = ts
+		err = ogg.WritePacket(payload, uint64(ts-first)+uint64(opusSamples(payload)))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (a *Audio) doResponse(s net.Conn, out io.Reader) error {
+	defer s.Close()
+	packets := &oggPackets{r: bufio.NewReader(out)}
+	// skip the OpusHead and OpusTags headers
+	for i := 0; i < 2; i++ {
+		_, err := packets.next()
+		if err != nil {
+			return err
+		}
+	}
+	stop := a.stopChan()
+	var ts uint32
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		packet, err := packets.next()
+		if err != nil {
+			return err
+		}
+		if len(packet) == 0 || len(packet) > 0xffff {
+			continue
+		}
+		// one write per frame, so every frame is sent as its own message
+		frame := make([]byte, audioFrameHeader+len(packet))
+		binary.BigEndian.PutUint16(frame[:2], uint16(len(packet)))
+		binary.BigEndian.PutUint32(frame[2:6], ts)
+		copy(frame[audioFrameHeader:], packet)
+		_, err = s.Write(frame)
+		if err != nil {
+			return err
+		}
+		ts += opusSamples(packet)
+	}
+}
+
+func (a *Audio) Response(ctx context.Context) error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	ac := cm.Conf.AudioConf
+	if !audioAllowed(ac, a.HostId()) {
+		return fmt.Errorf("audio access denied for %s", a.HostId())
+	}
+	cmd, err := captureCommand(ac)
+	if err != nil {
+		return err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	s, c := net.Pipe()
+	a.lock.Lock()
+	a.BaseImpl.conn = &c
+	a.cmd = cmd
+	a.lock.Unlock()
+	Log(a).Debug("stream audio to ", a.HostId())
+	go func() {
+		err := a.doResponse(s, out)
+		if err != nil {
+			Log(a).Error("do response ", err)
+		}
+		a.Close()
+		cmd.Wait()
+	}()
+	return nil
+}
+
+func (a *Audio) Close() error {
+	stop := a.stopChan()
+	a.once.Do(func() {
+		close(stop)
+		a.lock.Lock()
+		if a.cmd != nil && a.cmd.Process != nil {
+			a.cmd.Process.Kill()
+		}
+		a.lock.Unlock()
+	})
+	return a.BaseImpl.Close()
+}
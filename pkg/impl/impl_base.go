@@ -3,6 +3,8 @@
 package impl
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
 	"sync"
@@ -31,6 +33,13 @@ type BaseImpl struct {
 	
 	// ConnectNow indicates whether this implementation needs an active connection
 	ConnectNow bool
+	
+	// OTP is the one-time code the remote device may ask for the session
+	OTP string
+	
+	// constraints of the access rule allowing an inbound session
+	readOnly bool
+	viewOnly bool
 }
 
 func NewBaseImpl(hid string) *BaseImpl {
@@ -56,7 +65,7 @@ func (base *BaseImpl) Conn() net.Conn {
 	return *base.conn
 }
 
-func (base *BaseImpl) Preper() error {
+func (base *BaseImpl) Preper(ctx context.Context) error {
 	return nil
 }
 
@@ -75,6 +84,19 @@ func (base *BaseImpl) SetPairId(id string) {
 	base.PId = id
 }
 
+func (base *BaseImpl) OneTimeCode() string {
+	return base.OTP
+}
+
+func (base *BaseImpl) SetOneTimeCode(code string) {
+	base.OTP = code
+}
+
+func (base *BaseImpl) Restrict(readOnly, viewOnly bool) {
+	base.readOnly = readOnly
+	base.viewOnly = viewOnly
+}
+
 func (base *BaseImpl) ParentId() string {
 	return base.Parent
 }
@@ -112,24 +134,29 @@ func (base *BaseImpl) HostId() string {
 	return base.HId
 }
 
-func (base *BaseImpl) Close() {
-	if base.conn != nil {
-		logrus.Debug("close Conn")
-		(*base.conn).Close()
-	}
+func (base *BaseImpl) Close() error {
 	logrus.Debug("close base impl")
+	if base.conn == nil {
+		return nil
+	}
+	logrus.Debug("close Conn")
+	err := (*base.conn).Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
 }
 
 // Response of remote device call
-func (base *BaseImpl) Response() error {
+func (base *BaseImpl) Response(ctx context.Context) error {
 	return nil
 }
 
 // Call remote device
-func (base *BaseImpl) Dial() error {
+func (base *BaseImpl) Dial(ctx context.Context) error {
 	return nil
 }
 
-func (base *BaseImpl) Attach(net.Conn) error {
+func (base *BaseImpl) Attach(ctx context.Context, conn net.Conn) error {
 	return nil
 }
@@ -0,0 +1,282 @@
+package impl
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// frames of the benchmark start with their type and payload length
+const (
+	benchFramePing     = 'p' // echoed by the responder
+	benchFrameUpload   = 'u' // data sent to the responder
+	benchFrameUploaded = 'U' // ends the upload, answered by a benchResult frame
+	benchFrameDownload = 'd' // asks for data for some seconds, then data
+	benchFrameDone     = 'D' // ends the download
+	benchFrameResult   = 'r' // bytes received and nanoseconds it took
+	benchFramePath     = 'i' // asks for the network path, then the path
+
+	benchFrameHeader = 5
+	benchChunkSize   = 16 << 10
+	// a frame larger than a chunk is not a frame of the benchmark
+	benchMaxFrame = benchChunkSize
+)
+
+// PathReporter is implemented by applications which report the network
+// path of their session, connections set it before the session starts
+type PathReporter interface {
+	SetPath(path string)
+}
+
+// Bench measures the round trip time and the throughput to a peer over
+// the path sessions take, relayed or not
+type Bench struct {
+	BaseImpl
+	path string
+}
+
+// BenchResult is the outcome of a benchmark, in milliseconds and bytes per
+// second
+type BenchResult struct {
+	Peer          string  `json:"peer"`
+	Path          string  `json:"path"`
+	Pings         int     `json:"pings"`
+	RTTMin        float64 `json:"rtt_min_ms"`
+	RTTAvg        float64 `json:"rtt_avg_ms"`
+	RTTMax        float64 `json:"rtt_max_ms"`
+	UploadBytes   int64   `json:"upload_bytes"`
+	UploadRate    float64 `json:"upload_bytes_per_second"`
+	DownloadBytes int64   `json:"download_bytes"`
+	DownloadRate  float64 `json:"download_bytes_per_second"`
+}
+
+func NewBench(hostId string) *Bench {
+	return &Bench{
+		BaseImpl: *NewBaseImpl(hostId),
+	}
+}
+
+func (b *Bench) Code() int32 {
+	return types.APP_TYPE_BENCH
+}
+
+// SetPath sets the network path the responder reports
+func (b *Bench) SetPath(path string) {
+	b.path = path
+}
+
+func writeBenchFrame(w io.Writer, kind byte, payload []byte) error {
+	frame := make([]byte, benchFrameHeader+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	copy(frame[benchFrameHeader:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readBenchFrame(r io.Reader, buf []byte) (byte, []byte, error) {
+	header := make([]byte, benchFrameHeader)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > benchMaxFrame {
+		return 0, nil, fmt.Errorf("benchmark frame of %d bytes", n)
+	}
+	_, err = io.ReadFull(r, buf[:n])
+	return header[0], buf[:n], err
+}
+
+func benchResultFrame(bytes int64, elapsed time.Duration) []byte {
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint64(payload, uint64(bytes))
+	binary.BigEndian.PutUint64(payload[8:], uint64(elapsed))
+	return payload
+}
+
+func rate(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / elapsed.Seconds()
+}
+
+// Run measures pings round trips, then the upload and the download for
+// duration each
+func (b *Bench) Run(pings int, duration time.Duration) (*BenchResult, error) {
+	conn := b.Conn()
+	res := &BenchResult{Peer: b.HostId(), Pings: pings}
+	buf := make([]byte, benchMaxFrame)
+
+	// round trips
+	var total time.Duration
+	for i := 0; i < pings; i++ {
+		seq := make([]byte, 8)
+		binary.BigEndian.PutUint64(seq, uint64(i))
+		start := time.Now()
+		err := writeBenchFrame(conn, benchFramePing, seq)
+		if err != nil {
+			return nil, err
+		}
+		kind, payload, err := readBenchFrame(conn, buf)
+		if err != nil {
+			return nil, err
+		}
+		if kind != benchFramePing || binary.BigEndian.Uint64(payload) != uint64(i) {
+			return nil, fmt.Errorf("unexpected answer to ping %d", i)
+		}
+		rtt := time.Since(start)
+		ms := float64(rtt) / float64(time.Millisecond)
+		if i == 0 || ms < res.RTTMin {
+			res.RTTMin = ms
+		}
+		if ms > res.RTTMax {
+			res.RTTMax = ms
+		}
+		total += rtt
+	}
+	if pings > 0 {
+		res.RTTAvg = float64(total) / float64(pings) / float64(time.Millisecond)
+	}
+
+	// upload, measured by the responder
+	chunk := make([]byte, benchChunkSize)
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		err := writeBenchFrame(conn, benchFrameUpload, chunk)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := writeBenchFrame(conn, benchFrameUploaded, nil)
+	if err != nil {
+		return nil, err
+	}
+	kind, payload, err := readBenchFrame(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	if kind != benchFrameResult || len(payload) != 16 {
+		return nil, fmt.Errorf("unexpected answer to the upload")
+	}
+	res.UploadBytes = int64(binary.BigEndian.Uint64(payload))
+	res.UploadRate = rate(res.UploadBytes, time.Duration(binary.BigEndian.Uint64(payload[8:])))
+
+	// download
+	seconds := make([]byte, 4)
+	binary.BigEndian.PutUint32(seconds, uint32(duration/time.Second))
+	err = writeBenchFrame(conn, benchFrameDownload, seconds)
+	if err != nil {
+		return nil, err
+	}
+	var start time.Time
+	for {
+		kind, payload, err = readBenchFrame(conn, buf)
+		if err != nil {
+			return nil, err
+		}
+		if kind == benchFrameDone {
+			break
+		}
+		if kind != benchFrameDownload {
+			return nil, fmt.Errorf("unexpected frame %q during the download", kind)
+		}
+		// the first chunk starts the clock, as the responder does
+		if start.IsZero() {
+			start = time.Now()
+			continue
+		}
+		res.DownloadBytes += int64(len(payload))
+	}
+	res.DownloadRate = rate(res.DownloadBytes, time.Since(start))
+
+	// path
+	err = writeBenchFrame(conn, benchFramePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	kind, payload, err = readBenchFrame(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	if kind == benchFramePath {
+		res.Path = string(payload)
+	}
+	return res, nil
+}
+
+func (b *Bench) doResponse(s net.Conn) error {
+	buf := make([]byte, benchMaxFrame)
+	chunk := make([]byte, benchChunkSize)
+	var received int64
+	var first time.Time
+	for {
+		kind, payload, err := readBenchFrame(s, buf)
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case benchFramePing:
+			err = writeBenchFrame(s, benchFramePing, payload)
+		case benchFrameUpload:
+			// the first chunk starts the clock, the time it took to
+			// arrive is not known
+			if first.IsZero() {
+				first = time.Now()
+				continue
+			}
+			received += int64(len(payload))
+		case benchFrameUploaded:
+			var elapsed time.Duration
+			if !first.IsZero() {
+				elapsed = time.Since(first)
+			}
+			err = writeBenchFrame(s, benchFrameResult, benchResultFrame(received, elapsed))
+			received, first = 0, time.Time{}
+		case benchFrameDownload:
+			if len(payload) != 4 {
+				return fmt.Errorf("invalid download request")
+			}
+			seconds := binary.BigEndian.Uint32(payload)
+			if seconds > 60 {
+				seconds = 60
+			}
+			deadline := time.Now().Add(time.Duration(seconds) * time.Second)
+			for err == nil && time.Now().Before(deadline) {
+				err = writeBenchFrame(s, benchFrameDownload, chunk)
+			}
+			if err == nil {
+				err = writeBenchFrame(s, benchFrameDone, nil)
+			}
+		case benchFramePath:
+			err = writeBenchFrame(s, benchFramePath, []byte(b.path))
+		default:
+			return fmt.Errorf("unknown benchmark frame %q", kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Bench) Response(ctx context.Context) error {
+	s, c := net.Pipe()
+	b.lock.Lock()
+	b.BaseImpl.conn = &c
+	b.lock.Unlock()
+	Log(b).Debug("serve benchmark over ", b.path)
+	go func() {
+		err := b.doResponse(s)
+		if err != nil && err != io.EOF && err != io.ErrClosedPipe {
+			Log(b).Debug("benchmark ", err)
+		}
+		s.Close()
+	}()
+	return nil
+}
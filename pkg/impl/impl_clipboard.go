@@ -0,0 +1,318 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/clipboard"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	CLIPBOARD_GET = iota
+	CLIPBOARD_SET
+	CLIPBOARD_WATCH
+)
+
+// ClipboardData is a clipboard content in a MIME format
+type ClipboardData struct {
+	Format string
+	Data   []byte
+}
+
+// ClipboardRequest is sent by the dialer, Content is only used by CLIPBOARD_SET
+type ClipboardRequest struct {
+	Op      int32
+	Images  bool
+	Content ClipboardData
+}
+
+type ClipboardReply struct {
+	Error   string
+	Content ClipboardData
+}
+
+// Clipboard copies clipboard content between two devices, once or
+// continuously in both directions
+type Clipboard struct {
+	BaseImpl
+	// Images also synchronizes PNG images
+	Images bool
+	stop   chan struct{}
+	once   sync.Once
+	enc    *gob.Encoder
+	dec    *types.LimitedDecoder
+}
+
+func NewClipboard(hostId string, images bool) *Clipboard {
+	return &Clipboard{
+		BaseImpl: *NewBaseImpl(hostId),
+		Images:   images,
+	}
+}
+
+func (cb *Clipboard) Code() int32 {
+	return types.APP_TYPE_CLIPBOARD
+}
+
+func (cb *Clipboard) stopChan() chan struct{} {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.stop == nil {
+		cb.stop = make(chan struct{})
+	}
+	return cb.stop
+}
+
+func maxClipboardSize(cc conf.ClipboardConf) int {
+	if cc.MaxSize <= 0 {
+		return 4 << 20
+	}
+	return int(cc.MaxSize)
+}
+
+// clipboardMessageLimit bounds an encoded clipboard message, the largest
+// content and its fields
+func clipboardMessageLimit(cc conf.ClipboardConf) int64 {
+	return int64(maxClipboardSize(cc)) + 4<<10
+}
+
+// readClipboard returns the text of the clipboard, or the image if there is
+// no text and images are allowed
+func readClipboard(images bool) (ClipboardData, error) {
+	text, err := clipboard.Read(clipboard.FORMAT_TEXT)
+	if err == nil && len(text) > 0 || !images {
+		return ClipboardData{Format: clipboard.FORMAT_TEXT, Data: text}, err
+	}
+	img, err := clipboard.Read(clipboard.FORMAT_PNG)
+	return ClipboardData{Format: clipboard.FORMAT_PNG, Data: img}, err
+}
+
+func (cb *Clipboard) request(cc conf.ClipboardConf, req ClipboardRequest) (ClipboardReply, error) {
+	var reply ClipboardReply
+	// keep the coders, the decoder may buffer data following the reply
+	cb.enc = gob.NewEncoder(cb.Conn())
+	cb.dec = types.NewLimitedDecoder(cb.Conn(), clipboardMessageLimit(cc))
+	err := cb.enc.Encode(req)
+	if err != nil {
+		return reply, err
+	}
+	err = cb.dec.Decode(&reply)
+	if err != nil {
+		return reply, err
+	}
+	if reply.Error != "" {
+		return reply, errors.New(reply.Error)
+	}
+	return reply, nil
+}
+
+// DoGet replaces the local clipboard with the remote one
+func (cb *Clipboard) DoGet() error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	reply, err := cb.request(cm.Conf.ClipboardConf, ClipboardRequest{Op: CLIPBOARD_GET, Images: cb.Images})
+	if err != nil {
+		return err
+	}
+	if len(reply.Content.Data) > maxClipboardSize(cm.Conf.ClipboardConf) {
+		return fmt.Errorf("clipboard content too large (%d bytes)", len(reply.Content.Data))
+	}
+	return clipboard.Write(reply.Content.Format, reply.Content.Data)
+}
+
+// DoSet replaces the remote clipboard with the local one
+func (cb *Clipboard) DoSet() error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	content, err := readClipboard(cb.Images)
+	if err != nil {
+		return err
+	}
+	if len(content.Data) > maxClipboardSize(cm.Conf.ClipboardConf) {
+		return fmt.Errorf("clipboard content too large (%d bytes)", len(content.Data))
+	}
+	_, err = cb.request(cm.Conf.ClipboardConf, ClipboardRequest{Op: CLIPBOARD_SET, Content: content})
+	return err
+}
+
+// DoWatch keeps both clipboards in sync until Close is called or the
+// connection drops
+func (cb *Clipboard) DoWatch() error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	_, err = cb.request(cm.Conf.ClipboardConf, ClipboardRequest{Op: CLIPBOARD_WATCH, Images: cb.Images})
+	if err != nil {
+		return err
+	}
+	return watchClipboard(cb.Conn(), cb.enc, cb.dec, cb.Images, cm.Conf.ClipboardConf, cb.stopChan())
+}
+
+// watchClipboard sends local clipboard changes to conn and applies the ones
+// coming from conn
+func watchClipboard(conn net.Conn, enc *gob.Encoder, dec *types.LimitedDecoder, images bool, cc conf.ClipboardConf, stop chan struct{}) error {
+	maxSize := maxClipboardSize(cc)
+	interval := time.Duration(cc.PollInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = 500 * time.Millisecond
+	}
+	var lock sync.Mutex
+	// last content seen on either side, so remote changes are not echoed back
+	last, _ := readClipboard(images)
+
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			var content ClipboardData
+			err := dec.Decode(&content)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if len(content.Data) > maxSize || (content.Format == clipboard.FORMAT_PNG && !images) {
+				logrus.Warn("drop clipboard content ", content.Format, " of ", len(content.Data), " bytes")
+				continue
+			}
+			lock.Lock()
+			last = content
+			lock.Unlock()
+			err = clipboard.Write(content.Format, content.Data)
+			if err != nil {
+				logrus.Error(err)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer conn.Close()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case err := <-errCh:
+			return err
+		case <-ticker.C:
+		}
+		content, err := readClipboard(images)
+		if err != nil || len(content.Data) == 0 || len(content.Data) > maxSize {
+			continue
+		}
+		lock.Lock()
+		changed := content.Format != last.Format || !bytes.Equal(content.Data, last.Data)
+		if changed {
+			last = content
+		}
+		lock.Unlock()
+		if !changed {
+			continue
+		}
+		err = enc.Encode(content)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func clipboardAllowed(cc conf.ClipboardConf, peerId string) bool {
+	if !cc.Enabled {
+		return false
+	}
+	if len(cc.Peers) == 0 {
+		return true
+	}
+	for _, v := range cc.Peers {
+		if v == peerId {
+			return true
+		}
+	}
+	return false
+}
+
+func (cb *Clipboard) doResponse(s net.Conn) error {
+	defer s.Close()
+	enc := gob.NewEncoder(s)
+	cm, err := conf.Shared()
+	if err != nil {
+		enc.Encode(ClipboardReply{Error: err.Error()})
+		return err
+	}
+	cc := cm.Conf.ClipboardConf
+	var req ClipboardRequest
+	dec := types.NewLimitedDecoder(s, clipboardMessageLimit(cc))
+	err = dec.Decode(&req)
+	if err != nil {
+		return err
+	}
+	if !clipboardAllowed(cc, cb.HostId()) {
+		enc.Encode(ClipboardReply{Error: "clipboard access denied"})
+		return fmt.Errorf("clipboard access denied for %s", cb.HostId())
+	}
+	images := req.Images && cc.Images
+	reply := ClipboardReply{}
+	switch req.Op {
+	case CLIPBOARD_GET:
+		reply.Content, err = readClipboard(images)
+		if err == nil && len(reply.Content.Data) > maxClipboardSize(cc) {
+			err = fmt.Errorf("clipboard content too large (%d bytes)", len(reply.Content.Data))
+		}
+	case CLIPBOARD_SET:
+		switch {
+		case len(req.Content.Data) > maxClipboardSize(cc):
+			err = fmt.Errorf("clipboard content too large (%d bytes)", len(req.Content.Data))
+		case req.Content.Format == clipboard.FORMAT_PNG && !cc.Images:
+			err = fmt.Errorf("image clipboard disabled")
+		default:
+			err = clipboard.Write(req.Content.Format, req.Content.Data)
+		}
+	case CLIPBOARD_WATCH:
+		err = enc.Encode(reply)
+		if err != nil {
+			return err
+		}
+		Log(cb).Debug("watch clipboard with ", cb.HostId())
+		return watchClipboard(s, enc, dec, images, cc, cb.stopChan())
+	default:
+		err = fmt.Errorf("unknown clipboard operation %d", req.Op)
+	}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	return enc.Encode(reply)
+}
+
+func (cb *Clipboard) Response(ctx context.Context) error {
+	s, c := net.Pipe()
+	cb.lock.Lock()
+	cb.BaseImpl.conn = &c
+	cb.lock.Unlock()
+	go func() {
+		err := cb.doResponse(s)
+		if err != nil {
+			Log(cb).Error("do response ", err)
+		}
+	}()
+	return nil
+}
+
+func (cb *Clipboard) Close() error {
+	stop := cb.stopChan()
+	cb.once.Do(func() {
+		close(stop)
+	})
+	return cb.BaseImpl.Close()
+}
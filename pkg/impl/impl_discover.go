@@ -0,0 +1,76 @@
+package impl
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// maxDiscoverWait bounds the seconds the daemon waits for answers
+const maxDiscoverWait = 10
+
+// Discover lists the devices the daemon found on the local network. It is
+// not a connection, peers refuse it.
+type Discover struct {
+	BaseImpl
+	// Wait is the number of seconds the daemon waits for the answers of a
+	// new query before answering, none if zero
+	Wait int
+}
+
+func NewDiscover(hostId string) *Discover {
+	ret := &Discover{
+		BaseImpl: *NewBaseImpl(hostId),
+	}
+	ret.NoNeedConnect()
+	return ret
+}
+
+func (d *Discover) Code() int32 {
+	return types.APP_TYPE_DISCOVER
+}
+
+func (d *Discover) Dial(ctx context.Context) error {
+	return fmt.Errorf("discover is not a connection")
+}
+
+func (d *Discover) Response(ctx context.Context) error {
+	return fmt.Errorf("discover is not a connection")
+}
+
+// WaitSeconds is the bounded number of seconds to wait for answers
+func (d *Discover) WaitSeconds() int {
+	if d.Wait > maxDiscoverWait {
+		return maxDiscoverWait
+	}
+	return d.Wait
+}
+
+// RequestDiscover asks the local daemon for the devices of the local network
+func RequestDiscover(d *Discover) ([]types.LANPeer, error) {
+	return RequestDiscoverContext(context.Background(), d)
+}
+
+// RequestDiscoverContext is RequestDiscover until ctx is done
+func RequestDiscoverContext(ctx context.Context, d *Discover) ([]types.LANPeer, error) {
+	sender := NewSender(d, types.OPTION_TYPE_DISCOVER)
+	if sender == nil {
+		return nil, fmt.Errorf("cannot create sender")
+	}
+	conn, err := sender.SendContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var res []types.LANPeer
+	err = utils.WithContext(ctx, conn, func() error {
+		return gob.NewDecoder(conn).Decode(&res)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
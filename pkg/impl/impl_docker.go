@@ -0,0 +1,299 @@
+package impl
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// DockerRequest is sent by the dialer to list the containers of the remote
+// node, or to exec into or attach to one of them
+type DockerRequest struct {
+	List bool
+	// All lists the stopped containers too
+	All       bool
+	Container string
+	// Attach attaches to the main process of the container instead of
+	// running Command
+	Attach  bool
+	Command []string
+	User    string
+	TTY     bool
+}
+
+// DockerReply tells the dialer whether the stream is open
+type DockerReply struct {
+	Ready      bool
+	Error      string
+	Containers []types.DockerContainer
+	// TTY is set if the stream is a terminal, for attach it is the one of
+	// the container
+	TTY bool
+}
+
+// Docker reaches the containers of the Docker engine of a remote node,
+// the remote node talks to its engine so its socket is never exposed
+type Docker struct {
+	BaseImpl
+	Request DockerRequest
+}
+
+func NewDocker(hostId string, req DockerRequest) *Docker {
+	return &Docker{
+		BaseImpl: *NewBaseImpl(hostId),
+		Request:  req,
+	}
+}
+
+func (d *Docker) Code() int32 {
+	return types.APP_TYPE_DOCKER
+}
+
+func dockerAllowed(dc conf.DockerConf, peerId string) error {
+	if !dc.Enabled {
+		return fmt.Errorf("docker access is disabled")
+	}
+	if len(dc.Peers) == 0 {
+		return nil
+	}
+	for _, v := range dc.Peers {
+		if v == peerId {
+			return nil
+		}
+	}
+	return fmt.Errorf("docker access denied for %s", peerId)
+}
+
+func dockerContainerAllowed(dc conf.DockerConf, name string) bool {
+	if len(dc.Containers) == 0 {
+		return true
+	}
+	for _, v := range dc.Containers {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// open sends the request over the connection set by SetConn and waits for
+// the reply, the returned connection serves the bytes read ahead with it
+func (d *Docker) open() (net.Conn, DockerReply, error) {
+	var reply DockerReply
+	conn := d.Conn()
+	err := gob.NewEncoder(conn).Encode(d.Request)
+	if err != nil {
+		return nil, reply, err
+	}
+	reader := bufio.NewReader(conn)
+	err = types.DecodeLimited(reader, MaxReplySize, &reply)
+	if err != nil {
+		return nil, reply, err
+	}
+	if !reply.Ready {
+		return nil, reply, fmt.Errorf("remote docker: %s", reply.Error)
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, reply, nil
+}
+
+// DoList returns the containers of the remote node
+func (d *Docker) DoList() ([]types.DockerContainer, error) {
+	d.Request.List = true
+	_, reply, err := d.open()
+	return reply.Containers, err
+}
+
+// DoExec runs the command of the request, or attaches to the container,
+// with the terminal as its stdin, stdout and stderr. It returns the exit
+// code of the command.
+func (d *Docker) DoExec() (int, error) {
+	conn, reply, err := d.open()
+	if err != nil {
+		return 0, err
+	}
+	return execTerminal(conn, reply.TTY, func(msg []byte) (int, error) {
+		return strconv.Atoi(string(msg))
+	})
+}
+
+// dockerRelay passes an exec session between the dialer and the engine.
+// Streams which are not terminals multiplex stdout and stderr behind 8
+// bytes headers, the first byte is the stream and the last 4 the size.
+func dockerRelay(enc *gob.Encoder, dec *types.LimitedDecoder, stream net.Conn, tty bool, resize func(execSize) error) error {
+	go func() {
+		var err error
+		for err == nil {
+			var msg []byte
+			err = dec.Decode(&msg)
+			if err != nil || len(msg) == 0 {
+				continue
+			}
+			switch msg[0] {
+			case execStdin:
+				if len(msg) > 1 {
+					_, err = stream.Write(msg[1:])
+				} else if bc, ok := stream.(*bufferedConn); ok {
+					// the end of stdin
+					if cw, ok := bc.Conn.(interface{ CloseWrite() error }); ok {
+						cw.CloseWrite()
+					}
+				}
+			case execResize:
+				var size execSize
+				if json.Unmarshal(msg[1:], &size) == nil {
+					resize(size)
+				}
+			}
+		}
+		stream.Close()
+	}()
+	var err error
+	header := make([]byte, 8)
+	buf := make([]byte, 32*1024)
+	for err == nil {
+		if tty {
+			var n int
+			n, err = stream.Read(buf)
+			if n > 0 && enc.Encode(append([]byte{execStdout}, buf[:n]...)) != nil {
+				break
+			}
+			continue
+		}
+		_, err = io.ReadFull(stream, header)
+		if err != nil {
+			break
+		}
+		msg := make([]byte, 1+binary.BigEndian.Uint32(header[4:]))
+		msg[0] = header[0]
+		_, err = io.ReadFull(stream, msg[1:])
+		if err == nil && (msg[0] == execStdout || msg[0] == execStderr) {
+			err = enc.Encode(msg)
+		}
+	}
+	stream.Close()
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (d *Docker) doResponse(s net.Conn) error {
+	defer s.Close()
+	enc := gob.NewEncoder(s)
+	dec := types.NewLimitedDecoder(s, MaxRequestSize)
+	var req DockerRequest
+	err := dec.Decode(&req)
+	if err != nil {
+		return err
+	}
+	reject := func(err error) error {
+		enc.Encode(DockerReply{Error: err.Error()})
+		return err
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return reject(err)
+	}
+	dc := cm.Conf.DockerConf
+	err = dockerAllowed(dc, d.HostId())
+	if err != nil {
+		return reject(err)
+	}
+	client, err := newDockerClient(dc.Host)
+	if err != nil {
+		return reject(err)
+	}
+	if req.List {
+		list, err := client.Containers(req.All)
+		if err != nil {
+			return reject(err)
+		}
+		reply := DockerReply{Ready: true}
+		for _, v := range list {
+			if dockerContainerAllowed(dc, v.Name) {
+				reply.Containers = append(reply.Containers, v)
+			}
+		}
+		return enc.Encode(reply)
+	}
+	if !dc.Exec || d.readOnly {
+		return reject(fmt.Errorf("exec is not allowed"))
+	}
+	container, err := client.Inspect(req.Container)
+	if err != nil {
+		return reject(err)
+	}
+	if !dockerContainerAllowed(dc, container.Name) {
+		return reject(fmt.Errorf("container %s is not allowed", req.Container))
+	}
+	if !container.State.Running {
+		return reject(fmt.Errorf("container %s is not running", container.Name))
+	}
+	var stream net.Conn
+	var resizePath, execId string
+	tty := req.TTY
+	if req.Attach {
+		Log(d).Debug("attach to ", container.Name, " for ", d.HostId())
+		tty = container.Config.Tty
+		resizePath = "/containers/" + container.Id
+		stream, err = client.Attach(container.Id)
+	} else {
+		if len(req.Command) == 0 {
+			req.Command = []string{"sh"}
+		}
+		Log(d).Debugf("exec %v in %s for %s", req.Command, container.Name, d.HostId())
+		execId, stream, err = client.Exec(container.Id, req.Command, req.User, tty)
+		resizePath = "/exec/" + execId
+	}
+	if err != nil {
+		return reject(err)
+	}
+	err = enc.Encode(DockerReply{Ready: true, TTY: tty})
+	if err != nil {
+		stream.Close()
+		return err
+	}
+	err = dockerRelay(enc, dec, stream, tty, func(size execSize) error {
+		return client.Resize(resizePath, size)
+	})
+	if err != nil {
+		return err
+	}
+	code := 0
+	if req.Attach {
+		// the container still runs if the dialer detached
+		container, err = client.Inspect(container.Id)
+		if err == nil && !container.State.Running {
+			code = container.State.ExitCode
+		}
+	} else {
+		code, err = client.ExecExitCode(execId)
+	}
+	if err != nil {
+		return err
+	}
+	return enc.Encode(append([]byte{execStatus}, strconv.Itoa(code)...))
+}
+
+func (d *Docker) Response(ctx context.Context) error {
+	s, c := net.Pipe()
+	d.lock.Lock()
+	d.BaseImpl.conn = &c
+	d.lock.Unlock()
+	go func() {
+		err := d.doResponse(s)
+		if err != nil {
+			Log(d).Error("do response ", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,205 @@
+package impl
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// ExecRequest is sent by the dialer to run a command
+type ExecRequest struct {
+	// Command is a command line of the shell of the remote node, sh or
+	// cmd on Windows
+	Command string
+}
+
+// ExecReply tells the dialer whether the command runs
+type ExecReply struct {
+	Ready bool
+	Error string
+}
+
+// Exec runs a command on a remote node without a terminal, its output comes
+// back as it is written and the session ends with its exit code
+type Exec struct {
+	BaseImpl
+	Request ExecRequest
+}
+
+func NewExec(hostId string, command string) *Exec {
+	return &Exec{
+		BaseImpl: *NewBaseImpl(hostId),
+		Request:  ExecRequest{Command: command},
+	}
+}
+
+func (e *Exec) Code() int32 {
+	return types.APP_TYPE_EXEC
+}
+
+func execAllowed(ec conf.ExecConf, peerId string) error {
+	if !ec.Enabled {
+		return fmt.Errorf("remote commands are disabled")
+	}
+	if len(ec.Peers) == 0 {
+		return nil
+	}
+	for _, v := range ec.Peers {
+		if v == peerId {
+			return nil
+		}
+	}
+	return fmt.Errorf("remote commands denied for %s", peerId)
+}
+
+// DoRun runs the command over the connection set by SetConn, writing its
+// output to stdout and stderr, and returns its exit code. The command is
+// killed if ctx is done first.
+func (e *Exec) DoRun(ctx context.Context, stdout, stderr io.Writer) (int, error) {
+	conn := e.Conn()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	err := gob.NewEncoder(conn).Encode(e.Request)
+	if err != nil {
+		return 0, err
+	}
+	dec := types.NewLimitedDecoder(bufio.NewReader(conn), MaxStreamMessageSize)
+	var reply ExecReply
+	err = dec.Decode(&reply)
+	if err != nil {
+		return 0, err
+	}
+	if !reply.Ready {
+		return 0, fmt.Errorf("remote exec: %s", reply.Error)
+	}
+	for {
+		var msg []byte
+		err = dec.Decode(&msg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, fmt.Errorf("exec session closed: %v", err)
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		switch msg[0] {
+		case execStdout:
+			stdout.Write(msg[1:])
+		case execStderr:
+			stderr.Write(msg[1:])
+		case execStatus:
+			return strconv.Atoi(string(msg[1:]))
+		}
+	}
+}
+
+// execWriter sends what is written to it as the messages of a channel
+type execWriter struct {
+	enc     *gob.Encoder
+	lock    *sync.Mutex
+	channel byte
+}
+
+func (w *execWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	err := w.enc.Encode(append([]byte{w.channel}, p...))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (e *Exec) doResponse(c net.Conn) error {
+	defer c.Close()
+	enc := gob.NewEncoder(c)
+	reader := bufio.NewReader(c)
+	var req ExecRequest
+	err := types.DecodeLimited(reader, MaxRequestSize, &req)
+	if err != nil {
+		return err
+	}
+	reject := func(err error) error {
+		enc.Encode(ExecReply{Error: err.Error()})
+		return err
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return reject(err)
+	}
+	err = execAllowed(cm.Conf.ExecConf, e.HostId())
+	if err != nil {
+		return reject(err)
+	}
+	if e.readOnly {
+		return reject(fmt.Errorf("read only access"))
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", req.Command)
+	} else {
+		cmd = exec.Command("sh", "-c", req.Command)
+	}
+	var lock sync.Mutex
+	cmd.Stdout = &execWriter{enc: enc, lock: &lock, channel: execStdout}
+	cmd.Stderr = &execWriter{enc: enc, lock: &lock, channel: execStderr}
+	Log(e).Debugf("run %q for %s", req.Command, e.HostId())
+	err = enc.Encode(ExecReply{Ready: true})
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		enc.Encode(append([]byte{execStderr}, err.Error()+"\n"...))
+		return enc.Encode(append([]byte{execStatus}, "127"...))
+	}
+	go func() {
+		// the dialer sends nothing more, the read ends when it is gone
+		io.Copy(ioutil.Discard, reader)
+		cmd.Process.Kill()
+	}()
+	code := 0
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	return enc.Encode(append([]byte{execStatus}, strconv.Itoa(code)...))
+}
+
+func (e *Exec) Response(ctx context.Context) error {
+	s, c := net.Pipe()
+	e.lock.Lock()
+	e.BaseImpl.conn = &c
+	e.lock.Unlock()
+	go func() {
+		err := e.doResponse(s)
+		if err != nil {
+			Log(e).Error("do response ", err)
+		}
+	}()
+	return nil
+}
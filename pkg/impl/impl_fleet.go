@@ -0,0 +1,204 @@
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// overlays are small, a larger answer is not an overlay
+const maxOverlaySize = 1 << 20
+
+// Fleet serves the configure overlay an admin device published to the
+// devices of its fleet. Overlays are signed, so any device may fetch them.
+type Fleet struct {
+	BaseImpl
+}
+
+func NewFleet(hostId string) *Fleet {
+	return &Fleet{
+		BaseImpl: *NewBaseImpl(hostId),
+	}
+}
+
+func (f *Fleet) Code() int32 {
+	return types.APP_TYPE_FLEET
+}
+
+func publishedOverlayFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "fleet_overlay.json")
+}
+
+// PublishOverlay makes this device serve a signed overlay to its fleet, the
+// overlay must be signed by the admin key of this device
+func PublishOverlay(data []byte) error {
+	pub, err := conf.AdminPublicKey()
+	if err != nil {
+		return err
+	}
+	_, err = conf.VerifyOverlay(pub, data)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(utils.GetSSHXStateHome(), 0700)
+	if err != nil {
+		return err
+	}
+	tmp := publishedOverlayFile() + ".new"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, publishedOverlayFile())
+}
+
+func (f *Fleet) Response(ctx context.Context) error {
+	data, err := ioutil.ReadFile(publishedOverlayFile())
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no fleet overlay published")
+	}
+	if err != nil {
+		return err
+	}
+	s, c := net.Pipe()
+	f.lock.Lock()
+	f.BaseImpl.conn = &c
+	f.lock.Unlock()
+	Log(f).Debug("serve fleet overlay to ", f.HostId())
+	go func() {
+		_, err := s.Write(data)
+		if err != nil {
+			Log(f).Debug("serve fleet overlay ", err)
+		}
+		s.Close()
+	}()
+	return nil
+}
+
+// fetchOverlay reads the signed overlay from the URL or the admin peer
+func fetchOverlay(rc conf.RemoteConf) ([]byte, error) {
+	var r io.Reader
+	if rc.URL != "" {
+		client := http.Client{Timeout: timeout}
+		resp, err := client.Get(rc.URL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetch %s: %s", rc.URL, resp.Status)
+		}
+		r = resp.Body
+	} else if rc.AdminPeer != "" {
+		conn, err := NewSender(NewFleet(rc.AdminPeer), types.OPTION_TYPE_UP).Send()
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		r = conn
+	} else {
+		return nil, fmt.Errorf("neither RemoteConf.URL nor RemoteConf.AdminPeer is set")
+	}
+	// the overlay is read as one JSON value, the channel may not report EOF
+	var raw json.RawMessage
+	err := json.NewDecoder(io.LimitReader(r, maxOverlaySize)).Decode(&raw)
+	if err != nil {
+		return nil, fmt.Errorf("read fleet overlay: %v", err)
+	}
+	return raw, nil
+}
+
+// PullOverlay fetches the fleet overlay and applies it if it is newer than
+// the applied one, it reports whether the configure changed
+func PullOverlay() (bool, error) {
+	cm, err := conf.Shared()
+	if err != nil {
+		return false, err
+	}
+	rc := cm.Conf.RemoteConf
+	if rc.PublicKey == "" {
+		return false, fmt.Errorf("RemoteConf.PublicKey is not set")
+	}
+	data, err := fetchOverlay(rc)
+	if err != nil {
+		return false, err
+	}
+	o, err := conf.VerifyOverlay(rc.PublicKey, data)
+	if err != nil {
+		return false, err
+	}
+	return cm.ApplyOverlay(o)
+}
+
+// RemoteSync applies the fleet overlay every RemoteConf.Interval
+type RemoteSync struct {
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewRemoteSync() *RemoteSync {
+	return &RemoteSync{
+		stop: make(chan struct{}),
+	}
+}
+
+// Run pulls the overlay until Close is called, it returns right away if
+// this device is not managed
+func (rs *RemoteSync) Run() {
+	cm, err := conf.Shared()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	rc := cm.Conf.RemoteConf
+	if rc.URL == "" && rc.AdminPeer == "" {
+		return
+	}
+	interval := time.Duration(rc.Interval) * time.Second
+	if interval <= 0 {
+		interval = 300 * time.Second
+	}
+	// the first pull waits for the daemon to accept connections
+	timer := time.NewTimer(10 * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case <-rs.stop:
+			return
+		case <-timer.C:
+			rs.pull()
+			timer.Reset(interval)
+		}
+	}
+}
+
+func (rs *RemoteSync) pull() {
+	changed, err := PullOverlay()
+	if err != nil {
+		logrus.Warn("fleet overlay ", err)
+		return
+	}
+	if changed {
+		logrus.Info("fleet overlay applied, restart the daemon to apply signaling and ICE settings")
+	}
+}
+
+func (rs *RemoteSync) Close() {
+	rs.once.Do(func() {
+		close(rs.stop)
+	})
+}
@@ -0,0 +1,225 @@
+package impl
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// ForwardRequest is sent by the dialer with the address to connect to, or
+// the endpoint registered by a process of the remote node
+type ForwardRequest struct {
+	Addr     string
+	Endpoint string
+}
+
+// ForwardReply tells the dialer whether the address is reached
+type ForwardReply struct {
+	Ready  bool
+	Error  string
+	Status int32
+}
+
+// Forward opens a TCP connection from a remote node to an address of its
+// network, allowed by the forwardconf of that node, or to an endpoint a
+// process of that node listens on
+type Forward struct {
+	BaseImpl
+	// request is sent over the connection, not to the daemon
+	request ForwardRequest
+}
+
+func NewForward(hostId, addr string) *Forward {
+	return &Forward{
+		BaseImpl: *NewBaseImpl(hostId),
+		request:  ForwardRequest{Addr: addr},
+	}
+}
+
+// NewEndpointForward connects to the endpoint name of the remote node, see
+// RegisterEndpoint
+func NewEndpointForward(hostId, name string) *Forward {
+	return &Forward{
+		BaseImpl: *NewBaseImpl(hostId),
+		request:  ForwardRequest{Endpoint: name},
+	}
+}
+
+func (f *Forward) Code() int32 {
+	return types.APP_TYPE_FORWARD
+}
+
+func forwardPeerAllowed(fc conf.ForwardConf, peerId string) error {
+	if !fc.Enabled {
+		return Denied(fmt.Errorf("forwarding is disabled"))
+	}
+	if len(fc.Peers) == 0 {
+		return nil
+	}
+	for _, v := range fc.Peers {
+		if v == peerId {
+			return nil
+		}
+	}
+	return Denied(fmt.Errorf("forwarding denied for %s", peerId))
+}
+
+// forwardTarget returns the address to dial for addr if an entry of allow
+// matches it. Names matched by a network are resolved here, so the address
+// dialed is the one checked.
+func forwardTarget(allow []string, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	host = strings.TrimSuffix(host, ".")
+	var ips []net.IP
+	resolved := false
+	for _, v := range allow {
+		ahost, aport, err := net.SplitHostPort(v)
+		if err != nil || (aport != "*" && aport != port) {
+			continue
+		}
+		_, network, err := net.ParseCIDR(ahost)
+		if err != nil {
+			if strings.EqualFold(strings.TrimSuffix(ahost, "."), host) {
+				return net.JoinHostPort(host, port), nil
+			}
+			continue
+		}
+		if !resolved {
+			resolved = true
+			if ip := net.ParseIP(host); ip != nil {
+				ips = []net.IP{ip}
+			} else {
+				ips, _ = net.LookupIP(host)
+			}
+		}
+		for _, ip := range ips {
+			if network.Contains(ip) {
+				return net.JoinHostPort(ip.String(), port), nil
+			}
+		}
+	}
+	return "", Denied(fmt.Errorf("%s is not allowed", addr))
+}
+
+// DialContext asks the daemon for a connection of the remote node to the
+// address or endpoint of f, ctx cancels the set up but not the connection
+func (f *Forward) DialContext(ctx context.Context) (net.Conn, error) {
+	sender := NewSender(f, types.OPTION_TYPE_UP)
+	if sender == nil {
+		return nil, fmt.Errorf("cannot encode the forward request")
+	}
+	conn, err := sender.SendContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var reply ForwardReply
+	reader := bufio.NewReader(conn)
+	err = utils.WithContext(ctx, conn, func() error {
+		err := gob.NewEncoder(conn).Encode(f.request)
+		if err != nil {
+			return err
+		}
+		return types.DecodeLimited(reader, MaxReplySize, &reply)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !reply.Ready {
+		conn.Close()
+		return nil, remoteError(reply.Status, "remote forward: "+reply.Error)
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+func (f *Forward) doResponse(ctx context.Context, c net.Conn) error {
+	defer c.Close()
+	enc := gob.NewEncoder(c)
+	var req ForwardRequest
+	err := types.DecodeLimited(c, MaxRequestSize, &req)
+	if err != nil {
+		return err
+	}
+	reject := func(err error) error {
+		enc.Encode(ForwardReply{Error: err.Error(), Status: ErrorStatus(err)})
+		return err
+	}
+	if req.Endpoint != "" {
+		return f.respondEndpoint(ctx, c, enc, req.Endpoint, reject)
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return reject(err)
+	}
+	fc := cm.Conf.ForwardConf
+	err = forwardPeerAllowed(fc, f.HostId())
+	if err != nil {
+		return reject(err)
+	}
+	addr, err := forwardTarget(fc.Allow, req.Addr)
+	if err != nil {
+		return reject(err)
+	}
+	Log(f).Debug("Dail ", addr, " for ", f.HostId())
+	d := net.Dialer{Timeout: timeout}
+	target, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return reject(err)
+	}
+	err = enc.Encode(ForwardReply{Ready: true})
+	if err != nil {
+		target.Close()
+		return err
+	}
+	return utils.Pipe(&c, &target)
+}
+
+// respondEndpoint connects c to the endpoint name, the process listening
+// on it accepts every peer this node accepts
+func (f *Forward) respondEndpoint(ctx context.Context, c net.Conn, enc *gob.Encoder, name string, reject func(error) error) error {
+	addr, err := endpointAddr(name)
+	if err != nil {
+		return reject(err)
+	}
+	Log(f).Debug("Dail endpoint ", name, " for ", f.HostId())
+	d := net.Dialer{Timeout: timeout}
+	target, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return reject(fmt.Errorf("endpoint %s: %v", name, err))
+	}
+	_, err = fmt.Fprintf(target, "%s%s\n", endpointHeader, f.HostId())
+	if err != nil {
+		target.Close()
+		return reject(fmt.Errorf("endpoint %s: %v", name, err))
+	}
+	err = enc.Encode(ForwardReply{Ready: true})
+	if err != nil {
+		target.Close()
+		return err
+	}
+	return utils.Pipe(&c, &target)
+}
+
+func (f *Forward) Response(ctx context.Context) error {
+	s, c := net.Pipe()
+	f.lock.Lock()
+	f.BaseImpl.conn = &c
+	f.lock.Unlock()
+	go func() {
+		err := f.doResponse(ctx, s)
+		if err != nil {
+			Log(f).Debug("forward closed: ", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,74 @@
+package impl
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// History queries the completed sessions the daemon recorded. It is not a
+// connection, peers refuse it.
+type History struct {
+	BaseImpl
+	// Peer and App select the sessions of a peer or an application, any if
+	// empty
+	Peer string
+	App  string
+	// Since selects the sessions which ended after it, any if zero
+	Since time.Time
+	// Limit is the maximum number of sessions answered, the newest first
+	Limit int
+}
+
+func NewHistory(hostId string) *History {
+	ret := &History{
+		BaseImpl: *NewBaseImpl(hostId),
+	}
+	ret.NoNeedConnect()
+	return ret
+}
+
+func (h *History) Code() int32 {
+	return types.APP_TYPE_HISTORY
+}
+
+func (h *History) Dial(ctx context.Context) error {
+	return fmt.Errorf("history is not a connection")
+}
+
+func (h *History) Response(ctx context.Context) error {
+	return fmt.Errorf("history is not a connection")
+}
+
+// Match reports whether a record is selected by the query
+func (h *History) Match(r types.HistoryRecord) bool {
+	if h.Peer != "" && r.TargetId != h.Peer {
+		return false
+	}
+	if h.App != "" && r.App != h.App {
+		return false
+	}
+	return h.Since.IsZero() || r.End.After(h.Since)
+}
+
+// RequestHistory sends a history query to the local daemon
+func RequestHistory(h *History) ([]types.HistoryRecord, error) {
+	sender := NewSender(h, types.OPTION_TYPE_HISTORY)
+	if sender == nil {
+		return nil, fmt.Errorf("cannot create sender")
+	}
+	conn, err := sender.Send()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var res []types.HistoryRecord
+	err = gob.NewDecoder(conn).Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
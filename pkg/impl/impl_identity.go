@@ -0,0 +1,115 @@
+package impl
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	IDENTITY_OP_REVOKE = iota
+	IDENTITY_OP_ROTATE
+	IDENTITY_OP_UNLOCK
+)
+
+// Identity asks the local daemon to revoke Peer, to rotate the keys of
+// this device or to unlock its key store. It is not a connection, peers
+// refuse it.
+type Identity struct {
+	BaseImpl
+	Op   int
+	Peer string
+	// Passphrase of the key store
+	Passphrase string
+}
+
+// IdentityResult is the answer of the daemon to an identity request
+type IdentityResult struct {
+	// Closed is the number of connections of the revoked peer closed
+	Closed int
+	// Fingerprint is the new node key
+	Fingerprint string
+	// Notified is the number of peers the rotation was sent to
+	Notified int
+	Error    string
+}
+
+func NewIdentity(hostId string) *Identity {
+	ret := &Identity{
+		BaseImpl: *NewBaseImpl(hostId),
+	}
+	ret.NoNeedConnect()
+	return ret
+}
+
+func (id *Identity) Code() int32 {
+	return types.APP_TYPE_IDENTITY
+}
+
+func (id *Identity) Dial(ctx context.Context) error {
+	return fmt.Errorf("identity is not a connection")
+}
+
+func (id *Identity) Response(ctx context.Context) error {
+	return fmt.Errorf("identity is not a connection")
+}
+
+func requestIdentity(id *Identity) (*IdentityResult, error) {
+	cm, err := conf.Shared()
+	if err != nil {
+		return nil, err
+	}
+	id.SetHostId(cm.Conf.ID)
+	sender := NewSender(id, types.OPTION_TYPE_IDENTITY)
+	if sender == nil {
+		return nil, fmt.Errorf("cannot create sender")
+	}
+	conn, err := sender.Send()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var res IdentityResult
+	err = gob.NewDecoder(conn).Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("%s", res.Error)
+	}
+	return &res, nil
+}
+
+// Revoke asks the daemon to revoke peerId and close its connections, it
+// returns the number of connections closed
+func Revoke(peerId string) (int, error) {
+	id := NewIdentity("")
+	id.Op = IDENTITY_OP_REVOKE
+	id.Peer = peerId
+	res, err := requestIdentity(id)
+	if err != nil {
+		return 0, err
+	}
+	return res.Closed, nil
+}
+
+// UnlockDaemon unlocks the key store of the daemon with a passphrase, or
+// the keychain if it is empty
+func UnlockDaemon(passphrase string) error {
+	id := NewIdentity("")
+	id.Op = IDENTITY_OP_UNLOCK
+	id.Passphrase = passphrase
+	_, err := requestIdentity(id)
+	return err
+}
+
+// Rotate asks the daemon to rotate the keys of this device and announce
+// them to its peers
+func Rotate() (*IdentityResult, error) {
+	id := NewIdentity("")
+	id.Op = IDENTITY_OP_ROTATE
+	return requestIdentity(id)
+}
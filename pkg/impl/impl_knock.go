@@ -0,0 +1,93 @@
+package impl
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"strings"
+
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// Knock lists the inbound sessions waiting for approval, or approves or
+// denies Request. It is not a connection, peers refuse it.
+type Knock struct {
+	BaseImpl
+	// Request to decide on, 0 lists the waiting ones
+	Request int64
+	// Allow approves Request, it is denied otherwise
+	Allow bool
+}
+
+func NewKnock(hostId string) *Knock {
+	ret := &Knock{
+		BaseImpl: *NewBaseImpl(hostId),
+	}
+	ret.NoNeedConnect()
+	return ret
+}
+
+func (k *Knock) Code() int32 {
+	return types.APP_TYPE_KNOCK
+}
+
+func (k *Knock) Dial(ctx context.Context) error {
+	return fmt.Errorf("knock is not a connection")
+}
+
+func (k *Knock) Response(ctx context.Context) error {
+	return fmt.Errorf("knock is not a connection")
+}
+
+// AppName returns the name of an application as KnockConf.Apps lists it,
+// empty for unknown codes
+func AppName(code int32) string {
+	if GetImpl(code) == nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimPrefix(GetImplName(code), "*"))
+}
+
+func requestKnock(k *Knock) ([]types.KnockRequest, error) {
+	sender := NewSender(k, types.OPTION_TYPE_KNOCK)
+	if sender == nil {
+		return nil, fmt.Errorf("cannot create sender")
+	}
+	conn, err := sender.Send()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var res types.KnockResult
+	err = gob.NewDecoder(conn).Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("%s", res.Error)
+	}
+	return res.Requests, nil
+}
+
+// ListKnocks returns the inbound sessions waiting for approval
+func ListKnocks() ([]types.KnockRequest, error) {
+	cm, err := conf.Shared()
+	if err != nil {
+		return nil, err
+	}
+	return requestKnock(NewKnock(cm.Conf.ID))
+}
+
+// DecideKnock approves or denies an inbound session waiting for approval
+func DecideKnock(id int64, allow bool) error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	k := NewKnock(cm.Conf.ID)
+	k.Request = id
+	k.Allow = allow
+	_, err = requestKnock(k)
+	return err
+}
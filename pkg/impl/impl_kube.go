@@ -0,0 +1,384 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// KubeRequest is sent by the dialer to describe the workload it wants to
+// reach, a port to forward or a command to run
+type KubeRequest struct {
+	Namespace string
+	// Target is a pod name, pod/NAME or svc/NAME
+	Target string
+	// Port is the port to forward, a port of the service for services
+	Port      int32
+	Exec      bool
+	Container string
+	Command   []string
+	TTY       bool
+}
+
+// KubeReply tells the dialer whether the stream is open
+type KubeReply struct {
+	Ready bool
+	Error string
+	// Pod is the pod the target resolved to
+	Pod  string
+	Port int32
+}
+
+// Kube reaches the workloads of the Kubernetes cluster of a remote node.
+// The remote node talks to its API server with its own credentials, so
+// the API server is never exposed. Port forwards listen on a local port
+// like RDP, exec sessions run on the terminal.
+type Kube struct {
+	BaseImpl
+	Request KubeRequest
+	// LocalPort is the local port of port forwards
+	LocalPort int32
+	Running   bool
+	listener  net.Listener
+	once      sync.Once
+}
+
+func NewKube(hostId string, req KubeRequest) *Kube {
+	return &Kube{
+		BaseImpl: *NewBaseImpl(hostId),
+		Request:  req,
+	}
+}
+
+func (k *Kube) Code() int32 {
+	return types.APP_TYPE_KUBE
+}
+
+func kubeAllowed(kc conf.KubeConf, peerId, namespace string) error {
+	if !kc.Enabled {
+		return fmt.Errorf("kubernetes access is disabled")
+	}
+	allowed := len(kc.Peers) == 0
+	for _, v := range kc.Peers {
+		allowed = allowed || v == peerId
+	}
+	if !allowed {
+		return fmt.Errorf("kubernetes access denied for %s", peerId)
+	}
+	allowed = len(kc.Namespaces) == 0
+	for _, v := range kc.Namespaces {
+		allowed = allowed || v == namespace
+	}
+	if !allowed {
+		return fmt.Errorf("namespace %s is not allowed", namespace)
+	}
+	return nil
+}
+
+// open sends the request over conn and waits for the stream, the returned
+// connection serves the bytes read ahead with the reply
+func (k *Kube) open(conn net.Conn) (net.Conn, KubeReply, error) {
+	var reply KubeReply
+	err := gob.NewEncoder(conn).Encode(k.Request)
+	if err != nil {
+		return nil, reply, err
+	}
+	reader := bufio.NewReader(conn)
+	err = types.DecodeLimited(reader, MaxReplySize, &reply)
+	if err != nil {
+		return nil, reply, err
+	}
+	if !reply.Ready {
+		return nil, reply, fmt.Errorf("remote kubernetes: %s", reply.Error)
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, reply, nil
+}
+
+// Listen opens the local port of a port forward, so a client can be
+// launched before Start
+func (k *Kube) Listen() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", k.LocalPort))
+	if err != nil {
+		return err
+	}
+	k.lock.Lock()
+	k.listener = listener
+	k.Running = true
+	k.lock.Unlock()
+	fmt.Printf("Forward %s:%d of %s at :%d\n", k.Request.Target, k.Request.Port, k.HostId(), listener.Addr().(*net.TCPAddr).Port)
+	return nil
+}
+
+// Start accepts connections until Close is called, every accepted connection
+// opens its own stream to the workload
+func (k *Kube) Start() error {
+	if k.listener == nil {
+		err := k.Listen()
+		if err != nil {
+			return err
+		}
+	}
+	listener := k.listener
+
+	for k.Running {
+		conn, err := listener.Accept()
+		if err != nil {
+			continue
+		}
+		go k.doDial(conn)
+	}
+	Log(k).Debug("Close kubernetes port forward for ", k.HostId())
+	return nil
+}
+
+func (k *Kube) doDial(inconn net.Conn) {
+	imp := &Kube{
+		BaseImpl: BaseImpl{
+			HId:        k.HostId(),
+			ConnectNow: true,
+		},
+		Request: k.Request,
+	}
+	imp.SetParentId(k.PairId())
+	sender := NewSender(imp, types.OPTION_TYPE_UP)
+	conn, err := sender.Send()
+	if err != nil {
+		Log(k).Error(err)
+		inconn.Close()
+		return
+	}
+	defer conn.Close()
+	conn, reply, err := imp.open(conn)
+	if err != nil {
+		Log(k).Error(err)
+		inconn.Close()
+		return
+	}
+	Log(k).Debugf("forward to %s:%d", reply.Pod, reply.Port)
+	utils.Pipe(&inconn, &conn)
+}
+
+// DoExec runs the command of the request over the connection set by
+// SetConn with the terminal as its stdin, stdout and stderr, it returns
+// the exit code of the command
+func (k *Kube) DoExec() (int, error) {
+	conn, _, err := k.open(k.Conn())
+	if err != nil {
+		return 0, err
+	}
+	return execTerminal(conn, k.Request.TTY, func(msg []byte) (int, error) {
+		var status kubeStatus
+		err := json.Unmarshal(msg, &status)
+		if err != nil {
+			return 0, err
+		}
+		if status.Status != "Success" && status.Reason != "NonZeroExitCode" {
+			return 0, fmt.Errorf("%s", status.Message)
+		}
+		return status.ExitCode(), nil
+	})
+}
+
+// kubeForwardStream reads and writes the data channel of a port forward
+type kubeForwardStream struct {
+	ws  *websocket.Conn
+	buf []byte
+	// prefix is the number of bytes left of the port number which starts
+	// every channel
+	prefix [2]int
+}
+
+func newKubeForwardStream(ws *websocket.Conn) *kubeForwardStream {
+	return &kubeForwardStream{ws: ws, prefix: [2]int{2, 2}}
+}
+
+func (ks *kubeForwardStream) Read(p []byte) (int, error) {
+	for len(ks.buf) == 0 {
+		_, msg, err := ks.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if len(msg) == 0 || msg[0] > 1 {
+			continue
+		}
+		ch, data := msg[0], msg[1:]
+		skip := ks.prefix[ch]
+		if skip > len(data) {
+			skip = len(data)
+		}
+		ks.prefix[ch] -= skip
+		data = data[skip:]
+		if ch == 1 && len(data) > 0 {
+			return 0, fmt.Errorf("port forward: %s", bytes.TrimSpace(data))
+		}
+		if ch == 0 {
+			ks.buf = data
+		}
+	}
+	n := copy(p, ks.buf)
+	ks.buf = ks.buf[n:]
+	return n, nil
+}
+
+func (ks *kubeForwardStream) Write(p []byte) (int, error) {
+	err := ks.ws.WriteMessage(websocket.BinaryMessage, append([]byte{0}, p...))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// kubeForward pipes s and the port forward, both are closed once either ends
+func kubeForward(s net.Conn, ws *websocket.Conn) error {
+	stream := newKubeForwardStream(ws)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := utils.Copy(s, stream, nil)
+		s.Close()
+		ws.Close()
+		errCh <- err
+	}()
+	_, err := utils.Copy(stream, s, nil)
+	s.Close()
+	ws.Close()
+	if err2 := <-errCh; err == nil {
+		err = err2
+	}
+	return err
+}
+
+// kubeRelay passes the messages of an exec session between the dialer on s
+// and the API server, both are closed once either ends
+func kubeRelay(s net.Conn, enc *gob.Encoder, dec *types.LimitedDecoder, ws *websocket.Conn) error {
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			var msg []byte
+			err := dec.Decode(&msg)
+			if err == nil {
+				err = ws.WriteMessage(websocket.BinaryMessage, msg)
+			}
+			if err != nil {
+				s.Close()
+				ws.Close()
+				errCh <- err
+				return
+			}
+		}
+	}()
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err == nil {
+			err = enc.Encode(msg)
+		}
+		if err != nil {
+			s.Close()
+			ws.Close()
+			<-errCh
+			if err == io.EOF || websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (k *Kube) doResponse(s net.Conn) error {
+	defer s.Close()
+	reader := bufio.NewReader(s)
+	enc := gob.NewEncoder(s)
+	dec := types.NewLimitedDecoder(reader, MaxStreamMessageSize)
+	var req KubeRequest
+	err := dec.Decode(&req)
+	if err != nil {
+		return err
+	}
+	reject := func(err error) error {
+		enc.Encode(KubeReply{Error: err.Error()})
+		return err
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return reject(err)
+	}
+	kc := cm.Conf.KubeConf
+	client, err := newKubeClient(kc)
+	if err != nil {
+		return reject(err)
+	}
+	namespace := client.Namespace(req.Namespace)
+	err = kubeAllowed(kc, k.HostId(), namespace)
+	if err != nil {
+		return reject(err)
+	}
+	if req.Exec && (!kc.Exec || k.readOnly) {
+		return reject(fmt.Errorf("exec is not allowed"))
+	}
+	pod, port, err := client.Resolve(namespace, req.Target, req.Port)
+	if err != nil {
+		return reject(err)
+	}
+	var ws *websocket.Conn
+	if req.Exec {
+		if len(req.Command) == 0 {
+			req.Command = []string{"sh"}
+		}
+		Log(k).Debugf("exec %v in %s/%s for %s", req.Command, namespace, pod, k.HostId())
+		ws, err = client.Exec(namespace, pod, req.Container, req.Command, req.TTY)
+	} else {
+		if port <= 0 {
+			return reject(fmt.Errorf("no port to forward"))
+		}
+		Log(k).Debugf("forward %s/%s:%d for %s", namespace, pod, port, k.HostId())
+		ws, err = client.PortForward(namespace, pod, port)
+	}
+	if err != nil {
+		return reject(err)
+	}
+	defer ws.Close()
+	err = enc.Encode(KubeReply{Ready: true, Pod: pod, Port: port})
+	if err != nil {
+		return err
+	}
+	if req.Exec {
+		return kubeRelay(s, enc, dec, ws)
+	}
+	return kubeForward(&bufferedConn{Conn: s, reader: reader}, ws)
+}
+
+func (k *Kube) Response(ctx context.Context) error {
+	s, c := net.Pipe()
+	k.lock.Lock()
+	k.BaseImpl.conn = &c
+	k.lock.Unlock()
+	go func() {
+		err := k.doResponse(s)
+		if err != nil {
+			Log(k).Error("do response ", err)
+		}
+	}()
+	return nil
+}
+
+func (k *Kube) Close() error {
+	k.once.Do(func() {
+		k.lock.Lock()
+		k.Running = false
+		if k.listener != nil {
+			k.listener.Close()
+		}
+		k.lock.Unlock()
+	})
+	return k.BaseImpl.Close()
+}
@@ -0,0 +1,215 @@
+package impl
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	// MESH_ROUTES asks a neighbor for the routes it advertises
+	MESH_ROUTES = iota
+	// MESH_DIAL opens a session through a neighbor
+	MESH_DIAL
+)
+
+// MeshRequest is sent by the dialer to a node of the mesh
+type MeshRequest struct {
+	Kind int32
+	// Target is the peer the session is for
+	Target string
+	// App, OTP and Id are the application, one-time code and pool id of
+	// the session
+	App int32
+	OTP string
+	Id  int64
+	// Path are the devices the session went through, its origin first
+	// and the device which sent the request last
+	Path []string
+}
+
+// MeshReply tells the dialer whether the session is set up, or the routes
+// of the neighbor
+type MeshReply struct {
+	Ready  bool
+	Error  string
+	Status int32
+	Routes []types.MeshRoute
+}
+
+// MeshRouter routes the sessions of the mesh, it is the mesh service of
+// the daemon
+type MeshRouter interface {
+	// Advertise returns the routes given to the neighbor peerId
+	Advertise(peerId string) []types.MeshRoute
+	// Relay carries the session of req, sent by peerId, to its target or
+	// to the next node of its route. reply answers peerId once the session
+	// is set up or failed. Relay owns conn.
+	Relay(ctx context.Context, peerId string, req MeshRequest, conn net.Conn, reply func(error) error)
+}
+
+var (
+	meshRouter MeshRouter
+	meshLock   sync.Mutex
+)
+
+// SetMeshRouter sets the router of the mesh sessions peers open with this
+// node, nil refuses them
+func SetMeshRouter(r MeshRouter) {
+	meshLock.Lock()
+	defer meshLock.Unlock()
+	meshRouter = r
+}
+
+func getMeshRouter() MeshRouter {
+	meshLock.Lock()
+	defer meshLock.Unlock()
+	return meshRouter
+}
+
+// Mesh asks a neighbor for its routes, or opens a session through it
+type Mesh struct {
+	BaseImpl
+	Request MeshRequest
+}
+
+func NewMesh(hostId string, req MeshRequest) *Mesh {
+	return &Mesh{
+		BaseImpl: *NewBaseImpl(hostId),
+		Request:  req,
+	}
+}
+
+func (m *Mesh) Code() int32 {
+	return types.APP_TYPE_MESH
+}
+
+// MeshAllowed checks the node relays and accepts the mesh sessions of
+// peerId
+func MeshAllowed(mc conf.MeshConf, peerId string) error {
+	if !mc.Enabled {
+		return Denied(fmt.Errorf("mesh routing is disabled"))
+	}
+	if len(mc.Peers) == 0 {
+		return nil
+	}
+	for _, v := range mc.Peers {
+		if v == peerId {
+			return nil
+		}
+	}
+	return Denied(fmt.Errorf("mesh routing denied for %s", peerId))
+}
+
+// DialMesh asks the daemon for a session with next, and sends req over it.
+// It returns the connection to the target of req once every node of the
+// route set it up, ctx cancels the set up but not the connection.
+func DialMesh(ctx context.Context, next string, req MeshRequest) (net.Conn, error) {
+	req.Kind = MESH_DIAL
+	conn, _, err := NewMesh(next, req).do(ctx)
+	return conn, err
+}
+
+// MeshRoutes asks the neighbor peerId for the routes it advertises
+func MeshRoutes(ctx context.Context, peerId string) ([]types.MeshRoute, error) {
+	conn, routes, err := NewMesh(peerId, MeshRequest{Kind: MESH_ROUTES}).do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return routes, nil
+}
+
+func (m *Mesh) do(ctx context.Context) (net.Conn, []types.MeshRoute, error) {
+	sender := NewSender(m, types.OPTION_TYPE_UP)
+	if sender == nil {
+		return nil, nil, fmt.Errorf("cannot encode the mesh request")
+	}
+	conn, err := sender.SendContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var reply MeshReply
+	reader := bufio.NewReader(conn)
+	err = utils.WithContext(ctx, conn, func() error {
+		err := gob.NewEncoder(conn).Encode(m.Request)
+		if err != nil {
+			return err
+		}
+		return types.DecodeLimited(reader, MaxReplySize, &reply)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if !reply.Ready {
+		conn.Close()
+		return nil, nil, remoteError(reply.Status, "remote mesh: "+reply.Error)
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, reply.Routes, nil
+}
+
+func (m *Mesh) doResponse(ctx context.Context, c net.Conn) error {
+	enc := gob.NewEncoder(c)
+	reader := bufio.NewReader(c)
+	var req MeshRequest
+	err := types.DecodeLimited(reader, MaxRequestSize, &req)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	reject := func(err error) error {
+		enc.Encode(MeshReply{Error: err.Error(), Status: ErrorStatus(err)})
+		c.Close()
+		return err
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return reject(err)
+	}
+	err = MeshAllowed(cm.Conf.MeshConf, m.HostId())
+	if err != nil {
+		return reject(err)
+	}
+	router := getMeshRouter()
+	if router == nil {
+		return reject(fmt.Errorf("mesh routing is not running"))
+	}
+	switch req.Kind {
+	case MESH_ROUTES:
+		err = enc.Encode(MeshReply{Ready: true, Routes: router.Advertise(m.HostId())})
+		c.Close()
+		return err
+	case MESH_DIAL:
+		router.Relay(ctx, m.HostId(), req, &bufferedConn{Conn: c, reader: reader}, func(err error) error {
+			if err != nil {
+				enc.Encode(MeshReply{Error: err.Error(), Status: ErrorStatus(err)})
+				return err
+			}
+			return enc.Encode(MeshReply{Ready: true})
+		})
+		return nil
+	}
+	return reject(fmt.Errorf("unknown mesh request %d", req.Kind))
+}
+
+func (m *Mesh) Response(ctx context.Context) error {
+	s, c := net.Pipe()
+	m.lock.Lock()
+	m.BaseImpl.conn = &c
+	m.lock.Unlock()
+	go func() {
+		err := m.doResponse(ctx, s)
+		if err != nil {
+			Log(m).Error("do response ", err)
+		}
+	}()
+	return nil
+}
@@ -1,6 +1,7 @@
 package impl
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
 	"io"
@@ -8,14 +9,32 @@ import (
 	"os"
 
 	"github.com/martinlindhe/notify"
-	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/types"
 	"golang.org/x/term"
 )
 
+const (
+	MESSAGE_TYPE_TEXT = iota
+	// MESSAGE_TYPE_RECEIPT confirms the message whose ID is the payload
+	MESSAGE_TYPE_RECEIPT
+	// a file named by the payload is offered, it is uploaded once accepted
+	MESSAGE_TYPE_FILE_OFFER
+	MESSAGE_TYPE_FILE_ACCEPT
+	MESSAGE_TYPE_FILE_REJECT
+	MESSAGE_TYPE_FILE_DONE
+)
+
 type Message struct {
 	Type    int32
 	Payload []byte
+	// Group is the message group a broadcast was sent to
+	Group string
+	// ID asks the receiver for a receipt, it is set for queued messages and
+	// identifies file offers
+	ID string
+	// Size of an offered file
+	Size int64
 }
 
 type Messager struct {
@@ -50,24 +69,52 @@ func (m *Messager) serveRecv() {
 	}
 	for {
 		var msg Message
-		logrus.Debug("waiting message")
-		err := gob.NewDecoder(m.attachConn).Decode(&msg)
-		logrus.Debug("waiting message ok")
+		Log(m).Debug("waiting message")
+		err := types.DecodeLimited(m.attachConn, MaxStreamMessageSize, &msg)
+		Log(m).Debug("waiting message ok")
 		if err != nil {
-			logrus.Error(err)
+			Log(m).Error(err)
 			m.Close()
 			return
 		}
-		logrus.Debug("message come ", string(msg.Payload))
+		Log(m).Debug("message come ", string(msg.Payload))
+		peerOnline(m.HostId())
+		if msg.Type == MESSAGE_TYPE_RECEIPT {
+			continue
+		}
+		if msg.Type == MESSAGE_TYPE_FILE_OFFER && !m.UIOpened {
+			notify.Notify("sshx", "file", fmt.Sprintf("%s wants to send %s", m.HostId(), msg.Payload), "")
+		}
+		if msg.Type != MESSAGE_TYPE_TEXT {
+			select {
+			case m.recvChan <- msg:
+			default:
+			}
+			continue
+		}
+		if msg.ID != "" {
+			select {
+			case m.sendChan <- Message{Type: MESSAGE_TYPE_RECEIPT, Payload: []byte(msg.ID)}:
+			default:
+			}
+			if seenMessage(msg.ID) {
+				continue
+			}
+		}
+		saveMessage(m.HostId(), false, string(msg.Payload))
 		if !m.UIOpened {
-			notify.Notify("sshx", "message", string(msg.Payload), "")
+			title := "message"
+			if msg.Group != "" {
+				title = "message to " + msg.Group
+			}
+			notify.Notify("sshx", title, string(msg.Payload), "")
 		}
 		select {
 		case m.recvChan <- msg:
-			logrus.Debug("push message to recv chan")
+			Log(m).Debug("push message to recv chan")
 		default:
 			<-m.recvChan
-			logrus.Warn("drop a message")
+			Log(m).Warn("drop a message")
 		}
 	}
 }
@@ -80,14 +127,14 @@ func (m *Messager) serveSend() {
 		msg := <-m.sendChan
 		err := gob.NewEncoder(m.attachConn).Encode(msg)
 		if err != nil {
-			logrus.Error(err)
+			Log(m).Error(err)
 			m.Close()
 			return
 		}
 	}
 }
 
-func (m *Messager) Response() error {
+func (m *Messager) Response(ctx context.Context) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	// a naive test code
@@ -95,12 +142,35 @@ func (m *Messager) Response() error {
 	c, s := net.Pipe()
 	m.attachConn = c
 	m.BaseImpl.conn = &s
-	go m.serveRecv()
-	go m.serveSend()
+	go m.serve()
 	return nil
 }
 
-func (m *Messager) Attach(conn net.Conn) error {
+// serve answers the key exchange of the peer before messages flow
+func (m *Messager) serve() {
+	conn, err := acceptMessageConn(m.HostId(), m.attachConn)
+	if err != nil {
+		Log(m).Error(err)
+		m.Close()
+		return
+	}
+	m.attachConn = conn
+	go m.serveSend()
+	m.serveRecv()
+}
+
+// Secure runs the key exchange on a connection dialed to the peer, messages
+// written to the returned connection are encrypted end to end
+func (m *Messager) Secure(conn net.Conn) (net.Conn, error) {
+	ret, err := messageHandshake(conn, conn, m.HostId(), true)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (m *Messager) Attach(ctx context.Context, conn net.Conn) error {
 	m.UIOpened = true
 	go func() {
 		for {
@@ -121,19 +191,24 @@ func (m *Messager) Attach(conn net.Conn) error {
 	go func() {
 		for {
 			var msg Message
-			err := gob.NewDecoder(conn).Decode(&msg)
+			err := types.DecodeLimited(conn, MaxStreamMessageSize, &msg)
 			if err != nil {
 				conn.Close()
 				m.Close()
 				return
 			}
+			if msg.Type == MESSAGE_TYPE_TEXT {
+				saveMessage(m.HostId(), true, string(msg.Payload))
+			}
 			m.sendChan <- msg
 		}
 	}()
 	return nil
 }
 
-func (m *Messager) OpenChatConsole(conn io.ReadWriteCloser) {
+// OpenChatConsole runs a chat with the peer on the terminal, record saves
+// the conversation for consoles the daemon doesn't save messages of
+func (m *Messager) OpenChatConsole(conn io.ReadWriteCloser, record bool) {
 	if conn == nil {
 		return
 	}
@@ -154,26 +229,34 @@ func (m *Messager) OpenChatConsole(conn io.ReadWriteCloser) {
 	term.SetPrompt(string(term.Escape.Red) + "> " + string(term.Escape.Reset))
 
 	rePrefix := string(term.Escape.Cyan) + m.HId + ":" + string(term.Escape.Reset)
+	m.showHistory(term, rePrefix)
+	files := newChatFiles(m.HId, conn, term)
 	m.isRuning = true
 	go func() {
 		// send
 		for m.isRuning {
 			line, err := term.ReadLine()
 			if err != nil {
-				logrus.Debug(err)
+				Log(m).Debug(err)
 				conn.Close()
 				return
 			}
+			if files.command(line) {
+				continue
+			}
 			var outMsg = Message{
 				Payload: []byte(line),
 			}
-			err = gob.NewEncoder(conn).Encode(outMsg)
+			err = files.send(outMsg)
 			if err != nil {
-				logrus.Debug(err)
+				Log(m).Debug(err)
 				conn.Close()
 				return
 			}
-			logrus.Debug("send to remote")
+			if record {
+				saveMessage(m.HId, true, line)
+			}
+			Log(m).Debug("send to remote")
 		}
 
 	}()
@@ -181,22 +264,56 @@ func (m *Messager) OpenChatConsole(conn io.ReadWriteCloser) {
 	// recieve
 	for m.isRuning {
 		var inMsg Message
-		err := gob.NewDecoder(conn).Decode(&inMsg)
+		err := types.DecodeLimited(conn, MaxStreamMessageSize, &inMsg)
 		if err != nil {
-			logrus.Debug(err)
+			Log(m).Debug(err)
 			conn.Close()
 			return
 		}
-		if err != nil {
-			logrus.Debug(err)
-			conn.Close()
-			return
+		if inMsg.Type == MESSAGE_TYPE_RECEIPT || files.handle(inMsg) {
+			continue
+		}
+		if record {
+			saveMessage(m.HId, false, string(inMsg.Payload))
+		}
+		if inMsg.Group != "" {
+			fmt.Fprintln(term, string(term.Escape.Cyan)+"["+inMsg.Group+"]"+string(term.Escape.Reset), rePrefix, string(inMsg.Payload))
+			continue
 		}
 		fmt.Fprintln(term, rePrefix, string(inMsg.Payload))
 	}
 }
 
-func (m *Messager) Close() {
+// showHistory prints the last messages exchanged with the peer
+func (m *Messager) showHistory(t *term.Terminal, rePrefix string) {
+	cm, err := conf.Shared()
+	if err != nil {
+		Log(m).Error(err)
+		return
+	}
+	mc := cm.Conf.MessageConf
+	if !mc.History {
+		return
+	}
+	limit := int(mc.HistoryLines)
+	if limit <= 0 {
+		limit = 20
+	}
+	entries, err := LoadHistory(m.HId, limit)
+	if err != nil {
+		Log(m).Error("message history ", err)
+		return
+	}
+	for _, v := range entries {
+		prefix := rePrefix
+		if v.Outgoing {
+			prefix = string(t.Escape.Red) + ">" + string(t.Escape.Reset)
+		}
+		fmt.Fprintln(t, string(t.Escape.Blue)+v.Time.Format("01-02 15:04")+string(t.Escape.Reset), prefix, v.Text)
+	}
+}
+
+func (m *Messager) Close() error {
 	m.isRuning = false
 	if m.conn != nil {
 		(*m.conn).Close()
@@ -206,7 +323,7 @@ func (m *Messager) Close() {
 	}
 	safeClose(m.recvChan)
 	safeClose(m.sendChan)
-	m.BaseImpl.Close()
+	return m.BaseImpl.Close()
 }
 
 func safeClose(ch chan Message) (justClosed bool) {
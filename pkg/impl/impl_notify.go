@@ -0,0 +1,183 @@
+package impl
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/martinlindhe/notify"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	// notifyMaxTitle and notifyMaxMessage bound the notifications, longer
+	// ones are cut
+	notifyMaxTitle   = 64
+	notifyMaxMessage = 512
+
+	// notifyWindow is the period conf.NotifyConf.Rate counts over
+	notifyWindow = time.Minute
+)
+
+// NotifyRequest is the notification the dialer pops on the desktop
+type NotifyRequest struct {
+	Title   string
+	Message string
+}
+
+// NotifyReply tells the dialer whether the notification was shown
+type NotifyReply struct {
+	Error string
+}
+
+// Notify pops a desktop notification on a remote node, as the alert of a
+// script on this one
+type Notify struct {
+	BaseImpl
+	Request NotifyRequest
+}
+
+func NewNotify(hostId string, req NotifyRequest) *Notify {
+	return &Notify{
+		BaseImpl: *NewBaseImpl(hostId),
+		Request:  req,
+	}
+}
+
+func (n *Notify) Code() int32 {
+	return types.APP_TYPE_NOTIFY
+}
+
+func notifyAllowed(nc conf.NotifyConf, peerId string) error {
+	if !nc.Enabled {
+		return fmt.Errorf("notifications are disabled")
+	}
+	if len(nc.Peers) == 0 {
+		return nil
+	}
+	for _, v := range nc.Peers {
+		if v == peerId {
+			return nil
+		}
+	}
+	return fmt.Errorf("notifications denied for %s", peerId)
+}
+
+// notifyLimiter counts the notifications of each peer over the last
+// notifyWindow
+type notifyLimiter struct {
+	lock sync.Mutex
+	sent map[string][]time.Time
+}
+
+var notifyLimits = &notifyLimiter{sent: make(map[string][]time.Time)}
+
+// allow records a notification of peerId and reports whether it is within
+// rate per notifyWindow, a rate under 1 allows every notification
+func (nl *notifyLimiter) allow(peerId string, rate int) bool {
+	if rate < 1 {
+		return true
+	}
+	nl.lock.Lock()
+	defer nl.lock.Unlock()
+	now := time.Now()
+	recent := nl.sent[peerId][:0]
+	for _, v := range nl.sent[peerId] {
+		if now.Sub(v) < notifyWindow {
+			recent = append(recent, v)
+		}
+	}
+	if len(recent) >= rate {
+		nl.sent[peerId] = recent
+		return false
+	}
+	nl.sent[peerId] = append(recent, now)
+	return true
+}
+
+// cutText trims s and cuts it to max bytes without splitting a character
+func cutText(s string, max int) string {
+	s = strings.TrimSpace(s)
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && (s[max]&0xc0) == 0x80 {
+		max--
+	}
+	return s[:max] + "…"
+}
+
+// Do sends the notification over the connection set by SetConn and waits
+// for the peer to show it
+func (n *Notify) Do() error {
+	err := gob.NewEncoder(n.Conn()).Encode(n.Request)
+	if err != nil {
+		return err
+	}
+	var reply NotifyReply
+	err = types.DecodeLimited(n.Conn(), MaxReplySize, &reply)
+	if err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("remote notify: %s", reply.Error)
+	}
+	return nil
+}
+
+func (n *Notify) doResponse(s net.Conn) error {
+	defer s.Close()
+	enc := gob.NewEncoder(s)
+	var req NotifyRequest
+	err := types.DecodeLimited(s, MaxRequestSize, &req)
+	if err != nil {
+		return err
+	}
+	reject := func(err error) error {
+		enc.Encode(NotifyReply{Error: err.Error()})
+		return err
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return reject(err)
+	}
+	nc := cm.Conf.NotifyConf
+	err = notifyAllowed(nc, n.HostId())
+	if err != nil {
+		return reject(err)
+	}
+	msg := cutText(req.Message, notifyMaxMessage)
+	if msg == "" {
+		return reject(fmt.Errorf("empty notification"))
+	}
+	if !notifyLimits.allow(n.HostId(), int(nc.Rate)) {
+		return reject(fmt.Errorf("more than %d notifications a minute", nc.Rate))
+	}
+	// the title names the peer, peers can't pass theirs for another one
+	title := cm.PeerName(n.HostId())
+	if t := cutText(req.Title, notifyMaxTitle); t != "" {
+		title += ": " + t
+	}
+	notify.Notify("sshx", title, msg, "")
+	Log(n).Info("notification from ", n.HostId(), ": ", title)
+	return enc.Encode(NotifyReply{})
+}
+
+func (n *Notify) Response(ctx context.Context) error {
+	s, c := net.Pipe()
+	n.lock.Lock()
+	n.BaseImpl.conn = &c
+	n.lock.Unlock()
+	go func() {
+		err := n.doResponse(s)
+		if err != nil {
+			Log(n).Error("do response ", err)
+		}
+	}()
+	return nil
+}
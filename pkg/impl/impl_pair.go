@@ -0,0 +1,146 @@
+package impl
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Pair asks the local daemon for a pairing code, or to pair with the host
+// using PairingCode. It is not a connection, peers refuse it.
+type Pair struct {
+	BaseImpl
+	// PairingCode given by the device to pair with
+	PairingCode string
+	// TTL of a new pairing code, in seconds
+	TTL int64
+	// TOTP enrolls the device pairing with a new code for TOTP codes
+	TOTP bool
+	// Name is the name this device asks the host to know it by, when
+	// PairingCode is a join token
+	Name string
+}
+
+func NewPair(hostId string) *Pair {
+	ret := &Pair{
+		BaseImpl: *NewBaseImpl(hostId),
+	}
+	ret.NoNeedConnect()
+	return ret
+}
+
+func (p *Pair) Code() int32 {
+	return types.APP_TYPE_PAIR
+}
+
+func (p *Pair) Dial(ctx context.Context) error {
+	return fmt.Errorf("pairing is not a connection")
+}
+
+func (p *Pair) Response(ctx context.Context) error {
+	return fmt.Errorf("pairing is not a connection")
+}
+
+// IdentityKey returns the public key identifying this device to its peers
+func IdentityKey() ([]byte, error) {
+	_, pub, err := loadMessageKey()
+	return pub, err
+}
+
+// KeyFingerprint returns the fingerprint of a public key as devices
+// compare them
+func KeyFingerprint(pub []byte) string {
+	return keyFingerprint(pub)
+}
+
+// PairingProof proves the sender knows the pairing code, it binds the code
+// to both devices and the keys exchanged so far
+func PairingProof(code, from, to string, keys ...[]byte) []byte {
+	mac := hmac.New(sha256.New, []byte(code))
+	mac.Write([]byte(from + "\x00" + to))
+	for _, v := range keys {
+		mac.Write(v)
+	}
+	return mac.Sum(nil)
+}
+
+// IsPaired reports whether the identity key of peerId is known
+func IsPaired(peerId string) bool {
+	messageKeysLock.Lock()
+	defer messageKeysLock.Unlock()
+	keys, err := loadPinnedKeys()
+	if err != nil {
+		logrus.Error(err)
+		return false
+	}
+	_, ok := keys[peerId]
+	return ok
+}
+
+// PairPeer pins the identity key of peerId, replacing the one it had
+func PairPeer(peerId string, pub []byte) error {
+	if len(pub) != curve25519.PointSize {
+		return fmt.Errorf("invalid identity key of %s", peerId)
+	}
+	messageKeysLock.Lock()
+	defer messageKeysLock.Unlock()
+	keys, err := loadPinnedKeys()
+	if err != nil {
+		return err
+	}
+	keys[peerId] = base64.StdEncoding.EncodeToString(pub)
+	logrus.Info("paired with ", peerId, " ", keyFingerprint(pub))
+	return savePinnedKeys(keys)
+}
+
+// requestPairing sends a pairing request to the local daemon
+func requestPairing(p *Pair) (*types.PairResult, error) {
+	sender := NewSender(p, types.OPTION_TYPE_PAIR)
+	if sender == nil {
+		return nil, fmt.Errorf("cannot create sender")
+	}
+	conn, err := sender.Send()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var res types.PairResult
+	err = gob.NewDecoder(conn).Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("%s", res.Error)
+	}
+	return &res, nil
+}
+
+// NewPairingCode asks the local daemon for a pairing code valid for ttl,
+// with totp the device pairing must give TOTP codes for its sessions
+func NewPairingCode(ttl time.Duration, totp bool) (*types.PairResult, error) {
+	cm, err := conf.Shared()
+	if err != nil {
+		return nil, err
+	}
+	// the code is made by this device
+	p := NewPair(cm.Conf.ID)
+	p.TTL = int64(ttl / time.Second)
+	p.TOTP = totp
+	return requestPairing(p)
+}
+
+// PairWith pairs with the device hostId using the pairing code it showed
+func PairWith(hostId, code string) (*types.PairResult, error) {
+	p := NewPair(hostId)
+	p.PairingCode = code
+	return requestPairing(p)
+}
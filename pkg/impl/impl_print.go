@@ -0,0 +1,318 @@
+package impl
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// printPorts are the default ports of the schemes of printer URIs
+var printPorts = map[string]int{
+	"ipp":    631,
+	"ipps":   631,
+	"lpd":    515,
+	"socket": 9100,
+}
+
+// PrintRequest is sent by the dialer to print to a printer of the remote
+// node. List asks for the printers instead.
+type PrintRequest struct {
+	List    bool
+	Printer string
+}
+
+// PrinterInfo is a printer of the remote node, URI is its URI on the local
+// port without host, as ipp:///ipp/print
+type PrinterInfo struct {
+	Name string
+	URI  string
+}
+
+// PrintReply tells the dialer whether the printer is reached
+type PrintReply struct {
+	Ready    bool
+	Error    string
+	Status   int32
+	Printers []PrinterInfo
+}
+
+// Print forwards a local TCP port to a printer of the network of a remote
+// node. The stream is not interpreted, so IPP, LPD and raw printing all
+// work with the URI of the printer pointed to the local port.
+type Print struct {
+	BaseImpl
+	Port     int32
+	Request  PrintRequest
+	Running  bool
+	listener net.Listener
+	once     sync.Once
+}
+
+func NewPrint(port int32, hostId string, req PrintRequest) *Print {
+	return &Print{
+		BaseImpl: *NewBaseImpl(hostId),
+		Port:     port,
+		Request:  req,
+	}
+}
+
+func (p *Print) Code() int32 {
+	return types.APP_TYPE_PRINT
+}
+
+func printAllowed(pc conf.PrintConf, peerId string) error {
+	if !pc.Enabled {
+		return Denied(fmt.Errorf("printing is disabled"))
+	}
+	if len(pc.Peers) == 0 {
+		return nil
+	}
+	for _, v := range pc.Peers {
+		if v == peerId {
+			return nil
+		}
+	}
+	return Denied(fmt.Errorf("printing denied for %s", peerId))
+}
+
+// parsePrinterURI returns the address of the printer at uri and its URI
+// without host
+func parsePrinterURI(uri string) (string, string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid printer URI %s: %v", uri, err)
+	}
+	port, ok := printPorts[u.Scheme]
+	if !ok || u.Hostname() == "" {
+		return "", "", fmt.Errorf("invalid printer URI %s, ipp://, ipps://, lpd:// or socket:// with a host", uri)
+	}
+	if u.Port() != "" {
+		port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return "", "", fmt.Errorf("invalid printer URI %s: %v", uri, err)
+		}
+	}
+	addr := net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+	uri = u.Scheme + "://" + u.EscapedPath()
+	if u.RawQuery != "" {
+		uri += "?" + u.RawQuery
+	}
+	return addr, uri, nil
+}
+
+// LocalURI returns the URI of the printer on the local port
+func (p *Print) LocalURI(info PrinterInfo) string {
+	u, err := url.Parse(info.URI)
+	if err != nil {
+		return ""
+	}
+	u.Host = fmt.Sprintf("127.0.0.1:%d", p.Port)
+	return u.String()
+}
+
+// open sends the request over conn and waits for the reply, the reader
+// holds what the printer sent after it
+func (p *Print) open(conn net.Conn, req PrintRequest) (*bufio.Reader, PrintReply, error) {
+	var reply PrintReply
+	err := gob.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return nil, reply, err
+	}
+	reader := bufio.NewReader(conn)
+	err = types.DecodeLimited(reader, MaxReplySize, &reply)
+	if err != nil {
+		return nil, reply, err
+	}
+	if !reply.Ready {
+		return nil, reply, remoteError(reply.Status, "remote printer: "+reply.Error)
+	}
+	return reader, reply, nil
+}
+
+// DoList returns the printers of the remote node the peer may print to,
+// over the connection set by SetConn
+func (p *Print) DoList() ([]PrinterInfo, error) {
+	_, reply, err := p.open(p.Conn(), PrintRequest{List: true})
+	return reply.Printers, err
+}
+
+// Listen opens the local port, so a print queue can be added before Start
+func (p *Print) Listen() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", p.Port))
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.listener = listener
+	p.Running = true
+	p.lock.Unlock()
+	return nil
+}
+
+// Start accepts connections until Close is called, every accepted
+// connection opens its own channel to the remote printer
+func (p *Print) Start() error {
+	if p.listener == nil {
+		err := p.Listen()
+		if err != nil {
+			return err
+		}
+	}
+	listener := p.listener
+
+	for p.Running {
+		conn, err := listener.Accept()
+		if err != nil {
+			continue
+		}
+		go p.doDial(conn)
+	}
+	Log(p).Debug("Close printer ", p.Request.Printer, " for ", p.HostId())
+	return nil
+}
+
+func (p *Print) doDial(inconn net.Conn) {
+	imp := &Print{
+		BaseImpl: BaseImpl{
+			HId:        p.HostId(),
+			ConnectNow: true,
+		},
+	}
+	imp.SetParentId(p.PairId())
+	sender := NewSender(imp, types.OPTION_TYPE_UP)
+	conn, err := sender.Send()
+	if err != nil {
+		Log(p).Error(err)
+		inconn.Close()
+		return
+	}
+	reader, _, err := p.open(conn, p.Request)
+	if err != nil {
+		Log(p).Error(err)
+		inconn.Close()
+		conn.Close()
+		return
+	}
+	conn = &bufferedConn{Conn: conn, reader: reader}
+	utils.Pipe(&inconn, &conn)
+}
+
+func (p *Print) doResponse(ctx context.Context, c net.Conn) error {
+	defer c.Close()
+	enc := gob.NewEncoder(c)
+	var req PrintRequest
+	err := types.DecodeLimited(c, MaxRequestSize, &req)
+	if err != nil {
+		return err
+	}
+	reject := func(err error) error {
+		enc.Encode(PrintReply{Error: err.Error(), Status: ErrorStatus(err)})
+		return err
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return reject(err)
+	}
+	pc := cm.Conf.PrintConf
+	err = printAllowed(pc, p.HostId())
+	if err != nil {
+		return reject(err)
+	}
+	if req.List {
+		reply := PrintReply{Ready: true}
+		for _, v := range pc.Printers {
+			_, uri, err := parsePrinterURI(v.URI)
+			if err == nil {
+				reply.Printers = append(reply.Printers, PrinterInfo{Name: v.Name, URI: uri})
+			}
+		}
+		return enc.Encode(reply)
+	}
+	var addr string
+	for _, v := range pc.Printers {
+		if v.Name == req.Printer {
+			addr, _, err = parsePrinterURI(v.URI)
+			if err != nil {
+				return reject(err)
+			}
+		}
+	}
+	if addr == "" {
+		return reject(fmt.Errorf("no printer %s", req.Printer))
+	}
+	Log(p).Debug("Dail printer ", req.Printer, " at ", addr)
+	d := net.Dialer{Timeout: timeout}
+	printer, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return reject(err)
+	}
+	err = enc.Encode(PrintReply{Ready: true})
+	if err != nil {
+		printer.Close()
+		return err
+	}
+	return utils.Pipe(&c, &printer)
+}
+
+func (p *Print) Response(ctx context.Context) error {
+	s, c := net.Pipe()
+	p.lock.Lock()
+	p.BaseImpl.conn = &c
+	p.lock.Unlock()
+	go func() {
+		err := p.doResponse(ctx, s)
+		if err != nil {
+			Log(p).Debug("print closed: ", err)
+		}
+	}()
+	return nil
+}
+
+func (p *Print) Close() error {
+	p.once.Do(func() {
+		p.lock.Lock()
+		p.Running = false
+		if p.listener != nil {
+			p.listener.Close()
+		}
+		p.lock.Unlock()
+	})
+	return p.BaseImpl.Close()
+}
+
+// AddPrintQueue adds the print queue name of CUPS for uri, IPP printers
+// are set up without driver, others print raw
+func AddPrintQueue(name, uri string) error {
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("add the printer %s in the settings of Windows", uri)
+	}
+	model := "raw"
+	if u, err := url.Parse(uri); err == nil && (u.Scheme == "ipp" || u.Scheme == "ipps") {
+		model = "everywhere"
+	}
+	out, err := exec.Command("lpadmin", "-p", name, "-E", "-v", uri, "-m", model).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("lpadmin: %v %s", err, out)
+	}
+	return nil
+}
+
+// RemovePrintQueue removes the print queue name of CUPS
+func RemovePrintQueue(name string) error {
+	out, err := exec.Command("lpadmin", "-x", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("lpadmin: %v %s", err, out)
+	}
+	return nil
+}
@@ -1,12 +1,13 @@
 package impl
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"time"
 
-	"github.com/sirupsen/logrus"
 	"github.com/suutaku/sshx/internal/utils"
-	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/types"
 )
 
@@ -15,6 +16,17 @@ type Proxy struct {
 	ProxyPort   int32
 	Running     bool
 	ProxyHostId string
+	// tunnels dialed ahead of the connections, oldest first
+	warm     chan warmTunnel
+	warmIdle time.Duration
+	taken    chan struct{}
+	listener net.Listener
+}
+
+// warmTunnel is a tunnel to the remote device waiting for a connection
+type warmTunnel struct {
+	conn net.Conn
+	at   time.Time
 }
 
 func NewProxy(port int32, host string) *Proxy {
@@ -24,43 +36,168 @@ func NewProxy(port int32, host string) *Proxy {
 	}
 }
 
+// SetWarm keeps n tunnels dialed ahead of the connections, each one is
+// dialed again after idle
+func (p *Proxy) SetWarm(n int, idle time.Duration) {
+	if n <= 0 {
+		p.warm = nil
+		return
+	}
+	p.warm = make(chan warmTunnel, n)
+	p.warmIdle = idle
+	p.taken = make(chan struct{}, 1)
+}
+
 func (p *Proxy) Code() int32 {
 	return types.APP_TYPE_PROXY
 }
 
-func (p *Proxy) Start() error {
-	conf.ClearKnownHosts(fmt.Sprintf("127.0.0.1:%d", p.ProxyPort))
-	p.Running = true
+// Listen opens the local port of the proxy, Start opens it if it isn't
+// open yet
+func (p *Proxy) Listen() error {
 	listenner, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", p.ProxyPort))
 	if err != nil {
 		return err
 	}
+	// Close unblocks Accept
+	p.lock.Lock()
+	p.listener = listenner
+	p.lock.Unlock()
+	return nil
+}
+
+// Start serves the local port until Close is called
+func (p *Proxy) Start() error {
+	clearKnownHosts(p.ProxyPort)
+	p.Running = true
+	p.lock.Lock()
+	listenner := p.listener
+	p.lock.Unlock()
+	if listenner == nil {
+		err := p.Listen()
+		if err != nil {
+			return err
+		}
+		listenner = p.listener
+	}
+	defer listenner.Close()
 	fmt.Println("Proxy for ", p.ProxyHostId, " at :", p.ProxyPort)
+	if p.warm != nil {
+		go p.keepWarm()
+	}
 
 	for p.Running {
 		conn, err := listenner.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
 			continue
 		}
 		// proxy.conn = &conn
 		go p.doDial(conn)
 
 	}
-	logrus.Debug("Close proxy for ", p.ProxyHostId)
+	Log(p).Debug("Close proxy for ", p.ProxyHostId)
 
 	return nil
 }
 
-func (p *Proxy) Response() error {
+func (p *Proxy) Response(ctx context.Context) error {
 	return nil
 }
 
-func (p *Proxy) Close() {
+func (p *Proxy) Close() error {
 	p.Running = false
-	logrus.Debug("close proxy impl")
+	p.lock.Lock()
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	p.lock.Unlock()
+	p.expire(0)
+	Log(p).Debug("close proxy impl")
+	return nil
+}
+
+// keepWarm dials tunnels until the pool is full, and again as they are
+// taken or get old
+func (p *Proxy) keepWarm() {
+	for p.Running {
+		if len(p.warm) < cap(p.warm) {
+			conn, err := p.dial()
+			if err != nil {
+				Log(p).Debug("warm tunnel: ", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			// only this loop adds tunnels, there is room
+			p.warm <- warmTunnel{conn: conn, at: time.Now()}
+			continue
+		}
+		timer := time.NewTimer(p.warmIdle / 4)
+		select {
+		case <-p.taken:
+		case <-timer.C:
+			p.expire(p.warmIdle)
+		}
+		timer.Stop()
+	}
+	p.expire(0)
+}
+
+// expire closes the warm tunnels dialed more than idle ago
+func (p *Proxy) expire(idle time.Duration) {
+	for i := len(p.warm); i > 0; i-- {
+		select {
+		case t := <-p.warm:
+			if idle > 0 && time.Since(t.at) < idle {
+				p.warm <- t
+				continue
+			}
+			t.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// take returns a warm tunnel, nil if there is none
+func (p *Proxy) take() net.Conn {
+	for {
+		select {
+		case t := <-p.warm:
+			if time.Since(t.at) >= p.warmIdle {
+				t.conn.Close()
+				continue
+			}
+			select {
+			case p.taken <- struct{}{}:
+			default:
+			}
+			return t.conn
+		default:
+			return nil
+		}
+	}
 }
 
 func (p *Proxy) doDial(inconn net.Conn) {
+	conn := p.take()
+	if conn == nil {
+		var err error
+		conn, err = p.dial()
+		if err != nil {
+			Log(p).Error(err)
+			inconn.Close()
+			return
+		}
+	}
+	defer conn.Close()
+	utils.Pipe(&inconn, &conn)
+}
+
+// dial asks the daemon for a tunnel to the ssh server of the remote device
+func (p *Proxy) dial() (net.Conn, error) {
 	imp := &SSH{
 		BaseImpl: BaseImpl{
 			HId:        p.ProxyHostId,
@@ -69,17 +206,5 @@ func (p *Proxy) doDial(inconn net.Conn) {
 	}
 	imp.SetParentId(p.PairId())
 	sender := NewSender(imp, types.OPTION_TYPE_UP)
-	conn, err := sender.Send()
-	if err != nil {
-		logrus.Error(err)
-		return
-	}
-	defer conn.Close()
-	// defer func() {
-	// 	conn.Close()
-	// 	closeSender := NewSender(imp, types.OPTION_TYPE_DOWN)
-	// 	closeSender.PairId = sender.PairId
-	// 	closeSender.SendDetach()
-	// }()
-	utils.Pipe(&inconn, &conn)
+	return sender.Send()
 }
@@ -0,0 +1,159 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+	"sync"
+
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// RDP forwards a local TCP port to the RDP server of a remote node. The
+// stream is not interpreted, so any RDP client and security mode works.
+type RDP struct {
+	BaseImpl
+	Port     int32
+	Running  bool
+	listener net.Listener
+	once     sync.Once
+}
+
+func NewRDP(port int32, hostId string) *RDP {
+	return &RDP{
+		BaseImpl: *NewBaseImpl(hostId),
+		Port:     port,
+	}
+}
+
+func (r *RDP) Code() int32 {
+	return types.APP_TYPE_RDP
+}
+
+func rdpAllowed(rc conf.RDPConf, peerId string) bool {
+	if !rc.Enabled {
+		return false
+	}
+	if len(rc.Peers) == 0 {
+		return true
+	}
+	for _, v := range rc.Peers {
+		if v == peerId {
+			return true
+		}
+	}
+	return false
+}
+
+// Listen opens the local port, so a client can be launched before Start
+func (r *RDP) Listen() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", r.Port))
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.listener = listener
+	r.Running = true
+	r.lock.Unlock()
+	fmt.Println("RDP for ", r.HostId(), " at :", r.Port)
+	return nil
+}
+
+// Start accepts connections until Close is called, every accepted connection
+// opens its own channel to the remote RDP server
+func (r *RDP) Start() error {
+	if r.listener == nil {
+		err := r.Listen()
+		if err != nil {
+			return err
+		}
+	}
+	listener := r.listener
+
+	for r.Running {
+		conn, err := listener.Accept()
+		if err != nil {
+			continue
+		}
+		go r.doDial(conn)
+	}
+	Log(r).Debug("Close rdp for ", r.HostId())
+	return nil
+}
+
+func (r *RDP) doDial(inconn net.Conn) {
+	imp := &RDP{
+		BaseImpl: BaseImpl{
+			HId:        r.HostId(),
+			ConnectNow: true,
+		},
+	}
+	imp.SetParentId(r.PairId())
+	sender := NewSender(imp, types.OPTION_TYPE_UP)
+	conn, err := sender.Send()
+	if err != nil {
+		Log(r).Error(err)
+		inconn.Close()
+		return
+	}
+	defer conn.Close()
+	utils.Pipe(&inconn, &conn)
+}
+
+func (r *RDP) Response(ctx context.Context) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	rc := cm.Conf.RDPConf
+	if !rdpAllowed(rc, r.HostId()) {
+		return fmt.Errorf("rdp access denied for %s", r.HostId())
+	}
+	Log(r).Debug("Dail local rdp server ", rc.Address)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", rc.Address)
+	if err != nil {
+		return err
+	}
+	r.BaseImpl.conn = &conn
+	return nil
+}
+
+func (r *RDP) Close() error {
+	r.once.Do(func() {
+		r.lock.Lock()
+		r.Running = false
+		if r.listener != nil {
+			r.listener.Close()
+		}
+		r.lock.Unlock()
+	})
+	return r.BaseImpl.Close()
+}
+
+// LaunchRDPClient opens the RDP client of the platform on the local port
+func LaunchRDPClient(port int32) error {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("mstsc", "/v:"+addr)
+	case "darwin":
+		cmd = exec.Command("open", "rdp://full%20address=s:"+addr)
+	default:
+		if path, err := exec.LookPath("xfreerdp"); err == nil {
+			cmd = exec.Command(path, "/v:"+addr, "/cert:ignore")
+		} else if path, err := exec.LookPath("remmina"); err == nil {
+			cmd = exec.Command(path, "-c", "rdp://"+addr)
+		} else {
+			return fmt.Errorf("no rdp client found, please install xfreerdp or remmina")
+		}
+	}
+	return cmd.Start()
+}
@@ -1,6 +1,7 @@
 package impl
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -32,7 +33,7 @@ func NewSCP(src, dest, ident string) *SCP {
 	return ret
 }
 
-func (s *SCP) Preper() error {
+func (s *SCP) Preper(ctx context.Context) error {
 	return nil
 }
 
@@ -40,28 +41,28 @@ func (s *SCP) Code() int32 {
 	return types.APP_TYPE_SCP
 }
 
-func (s *SCP) Dial() error {
+func (s *SCP) Dial(ctx context.Context) error {
 	ssht := NewSSH(s.TargetAddress, false, s.Identiry, false)
-	err := ssht.Preper()
+	err := ssht.Preper(ctx)
 	if err != nil {
-		logrus.Error(err)
+		Log(s).Error(err)
 		return err
 	}
 
 	sender := NewSender(ssht, types.OPTION_TYPE_UP)
 	conn, err := sender.Send()
 	if err != nil {
-		logrus.Error(err)
+		Log(s).Error(err)
 		return err
 	}
 
-	logrus.Debug("create scp conn from dal.conn")
+	Log(s).Debug("create scp conn from dal.conn")
 	ssht.config.Auth = append(ssht.config.Auth, ssh.RetryableAuthMethod(ssh.PasswordCallback(ssht.passwordCallback), NumberOfPrompts))
 	c, chans, reqs, err := ssh.NewClientConn(conn, "", &ssht.config)
 	if err != nil {
 		return err
 	}
-	logrus.Debug("conn ok")
+	Log(s).Debug("conn ok")
 	client := ssh.NewClient(c, chans, reqs)
 	if client == nil {
 		return fmt.Errorf("cannot create ssh client")
@@ -95,7 +96,7 @@ func (s *SCP) Dial() error {
 	}
 }
 
-func (s *SCP) Response() error {
+func (s *SCP) Response(ctx context.Context) error {
 	return nil
 }
 
@@ -0,0 +1,210 @@
+package impl
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// screenshotMinInterval bounds the rate of the streams of screenshots, they
+// are previews and not a VNC session
+const screenshotMinInterval = time.Second
+
+// maxScreenshotFrameSize bounds an encoded ScreenshotFrame, the JPEG of a
+// large screen at full quality
+const maxScreenshotFrameSize = 32 << 20
+
+// ScreenshotRequest is sent by the dialer to capture the desktop
+type ScreenshotRequest struct {
+	// Width scales the screenshots down to this width, 0 keeps the size
+	// of the screen
+	Width int32
+	// Quality is the JPEG quality from 1 to 100, 0 for the default
+	Quality int32
+	// Interval is the number of seconds between the screenshots of a
+	// stream, 0 asks for a single one
+	Interval int32
+}
+
+// ScreenshotReply tells the dialer whether the desktop is captured
+type ScreenshotReply struct {
+	Ready bool
+	Error string
+}
+
+// ScreenshotFrame is a screenshot of the desktop
+type ScreenshotFrame struct {
+	Time time.Time
+	// Width and Height are the size of the screen, the image is smaller
+	// if it was scaled down
+	Width  int32
+	Height int32
+	JPEG   []byte
+	// Error is set if the capture failed, the stream ends with it
+	Error string
+}
+
+// Screenshot captures the desktop of a remote node, once or at a low rate,
+// to check its state without a VNC session
+type Screenshot struct {
+	BaseImpl
+	Request ScreenshotRequest
+}
+
+func NewScreenshot(hostId string, req ScreenshotRequest) *Screenshot {
+	return &Screenshot{
+		BaseImpl: *NewBaseImpl(hostId),
+		Request:  req,
+	}
+}
+
+func (s *Screenshot) Code() int32 {
+	return types.APP_TYPE_SCREENSHOT
+}
+
+func screenshotAllowed(sc conf.ScreenshotConf, peerId string) error {
+	if !sc.Enabled {
+		return fmt.Errorf("screenshots are disabled")
+	}
+	if len(sc.Peers) == 0 {
+		return nil
+	}
+	for _, v := range sc.Peers {
+		if v == peerId {
+			return nil
+		}
+	}
+	return fmt.Errorf("screenshots denied for %s", peerId)
+}
+
+// DoCapture asks for the screenshots over the connection set by SetConn and
+// calls frame with each of them, until the stream ends, frame returns an
+// error or ctx is done
+func (s *Screenshot) DoCapture(ctx context.Context, frame func(ScreenshotFrame) error) error {
+	conn := s.Conn()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	err := gob.NewEncoder(conn).Encode(s.Request)
+	if err != nil {
+		return err
+	}
+	dec := types.NewLimitedDecoder(bufio.NewReader(conn), maxScreenshotFrameSize)
+	var reply ScreenshotReply
+	err = dec.Decode(&reply)
+	if err != nil {
+		return err
+	}
+	if !reply.Ready {
+		return fmt.Errorf("remote screenshot: %s", reply.Error)
+	}
+	for {
+		var f ScreenshotFrame
+		err = dec.Decode(&f)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if f.Error != "" {
+			return fmt.Errorf("remote screenshot: %s", f.Error)
+		}
+		err = frame(f)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Screenshot) doResponse(c net.Conn) error {
+	defer c.Close()
+	enc := gob.NewEncoder(c)
+	reader := bufio.NewReader(c)
+	var req ScreenshotRequest
+	err := types.DecodeLimited(reader, MaxRequestSize, &req)
+	if err != nil {
+		return err
+	}
+	reject := func(err error) error {
+		enc.Encode(ScreenshotReply{Error: err.Error()})
+		return err
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return reject(err)
+	}
+	err = screenshotAllowed(cm.Conf.ScreenshotConf, s.HostId())
+	if err != nil {
+		return reject(err)
+	}
+	quality := int(req.Quality)
+	if quality < 1 || quality > 100 {
+		quality = jpeg.DefaultQuality
+	}
+	interval := time.Duration(req.Interval) * time.Second
+	if interval > 0 && interval < screenshotMinInterval {
+		interval = screenshotMinInterval
+	}
+	err = enc.Encode(ScreenshotReply{Ready: true})
+	if err != nil {
+		return err
+	}
+	gone := make(chan struct{})
+	go func() {
+		// the dialer sends nothing more, the read ends when it is gone
+		io.Copy(ioutil.Discard, reader)
+		close(gone)
+	}()
+	Log(s).Debugf("screenshots for %s every %s", s.HostId(), interval)
+	for {
+		f := ScreenshotFrame{Time: time.Now()}
+		data, bounds, err := encodeScreenshot(int(req.Width), quality)
+		if err != nil {
+			f.Error = err.Error()
+		} else {
+			f.JPEG, f.Width, f.Height = data, int32(bounds.Dx()), int32(bounds.Dy())
+		}
+		err = enc.Encode(f)
+		if err != nil || f.Error != "" || interval == 0 {
+			return err
+		}
+		select {
+		case <-gone:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (s *Screenshot) Response(ctx context.Context) error {
+	sc, c := net.Pipe()
+	s.lock.Lock()
+	s.BaseImpl.conn = &c
+	s.lock.Unlock()
+	go func() {
+		err := s.doResponse(sc)
+		if err != nil {
+			Log(s).Error("do response ", err)
+		}
+	}()
+	return nil
+}
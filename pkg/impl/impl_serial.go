@@ -0,0 +1,288 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/suutaku/sshx/internal/serial"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+	"golang.org/x/term"
+)
+
+// serialEscape ends a console, it is ctrl-]
+const serialEscape = 0x1d
+
+// SerialRequest is sent by the dialer to open a serial device, a zero
+// Baud is the default speed of the remote node. List asks for the devices
+// instead.
+type SerialRequest struct {
+	List   bool
+	Device string
+	Mode   serial.Mode
+}
+
+// SerialReply tells the dialer whether the device is open
+type SerialReply struct {
+	Ready bool
+	Error string
+	Mode  serial.Mode
+	// ReadOnly is set when the input of the dialer is dropped
+	ReadOnly bool
+	Devices  []string
+}
+
+// devices open by consoles, a device is open by one console at a time
+var (
+	serialLock sync.Mutex
+	serialOpen = make(map[string]bool)
+)
+
+// Serial bridges a serial device of a remote node, as the console of a
+// board wired to it, to the terminal
+type Serial struct {
+	BaseImpl
+	Request SerialRequest
+}
+
+func NewSerial(hostId string, req SerialRequest) *Serial {
+	return &Serial{
+		BaseImpl: *NewBaseImpl(hostId),
+		Request:  req,
+	}
+}
+
+func (s *Serial) Code() int32 {
+	return types.APP_TYPE_SERIAL
+}
+
+// serialAllowed checks a peer may open a device, device is a clean path
+func serialAllowed(sc conf.SerialConf, peerId, device string) error {
+	if !sc.Enabled {
+		return fmt.Errorf("serial consoles are disabled")
+	}
+	allowed := len(sc.Peers) == 0
+	for _, v := range sc.Peers {
+		allowed = allowed || v == peerId
+	}
+	if !allowed {
+		return fmt.Errorf("serial access denied for %s", peerId)
+	}
+	if len(sc.Devices) == 0 {
+		if strings.HasPrefix(device, "/dev/tty") || strings.HasPrefix(device, "/dev/cu.") {
+			return nil
+		}
+	}
+	for _, v := range sc.Devices {
+		if filepath.Clean(v) == device {
+			return nil
+		}
+	}
+	return fmt.Errorf("device %s is not allowed", device)
+}
+
+// serialDevices lists the serial devices of this node
+func serialDevices() []string {
+	var ret []string
+	for _, pattern := range []string{"/dev/serial/by-id/*", "/dev/ttyUSB*", "/dev/ttyACM*", "/dev/ttyAMA*", "/dev/ttyS*", "/dev/cu.*"} {
+		matches, _ := filepath.Glob(pattern)
+		ret = append(ret, matches...)
+	}
+	return ret
+}
+
+// open sends the request over the connection set by SetConn and waits for
+// the reply
+func (s *Serial) open() (*bufio.Reader, SerialReply, error) {
+	var reply SerialReply
+	err := gob.NewEncoder(s.Conn()).Encode(s.Request)
+	if err != nil {
+		return nil, reply, err
+	}
+	reader := bufio.NewReader(s.Conn())
+	err = types.DecodeLimited(reader, MaxReplySize, &reply)
+	if err != nil {
+		return nil, reply, err
+	}
+	if !reply.Ready {
+		return nil, reply, fmt.Errorf("remote serial: %s", reply.Error)
+	}
+	return reader, reply, nil
+}
+
+// DoList returns the serial devices of the remote node the peer may open
+func (s *Serial) DoList() ([]string, error) {
+	s.Request.List = true
+	_, reply, err := s.open()
+	return reply.Devices, err
+}
+
+// DoConsole bridges the device to the terminal until ctrl-] is typed or
+// the remote node closes the device
+func (s *Serial) DoConsole() error {
+	conn := s.Conn()
+	reader, reply, err := s.open()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Connected to %s of %s at %s, ctrl-] to quit\n", s.Request.Device, s.HostId(), reply.Mode)
+	if reply.ReadOnly {
+		fmt.Println("Read only, the input is dropped")
+	}
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+	}
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(os.Stdout, reader)
+		done <- err
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if i := bytes.IndexByte(buf[:n], serialEscape); i >= 0 {
+				conn.Write(buf[:i])
+				done <- nil
+				return
+			}
+			if n > 0 {
+				_, werr := conn.Write(buf[:n])
+				if werr != nil {
+					done <- werr
+					return
+				}
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	err = <-done
+	conn.Close()
+	fmt.Print("\r\n")
+	return err
+}
+
+func (s *Serial) doResponse(c net.Conn) error {
+	defer c.Close()
+	enc := gob.NewEncoder(c)
+	reader := bufio.NewReader(c)
+	var req SerialRequest
+	err := types.DecodeLimited(reader, MaxRequestSize, &req)
+	if err != nil {
+		return err
+	}
+	reject := func(err error) error {
+		enc.Encode(SerialReply{Error: err.Error()})
+		return err
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return reject(err)
+	}
+	sc := cm.Conf.SerialConf
+	if req.List {
+		reply := SerialReply{Ready: true}
+		for _, v := range serialDevices() {
+			target, err := filepath.EvalSymlinks(v)
+			if err != nil {
+				continue
+			}
+			if serialAllowed(sc, s.HostId(), v) == nil || serialAllowed(sc, s.HostId(), target) == nil {
+				reply.Devices = append(reply.Devices, v)
+			}
+		}
+		return enc.Encode(reply)
+	}
+	// links as /dev/serial/by-id are allowed by their target
+	device, err := filepath.EvalSymlinks(filepath.Clean(req.Device))
+	if err != nil {
+		return reject(err)
+	}
+	err = serialAllowed(sc, s.HostId(), filepath.Clean(req.Device))
+	if err != nil && device != filepath.Clean(req.Device) {
+		err = serialAllowed(sc, s.HostId(), device)
+	}
+	if err != nil {
+		return reject(err)
+	}
+	mode := req.Mode
+	if mode.Baud == 0 {
+		mode.Baud = int(sc.Baud)
+	}
+	if mode.DataBits == 0 {
+		mode.DataBits, mode.Parity, mode.StopBits = 8, 'N', 1
+	}
+	serialLock.Lock()
+	busy := serialOpen[device]
+	serialOpen[device] = true
+	serialLock.Unlock()
+	if busy {
+		return reject(fmt.Errorf("%s is open by another console", req.Device))
+	}
+	defer func() {
+		serialLock.Lock()
+		delete(serialOpen, device)
+		serialLock.Unlock()
+	}()
+	file, err := serial.Open(device, mode)
+	if err != nil {
+		return reject(err)
+	}
+	defer file.Close()
+	Log(s).Debug("open ", device, " at ", mode, " for ", s.HostId())
+	err = enc.Encode(SerialReply{Ready: true, Mode: mode, ReadOnly: s.readOnly})
+	if err != nil {
+		return err
+	}
+	var input io.Writer = file
+	if s.readOnly {
+		input = ioutil.Discard
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := utils.Copy(input, reader, nil)
+		file.Close()
+		c.Close()
+		errCh <- err
+	}()
+	_, err = utils.Copy(c, file, nil)
+	file.Close()
+	c.Close()
+	if err2 := <-errCh; err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (s *Serial) Response(ctx context.Context) error {
+	p, c := net.Pipe()
+	s.lock.Lock()
+	s.BaseImpl.conn = &c
+	s.lock.Unlock()
+	go func() {
+		err := s.doResponse(p)
+		if err != nil {
+			Log(s).Debug("serial console closed: ", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,600 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/suutaku/sshx/internal/pty"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+	"golang.org/x/term"
+)
+
+const (
+	// shellDetach detaches from a session, it is ctrl-]
+	shellDetach = 0x1d
+	// shellDefault is the name of sessions started without one
+	shellDefault = "default"
+	// shellRedial is the delay between the attempts to attach again
+	shellRedial = 2 * time.Second
+)
+
+// ErrDetached is returned by DoShell when the client detached from the
+// session, which keeps running
+var ErrDetached = errors.New("detached")
+
+// ShellRequest is sent by the dialer to start or attach to a session, to
+// end one or to list them
+type ShellRequest struct {
+	List bool
+	Kill bool
+	// Name names the session among the ones of the dialer, default if
+	// empty
+	Name string
+	// Attach only attaches to a running session, the session is started
+	// if there is none otherwise
+	Attach bool
+	// Command of a new session, shellconf.shell of the remote node if
+	// empty
+	Command []string
+	// Term is the TERM of the terminal of the dialer
+	Term string
+}
+
+// ShellReply tells the dialer whether it is attached to the session
+type ShellReply struct {
+	Ready    bool
+	Error    string
+	Sessions []types.ShellSession
+	// Started is set if the session was started by the request
+	Started bool
+	// ReadOnly is set when the input of the dialer is dropped
+	ReadOnly bool
+}
+
+// Shell runs a shell on a pseudo terminal of a remote node which outlives
+// its connections, as a tmux session: the client detaches or loses the
+// connection, the command keeps running and the client attaches again to
+// get the output it missed
+type Shell struct {
+	BaseImpl
+	Request ShellRequest
+}
+
+func NewShell(hostId string, req ShellRequest) *Shell {
+	return &Shell{
+		BaseImpl: *NewBaseImpl(hostId),
+		Request:  req,
+	}
+}
+
+func (s *Shell) Code() int32 {
+	return types.APP_TYPE_SHELL
+}
+
+// Persistent tells the daemon to reach the session over a new connection
+// for OPTION_TYPE_ATTACH
+func (s *Shell) Persistent() bool {
+	return true
+}
+
+func shellAllowed(sc conf.ShellConf, peerId string) error {
+	if !sc.Enabled {
+		return fmt.Errorf("shell sessions are disabled")
+	}
+	if len(sc.Peers) == 0 {
+		return nil
+	}
+	for _, v := range sc.Peers {
+		if v == peerId {
+			return nil
+		}
+	}
+	return fmt.Errorf("shell access denied for %s", peerId)
+}
+
+// shellClient is the connection of the client attached to a session
+type shellClient struct {
+	conn net.Conn
+	enc  *gob.Encoder
+}
+
+// shellSession is a command running on a pseudo terminal for a peer
+type shellSession struct {
+	peer    string
+	name    string
+	command string
+	started time.Time
+	cmd     *exec.Cmd
+	pty     *os.File
+
+	// lock guards client, which is closed without waiting for a write,
+	// and exited
+	lock   sync.Mutex
+	client *shellClient
+	exited bool
+	// wlock guards the output, its writes and the exit code
+	wlock      sync.Mutex
+	writer     *shellClient
+	scrollback []byte
+	limit      int
+	code       int
+}
+
+// sessions of the peers by peer and name
+var (
+	shellLock     sync.Mutex
+	shellSessions = make(map[string]*shellSession)
+)
+
+func shellKey(peer, name string) string {
+	return peer + "/" + name
+}
+
+// startShell runs command for peer as the session name
+func startShell(peer, name string, command []string, termName string, limit int) (*shellSession, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), "TERM="+termName)
+	if home, err := os.UserHomeDir(); err == nil {
+		cmd.Dir = home
+	}
+	master, err := pty.Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+	ss := &shellSession{
+		peer:    peer,
+		name:    name,
+		command: strings.Join(command, " "),
+		started: time.Now(),
+		cmd:     cmd,
+		pty:     master,
+		limit:   limit,
+	}
+	go ss.run()
+	return ss, nil
+}
+
+// run reads the output of the command until it exits
+func (ss *shellSession) run() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := ss.pty.Read(buf)
+		if n > 0 {
+			ss.output(buf[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+	ss.pty.Close()
+	code := 0
+	err := ss.cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	}
+	ss.wlock.Lock()
+	defer ss.wlock.Unlock()
+	ss.lock.Lock()
+	ss.exited = true
+	ss.lock.Unlock()
+	ss.code = code
+	if ss.writer != nil {
+		ss.end(ss.writer)
+	}
+}
+
+// output keeps b in the scrollback and passes it to the attached client
+func (ss *shellSession) output(b []byte) {
+	ss.wlock.Lock()
+	defer ss.wlock.Unlock()
+	ss.scrollback = append(ss.scrollback, b...)
+	if over := len(ss.scrollback) - ss.limit; over > 0 {
+		ss.scrollback = append(ss.scrollback[:0], ss.scrollback[over:]...)
+	}
+	if ss.writer == nil {
+		return
+	}
+	err := ss.writer.enc.Encode(append([]byte{execStdout}, b...))
+	if err != nil {
+		ss.detach(ss.writer)
+		ss.writer.conn.Close()
+		ss.writer = nil
+	}
+}
+
+// end sends the exit code to client and forgets the session, wlock is held
+func (ss *shellSession) end(client *shellClient) {
+	client.enc.Encode(append([]byte{execStatus}, strconv.Itoa(ss.code)...))
+	client.conn.Close()
+	ss.writer = nil
+	shellLock.Lock()
+	if shellSessions[shellKey(ss.peer, ss.name)] == ss {
+		delete(shellSessions, shellKey(ss.peer, ss.name))
+	}
+	shellLock.Unlock()
+}
+
+// attach replaces the attached client by client, which gets the scrollback
+// first
+func (ss *shellSession) attach(client *shellClient) error {
+	ss.lock.Lock()
+	old := ss.client
+	ss.client = client
+	ss.lock.Unlock()
+	if old != nil {
+		// unblocks a write to a client which is gone
+		old.conn.Close()
+	}
+	ss.wlock.Lock()
+	defer ss.wlock.Unlock()
+	if len(ss.scrollback) > 0 {
+		err := client.enc.Encode(append([]byte{execStdout}, ss.scrollback...))
+		if err != nil {
+			return err
+		}
+	}
+	ss.lock.Lock()
+	exited := ss.exited
+	ss.lock.Unlock()
+	if exited {
+		ss.end(client)
+		return nil
+	}
+	ss.writer = client
+	return nil
+}
+
+// detach forgets client if it is the attached one
+func (ss *shellSession) detach(client *shellClient) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if ss.client == client {
+		ss.client = nil
+	}
+}
+
+// kill hangs the terminal up, which ends the command, and forgets the
+// session
+func (ss *shellSession) kill() {
+	shellLock.Lock()
+	if shellSessions[shellKey(ss.peer, ss.name)] == ss {
+		delete(shellSessions, shellKey(ss.peer, ss.name))
+	}
+	shellLock.Unlock()
+	ss.pty.Close()
+	ss.cmd.Process.Kill()
+}
+
+func (ss *shellSession) status() types.ShellSession {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return types.ShellSession{
+		Name:     ss.name,
+		Command:  ss.command,
+		Started:  ss.started,
+		Attached: ss.client != nil,
+		Exited:   ss.exited,
+	}
+}
+
+// open sends the request over conn and waits for the reply
+func (s *Shell) open(conn net.Conn) (*bufio.Reader, ShellReply, error) {
+	var reply ShellReply
+	err := gob.NewEncoder(conn).Encode(s.Request)
+	if err != nil {
+		return nil, reply, err
+	}
+	reader := bufio.NewReader(conn)
+	err = types.DecodeLimited(reader, MaxReplySize, &reply)
+	if err != nil {
+		return nil, reply, err
+	}
+	if !reply.Ready {
+		return nil, reply, fmt.Errorf("remote shell: %s", reply.Error)
+	}
+	return reader, reply, nil
+}
+
+// DoList returns the sessions the peer has on the remote node
+func (s *Shell) DoList() ([]types.ShellSession, error) {
+	s.Request.List = true
+	_, reply, err := s.open(s.Conn())
+	return reply.Sessions, err
+}
+
+// DoKill ends the session of the request
+func (s *Shell) DoKill() error {
+	s.Request.Kill = true
+	_, _, err := s.open(s.Conn())
+	return err
+}
+
+// DoShell attaches the terminal to the session of the request over the
+// connection set by SetConn, until the command exits or ctrl-] is typed.
+// If the connection is lost, redial gives a new one to attach again, the
+// session ends then if redial is nil. It returns the exit code of the
+// command, or ErrDetached.
+func (s *Shell) DoShell(redial func() (net.Conn, error)) (int, error) {
+	if s.Request.Term == "" {
+		s.Request.Term = os.Getenv("TERM")
+	}
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return 0, err
+		}
+		defer term.Restore(fd, state)
+	}
+	// the terminal is read once for every connection
+	input := make(chan []byte)
+	detached := make(chan struct{})
+	go func() {
+		defer close(input)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if i := bytes.IndexByte(buf[:n], shellDetach); i >= 0 {
+				input <- append([]byte(nil), buf[:i]...)
+				close(detached)
+				return
+			}
+			if n > 0 {
+				input <- append([]byte(nil), buf[:n]...)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	conn := s.Conn()
+	for {
+		code, lost, err := s.attachTerminal(conn, input, detached)
+		if !lost || redial == nil {
+			return code, err
+		}
+		fmt.Printf("\r\n[%v, attaching again]\r\n", err)
+		s.Request.Attach = true
+		for {
+			conn, err = redial()
+			if err == nil {
+				break
+			}
+			if errors.Is(err, ErrDenied) {
+				return 0, err
+			}
+			select {
+			case <-detached:
+				return 0, ErrDetached
+			case <-time.After(shellRedial):
+			}
+		}
+		s.SetConn(conn)
+	}
+}
+
+// attachTerminal passes the terminal to the session over conn until it
+// ends, lost is set if the connection ended first
+func (s *Shell) attachTerminal(conn net.Conn, input <-chan []byte, detached <-chan struct{}) (code int, lost bool, err error) {
+	defer conn.Close()
+	reader, reply, err := s.open(conn)
+	if err != nil {
+		// a session which is gone would be refused the same again
+		return 0, reply.Error == "", err
+	}
+	if reply.Started {
+		fmt.Printf("Started session %s on %s, ctrl-] to detach\r\n", s.name(), s.HostId())
+	}
+	if reply.ReadOnly {
+		fmt.Print("Read only, the input is dropped\r\n")
+	}
+	enc := gob.NewEncoder(conn)
+	w, h, err := term.GetSize(int(os.Stdin.Fd()))
+	if err == nil {
+		size, _ := json.Marshal(execSize{w, h})
+		enc.Encode(append([]byte{execResize}, size...))
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case b, ok := <-input:
+				if !ok {
+					return
+				}
+				if len(b) > 0 && enc.Encode(append([]byte{execStdin}, b...)) != nil {
+					return
+				}
+			case <-detached:
+				conn.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	dec := types.NewLimitedDecoder(reader, MaxStreamMessageSize)
+	for {
+		var msg []byte
+		err := dec.Decode(&msg)
+		if err != nil {
+			select {
+			case <-detached:
+				return 0, false, ErrDetached
+			default:
+			}
+			return 0, true, fmt.Errorf("connection lost: %v", err)
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		switch msg[0] {
+		case execStdout:
+			os.Stdout.Write(msg[1:])
+		case execStatus:
+			code, err = strconv.Atoi(string(msg[1:]))
+			return code, false, err
+		}
+	}
+}
+
+func (s *Shell) name() string {
+	if s.Request.Name == "" {
+		return shellDefault
+	}
+	return s.Request.Name
+}
+
+func (s *Shell) doResponse(c net.Conn) error {
+	defer c.Close()
+	enc := gob.NewEncoder(c)
+	reader := bufio.NewReader(c)
+	dec := types.NewLimitedDecoder(reader, MaxStreamMessageSize)
+	var req ShellRequest
+	err := dec.Decode(&req)
+	if err != nil {
+		return err
+	}
+	s.Request = req
+	reject := func(err error) error {
+		enc.Encode(ShellReply{Error: err.Error()})
+		return err
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return reject(err)
+	}
+	sc := cm.Conf.ShellConf
+	err = shellAllowed(sc, s.HostId())
+	if err != nil {
+		return reject(err)
+	}
+	if req.List {
+		reply := ShellReply{Ready: true}
+		shellLock.Lock()
+		var list []*shellSession
+		for _, v := range shellSessions {
+			if v.peer == s.HostId() {
+				list = append(list, v)
+			}
+		}
+		shellLock.Unlock()
+		for _, v := range list {
+			reply.Sessions = append(reply.Sessions, v.status())
+		}
+		return enc.Encode(reply)
+	}
+	key := shellKey(s.HostId(), s.name())
+	shellLock.Lock()
+	ss := shellSessions[key]
+	shellLock.Unlock()
+	if req.Kill {
+		if ss == nil {
+			return reject(fmt.Errorf("no session %s", s.name()))
+		}
+		if s.readOnly {
+			return reject(fmt.Errorf("read only access"))
+		}
+		Log(s).Debug("kill session ", s.name(), " of ", s.HostId())
+		ss.kill()
+		return enc.Encode(ShellReply{Ready: true})
+	}
+	started := false
+	if ss == nil {
+		if req.Attach {
+			return reject(fmt.Errorf("no session %s", s.name()))
+		}
+		if s.readOnly {
+			return reject(fmt.Errorf("read only access cannot start a session"))
+		}
+		command := req.Command
+		if len(command) == 0 {
+			shell := sc.Shell
+			if shell == "" {
+				shell = os.Getenv("SHELL")
+			}
+			if shell == "" {
+				shell = "/bin/sh"
+			}
+			command = []string{shell}
+		}
+		if req.Term == "" {
+			req.Term = "xterm"
+		}
+		shellLock.Lock()
+		ss = shellSessions[key]
+		if ss == nil {
+			ss, err = startShell(s.HostId(), s.name(), command, req.Term, int(sc.Scrollback))
+			if err == nil {
+				shellSessions[key] = ss
+				started = true
+			}
+		}
+		shellLock.Unlock()
+		if err != nil {
+			return reject(err)
+		}
+		Log(s).Debugf("start session %s %v for %s", s.name(), command, s.HostId())
+	}
+	err = enc.Encode(ShellReply{Ready: true, Started: started, ReadOnly: s.readOnly})
+	if err != nil {
+		return err
+	}
+	client := &shellClient{conn: c, enc: enc}
+	err = ss.attach(client)
+	if err != nil {
+		ss.detach(client)
+		return err
+	}
+	defer ss.detach(client)
+	for {
+		var msg []byte
+		err = dec.Decode(&msg)
+		if err != nil {
+			// the client is gone, the session keeps running
+			return nil
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		switch msg[0] {
+		case execStdin:
+			if !s.readOnly {
+				ss.pty.Write(msg[1:])
+			}
+		case execResize:
+			var size execSize
+			if json.Unmarshal(msg[1:], &size) == nil {
+				pty.Resize(ss.pty, size.Width, size.Height)
+			}
+		}
+	}
+}
+
+func (s *Shell) Response(ctx context.Context) error {
+	p, c := net.Pipe()
+	s.lock.Lock()
+	s.BaseImpl.conn = &c
+	s.lock.Unlock()
+	go func() {
+		err := s.doResponse(p)
+		if err != nil {
+			Log(s).Error("do response ", err)
+		}
+	}()
+	return nil
+}
@@ -1,6 +1,7 @@
 package impl
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/pem"
 	"errors"
@@ -17,6 +18,7 @@ import (
 
 	"github.com/povsister/scp"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
 	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/types"
 	"golang.org/x/crypto/ssh"
@@ -35,6 +37,8 @@ type SSH struct {
 	CopyIdOpt bool
 	Identify  string
 	config    ssh.ClientConfig
+	// prompt asks the password instead of the terminal if set
+	prompt func() (string, error)
 }
 
 func NewSSH(address string, x11 bool, ident string, copyId bool) *SSH {
@@ -52,27 +56,47 @@ func (s *SSH) Code() int32 {
 	return types.APP_TYPE_SSH
 }
 
-func (s *SSH) Preper() error {
+func (s *SSH) Preper(ctx context.Context) error {
 	s.config = ssh.ClientConfig{
 		HostKeyCallback: ssh.HostKeyCallback(hostKeyCallback),
 		Timeout:         timeout,
 	}
+	// options missing on the command line are taken from the configure
+	var sc conf.SSHConf
+	cm, err := conf.Shared()
+	if err != nil {
+		Log(s).Warn(err)
+	} else {
+		sc = cm.Conf.SSHConf
+	}
+	s.X11 = s.X11 || sc.X11
+	if s.Identify == "" {
+		s.Identify = sc.IdentityFile
+	}
 	s.privateKeyOption()
-	err := s.decodeAddress()
+	err = s.decodeAddress(sc.Username)
+	if err == nil && cm != nil {
+		// devices may be given by their address book or domain name
+		s.HId, err = ResolveHost(cm, s.HId)
+	}
 	return err
 }
 
-func (s *SSH) Dial() error {
+func (s *SSH) Dial(ctx context.Context) error {
 	return nil
 }
 
-func (s *SSH) Response() error {
+func (s *SSH) Response(ctx context.Context) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	cm := conf.NewConfManager("")
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
 
-	logrus.Debug("Dail local addr ", cm.Conf.LocalSSHPort)
-	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", cm.Conf.LocalSSHPort))
+	Log(s).Debug("Dail local addr ", cm.Conf.LocalSSHPort)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", fmt.Sprintf("127.0.0.1:%d", cm.Conf.LocalSSHPort))
 	if err != nil {
 		return err
 	}
@@ -83,25 +107,32 @@ func (s *SSH) Response() error {
 func (s *SSH) privateKeyOption() {
 	if s.Identify == "" {
 		s.Identify = path.Join(os.Getenv("HOME"), ".ssh", "id_rsa")
+	} else if strings.HasPrefix(s.Identify, "~/") {
+		s.Identify = path.Join(os.Getenv("HOME"), s.Identify[2:])
 	}
 	pemBytes, err := ioutil.ReadFile(s.Identify)
 	if err != nil {
-		logrus.Printf("Reading private key file failed %v", err)
+		Log(s).Printf("Reading private key file failed %v", err)
 		return
 	}
 	// create signer
 	signer, err := SignerFromPem(pemBytes, nil)
 	if err != nil {
-		logrus.Error(err)
+		Log(s).Error(err)
 		return
 	}
 	s.config.Auth = append(s.config.Auth, ssh.PublicKeys(signer))
 }
 
-func (s *SSH) decodeAddress() error {
+// decodeAddress splits the user from the device of the address, users
+// missing in the address default to defaultUser or the local user
+func (s *SSH) decodeAddress(defaultUser string) error {
 	var userName, addr string
 	sps := strings.Split(s.Address, "@")
-	if len(sps) < 2 {
+	if len(sps) < 2 && defaultUser != "" {
+		userName = defaultUser
+		addr = sps[0]
+	} else if len(sps) < 2 {
 		user, err := user.Current()
 		if err != nil {
 			return err
@@ -117,36 +148,81 @@ func (s *SSH) decodeAddress() error {
 	return nil
 }
 
-// dial remote sshd with opened wrtc connection
-func (s *SSH) OpenTerminal(conn net.Conn) error {
-	logrus.Debug("dialRemoteAndOpenTerminal")
+// SetPasswordPrompt makes the client ask passwords with prompt instead of
+// reading them from the terminal
+func (s *SSH) SetPasswordPrompt(prompt func() (string, error)) {
+	s.prompt = prompt
+}
+
+// client opens an ssh client over the connection to the remote sshd
+func (s *SSH) client(conn net.Conn) (*ssh.Client, error) {
 	s.config.Auth = append(s.config.Auth, ssh.RetryableAuthMethod(ssh.PasswordCallback(s.passwordCallback), NumberOfPrompts))
 	c, chans, reqs, err := ssh.NewClientConn(conn, "", &s.config)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	logrus.Debug("conn ok")
+	Log(s).Debug("conn ok")
 	client := ssh.NewClient(c, chans, reqs)
 	if client == nil {
-		return fmt.Errorf("cannot create ssh client")
+		return nil, fmt.Errorf("cannot create ssh client")
+	}
+	Log(s).Debug("client ok")
+	return client, nil
+}
+
+// Shell opens a shell on a pty of cols x rows over the connection to the
+// remote sshd, for callers without a terminal. The caller wires the input
+// and output of the session, waits for it and closes the client.
+func (s *SSH) Shell(conn net.Conn, term string, cols, rows int) (*ssh.Client, *ssh.Session, error) {
+	client, err := s.client(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if term == "" {
+		term = "xterm-256color"
+	}
+	err = session.RequestPty(term, rows, cols, modes)
+	if err != nil {
+		session.Close()
+		client.Close()
+		return nil, nil, err
+	}
+	return client, session, nil
+}
+
+// dial remote sshd with opened wrtc connection
+func (s *SSH) OpenTerminal(conn net.Conn) error {
+	Log(s).Debug("dialRemoteAndOpenTerminal")
+	client, err := s.client(conn)
+	if err != nil {
+		return err
 	}
-	logrus.Debug("client ok")
 	session, err := client.NewSession()
 	if err != nil {
 		return err
 	}
-	logrus.Debug("session")
+	Log(s).Debug("session")
 	if s.CopyIdOpt {
 		scpClient, err := scp.NewClientFromExistingSSH(client, &scp.ClientOption{})
 		if err != nil {
 			return nil
 		}
-		pubKeyPath := path.Join(os.Getenv("HOME"), ".ssh", "id_rsa.pub")
+		pubKeyPath := s.Identify + ".pub"
 		tmplatePath := path.Join("tmp", "")
 		targetKey := path.Join("~", "./.ssh/authorized_keys")
 		err = scpClient.CopyFileToRemote(pubKeyPath, tmplatePath, &scp.FileTransferOption{Perm: os.FileMode(0600)})
 		if err != nil {
-			logrus.Warn(err)
+			Log(s).Warn(err)
 		} else {
 			session.Run("cat " + tmplatePath + " >> " + targetKey)
 			session.Run("rm " + tmplatePath)
@@ -156,7 +232,7 @@ func (s *SSH) OpenTerminal(conn net.Conn) error {
 
 	}
 	if s.X11 {
-		logrus.Debug("x11 enable")
+		Log(s).Debug("x11 enable")
 		x11Request(session, client)
 	}
 	fd := int(os.Stdin.Fd())
@@ -180,24 +256,32 @@ func (s *SSH) OpenTerminal(conn net.Conn) error {
 	if err := session.RequestPty(term, h, w, modes); err != nil {
 		return err
 	}
-	logrus.Debug("pty ok")
+	Log(s).Debug("pty ok")
 	session.Stdout = os.Stdout
 	session.Stderr = os.Stderr
 	session.Stdin = os.Stdin
 	if err := session.Shell(); err != nil {
 		return err
 	}
-	logrus.Debug("shell ok")
+	Log(s).Debug("shell ok")
 	defer session.Close()
 	defer client.Close()
 	defer terminal.Restore(fd, state)
-	logrus.Debug("wait session")
+	Log(s).Debug("wait session")
 	return session.Wait()
 
 }
 
 func (dal *SSH) passwordCallback() (string, error) {
-	logrus.Debug("password callback")
+	Log(dal).Debug("password callback")
+	if dal.prompt != nil {
+		pass, err := dal.prompt()
+		if err != nil {
+			return "", err
+		}
+		dal.config.Auth = append(dal.config.Auth, ssh.Password(pass))
+		return pass, nil
+	}
 	fmt.Print("Password: ")
 	b, _ := terminal.ReadPassword(int(syscall.Stdin))
 	fmt.Print("\n")
@@ -205,17 +289,54 @@ func (dal *SSH) passwordCallback() (string, error) {
 	return string(b), nil
 }
 
-func createKnownHosts() {
-	f, fErr := os.OpenFile(path.Join(os.Getenv("HOME"), ".ssh", "known_hosts"), os.O_CREATE, 0600)
+// knownHostsFile returns the known_hosts of the ssh applications, sshx
+// keeps its own so the one of the user is never edited
+func knownHostsFile() string {
+	cm, err := conf.Shared()
+	if err == nil && cm.Conf.SSHConf.KnownHostsFile != "" {
+		return cm.Conf.SSHConf.KnownHostsFile
+	}
+	if err != nil {
+		logrus.Error(err)
+	}
+	return path.Join(utils.GetSSHXStateHome(), "known_hosts")
+}
+
+// clearKnownHosts removes the keys of a local port from the known_hosts of
+// the user if SSHConf.ClearKnownHosts is set
+func clearKnownHosts(port int32) {
+	cm, err := conf.Shared()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	if !cm.Conf.SSHConf.ClearKnownHosts {
+		return
+	}
+	err = conf.ClearKnownHosts(path.Join(os.Getenv("HOME"), ".ssh", "known_hosts"), fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+func createKnownHosts(file string) {
+	err := os.MkdirAll(path.Dir(file), 0700)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	f, fErr := os.OpenFile(file, os.O_CREATE, 0600)
 	if fErr != nil {
 		logrus.Error(fErr)
+		return
 	}
 	f.Close()
 }
 
 func checkKnownHosts() ssh.HostKeyCallback {
-	createKnownHosts()
-	kh, err := knownhosts.New(path.Join(os.Getenv("HOME"), ".ssh", "known_hosts"))
+	file := knownHostsFile()
+	createKnownHosts(file)
+	kh, err := knownhosts.New(file)
 	if err != nil {
 		logrus.Error(err)
 	}
@@ -255,10 +376,16 @@ func hostKeyCallback(host string, remote net.Addr, pubKey ssh.PublicKey) error {
 	return nil
 }
 
+// KnownHostsCallback checks host keys with the known_hosts of sshx and
+// adds the unknown ones to it, as the ssh applications do
+func KnownHostsCallback() ssh.HostKeyCallback {
+	return hostKeyCallback
+}
+
 func addHostKey(host string, remote net.Addr, pubKey ssh.PublicKey) error {
 	// add host key if host is not found in known_hosts, error object is return, if nil then connection proceeds,
 	// if not nil then connection stops.
-	khFilePath := path.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	khFilePath := knownHostsFile()
 
 	f, fErr := os.OpenFile(khFilePath, os.O_APPEND|os.O_WRONLY, 0600)
 	if fErr != nil {
@@ -1,24 +1,33 @@
 package impl
 
 import (
+	"context"
 	"fmt"
+	"time"
 
-	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/pkg/sftp"
-	"github.com/sirupsen/logrus"
-	"github.com/suutaku/go-sshfs/pkg/sshfs"
-	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/types"
 	"golang.org/x/crypto/ssh"
 )
 
+// fsMount serves a remote directory at a local mount point, the backend
+// depends on the platform (FUSE or WinFsp)
+type fsMount interface {
+	// Mount blocks until the filesystem is unmounted
+	Mount() error
+	Unmount()
+}
+
 type SSHFS struct {
 	BaseImpl
 	MountPoint string
 	Root       string
 	Address    string
-	sshfs      *sshfs.Sshfs
+	mount      fsMount
 	Identify   string
+	client     *ssh.Client
+	closed     bool
 }
 
 func NewSSHFS(mountPoint, root, address, id string) *SSHFS {
@@ -30,10 +39,10 @@ func NewSSHFS(mountPoint, root, address, id string) *SSHFS {
 	}
 }
 
-func (fs *SSHFS) Preper() error {
+func (fs *SSHFS) Preper(ctx context.Context) error {
 	// use ssh impl to get host id
 	ssht := NewSSH(fs.Address, false, fs.Identify, false)
-	err := ssht.Preper()
+	err := ssht.Preper(ctx)
 	if err != nil {
 		return err
 	}
@@ -45,65 +54,154 @@ func (fs *SSHFS) Code() int32 {
 	return types.APP_TYPE_SFS
 }
 
-func (fs *SSHFS) Dial() error {
+// connect opens a new ssh session to the remote host through the local daemon
+func (fs *SSHFS) connect() (*ssh.Client, error) {
 	ssht := NewSSH(fs.Address, false, fs.Identify, false)
-	err := ssht.Preper()
+	err := ssht.Preper(context.Background())
 	if err != nil {
-		return err
+		return nil, err
 	}
 	ssht.SetParentId(fs.PairId())
 	fs.HId = ssht.HId
 	sender := NewSender(ssht, types.OPTION_TYPE_UP)
 	conn, err := sender.Send()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer conn.Close()
-	// defer func() {
-	// 	conn.Close()
-	// 	closeSender := NewSender(ssht, types.OPTION_TYPE_DOWN)
-	// 	closeSender.PairId = sender.PairId
-	// 	closeSender.SendDetach()
-	// }()
 	ssht.config.Auth = append(ssht.config.Auth, ssh.RetryableAuthMethod(ssh.PasswordCallback(ssht.passwordCallback), NumberOfPrompts))
 	c, chans, reqs, err := ssh.NewClientConn(conn, "", &ssht.config)
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
 	sshClient := ssh.NewClient(c, chans, reqs)
 	if sshClient == nil {
-		return fmt.Errorf("cannot create ssh client")
+		conn.Close()
+		return nil, fmt.Errorf("cannot create ssh client")
 	}
-	sftpClient, err := sftp.NewClient(sshClient)
+	return sshClient, nil
+}
+
+// serve mounts the remote filesystem over client and returns once the
+// transport is gone, an error is only returned if mounting failed
+func (fs *SSHFS) serve(client *ssh.Client, sc conf.SSHFSConf) error {
+	defer client.Close()
+	sftpClient, err := sftp.NewClient(client)
 	if err != nil {
 		return err
 	}
-	fs.sshfs = sshfs.NewSshfs(sftpClient, fs.Root, fs.MountPoint, fs.HId)
-	if fs.sshfs == nil {
-		return fmt.Errorf("cannot create sshfs")
+	mounted, err := newFsMount(sftpClient, fs.Root, fs.MountPoint, fs.HId, sc)
+	if err != nil {
+		return err
 	}
-	opts := &fusefs.Options{}
-	if utils.DebugOn() {
-		opts.Debug = true
+	fs.lock.Lock()
+	if fs.closed {
+		fs.lock.Unlock()
+		return nil
 	}
-	err = fs.sshfs.Mount(opts)
+	fs.mount = mounted
+	fs.client = client
+	fs.lock.Unlock()
+
+	lost := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(lost)
+		// release the stale mount so it can be mounted again
+		fs.unmount()
+	}()
+	err = mounted.Mount()
 	if err != nil {
-		logrus.Error(err)
-		fs.Close()
+		fs.unmount()
 		return err
 	}
-	logrus.Info("close sfs impl")
+	<-lost
 	return nil
 }
 
-func (fs *SSHFS) Response() error {
+func (fs *SSHFS) isClosed() bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.closed
+}
+
+func (fs *SSHFS) Dial(ctx context.Context) error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	sc := cm.Conf.SSHFSConf
+	maxDelay := time.Duration(sc.ReconnectMaxDelay) * time.Second
+	if sc.ReconnectMaxDelay == 0 {
+		maxDelay = 30 * time.Second
+	}
+	client, err := fs.connect()
+	if err != nil {
+		return err
+	}
+	for {
+		err = fs.serve(client, sc)
+		if err != nil {
+			Log(fs).Error(err)
+			fs.Close()
+			return err
+		}
+		if fs.isClosed() || maxDelay < 0 {
+			break
+		}
+		delay := time.Second
+		for {
+			Log(fs).Warnf("connection of %s lost, reconnect in %v", fs.MountPoint, delay)
+			time.Sleep(delay)
+			if fs.isClosed() {
+				Log(fs).Info("close sfs impl")
+				return nil
+			}
+			client, err = fs.connect()
+			if err == nil {
+				break
+			}
+			Log(fs).Error(err)
+			if delay *= 2; delay > maxDelay {
+				delay = maxDelay
+			}
+		}
+		Log(fs).Info("reconnected ", fs.MountPoint)
+	}
+	Log(fs).Info("close sfs impl")
+	return nil
+}
+
+func (fs *SSHFS) Response(ctx context.Context) error {
 	return nil
 }
 
-func (fs *SSHFS) Close() {
+func (fs *SSHFS) unmount() {
+	fs.lock.Lock()
+	mounted := fs.mount
+	fs.mount = nil
+	fs.lock.Unlock()
+	if mounted == nil {
+		return
+	}
+	mounted.Unmount()
+	// fusermount fails on busy mounts, detach lazily whatever is left
+	err := ReleaseMount(fs.MountPoint)
+	if err != nil {
+		Log(fs).Debug("release mount ", err)
+	}
+}
+
+func (fs *SSHFS) Close() error {
+	fs.lock.Lock()
+	fs.closed = true
+	client := fs.client
+	fs.lock.Unlock()
 	fs.BaseImpl.Close()
-	if fs.sshfs != nil {
-		fs.sshfs.Unmount()
+	fs.unmount()
+	if client != nil {
+		client.Close()
 	}
-	logrus.Info("close sfs impl")
+	Log(fs).Info("close sfs impl")
+	return nil
 }
@@ -0,0 +1,115 @@
+//go:build !windows
+// +build !windows
+
+package impl
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/pkg/sftp"
+	"github.com/suutaku/go-sshfs/pkg/sshfs"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+// fuseMount serves the remote directory with go-fuse
+type fuseMount struct {
+	sshfs *sshfs.Sshfs
+	opts  *fusefs.Options
+}
+
+func fuseTimeout(sec int32) *time.Duration {
+	if sec == 0 {
+		return nil
+	}
+	d := time.Duration(sec) * time.Second
+	if sec < 0 {
+		d = 0
+	}
+	return &d
+}
+
+func newFsMount(client *sftp.Client, root, mountPoint, hostId string, sc conf.SSHFSConf) (fsMount, error) {
+	fs := sshfs.NewSshfs(client, root, mountPoint, hostId)
+	if fs == nil {
+		return nil, fmt.Errorf("cannot create sshfs")
+	}
+	opts := &fusefs.Options{
+		AttrTimeout:     fuseTimeout(sc.AttrTimeout),
+		EntryTimeout:    fuseTimeout(sc.EntryTimeout),
+		NegativeTimeout: fuseTimeout(sc.NegativeTimeout),
+	}
+	opts.MaxReadAhead = int(sc.MaxReadAhead)
+	if utils.DebugOn() {
+		opts.Debug = true
+	}
+	return &fuseMount{
+		sshfs: fs,
+		opts:  opts,
+	}, nil
+}
+
+func (fm *fuseMount) Mount() error {
+	return fm.sshfs.Mount(fm.opts)
+}
+
+func (fm *fuseMount) Unmount() {
+	fm.sshfs.Unmount()
+}
+
+// CheckFUSE reports whether sshfs mounts can be served on this system
+func CheckFUSE() error {
+	switch runtime.GOOS {
+	case "linux":
+		if _, err := os.Stat("/dev/fuse"); err != nil {
+			return fmt.Errorf("/dev/fuse not found, install fuse or load its kernel module")
+		}
+		for _, v := range []string{"fusermount", "fusermount3"} {
+			if _, err := exec.LookPath(v); err == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("fusermount not found, install fuse")
+	case "darwin":
+		for _, v := range []string{"/Library/Filesystems/macfuse.fs", "/Library/Filesystems/osxfuse.fs"} {
+			if _, err := os.Stat(v); err == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("macFUSE not found, install it from https://osxfuse.github.io")
+	}
+	return nil
+}
+
+// ReleaseMount forces a FUSE mount point to be detached, even if the
+// filesystem serving it is gone
+func ReleaseMount(mountPoint string) error {
+	var cmds [][]string
+	switch runtime.GOOS {
+	case "linux":
+		cmds = [][]string{
+			{"fusermount", "-u", "-z", mountPoint},
+			{"umount", "-l", mountPoint},
+		}
+	case "darwin":
+		cmds = [][]string{
+			{"umount", "-f", mountPoint},
+			{"diskutil", "unmount", "force", mountPoint},
+		}
+	default:
+		return fmt.Errorf("force unmount is not supported on %s", runtime.GOOS)
+	}
+	var err error
+	for _, v := range cmds {
+		err = exec.Command(v[0], v[1:]...).Run()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
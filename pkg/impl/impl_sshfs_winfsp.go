@@ -0,0 +1,316 @@
+//go:build windows
+// +build windows
+
+package impl
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// winfspMount serves the remote directory through WinFsp, mount points are
+// drive letters like "X:" or directories which do not exist yet
+type winfspMount struct {
+	fuse.FileSystemBase
+	client     *sftp.Client
+	root       string
+	mountPoint string
+	hostId     string
+	options    []string
+	host       *fuse.FileSystemHost
+
+	lock    sync.Mutex
+	handles map[uint64]*sftp.File
+	nextFh  uint64
+}
+
+func newFsMount(client *sftp.Client, root, mountPoint, hostId string, sc conf.SSHFSConf) (fsMount, error) {
+	if len(mountPoint) == 1 {
+		mountPoint += ":"
+	}
+	if root == "" {
+		root = "."
+	}
+	ret := &winfspMount{
+		client:     client,
+		root:       root,
+		mountPoint: mountPoint,
+		hostId:     hostId,
+		handles:    make(map[uint64]*sftp.File),
+	}
+	ret.options = []string{"-o", "uid=-1,gid=-1,volname=sshx-" + hostId}
+	if sc.AttrTimeout != 0 {
+		timeout := sc.AttrTimeout * 1000
+		if timeout < 0 {
+			timeout = 0
+		}
+		ret.options = append(ret.options, "-o", fmt.Sprintf("FileInfoTimeout=%d", timeout))
+	}
+	if utils.DebugOn() {
+		ret.options = append(ret.options, "-d")
+	}
+	ret.host = fuse.NewFileSystemHost(ret)
+	return ret, nil
+}
+
+func (wm *winfspMount) Mount() error {
+	if !wm.host.Mount(wm.mountPoint, wm.options) {
+		return fmt.Errorf("cannot mount %s, is WinFsp installed?", wm.mountPoint)
+	}
+	return nil
+}
+
+func (wm *winfspMount) Unmount() {
+	wm.host.Unmount()
+}
+
+// ReleaseMount is a no-op on Windows, WinFsp removes the drive as soon as
+// the process serving it is gone
+func ReleaseMount(mountPoint string) error {
+	return nil
+}
+
+// CheckFUSE reports whether WinFsp, which serves sshfs mounts, is installed
+func CheckFUSE() error {
+	dir := os.Getenv("ProgramFiles(x86)")
+	if dir == "" {
+		dir = `C:\Program Files (x86)`
+	}
+	if _, err := os.Stat(filepath.Join(dir, "WinFsp", "bin")); err != nil {
+		return fmt.Errorf("WinFsp not found, install it from https://winfsp.dev")
+	}
+	return nil
+}
+
+func (wm *winfspMount) remote(name string) string {
+	return path.Join(wm.root, strings.TrimPrefix(name, "/"))
+}
+
+func errno(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case os.IsNotExist(err):
+		return -fuse.ENOENT
+	case os.IsExist(err):
+		return -fuse.EEXIST
+	case os.IsPermission(err):
+		return -fuse.EACCES
+	}
+	logrus.Debug("sshfs ", err)
+	return -fuse.EIO
+}
+
+func fillStat(stat *fuse.Stat_t, fi os.FileInfo) {
+	*stat = fuse.Stat_t{}
+	stat.Size = fi.Size()
+	stat.Mode = uint32(fi.Mode().Perm())
+	switch {
+	case fi.IsDir():
+		stat.Mode |= fuse.S_IFDIR
+	case fi.Mode()&os.ModeSymlink != 0:
+		stat.Mode |= fuse.S_IFLNK
+	default:
+		stat.Mode |= fuse.S_IFREG
+	}
+	stat.Nlink = 1
+	mtime := fuse.NewTimespec(fi.ModTime())
+	stat.Mtim = mtime
+	stat.Atim = mtime
+	stat.Ctim = mtime
+	stat.Birthtim = mtime
+}
+
+func (wm *winfspMount) Getattr(name string, stat *fuse.Stat_t, fh uint64) int {
+	fi, err := wm.client.Stat(wm.remote(name))
+	if err != nil {
+		return errno(err)
+	}
+	fillStat(stat, fi)
+	return 0
+}
+
+func (wm *winfspMount) Statfs(name string, stat *fuse.Statfs_t) int {
+	vfs, err := wm.client.StatVFS(wm.remote(name))
+	if err != nil {
+		// not every sftp server supports statvfs
+		return 0
+	}
+	stat.Bsize = vfs.Bsize
+	stat.Frsize = vfs.Frsize
+	stat.Blocks = vfs.Blocks
+	stat.Bfree = vfs.Bfree
+	stat.Bavail = vfs.Bavail
+	stat.Files = vfs.Files
+	stat.Ffree = vfs.Ffree
+	stat.Favail = vfs.Favail
+	stat.Namemax = vfs.Namemax
+	return 0
+}
+
+func (wm *winfspMount) Readdir(name string, fill func(name string, stat *fuse.Stat_t, ofst int64) bool, ofst int64, fh uint64) int {
+	entries, err := wm.client.ReadDir(wm.remote(name))
+	if err != nil {
+		return errno(err)
+	}
+	fill(".", nil, 0)
+	fill("..", nil, 0)
+	for _, v := range entries {
+		var stat fuse.Stat_t
+		fillStat(&stat, v)
+		if !fill(v.Name(), &stat, 0) {
+			break
+		}
+	}
+	return 0
+}
+
+func (wm *winfspMount) Opendir(name string) (int, uint64) {
+	fi, err := wm.client.Stat(wm.remote(name))
+	if err != nil {
+		return errno(err), ^uint64(0)
+	}
+	if !fi.IsDir() {
+		return -fuse.ENOTDIR, ^uint64(0)
+	}
+	return 0, ^uint64(0)
+}
+
+func (wm *winfspMount) open(name string, flags int) (int, uint64) {
+	file, err := wm.client.OpenFile(wm.remote(name), flags)
+	if err != nil {
+		return errno(err), ^uint64(0)
+	}
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+	wm.nextFh++
+	wm.handles[wm.nextFh] = file
+	return 0, wm.nextFh
+}
+
+// osFlags converts FUSE open flags to the os flags used by sftp
+func osFlags(flags int) int {
+	ret := os.O_RDONLY
+	switch flags & fuse.O_ACCMODE {
+	case fuse.O_WRONLY:
+		ret = os.O_WRONLY
+	case fuse.O_RDWR:
+		ret = os.O_RDWR
+	}
+	if flags&fuse.O_APPEND != 0 {
+		ret |= os.O_APPEND
+	}
+	if flags&fuse.O_CREAT != 0 {
+		ret |= os.O_CREATE
+	}
+	if flags&fuse.O_EXCL != 0 {
+		ret |= os.O_EXCL
+	}
+	if flags&fuse.O_TRUNC != 0 {
+		ret |= os.O_TRUNC
+	}
+	return ret
+}
+
+func (wm *winfspMount) Open(name string, flags int) (int, uint64) {
+	return wm.open(name, osFlags(flags))
+}
+
+func (wm *winfspMount) Create(name string, flags int, mode uint32) (int, uint64) {
+	ret, fh := wm.open(name, osFlags(flags)|os.O_CREATE)
+	if ret == 0 {
+		wm.client.Chmod(wm.remote(name), os.FileMode(mode).Perm())
+	}
+	return ret, fh
+}
+
+func (wm *winfspMount) handle(fh uint64) *sftp.File {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+	return wm.handles[fh]
+}
+
+func (wm *winfspMount) Read(name string, buff []byte, ofst int64, fh uint64) int {
+	file := wm.handle(fh)
+	if file == nil {
+		return -fuse.EBADF
+	}
+	n, err := file.ReadAt(buff, ofst)
+	if err != nil && err != io.EOF {
+		return errno(err)
+	}
+	return n
+}
+
+func (wm *winfspMount) Write(name string, buff []byte, ofst int64, fh uint64) int {
+	file := wm.handle(fh)
+	if file == nil {
+		return -fuse.EBADF
+	}
+	n, err := file.WriteAt(buff, ofst)
+	if err != nil {
+		return errno(err)
+	}
+	return n
+}
+
+func (wm *winfspMount) Release(name string, fh uint64) int {
+	wm.lock.Lock()
+	file := wm.handles[fh]
+	delete(wm.handles, fh)
+	wm.lock.Unlock()
+	if file == nil {
+		return -fuse.EBADF
+	}
+	return errno(file.Close())
+}
+
+func (wm *winfspMount) Truncate(name string, size int64, fh uint64) int {
+	if file := wm.handle(fh); file != nil {
+		return errno(file.Truncate(size))
+	}
+	return errno(wm.client.Truncate(wm.remote(name), size))
+}
+
+func (wm *winfspMount) Mkdir(name string, mode uint32) int {
+	return errno(wm.client.Mkdir(wm.remote(name)))
+}
+
+func (wm *winfspMount) Rmdir(name string) int {
+	return errno(wm.client.RemoveDirectory(wm.remote(name)))
+}
+
+func (wm *winfspMount) Unlink(name string) int {
+	return errno(wm.client.Remove(wm.remote(name)))
+}
+
+func (wm *winfspMount) Rename(oldName string, newName string) int {
+	// windows expects rename to replace an existing target
+	err := wm.client.PosixRename(wm.remote(oldName), wm.remote(newName))
+	if err != nil {
+		err = wm.client.Rename(wm.remote(oldName), wm.remote(newName))
+	}
+	return errno(err)
+}
+
+func (wm *winfspMount) Chmod(name string, mode uint32) int {
+	return errno(wm.client.Chmod(wm.remote(name), os.FileMode(mode).Perm()))
+}
+
+func (wm *winfspMount) Utimens(name string, tmsp []fuse.Timespec) int {
+	if len(tmsp) < 2 {
+		return 0
+	}
+	return errno(wm.client.Chtimes(wm.remote(name), tmsp[0].Time(), tmsp[1].Time()))
+}
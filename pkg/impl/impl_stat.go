@@ -1,13 +1,17 @@
 package impl
 
 import (
+	"bufio"
+	"context"
 	"encoding/gob"
 	"fmt"
+	"net"
 	"os"
+	"time"
 
 	"github.com/jedib0t/go-pretty/v6/list"
 	"github.com/jedib0t/go-pretty/v6/table"
-	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
 	"github.com/suutaku/sshx/pkg/types"
 )
 
@@ -18,6 +22,17 @@ const (
 
 type STAT struct {
 	BaseImpl
+	// Events asks the daemon for its last events after the sessions
+	Events bool
+	// Watch keeps the connection open after the last events, the daemon
+	// writes the events recorded afterwards on it one by one
+	Watch bool
+	// STUN asks the daemon for the last checks of its STUN servers, after
+	// the events
+	STUN bool
+	// Mesh asks the daemon for the routes of its mesh, after the STUN
+	// servers
+	Mesh bool
 }
 
 func NewSTAT() *STAT {
@@ -28,25 +43,44 @@ func (stat *STAT) Code() int32 {
 	return types.APP_TYPE_STAT
 }
 
-func (stat *STAT) Dial() error {
+func (stat *STAT) Dial(ctx context.Context) error {
 	return nil
 }
 
-func (stat *STAT) Response() error {
+func (stat *STAT) Response(ctx context.Context) error {
 	return nil
 }
 
 func (stat *STAT) ShowStatus(displayType int) {
-	logrus.Debug("read from conn")
-	var pld []types.Status
-	err := gob.NewEncoder(stat.Conn()).Encode(&pld)
+	Log(stat).Debug("read from conn")
+	r := bufio.NewReader(stat.Conn())
+	pld, events, err := decodeStatus(stat.Conn(), r, stat.Events)
 	if err != nil {
-		logrus.Error(err)
+		Log(stat).Error(err)
 		return
 	}
-	err = gob.NewDecoder(stat.Conn()).Decode(&pld)
-	if err != nil {
-		logrus.Error(err)
+	if stat.Events {
+		stat.showEvents(events)
+		return
+	}
+	if stat.STUN {
+		var servers []types.STUNServer
+		err = gob.NewDecoder(r).Decode(&servers)
+		if err != nil {
+			Log(stat).Error(err)
+			return
+		}
+		stat.showSTUN(servers)
+		return
+	}
+	if stat.Mesh {
+		var routes []types.MeshRoute
+		err = gob.NewDecoder(r).Decode(&routes)
+		if err != nil {
+			Log(stat).Error(err)
+			return
+		}
+		stat.showMesh(routes)
 		return
 	}
 	switch displayType {
@@ -57,6 +91,59 @@ func (stat *STAT) ShowStatus(displayType int) {
 	}
 }
 
+func (stat *STAT) showEvents(events []types.Event) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Time", "Event", "Pair ID", "Target ID", "Application", "Message"})
+	t.AppendSeparator()
+	for _, v := range events {
+		t.AppendRows([]table.Row{
+			{v.Time.Format("2 Jan 2006 15:04:05"), v.Kind, v.PairId, v.TargetId, v.App, v.Message},
+		})
+	}
+	t.AppendSeparator()
+	t.Render()
+}
+
+func (stat *STAT) showSTUN(servers []types.STUNServer) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Server", "State", "RTT", "Address", "Checked At", "Error"})
+	t.AppendSeparator()
+	for _, v := range servers {
+		state, rtt := "down", ""
+		if v.Up {
+			state, rtt = "up", v.RTT.Round(time.Millisecond).String()
+		}
+		t.AppendRows([]table.Row{
+			{v.URL, state, rtt, v.Address, v.Checked.Format("2 Jan 2006 15:04:05"), v.Error},
+		})
+	}
+	t.AppendSeparator()
+	t.Render()
+}
+
+func (stat *STAT) showMesh(routes []types.MeshRoute) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Target", "Via", "Hops", "Updated At"})
+	t.AppendSeparator()
+	for _, v := range routes {
+		via, updated := v.Via, ""
+		if via == "" {
+			via = "this device"
+		}
+		if !v.Updated.IsZero() {
+			updated = v.Updated.Format("2 Jan 2006 15:04:05")
+		}
+		t.AppendRows([]table.Row{
+			{v.Target, via, v.Hops, updated},
+		})
+	}
+	t.AppendSeparator()
+	t.Render()
+}
+
 func (stat *STAT) showTable(status []types.Status) {
 	t := table.NewWriter()
 	t.SetOutputMirror(os.Stdout)
@@ -105,6 +192,121 @@ func (stat *STAT) showList(status []types.Status) {
 	l.Render()
 }
 
-func (stat *STAT) Close() {
-	stat.BaseImpl.Close()
+// RequestStatus asks the local daemon for its sessions, and for its last
+// events if stat.Events is set
+func RequestStatus(ctx context.Context, stat *STAT) ([]types.Status, []types.Event, error) {
+	stat.Watch = false
+	var pld []types.Status
+	var events []types.Event
+	err := requestStatus(ctx, stat, func(conn net.Conn) error {
+		defer conn.Close()
+		return utils.WithContext(ctx, conn, func() error {
+			var err error
+			pld, events, err = decodeStatus(conn, bufio.NewReader(conn), stat.Events)
+			return err
+		})
+	})
+	return pld, events, err
+}
+
+// EventStream reads the events the daemon records after a request of
+// RequestEvents
+type EventStream struct {
+	conn net.Conn
+	dec  *gob.Decoder
+}
+
+// RequestEvents asks the local daemon for its last events and for the ones
+// it records afterwards, which the stream reads. ctx only bounds the
+// request.
+func RequestEvents(ctx context.Context) ([]types.Event, *EventStream, error) {
+	stat := NewSTAT()
+	stat.Events, stat.Watch = true, true
+	var events []types.Event
+	var stream *EventStream
+	err := requestStatus(ctx, stat, func(conn net.Conn) error {
+		r := bufio.NewReader(conn)
+		err := utils.WithContext(ctx, conn, func() error {
+			var err error
+			_, events, err = decodeStatus(conn, r, true)
+			return err
+		})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		stream = &EventStream{conn: conn, dec: gob.NewDecoder(r)}
+		return nil
+	})
+	return events, stream, err
+}
+
+// Next waits for the next event, it returns io.EOF once the daemon closes
+// the stream, as the ones which don't know Watch do at once
+func (es *EventStream) Next() (types.Event, error) {
+	var ev types.Event
+	err := es.dec.Decode(&ev)
+	return ev, err
+}
+
+// Close ends the stream
+func (es *EventStream) Close() error {
+	return es.conn.Close()
+}
+
+// requestStatus sends the status request of stat and calls f with the
+// connection answering it
+func requestStatus(ctx context.Context, stat *STAT, f func(net.Conn) error) error {
+	sender := NewSender(stat, types.OPTION_TYPE_STAT)
+	if sender == nil {
+		return fmt.Errorf("cannot create sender")
+	}
+	conn, err := sender.SendContext(ctx)
+	if err != nil {
+		return err
+	}
+	return f(conn)
+}
+
+// decodeStatus reads the answer of a status request, the sessions then
+// the last events if asked for. Each one has its own gob stream, r is
+// shared so a decoder doesn't read ahead of its stream.
+func decodeStatus(conn net.Conn, r *bufio.Reader, withEvents bool) ([]types.Status, []types.Event, error) {
+	var pld []types.Status
+	err := gob.NewEncoder(conn).Encode(&pld)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = gob.NewDecoder(r).Decode(&pld)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !withEvents {
+		return pld, nil, nil
+	}
+	var events []types.Event
+	err = gob.NewDecoder(r).Decode(&events)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pld, events, nil
+}
+
+// ReloadLogging asks the local daemon to apply the logging settings of the
+// configure
+func ReloadLogging() error {
+	sender := NewSender(NewSTAT(), types.OPTION_TYPE_LOG)
+	if sender == nil {
+		return fmt.Errorf("cannot create sender")
+	}
+	conn, err := sender.Send()
+	if err != nil {
+		return fmt.Errorf("reload logging: %v", err)
+	}
+	conn.Close()
+	return nil
+}
+
+func (stat *STAT) Close() error {
+	return stat.BaseImpl.Close()
 }
@@ -0,0 +1,293 @@
+package impl
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/suutaku/sshx/internal/rsync"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// maxSyncSignaturesSize bounds the encoded block signatures of a file, a
+// few million blocks
+const maxSyncSignaturesSize = 64 << 20
+
+// SyncHeader is sent by the dialer to describe the file it wants to push,
+// Delete asks the responder to remove the file instead
+type SyncHeader struct {
+	Path      string
+	Size      int64
+	BlockSize int32
+	Delete    bool
+}
+
+// SyncSignatures carries the block signatures of the responder's copy
+type SyncSignatures struct {
+	Ready  bool
+	Error  string
+	Blocks []rsync.BlockSignature
+}
+
+// SyncChunk wraps a delta operation, Done marks the end of the stream
+type SyncChunk struct {
+	Op   rsync.Operation
+	Done bool
+}
+
+// SyncResult reports how the responder rebuilt the file
+type SyncResult struct {
+	Error   string
+	Matched int64
+	Literal int64
+}
+
+// Sync pushes a local file to a remote peer, only transmitting the blocks
+// which differ from the copy the remote peer already has
+type Sync struct {
+	BaseImpl
+	LocalPath  string
+	RemotePath string
+	BlockSize  int32
+	// RateLimit caps the throughput in bytes per second, 0 means unlimited
+	RateLimit int64
+}
+
+func NewSync(hostId, localPath, remotePath string, blockSize int32) *Sync {
+	if blockSize <= 0 {
+		blockSize = rsync.DefaultBlockSize
+	} else if blockSize < rsync.MinBlockSize {
+		blockSize = rsync.MinBlockSize
+	} else if blockSize > rsync.MaxBlockSize {
+		blockSize = rsync.MaxBlockSize
+	}
+	return &Sync{
+		BaseImpl:   *NewBaseImpl(hostId),
+		LocalPath:  localPath,
+		RemotePath: remotePath,
+		BlockSize:  blockSize,
+	}
+}
+
+func (sy *Sync) Code() int32 {
+	return types.APP_TYPE_SYNC
+}
+
+// DoPush runs the dialer side of the protocol over the connection set by SetConn
+func (sy *Sync) DoPush() (SyncResult, error) {
+	var result SyncResult
+	file, err := os.Open(sy.LocalPath)
+	if err != nil {
+		return result, err
+	}
+	defer file.Close()
+	fInfo, err := file.Stat()
+	if err != nil {
+		return result, err
+	}
+	if fInfo.IsDir() {
+		return result, fmt.Errorf("%s is a directory", sy.LocalPath)
+	}
+	remotePath := sy.RemotePath
+	if remotePath == "" {
+		remotePath = filepath.Base(sy.LocalPath)
+	}
+
+	enc := gob.NewEncoder(sy.Conn())
+	dec := types.NewLimitedDecoder(sy.Conn(), maxSyncSignaturesSize)
+	err = enc.Encode(SyncHeader{
+		Path:      remotePath,
+		Size:      fInfo.Size(),
+		BlockSize: sy.BlockSize,
+	})
+	if err != nil {
+		return result, err
+	}
+	var sigs SyncSignatures
+	err = dec.Decode(&sigs)
+	if err != nil {
+		return result, err
+	}
+	if !sigs.Ready {
+		return result, fmt.Errorf("remote not ready: %s", sigs.Error)
+	}
+	Log(sy).Debug("got ", len(sigs.Blocks), " block signatures from remote")
+
+	bar := progressbar.DefaultBytes(
+		fInfo.Size(),
+		"sync",
+	)
+	err = rsync.Delta(sigs.Blocks, io.TeeReader(file, bar), int(sy.BlockSize), func(op rsync.Operation) error {
+		return enc.Encode(SyncChunk{Op: op})
+	})
+	if err != nil {
+		return result, err
+	}
+	err = enc.Encode(SyncChunk{Done: true})
+	if err != nil {
+		return result, err
+	}
+	err = dec.Decode(&result)
+	if err != nil {
+		return result, err
+	}
+	if result.Error != "" {
+		return result, errors.New(result.Error)
+	}
+	return result, nil
+}
+
+// DoDelete removes RemotePath on the remote peer
+func (sy *Sync) DoDelete() error {
+	enc := gob.NewEncoder(sy.Conn())
+	dec := types.NewLimitedDecoder(sy.Conn(), MaxReplySize)
+	err := enc.Encode(SyncHeader{
+		Path:   sy.RemotePath,
+		Delete: true,
+	})
+	if err != nil {
+		return err
+	}
+	var res SyncSignatures
+	err = dec.Decode(&res)
+	if err != nil {
+		return err
+	}
+	if !res.Ready {
+		return fmt.Errorf("remote delete: %s", res.Error)
+	}
+	return nil
+}
+
+func (sy *Sync) doResponse(s net.Conn) error {
+	defer s.Close()
+	enc := gob.NewEncoder(s)
+	dec := types.NewLimitedDecoder(s, MaxStreamMessageSize)
+	var header SyncHeader
+	err := dec.Decode(&header)
+	if err != nil {
+		return err
+	}
+	reject := func(err error) error {
+		enc.Encode(SyncSignatures{Error: err.Error()})
+		return err
+	}
+	if !header.Delete && (header.BlockSize < rsync.MinBlockSize || header.BlockSize > rsync.MaxBlockSize) {
+		return reject(fmt.Errorf("block size %d out of %d-%d", header.BlockSize, rsync.MinBlockSize, rsync.MaxBlockSize))
+	}
+	sb, err := newSandbox(sy.HostId(), sy.readOnly)
+	if err != nil {
+		return reject(err)
+	}
+	target, err := sb.resolve(header.Path, true)
+	if err != nil {
+		return reject(err)
+	}
+	Log(sy).Debug("response sync for ", target)
+	if header.Delete {
+		err = os.Remove(target)
+		if err != nil && !os.IsNotExist(err) {
+			return reject(err)
+		}
+		return enc.Encode(SyncSignatures{Ready: true})
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return reject(err)
+	}
+	mode := os.FileMode(0644)
+	var base *os.File
+	if fInfo, err := os.Stat(target); err == nil {
+		if fInfo.IsDir() {
+			return reject(fmt.Errorf("%s is a directory", header.Path))
+		}
+		mode = fInfo.Mode()
+		base, err = os.Open(target)
+		if err != nil {
+			return reject(err)
+		}
+		defer base.Close()
+	}
+
+	sigs := SyncSignatures{Ready: true}
+	if base != nil {
+		sigs.Blocks, err = rsync.Signature(base, int(header.BlockSize))
+		if err != nil {
+			return reject(err)
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".sshx-sync-*")
+	if err != nil {
+		return reject(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	err = enc.Encode(sigs)
+	if err != nil {
+		return err
+	}
+
+	var patcher *rsync.Patcher
+	if base != nil {
+		patcher = rsync.NewPatcher(base, tmp, int(header.BlockSize))
+	} else {
+		patcher = rsync.NewPatcher(nil, tmp, int(header.BlockSize))
+	}
+	result := SyncResult{}
+	for {
+		var chunk SyncChunk
+		err = dec.Decode(&chunk)
+		if err != nil {
+			return err
+		}
+		if chunk.Done {
+			break
+		}
+		err = patcher.Apply(chunk.Op)
+		if err != nil {
+			result.Error = err.Error()
+			enc.Encode(result)
+			return err
+		}
+	}
+	result.Matched = patcher.Matched
+	result.Literal = patcher.Literal
+	if err = tmp.Chmod(mode); err == nil {
+		if err = tmp.Sync(); err == nil {
+			if err = tmp.Close(); err == nil {
+				err = os.Rename(tmp.Name(), target)
+			}
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	Log(sy).Debugf("synced %s: %d bytes matched, %d bytes literal", target, result.Matched, result.Literal)
+	enc.Encode(result)
+	return err
+}
+
+func (sy *Sync) Response(ctx context.Context) error {
+	s, c := net.Pipe()
+	sy.lock.Lock()
+	sy.BaseImpl.conn = &c
+	sy.lock.Unlock()
+	go func() {
+		err := sy.doResponse(s)
+		if err != nil {
+			Log(sy).Error("do response ", err)
+		}
+	}()
+	return nil
+}
+
+func (sy *Sync) Close() error {
+	return sy.BaseImpl.Close()
+}
@@ -0,0 +1,214 @@
+package impl
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// SyncWatcher keeps a remote directory up to date with a local one, every
+// change is pushed with Sync once the directory was quiet for Debounce
+type SyncWatcher struct {
+	HostId    string
+	LocalDir  string
+	RemoteDir string
+	BlockSize int32
+	RateLimit int64
+	Debounce  time.Duration
+	// Delete propagates removed files to the remote peer
+	Delete bool
+
+	watcher *fsnotify.Watcher
+	lock    sync.Mutex
+	// busy serializes flushes which outlast the debounce delay
+	busy    sync.Mutex
+	pending map[string]bool
+	timer   *time.Timer
+	stop    chan struct{}
+}
+
+func NewSyncWatcher(hostId, localDir, remoteDir string) *SyncWatcher {
+	if remoteDir == "" {
+		remoteDir = filepath.Base(filepath.Clean(localDir))
+	}
+	return &SyncWatcher{
+		HostId:    hostId,
+		LocalDir:  filepath.Clean(localDir),
+		RemoteDir: remoteDir,
+		Debounce:  time.Second,
+		pending:   make(map[string]bool),
+		stop:      make(chan struct{}),
+	}
+}
+
+func ignoredSyncFile(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), ".sshx-sync-")
+}
+
+// remotePath maps a local file below LocalDir to its path on the remote peer
+func (sw *SyncWatcher) remotePath(name string) (string, error) {
+	rel, err := filepath.Rel(sw.LocalDir, name)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(sw.RemoteDir, filepath.ToSlash(rel)), nil
+}
+
+func (sw *SyncWatcher) open(imp *Sync) error {
+	imp.RateLimit = sw.RateLimit
+	err := imp.Preper(context.Background())
+	if err != nil {
+		return err
+	}
+	sender := NewSender(imp, types.OPTION_TYPE_UP)
+	conn, err := sender.Send()
+	if err != nil {
+		return err
+	}
+	imp.SetConn(conn)
+	return nil
+}
+
+func (sw *SyncWatcher) push(name string) error {
+	remote, err := sw.remotePath(name)
+	if err != nil {
+		return err
+	}
+	imp := NewSync(sw.HostId, name, remote, sw.BlockSize)
+	err = sw.open(imp)
+	if err != nil {
+		return err
+	}
+	defer imp.Close()
+	res, err := imp.DoPush()
+	if err != nil {
+		return err
+	}
+	logrus.Infof("synced %s: %d bytes matched, %d bytes sent", remote, res.Matched, res.Literal)
+	return nil
+}
+
+func (sw *SyncWatcher) remove(name string) error {
+	remote, err := sw.remotePath(name)
+	if err != nil {
+		return err
+	}
+	imp := NewSync(sw.HostId, name, remote, sw.BlockSize)
+	err = sw.open(imp)
+	if err != nil {
+		return err
+	}
+	defer imp.Close()
+	err = imp.DoDelete()
+	if err == nil {
+		logrus.Info("removed ", remote)
+	}
+	return err
+}
+
+// walk pushes every file below dir and watches all directories
+func (sw *SyncWatcher) walk(dir string) error {
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			logrus.Warn(err)
+			return nil
+		}
+		if info.IsDir() {
+			return sw.watcher.Add(name)
+		}
+		if info.Mode().IsRegular() && !ignoredSyncFile(name) {
+			sw.schedule(name)
+		}
+		return nil
+	})
+}
+
+// schedule queues name and restarts the debounce timer
+func (sw *SyncWatcher) schedule(name string) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+	sw.pending[name] = true
+	if sw.timer != nil {
+		sw.timer.Stop()
+	}
+	sw.timer = time.AfterFunc(sw.Debounce, sw.flush)
+}
+
+func (sw *SyncWatcher) flush() {
+	sw.busy.Lock()
+	defer sw.busy.Unlock()
+	sw.lock.Lock()
+	pending := sw.pending
+	sw.pending = make(map[string]bool)
+	sw.lock.Unlock()
+	for name := range pending {
+		info, err := os.Stat(name)
+		switch {
+		case os.IsNotExist(err):
+			if sw.Delete {
+				err = sw.remove(name)
+			} else {
+				err = nil
+			}
+		case err != nil:
+		case info.Mode().IsRegular():
+			err = sw.push(name)
+		}
+		if err != nil {
+			logrus.Error("sync ", name, ": ", err)
+		}
+	}
+}
+
+// Run pushes the whole directory, then keeps pushing changes until Close
+func (sw *SyncWatcher) Run() error {
+	var err error
+	sw.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer sw.watcher.Close()
+	err = sw.walk(sw.LocalDir)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("watching %s, syncing to %s:%s", sw.LocalDir, sw.HostId, sw.RemoteDir)
+	for {
+		select {
+		case <-sw.stop:
+			return nil
+		case err := <-sw.watcher.Errors:
+			logrus.Error(err)
+		case ev, ok := <-sw.watcher.Events:
+			if !ok {
+				return nil
+			}
+			if ignoredSyncFile(ev.Name) || ev.Op == fsnotify.Chmod {
+				continue
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+					// new directories are watched and their content pushed
+					err = sw.walk(ev.Name)
+					if err != nil {
+						logrus.Error(err)
+					}
+					continue
+				}
+			}
+			sw.schedule(ev.Name)
+		}
+	}
+}
+
+func (sw *SyncWatcher) Close() {
+	close(sw.stop)
+}
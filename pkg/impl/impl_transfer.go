@@ -1,6 +1,8 @@
 package impl
 
 import (
+	"bufio"
+	"context"
 	"encoding/gob"
 	"fmt"
 	"io"
@@ -8,15 +10,18 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/schollz/progressbar/v3"
 	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/types"
 )
 
 const (
 	TYPE_UPLOAD = iota
 	TYPE_DOWNLOAD
+	TYPE_STAT
 )
 
 type FileInfo struct {
@@ -24,8 +29,14 @@ type FileInfo struct {
 	Size       int64
 	OptionType int32
 	Ready      bool
+	// Offset and Length select a chunk of the file, zero Length means whole file
+	Offset int64
+	Length int64
 }
 
+// maxFileInfoSize bounds an encoded FileInfo, file names are short
+const maxFileInfoSize = 16 << 10
+
 type TransferStatus struct {
 	Status int32
 }
@@ -36,6 +47,14 @@ type Transfer struct {
 	Upload   bool
 	Size     int64
 	FileName string
+	Offset   int64
+	Length   int64
+	// RateLimit caps the throughput in bytes per second, 0 means unlimited
+	RateLimit int64
+	statOnly  bool
+	bar       *progressbar.ProgressBar
+	// reader keeps bytes buffered by the header decoder
+	reader *bufio.Reader
 }
 
 func NewTransfer(hostId string, filePath string, upload bool, header *multipart.FileHeader) *Transfer {
@@ -54,6 +73,33 @@ func NewTransfer(hostId string, filePath string, upload bool, header *multipart.
 	return ret
 }
 
+// downloadDir returns the directory of downloaded files
+func downloadDir(tc conf.TransferConf) string {
+	dir := tc.DownloadDir
+	if dir == "" {
+		return filepath.Join(os.Getenv("HOME"), "Downloads")
+	}
+	if strings.HasPrefix(dir, "~") {
+		dir = filepath.Join(os.Getenv("HOME"), dir[1:])
+	}
+	return dir
+}
+
+// localDownloadDir returns the download directory of this device, created
+// if missing
+func localDownloadDir() string {
+	var tc conf.TransferConf
+	cm, err := conf.Shared()
+	if err != nil {
+		logrus.Warn(err)
+	} else {
+		tc = cm.Conf.TransferConf
+	}
+	dir := downloadDir(tc)
+	os.MkdirAll(dir, 0755)
+	return dir
+}
+
 func (tr *Transfer) Code() int32 {
 	return types.APP_TYPE_TRANSFER
 }
@@ -62,8 +108,12 @@ func (tr *Transfer) sendHeader() (FileInfo, error) {
 	info := FileInfo{
 		Name:       tr.FilePath,
 		OptionType: TYPE_DOWNLOAD,
+		Offset:     tr.Offset,
+		Length:     tr.Length,
 	}
-	if tr.Upload {
+	if tr.statOnly {
+		info.OptionType = TYPE_STAT
+	} else if tr.Upload {
 		info.OptionType = TYPE_UPLOAD
 		if tr.Size > 0 && tr.FileName != "" {
 			info.Size = tr.Size
@@ -71,7 +121,7 @@ func (tr *Transfer) sendHeader() (FileInfo, error) {
 		} else {
 			fInfo, err := os.Stat(tr.FilePath)
 			if err != nil {
-				logrus.Error(err)
+				Log(tr).Error(err)
 				return info, err
 			}
 			info.Size = fInfo.Size()
@@ -83,7 +133,8 @@ func (tr *Transfer) sendHeader() (FileInfo, error) {
 	if err != nil {
 		return info, err
 	}
-	err = gob.NewDecoder(tr.Conn()).Decode(&info)
+	tr.reader = bufio.NewReader(tr.Conn())
+	err = types.DecodeLimited(tr.reader, maxFileInfoSize, &info)
 	if err != nil {
 		return info, err
 	}
@@ -92,25 +143,44 @@ func (tr *Transfer) sendHeader() (FileInfo, error) {
 
 func (tr *Transfer) recvHeader(conn net.Conn) (FileInfo, error) {
 	info := FileInfo{}
-	err := gob.NewDecoder(conn).Decode(&info)
+	err := types.DecodeLimited(conn, maxFileInfoSize, &info)
+	if err == nil && (info.Size < 0 || info.Offset < 0 || info.Length < 0) {
+		err = fmt.Errorf("invalid file header of %s", tr.HostId())
+	}
 	if err != nil {
-		logrus.Error(err)
+		Log(tr).Error(err)
 		return info, err
 	}
 
-	if info.OptionType == TYPE_DOWNLOAD {
-		tr.FilePath = info.Name
-		fInfo, err := os.Stat(tr.FilePath)
-		if err != nil {
-			logrus.Error(err, tr.FilePath)
-			return info, err
+	sb, err := newSandbox(tr.HostId(), tr.readOnly)
+	if err != nil {
+		// nothing is served without the sandbox of the peer
+		info.Ready = false
+	} else if info.OptionType == TYPE_DOWNLOAD || info.OptionType == TYPE_STAT {
+		info.Ready = false
+		tr.FilePath, err = sb.resolve(info.Name, false)
+		if err == nil {
+			var fInfo os.FileInfo
+			fInfo, err = os.Stat(tr.FilePath)
+			if err == nil {
+				info.Size = fInfo.Size()
+				info.Ready = info.Length <= info.Size-info.Offset
+			}
 		}
-		info.Size = fInfo.Size()
-		info.Ready = true
+	} else if info.Length > 0 && info.Length > info.Size-info.Offset {
+		// a chunk must lie within the file the uploader announces
+		info.Ready = false
+		err = fmt.Errorf("chunk %d+%d out of a file of %d bytes", info.Offset, info.Length, info.Size)
+	} else {
+		tr.FilePath, err = sb.resolve(info.Name, true)
+		info.Ready = info.Ready && err == nil
+	}
+	if err != nil {
+		Log(tr).Error(err, " ", info.Name)
 	}
 	err = gob.NewEncoder(conn).Encode(&info)
 	if err != nil {
-		logrus.Error(err)
+		Log(tr).Error(err)
 		return info, err
 	}
 	return info, nil
@@ -125,45 +195,80 @@ func (tr *Transfer) doResponse(s net.Conn) error {
 		return fmt.Errorf("remote not ready")
 	}
 	switch info.OptionType {
+	case TYPE_STAT:
+		s.Close()
+		return nil
 	case TYPE_DOWNLOAD:
-		logrus.Debug("response download")
+		Log(tr).Debug("response download")
 		file, err := os.Open(tr.FilePath)
 		if err != nil {
-			logrus.Error(err)
+			Log(tr).Error(err)
 			return err
 		}
 		defer file.Close()
+		var reader io.Reader = file
+		size := info.Size
+		if info.Length > 0 {
+			reader = io.NewSectionReader(file, info.Offset, info.Length)
+			size = info.Length
+		}
 		bar := progressbar.DefaultBytes(
-			info.Size,
+			size,
 			"update",
 		)
-		_, err = io.Copy(io.MultiWriter(s, bar), file)
+		_, err = io.Copy(io.MultiWriter(s, bar), reader)
 		s.Close()
 		return err
 	case TYPE_UPLOAD:
-		logrus.Debug("response upload")
-		file, err := os.Create(filepath.Join(os.Getenv("HOME"), "Downloads", info.Name))
+		Log(tr).Debug("response upload")
+		fileName := tr.FilePath
+		if info.Length > 0 {
+			Log(tr).Debugf("response upload chunk %d+%d", info.Offset, info.Length)
+			file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				Log(tr).Error(err)
+				return err
+			}
+			defer file.Close()
+			err = file.Truncate(info.Size)
+			if err != nil {
+				return err
+			}
+			bar := progressbar.DefaultBytes(
+				info.Length,
+				"download",
+			)
+			n, err := io.Copy(io.MultiWriter(&offsetWriter{file, info.Offset}, bar), io.LimitReader(s, info.Length))
+			if err == nil && n != info.Length {
+				err = fmt.Errorf("short chunk %d+%d: got %d bytes", info.Offset, info.Length, n)
+			}
+			return err
+		}
+		file, err := os.Create(fileName)
 		if err != nil {
-			logrus.Error(err)
+			Log(tr).Error(err)
 			return err
 		}
-		logrus.Debug("file created")
+		Log(tr).Debug("file created")
 		defer file.Close()
 		bar := progressbar.DefaultBytes(
 			info.Size,
 			"download",
 		)
-		_, err = io.Copy(io.MultiWriter(file, bar), s)
+		n, err := io.Copy(io.MultiWriter(file, bar), s)
+		if err == nil && n != info.Size {
+			err = fmt.Errorf("short upload of %s: got %d of %d bytes", info.Name, n, info.Size)
+		}
 		return err
 	default:
-		logrus.Error("invalid file option type for ", info.OptionType)
+		Log(tr).Error("invalid file option type for ", info.OptionType)
 	}
 	// progress
 	return nil
 
 }
 
-func (tr *Transfer) Response() error {
+func (tr *Transfer) Response(ctx context.Context) error {
 	s, c := net.Pipe()
 	tr.lock.Lock()
 	tr.BaseImpl.conn = &c
@@ -171,21 +276,28 @@ func (tr *Transfer) Response() error {
 	go func() {
 		err := tr.doResponse(s)
 		if err != nil {
-			logrus.Error("do response ", err)
+			Log(tr).Error("do response ", err)
 		}
 	}()
 	return nil
 }
 
+func (tr *Transfer) progress(size int64, description string) *progressbar.ProgressBar {
+	if tr.bar != nil {
+		return tr.bar
+	}
+	return progressbar.DefaultBytes(size, description)
+}
+
 func (tr *Transfer) DoUpload(reader io.Reader) error {
 	info, err := tr.sendHeader()
 	if err != nil {
 		return err
 	}
-	bar := progressbar.DefaultBytes(
-		info.Size,
-		"upload",
-	)
+	if !info.Ready {
+		return fmt.Errorf("remote not ready")
+	}
+	bar := tr.progress(info.Size, "upload")
 
 	if reader == nil {
 		file, err := os.Open(tr.FilePath)
@@ -193,15 +305,22 @@ func (tr *Transfer) DoUpload(reader io.Reader) error {
 			return err
 		}
 		defer file.Close()
-		n, err := io.Copy(io.MultiWriter(tr.Conn(), bar), file)
-		logrus.Debug("stop process upload ", err, n)
+		var src io.Reader = file
+		if tr.Length > 0 {
+			src = io.NewSectionReader(file, tr.Offset, tr.Length)
+		}
+		n, err := io.Copy(io.MultiWriter(tr.Conn(), bar), src)
+		Log(tr).Debug("stop process upload ", err, n)
+		if err == nil && tr.Length > 0 && n != tr.Length {
+			err = fmt.Errorf("short chunk %d+%d: sent %d bytes", tr.Offset, tr.Length, n)
+		}
 		// time.Sleep(5 * time.Second)
 		return err
 	} else {
 		n, err := io.Copy(io.MultiWriter(tr.Conn(), bar), reader)
-		logrus.Warn("use file discriber and do noting", n, err)
+		Log(tr).Debug("stop process upload ", err, n)
+		return err
 	}
-	return nil
 }
 
 func (tr *Transfer) DoDownload(writer io.Writer) error {
@@ -209,27 +328,35 @@ func (tr *Transfer) DoDownload(writer io.Writer) error {
 	if err != nil {
 		return err
 	}
-	bar := progressbar.DefaultBytes(
-		info.Size,
-		"download",
-	)
+	if !info.Ready {
+		return fmt.Errorf("remote not ready")
+	}
+	bar := tr.progress(info.Size, "download")
+	// the responder sends the chunk asked for, or the whole file
+	want := info.Size
+	if tr.Length > 0 {
+		want = tr.Length
+	}
 	if writer == nil {
-		file, err := os.Create(filepath.Join(os.Getenv("HOME"), "Downloads", filepath.Base(info.Name)))
+		file, err := os.Create(filepath.Join(localDownloadDir(), filepath.Base(info.Name)))
 		if err != nil {
-			logrus.Error(err)
+			Log(tr).Error(err)
 			return err
 		}
 		defer file.Close()
-		io.Copy(io.MultiWriter(file, bar), tr.Conn())
-	} else {
-		io.Copy(io.MultiWriter(writer, bar), tr.Conn())
+		writer = file
 	}
-	return nil
+	n, err := io.CopyN(io.MultiWriter(writer, bar), tr.reader, want)
+	if err == io.EOF {
+		err = fmt.Errorf("short download of %s: got %d of %d bytes", info.Name, n, want)
+	}
+	return err
 }
 
-func (tr *Transfer) Close() {
+func (tr *Transfer) Close() error {
 	tr.BaseImpl.Close()
 	if tr.conn != nil {
 		tr.Conn().Close()
 	}
+	return nil
 }
@@ -0,0 +1,166 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// offsetWriter writes sequentially into a file starting at a given offset
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (ow *offsetWriter) Write(b []byte) (int, error) {
+	n, err := ow.file.WriteAt(b, ow.offset)
+	ow.offset += int64(n)
+	return n, err
+}
+
+type chunk struct {
+	offset int64
+	length int64
+}
+
+func splitChunks(size int64, parallel int) []chunk {
+	if parallel < 1 {
+		parallel = 1
+	}
+	step := size / int64(parallel)
+	if size%int64(parallel) != 0 {
+		step++
+	}
+	ret := make([]chunk, 0, parallel)
+	for off := int64(0); off < size; off += step {
+		length := step
+		if off+length > size {
+			length = size - off
+		}
+		ret = append(ret, chunk{off, length})
+	}
+	return ret
+}
+
+// runTransfer opens a connection for tr and runs fn over it
+func runTransfer(tr *Transfer, fn func() error) error {
+	defer tr.Close()
+	err := tr.Preper(context.Background())
+	if err != nil {
+		return err
+	}
+	sender := NewSender(tr, types.OPTION_TYPE_UP)
+	if sender == nil {
+		return fmt.Errorf("cannot create sender")
+	}
+	conn, err := sender.Send()
+	if err != nil {
+		return err
+	}
+	tr.SetConn(conn)
+	return fn()
+}
+
+// RemoteFileSize asks the remote device for the size of a file
+func RemoteFileSize(hostId, filePath string) (int64, error) {
+	tr := NewTransfer(hostId, filePath, false, nil)
+	tr.statOnly = true
+	var size int64
+	err := runTransfer(tr, func() error {
+		info, err := tr.sendHeader()
+		if err != nil {
+			return err
+		}
+		if !info.Ready {
+			return fmt.Errorf("remote not ready")
+		}
+		size = info.Size
+		return nil
+	})
+	return size, err
+}
+
+func waitChunks(errCh chan error, count int) error {
+	var ret error
+	for i := 0; i < count; i++ {
+		if err := <-errCh; err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// chunkRate shares a rate limit between the chunks of a parallel transfer
+func chunkRate(rate int64, count int) int64 {
+	if rate <= 0 || count <= 1 {
+		return rate
+	}
+	if rate < int64(count) {
+		return 1
+	}
+	return rate / int64(count)
+}
+
+// ParallelUpload splits a local file into chunks which are uploaded over
+// independent connections and reassembled by the remote device, rate caps
+// the total throughput
+func ParallelUpload(hostId, filePath string, parallel int, rate int64) error {
+	fInfo, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	chunks := splitChunks(fInfo.Size(), parallel)
+	logrus.Debugf("upload %s in %d chunks", filePath, len(chunks))
+	bar := progressbar.DefaultBytes(fInfo.Size(), "upload")
+	errCh := make(chan error, len(chunks))
+	for _, c := range chunks {
+		go func(c chunk) {
+			tr := NewTransfer(hostId, filePath, true, nil)
+			tr.Offset = c.offset
+			tr.Length = c.length
+			tr.RateLimit = chunkRate(rate, len(chunks))
+			tr.bar = bar
+			errCh <- runTransfer(tr, func() error {
+				return tr.DoUpload(nil)
+			})
+		}(c)
+	}
+	return waitChunks(errCh, len(chunks))
+}
+
+// ParallelDownload fetches chunks of a remote file of the given size over
+// independent connections and writes them to the local download directory,
+// rate caps the total throughput
+func ParallelDownload(hostId, filePath string, size int64, parallel int, rate int64) error {
+	file, err := os.Create(filepath.Join(localDownloadDir(), filepath.Base(filePath)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = file.Truncate(size)
+	if err != nil {
+		return err
+	}
+	chunks := splitChunks(size, parallel)
+	logrus.Debugf("download %s in %d chunks", filePath, len(chunks))
+	bar := progressbar.DefaultBytes(size, "download")
+	errCh := make(chan error, len(chunks))
+	for _, c := range chunks {
+		go func(c chunk) {
+			tr := NewTransfer(hostId, filePath, false, nil)
+			tr.Offset = c.offset
+			tr.Length = c.length
+			tr.RateLimit = chunkRate(rate, len(chunks))
+			tr.bar = bar
+			errCh <- runTransfer(tr, func() error {
+				return tr.DoDownload(&offsetWriter{file, c.offset})
+			})
+		}(c)
+	}
+	return waitChunks(errCh, len(chunks))
+}
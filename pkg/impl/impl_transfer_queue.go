@@ -0,0 +1,84 @@
+package impl
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"os"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// ListTransfers asks the local daemon for the transfers it is tracking
+func ListTransfers() ([]types.TransferState, error) {
+	imp := &Transfer{}
+	imp.NoNeedConnect()
+	err := imp.Preper(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	sender := NewSender(imp, types.OPTION_TYPE_LIST)
+	conn, err := sender.Send()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var res []types.TransferState
+	err = gob.NewEncoder(conn).Encode(&res)
+	if err != nil {
+		return nil, err
+	}
+	err = gob.NewDecoder(conn).Decode(&res)
+	return res, err
+}
+
+// ControlTransfer sends a pause (OPTION_TYPE_PAUSE), resume (OPTION_TYPE_RESUME)
+// or cancel (OPTION_TYPE_DOWN) request for the transfer identified by pairId
+func ControlTransfer(pairId string, option int32) error {
+	imp := &Transfer{}
+	imp.NoNeedConnect()
+	err := imp.Preper(context.Background())
+	if err != nil {
+		return err
+	}
+	sender := NewSender(imp, option)
+	sender.PairId = []byte(pairId)
+	conn, err := sender.Send()
+	if err != nil {
+		return fmt.Errorf("transfer %s: %v", pairId, err)
+	}
+	conn.Close()
+	return nil
+}
+
+// TransferStateName returns the name of a state of TransferState
+func TransferStateName(state int32) string {
+	switch state {
+	case types.TRANSFER_STATE_QUEUED:
+		return "queued"
+	case types.TRANSFER_STATE_ACTIVE:
+		return "active"
+	case types.TRANSFER_STATE_PAUSED:
+		return "paused"
+	}
+	return "unknown"
+}
+
+func ShowTransfers(states []types.TransferState) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"#", "Pair ID", "Target ID", "File", "Direction", "State", "Bytes", "Start At"})
+	t.AppendSeparator()
+	for k, v := range states {
+		direction := "download"
+		if v.Upload {
+			direction = "upload"
+		}
+		t.AppendRows([]table.Row{
+			{k + 1, v.PairId, v.TargetId, v.FileName, direction, TransferStateName(v.State), v.Bytes, v.StartTime.Format("2 Jan 2006 15:04:05")},
+		})
+	}
+	t.AppendSeparator()
+	t.Render()
+}
@@ -2,6 +2,7 @@ package impl
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -14,9 +15,9 @@ import (
 	"github.com/andybalholm/brotli"
 	"github.com/gorilla/mux"
 	"github.com/schollz/progressbar/v3"
-	"github.com/sirupsen/logrus"
 	"github.com/suutaku/go-qrc/pkg/qrc"
 	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/res"
 	"github.com/suutaku/sshx/pkg/types"
 )
@@ -30,6 +31,10 @@ type TransferService struct {
 	FilePath   string
 	ShowQR     bool
 	TmpPath    string
+	// Parallelism overrides the configured number of chunks for large files
+	Parallelism int32
+	// RateLimit caps the throughput in bytes per second, 0 means unlimited
+	RateLimit int64
 }
 
 func NewTransferService(hostId string, filePath string, upload, qr bool) *TransferService {
@@ -55,7 +60,7 @@ func (trs *TransferService) Start() error {
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		<-c
-		logrus.Debug("ctr+c ", trs.PairId())
+		Log(trs).Debug("ctr+c ", trs.PairId())
 		sender := NewSender(trs, types.OPTION_TYPE_DOWN)
 		sender.PairId = []byte(trs.PairId())
 		sender.SendDetach()
@@ -63,14 +68,20 @@ func (trs *TransferService) Start() error {
 	}()
 
 	if !trs.ShowQR {
-		logrus.Debug("not shown qr code")
+		Log(trs).Debug("not shown qr code")
 		if trs.Upload { // upload case
+			if fInfo, err := os.Stat(trs.FilePath); err == nil {
+				if parallel := trs.parallelism(fInfo.Size()); parallel > 1 {
+					return ParallelUpload(trs.HostId(), trs.FilePath, parallel, trs.RateLimit)
+				}
+			}
 			transfer := NewTransfer(trs.HostId(), trs.FilePath, true, nil)
 			if transfer == nil {
 				return fmt.Errorf("cannot create transfer")
 			}
+			transfer.RateLimit = trs.RateLimit
 			defer transfer.Close()
-			err := transfer.Preper()
+			err := transfer.Preper(context.Background())
 			if err != nil {
 				return err
 			}
@@ -87,12 +98,22 @@ func (trs *TransferService) Start() error {
 			return nil
 
 		} else {
+			if trs.parallelism(-1) > 1 {
+				size, err := RemoteFileSize(trs.HostId(), trs.FilePath)
+				if err != nil {
+					return err
+				}
+				if parallel := trs.parallelism(size); parallel > 1 {
+					return ParallelDownload(trs.HostId(), trs.FilePath, size, parallel, trs.RateLimit)
+				}
+			}
 			transfer := NewTransfer(trs.HostId(), trs.FilePath, false, nil)
 			if transfer == nil {
 				return fmt.Errorf("cannot create transfer")
 			}
+			transfer.RateLimit = trs.RateLimit
 			defer transfer.Close()
-			err := transfer.Preper()
+			err := transfer.Preper(context.Background())
 			if err != nil {
 				return err
 			}
@@ -117,7 +138,7 @@ func (trs *TransferService) Start() error {
 		entryType = TYPE_UPLOAD
 	}
 	trs.ServerAddr = fmt.Sprintf("http://%s:%d/%s", utils.GetLocalIP(), trs.ServerPort, entryUrl)
-	logrus.Debug(trs.ServerAddr)
+	Log(trs).Debug(trs.ServerAddr)
 
 	r.HandleFunc("/"+upUrlEntry, func(w http.ResponseWriter, r *http.Request) {
 		// 	page := `<html>
@@ -145,7 +166,7 @@ func (trs *TransferService) Start() error {
 
 		finfo, err := os.Stat(tmpFilePath)
 		if os.IsNotExist(err) {
-			logrus.Debug("tmp file ", tmpFilePath, " not exist")
+			Log(trs).Debug("tmp file ", tmpFilePath, " not exist")
 			tf, err := os.Create(tmpFilePath)
 			if err != nil {
 				w.Write([]byte(err.Error()))
@@ -158,16 +179,17 @@ func (trs *TransferService) Start() error {
 				w.Write([]byte("cannot create transfer"))
 				return
 			}
+			transfer.RateLimit = trs.RateLimit
 			defer transfer.Close()
-			err = transfer.Preper()
+			err = transfer.Preper(context.Background())
 			if err != nil {
-				logrus.Error(err)
+				Log(trs).Error(err)
 				return
 			}
 			sender := NewSender(transfer, types.OPTION_TYPE_UP)
 			conn, err := sender.Send()
 			if err != nil {
-				logrus.Error(err)
+				Log(trs).Error(err)
 				return
 			}
 			mw := io.MultiWriter(w, tf)
@@ -179,7 +201,7 @@ func (trs *TransferService) Start() error {
 			}
 
 		} else {
-			logrus.Debug("tmp file ", tmpFilePath, " already exist")
+			Log(trs).Debug("tmp file ", tmpFilePath, " already exist")
 			tf, err := os.Open(tmpFilePath)
 			if err != nil {
 				w.Write([]byte(err.Error()))
@@ -193,10 +215,10 @@ func (trs *TransferService) Start() error {
 			mw := io.MultiWriter(w, bar)
 			io.Copy(mw, tf)
 		}
-		logrus.Debug("end of gorutine ", err)
+		Log(trs).Debug("end of gorutine ", err)
 	})
 	r.HandleFunc("/"+upUrl, func(w http.ResponseWriter, r *http.Request) {
-		logrus.Debug("new update request come")
+		Log(trs).Debug("new update request come")
 		file, header, err := r.FormFile("xcontent")
 		if err != nil {
 			w.Write([]byte(err.Error()))
@@ -207,16 +229,17 @@ func (trs *TransferService) Start() error {
 			w.Write([]byte("cannot create transfer at /upload "))
 			return
 		}
+		transfer.RateLimit = trs.RateLimit
 		defer transfer.Close()
-		err = transfer.Preper()
+		err = transfer.Preper(context.Background())
 		if err != nil {
-			logrus.Error(err)
+			Log(trs).Error(err)
 			return
 		}
 		sender := NewSender(transfer, types.OPTION_TYPE_UP)
 		conn, err := sender.Send()
 		if err != nil {
-			logrus.Error("sender: ", err)
+			Log(trs).Error("sender: ", err)
 			return
 		}
 		transfer.SetConn(conn)
@@ -228,7 +251,7 @@ func (trs *TransferService) Start() error {
 
 		msg := fmt.Sprintf("upload %s (%d) success!", header.Filename, header.Size)
 		w.Write([]byte(msg))
-		logrus.Debug("end of gorutine")
+		Log(trs).Debug("end of gorutine")
 	})
 	trs.server = &http.Server{Addr: fmt.Sprintf(":%d", trs.ServerPort), Handler: r}
 	if entryType == TYPE_DOWNLOAD {
@@ -244,11 +267,31 @@ func (trs *TransferService) Start() error {
 	return nil
 }
 
+// parallelism returns how many chunks a file of the given size is split into,
+// a negative size only checks if parallel transfer is enabled at all
+func (trs *TransferService) parallelism(size int64) int {
+	var tc conf.TransferConf
+	cm, err := conf.Shared()
+	if err != nil {
+		Log(trs).Error(err)
+	} else {
+		tc = cm.Conf.TransferConf
+	}
+	parallel := trs.Parallelism
+	if parallel <= 0 {
+		parallel = tc.Parallelism
+	}
+	if parallel <= 1 || (size >= 0 && size < tc.ParallelThreshold) {
+		return 1
+	}
+	return int(parallel)
+}
+
 func (trs *TransferService) Code() int32 {
 	return types.APP_TYPE_TRANSFER_SERVICE
 }
 
-func (trs *TransferService) Close() {
+func (trs *TransferService) Close() error {
 	if trs.server != nil {
 		trs.server.Close()
 	}
@@ -256,4 +299,5 @@ func (trs *TransferService) Close() {
 	if trs.conn != nil {
 		trs.Conn().Close()
 	}
+	return nil
 }
@@ -1,21 +1,35 @@
 package impl
 
 import (
+	"context"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 
 	"github.com/gorilla/websocket"
-	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
 	"github.com/suutaku/sshx/pkg/conf"
 	"github.com/suutaku/sshx/pkg/types"
 )
 
 type VNC struct {
 	BaseImpl
+	// Token is the password or session token checked by the remote VNC service
+	Token string
+	// ViewOnly asks the remote service to ignore keyboard and pointer input
+	ViewOnly bool
+	// Encodings, Quality and Compression replace the viewer preferences, see
+	// conf.VNCQualityConf
+	Encodings   []string
+	Quality     int32
+	Compression int32
 }
 
 func NewVNC(hostId string) *VNC {
 	return &VNC{
-		*NewBaseImpl(hostId),
+		BaseImpl: *NewBaseImpl(hostId),
 	}
 }
 
@@ -23,21 +37,160 @@ func (vnc *VNC) Code() int32 {
 	return types.APP_TYPE_VNC
 }
 
-func (vnc *VNC) Dial() error {
+func (vnc *VNC) Dial(ctx context.Context) error {
 	return nil
 }
 
-func (vnc *VNC) Response() error {
-	vnc.lock.Unlock()
-	defer vnc.lock.Unlock()
-	cm := conf.NewConfManager("")
-	localAddr := fmt.Sprintf("ws://%s:%d", cm.Conf.VNCConf.Websockify.Host, cm.Conf.VNCConf.Websockify.Port)
-	logrus.Debug("VNCResponser response ", localAddr)
-	vncConn, _, err := websocket.DefaultDialer.Dial(localAddr, nil)
+// maxVNCAuthSize bounds an encoded VNCAuthRequest or VNCAuthReply. They are
+// decoded byte by byte, so nothing of the VNC stream is buffered away.
+const maxVNCAuthSize = 4 << 10
+
+// Authorize sends the credential to the remote VNC service over the
+// connection set by SetConn, it must be called before the VNC stream starts
+func (vnc *VNC) Authorize() error {
+	err := gob.NewEncoder(vnc.Conn()).Encode(VNCAuthRequest{Token: vnc.Token, ViewOnly: vnc.ViewOnly})
+	if err != nil {
+		return err
+	}
+	var reply VNCAuthReply
+	err = types.DecodeLimited(vnc.Conn(), maxVNCAuthSize, &reply)
+	if err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
+
+// Serve bridges the websocket of a viewer to the remote VNC service over the
+// connection set by SetConn, until one side closes
+func (vnc *VNC) Serve(ws *websocket.Conn) error {
+	var filter func([]byte) ([]byte, error)
+	if rf := newRFBFilter(vnc.Encodings, vnc.Quality, vnc.Compression); rf != nil {
+		filter = rf.Filter
+	}
+	return pipeWebsocket(vnc.Conn(), ws, filter, nil)
+}
+
+// pipeWebsocket copies the messages of ws to conn and the data of conn back
+// as binary messages, so only the RFB stream travels between peers. wsFilter
+// and connFilter rewrite the data read from ws and conn if not nil.
+func pipeWebsocket(conn net.Conn, ws *websocket.Conn, wsFilter, connFilter func([]byte) ([]byte, error)) error {
+	return pipeRFB(conn, &wsStream{ws: ws}, wsFilter, connFilter)
+}
+
+// pipeRFB copies the RFB stream between conn and the server up until one
+// side closes, upFilter and connFilter rewrite the data read from up and
+// conn if not nil
+func pipeRFB(conn net.Conn, up io.ReadWriteCloser, upFilter, connFilter func([]byte) ([]byte, error)) error {
+	errCh := make(chan error, 2)
+	copyFiltered := func(dst io.Writer, src io.Reader, filter func([]byte) ([]byte, error)) {
+		pooled := utils.GetBuffer()
+		defer utils.PutBuffer(pooled)
+		buf := *pooled
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				data := buf[:n]
+				if filter != nil {
+					var ferr error
+					data, ferr = filter(data)
+					if ferr != nil {
+						errCh <- ferr
+						return
+					}
+				}
+				if len(data) > 0 {
+					_, werr := dst.Write(data)
+					if werr != nil {
+						errCh <- werr
+						return
+					}
+				}
+			}
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}
+	go copyFiltered(conn, up, upFilter)
+	go copyFiltered(up, conn, connFilter)
+	err := <-errCh
+	conn.Close()
+	up.Close()
+	if err == io.EOF || websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		return nil
+	}
+	return err
+}
+
+func (vnc *VNC) doResponse(s net.Conn) error {
+	defer s.Close()
+	var req VNCAuthRequest
+	err := types.DecodeLimited(s, maxVNCAuthSize, &req)
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(s)
+	viewOnly, err := checkVNCCredential(req.Token)
 	if err != nil {
+		enc.Encode(VNCAuthReply{Error: err.Error()})
+		return fmt.Errorf("%s: %v", vnc.HostId(), err)
+	}
+	viewOnly = viewOnly || req.ViewOnly || vnc.viewOnly
+	cm, err := conf.Shared()
+	if err != nil {
+		enc.Encode(VNCAuthReply{Error: err.Error()})
 		return err
 	}
-	unerConn := vncConn.UnderlyingConn()
-	vnc.BaseImpl.conn = &unerConn
+	rec := newFBSRecorder(vnc.HostId())
+	defer rec.Close()
+	if cm.Conf.VNCSessionConf.Shared {
+		viewer, err := sharedVNC.join(s, viewOnly, cm.Conf.VNCSessionConf.MaxViewers, rec)
+		if err != nil {
+			enc.Encode(VNCAuthReply{Error: err.Error()})
+			return err
+		}
+		Log(vnc).Debug("attach ", vnc.HostId(), " to shared vnc session, view only ", viewOnly)
+		// a failed reply breaks the stream, serve notices it in the handshake
+		enc.Encode(VNCAuthReply{})
+		return sharedVNC.serve(viewer)
+	}
+	vncConn, err := dialVNCServer(cm)
+	if err != nil {
+		enc.Encode(VNCAuthReply{Error: err.Error()})
+		return err
+	}
+	err = enc.Encode(VNCAuthReply{})
+	if err != nil {
+		vncConn.Close()
+		return err
+	}
+	var record, filter func([]byte) ([]byte, error)
+	if rec != nil {
+		record = func(data []byte) ([]byte, error) {
+			rec.Write(data)
+			return data, nil
+		}
+	}
+	if viewOnly {
+		filter = newViewOnlyFilter().Filter
+	}
+	return pipeRFB(s, vncConn, record, filter)
+}
+
+func (vnc *VNC) Response(ctx context.Context) error {
+	s, c := net.Pipe()
+	vnc.lock.Lock()
+	vnc.BaseImpl.conn = &c
+	vnc.lock.Unlock()
+	go func() {
+		err := vnc.doResponse(s)
+		if err != nil {
+			Log(vnc).Error("do response ", err)
+		}
+	}()
 	return nil
 }
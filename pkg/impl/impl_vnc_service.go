@@ -2,12 +2,18 @@ package impl
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"fmt"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"github.com/sirupsen/logrus"
 	vncconf "github.com/suutaku/go-vnc/pkg/config"
 	vncgo "github.com/suutaku/go-vnc/pkg/vnc"
 	"github.com/suutaku/sshx/internal/utils"
@@ -23,6 +29,19 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// localVNCService is the VNC service running on this node, viewers of the
+// shared session restart its server to resize the desktop
+var localVNCService struct {
+	lock sync.Mutex
+	svc  *VNCService
+}
+
+func runningVNCService() *VNCService {
+	localVNCService.lock.Lock()
+	defer localVNCService.lock.Unlock()
+	return localVNCService.svc
+}
+
 type VNCService struct {
 	BaseImpl
 	Running       bool
@@ -30,6 +49,7 @@ type VNCService struct {
 	VNCConf       *vncconf.Configure
 	httpServer    *http.Server
 	vncServer     *vncgo.VNC
+	display       *vncDisplay
 }
 
 func NewVNCService(conf *vncconf.Configure) *VNCService {
@@ -43,17 +63,98 @@ func (vnc *VNCService) Code() int32 {
 }
 
 func (vnc *VNCService) serviceIsRuning(port int32) bool {
-	res, err := http.Head(fmt.Sprintf("http://127.0.0.1:%d", port))
-	if err == nil && res.StatusCode == 200 {
-		logrus.Warn("vnc server was already runing")
+	// any answer means the port is taken, the certificate may be self-signed
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for _, scheme := range []string{"http", "https"} {
+		res, err := client.Head(fmt.Sprintf("%s://127.0.0.1:%d", scheme, port))
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+		Log(vnc).Warn("vnc server was already runing")
 		return true
 	}
 	return false
 }
 
-func (vnc *VNCService) Dial() error {
+// VNCWebCert loads the certificate of the noVNC web interface, a self-signed
+// one is created in the sshx home if no certificate is configured
+func VNCWebCert(wc conf.VNCWebConf) (tls.Certificate, error) {
+	certFile, keyFile := wc.CertFile, wc.KeyFile
+	if certFile == "" || keyFile == "" {
+		certFile = filepath.Join(utils.GetSSHXStateHome(), "vnc_cert.pem")
+		keyFile = filepath.Join(utils.GetSSHXStateHome(), "vnc_key.pem")
+		return utils.LoadOrCreateCert(certFile, keyFile, "sshx vnc")
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// basicAuth wraps next with HTTP basic auth if a user is configured
+func basicAuth(wc conf.VNCWebConf, next http.Handler) http.Handler {
+	if wc.BasicAuthUser == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(wc.BasicAuthUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(wc.BasicAuthPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="sshx vnc"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// applyQuality sets the encoding preferences of imp from the configuration,
+// the encodings, quality and compression query parameters override them
+func (vnc *VNCService) applyQuality(imp *VNC, query url.Values, qc conf.VNCQualityConf) {
+	imp.Encodings = qc.Encodings
+	imp.Quality = qc.Quality
+	imp.Compression = qc.Compression
+	if v := query.Get("encodings"); v != "" {
+		imp.Encodings = strings.Split(v, ",")
+	}
+	if v, err := strconv.Atoi(query.Get("quality")); err == nil {
+		imp.Quality = int32(v)
+	}
+	if v, err := strconv.Atoi(query.Get("compression")); err == nil {
+		imp.Compression = int32(v)
+	}
+}
+
+// bridgeClipboard keeps the local clipboard in sync with the remote desktop
+// of a VNC session until the returned impl is closed
+func (vnc *VNCService) bridgeClipboard(hostId, parentId string, cc conf.ClipboardConf) *Clipboard {
+	clip := NewClipboard(hostId, cc.Images)
+	go func() {
+		err := clip.Preper(context.Background())
+		if err != nil {
+			Log(vnc).Error(err)
+			return
+		}
+		clip.SetParentId(parentId)
+		conn, err := NewSender(clip, types.OPTION_TYPE_UP).Send()
+		if err != nil {
+			Log(vnc).Debug("vnc clipboard ", err)
+			return
+		}
+		clip.SetConn(conn)
+		err = clip.DoWatch()
+		if err != nil {
+			Log(vnc).Debug("vnc clipboard ", err)
+		}
+	}()
+	return clip
+}
+
+func (vnc *VNCService) Dial(ctx context.Context) error {
 	vnc.Running = true
-	cm := conf.NewConfManager("")
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
 	if vnc.VNCConf == nil {
 		vnc.VNCConf = &cm.Conf.VNCConf
 	}
@@ -64,56 +165,126 @@ func (vnc *VNCService) Dial() error {
 	r.Handle("/", http.FileServer(http.Dir(cm.Conf.VNCStaticPath)))
 	r.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		deviceId := r.URL.Query()["device"]
-		logrus.Debug(deviceId)
+		Log(vnc).Debug(deviceId)
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			logrus.Error(err)
+			Log(vnc).Error(err)
 			return
 		}
 		defer conn.Close()
 		imp := NewVNC(deviceId[0])
-		err = imp.Preper()
+		imp.Token = r.URL.Query().Get("token")
+		imp.SetOneTimeCode(r.URL.Query().Get("otp"))
+		imp.ViewOnly, _ = strconv.ParseBool(r.URL.Query().Get("view_only"))
+		vnc.applyQuality(imp, r.URL.Query(), cm.Conf.VNCQualityConf)
+		err = imp.Preper(ctx)
 		if err != nil {
-			logrus.Error(err)
+			Log(vnc).Error(err)
 			return
 		}
 		imp.SetParentId(vnc.PairId())
 		sender := NewSender(imp, types.OPTION_TYPE_UP)
 		if sender == nil {
-			logrus.Error("cannot create sender")
+			Log(vnc).Error("cannot create sender")
 			return
 		}
 		inConn, err := sender.Send()
 		if err != nil {
-			logrus.Error(err)
+			Log(vnc).Error(err)
 			return
 		}
-		defer conn.Close()
-		underConn := conn.UnderlyingConn()
-		utils.Pipe(&inConn, &underConn)
-		logrus.Debug("end of gorutine")
+		imp.SetConn(inConn)
+		err = imp.Authorize()
+		if err != nil {
+			Log(vnc).Error(err)
+			inConn.Close()
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+			return
+		}
+		if cm.Conf.ClipboardConf.VNCSessions {
+			clip := vnc.bridgeClipboard(deviceId[0], imp.PairId(), cm.Conf.ClipboardConf)
+			defer clip.Close()
+		}
+		err = imp.Serve(conn)
+		if err != nil {
+			Log(vnc).Debug("vnc session ", err)
+		}
+		Log(vnc).Debug("end of gorutine")
 
 	})
-	logrus.Info("servce http at port ", cm.Conf.LocalHTTPPort)
-	srv := &http.Server{Addr: fmt.Sprintf(":%d", cm.Conf.LocalHTTPPort), Handler: r}
+	wc := cm.Conf.VNCWebConf
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", cm.Conf.LocalHTTPPort), Handler: basicAuth(wc, r)}
+	if wc.TLS {
+		cert, err := VNCWebCert(wc)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		Log(vnc).Info("certificate fingerprint (SHA-256) ", utils.CertFingerprint(cert))
+	}
 	vnc.httpServer = srv
-	vnc.vncServer = vncgo.NewVNC(context.Background(), *vnc.VNCConf)
+	dc := cm.Conf.VNCDisplayConf
+	display, err := startVNCDisplay(dc)
+	if err != nil {
+		return err
+	}
+	vnc.lock.Lock()
+	vnc.display = display
+	if builtinVNCServer(dc) {
+		vnc.vncServer = vncgo.NewVNC(context.Background(), *vnc.VNCConf)
+		go vnc.vncServer.Start()
+	}
+	vnc.lock.Unlock()
+	localVNCService.lock.Lock()
+	localVNCService.svc = vnc
+	localVNCService.lock.Unlock()
+	if wc.TLS {
+		Log(vnc).Info("servce https at port ", cm.Conf.LocalHTTPPort)
+		srv.ListenAndServeTLS("", "")
+	} else {
+		Log(vnc).Info("servce http at port ", cm.Conf.LocalHTTPPort)
+		srv.ListenAndServe()
+	}
+	return nil
+}
+
+// restartServer replaces the VNC server by one with a framebuffer of
+// width x height, sessions of the old server keep running until closed
+func (vnc *VNCService) restartServer(width, height int) error {
+	vnc.lock.Lock()
+	defer vnc.lock.Unlock()
+	if vnc.vncServer == nil || vnc.VNCConf == nil {
+		return fmt.Errorf("vnc server is not running")
+	}
+	vc := *vnc.VNCConf
+	vc.Resolution.Width = int32(width)
+	vc.Resolution.Height = int32(height)
+	vnc.vncServer.Close()
+	vnc.vncServer = vncgo.NewVNC(context.Background(), vc)
 	go vnc.vncServer.Start()
-	srv.ListenAndServe()
 	return nil
 }
 
-func (vnc *VNCService) Response() error {
+func (vnc *VNCService) Response(ctx context.Context) error {
 	return nil
 }
 
-func (vnc *VNCService) Close() {
+func (vnc *VNCService) Close() error {
+	localVNCService.lock.Lock()
+	if localVNCService.svc == vnc {
+		localVNCService.svc = nil
+	}
+	localVNCService.lock.Unlock()
+	vnc.lock.Lock()
+	defer vnc.lock.Unlock()
 	if vnc.vncServer != nil {
-		logrus.Debug("close vnc server")
+		Log(vnc).Debug("close vnc server")
 		vnc.vncServer.Close()
 	}
+	vnc.display.Close()
 	if vnc.httpServer != nil {
-		logrus.Debug("close http server")
+		Log(vnc).Debug("close http server")
 		vnc.httpServer.Shutdown(context.TODO())
 	}
+	return nil
 }
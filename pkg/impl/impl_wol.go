@@ -0,0 +1,238 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	// wolPort is the port of magic packets, the discard port
+	wolPort = 9
+
+	// wolProbeInterval is the time between two probes of a waking device
+	wolProbeInterval = 5 * time.Second
+)
+
+// WOLRequest asks a peer to send magic packets for MAC to its network, to
+// Broadcast only if it is set. Probe only checks the peer is up.
+type WOLRequest struct {
+	Probe     bool
+	MAC       string
+	Broadcast string
+	Port      int
+}
+
+// WOLReply tells where the magic packets went
+type WOLReply struct {
+	Error string
+	Sent  []string
+}
+
+// WOL asks a peer which is up to wake a device of its network with
+// Wake-on-LAN magic packets
+type WOL struct {
+	BaseImpl
+	Request WOLRequest
+}
+
+func NewWOL(hostId string, req WOLRequest) *WOL {
+	return &WOL{
+		BaseImpl: *NewBaseImpl(hostId),
+		Request:  req,
+	}
+}
+
+func (w *WOL) Code() int32 {
+	return types.APP_TYPE_WOL
+}
+
+func wolAllowed(wc conf.WOLConf, peerId string) error {
+	if !wc.Enabled {
+		return fmt.Errorf("wake-on-lan relay is disabled")
+	}
+	if len(wc.Peers) == 0 {
+		return nil
+	}
+	for _, v := range wc.Peers {
+		if v == peerId {
+			return nil
+		}
+	}
+	return fmt.Errorf("wake-on-lan relay denied for %s", peerId)
+}
+
+// MagicPacket returns the magic packet of a MAC address, 6 bytes 0xff
+// then 16 times the address
+func MagicPacket(mac string) ([]byte, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	if len(hw) != 6 {
+		return nil, fmt.Errorf("%s is not an ethernet address", mac)
+	}
+	return append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(hw, 16)...), nil
+}
+
+// wolBroadcasts returns the broadcast addresses of the IPv4 networks of
+// this node, and the limited broadcast address
+func wolBroadcasts() []net.IP {
+	ret := []net.IP{net.IPv4bcast}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ret
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagBroadcast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, v := range addrs {
+			ipn, ok := v.(*net.IPNet)
+			if !ok || ipn.IP.To4() == nil || len(ipn.Mask) != net.IPv4len {
+				continue
+			}
+			bcast := make(net.IP, net.IPv4len)
+			for i, b := range ipn.IP.To4() {
+				bcast[i] = b | ^ipn.Mask[i]
+			}
+			ret = append(ret, bcast)
+		}
+	}
+	return ret
+}
+
+// sendMagicPacket sends the magic packet of req to its broadcast address,
+// or to the ones of the networks of this node
+func sendMagicPacket(req WOLRequest) ([]string, error) {
+	packet, err := MagicPacket(req.MAC)
+	if err != nil {
+		return nil, err
+	}
+	port := req.Port
+	if port == 0 {
+		port = wolPort
+	}
+	targets := wolBroadcasts()
+	if req.Broadcast != "" {
+		ip := net.ParseIP(req.Broadcast)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid broadcast address %s", req.Broadcast)
+		}
+		targets = []net.IP{ip}
+	}
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var sent []string
+	for _, ip := range targets {
+		addr := &net.UDPAddr{IP: ip, Port: port}
+		_, err = conn.WriteTo(packet, addr)
+		if err == nil {
+			sent = append(sent, addr.String())
+		}
+	}
+	if len(sent) == 0 {
+		return nil, err
+	}
+	return sent, nil
+}
+
+// Do sends the request over the connection set by SetConn and returns the
+// addresses the magic packets went to
+func (w *WOL) Do() ([]string, error) {
+	err := gob.NewEncoder(w.Conn()).Encode(w.Request)
+	if err != nil {
+		return nil, err
+	}
+	var reply WOLReply
+	err = types.DecodeLimited(w.Conn(), MaxReplySize, &reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("remote wake-on-lan: %s", reply.Error)
+	}
+	return reply.Sent, nil
+}
+
+// wolProbe reports whether the node of hostId answers
+func wolProbe(hostId string) bool {
+	imp := NewWOL(hostId, WOLRequest{Probe: true})
+	conn, err := NewSender(imp, types.OPTION_TYPE_UP).Send()
+	if err != nil {
+		return false
+	}
+	imp.SetConn(conn)
+	defer imp.Close()
+	_, err = imp.Do()
+	return err == nil
+}
+
+// WaitOnline probes the node of hostId until it answers or timeout is over
+func WaitOnline(hostId string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if wolProbe(hostId) {
+			return nil
+		}
+		if time.Now().Add(wolProbeInterval).After(deadline) {
+			return fmt.Errorf("%s is not up after %s", hostId, timeout)
+		}
+		time.Sleep(wolProbeInterval)
+	}
+}
+
+func (w *WOL) doResponse(s net.Conn) error {
+	defer s.Close()
+	enc := gob.NewEncoder(s)
+	var req WOLRequest
+	err := types.DecodeLimited(s, MaxRequestSize, &req)
+	if err != nil {
+		return err
+	}
+	if req.Probe {
+		return enc.Encode(WOLReply{})
+	}
+	reject := func(err error) error {
+		enc.Encode(WOLReply{Error: err.Error()})
+		return err
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return reject(err)
+	}
+	err = wolAllowed(cm.Conf.WOLConf, w.HostId())
+	if err != nil {
+		return reject(err)
+	}
+	sent, err := sendMagicPacket(req)
+	if err != nil {
+		return reject(err)
+	}
+	Log(w).Info("sent magic packets for ", req.MAC, " to ", sent, " for ", w.HostId())
+	return enc.Encode(WOLReply{Sent: sent})
+}
+
+func (w *WOL) Response(ctx context.Context) error {
+	s, c := net.Pipe()
+	w.lock.Lock()
+	w.BaseImpl.conn = &c
+	w.lock.Unlock()
+	go func() {
+		err := w.doResponse(s)
+		if err != nil {
+			Log(w).Error("do response ", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,268 @@
+package impl
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+const (
+	// default validity of a join token
+	defaultJoinTTL = 24 * time.Hour
+	// size of the secrets of join tokens
+	joinSecretSize = 16
+	// joinRetry is the wait between the attempts to pair with the device
+	// which issued a join token, joinTimeout bounds them
+	joinRetry   = 5 * time.Second
+	joinTimeout = 10 * time.Minute
+)
+
+// JoinToken is a token issued by this device, the devices joining with it
+// are paired and added to the address book
+type JoinToken struct {
+	// ID is a short hash of the secret, to name the token
+	ID     string
+	Secret string
+	// Name is the address book name of the joining device, its hostname
+	// if empty
+	Name string `json:",omitempty"`
+	// Groups are the address book groups the joining device is added to
+	Groups []string `json:",omitempty"`
+	// Template is the access template the joining device applies
+	Template string `json:",omitempty"`
+	Expires  time.Time
+	// Uses is the number of devices which may still join
+	Uses int
+	// Joined are the devices which joined with the token
+	Joined []string `json:",omitempty"`
+}
+
+func (t *JoinToken) joined(peerId string) bool {
+	for _, v := range t.Joined {
+		if v == peerId {
+			return true
+		}
+	}
+	return false
+}
+
+// the join tokens are read and written by the daemon and the commands
+var joinTokensLock sync.Mutex
+
+func joinTokensFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "join_tokens.json")
+}
+
+func loadJoinTokens() ([]JoinToken, error) {
+	bs, err := readStoreFile(joinTokensFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ret []JoinToken
+	return ret, json.Unmarshal(bs, &ret)
+}
+
+func saveJoinTokens(tokens []JoinToken) error {
+	bs, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStoreFile(joinTokensFile(), bs)
+}
+
+// IssueJoinToken creates a join token valid for ttl and uses devices, and
+// returns the bundle a new device joins with. The access template named
+// template, if any, is applied on the joining devices.
+func IssueJoinToken(name string, groups []string, template string, ttl time.Duration, uses int) (JoinToken, string, error) {
+	cm, err := conf.Shared()
+	if err != nil {
+		return JoinToken{}, "", err
+	}
+	if cm.Conf.SignalingServerAddr == "" {
+		return JoinToken{}, "", fmt.Errorf("no signaling server set")
+	}
+	b := cm.ExportBundle("", false)
+	if template != "" {
+		t := cm.FindAccessTemplate(template)
+		if t == nil {
+			return JoinToken{}, "", fmt.Errorf("no access template %s", template)
+		}
+		access := t.Bind(cm.Conf.ID)
+		b.Access = &access
+	}
+	if dc := cm.Conf.DirectoryConf; dc.Enabled {
+		// the joining device registers with the directory of this one,
+		// tagged with the groups of the token
+		b.Directory = &conf.DirectoryConf{URL: dc.URL, Owner: dc.Owner, Tags: groups}
+	}
+	if ttl <= 0 {
+		ttl = defaultJoinTTL
+	}
+	if uses <= 0 {
+		uses = 1
+	}
+	secret := make([]byte, joinSecretSize)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return JoinToken{}, "", err
+	}
+	sum := sha256.Sum256(secret)
+	t := JoinToken{
+		ID:       hex.EncodeToString(sum[:4]),
+		Secret:   base64.RawURLEncoding.EncodeToString(secret),
+		Name:     name,
+		Groups:   groups,
+		Template: template,
+		Expires:  time.Now().Add(ttl),
+		Uses:     uses,
+	}
+	b.Token = t.Secret
+	text, err := b.Encode()
+	if err != nil {
+		return JoinToken{}, "", err
+	}
+	joinTokensLock.Lock()
+	defer joinTokensLock.Unlock()
+	tokens, err := loadJoinTokens()
+	if err != nil {
+		return JoinToken{}, "", err
+	}
+	err = saveJoinTokens(append(tokens, t))
+	if err != nil {
+		return JoinToken{}, "", err
+	}
+	return t, text, nil
+}
+
+// ListJoinTokens returns the join tokens of this device, expired and used
+// ones included
+func ListJoinTokens() ([]JoinToken, error) {
+	joinTokensLock.Lock()
+	defer joinTokensLock.Unlock()
+	return loadJoinTokens()
+}
+
+// RevokeJoinToken removes the join token id, the devices which joined with
+// it stay paired
+func RevokeJoinToken(id string) error {
+	joinTokensLock.Lock()
+	defer joinTokensLock.Unlock()
+	tokens, err := loadJoinTokens()
+	if err != nil {
+		return err
+	}
+	for i, t := range tokens {
+		if t.ID == id {
+			return saveJoinTokens(append(tokens[:i], tokens[i+1:]...))
+		}
+	}
+	return fmt.Errorf("no join token %s", id)
+}
+
+// AcceptJoinToken returns the join token whose secret check accepts, and
+// uses it up for source. A device which already joined with the token may
+// join again, as its first answer may have been lost. Expired tokens are
+// dropped.
+func AcceptJoinToken(source string, check func(secret string) bool) (*JoinToken, error) {
+	joinTokensLock.Lock()
+	defer joinTokensLock.Unlock()
+	tokens, err := loadJoinTokens()
+	if err != nil || len(tokens) == 0 {
+		return nil, err
+	}
+	now := time.Now()
+	valid := tokens[:0]
+	var ret *JoinToken
+	for _, t := range tokens {
+		if now.After(t.Expires) {
+			continue
+		}
+		valid = append(valid, t)
+		if ret != nil || !check(t.Secret) {
+			continue
+		}
+		t := &valid[len(valid)-1]
+		if !t.joined(source) {
+			if t.Uses <= 0 {
+				return nil, fmt.Errorf("join token %s is used up", t.ID)
+			}
+			t.Uses--
+			t.Joined = append(t.Joined, source)
+		}
+		ret = t
+	}
+	if ret == nil && len(valid) == len(tokens) {
+		return nil, nil
+	}
+	err = saveJoinTokens(valid)
+	if err != nil || ret == nil {
+		return nil, err
+	}
+	cp := *ret
+	return &cp, nil
+}
+
+// PrepareJoin reads a join bundle with a token and imports it, with the
+// access rules and the directory it carries, unless this device is already paired with the
+// device which issued it. It is run before the daemon starts, so it uses
+// the signaling settings of the bundle.
+func PrepareJoin(cm *conf.ConfManager, text string) (*conf.JoinBundle, error) {
+	b, err := conf.DecodeBundle(text)
+	if err != nil {
+		return nil, err
+	}
+	if b.Token == "" {
+		return nil, fmt.Errorf("the bundle has no join token, import it with sshx conf import")
+	}
+	if IsPaired(b.Peer.ID) {
+		logrus.Info("already joined ", b.Peer.ID)
+		return b, nil
+	}
+	err = cm.ImportBundle(b)
+	if err == nil && b.Access != nil {
+		err = cm.ApplyAccessTemplate(*b.Access)
+	}
+	if err == nil && b.Directory != nil {
+		err = cm.ImportDirectory(*b.Directory)
+	}
+	return b, err
+}
+
+// CompleteJoin pairs through the local daemon with the device which issued
+// the join bundle b, until it answers or joinTimeout
+func CompleteJoin(b *conf.JoinBundle) error {
+	if IsPaired(b.Peer.ID) {
+		return nil
+	}
+	name, _ := os.Hostname()
+	deadline := time.Now().Add(joinTimeout)
+	for {
+		p := NewPair(b.Peer.ID)
+		p.PairingCode = b.Token
+		p.Name = name
+		res, err := requestPairing(p)
+		if err == nil {
+			logrus.Info("joined ", b.Peer.ID, " ", res.Fingerprint)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("join %s: %v", b.Peer.ID, err)
+		}
+		logrus.Debug("join ", b.Peer.ID, ": ", err)
+		time.Sleep(joinRetry)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build darwin
+// +build darwin
+
+package impl
+
+import (
+	"encoding/base64"
+	"os/exec"
+	"strings"
+)
+
+// the key of the key store is a generic password of the login keychain
+
+func keychainSave(key []byte) error {
+	return exec.Command("security", "add-generic-password", "-U", "-s", "sshx", "-a", keychainAccount(),
+		"-w", base64.StdEncoding.EncodeToString(key)).Run()
+}
+
+func keychainLoad() ([]byte, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", "sshx", "-a", keychainAccount(), "-w").Output()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+func keychainDelete() error {
+	return exec.Command("security", "delete-generic-password", "-s", "sshx", "-a", keychainAccount()).Run()
+}
@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package impl
+
+import (
+	"encoding/base64"
+	"os/exec"
+	"strings"
+)
+
+// the key of the key store is kept by the secret service through
+// secret-tool of libsecret
+
+func keychainSave(key []byte) error {
+	cmd := exec.Command("secret-tool", "store", "--label=sshx key store", "service", "sshx", "account", keychainAccount())
+	cmd.Stdin = strings.NewReader(base64.StdEncoding.EncodeToString(key))
+	return cmd.Run()
+}
+
+func keychainLoad() ([]byte, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", "sshx", "account", keychainAccount()).Output()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+func keychainDelete() error {
+	return exec.Command("secret-tool", "clear", "service", "sshx", "account", keychainAccount()).Run()
+}
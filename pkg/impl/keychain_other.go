@@ -0,0 +1,18 @@
+//go:build !darwin && !linux && !windows
+// +build !darwin,!linux,!windows
+
+package impl
+
+import "fmt"
+
+func keychainSave(key []byte) error {
+	return fmt.Errorf("no keychain on this system, use a passphrase")
+}
+
+func keychainLoad() ([]byte, error) {
+	return nil, fmt.Errorf("no keychain on this system, use a passphrase")
+}
+
+func keychainDelete() error {
+	return nil
+}
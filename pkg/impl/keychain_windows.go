@@ -0,0 +1,64 @@
+//go:build windows
+// +build windows
+
+package impl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/suutaku/sshx/internal/utils"
+	"golang.org/x/sys/windows"
+)
+
+// the key of the key store is encrypted with DPAPI for the user
+
+func dpapiFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "keystore.dpapi")
+}
+
+func dpapiBlob(data []byte) *windows.DataBlob {
+	if len(data) == 0 {
+		return &windows.DataBlob{}
+	}
+	return &windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+}
+
+func dpapiBytes(blob *windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(blob.Data)))
+	ret := make([]byte, blob.Size)
+	copy(ret, (*[1 << 30]byte)(unsafe.Pointer(blob.Data))[:blob.Size:blob.Size])
+	return ret
+}
+
+func keychainSave(key []byte) error {
+	var out windows.DataBlob
+	err := windows.CryptProtectData(dpapiBlob(key), nil, dpapiBlob([]byte(keychainAccount())), 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(utils.GetSSHXStateHome(), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dpapiFile(), dpapiBytes(&out), 0600)
+}
+
+func keychainLoad() ([]byte, error) {
+	bs, err := ioutil.ReadFile(dpapiFile())
+	if err != nil {
+		return nil, err
+	}
+	var out windows.DataBlob
+	err = windows.CryptUnprotectData(dpapiBlob(bs), nil, dpapiBlob([]byte(keychainAccount())), 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return nil, err
+	}
+	return dpapiBytes(&out), nil
+}
+
+func keychainDelete() error {
+	return os.Remove(dpapiFile())
+}
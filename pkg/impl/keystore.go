@@ -0,0 +1,430 @@
+package impl
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/term"
+)
+
+const (
+	// keys are kept as they are
+	KEYSTORE_PLAIN = ""
+	// keys are encrypted with a key derived from a passphrase
+	KEYSTORE_PASSPHRASE = "passphrase"
+	// keys are encrypted with a random key kept by the OS keychain
+	KEYSTORE_KEYCHAIN = "keychain"
+)
+
+// PASSPHRASE_ENV unlocks a key store protected by a passphrase without
+// asking for it
+const PASSPHRASE_ENV = "SSHX_PASSPHRASE"
+
+// keyStoreMagic starts the files encrypted by the key store
+const keyStoreMagic = "SSHXKS1\n"
+
+// keyStoreMeta is how the key store is protected
+type keyStoreMeta struct {
+	Mode string
+	// Salt of the passphrase
+	Salt []byte `json:",omitempty"`
+	// Check is a known text encrypted with the key, to tell wrong
+	// passphrases
+	Check []byte
+}
+
+// the key of the key store once unlocked
+var vault struct {
+	lock sync.Mutex
+	key  []byte
+}
+
+// keychainAccount names the key store key in the keychain, each state
+// directory has its own
+func keychainAccount() string {
+	return utils.GetSSHXStateHome()
+}
+
+func keyStoreMetaFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "keystore.json")
+}
+
+// keyStoreFiles are the files the key store encrypts: the keys of this
+// device and the keys pinned for peers
+func keyStoreFiles() []string {
+	return []string{messageKeyFile(), nodeKeyFile(), caKeyFile(), pinnedKeysFile(), nodePeersFile(), derpKeyFile(), joinTokensFile()}
+}
+
+func loadKeyStoreMeta() (*keyStoreMeta, error) {
+	bs, err := ioutil.ReadFile(keyStoreMetaFile())
+	if os.IsNotExist(err) {
+		return &keyStoreMeta{Mode: KEYSTORE_PLAIN}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var meta keyStoreMeta
+	return &meta, json.Unmarshal(bs, &meta)
+}
+
+func passphraseKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, 1, 64*1024, 4, chacha20poly1305.KeySize)
+}
+
+func vaultAEAD(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.NewX(key)
+}
+
+func vaultSeal(key []byte, name string, data []byte) ([]byte, error) {
+	aead, err := vaultAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, len(keyStoreMagic)+aead.NonceSize(), len(keyStoreMagic)+aead.NonceSize()+len(data)+aead.Overhead())
+	copy(ret, keyStoreMagic)
+	nonce := ret[len(keyStoreMagic):]
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(ret, nonce, data, []byte(name)), nil
+}
+
+func vaultOpen(key []byte, name string, data []byte) ([]byte, error) {
+	aead, err := vaultAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	data = data[len(keyStoreMagic):]
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid key store file %s", name)
+	}
+	ret, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt key store file %s", name)
+	}
+	return ret, nil
+}
+
+// checkVaultKey reports whether key is the key of the key store
+func checkVaultKey(meta *keyStoreMeta, key []byte) bool {
+	text, err := vaultOpen(key, "check", meta.Check)
+	return err == nil && string(text) == "sshx"
+}
+
+// vaultKey returns the key of the key store, nil if keys are kept as they
+// are. A passphrase is taken from PASSPHRASE_ENV, or asked if this runs in
+// a terminal.
+func vaultKey() ([]byte, error) {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	// another process may have changed the key store
+	meta, err := loadKeyStoreMeta()
+	if err != nil {
+		return nil, err
+	}
+	if vault.key != nil && meta.Mode != KEYSTORE_PLAIN && checkVaultKey(meta, vault.key) {
+		return vault.key, nil
+	}
+	vault.key = nil
+	var key []byte
+	switch meta.Mode {
+	case KEYSTORE_PLAIN:
+		return nil, nil
+	case KEYSTORE_KEYCHAIN:
+		key, err = keychainLoad()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the key store key from the keychain: %v", err)
+		}
+	case KEYSTORE_PASSPHRASE:
+		passphrase := os.Getenv(PASSPHRASE_ENV)
+		if passphrase == "" {
+			if !term.IsTerminal(int(os.Stdin.Fd())) {
+				return nil, fmt.Errorf("the key store is locked, run 'sshx keystore unlock'")
+			}
+			fmt.Fprint(os.Stderr, "key store passphrase: ")
+			bs, err := term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return nil, err
+			}
+			passphrase = string(bs)
+		}
+		key = passphraseKey(passphrase, meta.Salt)
+	default:
+		return nil, fmt.Errorf("unknown key store mode %s", meta.Mode)
+	}
+	if !checkVaultKey(meta, key) {
+		return nil, fmt.Errorf("wrong key store passphrase or key")
+	}
+	vault.key = key
+	return key, nil
+}
+
+// UnlockKeyStore unlocks the key store with a passphrase, or with the
+// keychain or PASSPHRASE_ENV if it is empty
+func UnlockKeyStore(passphrase string) error {
+	if passphrase == "" {
+		_, err := vaultKey()
+		return err
+	}
+	meta, err := loadKeyStoreMeta()
+	if err != nil {
+		return err
+	}
+	if meta.Mode != KEYSTORE_PASSPHRASE {
+		return fmt.Errorf("the key store is not protected by a passphrase")
+	}
+	key := passphraseKey(passphrase, meta.Salt)
+	if !checkVaultKey(meta, key) {
+		return fmt.Errorf("wrong key store passphrase")
+	}
+	vault.lock.Lock()
+	vault.key = key
+	vault.lock.Unlock()
+	return nil
+}
+
+// KeyStoreStatus returns how the key store is protected and whether this
+// process unlocked it
+func KeyStoreStatus() (string, bool, error) {
+	meta, err := loadKeyStoreMeta()
+	if err != nil {
+		return "", false, err
+	}
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	return meta.Mode, meta.Mode == KEYSTORE_PLAIN || vault.key != nil, nil
+}
+
+// readStoreFile reads a file of the key store and decrypts it if it is
+// encrypted, errors of the file are returned as they are
+func readStoreFile(file string) ([]byte, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil || !bytes.HasPrefix(bs, []byte(keyStoreMagic)) {
+		return bs, err
+	}
+	key, err := vaultKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%s is encrypted but the key store is disabled", file)
+	}
+	return vaultOpen(key, filepath.Base(file), bs)
+}
+
+// sealStoreData returns data as a file of the key store keeps it
+func sealStoreData(file string, data []byte) ([]byte, error) {
+	key, err := vaultKey()
+	if err != nil || key == nil {
+		return data, err
+	}
+	return vaultSeal(key, filepath.Base(file), data)
+}
+
+// writeStoreFile replaces a file of the key store
+func writeStoreFile(file string, data []byte) error {
+	data, err := sealStoreData(file, data)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d", file, os.Getpid())
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// rewriteKeyStore writes the files of the key store again with the key
+// key, nil to keep them as they are. meta is saved before, or removed
+// after, so every file stays readable if this is interrupted.
+func rewriteKeyStore(meta *keyStoreMeta, key []byte) error {
+	messageKeysLock.Lock()
+	defer messageKeysLock.Unlock()
+	nodeKeysLock.Lock()
+	defer nodeKeysLock.Unlock()
+	contents := make(map[string][]byte)
+	for _, file := range keyStoreFiles() {
+		bs, err := readStoreFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		contents[file] = bs
+	}
+	if meta != nil {
+		bs, err := json.MarshalIndent(meta, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(utils.GetSSHXStateHome(), 0700)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(keyStoreMetaFile(), bs, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	vault.lock.Lock()
+	vault.key = key
+	vault.lock.Unlock()
+	for file, bs := range contents {
+		err := writeStoreFile(file, bs)
+		if err != nil {
+			return err
+		}
+	}
+	if meta == nil {
+		err := os.Remove(keyStoreMetaFile())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnableKeyStore encrypts the keys of this device and the keys pinned for
+// peers, with a key derived from passphrase or, if it is empty, a random
+// key kept by the OS keychain
+func EnableKeyStore(passphrase string) error {
+	// the files are read with the current key
+	if _, err := vaultKey(); err != nil {
+		return err
+	}
+	meta := &keyStoreMeta{Mode: KEYSTORE_KEYCHAIN}
+	var key []byte
+	if passphrase != "" {
+		meta.Mode = KEYSTORE_PASSPHRASE
+		meta.Salt = make([]byte, 16)
+		_, err := rand.Read(meta.Salt)
+		if err != nil {
+			return err
+		}
+		key = passphraseKey(passphrase, meta.Salt)
+	} else {
+		key = make([]byte, chacha20poly1305.KeySize)
+		_, err := rand.Read(key)
+		if err != nil {
+			return err
+		}
+		err = keychainSave(key)
+		if err != nil {
+			return fmt.Errorf("cannot save the key store key in the keychain: %v", err)
+		}
+	}
+	check, err := vaultSeal(key, "check", []byte("sshx"))
+	if err != nil {
+		return err
+	}
+	meta.Check = check
+	err = rewriteKeyStore(meta, key)
+	if err != nil {
+		return err
+	}
+	logrus.Info("key store protected by ", meta.Mode)
+	return nil
+}
+
+// DisableKeyStore keeps the keys as they are again
+func DisableKeyStore() error {
+	meta, err := loadKeyStoreMeta()
+	if err != nil {
+		return err
+	}
+	if meta.Mode == KEYSTORE_PLAIN {
+		return nil
+	}
+	err = rewriteKeyStore(nil, nil)
+	if err != nil {
+		return err
+	}
+	if meta.Mode == KEYSTORE_KEYCHAIN {
+		if err := keychainDelete(); err != nil {
+			logrus.Warn("cannot remove the key store key from the keychain: ", err)
+		}
+	}
+	return nil
+}
+
+// replicaFiles are the files a standby daemon gets from the active one:
+// the key store and how it is protected
+func replicaFiles() []string {
+	return append(keyStoreFiles(), keyStoreMetaFile())
+}
+
+// ReadReplica returns the files of the key store by name, as the active
+// daemon of a standby pair replicates them. They stay encrypted, the
+// standby unlocks them with the same passphrase. Keys kept by the OS
+// keychain can't be replicated.
+func ReadReplica() (map[string][]byte, error) {
+	meta, err := loadKeyStoreMeta()
+	if err != nil {
+		return nil, err
+	}
+	if meta.Mode == KEYSTORE_KEYCHAIN {
+		return nil, fmt.Errorf("the key store key is in the keychain, protect the key store with a passphrase to replicate it")
+	}
+	ret := make(map[string][]byte)
+	for _, v := range replicaFiles() {
+		bs, err := ioutil.ReadFile(v)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret[filepath.Base(v)] = bs
+	}
+	return ret, nil
+}
+
+// WriteReplica replaces the files of the key store with the ones the active
+// daemon replicated, the files it doesn't have are removed
+func WriteReplica(files map[string][]byte) error {
+	messageKeysLock.Lock()
+	defer messageKeysLock.Unlock()
+	for _, v := range replicaFiles() {
+		bs, ok := files[filepath.Base(v)]
+		if !ok {
+			err := os.Remove(v)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(v), 0700)
+		if err != nil {
+			return err
+		}
+		tmp := fmt.Sprintf("%s.%d", v, os.Getpid())
+		err = ioutil.WriteFile(tmp, bs, 0600)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmp, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,466 @@
+package impl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/viper"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+const (
+	// kubeServiceAccount is where the service account of a pod is mounted
+	kubeServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// kubeChannelProtocol is the WebSocket protocol of exec and port
+	// forwarding, the first byte of every message is its channel
+	kubeChannelProtocol = "v4.channel.k8s.io"
+)
+
+// kubeClient talks to the API server of a cluster
+type kubeClient struct {
+	server string
+	token  string
+	// namespace is the namespace of the service account or the context
+	namespace string
+	tls       *tls.Config
+}
+
+// kubeconfig is the part of a kubeconfig file the client understands
+type kubeconfig struct {
+	CurrentContext string `mapstructure:"current-context"`
+	Clusters       []struct {
+		Name    string
+		Cluster struct {
+			Server                   string
+			CertificateAuthority     string `mapstructure:"certificate-authority"`
+			CertificateAuthorityData string `mapstructure:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `mapstructure:"insecure-skip-tls-verify"`
+			TLSServerName            string `mapstructure:"tls-server-name"`
+		}
+	}
+	Contexts []struct {
+		Name    string
+		Context struct {
+			Cluster   string
+			User      string
+			Namespace string
+		}
+	}
+	Users []struct {
+		Name string
+		User struct {
+			Token                 string
+			TokenFile             string `mapstructure:"tokenFile"`
+			ClientCertificate     string `mapstructure:"client-certificate"`
+			ClientCertificateData string `mapstructure:"client-certificate-data"`
+			ClientKey             string `mapstructure:"client-key"`
+			ClientKeyData         string `mapstructure:"client-key-data"`
+		}
+	}
+}
+
+// newKubeClient connects to the cluster of kc, with the service account of
+// the pod when the node runs in the cluster and no kubeconfig is set
+func newKubeClient(kc conf.KubeConf) (*kubeClient, error) {
+	if kc.Kubeconfig == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		if _, err := os.Stat(filepath.Join(kubeServiceAccount, "token")); err == nil {
+			return inClusterClient()
+		}
+	}
+	path := kc.Kubeconfig
+	if path == "" {
+		path = strings.Split(os.Getenv("KUBECONFIG"), string(os.PathListSeparator))[0]
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".kube", "config")
+	}
+	return kubeconfigClient(path, kc.Context)
+}
+
+// inClusterClient connects with the service account of the pod, the token
+// is read for every client as it is rotated
+func inClusterClient() (*kubeClient, error) {
+	token, err := ioutil.ReadFile(filepath.Join(kubeServiceAccount, "token"))
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(kubeServiceAccount, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid ca of the service account")
+	}
+	namespace, _ := ioutil.ReadFile(filepath.Join(kubeServiceAccount, "namespace"))
+	host := net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	return &kubeClient{
+		server:    "https://" + host,
+		token:     strings.TrimSpace(string(token)),
+		namespace: strings.TrimSpace(string(namespace)),
+		tls:       &tls.Config{RootCAs: pool},
+	}, nil
+}
+
+// kubeFile returns the content of a file of a kubeconfig, given inline in
+// base64 or by a path relative to the kubeconfig
+func kubeFile(dir, path, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// kubeconfigClient connects with the credentials of a context of a
+// kubeconfig file, the current one if context is empty
+func kubeconfigClient(path, context string) (*kubeClient, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("yaml")
+	err := v.ReadInConfig()
+	if err != nil {
+		return nil, err
+	}
+	var kc kubeconfig
+	err = v.Unmarshal(&kc)
+	if err != nil {
+		return nil, err
+	}
+	if context == "" {
+		context = kc.CurrentContext
+	}
+	ret := &kubeClient{tls: &tls.Config{}}
+	var clusterName, userName string
+	for _, c := range kc.Contexts {
+		if c.Name == context {
+			clusterName, userName, ret.namespace = c.Context.Cluster, c.Context.User, c.Context.Namespace
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("no context %q in %s", context, path)
+	}
+	dir := filepath.Dir(path)
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		ret.server = strings.TrimSuffix(c.Cluster.Server, "/")
+		ret.tls.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		ret.tls.ServerName = c.Cluster.TLSServerName
+		ca, err := kubeFile(dir, c.Cluster.CertificateAuthority, c.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return nil, err
+		}
+		if ca != nil {
+			ret.tls.RootCAs = x509.NewCertPool()
+			if !ret.tls.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("invalid certificate authority of cluster %s", clusterName)
+			}
+		}
+	}
+	if ret.server == "" {
+		return nil, fmt.Errorf("no server of cluster %s in %s", clusterName, path)
+	}
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		ret.token = u.User.Token
+		if u.User.TokenFile != "" {
+			token, err := kubeFile(dir, u.User.TokenFile, "")
+			if err != nil {
+				return nil, err
+			}
+			ret.token = strings.TrimSpace(string(token))
+		}
+		cert, err := kubeFile(dir, u.User.ClientCertificate, u.User.ClientCertificateData)
+		if err != nil {
+			return nil, err
+		}
+		key, err := kubeFile(dir, u.User.ClientKey, u.User.ClientKeyData)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil && key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, err
+			}
+			ret.tls.Certificates = []tls.Certificate{pair}
+		}
+	}
+	if ret.token == "" && len(ret.tls.Certificates) == 0 {
+		return nil, fmt.Errorf("user %s of %s has no token or client certificate, exec plugins are not supported", userName, path)
+	}
+	return ret, nil
+}
+
+// Namespace returns namespace, or the one of the client if it is empty
+func (kc *kubeClient) Namespace(namespace string) string {
+	if namespace != "" {
+		return namespace
+	}
+	if kc.namespace != "" {
+		return kc.namespace
+	}
+	return "default"
+}
+
+func (kc *kubeClient) header() http.Header {
+	header := http.Header{}
+	if kc.token != "" {
+		header.Set("Authorization", "Bearer "+kc.token)
+	}
+	return header
+}
+
+// kubeStatus is the status the API server returns with errors and at the
+// end of exec sessions
+type kubeStatus struct {
+	Status  string
+	Message string
+	Reason  string
+	Details struct {
+		Causes []struct {
+			Reason  string
+			Message string
+		}
+	}
+}
+
+// ExitCode returns the exit code of the command of an exec session
+func (ks kubeStatus) ExitCode() int {
+	if ks.Status == "Success" {
+		return 0
+	}
+	for _, v := range ks.Details.Causes {
+		if v.Reason == "ExitCode" {
+			code, err := strconv.Atoi(v.Message)
+			if err == nil {
+				return code
+			}
+		}
+	}
+	return 1
+}
+
+// get decodes the object at path of the API server into v
+func (kc *kubeClient) get(path string, query url.Values, v interface{}) error {
+	req, err := http.NewRequest("GET", kc.server+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header = kc.header()
+	client := http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: kc.tls, Proxy: http.ProxyFromEnvironment},
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var status kubeStatus
+		if json.NewDecoder(res.Body).Decode(&status) == nil && status.Message != "" {
+			return fmt.Errorf("%s", status.Message)
+		}
+		return fmt.Errorf("%s: %s", path, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// dial opens a channel stream of a pod subresource
+func (kc *kubeClient) dial(path string, query url.Values) (*websocket.Conn, error) {
+	u, err := url.Parse(kc.server + path)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	u.RawQuery = query.Encode()
+	dialer := websocket.Dialer{
+		TLSClientConfig:  kc.tls,
+		Subprotocols:     []string{kubeChannelProtocol},
+		HandshakeTimeout: timeout,
+		Proxy:            http.ProxyFromEnvironment,
+	}
+	ws, res, err := dialer.Dial(u.String(), kc.header())
+	if err != nil {
+		if res != nil {
+			var status kubeStatus
+			if json.NewDecoder(res.Body).Decode(&status) == nil && status.Message != "" {
+				return nil, fmt.Errorf("%s", status.Message)
+			}
+		}
+		return nil, err
+	}
+	return ws, nil
+}
+
+// Exec runs command in a container of a pod, stdin, stdout and stderr go
+// over their channels. A terminal has no stderr.
+func (kc *kubeClient) Exec(namespace, pod, container string, command []string, tty bool) (*websocket.Conn, error) {
+	query := url.Values{}
+	query["command"] = command
+	if container != "" {
+		query.Set("container", container)
+	}
+	query.Set("stdin", "true")
+	query.Set("stdout", "true")
+	query.Set("stderr", strconv.FormatBool(!tty))
+	query.Set("tty", strconv.FormatBool(tty))
+	return kc.dial(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/exec", url.PathEscape(namespace), url.PathEscape(pod)), query)
+}
+
+// PortForward forwards a port of a pod, the data goes over channel 0 and
+// the errors over channel 1
+func (kc *kubeClient) PortForward(namespace, pod string, port int32) (*websocket.Conn, error) {
+	query := url.Values{}
+	query.Set("ports", strconv.Itoa(int(port)))
+	return kc.dial(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/portforward", url.PathEscape(namespace), url.PathEscape(pod)), query)
+}
+
+// kubePort is a port of a service or a container, the target port of a
+// service is a number or the name of a container port
+type kubePort struct {
+	Name          string
+	Port          int32
+	ContainerPort int32
+	TargetPort    json.RawMessage
+}
+
+type kubePod struct {
+	Metadata struct {
+		Name string
+	}
+	Spec struct {
+		Containers []struct {
+			Name  string
+			Ports []kubePort
+		}
+	}
+	Status struct {
+		Phase      string
+		Conditions []struct {
+			Type   string
+			Status string
+		}
+	}
+}
+
+// ready reports whether the pod runs and passes its readiness probes
+func (kp *kubePod) ready() bool {
+	if kp.Status.Phase != "Running" {
+		return false
+	}
+	for _, v := range kp.Status.Conditions {
+		if v.Type == "Ready" {
+			return v.Status == "True"
+		}
+	}
+	return false
+}
+
+// containerPort returns the number of a named port of the pod
+func (kp *kubePod) containerPort(name string) int32 {
+	for _, c := range kp.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.Name == name {
+				return p.ContainerPort
+			}
+		}
+	}
+	return 0
+}
+
+// Resolve returns the pod and port a target is reached at, target is a pod
+// name, pod/NAME or svc/NAME. A service resolves to one of its ready pods
+// and port is a port of the service, which may be 0 if it has only one.
+func (kc *kubeClient) Resolve(namespace, target string, port int32) (string, int32, error) {
+	kind, name := "pod", target
+	if i := strings.Index(target, "/"); i >= 0 {
+		kind, name = target[:i], target[i+1:]
+	}
+	switch kind {
+	case "pod", "pods", "po":
+		return name, port, nil
+	case "svc", "service", "services":
+	default:
+		return "", 0, fmt.Errorf("unsupported target %s, want a pod or svc/NAME", target)
+	}
+	var svc struct {
+		Spec struct {
+			Selector map[string]string
+			Ports    []kubePort
+		}
+	}
+	err := kc.get(fmt.Sprintf("/api/v1/namespaces/%s/services/%s", url.PathEscape(namespace), url.PathEscape(name)), url.Values{}, &svc)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(svc.Spec.Selector) == 0 {
+		return "", 0, fmt.Errorf("service %s has no selector", name)
+	}
+	var sp *kubePort
+	for i, v := range svc.Spec.Ports {
+		if v.Port == port || (port == 0 && len(svc.Spec.Ports) == 1) {
+			sp = &svc.Spec.Ports[i]
+		}
+	}
+	if sp == nil {
+		return "", 0, fmt.Errorf("service %s has no port %d", name, port)
+	}
+	var selector []string
+	for k, v := range svc.Spec.Selector {
+		selector = append(selector, k+"="+v)
+	}
+	var pods struct {
+		Items []kubePod
+	}
+	err = kc.get(fmt.Sprintf("/api/v1/namespaces/%s/pods", url.PathEscape(namespace)), url.Values{"labelSelector": {strings.Join(selector, ",")}}, &pods)
+	if err != nil {
+		return "", 0, err
+	}
+	for _, pod := range pods.Items {
+		if !pod.ready() {
+			continue
+		}
+		// the target port is the port of the service if it is not set
+		targetPort := sp.Port
+		var number int32
+		var portName string
+		if json.Unmarshal(sp.TargetPort, &number) == nil && number != 0 {
+			targetPort = number
+		} else if json.Unmarshal(sp.TargetPort, &portName) == nil && portName != "" {
+			targetPort = pod.containerPort(portName)
+			if targetPort == 0 {
+				continue
+			}
+		}
+		return pod.Metadata.Name, targetPort, nil
+	}
+	return "", 0, fmt.Errorf("service %s has no ready pod", name)
+}
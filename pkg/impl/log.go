@@ -0,0 +1,34 @@
+package impl
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// sessionFields returns the log fields of a session, empty ones are left out
+func sessionFields(pairId, app, peer string) logrus.Fields {
+	fields := logrus.Fields{}
+	if pairId != "" {
+		fields[types.LOG_FIELD_SESSION] = types.SessionOf(pairId)
+		fields[types.LOG_FIELD_PAIR] = pairId
+	}
+	if app != "" {
+		fields[types.LOG_FIELD_APP] = app
+	}
+	if peer != "" {
+		fields[types.LOG_FIELD_PEER] = peer
+	}
+	return fields
+}
+
+// Log returns the logger of the session of imp, its lines carry the pair
+// ID, the application and the peer
+func Log(imp Impl) *logrus.Entry {
+	return logrus.WithFields(sessionFields(imp.PairId(), AppName(imp.Code()), imp.HostId()))
+}
+
+// Log returns the logger of a request, its lines carry the pair ID and the
+// application
+func (sender *Sender) Log() *logrus.Entry {
+	return logrus.WithFields(sessionFields(string(sender.PairId), AppName(sender.GetAppCode()), ""))
+}
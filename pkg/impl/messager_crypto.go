@@ -0,0 +1,426 @@
+package impl
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/e2e"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// messageHello starts the key exchange, it is followed by the static and
+// the ephemeral X25519 keys of the sender
+const messageHello = "SSHXM1"
+
+// meshHello starts the hellos of the sessions relayed by the mesh
+const meshHello = "SSHXR1"
+
+// directHello starts the hellos of the sessions of the direct service
+const directHello = "SSHXD1"
+
+// largest plain text sealed in a frame
+const maxMessageFrame = 32 << 10
+
+// pinned keys are read and written by the daemon and consoles
+var messageKeysLock sync.Mutex
+
+func messageKeyFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "message.key")
+}
+
+func pinnedKeysFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "message_peers.json")
+}
+
+// loadMessageKey returns the X25519 key of this device, it is created on
+// first use and identifies the device to the peers it chats and connects
+// with
+func loadMessageKey() (priv, pub []byte, err error) {
+	priv, err = readStoreFile(messageKeyFile())
+	if os.IsNotExist(err) {
+		priv, err = createX25519Key(messageKeyFile(), "message key")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(priv) != curve25519.ScalarSize {
+		return nil, nil, fmt.Errorf("invalid message key %s", messageKeyFile())
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	return priv, pub, err
+}
+
+// createX25519Key creates the X25519 key file of this device, name is
+// what it is called in the logs
+func createX25519Key(file, name string) ([]byte, error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(priv)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(utils.GetSSHXStateHome(), 0700)
+	if err != nil {
+		return nil, err
+	}
+	data, err := sealStoreData(file, priv)
+	if err != nil {
+		return nil, err
+	}
+	tmp := fmt.Sprintf("%s.%d", file, os.Getpid())
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	// the daemon and a console may create the key at the same time, the
+	// link fails for the last one which uses the key of the first
+	err = os.Link(tmp, file)
+	if os.IsExist(err) {
+		return readStoreFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logrus.Info("created ", name, " ", file)
+	return priv, nil
+}
+
+// keyFingerprint returns the fingerprint of a public key as devices
+// compare them
+func keyFingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	parts := make([]string, 16)
+	for i := range parts {
+		parts[i] = fmt.Sprintf("%02X", sum[i])
+	}
+	return strings.Join(parts, ":")
+}
+
+func loadPinnedKeys() (map[string]string, error) {
+	ret := make(map[string]string)
+	bs, err := readStoreFile(pinnedKeysFile())
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, json.Unmarshal(bs, &ret)
+}
+
+func savePinnedKeys(keys map[string]string) error {
+	bs, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStoreFile(pinnedKeysFile(), bs)
+}
+
+// checkPeerKey refuses peers which are not paired and keys other than the
+// pinned one. With AllowUnpairedPeers the key of a peer is pinned the
+// first time it is seen instead.
+func checkPeerKey(peerId string, pub []byte) error {
+	messageKeysLock.Lock()
+	defer messageKeysLock.Unlock()
+	keys, err := loadPinnedKeys()
+	if err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(pub)
+	if pinned, ok := keys[peerId]; ok {
+		if pinned != key {
+			return fmt.Errorf("identity key of %s changed to %s, run 'sshx pair remove %s' and pair again if the device was reinstalled", peerId, keyFingerprint(pub), peerId)
+		}
+		return nil
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	if !cm.Conf.AllowUnpairedPeers {
+		return fmt.Errorf("%s is not paired, pair with 'sshx pair'", peerId)
+	}
+	keys[peerId] = key
+	logrus.Info("pinned identity key of ", peerId, " ", keyFingerprint(pub))
+	return savePinnedKeys(keys)
+}
+
+// ForgetPeerKey unpins the key of peerId, the next key it presents is
+// pinned instead
+func ForgetPeerKey(peerId string) error {
+	messageKeysLock.Lock()
+	defer messageKeysLock.Unlock()
+	keys, err := loadPinnedKeys()
+	if err != nil {
+		return err
+	}
+	if _, ok := keys[peerId]; !ok {
+		return fmt.Errorf("no message key pinned for %s", peerId)
+	}
+	delete(keys, peerId)
+	return savePinnedKeys(keys)
+}
+
+// ShowMessageKeys prints the fingerprint of this device and of the pinned
+// keys of peers
+func ShowMessageKeys() error {
+	_, pub, err := loadMessageKey()
+	if err != nil {
+		return err
+	}
+	keys, err := loadPinnedKeys()
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(keys))
+	for k := range keys {
+		ids = append(ids, k)
+	}
+	sort.Strings(ids)
+	fmt.Println("this device:", keyFingerprint(pub))
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Peer", "Fingerprint"})
+	t.AppendSeparator()
+	for _, id := range ids {
+		key, err := base64.StdEncoding.DecodeString(keys[id])
+		if err != nil {
+			continue
+		}
+		t.AppendRows([]table.Row{{id, keyFingerprint(key)}})
+	}
+	t.AppendSeparator()
+	t.Render()
+	return nil
+}
+
+// sealedConn encrypts the message stream between two devices, whatever
+// carries it in between. Every write is sealed in frames numbered from 0 in
+// each direction, so frames can't be replayed or reordered.
+type sealedConn struct {
+	net.Conn
+	reader  io.Reader
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	sendSeq uint64
+	recvSeq uint64
+	wlock   sync.Mutex
+	// plain text of the last frame not read yet
+	buf []byte
+}
+
+func frameNonce(seq uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func (sc *sealedConn) Write(p []byte) (int, error) {
+	sc.wlock.Lock()
+	defer sc.wlock.Unlock()
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxMessageFrame {
+			n = maxMessageFrame
+		}
+		frame := make([]byte, 4, 4+n+sc.send.Overhead())
+		frame = sc.send.Seal(frame, frameNonce(sc.sendSeq), p[:n], nil)
+		binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+		sc.sendSeq++
+		_, err := sc.Conn.Write(frame)
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (sc *sealedConn) Read(p []byte) (int, error) {
+	if len(sc.buf) == 0 {
+		var head [4]byte
+		_, err := io.ReadFull(sc.reader, head[:])
+		if err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(head[:])
+		if size > uint32(maxMessageFrame+sc.recv.Overhead()) {
+			return 0, fmt.Errorf("message frame too large")
+		}
+		frame := make([]byte, size)
+		_, err = io.ReadFull(sc.reader, frame)
+		if err != nil {
+			return 0, err
+		}
+		sc.buf, err = sc.recv.Open(frame[:0], frameNonce(sc.recvSeq), frame, nil)
+		if err != nil {
+			return 0, fmt.Errorf("cannot decrypt message: %v", err)
+		}
+		sc.recvSeq++
+	}
+	n := copy(p, sc.buf)
+	sc.buf = sc.buf[n:]
+	return n, nil
+}
+
+// bufferedConn serves the bytes peeked from a connection before the rest
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.reader.Read(p)
+}
+
+// KeyExchange makes the keys of a connection with a peer with the message
+// key of this device, see e2e.KeyExchange. Static keys are pinned per peer
+// ID the first time they are seen.
+type KeyExchange struct {
+	kx *e2e.KeyExchange
+}
+
+// NewKeyExchange makes the key of a connection, magic starts the hellos
+// and tells the protocols apart
+func NewKeyExchange(magic string) (*KeyExchange, error) {
+	priv, _, err := loadMessageKey()
+	if err != nil {
+		return nil, err
+	}
+	kx, err := e2e.NewKeyExchange(magic, priv)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyExchange{kx: kx}, nil
+}
+
+// Hello returns the hello to send to the peer
+func (kx *KeyExchange) Hello() []byte {
+	return kx.kx.Hello()
+}
+
+// Keys returns the keys to seal and open data once the hello of peerId is
+// received, label binds them to their use. The dialer and the responder
+// get each other's keys.
+func (kx *KeyExchange) Keys(peerHello []byte, peerId string, dialer bool, label string) (send, recv cipher.AEAD, err error) {
+	peerPub, err := kx.kx.PeerKey(peerHello)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid key exchange hello from %s", peerId)
+	}
+	err = checkPeerKey(peerId, peerPub)
+	if err != nil {
+		return nil, nil, err
+	}
+	return kx.kx.Keys(peerHello, dialer, label)
+}
+
+// messageHandshake exchanges keys with peerId over the message stream. The
+// dialer speaks first.
+func messageHandshake(conn net.Conn, reader io.Reader, peerId string, dialer bool) (net.Conn, error) {
+	return sealedHandshake(conn, reader, peerId, dialer, messageHello, "sshx message")
+}
+
+// MeshHandshake exchanges keys with peerId at the other end of a session
+// the mesh relays, and returns the session sealed end to end. The key of
+// peerId must be pinned already: the relays only vouch for the IDs, the
+// key proves the session comes from, or goes to, the device pairing
+// pinned.
+func MeshHandshake(conn net.Conn, reader io.Reader, peerId string, dialer bool) (net.Conn, error) {
+	if !IsPaired(peerId) {
+		return nil, Denied(fmt.Errorf("%s is not paired, mesh sessions need the pinned key of both ends", peerId))
+	}
+	return sealedHandshake(conn, reader, peerId, dialer, meshHello, "sshx mesh")
+}
+
+// DirectHandshake exchanges keys with peerId over a session of the direct
+// service, once the dialer sent its DirectInfo, and returns the session
+// sealed end to end. As for the mesh, the key of peerId must be pinned
+// already, the address the session comes from proves nothing.
+func DirectHandshake(conn net.Conn, reader io.Reader, peerId string, dialer bool) (net.Conn, error) {
+	if !IsPaired(peerId) {
+		return nil, Denied(fmt.Errorf("%s is not paired, direct sessions need its pinned key", peerId))
+	}
+	return sealedHandshake(conn, reader, peerId, dialer, directHello, "sshx direct")
+}
+
+// sealedHandshake exchanges the hellos starting with magic with peerId,
+// label binds the keys to their use. The dialer speaks first.
+func sealedHandshake(conn net.Conn, reader io.Reader, peerId string, dialer bool, magic, label string) (net.Conn, error) {
+	kx, err := NewKeyExchange(magic)
+	if err != nil {
+		return nil, err
+	}
+	hello := kx.Hello()
+	peerHello := make([]byte, len(hello))
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if dialer {
+		_, err = conn.Write(hello)
+		if err == nil {
+			_, err = io.ReadFull(reader, peerHello)
+		}
+	} else {
+		_, err = io.ReadFull(reader, peerHello)
+		if err == nil {
+			_, err = conn.Write(hello)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s key exchange: %v", label, err)
+	}
+	if string(peerHello[:len(magic)]) != magic {
+		return nil, fmt.Errorf("%s did not answer the %s key exchange", peerId, label)
+	}
+	send, recv, err := kx.Keys(peerHello, peerId, dialer, label)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debug(label, " with ", peerId, " is encrypted")
+	return &sealedConn{Conn: conn, reader: reader, send: send, recv: recv}, nil
+}
+
+// acceptMessageConn answers the key exchange of a dialer. Peers without
+// encryption are served in clear only if AllowPlaintext is set.
+func acceptMessageConn(peerId string, conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	// a dialer without encryption sends nothing before its first message
+	head, err := reader.Peek(len(messageHello))
+	if err != nil {
+		return nil, err
+	}
+	if string(head) == messageHello {
+		return messageHandshake(conn, reader, peerId, false)
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return nil, err
+	}
+	if !cm.Conf.MessageConf.AllowPlaintext {
+		return nil, fmt.Errorf("%s does not encrypt messages", peerId)
+	}
+	logrus.Warn("messages with ", peerId, " are not encrypted")
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
@@ -0,0 +1,244 @@
+package impl
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/schollz/progressbar/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/types"
+	"golang.org/x/term"
+)
+
+// chatFiles sends and receives the file attachments of a chat console.
+// Files are offered with a message and uploaded by the transfer application
+// once the peer accepted them.
+type chatFiles struct {
+	peerId string
+	conn   io.ReadWriteCloser
+	t      *term.Terminal
+	// wlock serializes messages of the console and of running uploads
+	wlock sync.Mutex
+	lock  sync.Mutex
+	// sent maps the IDs of our offers to the offered files
+	sent map[string]string
+	// offers are the pending offers of the peer, the last one first
+	offers []Message
+}
+
+func newChatFiles(peerId string, conn io.ReadWriteCloser, t *term.Terminal) *chatFiles {
+	return &chatFiles{
+		peerId: peerId,
+		conn:   conn,
+		t:      t,
+		sent:   make(map[string]string),
+	}
+}
+
+func (cf *chatFiles) send(msg Message) error {
+	cf.wlock.Lock()
+	defer cf.wlock.Unlock()
+	return gob.NewEncoder(cf.conn).Encode(msg)
+}
+
+func (cf *chatFiles) print(a ...interface{}) {
+	fmt.Fprintln(cf.t, append([]interface{}{string(cf.t.Escape.Yellow) + "*" + string(cf.t.Escape.Reset)}, a...)...)
+}
+
+// droppedFile returns the file of a line if it is the path of a regular
+// file, as terminals paste it when a file is dropped on them
+func droppedFile(line string) string {
+	name := strings.TrimSpace(line)
+	name = strings.TrimPrefix(name, "file://")
+	if len(name) > 1 && (name[0] == '\'' || name[0] == '"') && name[len(name)-1] == name[0] {
+		name = name[1 : len(name)-1]
+	} else {
+		name = strings.ReplaceAll(name, "\\ ", " ")
+	}
+	if strings.HasPrefix(name, "~/") {
+		name = filepath.Join(os.Getenv("HOME"), name[2:])
+	}
+	if !filepath.IsAbs(name) {
+		return ""
+	}
+	info, err := os.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	return name
+}
+
+// command handles the file commands of the console, it returns false if
+// line is a message
+func (cf *chatFiles) command(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		switch fields[0] {
+		case "/send":
+			name := droppedFile(strings.TrimSpace(strings.TrimPrefix(line, "/send")))
+			if name == "" {
+				cf.print("usage: /send ABSOLUTE_PATH_OF_FILE")
+				return true
+			}
+			cf.offer(name)
+			return true
+		case "/accept", "/reject":
+			id := ""
+			if len(fields) > 1 {
+				id = fields[1]
+			}
+			cf.answer(id, fields[0] == "/accept")
+			return true
+		}
+	}
+	if name := droppedFile(line); name != "" {
+		cf.offer(name)
+		return true
+	}
+	return false
+}
+
+func (cf *chatFiles) offer(name string) {
+	info, err := os.Stat(name)
+	if err != nil {
+		cf.print(err)
+		return
+	}
+	id := uuid.New().String()[:8]
+	cf.lock.Lock()
+	cf.sent[id] = name
+	cf.lock.Unlock()
+	err = cf.send(Message{Type: MESSAGE_TYPE_FILE_OFFER, ID: id, Payload: []byte(filepath.Base(name)), Size: info.Size()})
+	if err != nil {
+		cf.print(err)
+		return
+	}
+	cf.print(fmt.Sprintf("offered %s (%s), waiting for %s to accept", filepath.Base(name), utils.FormatByteSize(info.Size()), cf.peerId))
+}
+
+// answer accepts or rejects the offer id, or the last one if id is empty
+func (cf *chatFiles) answer(id string, accept bool) {
+	cf.lock.Lock()
+	var offer *Message
+	for i, v := range cf.offers {
+		if id == "" || v.ID == id {
+			offer = &v
+			cf.offers = append(cf.offers[:i], cf.offers[i+1:]...)
+			break
+		}
+	}
+	cf.lock.Unlock()
+	if offer == nil {
+		cf.print("no pending file offer")
+		return
+	}
+	msgType := MESSAGE_TYPE_FILE_REJECT
+	if accept {
+		msgType = MESSAGE_TYPE_FILE_ACCEPT
+	}
+	err := cf.send(Message{Type: int32(msgType), ID: offer.ID})
+	if err != nil {
+		cf.print(err)
+		return
+	}
+	if accept {
+		cf.print("receiving", string(offer.Payload))
+	}
+}
+
+// handle processes the file messages of the peer, it returns false for
+// other messages
+func (cf *chatFiles) handle(msg Message) bool {
+	switch msg.Type {
+	case MESSAGE_TYPE_FILE_OFFER:
+		cf.lock.Lock()
+		cf.offers = append([]Message{msg}, cf.offers...)
+		cf.lock.Unlock()
+		cf.print(fmt.Sprintf("%s wants to send %s (%s), /accept %s or /reject %s", cf.peerId, msg.Payload, utils.FormatByteSize(msg.Size), msg.ID, msg.ID))
+	case MESSAGE_TYPE_FILE_ACCEPT:
+		cf.lock.Lock()
+		name, ok := cf.sent[msg.ID]
+		delete(cf.sent, msg.ID)
+		cf.lock.Unlock()
+		if ok {
+			go cf.upload(msg.ID, name)
+		}
+	case MESSAGE_TYPE_FILE_REJECT:
+		cf.lock.Lock()
+		name := cf.sent[msg.ID]
+		delete(cf.sent, msg.ID)
+		cf.lock.Unlock()
+		cf.print(cf.peerId, "rejected", filepath.Base(name))
+	case MESSAGE_TYPE_FILE_DONE:
+		if len(msg.Payload) > 0 {
+			cf.print("failed to receive file:", string(msg.Payload))
+		} else {
+			cf.print("file received")
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// consoleProgress prints the progress of an upload every 10 percent
+type consoleProgress struct {
+	cf   *chatFiles
+	name string
+	size int64
+	done int64
+	step int64
+}
+
+func (cp *consoleProgress) Write(p []byte) (int, error) {
+	cp.done += int64(len(p))
+	if cp.size > 0 {
+		if step := cp.done * 10 / cp.size; step > cp.step {
+			cp.step = step
+			cp.cf.print(fmt.Sprintf("%s %d%%", cp.name, step*10))
+		}
+	}
+	return len(p), nil
+}
+
+func (cf *chatFiles) upload(id, name string) {
+	base := filepath.Base(name)
+	err := func() error {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		tr := NewTransfer(cf.peerId, name, true, nil)
+		// the console shows the progress instead of a bar
+		tr.bar = progressbar.DefaultBytesSilent(info.Size())
+		conn, err := NewSender(tr, types.OPTION_TYPE_UP).Send()
+		if err != nil {
+			return err
+		}
+		tr.SetConn(conn)
+		defer tr.Close()
+		progress := &consoleProgress{cf: cf, name: base, size: info.Size()}
+		return tr.DoUpload(io.TeeReader(file, progress))
+	}()
+	done := Message{Type: MESSAGE_TYPE_FILE_DONE, ID: id}
+	if err != nil {
+		logrus.Debug("send file ", err)
+		cf.print("cannot send", base, ":", err)
+		done.Payload = []byte(err.Error())
+	} else {
+		cf.print("sent", base)
+	}
+	cf.send(done)
+}
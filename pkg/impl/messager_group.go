@@ -0,0 +1,155 @@
+package impl
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+	"golang.org/x/term"
+)
+
+// GroupChat fans messages out to every member of a group of the address
+// book, each member gets its own messager connection
+type GroupChat struct {
+	Group string
+	lock  sync.Mutex
+	conns map[string]net.Conn
+}
+
+func NewGroupChat(group string) *GroupChat {
+	return &GroupChat{
+		Group: group,
+		conns: make(map[string]net.Conn),
+	}
+}
+
+// Connect opens a connection to each member, members which can't be reached
+// are skipped. An error is returned if none is reachable.
+func (gc *GroupChat) Connect() error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	members := cm.GroupMembers(gc.Group)
+	if len(members) == 0 {
+		return fmt.Errorf("group %s has no members", gc.Group)
+	}
+	var wg sync.WaitGroup
+	for _, id := range members {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			msgr := NewMessager(id)
+			msgr.Preper(context.Background())
+			conn, err := NewSender(msgr, types.OPTION_TYPE_UP).Send()
+			if err == nil {
+				conn, err = msgr.Secure(conn)
+			}
+			if err != nil {
+				logrus.Warn("cannot reach ", id, " of ", gc.Group, ": ", err)
+				return
+			}
+			gc.lock.Lock()
+			gc.conns[id] = conn
+			gc.lock.Unlock()
+		}(id)
+	}
+	wg.Wait()
+	if len(gc.conns) == 0 {
+		return fmt.Errorf("no member of %s reachable", gc.Group)
+	}
+	return nil
+}
+
+// Send sends text to every connected member, members whose connection
+// failed are dropped
+func (gc *GroupChat) Send(text string) map[string]error {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	ret := make(map[string]error)
+	for id, conn := range gc.conns {
+		err := gob.NewEncoder(conn).Encode(Message{Payload: []byte(text), Group: gc.Group})
+		if err != nil {
+			ret[id] = err
+			conn.Close()
+			delete(gc.conns, id)
+			continue
+		}
+		saveMessage(id, true, text)
+	}
+	return ret
+}
+
+// OpenConsole runs a chat with the group on the terminal until input ends
+// or every member left
+func (gc *GroupChat) OpenConsole() {
+	if !term.IsTerminal(0) || !term.IsTerminal(1) {
+		return
+	}
+	oldState, err := term.MakeRaw(0)
+	if err != nil {
+		return
+	}
+	defer term.Restore(0, oldState)
+	screen := struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}
+	t := term.NewTerminal(screen, "")
+	t.SetPrompt(string(t.Escape.Red) + gc.Group + "> " + string(t.Escape.Reset))
+
+	done := make(chan struct{})
+	var left sync.WaitGroup
+	gc.lock.Lock()
+	for id, conn := range gc.conns {
+		left.Add(1)
+		go func(id string, conn net.Conn) {
+			defer left.Done()
+			prefix := string(t.Escape.Cyan) + id + ":" + string(t.Escape.Reset)
+			for {
+				var msg Message
+				err := types.DecodeLimited(conn, MaxStreamMessageSize, &msg)
+				if err != nil {
+					fmt.Fprintln(t, prefix, "left the chat")
+					return
+				}
+				saveMessage(id, false, string(msg.Payload))
+				fmt.Fprintln(t, prefix, string(msg.Payload))
+			}
+		}(id, conn)
+	}
+	gc.lock.Unlock()
+	go func() {
+		left.Wait()
+		close(done)
+	}()
+	go func() {
+		for {
+			line, err := t.ReadLine()
+			if err != nil {
+				gc.Close()
+				return
+			}
+			for id, err := range gc.Send(line) {
+				fmt.Fprintln(t, "cannot send to", id, err)
+			}
+		}
+	}()
+	<-done
+}
+
+func (gc *GroupChat) Close() {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	for id, conn := range gc.conns {
+		conn.Close()
+		delete(gc.conns, id)
+	}
+}
@@ -0,0 +1,158 @@
+package impl
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+// HistoryEntry is a message saved in the history of a peer
+type HistoryEntry struct {
+	Time     time.Time
+	Peer     string
+	Outgoing bool
+	Text     string
+}
+
+// the daemon and consoles may append to the same history
+var historyLock sync.Mutex
+
+func messageHistoryDir() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "messages")
+}
+
+// historyFile returns the history of peerId, which is kept as one JSON
+// object per line so appending never rewrites the file
+func historyFile(peerId string) string {
+	name := strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(peerId)
+	return filepath.Join(messageHistoryDir(), name+".jsonl")
+}
+
+// saveMessage appends a message to the history of peerId if enabled,
+// failures are only logged so they never break a conversation
+func saveMessage(peerId string, outgoing bool, text string) {
+	if peerId == "" {
+		return
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		logrus.Error("message history ", err)
+		return
+	}
+	if !cm.Conf.MessageConf.History {
+		return
+	}
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	err = os.MkdirAll(messageHistoryDir(), 0700)
+	if err != nil {
+		logrus.Error("message history ", err)
+		return
+	}
+	file, err := os.OpenFile(historyFile(peerId), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		logrus.Error("message history ", err)
+		return
+	}
+	defer file.Close()
+	err = json.NewEncoder(file).Encode(HistoryEntry{
+		Time:     time.Now(),
+		Peer:     peerId,
+		Outgoing: outgoing,
+		Text:     text,
+	})
+	if err != nil {
+		logrus.Error("message history ", err)
+	}
+}
+
+func readHistory(name string, match func(HistoryEntry) bool) ([]HistoryEntry, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	var ret []HistoryEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			// a line cut by a crash
+			continue
+		}
+		if match == nil || match(entry) {
+			ret = append(ret, entry)
+		}
+	}
+	return ret, scanner.Err()
+}
+
+// LoadHistory returns the last limit messages exchanged with peerId, all of
+// them if limit is 0
+func LoadHistory(peerId string, limit int) ([]HistoryEntry, error) {
+	entries, err := readHistory(historyFile(peerId), nil)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, nil
+}
+
+// SearchHistory returns the messages containing query, ignoring case, of
+// peerId or of every peer if peerId is empty
+func SearchHistory(peerId, query string) ([]HistoryEntry, error) {
+	query = strings.ToLower(query)
+	match := func(entry HistoryEntry) bool {
+		return strings.Contains(strings.ToLower(entry.Text), query)
+	}
+	if peerId != "" {
+		return readHistory(historyFile(peerId), match)
+	}
+	files, err := filepath.Glob(filepath.Join(messageHistoryDir(), "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	var ret []HistoryEntry
+	for _, v := range files {
+		entries, err := readHistory(v, match)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, entries...)
+	}
+	return ret, nil
+}
+
+// ShowHistory prints messages as a table
+func ShowHistory(entries []HistoryEntry) {
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Time", "Peer", "From", "Message"})
+	t.AppendSeparator()
+	for _, v := range entries {
+		from := v.Peer
+		if v.Outgoing {
+			from = "me"
+		}
+		t.AppendRows([]table.Row{
+			{v.Time.Format("2 Jan 2006 15:04:05"), v.Peer, from, v.Text},
+		})
+	}
+	t.AppendSeparator()
+	t.Render()
+}
@@ -0,0 +1,315 @@
+package impl
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// OutboxEntry is a message waiting for its peer to come online
+type OutboxEntry struct {
+	ID       string
+	Time     time.Time
+	Peer     string
+	Group    string
+	Text     string
+	Attempts int32
+}
+
+// Outbox delivers queued messages once their peer is reachable. Peers are
+// tried every RetryInterval, and right away when they send a message.
+type Outbox struct {
+	stop chan struct{}
+	kick chan string
+	once sync.Once
+}
+
+// runningOutbox is the outbox of the daemon, messages received from a peer
+// kick the delivery of its queue
+var runningOutbox struct {
+	lock sync.Mutex
+	ob   *Outbox
+}
+
+func NewOutbox() *Outbox {
+	return &Outbox{
+		stop: make(chan struct{}),
+		kick: make(chan string, 16),
+	}
+}
+
+func outboxDir() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "outbox")
+}
+
+// QueueMessage saves a message for a later delivery, every message is its
+// own file so the daemon and the command line never rewrite each other
+func QueueMessage(peerId, group, text string) error {
+	return writeOutboxEntry(newOutboxEntry(peerId, group, text))
+}
+
+func newOutboxEntry(peerId, group, text string) OutboxEntry {
+	return OutboxEntry{
+		ID:    uuid.New().String(),
+		Time:  time.Now(),
+		Peer:  peerId,
+		Group: group,
+		Text:  text,
+	}
+}
+
+func writeOutboxEntry(entry OutboxEntry) error {
+	err := os.MkdirAll(outboxDir(), 0700)
+	if err != nil {
+		return err
+	}
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(outboxDir(), "."+entry.ID)
+	err = ioutil.WriteFile(tmp, bs, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(outboxDir(), entry.ID+".json"))
+}
+
+// LoadOutbox returns the queued messages from the oldest
+func LoadOutbox() ([]OutboxEntry, error) {
+	files, err := filepath.Glob(filepath.Join(outboxDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var ret []OutboxEntry
+	for _, v := range files {
+		bs, err := ioutil.ReadFile(v)
+		if err != nil {
+			continue
+		}
+		var entry OutboxEntry
+		if json.Unmarshal(bs, &entry) != nil {
+			logrus.Warn("invalid queued message ", v)
+			continue
+		}
+		ret = append(ret, entry)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Time.Before(ret[j].Time)
+	})
+	return ret, nil
+}
+
+func removeOutboxEntry(id string) {
+	err := os.Remove(filepath.Join(outboxDir(), id+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warn("outbox ", err)
+	}
+}
+
+// DeliverMessages sends messages to peerId and waits for their receipts, it
+// returns the IDs of the delivered ones
+func DeliverMessages(peerId string, entries []OutboxEntry) ([]string, error) {
+	msgr := NewMessager(peerId)
+	msgr.Preper(context.Background())
+	conn, err := NewSender(msgr, types.OPTION_TYPE_UP).Send()
+	if err != nil {
+		return nil, err
+	}
+	conn, err = msgr.Secure(conn)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	pending := make(map[string]bool)
+	// the messager starts a new gob stream for every message
+	for _, v := range entries {
+		err = gob.NewEncoder(conn).Encode(Message{Type: MESSAGE_TYPE_TEXT, ID: v.ID, Payload: []byte(v.Text), Group: v.Group})
+		if err != nil {
+			return nil, err
+		}
+		pending[v.ID] = true
+	}
+	var delivered []string
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for len(pending) > 0 {
+		var msg Message
+		err = types.DecodeLimited(conn, MaxStreamMessageSize, &msg)
+		if err != nil {
+			return delivered, fmt.Errorf("%d messages not confirmed: %v", len(pending), err)
+		}
+		if msg.Type != MESSAGE_TYPE_RECEIPT {
+			// the peer answered before the receipts arrived
+			saveMessage(peerId, false, string(msg.Payload))
+			continue
+		}
+		id := string(msg.Payload)
+		if pending[id] {
+			delete(pending, id)
+			delivered = append(delivered, id)
+		}
+	}
+	return delivered, nil
+}
+
+// SendOrQueue delivers a message right away, or queues it if the peer is
+// not reachable. It reports whether the message was queued.
+func SendOrQueue(peerId, group, text string) (bool, error) {
+	entry := newOutboxEntry(peerId, group, text)
+	delivered, err := DeliverMessages(peerId, []OutboxEntry{entry})
+	if err == nil && len(delivered) == 1 {
+		saveMessage(peerId, true, text)
+		return false, nil
+	}
+	logrus.Debug("queue message to ", peerId, ": ", err)
+	return true, writeOutboxEntry(entry)
+}
+
+// flush tries to deliver the queue of peerId, or of every peer if empty
+func (ob *Outbox) flush(peerId string) {
+	entries, err := LoadOutbox()
+	if err != nil {
+		logrus.Error("outbox ", err)
+		return
+	}
+	queues := make(map[string][]OutboxEntry)
+	for _, v := range entries {
+		if peerId == "" || v.Peer == peerId {
+			queues[v.Peer] = append(queues[v.Peer], v)
+		}
+	}
+	for peer, queue := range queues {
+		delivered, err := DeliverMessages(peer, queue)
+		done := make(map[string]bool)
+		for _, id := range delivered {
+			done[id] = true
+		}
+		for _, v := range queue {
+			if done[v.ID] {
+				removeOutboxEntry(v.ID)
+				saveMessage(peer, true, v.Text)
+				continue
+			}
+			v.Attempts++
+			writeOutboxEntry(v)
+		}
+		if len(delivered) > 0 {
+			logrus.Infof("delivered %d queued messages to %s", len(delivered), peer)
+		}
+		if err != nil {
+			logrus.Debug("peer ", peer, " not reachable: ", err)
+		}
+	}
+}
+
+// Run delivers queued messages until Close is called
+func (ob *Outbox) Run() {
+	runningOutbox.lock.Lock()
+	runningOutbox.ob = ob
+	runningOutbox.lock.Unlock()
+	var interval time.Duration
+	cm, err := conf.Shared()
+	if err != nil {
+		logrus.Error(err)
+	} else {
+		interval = time.Duration(cm.Conf.MessageConf.RetryInterval) * time.Second
+	}
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ob.stop:
+			return
+		case peer := <-ob.kick:
+			ob.flush(peer)
+		case <-ticker.C:
+			ob.flush("")
+		}
+	}
+}
+
+// peerOnline is called when a peer sends a message, its queue is delivered
+// right away
+func peerOnline(peerId string) {
+	runningOutbox.lock.Lock()
+	ob := runningOutbox.ob
+	runningOutbox.lock.Unlock()
+	if ob == nil {
+		return
+	}
+	select {
+	case ob.kick <- peerId:
+	default:
+	}
+}
+
+func (ob *Outbox) Close() {
+	ob.once.Do(func() {
+		runningOutbox.lock.Lock()
+		if runningOutbox.ob == ob {
+			runningOutbox.ob = nil
+		}
+		runningOutbox.lock.Unlock()
+		close(ob.stop)
+	})
+}
+
+// ShowOutbox prints the messages waiting for delivery
+func ShowOutbox() error {
+	entries, err := LoadOutbox()
+	if err != nil {
+		return err
+	}
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"ID", "Queued", "Peer", "Attempts", "Message"})
+	t.AppendSeparator()
+	for _, v := range entries {
+		t.AppendRows([]table.Row{
+			{v.ID, v.Time.Format("2 Jan 2006 15:04:05"), v.Peer, v.Attempts, v.Text},
+		})
+	}
+	t.AppendSeparator()
+	t.Render()
+	return nil
+}
+
+// recentMessages remembers the IDs of received messages, so a message whose
+// receipt was lost is not shown twice when it is delivered again
+var recentMessages = struct {
+	lock  sync.Mutex
+	ids   map[string]bool
+	order []string
+}{ids: make(map[string]bool)}
+
+func seenMessage(id string) bool {
+	recentMessages.lock.Lock()
+	defer recentMessages.lock.Unlock()
+	if recentMessages.ids[id] {
+		return true
+	}
+	recentMessages.ids[id] = true
+	recentMessages.order = append(recentMessages.order, id)
+	if len(recentMessages.order) > 1024 {
+		delete(recentMessages.ids, recentMessages.order[0])
+		recentMessages.order = recentMessages.order[1:]
+	}
+	return false
+}
@@ -0,0 +1,271 @@
+package impl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"golang.org/x/crypto/curve25519"
+)
+
+// rotations sent along signaling messages, older ones are dropped
+const maxRotations = 8
+
+// KeyRotation announces the keys replacing the node key OldNodeKey
+type KeyRotation struct {
+	ID             string
+	OldNodeKey     []byte
+	NewNodeKey     []byte
+	NewIdentityKey []byte
+	Time           time.Time
+}
+
+// SignedRotation is a key rotation signed by the old and the new node key
+type SignedRotation struct {
+	// Payload is the JSON of the KeyRotation
+	Payload []byte
+
+	OldSignature []byte
+	NewSignature []byte
+}
+
+func rotationsFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "node_rotations.json")
+}
+
+func loadRotations() ([]SignedRotation, error) {
+	var ret []SignedRotation
+	bs, err := ioutil.ReadFile(rotationsFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, json.Unmarshal(bs, &ret)
+}
+
+// rotationsData returns the last rotations of this device as they are
+// sent to peers, nil if the keys were never rotated
+func rotationsData() ([]byte, error) {
+	list, err := loadRotations()
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	if len(list) > maxRotations {
+		list = list[len(list)-maxRotations:]
+	}
+	return json.Marshal(list)
+}
+
+func replaceFile(file string, data []byte) error {
+	tmp := fmt.Sprintf("%s.%d", file, os.Getpid())
+	err := ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// RotateIdentity replaces the node key and the identity key of this device.
+// The rotation is signed by the old and the new node key and sent along
+// the signaling messages of this device, so peers which pinned the old keys
+// pin the new ones. A certificate of the old node key is removed. It
+// returns the fingerprint of the new node key.
+func RotateIdentity() (string, error) {
+	cm, err := conf.Shared()
+	if err != nil {
+		return "", err
+	}
+	oldKey, err := NodeKey()
+	if err != nil {
+		return "", err
+	}
+	newPub, newKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	newPriv := make([]byte, curve25519.ScalarSize)
+	_, err = rand.Read(newPriv)
+	if err != nil {
+		return "", err
+	}
+	newIdentity, err := curve25519.X25519(newPriv, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(KeyRotation{
+		ID:             cm.Conf.ID,
+		OldNodeKey:     oldKey.Public().(ed25519.PublicKey),
+		NewNodeKey:     newPub,
+		NewIdentityKey: newIdentity,
+		Time:           time.Now().UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+	list, err := loadRotations()
+	if err != nil {
+		return "", err
+	}
+	list = append(list, SignedRotation{
+		Payload:      payload,
+		OldSignature: ed25519.Sign(oldKey, payload),
+		NewSignature: ed25519.Sign(newKey, payload),
+	})
+	bs, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	// the key store is encrypted with the identity key
+	err = rekeyKeyStore(newPriv)
+	if err != nil {
+		return "", err
+	}
+	err = replaceFile(rotationsFile(), bs)
+	if err != nil {
+		return "", err
+	}
+	err = writeStoreFile(messageKeyFile(), newPriv)
+	if err != nil {
+		return "", err
+	}
+	err = writeKeyFile(nodeKeyFile(), newKey)
+	if err != nil {
+		return "", err
+	}
+	if err = os.Remove(nodeCertFile()); err == nil {
+		logrus.Warn("the certificate of the old node key was removed, install a certificate of the new key")
+	}
+	logrus.Info("rotated node key to ", keyFingerprint(newPub))
+	return keyFingerprint(newPub), nil
+}
+
+// followRotations walks the rotations of peerId from the pinned node key to
+// the node key it presents, and returns the identity key of the last one
+func followRotations(peerId string, pinned, presented, data []byte) ([]byte, error) {
+	var list []SignedRotation
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key rotations of %s", peerId)
+	}
+	cur := pinned
+	var identity []byte
+	for range list {
+		found := false
+		for _, v := range list {
+			var kr KeyRotation
+			if json.Unmarshal(v.Payload, &kr) != nil || kr.ID != peerId || !bytes.Equal(kr.OldNodeKey, cur) {
+				continue
+			}
+			if len(kr.NewNodeKey) != ed25519.PublicKeySize ||
+				!ed25519.Verify(ed25519.PublicKey(cur), v.Payload, v.OldSignature) ||
+				!ed25519.Verify(ed25519.PublicKey(kr.NewNodeKey), v.Payload, v.NewSignature) {
+				return nil, fmt.Errorf("invalid key rotation of %s", peerId)
+			}
+			cur = kr.NewNodeKey
+			identity = kr.NewIdentityKey
+			found = true
+			break
+		}
+		if !found {
+			break
+		}
+		if bytes.Equal(cur, presented) {
+			return identity, nil
+		}
+	}
+	return nil, fmt.Errorf("no key rotation of %s leads to its node key", peerId)
+}
+
+// updateIdentityPin replaces the pinned identity key of peerId after a key
+// rotation, peers not pinned are left alone
+func updateIdentityPin(peerId string, pub []byte) error {
+	if len(pub) != curve25519.PointSize {
+		return fmt.Errorf("invalid identity key of %s", peerId)
+	}
+	messageKeysLock.Lock()
+	defer messageKeysLock.Unlock()
+	keys, err := loadPinnedKeys()
+	if err != nil {
+		return err
+	}
+	if _, ok := keys[peerId]; !ok {
+		return nil
+	}
+	keys[peerId] = base64.StdEncoding.EncodeToString(pub)
+	return savePinnedKeys(keys)
+}
+
+// PinnedPeers returns the peers which pinned a key of this device, they are
+// told about key rotations
+func PinnedPeers() ([]string, error) {
+	messageKeysLock.Lock()
+	keys, err := loadPinnedKeys()
+	messageKeysLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	nodeKeysLock.Lock()
+	nodes, err := loadNodePeers()
+	nodeKeysLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range nodes {
+		keys[k] = v
+	}
+	ret := make([]string, 0, len(keys))
+	for k := range keys {
+		ret = append(ret, k)
+	}
+	return ret, nil
+}
+
+// IsRevoked reports whether peerId was revoked
+func IsRevoked(cm *conf.ConfManager, peerId string) bool {
+	for _, v := range cm.Conf.IdentityConf.Revoked {
+		if v == peerId {
+			return true
+		}
+	}
+	return false
+}
+
+// RevokePeer refuses peerId from now on: its keys are unpinned, its TOTP
+// secret removed and it can't pair again until it is removed from
+// IdentityConf.Revoked
+func RevokePeer(peerId string) error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	if !IsRevoked(cm, peerId) {
+		err = cm.SetValue("identityconf.revoked", append(cm.Conf.IdentityConf.Revoked, peerId))
+		if err != nil {
+			return err
+		}
+	}
+	for _, forget := range []func(string) error{ForgetPeerKey, ForgetNodeKey} {
+		if err := forget(peerId); err != nil {
+			logrus.Debug(err)
+		}
+	}
+	for _, v := range cm.Conf.TOTPConf.Peers {
+		if v == peerId {
+			return RemoveTOTP(peerId)
+		}
+	}
+	logrus.Info("revoked ", peerId)
+	return nil
+}
@@ -0,0 +1,134 @@
+package impl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+// sandbox confines the paths a remote peer can access through the transfer
+// and sync responders
+type sandbox struct {
+	roots     []string
+	readOnly  bool
+	downloads string
+}
+
+// newSandbox loads the sandbox configured for peerId, falling back to the
+// global one. With readOnly it is read only whatever its configure. A root
+// which can't be resolved fails the sandbox, rather than leaving the peer
+// with fewer roots or none.
+func newSandbox(peerId string, readOnly bool) (*sandbox, error) {
+	cm, err := conf.Shared()
+	if err != nil {
+		return nil, err
+	}
+	sc := cm.Conf.TransferConf.Sandbox
+	for _, v := range cm.Conf.TransferConf.PeerSandboxes {
+		if v.PeerId == peerId {
+			sc = v
+			break
+		}
+	}
+	ret := &sandbox{
+		readOnly:  sc.ReadOnly || readOnly,
+		downloads: downloadDir(cm.Conf.TransferConf),
+	}
+	for _, root := range sc.Roots {
+		real, err := sandboxRoot(root)
+		if err != nil {
+			return nil, fmt.Errorf("sandbox root %q: %v", root, err)
+		}
+		ret.roots = append(ret.roots, real)
+	}
+	return ret, nil
+}
+
+// sandboxRoot resolves a root of the configure, ~ being the home directory
+func sandboxRoot(root string) (string, error) {
+	if root == "" {
+		return "", fmt.Errorf("empty path")
+	}
+	if root == "~" || strings.HasPrefix(root, "~"+string(filepath.Separator)) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		root = filepath.Join(home, root[1:])
+	} else if strings.HasPrefix(root, "~") {
+		return "", fmt.Errorf("only the home directory of the daemon is known as ~")
+	}
+	return canonicalPath(root)
+}
+
+// canonicalPath returns the absolute path of name with symbolic links of
+// its existing part resolved, so links can't be used to leave a root
+func canonicalPath(name string) (string, error) {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(name)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(name)
+		if parent == name {
+			return filepath.Join(name, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(name), rest)
+		name = parent
+	}
+}
+
+func within(root, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolve maps a path requested by the peer to a local path. Relative paths
+// are taken from the first root, or the download directory when no root is
+// configured.
+func (sb *sandbox) resolve(name string, write bool) (string, error) {
+	if write && sb.readOnly {
+		return "", fmt.Errorf("permission denied: read-only sandbox")
+	}
+	roots := sb.roots
+	if len(roots) == 0 {
+		if !write {
+			if filepath.IsAbs(name) {
+				return filepath.Clean(name), nil
+			}
+			return filepath.Abs(name)
+		}
+		downloads, err := canonicalPath(sb.downloads)
+		if err != nil {
+			return "", err
+		}
+		roots = []string{downloads}
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(roots[0], name)
+	}
+	real, err := canonicalPath(name)
+	if err != nil {
+		return "", err
+	}
+	for _, root := range roots {
+		if within(root, real) {
+			return real, nil
+		}
+	}
+	return "", fmt.Errorf("permission denied: %s is outside of the sandbox", name)
+}
@@ -0,0 +1,124 @@
+package impl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testRoots makes a sandbox root holding a file, a link to a directory out
+// of the root and a link back into the root, next to that directory
+func testRoots(t *testing.T) (root, outside string) {
+	dir, err := canonicalPath(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root = filepath.Join(dir, "root")
+	outside = filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(root, "sub"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "sub", "file"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "inner")); err != nil {
+		t.Fatal(err)
+	}
+	return root, outside
+}
+
+func TestCanonicalPath(t *testing.T) {
+	root, outside := testRoots(t)
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"plain", filepath.Join(root, "sub", "file"), filepath.Join(root, "sub", "file")},
+		{"dot dot", filepath.Join(root, "sub", "..", "sub", "file"), filepath.Join(root, "sub", "file")},
+		{"missing part", filepath.Join(root, "sub", "new", "file"), filepath.Join(root, "sub", "new", "file")},
+		{"link out", filepath.Join(root, "escape", "file"), filepath.Join(outside, "file")},
+		{"link in", filepath.Join(root, "inner", "file"), filepath.Join(root, "sub", "file")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := canonicalPath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("canonicalPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithin(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "srv", "root")
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{root, true},
+		{filepath.Join(root, "file"), true},
+		{filepath.Join(root, "..file"), true},
+		{filepath.Join(root, ".."), false},
+		{filepath.Join(root, "..", "other"), false},
+		{root + "2", false},
+		{filepath.Join(string(filepath.Separator), "etc", "passwd"), false},
+	}
+	for _, tt := range tests {
+		if got := within(root, tt.name); got != tt.want {
+			t.Errorf("within(%q, %q) = %v, want %v", root, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSandboxResolve(t *testing.T) {
+	root, outside := testRoots(t)
+	sb := &sandbox{roots: []string{root}}
+	ro := &sandbox{roots: []string{root}, readOnly: true}
+	tests := []struct {
+		name  string
+		sb    *sandbox
+		path  string
+		write bool
+		want  string
+	}{
+		{"relative", sb, "sub/file", false, filepath.Join(root, "sub", "file")},
+		{"relative write", sb, "sub/new", true, filepath.Join(root, "sub", "new")},
+		{"absolute", sb, filepath.Join(root, "sub", "file"), false, filepath.Join(root, "sub", "file")},
+		{"traversal", sb, "../outside/file", false, ""},
+		{"deep traversal", sb, "sub/../../outside/file", true, ""},
+		{"absolute outside", sb, filepath.Join(outside, "file"), false, ""},
+		{"absolute traversal", sb, filepath.Join(root, "..", "outside"), false, ""},
+		{"symlink escape", sb, "escape/file", false, ""},
+		{"symlink escape write", sb, "escape/new", true, ""},
+		{"symlink inside", sb, "inner/file", false, filepath.Join(root, "sub", "file")},
+		{"read only read", ro, "sub/file", false, filepath.Join(root, "sub", "file")},
+		{"read only write", ro, "sub/file", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.sb.resolve(tt.path, tt.write)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("resolve(%q) = %q, want an error", tt.path, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("resolve(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
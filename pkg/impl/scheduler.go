@@ -0,0 +1,276 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/cron"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// taskOutputTail is the size of the end of the output of a command kept in
+// the event of its task
+const taskOutputTail = 512
+
+// Scheduler runs the tasks of scheduleconf against their peers through the
+// daemon and reports each run to record. The configure is read again every
+// minute, so tasks added or removed take effect without a restart.
+type Scheduler struct {
+	record func(types.Event)
+	stop   chan struct{}
+	once   sync.Once
+	lock   sync.Mutex
+	// running are the names of the tasks running, a task whose previous
+	// run isn't over is skipped
+	running map[string]bool
+}
+
+func NewScheduler(record func(types.Event)) *Scheduler {
+	return &Scheduler{
+		record:  record,
+		stop:    make(chan struct{}),
+		running: make(map[string]bool),
+	}
+}
+
+func (sc *Scheduler) Run() {
+	// next run of the tasks by name and schedule, a changed schedule
+	// starts over
+	next := make(map[string]time.Time)
+	invalid := make(map[string]bool)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-sc.stop:
+			return
+		case <-timer.C:
+		}
+		var tasks []conf.TaskConf
+		cm, err := conf.Shared()
+		if err != nil {
+			logrus.Warn("scheduler: ", err)
+		} else {
+			tasks = cm.Conf.ScheduleConf.Tasks
+		}
+		now := time.Now()
+		wait := time.Minute
+		seen := make(map[string]bool)
+		for _, t := range tasks {
+			key := t.Name + "\x00" + t.Schedule
+			seen[key] = true
+			schedule, err := cron.Parse(t.Schedule)
+			if err != nil {
+				if !invalid[key] {
+					logrus.Warn("task ", t.Name, ": ", err)
+					invalid[key] = true
+				}
+				continue
+			}
+			at, ok := next[key]
+			if ok && !at.After(now) {
+				go sc.run(cm, t)
+				ok = false
+			}
+			if !ok {
+				at = schedule.Next(now)
+				if at.IsZero() {
+					continue
+				}
+				next[key] = at
+			}
+			if d := at.Sub(now); d < wait {
+				wait = d
+			}
+		}
+		for key := range next {
+			if !seen[key] {
+				delete(next, key)
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+func (sc *Scheduler) Close() {
+	sc.once.Do(func() {
+		close(sc.stop)
+	})
+}
+
+// run runs t once and reports it
+func (sc *Scheduler) run(cm *conf.ConfManager, t conf.TaskConf) {
+	peer := cm.ResolvePeer(t.Peer)
+	ev := types.Event{
+		Kind:     types.EVENT_TASK,
+		TargetId: peer,
+		App:      AppName(types.APP_TYPE_TRANSFER),
+	}
+	if t.Exec != "" {
+		ev.App = AppName(types.APP_TYPE_EXEC)
+	}
+	sc.lock.Lock()
+	busy := sc.running[t.Name]
+	sc.running[t.Name] = true
+	sc.lock.Unlock()
+	if busy {
+		ev.Time = time.Now()
+		ev.Kind = types.EVENT_TASK_FAILURE
+		ev.Message = t.Name + ": skipped, the previous run isn't over"
+		sc.record(ev)
+		return
+	}
+	defer func() {
+		sc.lock.Lock()
+		delete(sc.running, t.Name)
+		sc.lock.Unlock()
+	}()
+	ctx := context.Background()
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t.Timeout)*time.Second)
+		defer cancel()
+	}
+	start := time.Now()
+	msg, err := RunTask(ctx, peer, t)
+	ev.Time = time.Now()
+	if err != nil {
+		ev.Kind = types.EVENT_TASK_FAILURE
+		msg = err.Error()
+	}
+	ev.Message = fmt.Sprintf("%s: %s after %s", t.Name, msg, time.Since(start).Round(time.Second))
+	sc.record(ev)
+}
+
+// tailWriter keeps the end of what is written to it
+type tailWriter struct {
+	lock sync.Mutex
+	buf  []byte
+}
+
+func (tw *tailWriter) Write(p []byte) (int, error) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	tw.buf = append(tw.buf, p...)
+	if over := len(tw.buf) - taskOutputTail; over > 0 {
+		tw.buf = append(tw.buf[:0], tw.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// RunTask runs the action of t against peer through the daemon and
+// returns what it did
+func RunTask(ctx context.Context, peer string, t conf.TaskConf) (string, error) {
+	switch {
+	case t.Exec != "":
+		imp := NewExec(peer, t.Exec)
+		conn, err := NewSender(imp, types.OPTION_TYPE_UP).SendContext(ctx)
+		if err != nil {
+			return "", err
+		}
+		imp.SetConn(conn)
+		defer imp.Close()
+		output := &tailWriter{}
+		code, err := imp.DoRun(ctx, output, output)
+		if err != nil {
+			return "", err
+		}
+		msg := fmt.Sprintf("exit %d", code)
+		if tail := strings.TrimSpace(string(output.buf)); tail != "" {
+			msg += ": " + tail
+		}
+		if code != 0 {
+			return "", fmt.Errorf("%s", msg)
+		}
+		return msg, nil
+	case t.Pull != "":
+		return pullTask(ctx, peer, t)
+	case t.Push != "":
+		info, err := os.Stat(t.Push)
+		if err != nil {
+			return "", err
+		}
+		tr := NewTransfer(peer, t.Push, true, nil)
+		tr.bar = progressbar.DefaultBytesSilent(info.Size())
+		err = transferTask(ctx, tr, func() error {
+			return tr.DoUpload(nil)
+		})
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("pushed %s (%d bytes)", t.Push, info.Size()), nil
+	}
+	return "", fmt.Errorf("nothing to run")
+}
+
+// transferTask connects tr and runs do, the connection is closed if ctx is
+// done first
+func transferTask(ctx context.Context, tr *Transfer, do func() error) error {
+	conn, err := NewSender(tr, types.OPTION_TYPE_UP).SendContext(ctx)
+	if err != nil {
+		return err
+	}
+	tr.SetConn(conn)
+	defer tr.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	err = do()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// pullTask downloads t.Pull next to its destination first, so an
+// interrupted pull leaves the previous copy
+func pullTask(ctx context.Context, peer string, t conf.TaskConf) (string, error) {
+	dest := t.Local
+	if dest == "" {
+		dest = localDownloadDir()
+	}
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		dest = filepath.Join(dest, filepath.Base(t.Pull))
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	tr := NewTransfer(peer, t.Pull, false, nil)
+	tr.bar = progressbar.DefaultBytesSilent(-1)
+	err = transferTask(ctx, tr, func() error {
+		return tr.DoDownload(tmp)
+	})
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(tmp.Name(), dest)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pulled %s to %s (%d bytes)", t.Pull, dest, info.Size()), nil
+}
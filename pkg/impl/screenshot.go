@@ -0,0 +1,74 @@
+package impl
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/go-vgo/robotgo"
+	"golang.org/x/image/draw"
+)
+
+// captureScreen captures the desktop of this device, with grim on Wayland
+// as X11 capture returns black screens there
+func captureScreen() (image.Image, error) {
+	if runtime.GOOS == "linux" {
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			return captureWayland()
+		}
+		if os.Getenv("DISPLAY") == "" {
+			return nil, fmt.Errorf("DISPLAY is not set, start the daemon in the desktop session")
+		}
+	}
+	img := robotgo.CaptureImg()
+	if img == nil || img.Bounds().Empty() {
+		return nil, fmt.Errorf("cannot capture the screen")
+	}
+	return img, nil
+}
+
+func captureWayland() (image.Image, error) {
+	if _, err := exec.LookPath("grim"); err != nil {
+		return nil, fmt.Errorf("grim is needed to capture Wayland desktops")
+	}
+	out, err := exec.Command("grim", "-t", "png", "-").Output()
+	if err != nil {
+		return nil, fmt.Errorf("grim: %v", err)
+	}
+	return png.Decode(bytes.NewReader(out))
+}
+
+// scaleImage scales img down to width, keeping its ratio
+func scaleImage(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	if width <= 0 || width >= b.Dx() {
+		return img
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// encodeScreenshot captures the screen, scales it down to width if it is
+// set and returns it as a JPEG of quality with the size of the screen
+func encodeScreenshot(width, quality int) ([]byte, image.Rectangle, error) {
+	img, err := captureScreen()
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, scaleImage(img, width), &jpeg.Options{Quality: quality})
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	return buf.Bytes(), img.Bounds(), nil
+}
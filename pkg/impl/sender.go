@@ -7,7 +7,7 @@ package impl
 // Communication Flow:
 // 1. Client creates an application implementation (SSH, VNC, Proxy, etc.)
 // 2. NewSender() encodes the implementation and creates a Sender request
-// 3. Sender.Send() connects to the daemon via TCP and sends the gob-encoded request
+// 3. Sender.Send() connects to the daemon via TCP and sends the request in the wire encoding
 // 4. Daemon (internal/node/tcp.go) receives, decodes, and processes the request
 // 5. Connection is established via WebRTC or direct TCP based on the implementation
 //
@@ -19,12 +19,44 @@ package impl
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"fmt"
+	"io"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+const (
+	// MaxSenderSize bounds an encoded Sender, the payload included
+	MaxSenderSize = 1 << 20
+
+	// MaxRequestSize bounds the requests the apps read from peers
+	MaxRequestSize = 64 << 10
+
+	// MaxReplySize bounds the replies the apps read from peers, lists of
+	// containers or sessions included
+	MaxReplySize = 4 << 20
+
+	// MaxStreamMessageSize bounds a message of the streams of the apps:
+	// terminal data, relayed input, sync blocks and chat messages
+	MaxStreamMessageSize = 2 << 20
+
+	// MaxPairIdLength bounds Sender.PairId
+	MaxPairIdLength = 256
+
+	// UnixEntryPrefix starts the Sender.LocalEntry of a shared daemon,
+	// followed by the path of its socket
+	UnixEntryPrefix = "unix:"
+
+	// MaxEntryLength bounds Sender.LocalEntry
+	MaxEntryLength = 128
 )
 
 // Sender represents a request structure sent to the Local TCP daemon (internal/node/tcp.go).
@@ -34,7 +66,8 @@ type Sender struct {
 	// Type contains both the application code (upper bits) and option code (lower 8 bits)
 	// Format: (appCode << flagLen) | optionCode
 	// Application codes: APP_TYPE_SSH, APP_TYPE_VNC, APP_TYPE_PROXY, etc. (pkg/types/types.go)
-	// Option codes: OPTION_TYPE_UP, OPTION_TYPE_DOWN, OPTION_TYPE_STAT, OPTION_TYPE_ATTACH
+	// Option codes: OPTION_TYPE_UP, OPTION_TYPE_DOWN, OPTION_TYPE_STAT, OPTION_TYPE_ATTACH,
+	// OPTION_TYPE_LIST, OPTION_TYPE_PAUSE, OPTION_TYPE_RESUME, OPTION_TYPE_LOG
 	Type       int32
 	
 	// PairId uniquely identifies a connection pair for matching client/server sides
@@ -56,6 +89,16 @@ type Sender struct {
 	// Status is set by the daemon to indicate success (0) or failure (non-zero)
 	// Only valid in response messages from the daemon
 	Status     int32
+	
+	// legacy is set on requests decoded from gob, the daemon answers them
+	// in gob so older clients can read the response
+	legacy     bool
+	
+	// user is the local user who sent the request to a shared daemon, set
+	// by the daemon from the credentials of its socket. scoped is set if
+	// the user only reaches its own sessions.
+	user   string
+	scoped bool
 }
 
 // NewSender creates a new Sender request for the given application implementation and option code.
@@ -98,14 +141,68 @@ func NewSender(imp Impl, optCode int32) *Sender {
 	ret.Payload = buf.Bytes()
 	
 	// Set the daemon TCP address from configuration (default: 127.0.0.1:2224)
-	cm := conf.NewConfManager("")
-	ret.LocalEntry = fmt.Sprintf("127.0.0.1:%d", cm.Conf.LocalTCPPort)
+	ret.LocalEntry, err = daemonAddr()
+	if err != nil {
+		logrus.Error(err)
+		return nil
+	}
 	
 	// Copy the connection pair ID for tracking this specific connection
 	ret.PairId = []byte(imp.PairId())
 	return ret
 }
 
+// daemon is the address of the daemon set by processes embedding it
+var daemon struct {
+	lock sync.Mutex
+	addr string
+}
+
+// SetDaemonAddr makes the senders of this process reach the daemon at addr
+// instead of reading LocalTCPPort from the configure, for processes which
+// embed the daemon as mobile applications
+func SetDaemonAddr(addr string) {
+	daemon.lock.Lock()
+	daemon.addr = addr
+	daemon.lock.Unlock()
+}
+
+// daemonAddr returns the address of the daemon
+func daemonAddr() (string, error) {
+	daemon.lock.Lock()
+	addr := daemon.addr
+	daemon.lock.Unlock()
+	if addr != "" {
+		return addr, nil
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return "", err
+	}
+	if sc := cm.Conf.SharingConf; sc.Enabled {
+		return UnixEntryPrefix + sc.Socket, nil
+	}
+	return fmt.Sprintf("127.0.0.1:%d", cm.Conf.LocalTCPPort), nil
+}
+
+// SetUser attributes the request to the local user name, scoped users
+// only reach their own sessions
+func (sender *Sender) SetUser(name string, scoped bool) {
+	sender.user, sender.scoped = name, scoped
+}
+
+// User returns the local user who sent the request to a shared daemon,
+// empty for the requests of the local TCP port
+func (sender *Sender) User() string {
+	return sender.user
+}
+
+// Scoped reports whether the user of the request only reaches its own
+// sessions
+func (sender *Sender) Scoped() bool {
+	return sender.scoped
+}
+
 // GetAppCode extracts the application type code from the encoded Type field.
 // Used by the daemon to determine which application type is being requested.
 //
@@ -157,17 +254,105 @@ func (sender *Sender) GetImpl() Impl {
 	buf := bytes.NewBuffer(sender.Payload)
 	err := gob.NewDecoder(buf).Decode(impl)
 	if err != nil {
-		logrus.Error(err)
+		sender.Log().Error(err)
 	}
 	return impl
 }
 
+// Validate checks the lengths of the fields of a request and that its
+// payload decodes into the implementation of its application code.
+// The daemon refuses requests which don't validate before serving them.
+func (sender *Sender) Validate() error {
+	if len(sender.PairId) > MaxPairIdLength {
+		return fmt.Errorf("pair id too long: %d > %d", len(sender.PairId), MaxPairIdLength)
+	}
+	if len(sender.LocalEntry) > MaxEntryLength {
+		return fmt.Errorf("local entry too long: %d > %d", len(sender.LocalEntry), MaxEntryLength)
+	}
+	impl := GetImpl(sender.GetAppCode())
+	if impl == nil {
+		return fmt.Errorf("unknown application code %d", sender.GetAppCode())
+	}
+	if len(sender.Payload) == 0 {
+		return nil
+	}
+	err := types.DecodeLimited(bytes.NewReader(sender.Payload), int64(len(sender.Payload)), impl)
+	if err != nil {
+		return fmt.Errorf("invalid payload: %v", err)
+	}
+	if len(impl.HostId()) > types.MAX_ID_LENGTH {
+		return fmt.Errorf("host id too long: %d > %d", len(impl.HostId()), types.MAX_ID_LENGTH)
+	}
+	return nil
+}
+
+// MarshalWire appends the wire body of the request to buf, see
+// types.WriteWire. The payload stays gob-encoded.
+func (sender *Sender) MarshalWire(buf []byte) []byte {
+	ww := types.WireWriter{Buf: buf}
+	ww.Int(int64(sender.Type))
+	ww.Bytes(sender.PairId)
+	ww.Bool(sender.Detach)
+	ww.String(sender.LocalEntry)
+	ww.Bytes(sender.Payload)
+	ww.Int(int64(sender.Status))
+	return ww.Buf
+}
+
+// UnmarshalWire reads the request from a wire body
+func (sender *Sender) UnmarshalWire(body []byte) error {
+	wr := types.NewWireReader(body)
+	sender.Type = int32(wr.Int())
+	sender.PairId = wr.Bytes()
+	sender.Detach = wr.Bool()
+	sender.LocalEntry = wr.String()
+	sender.Payload = wr.Bytes()
+	sender.Status = int32(wr.Int())
+	return wr.Err()
+}
+
+// Encode writes the request to w, in gob if it was decoded from gob and in
+// the wire encoding otherwise
+func (sender *Sender) Encode(w io.Writer) error {
+	if sender.legacy {
+		return gob.NewEncoder(w).Encode(sender)
+	}
+	return types.WriteWire(w, sender.MarshalWire)
+}
+
+// decodeSender reads one request from r in the wire encoding or in gob
+func decodeSender(r io.Reader, sender *Sender) error {
+	wire, r, err := types.SniffWire(r)
+	if err != nil {
+		return err
+	}
+	if !wire {
+		sender.legacy = true
+		return types.DecodeLimited(r, MaxSenderSize, sender)
+	}
+	body, err := types.ReadWire(r, MaxSenderSize)
+	if err != nil {
+		return err
+	}
+	return sender.UnmarshalWire(body)
+}
+
+// DecodeSender reads one request from r and validates it
+func DecodeSender(r io.Reader) (Sender, error) {
+	var sender Sender
+	err := decodeSender(r, &sender)
+	if err != nil {
+		return sender, err
+	}
+	return sender, sender.Validate()
+}
+
 // Send establishes a TCP connection to the daemon and sends this Sender request.
 // This is the main communication method used by all applications to interact with the daemon.
 //
 // Communication Protocol:
 //   1. Connect to daemon via TCP on LocalEntry address (127.0.0.1:2224)
-//   2. Send gob-encoded Sender request to daemon
+//   2. Send the Sender request to daemon in the wire encoding
 //   3. Wait for daemon to process request and send response
 //   4. Receive updated Sender with Status field set
 //   5. Return the TCP connection if successful
@@ -186,30 +371,87 @@ func (sender *Sender) GetImpl() Impl {
 //   - net.Conn: Active TCP connection to daemon for data transfer
 //   - error: Connection or protocol error
 func (sender *Sender) Send() (net.Conn, error) {
-	// Connect to the local daemon via TCP
-	conn, err := net.Dial("tcp", sender.LocalEntry)
+	return sender.SendContext(context.Background())
+}
+
+// SendContext is Send canceled by ctx while it connects to the daemon and
+// waits for its response. The returned connection isn't bound to ctx.
+func (sender *Sender) SendContext(ctx context.Context) (net.Conn, error) {
+	// Connect to the local daemon via TCP, or the Unix socket of a shared
+	// daemon
+	var d net.Dialer
+	network, addr := "tcp", sender.LocalEntry
+	if strings.HasPrefix(addr, UnixEntryPrefix) {
+		network, addr = "unix", strings.TrimPrefix(addr, UnixEntryPrefix)
+	}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, contextError(ctx)
+		}
+		return nil, newError(ErrDaemonUnreachable, err)
+	}
+
+	// Unblock the exchange below once ctx is done
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	conn, err = sender.exchange(conn)
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		if err == nil {
+			conn.Close()
+		}
+		return nil, contextError(ctx)
+	}
 	if err != nil {
 		return nil, err
 	}
-	
-	// Send the gob-encoded request to daemon
-	err = gob.NewEncoder(conn).Encode(sender)
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// contextError returns the error of the done ctx, deadlines are in the
+// class ErrTimeout
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return newError(ErrTimeout, ctx.Err())
+	}
+	return ctx.Err()
+}
+
+// exchange sends the request over conn and reads the response of the
+// daemon, conn is closed if it fails
+func (sender *Sender) exchange(conn net.Conn) (net.Conn, error) {
+	// Send the request to daemon in the wire encoding
+	err := sender.Encode(conn)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
-	logrus.Debug("waiting TCP Responnse")
+	sender.Log().Debug("waiting TCP Responnse")
 
 	// Wait for daemon response - daemon will update Status field
-	err = gob.NewDecoder(conn).Decode(sender)
+	err = decodeSender(conn, sender)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	logrus.Debug("TCP Responnse OK ", string(sender.PairId))
+	sender.Log().Debug("TCP Responnse OK ", string(sender.PairId))
 	
 	// Check if daemon successfully processed the request
-	if sender.Status != 0 {
-		return nil, fmt.Errorf("response error")
+	if sender.Status != types.STATUS_OK {
+		conn.Close()
+		return nil, StatusError(sender.Status)
 	}
 	
 	// Return the active TCP connection for data transfer
@@ -0,0 +1,70 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/suutaku/sshx/pkg/types"
+)
+
+// stdioSuffix may end the host names of ssh_config, so a "Host *.sshx"
+// block routes every device through sshx
+const stdioSuffix = ".sshx"
+
+// StdioPeer returns the device of a host name given to ProxyCommand,
+// [username@]device[.sshx][:port]. ssh sends the user and port itself.
+func StdioPeer(host string) string {
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		host = host[i+1:]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(host, stdioSuffix)
+}
+
+// DialSSH asks the daemon for a tunnel to the ssh server of hostId, with
+// the one-time code otp if it isn't empty
+func DialSSH(hostId, otp string) (net.Conn, error) {
+	return DialSSHContext(context.Background(), hostId, otp)
+}
+
+// DialSSHContext is DialSSH canceled by ctx until the tunnel is set up
+func DialSSHContext(ctx context.Context, hostId, otp string) (net.Conn, error) {
+	imp := &SSH{
+		BaseImpl: BaseImpl{
+			HId:        hostId,
+			ConnectNow: true,
+		},
+	}
+	imp.SetOneTimeCode(otp)
+	sender := NewSender(imp, types.OPTION_TYPE_UP)
+	if sender == nil {
+		return nil, errors.New("cannot encode the ssh request")
+	}
+	return sender.SendContext(ctx)
+}
+
+// StdioBridge copies the tunnel to w and r to the tunnel, as is, until the
+// remote end closes the tunnel. The end of r isn't passed on since the
+// tunnel has no half close: ssh, git and rsync close their end by exiting,
+// and the remote sshd closes the tunnel once the session ends, after the
+// exit status of the command.
+func StdioBridge(conn net.Conn, r io.Reader, w io.Writer) error {
+	go func() {
+		_, err := io.Copy(conn, r)
+		if err != nil {
+			// the tunnel is gone, or r can't be read
+			conn.Close()
+		}
+	}()
+	_, err := io.Copy(w, conn)
+	conn.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,432 @@
+package impl
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// TOTP codes of RFC 6238 as authenticator apps make them
+	totpStep   = 30
+	totpDigits = 6
+	// size of the secrets created
+	totpSecretSize = 20
+	// a peer or a source sending this many wrong codes in a row waits
+	// totpLockout, twice as long after each further wrong code up to
+	// totpMaxLockout
+	totpMaxFailures = 5
+	totpLockout     = 30 * time.Second
+	totpMaxLockout  = time.Hour
+	// sources tracked at most, the ones not waiting are dropped first
+	totpMaxSources = 4096
+)
+
+// the key store and the steps used are read and written by the daemon and
+// the commands
+var totpLock sync.Mutex
+
+// last step used by each peer, a code is accepted once
+var totpUsed = make(map[string]int64)
+
+// totpThrottle counts the wrong codes of a peer or a source
+type totpThrottle struct {
+	failures int
+	until    time.Time
+}
+
+// wrong codes by "peer <ID>" and "source <address>"
+var totpFailures = make(map[string]*totpThrottle)
+
+func keyStoreFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), "totp_secrets.json")
+}
+
+// keyStoreKey returns the key the key store is encrypted with, derived from
+// the identity key so the file alone discloses no secret
+func keyStoreKey() (cipher.AEAD, error) {
+	priv, _, err := loadMessageKey()
+	if err != nil {
+		return nil, err
+	}
+	return keyStoreAEAD(priv)
+}
+
+func keyStoreAEAD(priv []byte) (cipher.AEAD, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, priv, nil, []byte("sshx key store")), key)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// rekeyKeyStore encrypts the key store with the key derived from the
+// identity key newPriv
+func rekeyKeyStore(newPriv []byte) error {
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	store, err := loadKeyStore()
+	if err != nil || len(store) == 0 {
+		return err
+	}
+	old, err := keyStoreKey()
+	if err != nil {
+		return err
+	}
+	aead, err := keyStoreAEAD(newPriv)
+	if err != nil {
+		return err
+	}
+	for peerId, sealed := range store {
+		secret, err := openSecret(old, peerId, sealed)
+		if err != nil {
+			return err
+		}
+		store[peerId], err = sealSecret(aead, peerId, secret)
+		if err != nil {
+			return err
+		}
+	}
+	return saveKeyStore(store)
+}
+
+func loadKeyStore() (map[string]string, error) {
+	ret := make(map[string]string)
+	bs, err := ioutil.ReadFile(keyStoreFile())
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, json.Unmarshal(bs, &ret)
+}
+
+func saveKeyStore(store map[string]string) error {
+	bs, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(utils.GetSSHXStateHome(), 0700)
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d", keyStoreFile(), os.Getpid())
+	err = ioutil.WriteFile(tmp, bs, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, keyStoreFile())
+}
+
+// sealSecret encrypts a secret of peerId, the peer ID is authenticated so
+// secrets can't be swapped between peers
+func sealSecret(aead cipher.AEAD, peerId string, secret []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(secret)+aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, secret, []byte(peerId))), nil
+}
+
+func openSecret(aead cipher.AEAD, peerId, sealed string) ([]byte, error) {
+	bs, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(bs) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid TOTP secret of %s", peerId)
+	}
+	ret, err := aead.Open(nil, bs[:aead.NonceSize()], bs[aead.NonceSize():], []byte(peerId))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt TOTP secret of %s", peerId)
+	}
+	return ret, nil
+}
+
+func loadTOTPSecret(peerId string) ([]byte, error) {
+	store, err := loadKeyStore()
+	if err != nil {
+		return nil, err
+	}
+	sealed, ok := store[peerId]
+	if !ok {
+		return nil, fmt.Errorf("no TOTP secret enrolled for %s", peerId)
+	}
+	aead, err := keyStoreKey()
+	if err != nil {
+		return nil, err
+	}
+	return openSecret(aead, peerId, sealed)
+}
+
+// EnrollTOTP creates the TOTP secret of peerId and requires its codes for
+// the applications of TOTPConf.Apps. An enrolled secret is replaced.
+func EnrollTOTP(peerId string) ([]byte, error) {
+	secret := make([]byte, totpSecretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := keyStoreKey()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealSecret(aead, peerId, secret)
+	if err != nil {
+		return nil, err
+	}
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	store, err := loadKeyStore()
+	if err != nil {
+		return nil, err
+	}
+	store[peerId] = sealed
+	err = saveKeyStore(store)
+	if err != nil {
+		return nil, err
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range cm.Conf.TOTPConf.Peers {
+		if v == peerId {
+			return secret, nil
+		}
+	}
+	return secret, cm.SetValue("totpconf.peers", append(cm.Conf.TOTPConf.Peers, peerId))
+}
+
+// RemoveTOTP removes the TOTP secret of peerId, its sessions need no code
+// anymore
+func RemoveTOTP(peerId string) error {
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	store, err := loadKeyStore()
+	if err != nil {
+		return err
+	}
+	delete(store, peerId)
+	err = saveKeyStore(store)
+	if err != nil {
+		return err
+	}
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	peers := make([]string, 0, len(cm.Conf.TOTPConf.Peers))
+	for _, v := range cm.Conf.TOTPConf.Peers {
+		if v != peerId {
+			peers = append(peers, v)
+		}
+	}
+	return cm.SetValue("totpconf.peers", peers)
+}
+
+// TOTPURI returns the URI authenticator apps enroll a secret with
+func TOTPURI(secret []byte, account string) string {
+	v := url.Values{}
+	v.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret))
+	v.Set("issuer", "sshx")
+	return "otpauth://totp/" + url.PathEscape("sshx:"+account) + "?" + v.Encode()
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// totpThrottled fails while one of keys waits for sending wrong codes
+func totpThrottled(keys []string, now time.Time) error {
+	for _, k := range keys {
+		t, ok := totpFailures[k]
+		if ok && now.Before(t.until) {
+			return Denied(fmt.Errorf("too many wrong one-time codes of %s, retry in %s", k, t.until.Sub(now).Round(time.Second)))
+		}
+	}
+	return nil
+}
+
+// totpFailed counts a wrong code of keys
+func totpFailed(keys []string, now time.Time) {
+	for _, k := range keys {
+		t, ok := totpFailures[k]
+		if !ok {
+			if len(totpFailures) >= totpMaxSources {
+				for k, t := range totpFailures {
+					if !now.Before(t.until) {
+						delete(totpFailures, k)
+					}
+				}
+			}
+			t = &totpThrottle{}
+			totpFailures[k] = t
+		}
+		t.failures++
+		if t.failures < totpMaxFailures {
+			continue
+		}
+		wait := totpMaxLockout
+		if shift := t.failures - totpMaxFailures; shift < 8 {
+			wait = totpLockout << uint(shift)
+		}
+		if wait > totpMaxLockout {
+			wait = totpMaxLockout
+		}
+		t.until = now.Add(wait)
+	}
+}
+
+// verifyTOTP accepts the code of the current step, or of the steps next to
+// it for clocks apart, and only once. Wrong codes slow down the peer and
+// the source address they come from, empty if unknown.
+func verifyTOTP(peerId, source string, secret []byte, code string) error {
+	keys := []string{"peer " + peerId}
+	if source != "" {
+		keys = append(keys, "source "+source)
+	}
+	now := time.Now()
+	err := totpThrottled(keys, now)
+	if err != nil {
+		return err
+	}
+	err = checkTOTP(peerId, secret, code, now.Unix()/totpStep)
+	if err != nil {
+		totpFailed(keys, now)
+		return err
+	}
+	for _, k := range keys {
+		delete(totpFailures, k)
+	}
+	return nil
+}
+
+func checkTOTP(peerId string, secret []byte, code string, now int64) error {
+	for _, step := range []int64{now, now - 1, now + 1} {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) != 1 {
+			continue
+		}
+		if step <= totpUsed[peerId] {
+			return fmt.Errorf("one-time code of %s already used", peerId)
+		}
+		totpUsed[peerId] = step
+		return nil
+	}
+	return fmt.Errorf("invalid one-time code of %s", peerId)
+}
+
+// CheckOneTimeCode checks the TOTP code of an inbound session when the
+// peer and the application need one, source is the address the session
+// comes from
+func CheckOneTimeCode(peerId, source string, appCode int32, code string) error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	tc := cm.Conf.TOTPConf
+	required := false
+	for _, v := range tc.Peers {
+		if v == peerId {
+			required = true
+		}
+	}
+	if !required {
+		return nil
+	}
+	required = false
+	for _, v := range tc.Apps {
+		if v == AppName(appCode) {
+			required = true
+		}
+	}
+	if !required {
+		return nil
+	}
+	if code == "" {
+		return fmt.Errorf("%s session of %s needs a one-time code", AppName(appCode), peerId)
+	}
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	secret, err := loadTOTPSecret(peerId)
+	if err != nil {
+		return err
+	}
+	err = verifyTOTP(peerId, source, secret, code)
+	if err != nil {
+		return err
+	}
+	logrus.Debug("one-time code of ", peerId, " accepted")
+	return nil
+}
+
+// pairingKey returns the key a secret sent to peerPub during pairing is
+// encrypted with, both devices make it from their identity keys and code
+func pairingKey(peerPub []byte, code string) (cipher.AEAD, error) {
+	priv, _, err := loadMessageKey()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(priv, peerPub)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err = io.ReadFull(hkdf.New(sha256.New, shared, []byte(code), []byte("sshx pairing secret")), key)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// SealPairingSecret encrypts a secret for the peer being paired
+func SealPairingSecret(peerId string, peerPub []byte, code string, secret []byte) ([]byte, error) {
+	aead, err := pairingKey(peerPub, code)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealSecret(aead, peerId, secret)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(sealed), nil
+}
+
+// OpenPairingSecret decrypts a secret sent by the peer this device paired
+// with, selfId is the ID of this device
+func OpenPairingSecret(selfId string, peerPub []byte, code string, sealed []byte) ([]byte, error) {
+	aead, err := pairingKey(peerPub, code)
+	if err != nil {
+		return nil, err
+	}
+	return openSecret(aead, selfId, string(sealed))
+}
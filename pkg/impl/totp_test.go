@@ -0,0 +1,84 @@
+package impl
+
+import (
+	"testing"
+	"time"
+)
+
+// the SHA-1 test vectors of RFC 6238, truncated to the 6 digits of
+// totpDigits
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, tt.time/totpStep); got != tt.code {
+			t.Errorf("code at %d = %s, want %s", tt.time, got, tt.code)
+		}
+	}
+}
+
+// resetTOTP forgets the steps used and the wrong codes of the tests
+func resetTOTP(t *testing.T) {
+	t.Cleanup(func() {
+		totpUsed = make(map[string]int64)
+		totpFailures = make(map[string]*totpThrottle)
+	})
+}
+
+func TestVerifyTOTPReplay(t *testing.T) {
+	resetTOTP(t)
+	secret := []byte("12345678901234567890")
+	code := totpCode(secret, time.Now().Unix()/totpStep)
+	if err := verifyTOTP("alice", "", secret, code); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyTOTP("alice", "", secret, code); err == nil {
+		t.Fatal("a code is accepted twice")
+	}
+	if totpUsed["alice"] == 0 {
+		t.Fatal("the step of the code is not recorded")
+	}
+	// a code of an older step is refused once a later one is used
+	old := totpCode(secret, totpUsed["alice"]-1)
+	if err := verifyTOTP("alice", "", secret, old); err == nil {
+		t.Fatal("a code older than the last one used is accepted")
+	}
+}
+
+func TestVerifyTOTPThrottle(t *testing.T) {
+	resetTOTP(t)
+	secret := []byte("12345678901234567890")
+	code := totpCode(secret, time.Now().Unix()/totpStep)
+	wrong := "000000"
+	if wrong == code {
+		wrong = "111111"
+	}
+	for i := 0; i < totpMaxFailures; i++ {
+		if err := verifyTOTP("alice", "192.0.2.1", secret, wrong); err == nil {
+			t.Fatal("a wrong code is accepted")
+		}
+	}
+	// the peer waits, from any source, and so does the source for any peer
+	if err := verifyTOTP("alice", "192.0.2.2", secret, code); err == nil {
+		t.Fatal("the right code of a throttled peer is accepted")
+	}
+	if err := verifyTOTP("bob", "192.0.2.1", secret, code); err == nil {
+		t.Fatal("a code from a throttled source is accepted")
+	}
+	if err := verifyTOTP("bob", "192.0.2.3", secret, code); err != nil {
+		t.Fatal(err)
+	}
+	if until := totpFailures["peer alice"].until; until.Sub(time.Now()) > totpLockout {
+		t.Fatalf("first wait of %s, want %s", until.Sub(time.Now()), totpLockout)
+	}
+}
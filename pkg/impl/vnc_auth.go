@@ -0,0 +1,136 @@
+package impl
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+// VNCAuthRequest is sent by the viewer side before the VNC stream
+type VNCAuthRequest struct {
+	Token string
+	// ViewOnly asks for a session without keyboard and pointer input
+	ViewOnly bool
+}
+
+type VNCAuthReply struct {
+	Error string
+}
+
+// vncToken is a stored session token, only the hash of the token is kept
+type vncToken struct {
+	Hash    string
+	Expires time.Time
+	// Uses is the number of sessions left, 0 means unlimited until expired
+	Uses int32
+	// ViewOnly tokens only allow watching the desktop
+	ViewOnly bool
+}
+
+var vncTokenLock sync.Mutex
+
+func vncTokenFile() string {
+	return filepath.Join(utils.GetSSHXStateHome(), ".sshx_vnc_tokens.json")
+}
+
+func loadVNCTokens() []vncToken {
+	var ret []vncToken
+	bs, err := ioutil.ReadFile(vncTokenFile())
+	if err != nil {
+		return ret
+	}
+	err = json.Unmarshal(bs, &ret)
+	if err != nil {
+		logrus.Error("vnc tokens ", err)
+	}
+	return ret
+}
+
+func saveVNCTokens(tokens []vncToken) error {
+	bs, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := vncTokenFile() + ".tmp"
+	err = ioutil.WriteFile(tmp, bs, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, vncTokenFile())
+}
+
+// NewVNCToken creates a token accepted by the local VNC service for uses
+// sessions (0 for unlimited) during ttl
+func NewVNCToken(uses int32, ttl time.Duration, viewOnly bool) (string, error) {
+	token, err := utils.MakeRandomStr(20)
+	if err != nil {
+		return "", err
+	}
+	vncTokenLock.Lock()
+	defer vncTokenLock.Unlock()
+	tokens := make([]vncToken, 0)
+	now := time.Now()
+	for _, v := range loadVNCTokens() {
+		if v.Expires.After(now) {
+			tokens = append(tokens, v)
+		}
+	}
+	tokens = append(tokens, vncToken{
+		Hash:     utils.HashString(token),
+		Expires:  now.Add(ttl),
+		Uses:     uses,
+		ViewOnly: viewOnly,
+	})
+	return token, saveVNCTokens(tokens)
+}
+
+// checkVNCCredential validates the credential given by a viewer against the
+// configured password and the stored tokens, a matching token is consumed.
+// viewOnly is set if the credential doesn't allow input.
+func checkVNCCredential(credential string) (viewOnly bool, err error) {
+	cm, err := conf.Shared()
+	if err != nil {
+		return false, err
+	}
+	ac := cm.Conf.VNCAuthConf
+	if ac.Password == "" && !ac.RequireAuth {
+		return false, nil
+	}
+	if credential == "" {
+		return false, fmt.Errorf("vnc credential required")
+	}
+	if ac.Password != "" && subtle.ConstantTimeCompare([]byte(ac.Password), []byte(credential)) == 1 {
+		return false, nil
+	}
+	vncTokenLock.Lock()
+	defer vncTokenLock.Unlock()
+	hash := utils.HashString(credential)
+	now := time.Now()
+	tokens := loadVNCTokens()
+	for i, v := range tokens {
+		if v.Hash != hash || !v.Expires.After(now) {
+			continue
+		}
+		if v.Uses > 0 {
+			tokens[i].Uses--
+			if tokens[i].Uses == 0 {
+				tokens = append(tokens[:i], tokens[i+1:]...)
+			}
+			err := saveVNCTokens(tokens)
+			if err != nil {
+				return false, err
+			}
+		}
+		return v.ViewOnly, nil
+	}
+	return false, fmt.Errorf("invalid vnc credential")
+}
@@ -0,0 +1,218 @@
+package impl
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+// desktops the VNC service can serve
+const (
+	VNC_BACKEND_X11      = "x11"
+	VNC_BACKEND_WAYLAND  = "wayland"
+	VNC_BACKEND_HEADLESS = "headless"
+	VNC_BACKEND_EXTERNAL = "external"
+)
+
+// sessions tried by the headless backend if none is configured
+var headlessSessions = []string{"startxfce4", "startlxqt", "openbox-session", "xterm"}
+
+// vncBackend returns the configured backend, or the one of the running
+// session. Headless displays are never chosen automatically, a daemon
+// started without DISPLAY may still run on a desktop.
+func vncBackend(dc conf.VNCDisplayConf) string {
+	if dc.Backend != "" {
+		return strings.ToLower(dc.Backend)
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		return VNC_BACKEND_WAYLAND
+	}
+	return VNC_BACKEND_X11
+}
+
+// builtinVNCServer reports whether the backend is captured by the built-in
+// server, other backends are served by an RFB server at dc.Address
+func builtinVNCServer(dc conf.VNCDisplayConf) bool {
+	backend := vncBackend(dc)
+	return backend == VNC_BACKEND_X11 || backend == VNC_BACKEND_HEADLESS
+}
+
+// CheckVNCDisplay returns the backend of the VNC service and whether what
+// it needs is there
+func CheckVNCDisplay(dc conf.VNCDisplayConf) (string, error) {
+	backend := vncBackend(dc)
+	switch backend {
+	case VNC_BACKEND_X11:
+		// other systems capture their desktop without X
+		if runtime.GOOS == "linux" && os.Getenv("DISPLAY") == "" {
+			return backend, fmt.Errorf("DISPLAY is not set, start the daemon in the desktop session or use the %s backend", VNC_BACKEND_HEADLESS)
+		}
+	case VNC_BACKEND_WAYLAND:
+		if _, err := exec.LookPath("wayvnc"); err != nil {
+			return backend, fmt.Errorf("wayvnc not found, install it on wlroots desktops or use the %s backend", VNC_BACKEND_EXTERNAL)
+		}
+	case VNC_BACKEND_HEADLESS:
+		if _, err := exec.LookPath("Xvfb"); err != nil {
+			return backend, fmt.Errorf("Xvfb not found, it is needed by the %s backend", VNC_BACKEND_HEADLESS)
+		}
+	case VNC_BACKEND_EXTERNAL:
+		conn, err := net.DialTimeout("tcp", vncServerAddress(dc), 3*time.Second)
+		if err != nil {
+			return backend, fmt.Errorf("no RFB server at %s: %v", vncServerAddress(dc), err)
+		}
+		conn.Close()
+	default:
+		return backend, fmt.Errorf("unknown backend %s", backend)
+	}
+	return backend, nil
+}
+
+func vncServerAddress(dc conf.VNCDisplayConf) string {
+	if dc.Address == "" {
+		return "127.0.0.1:5900"
+	}
+	return dc.Address
+}
+
+// dialVNCServer opens an RFB stream to the server of the desktop
+func dialVNCServer(cm *conf.ConfManager) (io.ReadWriteCloser, error) {
+	dc := cm.Conf.VNCDisplayConf
+	if !builtinVNCServer(dc) {
+		logrus.Debug("dial vnc server ", vncServerAddress(dc))
+		return net.Dial("tcp", vncServerAddress(dc))
+	}
+	addr := fmt.Sprintf("ws://%s:%d", cm.Conf.VNCConf.Websockify.Host, cm.Conf.VNCConf.Websockify.Port)
+	logrus.Debug("dial vnc server ", addr)
+	ws, _, err := websocket.DefaultDialer.Dial(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &wsStream{ws: ws}, nil
+}
+
+// vncDisplay holds the processes started for the desktop of the VNC service
+type vncDisplay struct {
+	cmds []*exec.Cmd
+}
+
+// startVNCDisplay prepares the desktop of the backend: a wlroots session is
+// served by wayvnc, a headless one gets a virtual framebuffer and a desktop
+// session the built-in server captures
+func startVNCDisplay(dc conf.VNCDisplayConf) (*vncDisplay, error) {
+	ret := &vncDisplay{}
+	switch vncBackend(dc) {
+	case VNC_BACKEND_X11, VNC_BACKEND_EXTERNAL:
+	case VNC_BACKEND_WAYLAND:
+		err := ret.startWayland(dc)
+		if err != nil {
+			return nil, err
+		}
+	case VNC_BACKEND_HEADLESS:
+		err := ret.startHeadless(dc)
+		if err != nil {
+			ret.Close()
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown vnc backend %s", dc.Backend)
+	}
+	return ret, nil
+}
+
+func (vd *vncDisplay) start(cmd *exec.Cmd) error {
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	vd.cmds = append(vd.cmds, cmd)
+	return nil
+}
+
+func (vd *vncDisplay) startWayland(dc conf.VNCDisplayConf) error {
+	path, err := exec.LookPath("wayvnc")
+	if err != nil {
+		// GNOME and KDE capture through the desktop portal with their own
+		// servers, which are reached with the external backend
+		return fmt.Errorf("wayvnc not found, install it on wlroots desktops or run the RFB server of the desktop and use the %s backend", VNC_BACKEND_EXTERNAL)
+	}
+	host, port, err := net.SplitHostPort(vncServerAddress(dc))
+	if err != nil {
+		return err
+	}
+	logrus.Info("serve wayland session with wayvnc at ", vncServerAddress(dc))
+	return vd.start(exec.Command(path, host, port))
+}
+
+func (vd *vncDisplay) startHeadless(dc conf.VNCDisplayConf) error {
+	display := dc.Display
+	if display == "" {
+		display = ":99"
+	}
+	width, height := dc.Width, dc.Height
+	if width <= 0 || height <= 0 {
+		width, height = 1280, 800
+	}
+	path, err := exec.LookPath("Xvfb")
+	if err != nil {
+		return fmt.Errorf("Xvfb not found, it is needed by the %s backend", VNC_BACKEND_HEADLESS)
+	}
+	err = vd.start(exec.Command(path, display, "-screen", "0", fmt.Sprintf("%dx%dx24", width, height), "-nolisten", "tcp"))
+	if err != nil {
+		return err
+	}
+	socket := "/tmp/.X11-unix/X" + strings.TrimPrefix(display, ":")
+	for i := 0; ; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		if i == 50 {
+			return fmt.Errorf("virtual display %s did not start", display)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// the built-in server captures the display of the daemon
+	os.Setenv("DISPLAY", display)
+	logrus.Infof("virtual display %s started (%dx%d)", display, width, height)
+
+	session := dc.Session
+	if session == "" {
+		for _, v := range headlessSessions {
+			if _, err := exec.LookPath(v); err == nil {
+				session = v
+				break
+			}
+		}
+	}
+	if session == "" {
+		logrus.Warn("no desktop session found for the virtual display")
+		return nil
+	}
+	cmd := exec.Command("sh", "-c", session)
+	cmd.Env = append(os.Environ(), "DISPLAY="+display)
+	logrus.Info("start desktop session ", session)
+	return vd.start(cmd)
+}
+
+// Close stops the processes in the reverse order of their start
+func (vd *vncDisplay) Close() {
+	if vd == nil {
+		return
+	}
+	for i := len(vd.cmds) - 1; i >= 0; i-- {
+		cmd := vd.cmds[i]
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	vd.cmds = nil
+}
@@ -0,0 +1,318 @@
+package impl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RFB encodings the viewer preferences can refer to by name
+var rfbEncodings = map[string]int32{
+	"raw":      0,
+	"copyrect": 1,
+	"rre":      2,
+	"hextile":  5,
+	"zlib":     6,
+	"tight":    7,
+	"zrle":     16,
+	"tightpng": -260,
+}
+
+const (
+	rfbQualityLevel0     = -32
+	rfbCompressionLevel0 = -256
+)
+
+// states of the viewer side of the stream
+const (
+	rfbStateVersion = iota
+	rfbStateSecurity
+	rfbStateSkip
+	rfbStateMessages
+)
+
+// rfbFilter rewrites the SetEncodings messages of a viewer, so the encoding
+// order and the JPEG quality and compression levels asked by the server
+// follow the sshx settings instead of the viewer defaults. Input of view-only
+// viewers is dropped.
+type rfbFilter struct {
+	encodings   []int32
+	quality     int32
+	compression int32
+	viewOnly    bool
+
+	buf   []byte
+	out   []byte
+	state int
+	// skip is the number of handshake bytes forwarded without parsing
+	skip int
+	// passthrough disables rewriting once the stream can't be followed
+	passthrough bool
+}
+
+// newRFBFilter returns nil if there is nothing to rewrite. Quality and
+// compression go from 1 to 9, 0 keeps the level asked by the viewer.
+func newRFBFilter(encodings []string, quality, compression int32) *rfbFilter {
+	ret := &rfbFilter{}
+	for _, v := range encodings {
+		code, ok := rfbEncodings[strings.ToLower(strings.TrimSpace(v))]
+		if !ok {
+			logrus.Warn("unknown vnc encoding ", v)
+			continue
+		}
+		ret.encodings = append(ret.encodings, code)
+	}
+	if quality > 0 {
+		ret.quality = rfbQualityLevel0 + clampLevel(quality)
+	}
+	if compression > 0 {
+		ret.compression = rfbCompressionLevel0 + clampLevel(compression)
+	}
+	if len(ret.encodings) == 0 && ret.quality == 0 && ret.compression == 0 {
+		return nil
+	}
+	return ret
+}
+
+// newViewOnlyFilter returns a filter which only drops input of the viewer
+func newViewOnlyFilter() *rfbFilter {
+	return &rfbFilter{viewOnly: true}
+}
+
+func clampLevel(level int32) int32 {
+	if level > 9 {
+		return 9
+	}
+	return level
+}
+
+func isQualityLevel(code int32) bool {
+	return code >= rfbQualityLevel0 && code < rfbQualityLevel0+10
+}
+
+func isCompressionLevel(code int32) bool {
+	return code >= rfbCompressionLevel0 && code < rfbCompressionLevel0+10
+}
+
+// rewriteEncodings orders the encodings of the viewer and replaces its
+// quality and compression levels
+func (rf *rfbFilter) rewriteEncodings(encs []int32) []int32 {
+	var real, pseudo []int32
+	for _, v := range encs {
+		switch {
+		case rf.quality != 0 && isQualityLevel(v):
+		case rf.compression != 0 && isCompressionLevel(v):
+		case v < 0 && v != rfbEncodings["tightpng"]:
+			pseudo = append(pseudo, v)
+		default:
+			real = append(real, v)
+		}
+	}
+	ret := make([]int32, 0, len(encs)+2)
+	used := make(map[int32]bool)
+	// only encodings the viewer is able to decode are kept
+	for _, pref := range rf.encodings {
+		if pref == 0 {
+			continue
+		}
+		for _, v := range real {
+			if v == pref && !used[v] {
+				ret = append(ret, v)
+				used[v] = true
+			}
+		}
+	}
+	for _, v := range real {
+		if !used[v] && v != 0 {
+			ret = append(ret, v)
+			used[v] = true
+		}
+	}
+	// servers treat everything after raw as pseudo encodings, so raw is
+	// always kept last
+	ret = append(ret, 0)
+	ret = append(ret, pseudo...)
+	if rf.quality != 0 {
+		ret = append(ret, rf.quality)
+	}
+	if rf.compression != 0 {
+		ret = append(ret, rf.compression)
+	}
+	return ret
+}
+
+// rfbMessageLen returns the length of the viewer message at the start of bs, 0
+// if more data is needed and -1 if the message type is unknown
+func rfbMessageLen(bs []byte) int {
+	need := func(n int) int {
+		if len(bs) < n {
+			return 0
+		}
+		return n
+	}
+	switch bs[0] {
+	case 0: // SetPixelFormat
+		return need(20)
+	case 2: // SetEncodings
+		if len(bs) < 4 {
+			return 0
+		}
+		return need(4 + 4*int(binary.BigEndian.Uint16(bs[2:4])))
+	case 3: // FramebufferUpdateRequest
+		return need(10)
+	case 4: // KeyEvent
+		return need(8)
+	case 5: // PointerEvent
+		return need(6)
+	case 6: // ClientCutText, a negative length is used by extended clipboard
+		if len(bs) < 8 {
+			return 0
+		}
+		n := int32(binary.BigEndian.Uint32(bs[4:8]))
+		if n < 0 {
+			n = -n
+		}
+		return need(8 + int(n))
+	case 150: // EnableContinuousUpdates
+		return need(10)
+	case 248: // ClientFence
+		if len(bs) < 9 {
+			return 0
+		}
+		return need(9 + int(bs[8]))
+	case 250: // xvp
+		return need(4)
+	case 251: // SetDesktopSize
+		if len(bs) < 8 {
+			return 0
+		}
+		return need(8 + 16*int(bs[6]))
+	}
+	return -1
+}
+
+// isRFBInput reports whether the viewer message controls the remote desktop
+func isRFBInput(msgType byte) bool {
+	switch msgType {
+	case 4, 5, 6, 251: // KeyEvent, PointerEvent, ClientCutText, SetDesktopSize
+		return true
+	}
+	return false
+}
+
+// Filter takes the next data sent by the viewer and returns what has to be
+// forwarded to the server. An error is returned if the stream of a view-only
+// viewer can't be followed.
+func (rf *rfbFilter) Filter(data []byte) ([]byte, error) {
+	if rf.passthrough {
+		return data, nil
+	}
+	rf.buf = append(rf.buf, data...)
+	for len(rf.buf) > 0 && !rf.passthrough {
+		if rf.state != rfbStateMessages {
+			if !rf.followHandshake() {
+				break
+			}
+			continue
+		}
+		n := rfbMessageLen(rf.buf)
+		if n < 0 {
+			rf.giveUp(fmt.Sprintf("message type %d", rf.buf[0]))
+			break
+		}
+		if n == 0 {
+			break
+		}
+		switch {
+		case rf.viewOnly && isRFBInput(rf.buf[0]):
+			rf.buf = rf.buf[n:]
+		case rf.buf[0] == 2 && !rf.viewOnly:
+			rf.out = append(rf.out, rf.encodeEncodings(rf.buf[:n])...)
+			rf.buf = rf.buf[n:]
+		default:
+			rf.pending(n)
+		}
+	}
+	if rf.passthrough {
+		if rf.viewOnly {
+			return nil, fmt.Errorf("cannot enforce view-only session")
+		}
+		rf.pending(len(rf.buf))
+	}
+	out := rf.out
+	rf.out = nil
+	return out, nil
+}
+
+func (rf *rfbFilter) encodeEncodings(msg []byte) []byte {
+	count := int(binary.BigEndian.Uint16(msg[2:4]))
+	encs := make([]int32, count)
+	for i := range encs {
+		encs[i] = int32(binary.BigEndian.Uint32(msg[4+4*i:]))
+	}
+	encs = rf.rewriteEncodings(encs)
+	logrus.Debug("vnc encodings ", encs)
+	ret := make([]byte, 4+4*len(encs))
+	ret[0] = 2
+	binary.BigEndian.PutUint16(ret[2:4], uint16(len(encs)))
+	for i, v := range encs {
+		binary.BigEndian.PutUint32(ret[4+4*i:], uint32(v))
+	}
+	return ret
+}
+
+// followHandshake forwards the handshake of the viewer, which is the
+// protocol version, the security type, its response and ClientInit. Bytes
+// are never held back longer than needed, the server answers each step. It
+// returns false if more data is needed.
+func (rf *rfbFilter) followHandshake() bool {
+	switch rf.state {
+	case rfbStateVersion:
+		if len(rf.buf) < 12 {
+			return false
+		}
+		version := string(rf.buf[:12])
+		if version != "RFB 003.007\n" && version != "RFB 003.008\n" {
+			rf.giveUp("protocol version " + strings.TrimSpace(version))
+			return true
+		}
+		rf.pending(12)
+		rf.state = rfbStateSecurity
+	case rfbStateSecurity:
+		switch rf.buf[0] {
+		case 1: // None, followed by ClientInit
+			rf.skip = 1
+		case 2: // VNC authentication response and ClientInit
+			rf.skip = 16 + 1
+		default:
+			rf.giveUp(fmt.Sprintf("security type %d", rf.buf[0]))
+			return true
+		}
+		rf.pending(1)
+		rf.state = rfbStateSkip
+	case rfbStateSkip:
+		n := rf.skip
+		if len(rf.buf) < n {
+			n = len(rf.buf)
+		}
+		rf.pending(n)
+		rf.skip -= n
+		if rf.skip == 0 {
+			rf.state = rfbStateMessages
+		}
+	}
+	return true
+}
+
+func (rf *rfbFilter) giveUp(reason string) {
+	logrus.Debug("unsupported vnc ", reason, ", stop applying viewer settings")
+	rf.passthrough = true
+}
+
+// pending moves the first n buffered bytes to the output unchanged
+func (rf *rfbFilter) pending(n int) {
+	rf.out = append(rf.out, rf.buf[:n]...)
+	rf.buf = rf.buf[n:]
+}
@@ -0,0 +1,636 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/des"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+// pixel format asked from the server and announced to viewers, 32 bits true
+// colour as used by noVNC
+var hubPixelFormat = []byte{32, 24, 0, 1, 0, 255, 0, 255, 0, 255, 0, 8, 16, 0, 0, 0}
+
+// encodings the hub is able to split into messages, the built-in server only
+// sends JPEG and PNG rectangles for tight
+var hubEncodings = []int32{7, -260, 0, -223}
+
+// wsStream reads and writes the binary messages of a websocket as a stream
+type wsStream struct {
+	ws    *websocket.Conn
+	r     io.Reader
+	wlock sync.Mutex
+}
+
+func (s *wsStream) Read(p []byte) (int, error) {
+	for {
+		if s.r == nil {
+			_, r, err := s.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			s.r = r
+		}
+		n, err := s.r.Read(p)
+		if err == io.EOF {
+			s.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (s *wsStream) Close() error {
+	return s.ws.Close()
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	err := s.ws.WriteMessage(websocket.BinaryMessage, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// vncViewer is a viewer attached to the hub
+type vncViewer struct {
+	conn     net.Conn
+	viewOnly bool
+	out      chan []byte
+	once     sync.Once
+	rec      *fbsRecorder
+	// extDesktop and desktopSize are set if the viewer understands the
+	// ExtendedDesktopSize and DesktopSize pseudo encodings
+	extDesktop  bool
+	desktopSize bool
+}
+
+// Write sends data to the viewer and records it
+func (v *vncViewer) Write(p []byte) (int, error) {
+	n, err := v.conn.Write(p)
+	if n > 0 {
+		v.rec.Write(p[:n])
+	}
+	return n, err
+}
+
+func (v *vncViewer) close() {
+	v.once.Do(func() {
+		close(v.out)
+		v.conn.Close()
+	})
+}
+
+// vncHub shares one session of the local VNC server between all viewers, so
+// the desktop is captured once and every framebuffer update is sent to each
+// of them
+type vncHub struct {
+	lock     sync.Mutex
+	upstream io.ReadWriteCloser
+	viewers  map[*vncViewer]bool
+	joining  int
+	width    uint16
+	height   uint16
+	name     []byte
+	// nativeWidth and nativeHeight are the size of the captured screen,
+	// pointer events are scaled from the framebuffer to it
+	nativeWidth  uint16
+	nativeHeight uint16
+	// pending is the time of the outstanding incremental update request
+	pending time.Time
+}
+
+var sharedVNC = &vncHub{}
+
+// vncAuthResponse encrypts the VNC authentication challenge with password
+func vncAuthResponse(password string, challenge []byte) ([]byte, error) {
+	key := make([]byte, 8)
+	for i := 0; i < len(password) && i < 8; i++ {
+		// the key bits are mirrored, a quirk of the original implementation
+		b := password[i]
+		var r byte
+		for j := 0; j < 8; j++ {
+			r = r<<1 | b&1
+			b >>= 1
+		}
+		key[i] = r
+	}
+	block, err := des.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, 16)
+	block.Encrypt(ret, challenge[:8])
+	block.Encrypt(ret[8:], challenge[8:16])
+	return ret, nil
+}
+
+// connect opens the shared session with the local server
+func (hub *vncHub) connect() error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	up, err := dialVNCServer(cm)
+	if err != nil {
+		return err
+	}
+	err = hub.handshake(up, bufio.NewReader(up), cm)
+	if err != nil {
+		up.Close()
+		return err
+	}
+	return nil
+}
+
+func (hub *vncHub) handshake(up io.ReadWriteCloser, r *bufio.Reader, cm *conf.ConfManager) error {
+	version := make([]byte, 12)
+	_, err := io.ReadFull(r, version)
+	if err != nil {
+		return err
+	}
+	_, err = up.Write([]byte("RFB 003.008\n"))
+	if err != nil {
+		return err
+	}
+	count, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("vnc server refused connection")
+	}
+	secTypes := make([]byte, count)
+	_, err = io.ReadFull(r, secTypes)
+	if err != nil {
+		return err
+	}
+	var secType byte
+	for _, v := range secTypes {
+		if v == 1 || (v == 2 && secType == 0) {
+			secType = v
+		}
+	}
+	if secType == 0 {
+		return fmt.Errorf("no supported vnc security type in %v", secTypes)
+	}
+	_, err = up.Write([]byte{secType})
+	if err != nil {
+		return err
+	}
+	if secType == 2 {
+		challenge := make([]byte, 16)
+		_, err = io.ReadFull(r, challenge)
+		if err != nil {
+			return err
+		}
+		res, err := vncAuthResponse(cm.Conf.VNCConf.Password, challenge)
+		if err != nil {
+			return err
+		}
+		_, err = up.Write(res)
+		if err != nil {
+			return err
+		}
+	}
+	var result uint32
+	err = binary.Read(r, binary.BigEndian, &result)
+	if err != nil {
+		return err
+	}
+	if result != 0 {
+		return fmt.Errorf("vnc authentication failed")
+	}
+	// shared ClientInit
+	_, err = up.Write([]byte{1})
+	if err != nil {
+		return err
+	}
+	init := make([]byte, 24)
+	_, err = io.ReadFull(r, init)
+	if err != nil {
+		return err
+	}
+	name := make([]byte, binary.BigEndian.Uint32(init[20:24]))
+	_, err = io.ReadFull(r, name)
+	if err != nil {
+		return err
+	}
+
+	msg := append([]byte{0, 0, 0, 0}, hubPixelFormat...)
+	_, err = up.Write(msg)
+	if err != nil {
+		return err
+	}
+	encs := hubEncodings
+	if rf := newRFBFilter(cm.Conf.VNCQualityConf.Encodings, cm.Conf.VNCQualityConf.Quality, cm.Conf.VNCQualityConf.Compression); rf != nil {
+		encs = rf.rewriteEncodings(encs)
+	}
+	msg = make([]byte, 4+4*len(encs))
+	msg[0] = 2
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(encs)))
+	for i, v := range encs {
+		binary.BigEndian.PutUint32(msg[4+4*i:], uint32(v))
+	}
+	_, err = up.Write(msg)
+	if err != nil {
+		return err
+	}
+
+	hub.upstream = up
+	hub.width = binary.BigEndian.Uint16(init[0:2])
+	hub.height = binary.BigEndian.Uint16(init[2:4])
+	hub.name = name
+	hub.pending = time.Time{}
+	if hub.viewers == nil {
+		hub.viewers = make(map[*vncViewer]bool)
+	}
+	if hub.nativeWidth == 0 {
+		// other servers scale nothing, their framebuffer is the screen
+		hub.nativeWidth, hub.nativeHeight = hub.width, hub.height
+		if builtinVNCServer(cm.Conf.VNCDisplayConf) {
+			hub.nativeWidth, hub.nativeHeight = nativeScreenSize(hub.width, hub.height)
+		}
+	}
+	go hub.broadcast(up, r)
+	return nil
+}
+
+// readServerMessage reads the next message of the server and returns it
+// unchanged
+func (hub *vncHub) readServerMessage(r *bufio.Reader) ([]byte, error) {
+	var msg bytes.Buffer
+	tr := io.TeeReader(r, &msg)
+	read := func(n int) ([]byte, error) {
+		bs := make([]byte, n)
+		_, err := io.ReadFull(tr, bs)
+		return bs, err
+	}
+	head, err := read(1)
+	if err != nil {
+		return nil, err
+	}
+	switch head[0] {
+	case 0: // FramebufferUpdate
+		bs, err := read(3)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < int(binary.BigEndian.Uint16(bs[1:3])); i++ {
+			err = hub.readRect(read)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case 1: // SetColourMapEntries
+		bs, err := read(5)
+		if err != nil {
+			return nil, err
+		}
+		_, err = read(6 * int(binary.BigEndian.Uint16(bs[3:5])))
+		if err != nil {
+			return nil, err
+		}
+	case 2, 150: // Bell, EndOfContinuousUpdates
+	case 3: // ServerCutText
+		bs, err := read(7)
+		if err != nil {
+			return nil, err
+		}
+		_, err = read(int(binary.BigEndian.Uint32(bs[3:7])))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported vnc server message %d", head[0])
+	}
+	return msg.Bytes(), nil
+}
+
+func (hub *vncHub) readRect(read func(int) ([]byte, error)) error {
+	rect, err := read(12)
+	if err != nil {
+		return err
+	}
+	width := int(binary.BigEndian.Uint16(rect[4:6]))
+	height := int(binary.BigEndian.Uint16(rect[6:8]))
+	encoding := int32(binary.BigEndian.Uint32(rect[8:12]))
+	switch encoding {
+	case 0: // raw
+		_, err = read(width * height * 4)
+		return err
+	case 7, -260: // tight and tight PNG
+		return readTightRect(read)
+	case -223: // DesktopSize
+		hub.lock.Lock()
+		hub.width = uint16(width)
+		hub.height = uint16(height)
+		hub.lock.Unlock()
+		return nil
+	}
+	return fmt.Errorf("unsupported vnc encoding %d", encoding)
+}
+
+// readTightRect reads a fill, JPEG or PNG tight rectangle
+func readTightRect(read func(int) ([]byte, error)) error {
+	ctl, err := read(1)
+	if err != nil {
+		return err
+	}
+	if ctl[0]>>4 == 8 {
+		// one pixel in the 24 bits tight format
+		_, err = read(3)
+		return err
+	}
+	length := 0
+	for i := 0; i < 3; i++ {
+		b, err := read(1)
+		if err != nil {
+			return err
+		}
+		if i == 2 {
+			length |= int(b[0]) << 14
+			break
+		}
+		length |= int(b[0]&0x7f) << (7 * i)
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+	_, err = read(length)
+	return err
+}
+
+// broadcast sends the messages of the server to all viewers until the
+// session ends
+func (hub *vncHub) broadcast(up io.ReadWriteCloser, r *bufio.Reader) {
+	for {
+		msg, err := hub.readServerMessage(r)
+		if err != nil {
+			logrus.Debug("shared vnc session ", err)
+			break
+		}
+		hub.lock.Lock()
+		if msg[0] == 0 {
+			hub.pending = time.Time{}
+		}
+		for v := range hub.viewers {
+			hub.send(v, msg)
+		}
+		hub.lock.Unlock()
+	}
+	hub.lock.Lock()
+	// a resized session replaces the upstream, its viewers are kept
+	if hub.upstream == up {
+		for v := range hub.viewers {
+			v.close()
+		}
+		hub.viewers = nil
+		hub.upstream = nil
+	}
+	hub.lock.Unlock()
+	up.Close()
+}
+
+// join reserves a place for a viewer, connecting to the server if this is
+// the first one
+func (hub *vncHub) join(conn net.Conn, viewOnly bool, maxViewers int32, rec *fbsRecorder) (*vncViewer, error) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if maxViewers > 0 && len(hub.viewers)+hub.joining >= int(maxViewers) {
+		return nil, fmt.Errorf("too many vnc viewers")
+	}
+	if hub.upstream == nil {
+		err := hub.connect()
+		if err != nil {
+			return nil, err
+		}
+	}
+	hub.joining++
+	return &vncViewer{
+		conn:     conn,
+		viewOnly: viewOnly,
+		out:      make(chan []byte, 256),
+		rec:      rec,
+	}, nil
+}
+
+// greet does the server side of the handshake with a viewer, the viewer was
+// already authenticated by sshx so no VNC security is used
+func (hub *vncHub) greet(v *vncViewer, r *bufio.Reader) error {
+	_, err := v.Write([]byte("RFB 003.008\n"))
+	if err != nil {
+		return err
+	}
+	version := make([]byte, 12)
+	_, err = io.ReadFull(r, version)
+	if err != nil {
+		return err
+	}
+	switch string(version) {
+	case "RFB 003.003\n":
+		err = binary.Write(v, binary.BigEndian, uint32(1))
+	default:
+		_, err = v.Write([]byte{1, 1})
+		if err != nil {
+			return err
+		}
+		var secType byte
+		secType, err = r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if secType != 1 {
+			return fmt.Errorf("unsupported vnc security type %d", secType)
+		}
+		if string(version) == "RFB 003.008\n" {
+			err = binary.Write(v, binary.BigEndian, uint32(0))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// ClientInit, the session is always shared
+	_, err = r.ReadByte()
+	if err != nil {
+		return err
+	}
+	hub.lock.Lock()
+	init := make([]byte, 24, 24+len(hub.name))
+	binary.BigEndian.PutUint16(init[0:2], hub.width)
+	binary.BigEndian.PutUint16(init[2:4], hub.height)
+	copy(init[4:20], hubPixelFormat)
+	binary.BigEndian.PutUint32(init[20:24], uint32(len(hub.name)))
+	init = append(init, hub.name...)
+	hub.lock.Unlock()
+	_, err = v.Write(init)
+	return err
+}
+
+// serve runs the session of a viewer until it leaves
+func (hub *vncHub) serve(v *vncViewer) error {
+	defer v.conn.Close()
+	r := bufio.NewReader(v.conn)
+	err := hub.greet(v, r)
+	hub.lock.Lock()
+	hub.joining--
+	if err == nil && (hub.upstream == nil || hub.viewers == nil) {
+		err = fmt.Errorf("shared vnc session closed")
+	}
+	if err != nil {
+		hub.lock.Unlock()
+		return err
+	}
+	hub.viewers[v] = true
+	hub.lock.Unlock()
+	defer hub.leave(v)
+
+	go func() {
+		for msg := range v.out {
+			_, err := v.Write(msg)
+			if err != nil {
+				v.conn.Close()
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 0, 4096)
+	tmp := make([]byte, 4096)
+	for {
+		n, err := r.Read(tmp)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		buf = append(buf, tmp[:n]...)
+		for len(buf) > 0 {
+			size := rfbMessageLen(buf)
+			if size < 0 {
+				return fmt.Errorf("unsupported vnc message %d", buf[0])
+			}
+			if size == 0 {
+				break
+			}
+			err = hub.forward(v, buf[:size])
+			if err != nil {
+				return err
+			}
+			buf = buf[size:]
+		}
+	}
+}
+
+// send queues msg for v, the hub lock must be held
+func (hub *vncHub) send(v *vncViewer, msg []byte) {
+	if msg == nil || !hub.viewers[v] {
+		return
+	}
+	select {
+	case v.out <- msg:
+	default:
+		logrus.Warn("vnc viewer too slow, disconnect it")
+		delete(hub.viewers, v)
+		v.close()
+	}
+}
+
+// forward passes a message of a viewer to the server
+func (hub *vncHub) forward(v *vncViewer, msg []byte) error {
+	switch {
+	case msg[0] == 0:
+		if !bytes.Equal(msg[4:20], hubPixelFormat) {
+			logrus.Warn("vnc viewer asked for another pixel format, ignored in shared session")
+		}
+		return nil
+	case msg[0] == 2:
+		// encodings are chosen for all viewers, only the support of desktop
+		// size changes is remembered
+		hub.lock.Lock()
+		defer hub.lock.Unlock()
+		for i := 4; i+4 <= len(msg); i += 4 {
+			switch int32(binary.BigEndian.Uint32(msg[i:])) {
+			case -308:
+				v.extDesktop = true
+			case -223:
+				v.desktopSize = true
+			}
+		}
+		if v.extDesktop {
+			// tells the viewer it may ask for another size
+			hub.send(v, hub.desktopSizeUpdate(v, 0, 0))
+		}
+		return nil
+	case msg[0] == 251:
+		if v.viewOnly {
+			hub.lock.Lock()
+			hub.send(v, hub.desktopSizeUpdate(v, 1, rfbResizeProhibited))
+			hub.lock.Unlock()
+			return nil
+		}
+		hub.resize(v, int(binary.BigEndian.Uint16(msg[2:4])), int(binary.BigEndian.Uint16(msg[4:6])))
+		return nil
+	case msg[0] == 5:
+		if v.viewOnly {
+			return nil
+		}
+		msg = hub.scalePointer(msg)
+	case msg[0] == 3:
+		hub.lock.Lock()
+		// one incremental request at a time, every viewer gets the answer.
+		// The server may not answer if nothing changed, so retry after a while.
+		skip := msg[1] != 0 && time.Since(hub.pending) < time.Second
+		if msg[1] != 0 && !skip {
+			hub.pending = time.Now()
+		}
+		hub.lock.Unlock()
+		if skip {
+			return nil
+		}
+	case isRFBInput(msg[0]):
+		if v.viewOnly {
+			return nil
+		}
+	default:
+		// extensions are not announced to viewers of the shared session
+		return nil
+	}
+	hub.lock.Lock()
+	up := hub.upstream
+	hub.lock.Unlock()
+	if up == nil {
+		return fmt.Errorf("shared vnc session closed")
+	}
+	_, err := up.Write(msg)
+	return err
+}
+
+// leave removes a viewer, the session with the server ends with the last one
+func (hub *vncHub) leave(v *vncViewer) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if hub.viewers != nil && hub.viewers[v] {
+		delete(hub.viewers, v)
+		v.close()
+	}
+	if len(hub.viewers) == 0 && hub.joining == 0 && hub.upstream != nil {
+		hub.upstream.Close()
+		hub.upstream = nil
+	}
+}
@@ -0,0 +1,180 @@
+package impl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/utils"
+	"github.com/suutaku/sshx/pkg/conf"
+)
+
+// fbsRecorder saves what the VNC server sends to a viewer as an FBS 001.000
+// file, which can be replayed by VNC players or converted to video
+type fbsRecorder struct {
+	lock  sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	start time.Time
+}
+
+// VNCRecordingDir returns the directory of the VNC session recordings
+func VNCRecordingDir(rc conf.VNCRecordConf) string {
+	if rc.Path != "" {
+		return rc.Path
+	}
+	return filepath.Join(utils.GetSSHXStateHome(), "recordings")
+}
+
+// newFBSRecorder starts recording a session of peerId if recording is
+// enabled, nil is returned otherwise
+func newFBSRecorder(peerId string) *fbsRecorder {
+	cm, err := conf.Shared()
+	if err != nil {
+		logrus.Error("vnc recording ", err)
+		return nil
+	}
+	rc := cm.Conf.VNCRecordConf
+	if !rc.Enabled {
+		return nil
+	}
+	dir := VNCRecordingDir(rc)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		logrus.Error("vnc recording ", err)
+		return nil
+	}
+	pruneRecordings(dir, rc)
+	now := time.Now()
+	name := filepath.Join(dir, fmt.Sprintf("%s-%s.fbs", now.Format("20060102-150405"), peerId))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		logrus.Error("vnc recording ", err)
+		return nil
+	}
+	ret := &fbsRecorder{
+		file:  file,
+		w:     bufio.NewWriter(file),
+		start: now,
+	}
+	ret.w.WriteString("FBS 001.000\n")
+	logrus.Info("record vnc session of ", peerId, " to ", name)
+	return ret
+}
+
+// Write appends a block of server data, recording errors never break the
+// session so they are only logged
+func (fr *fbsRecorder) Write(p []byte) (int, error) {
+	if fr == nil {
+		return len(p), nil
+	}
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	if fr.w == nil {
+		return len(p), nil
+	}
+	binary.Write(fr.w, binary.BigEndian, uint32(len(p)))
+	fr.w.Write(p)
+	if pad := len(p) % 4; pad != 0 {
+		fr.w.Write(make([]byte, 4-pad))
+	}
+	err := binary.Write(fr.w, binary.BigEndian, uint32(time.Since(fr.start)/time.Millisecond))
+	if err != nil {
+		logrus.Error("vnc recording ", err)
+		fr.file.Close()
+		fr.w = nil
+	}
+	return len(p), nil
+}
+
+func (fr *fbsRecorder) Close() {
+	if fr == nil {
+		return
+	}
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	if fr.w == nil {
+		return
+	}
+	fr.w.Flush()
+	fr.file.Close()
+	fr.w = nil
+}
+
+// pruneRecordings removes recordings older than MaxAge days, then the oldest
+// ones until all fit in MaxSize bytes
+func pruneRecordings(dir string, rc conf.VNCRecordConf) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	// names start with the time, so they sort from the oldest
+	var files []os.FileInfo
+	var total int64
+	for _, v := range infos {
+		if v.IsDir() || !strings.HasSuffix(v.Name(), ".fbs") {
+			continue
+		}
+		if rc.MaxAge > 0 && time.Since(v.ModTime()) > time.Duration(rc.MaxAge)*24*time.Hour {
+			removeRecording(filepath.Join(dir, v.Name()))
+			continue
+		}
+		files = append(files, v)
+		total += v.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	for i := 0; rc.MaxSize > 0 && total > rc.MaxSize && i < len(files); i++ {
+		removeRecording(filepath.Join(dir, files[i].Name()))
+		total -= files[i].Size()
+	}
+}
+
+func removeRecording(name string) {
+	err := os.Remove(name)
+	if err != nil {
+		logrus.Warn("vnc recording ", err)
+		return
+	}
+	logrus.Debug("removed vnc recording ", name)
+}
+
+// ShowVNCRecordings prints the recorded sessions of the local VNC service
+func ShowVNCRecordings() error {
+	cm, err := conf.Shared()
+	if err != nil {
+		return err
+	}
+	dir := VNCRecordingDir(cm.Conf.VNCRecordConf)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"#", "File", "Bytes", "Last Modified"})
+	t.AppendSeparator()
+	k := 0
+	for _, v := range infos {
+		if v.IsDir() || !strings.HasSuffix(v.Name(), ".fbs") {
+			continue
+		}
+		k++
+		t.AppendRows([]table.Row{
+			{k, filepath.Join(dir, v.Name()), v.Size(), v.ModTime().Format("2 Jan 2006 15:04:05")},
+		})
+	}
+	t.AppendSeparator()
+	t.Render()
+	return nil
+}
@@ -0,0 +1,150 @@
+package impl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/go-vgo/robotgo"
+	"github.com/sirupsen/logrus"
+)
+
+// ExtendedDesktopSize status codes
+const (
+	rfbResizeOK         = 0
+	rfbResizeProhibited = 1
+	rfbResizeInvalid    = 3
+)
+
+// nativeScreenSize returns the size of the captured screen, or the given
+// framebuffer size if it is unknown
+func nativeScreenSize(width, height uint16) (uint16, uint16) {
+	w, h := robotgo.GetScreenSize()
+	if w <= 0 || h <= 0 {
+		return width, height
+	}
+	return uint16(w), uint16(h)
+}
+
+// fitSize returns the largest size with the aspect ratio of the screen that
+// fits in width x height, the screen is never scaled up
+func fitSize(nativeWidth, nativeHeight, width, height int) (int, int) {
+	if width >= nativeWidth && height >= nativeHeight {
+		return nativeWidth, nativeHeight
+	}
+	if width*nativeHeight < height*nativeWidth {
+		return width, nativeHeight * width / nativeWidth
+	}
+	return nativeWidth * height / nativeHeight, height
+}
+
+// desktopSizeUpdate returns a FramebufferUpdate telling v the framebuffer
+// size, nil if the viewer doesn't support it. The hub lock must be held.
+func (hub *vncHub) desktopSizeUpdate(v *vncViewer, reason, status uint16) []byte {
+	switch {
+	case v.extDesktop:
+		msg := make([]byte, 4+12+4+16)
+		binary.BigEndian.PutUint16(msg[2:4], 1)
+		rect := msg[4:]
+		binary.BigEndian.PutUint16(rect[0:2], reason)
+		binary.BigEndian.PutUint16(rect[2:4], status)
+		binary.BigEndian.PutUint16(rect[4:6], hub.width)
+		binary.BigEndian.PutUint16(rect[6:8], hub.height)
+		binary.BigEndian.PutUint32(rect[8:12], uint32(0xfffffecc)) // -308
+		// a single screen covering the framebuffer
+		screen := rect[12:]
+		screen[0] = 1
+		binary.BigEndian.PutUint16(screen[12:14], hub.width)
+		binary.BigEndian.PutUint16(screen[14:16], hub.height)
+		return msg
+	case v.desktopSize && reason != 1:
+		msg := make([]byte, 4+12)
+		binary.BigEndian.PutUint16(msg[2:4], 1)
+		binary.BigEndian.PutUint16(msg[8:10], hub.width)
+		binary.BigEndian.PutUint16(msg[10:12], hub.height)
+		binary.BigEndian.PutUint32(msg[12:16], uint32(0xffffff21)) // -223
+		return msg
+	}
+	return nil
+}
+
+// scalePointer maps the position of a pointer event from the framebuffer to
+// the captured screen
+func (hub *vncHub) scalePointer(msg []byte) []byte {
+	hub.lock.Lock()
+	fw, fh := int(hub.width), int(hub.height)
+	nw, nh := int(hub.nativeWidth), int(hub.nativeHeight)
+	hub.lock.Unlock()
+	if fw == 0 || fh == 0 || (fw == nw && fh == nh) {
+		return msg
+	}
+	ret := make([]byte, len(msg))
+	copy(ret, msg)
+	x := int(binary.BigEndian.Uint16(msg[2:4])) * nw / fw
+	y := int(binary.BigEndian.Uint16(msg[4:6])) * nh / fh
+	binary.BigEndian.PutUint16(ret[2:4], uint16(x))
+	binary.BigEndian.PutUint16(ret[4:6], uint16(y))
+	return ret
+}
+
+// resize restarts the local VNC server with a framebuffer fitting in
+// width x height and moves the shared session to it. requester gets the
+// result of its request, other viewers are told about the new size.
+func (hub *vncHub) resize(requester *vncViewer, width, height int) {
+	err := hub.doResize(width, height)
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if err != nil {
+		logrus.Warn("resize vnc desktop ", err)
+		status := uint16(rfbResizeProhibited)
+		if width == 0 || height == 0 {
+			status = rfbResizeInvalid
+		}
+		hub.send(requester, hub.desktopSizeUpdate(requester, 1, status))
+		return
+	}
+	for v := range hub.viewers {
+		if v == requester {
+			hub.send(v, hub.desktopSizeUpdate(v, 1, rfbResizeOK))
+			continue
+		}
+		hub.send(v, hub.desktopSizeUpdate(v, 2, rfbResizeOK))
+	}
+}
+
+func (hub *vncHub) doResize(width, height int) error {
+	if width == 0 || height == 0 {
+		return fmt.Errorf("invalid size %dx%d", width, height)
+	}
+	svc := runningVNCService()
+	if svc == nil {
+		return fmt.Errorf("vnc server was not started by this node")
+	}
+	hub.lock.Lock()
+	width, height = fitSize(int(hub.nativeWidth), int(hub.nativeHeight), width, height)
+	same := width == int(hub.width) && height == int(hub.height)
+	hub.lock.Unlock()
+	if same {
+		return nil
+	}
+	err := svc.restartServer(width, height)
+	if err != nil {
+		return err
+	}
+	// the old session keeps going until the restarted server accepts
+	for i := 0; i < 20; i++ {
+		time.Sleep(100 * time.Millisecond)
+		hub.lock.Lock()
+		old := hub.upstream
+		err = hub.connect()
+		if err == nil && old != nil {
+			old.Close()
+		}
+		hub.lock.Unlock()
+		if err == nil {
+			logrus.Infof("vnc desktop resized to %dx%d", width, height)
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,323 @@
+// Package mobile is the API of sshx for iOS and Android applications, which
+// embed the node instead of talking to a daemon. It is bound with
+//
+//	gomobile bind github.com/suutaku/sshx/pkg/mobile
+//
+// so it only takes and returns the types gomobile supports, lists and
+// events are JSON encoded. Nothing of it exits the process or blocks
+// beyond the call it serves.
+//
+// The configure still imports the settings of the VNC server, whose screen
+// capture needs the cgo libraries of desktops, so gomobile can't build the
+// package for iOS and Android until those settings move out of pkg/conf.
+package mobile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/suutaku/sshx/internal/conn"
+	"github.com/suutaku/sshx/internal/node"
+	"github.com/suutaku/sshx/pkg/conf"
+	"github.com/suutaku/sshx/pkg/impl"
+	"github.com/suutaku/sshx/pkg/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// EventHandler receives the session events of the node, each one is the
+// JSON of a types.Event
+type EventHandler interface {
+	OnEvent(event string)
+}
+
+// Terminal is the terminal view of an ssh session
+type Terminal interface {
+	// Output receives the output of the shell
+	Output(data []byte)
+	// Password asks the user a password, an empty one cancels the login
+	Password(prompt string) string
+	// Closed is called once the shell exited, err is empty if it exited
+	// cleanly
+	Closed(err string)
+}
+
+// Client is a node embedded in the application
+type Client struct {
+	lock    sync.Mutex
+	cm      *conf.ConfManager
+	node    *node.Node
+	proxies map[int]*impl.Proxy
+	unwatch func()
+}
+
+// NewClient loads the configure of home, a directory of the application,
+// and writes the default one there if there is none. The node isn't
+// started until Start is called.
+func NewClient(home string) (*Client, error) {
+	if home == "" {
+		return nil, fmt.Errorf("empty home directory")
+	}
+	// the applications read the configure again, from home too
+	os.Setenv("SSHX_HOME", home)
+	cm, err := conf.NewConfManager(home)
+	if err != nil {
+		return nil, err
+	}
+	impl.SetDaemonAddr(fmt.Sprintf("127.0.0.1:%d", cm.Conf.LocalTCPPort))
+	return &Client{
+		cm:      cm,
+		proxies: make(map[int]*impl.Proxy),
+	}, nil
+}
+
+// ID returns the device ID of this node
+func (c *Client) ID() string {
+	return c.cm.Conf.ID
+}
+
+// SetConfig sets a key of the configure as sshx conf set does, structures
+// and lists in JSON. The node reads most keys when it starts.
+func (c *Client) SetConfig(key, value string) error {
+	return c.cm.SetString(key, value)
+}
+
+// Start starts the node in the background, it returns once the node
+// serves the sessions of the application
+func (c *Client) Start() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.node != nil {
+		return nil
+	}
+	n, err := node.NewNode(c.cm.Path)
+	if err != nil {
+		return err
+	}
+	err = n.Listen()
+	if err != nil {
+		return err
+	}
+	c.node = n
+	go func() {
+		err := n.Start()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}()
+	return nil
+}
+
+// Stop closes the proxies and stops the node
+func (c *Client) Stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for port, p := range c.proxies {
+		p.Close()
+		delete(c.proxies, port)
+	}
+	if c.unwatch != nil {
+		c.unwatch()
+		c.unwatch = nil
+	}
+	if c.node != nil {
+		c.node.Stop()
+		c.node = nil
+	}
+}
+
+// SetEventHandler makes h receive the events of the node, nil stops them
+func (c *Client) SetEventHandler(h EventHandler) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.unwatch != nil {
+		c.unwatch()
+		c.unwatch = nil
+	}
+	if h == nil {
+		return
+	}
+	c.unwatch = conn.WatchEvents(func(ev types.Event) {
+		bs, err := json.Marshal(ev)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		h.OnEvent(string(bs))
+	})
+}
+
+// Peers returns the JSON of the devices of the address book
+func (c *Client) Peers() (string, error) {
+	cm, err := conf.NewConfManager(c.cm.Path)
+	if err != nil {
+		return "", err
+	}
+	peers := cm.Conf.AddressBook
+	if peers == nil {
+		peers = []conf.Peer{}
+	}
+	bs, err := json.Marshal(peers)
+	return string(bs), err
+}
+
+// StartProxy forwards the local port to the ssh server of peer, a device ID
+// or address book name, until StopProxy is called
+func (c *Client) StartProxy(port int, peer string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.node == nil {
+		return fmt.Errorf("the node is not started")
+	}
+	if _, ok := c.proxies[port]; ok {
+		return fmt.Errorf("port %d is already forwarded", port)
+	}
+	proxy := impl.NewProxy(int32(port), c.cm.ResolvePeer(peer))
+	proxy.SetWarm(int(c.cm.Conf.ProxyConf.Warm), time.Duration(c.cm.Conf.ProxyConf.WarmIdle)*time.Second)
+	proxy.Preper(context.Background())
+	proxy.NoNeedConnect()
+	err := proxy.Listen()
+	if err != nil {
+		return err
+	}
+	sender := impl.NewSender(proxy, types.OPTION_TYPE_UP)
+	if sender == nil {
+		proxy.Close()
+		return fmt.Errorf("cannot encode the proxy request")
+	}
+	_, err = sender.SendDetach()
+	if err != nil {
+		proxy.Close()
+		return err
+	}
+	c.proxies[port] = proxy
+	go func() {
+		err := proxy.Start()
+		if err != nil {
+			logrus.Error(err)
+		}
+	}()
+	return nil
+}
+
+// StopProxy stops forwarding the local port
+func (c *Client) StopProxy(port int) error {
+	c.lock.Lock()
+	proxy, ok := c.proxies[port]
+	delete(c.proxies, port)
+	c.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("port %d is not forwarded", port)
+	}
+	proxy.Close()
+	sender := impl.NewSender(proxy, types.OPTION_TYPE_DOWN)
+	if sender == nil {
+		return nil
+	}
+	_, err := sender.SendDetach()
+	return err
+}
+
+// Session is an ssh shell of a remote device
+type Session struct {
+	client  *ssh.Client
+	session *ssh.Session
+	stdin   io.WriteCloser
+}
+
+// outputWriter passes the output of a session to its terminal
+type outputWriter struct {
+	term Terminal
+}
+
+func (w outputWriter) Write(p []byte) (int, error) {
+	w.term.Output(p)
+	return len(p), nil
+}
+
+// ConnectSSH opens a shell of cols x rows on addr, [username]@[device id or
+// name], with the private key file identity if it isn't empty. The output
+// of the shell goes to term.
+func (c *Client) ConnectSSH(addr, identity string, cols, rows int, term Terminal) (*Session, error) {
+	c.lock.Lock()
+	started := c.node != nil
+	c.lock.Unlock()
+	if !started {
+		return nil, fmt.Errorf("the node is not started")
+	}
+	imp := impl.NewSSH(addr, false, identity, false)
+	err := imp.Preper(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	imp.SetPasswordPrompt(func() (string, error) {
+		pass := term.Password(fmt.Sprintf("Password of %s: ", addr))
+		if pass == "" {
+			return "", fmt.Errorf("login canceled")
+		}
+		return pass, nil
+	})
+	sender := impl.NewSender(imp, types.OPTION_TYPE_UP)
+	if sender == nil {
+		return nil, fmt.Errorf("cannot encode the ssh request")
+	}
+	tunnel, err := sender.Send()
+	if err != nil {
+		return nil, err
+	}
+	client, session, err := imp.Shell(tunnel, "xterm-256color", cols, rows)
+	if err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		client.Close()
+		return nil, err
+	}
+	session.Stdout = outputWriter{term}
+	session.Stderr = outputWriter{term}
+	err = session.Shell()
+	if err != nil {
+		session.Close()
+		client.Close()
+		return nil, err
+	}
+	go func() {
+		err := session.Wait()
+		client.Close()
+		if err != nil {
+			term.Closed(err.Error())
+			return
+		}
+		term.Closed("")
+	}()
+	return &Session{
+		client:  client,
+		session: session,
+		stdin:   stdin,
+	}, nil
+}
+
+// Write sends the input of the user to the shell
+func (s *Session) Write(data []byte) error {
+	_, err := s.stdin.Write(data)
+	return err
+}
+
+// Resize changes the size of the terminal of the shell
+func (s *Session) Resize(cols, rows int) error {
+	return s.session.WindowChange(rows, cols)
+}
+
+// Close ends the shell
+func (s *Session) Close() error {
+	s.session.Close()
+	return s.client.Close()
+}
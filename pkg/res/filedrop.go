@@ -0,0 +1,44 @@
+package res
+
+// FileDropPage is the page served by the node file drop endpoint, {{.Token}}
+// is filled with the access token
+const FileDropPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>sshx file drop</title>
+<style>
+body { font-family: sans-serif; max-width: 32em; margin: 2em auto; padding: 0 1em; color: #333; }
+fieldset { border: 1px solid #ccc; border-radius: 6px; margin-bottom: 1.5em; }
+label { display: block; margin: .6em 0 .2em; }
+input[type=text], input[type=file] { width: 100%; box-sizing: border-box; }
+button { margin-top: 1em; padding: .4em 1.2em; }
+</style>
+</head>
+<body>
+<h2>sshx file drop</h2>
+<form method="post" enctype="multipart/form-data" action="upload?token={{.Token}}">
+<fieldset>
+<legend>Send a file</legend>
+<label>Device ID</label>
+<input type="text" name="target" required>
+<label>File</label>
+<input type="file" name="file" required>
+<button type="submit">Send</button>
+</fieldset>
+</form>
+<form method="get" action="download">
+<fieldset>
+<legend>Fetch a file</legend>
+<input type="hidden" name="token" value="{{.Token}}">
+<label>Device ID</label>
+<input type="text" name="target" required>
+<label>Path on device</label>
+<input type="text" name="path" required>
+<button type="submit">Fetch</button>
+</fieldset>
+</form>
+</body>
+</html>
+`
@@ -0,0 +1,79 @@
+package types
+
+import "strings"
+
+const (
+	// MAX_DIRECTORY_ENTRY bounds an encoded directory entry
+	MAX_DIRECTORY_ENTRY = 8 << 10
+
+	// MAX_DIRECTORY_TAGS bounds the tags and the capabilities of an entry
+	MAX_DIRECTORY_TAGS = 32
+)
+
+// DirectoryEntry is the record of a device in the peer directory of a
+// signaling server. It is signed by the node key of the device, the
+// directory keeps the first key an ID registered with.
+type DirectoryEntry struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Owner is the person or team the device belongs to
+	Owner string `json:"owner,omitempty"`
+	// Tags are free labels, as a site or a role
+	Tags []string `json:"tags,omitempty"`
+	// Capabilities are the applications the device serves, as ssh or vnc
+	Capabilities []string `json:"capabilities,omitempty"`
+	NodeKey      []byte   `json:"node_key"`
+	// Updated is the unix time the entry was signed, the directory refuses
+	// entries older than the one it has
+	Updated int64 `json:"updated"`
+	// Removed asks the directory to drop the entry
+	Removed   bool   `json:"removed,omitempty"`
+	Signature []byte `json:"signature"`
+}
+
+// DirectoryQuery selects entries of the directory, empty fields match any
+type DirectoryQuery struct {
+	// Text is matched against the ID, the name, the owner and the tags,
+	// ignoring case
+	Text  string
+	Owner string
+	// Tags and Capabilities must all be in the entry
+	Tags         []string
+	Capabilities []string
+}
+
+// Match reports whether the entry is selected by q
+func (q DirectoryQuery) Match(e *DirectoryEntry) bool {
+	if q.Owner != "" && !strings.EqualFold(q.Owner, e.Owner) {
+		return false
+	}
+	for _, v := range q.Tags {
+		if !containsFold(e.Tags, v) {
+			return false
+		}
+	}
+	for _, v := range q.Capabilities {
+		if !containsFold(e.Capabilities, v) {
+			return false
+		}
+	}
+	if q.Text == "" {
+		return true
+	}
+	text := strings.ToLower(q.Text)
+	for _, v := range append([]string{e.ID, e.Name, e.Owner}, e.Tags...) {
+		if strings.Contains(strings.ToLower(v), text) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, v string) bool {
+	for _, s := range list {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
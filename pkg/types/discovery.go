@@ -0,0 +1,17 @@
+package types
+
+import "time"
+
+// LANPeer is a device found on the local network
+type LANPeer struct {
+	ID   string
+	Name string
+	// Apps are the applications the device advertises
+	Apps []string
+	// Addrs are the addresses of the device, the one it was last seen
+	// from first
+	Addrs []string
+	// Port is the port of its direct service
+	Port int
+	Seen time.Time
+}
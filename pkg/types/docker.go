@@ -0,0 +1,15 @@
+package types
+
+import "time"
+
+// DockerContainer is a container of the Docker engine of a remote node
+type DockerContainer struct {
+	ID    string
+	Name  string
+	Image string
+	// State is created, running, paused, exited...
+	State string
+	// Status is the status the engine shows, as "Up 2 hours"
+	Status  string
+	Created time.Time
+}
@@ -0,0 +1,31 @@
+package types
+
+import "time"
+
+// Kinds of the events of the daemon
+const (
+	EVENT_DIAL    = "dial"    // a session is dialed
+	EVENT_OPEN    = "open"    // a session is open
+	EVENT_CLOSE   = "close"   // a session is closed
+	EVENT_FAILURE = "failure" // a session failed
+	EVENT_DENIED  = "denied"  // a session or a message was refused
+	EVENT_EXPIRED = "expired" // a session reached its maximum duration
+	EVENT_STUN    = "stun"    // a STUN server went up or down
+)
+
+// Kinds of the events of the scheduled tasks
+const (
+	EVENT_TASK         = "task"         // a task succeeded
+	EVENT_TASK_FAILURE = "task-failure" // a task failed
+)
+
+// Event is a lifecycle or error event of the daemon, the last ones are
+// returned by the status request
+type Event struct {
+	Time     time.Time
+	Kind     string
+	PairId   string
+	TargetId string
+	App      string
+	Message  string
+}
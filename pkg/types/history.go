@@ -0,0 +1,40 @@
+package types
+
+import "time"
+
+// HistoryRecord is a completed or failed session of the daemon
+type HistoryRecord struct {
+	PairId   string
+	TargetId string
+	App      string
+	// Inbound is set for sessions peers opened to this device
+	Inbound bool
+	Start   time.Time
+	End     time.Time
+	// BytesIn and BytesOut are the bytes received from and sent to the peer
+	BytesIn  int64
+	BytesOut int64
+	// Candidate is the least direct candidate type of the path: host,
+	// srflx, relay, direct for direct tcp connections or overlay
+	Candidate string
+	Path      string
+	// Failure is why the session failed, empty if it was open
+	Failure string
+	// User is the local user who opened the session through a shared
+	// daemon
+	User string `json:",omitempty"`
+}
+
+// Duration is how long the session lasted
+func (r HistoryRecord) Duration() time.Duration {
+	return r.End.Sub(r.Start)
+}
+
+// Rate is the average throughput of the session in bytes per second
+func (r HistoryRecord) Rate() float64 {
+	d := r.Duration().Seconds()
+	if d <= 0 {
+		return 0
+	}
+	return float64(r.BytesIn+r.BytesOut) / d
+}
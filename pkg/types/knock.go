@@ -0,0 +1,21 @@
+package types
+
+import "time"
+
+// KnockRequest is an inbound session waiting for the approval of the
+// operator
+type KnockRequest struct {
+	Id   int64
+	Peer string
+	// Name of the peer in the address book
+	Name string
+	App  string
+	Time time.Time
+}
+
+// KnockResult is the answer of the daemon to 'sshx knock'
+type KnockResult struct {
+	Requests []KnockRequest
+	// Error is set if the request failed
+	Error string
+}
@@ -0,0 +1,168 @@
+// Package types - limits.go bounds the messages the daemon decodes from
+// peers and from the signaling server
+package types
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"unicode"
+)
+
+const (
+	// MAX_SIGNALING_SIZE bounds an encoded SignalingInfo, SDPs are a few
+	// kilobytes
+	MAX_SIGNALING_SIZE = 256 << 10
+
+	// MAX_ID_LENGTH bounds device IDs, names, endpoints and relay URLs
+	MAX_ID_LENGTH = 128
+
+	// MAX_SDP_LENGTH bounds session descriptions
+	MAX_SDP_LENGTH = 64 << 10
+
+	// MAX_KEY_LENGTH bounds keys, signatures, proofs and one-time codes
+	MAX_KEY_LENGTH = 1 << 10
+
+	// MAX_BLOB_LENGTH bounds candidates, certificates and rotations
+	MAX_BLOB_LENGTH = 16 << 10
+)
+
+// ErrTooLarge is returned for messages over their size limit
+var ErrTooLarge = fmt.Errorf("message too large")
+
+// LimitedReader fails with ErrTooLarge once more than N bytes were read,
+// where io.LimitReader would report a plain EOF. It reads byte by byte when
+// asked to, so gob doesn't buffer the data following the decoded value.
+type LimitedReader struct {
+	R io.Reader
+	N int64
+}
+
+func (lr *LimitedReader) Read(p []byte) (int, error) {
+	if lr.N <= 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > lr.N {
+		p = p[:lr.N]
+	}
+	n, err := lr.R.Read(p)
+	lr.N -= int64(n)
+	return n, err
+}
+
+func (lr *LimitedReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(lr, b[:])
+	return b[0], err
+}
+
+// DecodeLimited gob-decodes one value of at most limit bytes from r
+func DecodeLimited(r io.Reader, limit int64, v interface{}) error {
+	lr := &LimitedReader{R: r, N: limit}
+	err := gob.NewDecoder(lr).Decode(v)
+	if err != nil && lr.N <= 0 {
+		return ErrTooLarge
+	}
+	return err
+}
+
+// LimitedDecoder gob-decodes a stream of values of at most limit bytes
+// each. A new decoder per value would lose the types gob sends once per
+// stream.
+type LimitedDecoder struct {
+	lr    *LimitedReader
+	dec   *gob.Decoder
+	limit int64
+}
+
+func NewLimitedDecoder(r io.Reader, limit int64) *LimitedDecoder {
+	lr := &LimitedReader{R: r, N: limit}
+	return &LimitedDecoder{
+		lr:    lr,
+		dec:   gob.NewDecoder(lr),
+		limit: limit,
+	}
+}
+
+// Decode decodes the next value, failing with ErrTooLarge if it takes more
+// than the limit
+func (ld *LimitedDecoder) Decode(v interface{}) error {
+	ld.lr.N = ld.limit
+	err := ld.dec.Decode(v)
+	if err != nil && ld.lr.N <= 0 {
+		return ErrTooLarge
+	}
+	return err
+}
+
+func checkLength(field string, n, max int) error {
+	if n > max {
+		return fmt.Errorf("%s too long: %d > %d", field, n, max)
+	}
+	return nil
+}
+
+// Validate checks the lengths of the fields of a signaling message
+func (info *SignalingInfo) Validate() error {
+	checks := []struct {
+		field string
+		n     int
+		max   int
+	}{
+		{"source", len(info.Source), MAX_ID_LENGTH},
+		{"target", len(info.Target), MAX_ID_LENGTH},
+		{"sdp", len(info.SDP), MAX_SDP_LENGTH},
+		{"candidate", len(info.Candidate), MAX_BLOB_LENGTH},
+		{"hello", len(info.Hello), MAX_KEY_LENGTH},
+		{"proof", len(info.Proof), MAX_KEY_LENGTH},
+		{"otp", len(info.OTP), MAX_KEY_LENGTH},
+		{"totp secret", len(info.TOTPSecret), MAX_KEY_LENGTH},
+		{"node key", len(info.NodeKey), MAX_KEY_LENGTH},
+		{"signature", len(info.Signature), MAX_KEY_LENGTH},
+		{"cert", len(info.Cert), MAX_BLOB_LENGTH},
+		{"rotations", len(info.Rotations), MAX_BLOB_LENGTH},
+		{"endpoint", len(info.Endpoint), MAX_ID_LENGTH},
+		{"derp key", len(info.DERPKey), MAX_KEY_LENGTH},
+		{"derp relay", len(info.DERPRelay), MAX_ID_LENGTH},
+		{"name", len(info.Name), MAX_ID_LENGTH},
+	}
+	for _, v := range checks {
+		err := checkLength(v.field, v.n, v.max)
+		if err != nil {
+			return err
+		}
+	}
+	if info.Source == "" {
+		return fmt.Errorf("signaling message without source")
+	}
+	// the name ends up in the address book and in the terminal
+	for _, r := range info.Name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("control character in name %q", info.Name)
+		}
+	}
+	return nil
+}
+
+// DecodeSignalingInfo reads one signaling message from r, in the wire
+// encoding or in gob, and validates it
+func DecodeSignalingInfo(r io.Reader) (SignalingInfo, error) {
+	var info SignalingInfo
+	wire, r, err := SniffWire(r)
+	if err != nil {
+		return info, err
+	}
+	if wire {
+		var body []byte
+		body, err = ReadWire(r, MAX_SIGNALING_SIZE)
+		if err == nil {
+			err = info.UnmarshalWire(body)
+		}
+	} else {
+		err = DecodeLimited(r, MAX_SIGNALING_SIZE, &info)
+	}
+	if err != nil {
+		return info, err
+	}
+	return info, info.Validate()
+}
@@ -0,0 +1,134 @@
+package types
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strings"
+	"testing"
+)
+
+func sampleSignalingInfo() SignalingInfo {
+	return SignalingInfo{
+		Flag:              SIG_TYPE_OFFER,
+		Source:            "alice",
+		Target:            "bob",
+		SDP:               "v=0\r\no=- 4611731400430051336 2 IN IP4 127.0.0.1\r\n",
+		Candidate:         []byte("candidate:1 1 udp 2130706431 192.0.2.1 54400 typ host"),
+		Id:                PoolId{Value: 1700000000000000000, Direction: 1, ImplCode: 2},
+		RemoteRequestType: 2,
+		Hello:             bytes.Repeat([]byte{1}, 32),
+		Proof:             bytes.Repeat([]byte{2}, 32),
+	}
+}
+
+func FuzzDecodeLimited(f *testing.F) {
+	const limit = 4 << 10
+	var buf bytes.Buffer
+	info := sampleSignalingInfo()
+	gob.NewEncoder(&buf).Encode(&info)
+	f.Add(buf.Bytes())
+	info.SDP = string(bytes.Repeat([]byte{'a'}, 2*limit))
+	buf.Reset()
+	gob.NewEncoder(&buf).Encode(&info)
+	f.Add(buf.Bytes())
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		var got SignalingInfo
+		err := DecodeLimited(r, limit, &got)
+		if read := len(data) - r.Len(); read > limit {
+			t.Fatalf("read %d bytes over the limit of %d", read, limit)
+		}
+		if err == nil && len(got.SDP) > limit {
+			t.Fatalf("decoded an SDP of %d bytes over the limit", len(got.SDP))
+		}
+	})
+}
+
+func TestDecodeLimited(t *testing.T) {
+	info := sampleSignalingInfo()
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	enc.Encode(&info)
+	size := buf.Len()
+	// the value following the decoded one is left to the next reader
+	enc.Encode(&info)
+	rest := buf.Len() - size
+	var got SignalingInfo
+	err := DecodeLimited(&buf, int64(size), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Source != info.Source {
+		t.Fatalf("got source %q, want %q", got.Source, info.Source)
+	}
+	if buf.Len() != rest {
+		t.Fatalf("%d bytes left, want %d", buf.Len(), rest)
+	}
+	buf.Reset()
+	gob.NewEncoder(&buf).Encode(&info)
+	err = DecodeLimited(&buf, int64(buf.Len()-1), &got)
+	if err != ErrTooLarge {
+		t.Fatalf("got %v for a value over the limit, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestLimitedDecoder(t *testing.T) {
+	info := sampleSignalingInfo()
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	for i := 0; i < 3; i++ {
+		enc.Encode(&info)
+	}
+	info.SDP = string(bytes.Repeat([]byte{'a'}, 8<<10))
+	enc.Encode(&info)
+	dec := NewLimitedDecoder(&buf, 4<<10)
+	for i := 0; i < 3; i++ {
+		var got SignalingInfo
+		err := dec.Decode(&got)
+		if err != nil {
+			t.Fatalf("value %d: %v", i, err)
+		}
+	}
+	var got SignalingInfo
+	err := dec.Decode(&got)
+	if err != ErrTooLarge {
+		t.Fatalf("got %v for a value over the limit, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestSignalingInfoValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(*SignalingInfo)
+		valid bool
+	}{
+		{"sample", func(*SignalingInfo) {}, true},
+		{"no source", func(info *SignalingInfo) { info.Source = "" }, false},
+		{"long source", func(info *SignalingInfo) { info.Source = strings.Repeat("a", MAX_ID_LENGTH+1) }, false},
+		{"long sdp", func(info *SignalingInfo) { info.SDP = strings.Repeat("a", MAX_SDP_LENGTH+1) }, false},
+		{"derp", func(info *SignalingInfo) {
+			info.DERPKey = bytes.Repeat([]byte{3}, 32)
+			info.DERPRelay = "https://derp.example.com/derp"
+		}, true},
+		{"long derp key", func(info *SignalingInfo) { info.DERPKey = make([]byte, MAX_KEY_LENGTH+1) }, false},
+		{"long derp relay", func(info *SignalingInfo) { info.DERPRelay = strings.Repeat("a", MAX_ID_LENGTH+1) }, false},
+		{"name", func(info *SignalingInfo) { info.Name = "Alice's laptop ü" }, true},
+		{"long name", func(info *SignalingInfo) { info.Name = strings.Repeat("a", MAX_ID_LENGTH+1) }, false},
+		{"name with escape", func(info *SignalingInfo) { info.Name = "laptop\x1b[2J" }, false},
+		{"name with newline", func(info *SignalingInfo) { info.Name = "laptop\nalice" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := sampleSignalingInfo()
+			tt.edit(&info)
+			err := info.Validate()
+			if tt.valid && err != nil {
+				t.Fatal(err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("invalid message validated")
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+// Package types - log.go names the fields of the logs of sessions, so the
+// lifecycle of a session can be filtered across the client, the daemons of
+// both peers and the services
+package types
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Fields of the logs of sessions
+const (
+	// LOG_FIELD_SESSION is the pool ID value of the session, the same for
+	// the dialing and the responding device
+	LOG_FIELD_SESSION = "session"
+
+	// LOG_FIELD_PAIR is the pair ID of the session on this device
+	LOG_FIELD_PAIR = "pair_id"
+
+	// LOG_FIELD_APP is the application name, as ssh or vnc
+	LOG_FIELD_APP = "app"
+
+	// LOG_FIELD_PEER is the ID of the remote device
+	LOG_FIELD_PEER = "peer"
+)
+
+// Session returns the correlation ID of the session of the pool
+func (pd *PoolId) Session() string {
+	return strconv.FormatInt(pd.Value, 10)
+}
+
+// SessionOf returns the correlation ID of a pair ID made by PoolId.String,
+// or the pair ID itself if it is not one
+func SessionOf(pairId string) string {
+	var code, direct int32
+	var value int64
+	_, err := fmt.Sscanf(pairId, "conn_%d_%d_%d", &code, &value, &direct)
+	if err != nil {
+		return pairId
+	}
+	return strconv.FormatInt(value, 10)
+}
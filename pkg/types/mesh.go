@@ -0,0 +1,16 @@
+package types
+
+import "time"
+
+// MeshRoute is a peer or a network a node of the mesh reaches
+type MeshRoute struct {
+	// Target is the ID of the peer, or the CIDR of the network
+	Target string
+	// Via is the neighbor the route was learned from, empty for the
+	// routes of the node
+	Via string
+	// Hops is the number of connections from the node to the target
+	Hops int32
+	// Updated is the time the route was learned
+	Updated time.Time
+}
@@ -0,0 +1,17 @@
+package types
+
+import "time"
+
+// PairResult is the answer of the daemon to a pairing request
+type PairResult struct {
+	// Code is the pairing code created, valid until Expires
+	Code    string
+	Expires time.Time
+	// Fingerprint is the identity key of the paired device
+	Fingerprint string
+	// TOTPURI enrolls the TOTP secret the paired device asks codes of in
+	// an authenticator app, if it enrolled one
+	TOTPURI string
+	// Error is set if the request failed
+	Error string
+}
@@ -0,0 +1,15 @@
+package types
+
+import "time"
+
+// ShellSession is a persistent shell session of a remote node
+type ShellSession struct {
+	Name    string
+	Command string
+	Started time.Time
+	// Attached is set while a client is attached to the session
+	Attached bool
+	// Exited is set once the command exited, the session is kept until a
+	// client gets the rest of its output
+	Exited bool
+}
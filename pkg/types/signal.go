@@ -32,4 +32,46 @@ type SignalingInfo struct {
 	// RemoteRequestType specifies the type of application/service being requested
 	// (APP_TYPE_SSH, APP_TYPE_VNC, etc.)
 	RemoteRequestType int32 `json:"remote_request_type"`
+	
+	// Hello carries the key exchange of the end-to-end encryption in offers
+	// and answers, and the identity key in pairing messages. Peers which
+	// don't encrypt leave it empty.
+	Hello []byte `json:"hello"`
+	
+	// Proof shows the sender of a pairing message knows the pairing code,
+	// a refused pairing has none
+	Proof []byte `json:"proof"`
+	
+	// OTP is the one-time code of the session in offers, for responders
+	// which ask the dialer for one
+	OTP string `json:"otp,omitempty"`
+	
+	// TOTPSecret is the TOTP secret enrolled during pairing, encrypted for
+	// the joining device
+	TOTPSecret []byte `json:"totp_secret,omitempty"`
+	
+	// NodeKey is the ed25519 key of the source, Signature covers the
+	// message with it
+	NodeKey   []byte `json:"node_key,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+	
+	// Cert is the certificate of NodeKey by the CA of the source, if any
+	Cert []byte `json:"cert,omitempty"`
+	
+	// Rotations are the last key rotations of the source, peers which
+	// pinned an older node key follow them to NodeKey
+	Rotations []byte `json:"rotations,omitempty"`
+	
+	// Endpoint is the public address of the direct service of the source,
+	// mapped on its router, in offers and answers
+	Endpoint string `json:"endpoint,omitempty"`
+	
+	// DERPKey is the DERP key of the source and DERPRelay the relay it
+	// receives on, in the handshakes of sessions over DERP relays
+	DERPKey   []byte `json:"derp_key,omitempty"`
+	DERPRelay string `json:"derp_relay,omitempty"`
+	
+	// Name is the name a device joining with a token asks to be known by,
+	// in pairing requests
+	Name string `json:"name,omitempty"`
 }
@@ -8,4 +8,26 @@ type Status struct {
 	ImplType     int32
 	PairId       string
 	ParentPairId string
+	// Inbound is set for the sessions peers opened
+	Inbound bool
+	// BytesIn and BytesOut are the bytes received from and sent to the
+	// peer so far
+	BytesIn  int64
+	BytesOut int64
+	// User is the local user who opened the session through a shared
+	// daemon
+	User string
+}
+
+// STUNServer is the last check of a STUN server by the daemon
+type STUNServer struct {
+	URL string
+	// Checked is the time of the last check, zero until the first one
+	Checked time.Time
+	Up      bool
+	// RTT is the time the server took to answer
+	RTT time.Duration
+	// Address is the address of this node the server saw
+	Address string
+	Error   string
 }
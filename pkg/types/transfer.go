@@ -0,0 +1,21 @@
+package types
+
+import "time"
+
+// Transfer states reported by the daemon for 'trans list'
+const (
+	TRANSFER_STATE_QUEUED = iota
+	TRANSFER_STATE_ACTIVE
+	TRANSFER_STATE_PAUSED
+)
+
+// TransferState describes a file transfer tracked by the local daemon
+type TransferState struct {
+	PairId    string
+	TargetId  string
+	FileName  string
+	Upload    bool
+	Bytes     int64
+	State     int32
+	StartTime time.Time
+}
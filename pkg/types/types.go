@@ -5,10 +5,31 @@ package types
 // Option types define the direction and purpose of connection operations
 // These are used to indicate whether a connection is being established, torn down, or queried
 const (
-	OPTION_TYPE_UP     = iota // Establish/bring up a connection
-	OPTION_TYPE_DOWN          // Tear down/close a connection
-	OPTION_TYPE_STAT          // Query connection status
-	OPTION_TYPE_ATTACH        // Attach to an existing connection
+	OPTION_TYPE_UP       = iota // Establish/bring up a connection
+	OPTION_TYPE_DOWN            // Tear down/close a connection
+	OPTION_TYPE_STAT            // Query connection status
+	OPTION_TYPE_ATTACH          // Attach to an existing connection
+	OPTION_TYPE_LIST            // List transfers managed by the daemon
+	OPTION_TYPE_PAUSE           // Pause an active transfer
+	OPTION_TYPE_RESUME          // Resume a paused transfer
+	OPTION_TYPE_LOG             // Apply the logging settings of the configure
+	OPTION_TYPE_PAIR            // Create a pairing code or pair with a device
+	OPTION_TYPE_KNOCK           // List, approve or deny inbound sessions waiting for approval
+	OPTION_TYPE_ACCESS          // List, add, remove or check access rules
+	OPTION_TYPE_IDENTITY        // Revoke a peer or rotate the keys of this device
+	OPTION_TYPE_HISTORY         // Query the history of the completed sessions
+	OPTION_TYPE_DISCOVER        // List the devices found on the local network
+)
+
+// Status codes of the responses of the daemon, in the Status of a sender.
+// Clients which only know STATUS_OK treat every other code as a failure.
+const (
+	STATUS_OK              = 0  // The request succeeded
+	STATUS_FAILED          = -1 // The request failed for another reason
+	STATUS_PEER_OFFLINE    = -2 // The peer can't be reached
+	STATUS_DENIED          = -3 // The peer or this device refused the session
+	STATUS_TIMEOUT         = -4 // The session wasn't set up in time
+	STATUS_UNSUPPORTED_APP = -5 // The application isn't known to the daemon
 )
 
 // Application types define the different services/applications supported by sshx
@@ -24,13 +45,40 @@ const (
 	APP_TYPE_MESSAGER                // Real-time messaging console
 	APP_TYPE_TRANSFER_SERVICE        // File transfer server
 	APP_TYPE_TRANSFER                // File transfer client
+	APP_TYPE_SYNC                    // Delta (rsync style) file synchronization
+	APP_TYPE_CLIPBOARD               // Clipboard synchronization
+	APP_TYPE_RDP                     // RDP remote desktop gateway
+	APP_TYPE_AUDIO                   // Remote desktop audio streaming
+	APP_TYPE_FLEET                   // Configure overlays of a managed fleet
+	APP_TYPE_PAIR                    // Pairing of trusted devices
+	APP_TYPE_KNOCK                   // Approval of inbound sessions
+	APP_TYPE_ACCESS                  // Access rules of inbound sessions
+	APP_TYPE_IDENTITY                // Revocation and key rotation
+	APP_TYPE_BENCH                   // Round trip time and throughput measurement
+	APP_TYPE_HISTORY                 // History of the completed sessions
+	APP_TYPE_DISCOVER                // Devices found on the local network
+	APP_TYPE_KUBE                    // Exec and port forwarding in a Kubernetes cluster
+	APP_TYPE_DOCKER                  // Exec and attach to containers of a Docker engine
+	APP_TYPE_SERIAL                  // Serial console forwarding
+	APP_TYPE_WOL                     // Wake-on-LAN relay
+	APP_TYPE_PRINT                   // Printing to printers of the remote network
+	APP_TYPE_FORWARD                 // TCP connections to the remote network
+	APP_TYPE_SHELL                   // Persistent shell sessions
+	APP_TYPE_EXEC                    // Commands run without a terminal
+	APP_TYPE_SCREENSHOT              // Screenshots of the desktop
+	APP_TYPE_NOTIFY                  // Desktop notifications
+	APP_TYPE_MESH                    // Sessions relayed by the mesh
 )
 
 // WebRTC signaling message types used in the peer-to-peer connection establishment
 // These correspond to different phases of the WebRTC handshake process
 const (
-	SIG_TYPE_UNKNOWN   = iota // Unknown or invalid signaling message
-	SIG_TYPE_CANDIDATE        // ICE candidate exchange for NAT traversal
-	SIG_TYPE_ANSWER           // SDP answer in response to an offer
-	SIG_TYPE_OFFER            // SDP offer to initiate connection
+	SIG_TYPE_UNKNOWN       = iota // Unknown or invalid signaling message
+	SIG_TYPE_CANDIDATE            // ICE candidate exchange for NAT traversal
+	SIG_TYPE_ANSWER               // SDP answer in response to an offer
+	SIG_TYPE_OFFER                // SDP offer to initiate connection
+	SIG_TYPE_PAIR_REQUEST         // Identity key and pairing code proof of a joining peer
+	SIG_TYPE_PAIR_RESPONSE        // Identity key and proof of the paired host
+	SIG_TYPE_KEY_ROTATION         // Announcement of new keys of the source
+	SIG_TYPE_CANCEL               // The source gave up the connection it offered
 )
@@ -0,0 +1,290 @@
+// Package types - wire.go is the binary encoding of the messages of the hot
+// paths: signaling messages and the requests to the daemon. It is simple
+// enough to be written in any language, where gob is Go only.
+//
+// A message is the byte WIRE_MAGIC, the byte WIRE_VERSION, the length of
+// the body as an unsigned varint, and the body. The body is a sequence of
+// fields in a fixed order: integers and booleans are signed varints, byte
+// strings and strings are an unsigned varint length followed by the bytes.
+// Decoders ignore the fields following the ones they know, so fields are
+// only ever appended.
+package types
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// WIRE_MAGIC starts the messages of the wire encoding. Gob streams start
+	// with a byte count below 0x80 or above 0xf7, so both encodings are told
+	// apart by their first byte.
+	WIRE_MAGIC = 0xa5
+
+	// WIRE_VERSION is the version of the layout of the messages
+	WIRE_VERSION = 1
+
+	// WIRE_CONTENT_TYPE is the HTTP content type of wire messages
+	WIRE_CONTENT_TYPE = "application/x-sshx-wire"
+)
+
+// buffers of the wire encoders are kept up to this size
+const maxPooledWire = 64 << 10
+
+var wireBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
+
+// WireWriter appends the fields of a message body to a buffer
+type WireWriter struct {
+	Buf []byte
+}
+
+func (ww *WireWriter) Int(v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	ww.Buf = append(ww.Buf, tmp[:binary.PutVarint(tmp[:], v)]...)
+}
+
+func (ww *WireWriter) length(l int) {
+	var tmp [binary.MaxVarintLen64]byte
+	ww.Buf = append(ww.Buf, tmp[:binary.PutUvarint(tmp[:], uint64(l))]...)
+}
+
+func (ww *WireWriter) Bool(v bool) {
+	if v {
+		ww.Int(1)
+	} else {
+		ww.Int(0)
+	}
+}
+
+func (ww *WireWriter) Bytes(v []byte) {
+	ww.length(len(v))
+	ww.Buf = append(ww.Buf, v...)
+}
+
+func (ww *WireWriter) String(v string) {
+	ww.length(len(v))
+	ww.Buf = append(ww.Buf, v...)
+}
+
+// WireReader reads the fields of a message body. The first error is kept
+// and returned by Err, fields read after it are zero. Byte strings share
+// the memory of the body.
+type WireReader struct {
+	buf []byte
+	err error
+}
+
+func NewWireReader(body []byte) *WireReader {
+	return &WireReader{buf: body}
+}
+
+// More reports whether the body has fields left, messages of older peers
+// lack the fields appended since
+func (wr *WireReader) More() bool {
+	return wr.err == nil && len(wr.buf) > 0
+}
+
+func (wr *WireReader) Err() error {
+	return wr.err
+}
+
+func (wr *WireReader) Int() int64 {
+	if wr.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(wr.buf)
+	if n <= 0 {
+		wr.err = fmt.Errorf("invalid wire integer")
+		return 0
+	}
+	wr.buf = wr.buf[n:]
+	return v
+}
+
+func (wr *WireReader) Bool() bool {
+	return wr.Int() != 0
+}
+
+// Bytes reads a byte string, nil if it is empty
+func (wr *WireReader) Bytes() []byte {
+	if wr.err != nil {
+		return nil
+	}
+	l, n := binary.Uvarint(wr.buf)
+	if n <= 0 || l > uint64(len(wr.buf)-n) {
+		wr.err = fmt.Errorf("invalid wire byte string")
+		return nil
+	}
+	wr.buf = wr.buf[n:]
+	if l == 0 {
+		return nil
+	}
+	v := wr.buf[:l:l]
+	wr.buf = wr.buf[l:]
+	return v
+}
+
+func (wr *WireReader) String() string {
+	return string(wr.Bytes())
+}
+
+// WriteWire writes a message, encode appends its body to the buffer it is
+// given. The buffer comes from a pool.
+func WriteWire(w io.Writer, encode func(buf []byte) []byte) error {
+	pooled := wireBuffers.Get().(*[]byte)
+	body := encode((*pooled)[:0])
+	head := WireWriter{Buf: make([]byte, 0, 2+binary.MaxVarintLen64+len(body))}
+	head.Buf = append(head.Buf, WIRE_MAGIC, WIRE_VERSION)
+	head.length(len(body))
+	_, err := w.Write(append(head.Buf, body...))
+	if cap(body) <= maxPooledWire {
+		*pooled = body[:0]
+		wireBuffers.Put(pooled)
+	}
+	return err
+}
+
+// SniffWire reads the first byte of a message from r and reports whether
+// it is in the wire encoding. The returned reader reads the message from
+// its first byte.
+func SniffWire(r io.Reader) (bool, io.Reader, error) {
+	var first [1]byte
+	_, err := io.ReadFull(r, first[:])
+	if err != nil {
+		return false, r, err
+	}
+	return first[0] == WIRE_MAGIC, io.MultiReader(&oneByte{b: first[0]}, r), nil
+}
+
+// oneByte reads a byte once
+type oneByte struct {
+	b    byte
+	read bool
+}
+
+func (ob *oneByte) Read(p []byte) (int, error) {
+	if ob.read {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	p[0] = ob.b
+	ob.read = true
+	return 1, nil
+}
+
+// ReadWire reads the body of a message of at most limit bytes from r,
+// nothing is read past the message
+func ReadWire(r io.Reader, limit int) ([]byte, error) {
+	var head [2]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return nil, err
+	}
+	if head[0] != WIRE_MAGIC {
+		return nil, fmt.Errorf("not a wire message")
+	}
+	if head[1] != WIRE_VERSION {
+		return nil, fmt.Errorf("unsupported wire version %d", head[1])
+	}
+	size, err := binary.ReadUvarint(byteReader{r})
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(limit) {
+		return nil, ErrTooLarge
+	}
+	body := make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// byteReader reads byte by byte, so nothing is buffered past a message
+type byteReader struct {
+	io.Reader
+}
+
+func (br byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(br.Reader, b[:])
+	return b[0], err
+}
+
+// MarshalWire appends the wire body of the message to buf
+func (info *SignalingInfo) MarshalWire(buf []byte) []byte {
+	ww := WireWriter{Buf: buf}
+	ww.Int(int64(info.Flag))
+	ww.String(info.Source)
+	ww.String(info.SDP)
+	ww.Bytes(info.Candidate)
+	ww.Int(info.Id.Value)
+	ww.Int(int64(info.Id.Direction))
+	ww.Int(int64(info.Id.ImplCode))
+	ww.String(info.Target)
+	ww.Int(int64(info.PeerType))
+	ww.Int(int64(info.RemoteRequestType))
+	ww.Bytes(info.Hello)
+	ww.Bytes(info.Proof)
+	ww.String(info.OTP)
+	ww.Bytes(info.TOTPSecret)
+	ww.Bytes(info.NodeKey)
+	ww.Bytes(info.Signature)
+	ww.Bytes(info.Cert)
+	ww.Bytes(info.Rotations)
+	ww.String(info.Endpoint)
+	ww.Bytes(info.DERPKey)
+	ww.String(info.DERPRelay)
+	ww.String(info.Name)
+	return ww.Buf
+}
+
+// UnmarshalWire reads the message from a wire body, its byte fields share
+// the memory of the body
+func (info *SignalingInfo) UnmarshalWire(body []byte) error {
+	wr := NewWireReader(body)
+	info.Flag = int(wr.Int())
+	info.Source = wr.String()
+	info.SDP = wr.String()
+	info.Candidate = wr.Bytes()
+	info.Id.Value = wr.Int()
+	info.Id.Direction = int32(wr.Int())
+	info.Id.ImplCode = int32(wr.Int())
+	info.Target = wr.String()
+	info.PeerType = int32(wr.Int())
+	info.RemoteRequestType = int32(wr.Int())
+	info.Hello = wr.Bytes()
+	info.Proof = wr.Bytes()
+	info.OTP = wr.String()
+	info.TOTPSecret = wr.Bytes()
+	info.NodeKey = wr.Bytes()
+	info.Signature = wr.Bytes()
+	info.Cert = wr.Bytes()
+	info.Rotations = wr.Bytes()
+	if wr.More() {
+		info.Endpoint = wr.String()
+	}
+	if wr.More() {
+		info.DERPKey = wr.Bytes()
+		info.DERPRelay = wr.String()
+	}
+	if wr.More() {
+		info.Name = wr.String()
+	}
+	return wr.Err()
+}
+
+// WriteSignalingInfo writes a signaling message in the wire encoding
+func WriteSignalingInfo(w io.Writer, info *SignalingInfo) error {
+	return WriteWire(w, info.MarshalWire)
+}
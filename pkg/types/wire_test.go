@@ -0,0 +1,108 @@
+package types
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func FuzzUnmarshalWire(f *testing.F) {
+	info := sampleSignalingInfo()
+	f.Add(info.MarshalWire(nil))
+	f.Add([]byte{})
+	f.Add([]byte{0x80})
+	f.Fuzz(func(t *testing.T, body []byte) {
+		var got SignalingInfo
+		if got.UnmarshalWire(body) != nil {
+			return
+		}
+		// a body read once encodes to one read the same
+		first := got.MarshalWire(nil)
+		var again SignalingInfo
+		err := again.UnmarshalWire(first)
+		if err != nil {
+			t.Fatalf("cannot read back %x: %v", first, err)
+		}
+		if second := again.MarshalWire(nil); !bytes.Equal(first, second) {
+			t.Fatalf("round trip of %x gave %x", first, second)
+		}
+	})
+}
+
+func TestSignalingInfoWire(t *testing.T) {
+	info := sampleSignalingInfo()
+	var buf bytes.Buffer
+	err := WriteSignalingInfo(&buf, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeSignalingInfo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Source != info.Source || got.SDP != info.SDP || got.Id != info.Id || !bytes.Equal(got.Hello, info.Hello) {
+		t.Fatalf("got %+v, want %+v", got, info)
+	}
+}
+
+// the gob benchmarks use a new coder per message as the daemon does, the
+// type goes along with every message
+func BenchmarkEncodeGob(b *testing.B) {
+	info := sampleSignalingInfo()
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		err := gob.NewEncoder(&buf).Encode(&info)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(buf.Len()))
+}
+
+func BenchmarkEncodeWire(b *testing.B) {
+	info := sampleSignalingInfo()
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		err := WriteSignalingInfo(&buf, &info)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(buf.Len()))
+}
+
+func BenchmarkDecodeGob(b *testing.B) {
+	info := sampleSignalingInfo()
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(&info)
+	msg := buf.Bytes()
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := DecodeSignalingInfo(bytes.NewReader(msg))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeWire(b *testing.B) {
+	info := sampleSignalingInfo()
+	var buf bytes.Buffer
+	WriteSignalingInfo(&buf, &info)
+	msg := buf.Bytes()
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := DecodeSignalingInfo(bytes.NewReader(msg))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+#!/bin/bash
+# Checks ssh, git, rsync and ansible through `sshx stdio` against a device:
+#
+#   scripts/stdio_test.sh [username@]PEER
+#
+# The daemon must run and the device must accept the public key of the
+# user without a password (see sshx cpyid). ansible is skipped if it isn't
+# installed.
+
+set -u
+
+if [ $# -lt 1 ];then
+  echo "usage: $0 [username@]PEER"
+  exit 2
+fi
+
+SSHX=${SSHX:-sshx}
+user=${1%@*}
+peer=${1#*@}
+if [ "$user" = "$1" ];then
+  user=$(id -un)
+fi
+host="${peer}.sshx"
+target="${user}@${host}"
+
+tmp=$(mktemp -d)
+remote=""
+failed=0
+
+cleanup() {
+  if [ -n "$remote" ];then
+    ssh -F "$tmp/config" "$target" "rm -rf '$remote'" >/dev/null 2>&1
+  fi
+  rm -rf "$tmp"
+}
+trap cleanup EXIT
+
+cat > "$tmp/config" <<EOF
+Host *.sshx
+    ProxyCommand $SSHX stdio %h
+    BatchMode yes
+    StrictHostKeyChecking accept-new
+    UserKnownHostsFile $tmp/known_hosts
+EOF
+export GIT_SSH_COMMAND="ssh -F $tmp/config"
+
+check() {
+  if [ "$2" = "0" ];then
+    echo "ok    $1"
+  else
+    echo "FAIL  $1"
+    failed=1
+  fi
+}
+
+# binary stream both ways
+head -c 4194304 /dev/urandom > "$tmp/blob"
+ssh -F "$tmp/config" "$target" cat < "$tmp/blob" > "$tmp/blob.out"
+cmp -s "$tmp/blob" "$tmp/blob.out"
+check "binary stream" $?
+
+# exit status of remote commands
+ssh -F "$tmp/config" "$target" "exit 42"
+[ $? -eq 42 ]
+check "exit status" $?
+
+# remote stderr reaches stderr only
+ssh -F "$tmp/config" "$target" "echo to-stderr >&2" > "$tmp/out" 2> "$tmp/err"
+[ ! -s "$tmp/out" ] && grep -q to-stderr "$tmp/err"
+check "stderr" $?
+
+# unknown devices fail like unreachable hosts
+ssh -F "$tmp/config" "${user}@sshx-stdio-test-unknown.sshx" true 2>/dev/null
+[ $? -eq 255 ]
+check "unreachable device" $?
+
+remote=$(ssh -F "$tmp/config" "$target" "mktemp -d")
+if [ -z "$remote" ];then
+  check "remote directory" 1
+  exit 1
+fi
+
+# git push and clone
+ssh -F "$tmp/config" "$target" "git init -q --bare '$remote/repo.git'"
+git init -q "$tmp/repo" &&
+  git -C "$tmp/repo" -c user.name=sshx -c user.email=sshx@localhost commit -q --allow-empty -m test &&
+  git -C "$tmp/repo" push -q "$target:$remote/repo.git" HEAD:refs/heads/master &&
+  git clone -q "$target:$remote/repo.git" "$tmp/clone" &&
+  [ "$(git -C "$tmp/repo" rev-parse HEAD)" = "$(git -C "$tmp/clone" rev-parse HEAD)" ]
+check "git" $?
+
+# rsync there and back
+mkdir -p "$tmp/data/dir"
+head -c 1048576 /dev/urandom > "$tmp/data/dir/file"
+echo text > "$tmp/data/text"
+rsync -a -e "ssh -F $tmp/config" "$tmp/data/" "$target:$remote/data/" &&
+  rsync -a -e "ssh -F $tmp/config" "$target:$remote/data/" "$tmp/back/" &&
+  diff -r "$tmp/data" "$tmp/back" > /dev/null
+check "rsync" $?
+
+# ansible's ssh connection plugin
+if command -v ansible > /dev/null;then
+  ansible all -i "$host," -u "$user" -e "ansible_ssh_common_args='-F $tmp/config'" -m ping > /dev/null
+  check "ansible ping" $?
+  ansible all -i "$host," -u "$user" -e "ansible_ssh_common_args='-F $tmp/config'" -m command -a false > /dev/null
+  [ $? -ne 0 ]
+  check "ansible command failure" $?
+else
+  echo "skip  ansible"
+fi
+
+exit $failed